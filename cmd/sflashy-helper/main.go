@@ -0,0 +1,72 @@
+//go:build linux
+
+// Command sflashy-helper opens a device for sflashy with root privileges.
+// It is started through pkexec, so that polkit authorizes the user, and
+// does nothing but check that the device is a safe flash target and hand
+// an open descriptor of it back to sflashy over its standard output, a
+// Unix socket. sflashy, with its network and decompression code, keeps
+// running as the user.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: sflashy-helper <device>")
+		os.Exit(2)
+	}
+	if err := run(os.Args[1]); err != nil {
+		fmt.Fprintln(os.Stderr, "sflashy-helper:", err)
+		os.Exit(1)
+	}
+}
+
+// run validates device, opens it exclusively and sends it to sflashy.
+func run(device string) error {
+	dev, err := flasher.ReadDeviceDetails(device)
+	if err != nil {
+		return err
+	}
+	if err := validate(dev); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dev.Path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", dev.Path, err)
+	}
+	defer f.Close()
+	return flasher.SendFile(os.Stdout, f)
+}
+
+// validate refuses the devices that are not flash targets: read-only,
+// mounted or in use by LVM, RAID or dm-crypt, and the fixed disks, so that
+// the authorization cannot be used to overwrite the system.
+func validate(dev *flasher.DeviceDetails) error {
+	switch {
+	case dev.ReadOnly:
+		return fmt.Errorf("%s is read-only", dev.Path)
+	case len(dev.Holders) > 0:
+		return fmt.Errorf("%s is in use by %s", dev.Path, strings.Join(dev.Holders, ", "))
+	case len(dev.Mountpoints) > 0:
+		return fmt.Errorf("%s is mounted on %s", dev.Path, strings.Join(dev.Mountpoints, ", "))
+	}
+	for _, p := range dev.Partitions {
+		if len(p.Holders) > 0 {
+			return fmt.Errorf("%s is in use by %s", p.Path, strings.Join(p.Holders, ", "))
+		}
+		if len(p.Mountpoints) > 0 {
+			return fmt.Errorf("%s is mounted on %s", p.Path, strings.Join(p.Mountpoints, ", "))
+		}
+	}
+	// I lettori SD integrati spesso non dichiarano il supporto rimovibile.
+	if !dev.Removable && dev.USB == nil && !strings.HasPrefix(dev.Name, "mmcblk") {
+		return fmt.Errorf("%s is not a removable or USB device", dev.Path)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestValidate verifica quali dispositivi l'helper accetta di aprire.
+func TestValidate(t *testing.T) {
+	usb := &flasher.USBDetails{Port: "2-1"}
+	tests := []struct {
+		name string
+		dev  flasher.DeviceDetails
+		ok   bool
+	}{
+		{"chiavetta USB", flasher.DeviceDetails{Path: "/dev/sdb", Name: "sdb", USB: usb}, true},
+		{"scheda SD", flasher.DeviceDetails{Path: "/dev/mmcblk0", Name: "mmcblk0"}, true},
+		{"rimovibile", flasher.DeviceDetails{Path: "/dev/sdc", Name: "sdc", Removable: true}, true},
+		{"disco fisso", flasher.DeviceDetails{Path: "/dev/sda", Name: "sda"}, false},
+		{"sola lettura", flasher.DeviceDetails{Path: "/dev/sdb", Name: "sdb", USB: usb, ReadOnly: true}, false},
+		{"montato", flasher.DeviceDetails{Path: "/dev/sdb", Name: "sdb", USB: usb,
+			Partitions: []flasher.PartitionDetails{{Path: "/dev/sdb1", Mountpoints: []string{"/media/boot"}}}}, false},
+		{"in uso da LVM", flasher.DeviceDetails{Path: "/dev/sdb", Name: "sdb", USB: usb,
+			Partitions: []flasher.PartitionDetails{{Path: "/dev/sdb1", Holders: []string{"dm-0"}}}}, false},
+	}
+	for _, tt := range tests {
+		if err := validate(&tt.dev); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, accettato atteso %t", tt.name, err, tt.ok)
+		}
+	}
+}
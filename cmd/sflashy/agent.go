@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// agent is `sflashy agent`: it reports the devices of this station to a
+// controller and runs the jobs the controller queues for it.
+type agent struct {
+	// controller is the URL of the controller, name the one of the agent.
+	controller, name, token string
+	client                  *http.Client
+	// local runs the jobs, with the images downloaded from the controller.
+	local *server
+
+	mu   sync.Mutex
+	jobs map[string]*agentJob
+	// fetch serializes the downloads: the jobs of an image share it.
+	fetch sync.Mutex
+}
+
+// agentJob is a job of the controller on the agent.
+type agentJob struct {
+	order remoteJob
+	// local is the ID of the job in the JobManager, once the image is
+	// downloaded; until then state is "downloading", or the state in
+	// which the job ended, with err.
+	local  string
+	state  string
+	err    error
+	cancel context.CancelFunc
+}
+
+// view returns the jobView of j, as the controller knows it; a.mu is held.
+func (a *agent) view(j *agentJob) jobView {
+	if j.local == "" {
+		v := jobView{ID: j.order.ID, Image: j.order.Image, Device: j.order.Device, State: j.state, Queued: j.order.Queued}
+		if j.err != nil {
+			v.Error = j.err.Error()
+		}
+		return v
+	}
+	st, _ := a.local.jobs.Job(j.local)
+	v := a.local.view(st)
+	v.ID, v.Image, v.Device = j.order.ID, j.order.Image, j.order.Device
+	return v
+}
+
+// report sends the devices and the jobs of a to the controller, and
+// carries out its orders.
+func (a *agent) report(ctx context.Context) error {
+	devices, err := a.local.devices()
+	if err != nil {
+		logger.Warn("could not list the devices", "err", err)
+	}
+	rep := agentReport{Devices: filterDevices(devices, a.local.filter), Jobs: []jobView{}}
+	var done []string
+	a.mu.Lock()
+	for id, j := range a.jobs {
+		v := a.view(j)
+		rep.Jobs = append(rep.Jobs, v)
+		if flasher.JobState(v.State).Done() {
+			done = append(done, id)
+		}
+	}
+	a.mu.Unlock()
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	var orders agentOrders
+	if err := a.call(ctx, http.MethodPost, "/api/agents/"+url.PathEscape(a.name), bytes.NewReader(body), &orders); err != nil {
+		return err
+	}
+	// Il controller ha ricevuto l'esito dei job finiti: si dimenticano.
+	a.mu.Lock()
+	for _, id := range done {
+		delete(a.jobs, id)
+	}
+	a.mu.Unlock()
+	if len(done) > 0 {
+		a.local.jobs.Prune()
+	}
+	for _, order := range orders.Jobs {
+		a.start(order)
+	}
+	for _, id := range orders.Cancel {
+		a.cancel(id)
+	}
+	return nil
+}
+
+// call sends a request to the controller and decodes its JSON reply into
+// v, if any.
+func (a *agent) call(ctx context.Context, method, path string, body *bytes.Reader, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(a.controller, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("controller %s: %s %s", a.controller, resp.Status, e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// start downloads the image of order, if the agent does not have it yet,
+// and submits the job.
+func (a *agent) start(order remoteJob) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.jobs[order.ID]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(a.local.ctx)
+	j := &agentJob{order: order, state: "downloading", cancel: cancel}
+	a.jobs[order.ID] = j
+	logger.Info("job received", "job", order.ID, "image", order.Image, "device", order.Device, "verify", order.Verify)
+	go func() {
+		defer cancel()
+		id, err := a.submit(ctx, order)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		switch {
+		case ctx.Err() != nil && err != nil:
+			j.state = string(flasher.JobCancelled)
+		case err != nil:
+			j.state, j.err = string(flasher.JobFailed), err
+			logger.Warn("job failed", "job", order.ID, "device", order.Device, "err", err)
+		default:
+			j.local = id
+		}
+	}()
+}
+
+// submit downloads the image of order and submits its flash to the
+// JobManager of the agent.
+func (a *agent) submit(ctx context.Context, order remoteJob) (string, error) {
+	image, err := a.image(ctx, order.Image, order.ImageSize, order.ImageSHA256)
+	if err != nil {
+		return "", err
+	}
+	dev, _, err := a.local.jobDevice(order.Device)
+	if err != nil {
+		return "", err
+	}
+	return a.local.start(image, order.Device, order.Verify, dev)
+}
+
+// image returns the path of the image name of the controller, downloading
+// it unless the images directory has it already, with the same size and
+// SHA-256 digest.
+func (a *agent) image(ctx context.Context, name string, size int64, digest string) (string, error) {
+	name, err := imageName(name)
+	if err != nil {
+		return "", err
+	}
+	if digest, err = checkDigest(digest); err != nil {
+		return "", fmt.Errorf("image %s: %w", name, err)
+	}
+	a.fetch.Lock()
+	defer a.fetch.Unlock()
+	path := filepath.Join(a.local.images, name)
+	if info, err := os.Stat(path); err == nil && info.Size() == size {
+		if got, err := hashFile(path); err == nil && got == digest {
+			return path, nil
+		}
+		// Un'immagine con lo stesso nome ma diversa: si riscarica.
+		logger.Info("the image differs from the one of the controller, downloading it again", "image", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(a.controller, "/")+"/api/images/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download %s from the controller: %s", name, resp.Status)
+	}
+	h := sha256.New()
+	img, err := a.local.saveImage(name, io.TeeReader(resp.Body, h))
+	if err != nil {
+		return "", err
+	}
+	if img.SizeBytes != size {
+		os.Remove(path)
+		return "", fmt.Errorf("image %s: downloaded %d bytes, expected %d", name, img.SizeBytes, size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		os.Remove(path)
+		return "", fmt.Errorf("image %s: downloaded image has SHA-256 %s, expected %s", name, got, digest)
+	}
+	return path, nil
+}
+
+// cancel cancels the job id of the controller.
+func (a *agent) cancel(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	j := a.jobs[id]
+	if j == nil {
+		return
+	}
+	if j.local == "" {
+		j.cancel()
+		return
+	}
+	if err := a.local.jobs.Cancel(j.local); err != nil && !errors.Is(err, flasher.ErrJobNotFound) {
+		logger.Warn("could not cancel the job", "job", id, "err", err)
+	}
+}
+
+// runAgent implements the `agent` subcommand: the station reports to the
+// controller and flashes what it is told to, until an interrupt.
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	controllerURL := fs.String("controller", "", "URL of the controller, e.g. http://controller:8090")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", hostname, "name of the agent on the controller")
+	token := fs.String("token", os.Getenv("SFLASHY_TOKEN"), "token of the controller, $SFLASHY_TOKEN by default")
+	interval := fs.Duration("interval", 2*time.Second, "how often the agent reports to the controller")
+	images := fs.String("images", "", "directory of the images downloaded from the controller (default ~/.cache/sflashy/agent)")
+	maxJobs := fs.Int("max-jobs", 4, "number of devices flashed at once")
+	perController := fs.Int("max-per-controller", 0, "number of devices on the same USB controller flashed at once (0 for no limit)")
+	metricsAddr := addMetricsFlag(fs)
+	logCfg := addLogFlags(fs)
+	var filter deviceFilter
+	minSize, maxSize := addFilterFlags(fs, &filter)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("agent takes no arguments")
+	}
+	if u, err := url.Parse(*controllerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return usageError("--controller must be the http or https URL of the controller")
+	}
+	if *name == "" {
+		return usageError("--name is required")
+	}
+	if *interval <= 0 {
+		return usageError("--interval must be positive")
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	filter.MinSize, filter.MaxSize = minSize.bytes, maxSize.bytes
+	// Come serve, solo i supporti rimovibili se non richiesto altrimenti.
+	removableSet := false
+	fs.Visit(func(f *flag.Flag) { removableSet = removableSet || f.Name == "removable" })
+	if !removableSet {
+		filter.Removable = true
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+	stopMQTT, err := startMQTT()
+	if err != nil {
+		return err
+	}
+	defer stopMQTT()
+	if *images == "" {
+		if *images, err = defaultImagesDir("agent"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*images, 0o700); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	a := &agent{
+		controller: *controllerURL,
+		name:       *name,
+		token:      *token,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		local:      newServer(ctx, *images, *maxJobs, *perController, filter),
+		jobs:       map[string]*agentJob{},
+	}
+	stopMetrics, err := a.local.metrics(*metricsAddr)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+	logger.Info("agent started (press Ctrl+C to stop)", "agent", *name, "controller", *controllerURL)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	reachable := true
+	for {
+		// Un controller irraggiungibile non ferma l'agente: si riprova,
+		// avvisando una volta sola.
+		if err := a.report(ctx); err != nil && ctx.Err() == nil {
+			if reachable {
+				logger.Warn("could not report to the controller, retrying", "controller", *controllerURL, "err", err)
+			}
+			reachable = false
+		} else if err == nil && !reachable {
+			logger.Info("controller reachable again", "controller", *controllerURL)
+			reachable = true
+		}
+		select {
+		case <-ctx.Done():
+			a.local.wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
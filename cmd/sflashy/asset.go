@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// assetRecord is what is exported of a unit flashed successfully, to pair
+// it with its asset label.
+type assetRecord struct {
+	Time    string `json:"time"`
+	Serial  string `json:"serial"`
+	Model   string `json:"model"`
+	Device  string `json:"device"`
+	Image   string `json:"image"`
+	Version string `json:"version"`
+	Hash    string `json:"hash"`
+	Digest  string `json:"digest"`
+}
+
+// assetColumns are the columns of the CSV asset log.
+var assetColumns = []string{"time", "serial", "model", "device", "image", "version", "hash", "digest"}
+
+// assetExport appends an assetRecord to the asset log, and prints a label
+// of it, after each successful flash.
+type assetExport struct {
+	// Log is a CSV file, if its extension is .csv, or else one of JSON
+	// lines; none if empty.
+	Log string
+	// Label renders the label of the unit, on LabelOutput or stdout.
+	Label       *template.Template
+	LabelOutput string
+	// Version is the version of the image (imageVersion if empty).
+	Version string
+}
+
+// assetFlags are the asset-tracking flags.
+type assetFlags struct {
+	log, label, labelOutput, version string
+}
+
+// addAssetFlags registers the asset-tracking flags on fs.
+func addAssetFlags(fs *flag.FlagSet) *assetFlags {
+	f := &assetFlags{}
+	fs.StringVar(&f.log, "asset-log", "", "append each unit flashed successfully to this file: CSV if it ends in .csv, JSON lines otherwise")
+	fs.StringVar(&f.label, "label", "", `print a label for each unit flashed successfully, a Go template of .Serial, .Version, .Digest, .Time..., e.g. "{{.Serial}} {{.Version}}"`)
+	fs.StringVar(&f.labelOutput, "label-output", "", "write the labels to this file, e.g. a label printer, instead of stdout")
+	fs.StringVar(&f.version, "image-version", "", "version of the image in the asset log and labels (default: the image name without extensions)")
+	return f
+}
+
+// apply sets the asset export of opts.
+func (f assetFlags) apply(opts *flashOptions) error {
+	if f.log == "" && f.label == "" {
+		if f.labelOutput != "" || f.version != "" {
+			return usageError("--label-output and --image-version need --asset-log or --label")
+		}
+		return nil
+	}
+	a := &assetExport{Log: f.log, LabelOutput: f.labelOutput, Version: f.version}
+	if f.label != "" {
+		t, err := template.New("label").Option("missingkey=error").Parse(f.label)
+		if err != nil {
+			return usageError("invalid --label: %v", err)
+		}
+		a.Label = t
+	}
+	opts.Asset = a
+	return nil
+}
+
+// imageVersion returns the name of image without its extensions, e.g.
+// raspios-2024-11-19 for raspios-2024-11-19.img.xz.
+func imageVersion(image string) string {
+	name := filepath.Base(image)
+	for {
+		ext := strings.ToLower(filepath.Ext(name))
+		if !slices.Contains([]string{".img", ".iso", ".raw", ".bin", ".xz", ".gz", ".zst", ".bz2", ".lz4", ".zip"}, ext) {
+			return name
+		}
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+}
+
+// done exports the flash of s to dev, if a is set and the flash succeeded,
+// with err. An export that fails is only a warning: the flash is done by
+// then.
+func (a *assetExport) done(s flashSummary, dev *deviceInfo, err error) {
+	if a == nil || err != nil {
+		return
+	}
+	if err := a.record(s, dev); err != nil {
+		logger.Warn("could not export the unit", "device", s.Device, "err", err)
+	}
+}
+
+// record exports the flash of s to dev, which may be nil.
+func (a *assetExport) record(s flashSummary, dev *deviceInfo) error {
+	r := assetRecord{
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Device:  s.Device,
+		Image:   s.Image,
+		Version: firstNonEmpty(a.Version, imageVersion(s.Image)),
+		Hash:    s.hash(),
+		Digest:  hex.EncodeToString(s.Digest),
+	}
+	if dev != nil {
+		r.Serial, r.Model = dev.Serial, strings.TrimSpace(dev.Vendor+" "+dev.Model)
+	}
+	if a.Log != "" {
+		if err := a.append(r); err != nil {
+			return fmt.Errorf("asset log %s: %w", a.Log, err)
+		}
+	}
+	if a.Label != nil {
+		if err := a.print(r); err != nil {
+			return fmt.Errorf("label: %w", err)
+		}
+	}
+	return nil
+}
+
+// append adds r to the asset log, with the CSV header if the file is new.
+func (a *assetExport) append(r assetRecord) error {
+	f, err := os.OpenFile(a.Log, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(a.Log), ".csv") {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w := csv.NewWriter(f)
+		if info.Size() == 0 {
+			w.Write(assetColumns)
+		}
+		w.Write([]string{r.Time, r.Serial, r.Model, r.Device, r.Image, r.Version, r.Hash, r.Digest})
+		w.Flush()
+		return w.Error()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// print writes the label of r, followed by a newline.
+func (a *assetExport) print(r assetRecord) error {
+	var w io.Writer = os.Stdout
+	if a.LabelOutput != "" {
+		f, err := os.OpenFile(a.LabelOutput, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	var label strings.Builder
+	if err := a.Label.Execute(&label, r); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, label.String())
+	return err
+}
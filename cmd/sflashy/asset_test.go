@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestImageVersion verifica la versione ricavata dal nome dell'immagine.
+func TestImageVersion(t *testing.T) {
+	for image, want := range map[string]string{
+		"/srv/raspios-2024-11-19.img.xz": "raspios-2024-11-19",
+		"kiosk-1.4.2.iso":                "kiosk-1.4.2",
+		"firmware-v3":                    "firmware-v3",
+		"os.tar":                         "os.tar",
+	} {
+		if got := imageVersion(image); got != want {
+			t.Errorf("imageVersion(%q). Got: %q, want %q", image, got, want)
+		}
+	}
+}
+
+// TestAssetExport verifica il registro CSV e JSON e l'etichetta.
+func TestAssetExport(t *testing.T) {
+	dir := t.TempDir()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := addAssetFlags(fs)
+	fs.Parse([]string{"--asset-log", filepath.Join(dir, "units.csv"), "--label", "{{.Serial}} {{.Version}} {{printf \"%.8s\" .Digest}}", "--label-output", filepath.Join(dir, "label")})
+	var opts flashOptions
+	if err := f.apply(&opts); err != nil {
+		t.Fatal(err)
+	}
+	s := flashSummary{Image: "/srv/kiosk-1.4.2.img.xz", Device: "/dev/sdb", Digest: []byte{0xde, 0xad, 0xbe, 0xef, 0x01}}
+	dev := &deviceInfo{Serial: "SN-1", Vendor: "SanDisk", Model: "Ultra"}
+	opts.Asset.done(s, dev, errors.New("verifica fallita"))
+	opts.Asset.done(s, dev, nil)
+	opts.Asset.done(s, nil, nil)
+
+	file, _ := os.Open(filepath.Join(dir, "units.csv"))
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Attese l'intestazione e 2 righe. Got: %v, %v", rows, err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(assetColumns, ",") {
+		t.Errorf("Intestazione errata. Got: %v", rows[0])
+	}
+	if r := rows[1]; r[1] != "SN-1" || r[2] != "SanDisk Ultra" || r[5] != "kiosk-1.4.2" || r[6] != "sha256" || r[7] != "deadbeef01" {
+		t.Errorf("Riga errata. Got: %v", r)
+	}
+	if label, _ := os.ReadFile(filepath.Join(dir, "label")); string(label) != "SN-1 kiosk-1.4.2 deadbeef\n kiosk-1.4.2 deadbeef\n" {
+		t.Errorf("Etichette errate. Got: %q", label)
+	}
+
+	a := &assetExport{Log: filepath.Join(dir, "units.jsonl"), Version: "2.0"}
+	a.done(s, dev, nil)
+	data, _ := os.ReadFile(a.Log)
+	var r assetRecord
+	if err := json.Unmarshal(data, &r); err != nil || r.Serial != "SN-1" || r.Version != "2.0" || r.Time == "" {
+		t.Errorf("Riga JSON errata. Got: %s, %v", data, err)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	f = addAssetFlags(fs)
+	fs.Parse([]string{"--image-version", "1.0"})
+	if err := f.apply(&opts); !errors.Is(err, errUsage) {
+		t.Errorf("--image-version senza esportazione accettato. Got: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditConfig is the audit section of the configuration.
+type auditConfig struct {
+	// Log is the file of the audit log; none if empty.
+	Log string `yaml:"log"`
+	// Key is an Ed25519 private key, in PEM, that signs each entry; the
+	// entries are only chained if empty.
+	Key string `yaml:"key"`
+}
+
+// auditEntry is a destructive operation in the audit log. Each entry
+// has the Chain of the previous one in Prev, and its own Chain is the
+// SHA-256 of its JSON without Chain and Signature: changing, removing or
+// reordering an entry breaks the chain from there on.
+type auditEntry struct {
+	Seq       int64  `json:"seq"`
+	Time      string `json:"time"`
+	Operation string `json:"operation"`
+	Device    string `json:"device"`
+	Serial    string `json:"serial"`
+	Model     string `json:"model"`
+	Image     string `json:"image"`
+	Hash      string `json:"hash"`
+	Digest    string `json:"digest"`
+	Bytes     int64  `json:"bytes"`
+	Operator  string `json:"operator"`
+	Host      string `json:"host"`
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+	Prev      string `json:"prev"`
+	Chain     string `json:"chain,omitempty"`
+	// Signature is the Ed25519 signature of the Chain sum, in base64.
+	Signature string `json:"signature,omitempty"`
+}
+
+// sum returns the SHA-256 of e without its Chain and Signature.
+func (e auditEntry) sum() []byte {
+	e.Chain, e.Signature = "", ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// auditLog appends an auditEntry for each destructive operation to an
+// append-only file, which `sflashy audit verify` checks.
+type auditLog struct {
+	path string
+	key  ed25519.PrivateKey
+	// operator and host are who runs sflashy, and where.
+	operator, host string
+	// mu serializes the entries of the jobs of serve; lockFile those of
+	// other sflashy processes.
+	mu sync.Mutex
+}
+
+// flashAudit is the audit log of the configuration, nil if there is none.
+var flashAudit *auditLog
+
+// newAuditLog returns the audit log of cfg, with its signing key.
+func newAuditLog(cfg auditConfig) (*auditLog, error) {
+	host, _ := os.Hostname()
+	a := &auditLog{path: cfg.Log, operator: ledgerOperator(), host: host}
+	if cfg.Key != "" {
+		key, err := readAuditKey(cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("audit key %s: not an Ed25519 private key", cfg.Key)
+		}
+		a.key = priv
+	}
+	return a, nil
+}
+
+// readAuditKey parses the PEM key at path: a PKCS #8 private key, as
+// `openssl genpkey -algorithm ed25519` writes it, or a PKIX public key.
+func readAuditKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("audit key %s: no PEM block", path)
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("audit key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// operation returns the name of the flash of opts in the audit log.
+func (opts flashOptions) operation() string {
+	if opts.Clone {
+		return "clone"
+	}
+	return "flash"
+}
+
+// record appends the operation op, of s on dev, to the audit log, if
+// any: dev may be nil, and err is the outcome. An operation cancelled at
+// the confirmation wrote nothing, and is not recorded; an audit log that
+// cannot be written is an error in the log of sflashy, the operation is
+// done by then.
+func (a *auditLog) record(op string, s flashSummary, dev *deviceInfo, err error) {
+	if a == nil || errors.Is(err, errCancelled) {
+		return
+	}
+	e := auditEntry{Operation: op, Device: s.Device, Image: s.Image, Bytes: s.Bytes, Status: "ok"}
+	if dev != nil {
+		e.Serial, e.Model = dev.Serial, strings.TrimSpace(dev.Vendor+" "+dev.Model)
+	}
+	if len(s.Digest) > 0 {
+		e.Hash, e.Digest = s.hash(), hex.EncodeToString(s.Digest)
+	}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	if err := a.append(e); err != nil {
+		logger.Error("could not write the audit log", "audit_log", a.path, "device", s.Device, "err", err)
+	}
+}
+
+// append chains e to the last entry of the log, signs it and writes it.
+func (a *auditLog) append(e auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	unlock, err := lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	last, err := lastAuditEntry(f)
+	if err != nil {
+		return err
+	}
+	e.Seq, e.Prev = last.Seq+1, last.Chain
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	e.Operator, e.Host = a.operator, a.host
+	sum := e.sum()
+	e.Chain = hex.EncodeToString(sum)
+	if a.key != nil {
+		e.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(a.key, sum))
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lastAuditEntry returns the last entry of the log f, or the zero entry
+// if f is empty. Only the end of f is read.
+func lastAuditEntry(f *os.File) (auditEntry, error) {
+	var e auditEntry
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return e, err
+	}
+	const tail = 64 << 10
+	off := max(info.Size()-tail, 0)
+	buf := make([]byte, info.Size()-off)
+	if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+		return e, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 && off > 0 {
+		return e, errors.New("the last entry is too long")
+	}
+	if err := json.Unmarshal(buf[i+1:], &e); err != nil {
+		return e, fmt.Errorf("the last entry is not valid: %w", err)
+	}
+	return e, nil
+}
+
+// verifyAudit checks the chain of the log r and, if pub is not nil, the
+// signature of each entry. It returns the number of entries and the last
+// one; the first entry that does not check is an error.
+func verifyAudit(r io.Reader, pub ed25519.PublicKey) (int64, auditEntry, error) {
+	var last auditEntry
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	n := int64(0)
+	for sc.Scan() {
+		n++
+		var e auditEntry
+		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return n - 1, last, fmt.Errorf("line %d: %w", n, err)
+		}
+		sum := e.sum()
+		switch {
+		case e.Seq != last.Seq+1:
+			return n - 1, last, fmt.Errorf("line %d: entry %d follows entry %d", n, e.Seq, last.Seq)
+		case e.Prev != last.Chain:
+			return n - 1, last, fmt.Errorf("line %d: the chain is broken, the previous entry was changed or removed", n)
+		case e.Chain != hex.EncodeToString(sum):
+			return n - 1, last, fmt.Errorf("line %d: the entry was changed", n)
+		}
+		if pub != nil {
+			sig, err := base64.StdEncoding.DecodeString(e.Signature)
+			if err != nil || !ed25519.Verify(pub, sum, sig) {
+				return n - 1, last, fmt.Errorf("line %d: invalid signature", n)
+			}
+		}
+		last = e
+	}
+	return n, last, sc.Err()
+}
+
+// runAudit implements the `audit` subcommand.
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return usageError("audit requires verify")
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	keyPath := fs.String("key", "", "Ed25519 public (or private) key in PEM that signed the entries")
+	positional, err := parseInterspersed(fs, args[1:])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	var path string
+	switch {
+	case len(positional) == 1:
+		path = positional[0]
+	case len(positional) > 1:
+		return usageError("audit verify takes at most one audit log")
+	case flashAudit != nil:
+		path = flashAudit.path
+	default:
+		return usageError("no audit log: give its path or set audit.log in the configuration file")
+	}
+	var pub ed25519.PublicKey
+	if *keyPath != "" {
+		key, err := readAuditKey(*keyPath)
+		if err != nil {
+			return err
+		}
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			pub = key
+		case ed25519.PrivateKey:
+			pub = key.Public().(ed25519.PublicKey)
+		default:
+			return fmt.Errorf("audit key %s: not an Ed25519 key", *keyPath)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, last, err := verifyAudit(f, pub)
+	if err != nil {
+		return fmt.Errorf("audit log %s: %w (%d entries checked)", path, err, n)
+	}
+	signed := "not checked"
+	if pub != nil {
+		signed = "valid"
+	}
+	fmt.Printf("%s: %d entries, chain intact, signatures %s\n", path, n, signed)
+	if n > 0 {
+		// Conservare l'ultimo anello altrove rivela anche un log troncato.
+		fmt.Printf("Last entry: %d, %s, chain %s\n", last.Seq, last.Time, last.Chain)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile locks f exclusively, waiting for the other sflashy processes
+// that hold it, and returns the function that unlocks it.
+func lockFile(f *os.File) (func(), error) {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	return func() { syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAuditLog verifica la catena e le firme del log di audit, e che
+// ogni modifica del log venga scoperta.
+func TestAuditLog(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyPath := filepath.Join(t.TempDir(), "audit.key")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditLog(auditConfig{Log: path, Key: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.operator = "operatore"
+	dev := &deviceInfo{Serial: "SN-1", Vendor: "SanDisk", Model: "Ultra"}
+	a.record("flash", flashSummary{Image: "/srv/os.img", Device: "/dev/sdb", Bytes: 1024, Digest: []byte{0xab}}, dev, nil)
+	a.record("flash", flashSummary{Image: "/srv/os.img", Device: "/dev/sdc"}, nil, errCancelled)
+	a.record("wipe", flashSummary{Image: "(zero wipe)", Device: "/dev/sdc"}, nil, errors.New("write failed"))
+	a.record("clone", flashSummary{Image: "/dev/sdb", Device: "/dev/sdd"}, nil, nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, last, err := verifyAudit(bytes.NewReader(data), pub)
+	if err != nil || n != 3 || last.Seq != 3 || last.Operation != "clone" {
+		t.Fatalf("Log valido rifiutato. Got: %d, %+v, %v", n, last, err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if !strings.Contains(lines[0], `"serial":"SN-1"`) || !strings.Contains(lines[0], `"operator":"operatore"`) || !strings.Contains(lines[1], `"error":"write failed"`) {
+		t.Errorf("Voci errate. Got: %s", data)
+	}
+
+	// Una voce cambiata e ricalcolata rompe la catena con la successiva.
+	var first auditEntry
+	json.Unmarshal([]byte(lines[0]), &first)
+	first.Image = "/srv/altro.img"
+	first.Chain = hex.EncodeToString(first.sum())
+	rehashed, _ := json.Marshal(first)
+	tampered := map[string]string{
+		"line 2: the entry was changed":   strings.Replace(string(data), "write failed", "ok", 1),
+		"line 2: the chain is broken":     string(rehashed) + "\n" + lines[1] + lines[2],
+		"line 1: entry 2 follows entry 0": lines[1] + lines[2],
+		"line 2: entry 3 follows entry 1": lines[0] + lines[2],
+	}
+	for want, log := range tampered {
+		if _, _, err := verifyAudit(strings.NewReader(log), nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Modifica non scoperta: %s. Got: %v", want, err)
+		}
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, _, err := verifyAudit(bytes.NewReader(data), other); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("Firma di un'altra chiave accettata. Got: %v", err)
+	}
+}
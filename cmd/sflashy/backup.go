@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// backupOptions collects the settings of `sflashy backup`.
+type backupOptions struct {
+	Device string
+	// Image is the file the device is read into, compressed as its
+	// extension asks, or "-" for stdout.
+	Image string
+	// Force overwrites an existing Image.
+	Force bool
+	// Hash names the hash of the digest (flasher.DefaultHash if empty).
+	Hash string
+	// BlockSize is the size of each read (copyBlockSize() if 0).
+	BlockSize int
+	// Skip is the device offset where reading starts; Count limits the
+	// bytes read (0 for the whole device).
+	Skip, Count int64
+	// Timeout aborts the backup when it takes longer than this.
+	Timeout time.Duration
+	// SkipFree reads only the blocks the filesystems of the device use; the
+	// free ones are zeros in the image, which is written sparse when it is
+	// not compressed.
+	SkipFree bool
+	// Trim ends the image at the last data of the last partition.
+	Trim bool
+	// Split writes the image in parts of this many bytes, Image.001,
+	// Image.002, ... (0 for a single file).
+	Split int64
+	// Manifest is the path of the JSON manifest of the backup, empty for
+	// Image.manifest.json; an image written to stdout only gets one when
+	// it is set.
+	Manifest string
+	// JSON, if set, receives the result of the run as a JSON object.
+	JSON io.Writer
+}
+
+// fat32MaxFile is the size of the largest file FAT32 holds.
+const fat32MaxFile = 1<<32 - 1
+
+// runBackup runs `sflashy backup <device> <image>`.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	force := fs.Bool("force", false, "overwrite the image if it exists")
+	hashName := fs.String("hash", "", "hash of the digest: "+strings.Join(flasher.HashNames(), ", ")+" (default "+flasher.DefaultHash+")")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort the backup if it takes longer than this, e.g. 20m")
+	var bs, skip, count, split sizeFlag
+	fs.Var(&bs, "bs", "size of each read from the device (default 32M)")
+	fs.Var(&skip, "skip", "device offset where reading starts, e.g. 8192s or 4M")
+	fs.Var(&count, "count", "read only the first bytes of the device, e.g. 1G")
+	skipFree := fs.Bool("skip-free", false, "read only the blocks in use by ext, FAT and NTFS filesystems")
+	fs.Var(&split, "split", "write the image in parts of this size, <image>.001, .002, ..., e.g. 4G for FAT32")
+	manifest := fs.String("manifest", "", "path of the JSON manifest of the backup (default <image>.manifest.json)")
+	trim := fs.Bool("trim", false, "end the image at the last data of the last partition, leaving out the trailing zeros")
+	addLowMemoryFlag(fs)
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 2 {
+		return usageError("backup requires a device and an image file")
+	}
+	if *hashName != "" {
+		if _, err := flasher.LookupHash(*hashName); err != nil {
+			return fmt.Errorf("%w: %w", errUsage, err)
+		}
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+
+	selector, err := parseTargetSelector(positional[0])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	device, err := findTarget(selector)
+	if err != nil {
+		return err
+	}
+	opts := backupOptions{
+		Device: device, Image: positional[1], Force: *force, Hash: *hashName,
+		BlockSize: int(bs.bytes), Skip: int64(skip.bytes), Count: int64(count.bytes), Timeout: *timeout, SkipFree: *skipFree, Trim: *trim, Split: int64(split.bytes),
+		Manifest: *manifest,
+	}
+	// FAT32 arriva a 4 GiB meno un byte: --split 4G deve starci.
+	if opts.Split == 4<<30 {
+		opts.Split = fat32MaxFile
+	}
+	if opts.Split > 0 && opts.Image == flasher.StdinImage {
+		return usageError("--split cannot be used when the image is written to stdout")
+	}
+	if *jsonOut {
+		if opts.Image == flasher.StdinImage {
+			return usageError("--json cannot be used when the image is written to stdout")
+		}
+		opts.JSON = os.Stdout
+	}
+	return backupDevice(context.Background(), opts, os.Stderr)
+}
+
+// backupDevice reads opts.Device into opts.Image and writes the digest of
+// the uncompressed data next to it, in the format of sha256sum, and the
+// manifest of the backup. A failed backup does not leave a partial image
+// behind.
+func backupDevice(ctx context.Context, opts backupOptions, termOut io.Writer) (err error) {
+	summary := flashSummary{Image: opts.Image, Device: opts.Device, Hash: opts.Hash, Verification: "skipped"}
+	if opts.JSON != nil {
+		defer func() { summary.writeJSON(opts.JSON, err) }()
+	}
+	log := logger.With("image", opts.Image, "device", opts.Device)
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return err
+	}
+	if mounts := mountedPartitions(opts.Device); len(mounts) > 0 {
+		log.Warn("the device is mounted, the backup may catch its filesystems in an inconsistent state", "mountpoints", mounts)
+	}
+
+	newHash, err := flasher.LookupHash(summary.hash())
+	if err != nil {
+		return err
+	}
+	manifestPath := opts.Manifest
+	if manifestPath == "" && opts.Image != flasher.StdinImage {
+		manifestPath = opts.Image + ".manifest.json"
+	}
+	manifest := &backupManifest{
+		Image: filepath.Base(opts.Image), Created: time.Now().UTC(), Sflashy: currentBuildInfo().Version,
+		Device: newManifestDevice(opts.Device, lookupDeviceInfo(opts.Device)), Offset: opts.Skip,
+		Hash: summary.hash(), ChunkSize: manifestChunkSize,
+	}
+
+	var file *os.File
+	var split *flasher.SplitWriter
+	var parts *chunkHasher
+	var out io.Writer = os.Stdout
+	switch {
+	case opts.Split > 0:
+		if _, err := os.Stat(flasher.SplitPartName(opts.Image, 1)); err == nil && !opts.Force {
+			return usageError("%s already exists, use --force to overwrite it", flasher.SplitPartName(opts.Image, 1))
+		}
+		split = flasher.NewSplitWriter(opts.Image, opts.Split, opts.Force)
+		defer func() {
+			if err != nil {
+				split.Remove()
+			}
+		}()
+		parts = &chunkHasher{size: opts.Split, newHash: newHash}
+		out = io.MultiWriter(split, parts)
+	case opts.Image != flasher.StdinImage:
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if opts.Force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		file, err = os.OpenFile(opts.Image, flags, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			return usageError("%s already exists, use --force to overwrite it", opts.Image)
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			file.Close()
+			if err != nil {
+				os.Remove(opts.Image)
+			}
+		}()
+		out = file
+	}
+	var sparse *sparseWriter
+	var compressor io.WriteCloser
+	if format := flasher.CompressionOf(opts.Image); format != "" {
+		if compressor, err = flasher.NewCompressor(format, out); err != nil {
+			return err
+		}
+		log.Info("compressing image", "format", format)
+		out = compressor
+		manifest.Format = format
+	} else if file != nil && opts.SkipFree {
+		sparse = &sparseWriter{file: file}
+		out = sparse
+	}
+
+	chunks := &chunkHasher{size: manifestChunkSize, newHash: newHash}
+	out = io.MultiWriter(out, chunks)
+
+	f := newFlasher(flashOptions{Image: opts.Image, Device: opts.Device, Hash: opts.Hash, BlockSize: opts.BlockSize, Skip: opts.Skip, Count: opts.Count, Timeout: opts.Timeout}, termOut)
+	f.SkipFree, f.Trim = opts.SkipFree, opts.Trim
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer cancelOnInterrupt(cancel)()
+	res, err := f.Backup(ctx, deviceLocation(opts.Device), out)
+	if err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return fmt.Errorf("could not compress %s: %w", opts.Image, err)
+		}
+	}
+	if sparse != nil {
+		if err := sparse.Close(); err != nil {
+			return fmt.Errorf("could not write %s: %w", opts.Image, err)
+		}
+	}
+	if file != nil {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("could not write %s: %w", opts.Image, err)
+		}
+	}
+	if split != nil {
+		if err := split.Close(); err != nil {
+			return err
+		}
+		log.Info("image split", "parts", len(split.Parts()), "part_size", opts.Split)
+		fmt.Fprintf(termOut, "Image written in %d parts, flash it back from %s.\n", len(split.Parts()), split.Parts()[0])
+	}
+	if file != nil || split != nil {
+		if err := writeDigestFile(opts.Image, summary.hash(), res.Digest); err != nil {
+			return err
+		}
+	}
+	if manifestPath != "" {
+		chunks.finish()
+		manifest.Bytes, manifest.Digest, manifest.Chunks = res.Bytes, hex.EncodeToString(res.Digest), chunks.digests
+		if split != nil {
+			parts.finish()
+			for i, name := range split.Parts() {
+				// Un'immagine vuota ha una sola parte, vuota.
+				part := manifestPart{Name: filepath.Base(name), Digest: hex.EncodeToString(newHash().Sum(nil))}
+				if i < len(parts.digests) {
+					part.Bytes, part.Digest = parts.lengths[i], parts.digests[i]
+				}
+				manifest.Parts = append(manifest.Parts, part)
+			}
+		}
+		if err := manifest.write(manifestPath); err != nil {
+			return err
+		}
+	}
+	summary.Bytes, summary.Digest, summary.Elapsed = res.Bytes, res.Digest, res.Elapsed
+	summary.write(termOut)
+	log.Info("backup finished", "bytes", res.Bytes, "elapsed", res.Elapsed)
+	return nil
+}
+
+// writeDigestFile writes digest to image.<hash> in the format of
+// sha256sum. For a compressed image it is the digest of the uncompressed
+// data, which --sha256 checks when the image is flashed back.
+func writeDigestFile(image, hashName string, digest []byte) error {
+	line := hex.EncodeToString(digest) + "  " + filepath.Base(image) + "\n"
+	if err := os.WriteFile(image+"."+hashName, []byte(line), 0o644); err != nil {
+		return fmt.Errorf("could not write the digest of %s: %w", image, err)
+	}
+	return nil
+}
+
+// sparseWriter writes to file skipping the blocks that are all zeros,
+// which become holes on the filesystems that support them.
+type sparseWriter struct {
+	file *os.File
+	off  int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		block := p[n:min(len(p), n+sparseBlock)]
+		if !isZero(block) {
+			if _, err := w.file.WriteAt(block, w.off); err != nil {
+				return n, err
+			}
+		}
+		n += len(block)
+		w.off += int64(len(block))
+	}
+	return len(p), nil
+}
+
+// Close sets the size of the file, in case it ends with a hole.
+func (w *sparseWriter) Close() error {
+	return w.file.Truncate(w.off)
+}
+
+// sparseBlock is the granularity of the holes of sparseWriter.
+const sparseBlock = 64 * 1024
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
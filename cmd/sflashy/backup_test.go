@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteDigestFile verifica il file con il digest di un backup.
+func TestWriteDigestFile(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "golden.img.zst")
+	if err := writeDigestFile(image, "sha256", []byte{0xab, 0xcd}); err != nil {
+		t.Fatalf("writeDigestFile ha restituito un errore: %v", err)
+	}
+	data, err := os.ReadFile(image + ".sha256")
+	if want := "abcd  golden.img.zst\n"; err != nil || string(data) != want {
+		t.Errorf("File del digest errato. Got: %q, Want: %q", data, want)
+	}
+}
+
+// TestSparseWriter verifica che i blocchi di zeri non cambino il contenuto
+// del file, anche quando si trovano alla fine.
+func TestSparseWriter(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "backup.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	want := make([]byte, 3*sparseBlock+100)
+	copy(want[sparseBlock:], "dati")
+	w := &sparseWriter{file: file}
+	for _, chunk := range [][]byte{want[:1000], want[1000 : 2*sparseBlock], want[2*sparseBlock:]} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("Write ha restituito un errore: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close ha restituito un errore: %v", err)
+	}
+	got, err := os.ReadFile(file.Name())
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Contenuto errato: %d byte, Want: %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// bootFiles are the files of --copy, keyed by their path on the boot
+// partition.
+type bootFiles map[string]string
+
+// addBootFilesFlag registers --copy on fs.
+func addBootFilesFlag(fs *flag.FlagSet) bootFiles {
+	files := bootFiles{}
+	fs.Func("copy", "copy a file to the boot partition, <file>:/<path> (repeatable)", files.add)
+	return files
+}
+
+// add records the file of <file>:/<path>, a path ending with / keeping
+// its name.
+func (b bootFiles) add(s string) error {
+	// Il file può avere i due punti, p.es. C:\ su Windows: il percorso di
+	// destinazione è assoluto.
+	i := strings.LastIndex(s, ":/")
+	if i <= 0 {
+		return fmt.Errorf("expected <file>:/<path on the boot partition>, not %q", s)
+	}
+	src, dst := s[:i], path.Clean(s[i+1:])
+	if strings.HasSuffix(s, "/") {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+	if dst == "/" {
+		return fmt.Errorf("%q has no file name on the boot partition", s)
+	}
+	b[dst] = src
+	return nil
+}
+
+// steps returns the customization step that copies the files to the boot
+// partition, the first FAT32 one, if any. The files are read now, so that
+// a missing one is reported before the flash.
+func (b bootFiles) steps() ([]flasher.Step, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	files := make(map[string][]byte, len(b))
+	for dst, src := range b {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the file to copy: %w", err)
+		}
+		files[dst] = data
+	}
+	step := flasher.StepFunc(fmt.Sprintf("copy %d files to the boot partition", len(files)), func(ctx context.Context, d *flasher.Disk) error {
+		p, _, err := d.BootPartition()
+		if err != nil {
+			return err
+		}
+		return flasher.WriteFiles{Partition: p.Number, Files: files}.Apply(ctx, d)
+	})
+	return []flasher.Step{step}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBootFilesFlag verifica la lettura di --copy e dei file da copiare.
+func TestBootFilesFlag(t *testing.T) {
+	dir := t.TempDir()
+	overlay := filepath.Join(dir, "mio:overlay.dtbo")
+	os.WriteFile(overlay, []byte("dtbo"), 0o644)
+
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	files := addBootFilesFlag(fs)
+	if err := fs.Parse([]string{"--copy", overlay + ":/overlays/", "--copy", overlay + ":/LICENSE.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if files["/overlays/mio:overlay.dtbo"] != overlay || files["/LICENSE.txt"] != overlay || len(files) != 2 {
+		t.Errorf("Destinazioni errate. Got: %v", files)
+	}
+	if steps, err := files.steps(); err != nil || len(steps) != 1 {
+		t.Errorf("Un passo per tutti i file. Got: %v, %v", steps, err)
+	}
+	if steps, err := (bootFiles{}).steps(); err != nil || steps != nil {
+		t.Errorf("Senza --copy non ci sono passi. Got: %v, %v", steps, err)
+	}
+	if _, err := (bootFiles{"/x": filepath.Join(dir, "manca")}).steps(); err == nil {
+		t.Error("Un file mancante va segnalato prima del flash")
+	}
+
+	for _, bad := range []string{"overlay.dtbo", "overlay.dtbo:overlays/x", ":/x", "overlay.dtbo:/."} {
+		fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		addBootFilesFlag(fs)
+		if err := fs.Parse([]string{"--copy", bad}); err == nil {
+			t.Errorf("--copy %s dovrebbe essere rifiutato", bad)
+		}
+	}
+}
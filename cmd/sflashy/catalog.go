@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+)
+
+// defaultCatalog is the OS list of Raspberry Pi Imager.
+const defaultCatalog = "https://downloads.raspberrypi.com/os_list_imagingutility_v4.json"
+
+// catalogPrefix marks an image argument as the name of an OS of the
+// catalog, e.g. "rpi:Raspberry Pi OS Lite (64-bit)".
+const catalogPrefix = "rpi:"
+
+// catalogLocation is the catalog used: the catalog key of the
+// configuration, or defaultCatalog.
+var catalogLocation = defaultCatalog
+
+// rpiOS is an entry of the os_list of a Raspberry Pi Imager catalog: an
+// OS, or a category with the OSes of subitems or of the catalog at
+// subitems_url.
+type rpiOS struct {
+	Name                string   `json:"name"`
+	Description         string   `json:"description"`
+	URL                 string   `json:"url"`
+	ExtractSize         int64    `json:"extract_size"`
+	ExtractSHA256       string   `json:"extract_sha256"`
+	ImageDownloadSize   int64    `json:"image_download_size"`
+	ImageDownloadSHA256 string   `json:"image_download_sha256"`
+	ReleaseDate         string   `json:"release_date"`
+	Devices             []string `json:"devices"`
+	Subitems            []rpiOS  `json:"subitems"`
+	SubitemsURL         string   `json:"subitems_url"`
+}
+
+// catalogEntry is an OS of the catalog that can be downloaded.
+type catalogEntry struct {
+	// Name is the name of the OS preceded by its categories, separated
+	// by " / ".
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	URL         string `json:"url"`
+	// SHA256 is the digest of the download, ExtractSHA256 that of the
+	// image once decompressed, which is the one written.
+	SHA256        string   `json:"sha256,omitempty"`
+	ExtractSHA256 string   `json:"extract_sha256,omitempty"`
+	DownloadSize  int64    `json:"download_size,omitempty"`
+	ExtractSize   int64    `json:"extract_size,omitempty"`
+	Released      string   `json:"release_date,omitempty"`
+	Devices       []string `json:"devices,omitempty"`
+}
+
+// maxCatalogDepth bounds the subitems_url followed, which could point
+// back to the catalog.
+const maxCatalogDepth = 4
+
+// loadCatalog reads the catalog at location, an http(s) URL or a file,
+// and returns its OSes. The entries that are not downloads, like the
+// erase and custom image items of Imager, are left out.
+func loadCatalog(ctx context.Context, location string) ([]catalogEntry, error) {
+	return loadCatalogItems(ctx, location, nil, 0)
+}
+
+// loadCatalogItems returns the OSes of the catalog at location, in the
+// categories of path.
+func loadCatalogItems(ctx context.Context, location string, path []string, depth int) ([]catalogEntry, error) {
+	if depth > maxCatalogDepth {
+		return nil, fmt.Errorf("catalog %s: too many nested subitems_url", location)
+	}
+	data, err := readCatalog(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		OSList []rpiOS `json:"os_list"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("catalog %s: %w", location, err)
+	}
+	return flattenCatalog(ctx, list.OSList, path, depth)
+}
+
+// flattenCatalog returns the OSes of items and of their subitems.
+func flattenCatalog(ctx context.Context, items []rpiOS, path []string, depth int) ([]catalogEntry, error) {
+	var entries []catalogEntry
+	for _, item := range items {
+		name := append(path[:len(path):len(path)], strings.TrimSpace(item.Name))
+		switch {
+		case len(item.Subitems) > 0:
+			sub, err := flattenCatalog(ctx, item.Subitems, name, depth)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, sub...)
+		case item.SubitemsURL != "":
+			sub, err := loadCatalogItems(ctx, item.SubitemsURL, name, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, sub...)
+		case strings.HasPrefix(item.URL, "http://") || strings.HasPrefix(item.URL, "https://"):
+			entries = append(entries, catalogEntry{
+				Name: strings.Join(name, " / "), Description: item.Description, URL: item.URL,
+				SHA256: strings.ToLower(item.ImageDownloadSHA256), ExtractSHA256: strings.ToLower(item.ExtractSHA256),
+				DownloadSize: item.ImageDownloadSize, ExtractSize: item.ExtractSize,
+				Released: item.ReleaseDate, Devices: item.Devices,
+			})
+		}
+	}
+	return entries, nil
+}
+
+// readCatalog returns the content of the catalog at location.
+func readCatalog(ctx context.Context, location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return os.ReadFile(location)
+	}
+	return fetchURL(ctx, location)
+}
+
+// maxFetched bounds what fetchURL reads: catalogs, checksum files and
+// directory listings, not images.
+const maxFetched = 32 << 20
+
+// fetchURL returns the content at the http(s) URL u.
+func fetchURL(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxFetched))
+}
+
+// findCatalogEntry returns the OS of entries named name: its full name or
+// its own name, ignoring case, or else the only one whose name contains
+// name.
+func findCatalogEntry(entries []catalogEntry, name string) (catalogEntry, error) {
+	name = strings.TrimSpace(name)
+	var exact, partial []catalogEntry
+	for _, e := range entries {
+		own := e.Name
+		if i := strings.LastIndex(own, " / "); i >= 0 {
+			own = own[i+len(" / "):]
+		}
+		switch {
+		case strings.EqualFold(e.Name, name) || strings.EqualFold(own, name):
+			exact = append(exact, e)
+		case strings.Contains(strings.ToLower(e.Name), strings.ToLower(name)):
+			partial = append(partial, e)
+		}
+	}
+	matches := exact
+	if len(matches) == 0 {
+		matches = partial
+	}
+	switch len(matches) {
+	case 0:
+		return catalogEntry{}, fmt.Errorf("no OS named %q in the catalog, see `sflashy catalog`", name)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, e := range matches {
+		names[i] = e.Name
+	}
+	return catalogEntry{}, fmt.Errorf("%q matches several OSes of the catalog: %s", name, strings.Join(names, "; "))
+}
+
+// fetchCatalogImage downloads the OS named name of the catalog at
+// location to cache, checking the SHA-256 of the download, and returns
+// the path of the image and its entry.
+func fetchCatalogImage(ctx context.Context, cache *imageCache, location, name string) (string, catalogEntry, error) {
+	entries, err := loadCatalog(ctx, location)
+	if err != nil {
+		return "", catalogEntry{}, err
+	}
+	e, err := findCatalogEntry(entries, name)
+	if err != nil {
+		return "", catalogEntry{}, err
+	}
+	digest := e.SHA256
+	if digest != "" {
+		if digest, err = checkDigest(digest); err != nil {
+			return "", e, fmt.Errorf("catalog entry %s: %w", e.Name, err)
+		}
+	}
+	logger.Info("OS found in the catalog", "os", e.Name, "url", e.URL, "released", e.Released)
+	path, err := cache.fetch(ctx, e.URL, digest)
+	return path, e, err
+}
+
+// writeCatalog writes entries as a table or as JSON.
+func writeCatalog(w io.Writer, entries []catalogEntry, format string) error {
+	switch format {
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tRELEASED\tDOWNLOAD")
+		for _, e := range entries {
+			size := "-"
+			if e.DownloadSize > 0 {
+				size = formatSize(uint64(e.DownloadSize))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Name, e.Released, size)
+		}
+		return tw.Flush()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	default:
+		return usageError("unknown format %q (expected table or json)", format)
+	}
+}
+
+// runCatalog implements the `catalog` subcommand: the OSes of the
+// catalog whose name contains the words given, if any.
+func runCatalog(args []string) error {
+	fs := flag.NewFlagSet("catalog", flag.ContinueOnError)
+	location := fs.String("url", catalogLocation, "URL or file of a Raspberry Pi Imager os_list catalog")
+	format := fs.String("format", "table", "output format: table or json")
+	listDistros := fs.Bool("distros", false, "list the distros whose images can be flashed by name instead")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if *listDistros {
+		return writeDistros(os.Stdout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	entries, err := loadCatalog(ctx, *location)
+	if err != nil {
+		return err
+	}
+	if search := strings.ToLower(strings.Join(positional, " ")); search != "" {
+		var found []catalogEntry
+		for _, e := range entries {
+			if strings.Contains(strings.ToLower(e.Name+" "+e.Description), search) {
+				found = append(found, e)
+			}
+		}
+		entries = found
+	}
+	if entries == nil {
+		entries = []catalogEntry{}
+	}
+	return writeCatalog(os.Stdout, entries, *format)
+}
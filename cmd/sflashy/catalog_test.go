@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// catalogServer serve un catalogo di prova, con una categoria, un
+// catalogo annidato e l'immagine image.
+func catalogServer(t *testing.T, image []byte, digest string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/os_list.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"imager": {}, "os_list": [
+			{"name": "Raspberry Pi OS Lite (64-bit)", "url": "%[1]s/lite.img.xz", "image_download_sha256": "%[2]s", "extract_sha256": "ab", "release_date": "2026-05-01", "image_download_size": 500000000},
+			{"name": "Raspberry Pi OS (other)", "subitems": [
+				{"name": "Raspberry Pi OS Lite (32-bit)", "url": "%[1]s/lite32.img.xz"},
+				{"name": "Raspberry Pi OS Full (64-bit)", "url": "%[1]s/full.img.xz"}
+			]},
+			{"name": "Media player OS", "subitems_url": "%[1]s/media.json"},
+			{"name": "Erase", "url": "internal://format"}
+		]}`, srv.URL, digest)
+	})
+	mux.HandleFunc("/media.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"os_list": [{"name": "LibreELEC", "description": "Kodi", "url": "%s/libreelec.img.gz"}]}`, srv.URL)
+	})
+	mux.HandleFunc("/lite.img.xz", func(w http.ResponseWriter, r *http.Request) { w.Write(image) })
+	return srv
+}
+
+// TestCatalog verifica la lettura del catalogo, con le sottovoci, e la
+// scelta di un OS per nome.
+func TestCatalog(t *testing.T) {
+	srv := catalogServer(t, nil, "")
+	entries, err := loadCatalog(context.Background(), srv.URL+"/os_list.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	want := "Raspberry Pi OS Lite (64-bit)|Raspberry Pi OS (other) / Raspberry Pi OS Lite (32-bit)|Raspberry Pi OS (other) / Raspberry Pi OS Full (64-bit)|Media player OS / LibreELEC"
+	if strings.Join(names, "|") != want {
+		t.Errorf("Voci del catalogo errate. Got: %q", names)
+	}
+
+	for name, want := range map[string]string{
+		"raspberry pi os lite (64-bit)":                           "Raspberry Pi OS Lite (64-bit)",
+		"Raspberry Pi OS (other) / Raspberry Pi OS Full (64-bit)": "Raspberry Pi OS (other) / Raspberry Pi OS Full (64-bit)",
+		"LibreELEC": "Media player OS / LibreELEC",
+		"Full":      "Raspberry Pi OS (other) / Raspberry Pi OS Full (64-bit)",
+	} {
+		if e, err := findCatalogEntry(entries, name); err != nil || e.Name != want {
+			t.Errorf("%q: got %q, %v", name, e.Name, err)
+		}
+	}
+	for name, want := range map[string]string{"Lite": "matches several", "Ubuntu": "no OS named"} {
+		if _, err := findCatalogEntry(entries, name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: errore atteso %q. Got: %v", name, want, err)
+		}
+	}
+
+	var out strings.Builder
+	if err := writeCatalog(&out, entries[:1], "table"); err != nil || !strings.Contains(out.String(), "Raspberry Pi OS Lite (64-bit)  2026-05-01") {
+		t.Errorf("Tabella errata. Got: %q, %v", out.String(), err)
+	}
+}
+
+// TestFetchCatalogImage verifica lo scaricamento di un OS del catalogo e
+// il controllo del suo SHA-256.
+func TestFetchCatalogImage(t *testing.T) {
+	image := []byte("immagine di Raspberry Pi OS")
+	sum := sha256.Sum256(image)
+	srv := catalogServer(t, image, strings.ToUpper(hex.EncodeToString(sum[:])))
+	cache := newImageCache(cacheConfig{Dir: t.TempDir()})
+	path, e, err := fetchCatalogImage(context.Background(), cache, srv.URL+"/os_list.json", "Raspberry Pi OS Lite (64-bit)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(image) || e.ExtractSHA256 != "ab" {
+		t.Errorf("Immagine errata. Got: %q, %+v", data, e)
+	}
+
+	bad := catalogServer(t, image, strings.Repeat("0", 64))
+	if _, _, err := fetchCatalogImage(context.Background(), newImageCache(cacheConfig{Dir: t.TempDir()}), bad.URL+"/os_list.json", "Raspberry Pi OS Lite (64-bit)"); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("Un'immagine con un altro SHA-256 va rifiutata. Got: %v", err)
+	}
+}
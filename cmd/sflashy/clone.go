@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// runClone runs `sflashy clone <source> <target>...`, which copies a whole
+// device to one or more others, with the checks of a flash on each. The
+// source is read once however many targets there are.
+func runClone(args []string) error {
+	fs := flag.NewFlagSet("clone", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	eject := fs.Bool("eject", false, "power off / eject the target after cloning")
+	verify := fs.Bool("verify", false, "read the target back and compare it with the source")
+	hashName := fs.String("hash", "", "hash of the digest and of --verify: "+strings.Join(flasher.HashNames(), ", ")+" (default "+flasher.DefaultHash+")")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort the clone if it takes longer than this, e.g. 20m")
+	expand := fs.Bool("expand", false, "grow the last partition of each target to the end of the device")
+	partition := addPartitionFlags(fs)
+	var bs sizeFlag
+	fs.Var(&bs, "bs", "size of each write to the target (default 32M)")
+	retry := addRetryFlags(fs)
+	addHookFlags(fs)
+	addLowMemoryFlag(fs)
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) < 2 {
+		return usageError("clone requires a source and at least one target device")
+	}
+	opts := flashOptions{Clone: true, Yes: *yes, Eject: *eject, Verify: *verify, Expand: *expand, Steps: partition.steps(), Timeout: *timeout, BlockSize: int(bs.bytes), PauseKey: flasher.IsTerminal(os.Stdin)}
+	if opts.Hash, opts.Checksum, err = checksumOptions(*hashName, "", ""); err != nil {
+		return err
+	}
+	if opts.Retry, err = retry.policy(); err != nil {
+		return err
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+
+	// Sorgente e destinazione si indicano come per flash: percorso o
+	// serial:, model:, label:.
+	devices := make([]string, len(positional))
+	for i, arg := range positional {
+		selector, err := parseTargetSelector(arg)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUsage, err)
+		}
+		if devices[i], err = findTarget(selector); err != nil {
+			return err
+		}
+	}
+	opts.Image, opts.Device = devices[0], devices[1]
+	if *jsonOut {
+		opts.JSON = os.Stdout
+	}
+	if len(devices) > 2 {
+		return runFlashMany(context.Background(), opts, devices[1:], os.Stdin, os.Stderr)
+	}
+	return runFlash(context.Background(), opts, os.Stdin, os.Stderr)
+}
+
+// checkCloneSource verifies that source is a block device that can be
+// cloned to target: not target itself, or one of its partitions, and not
+// mounted, since its filesystems would change while they are copied.
+func checkCloneSource(source, target string) error {
+	if err := checkBlockDevice(source); err != nil {
+		return err
+	}
+	if sameDisk(source, target) {
+		return usageError("%s and %s are the same device", source, target)
+	}
+	if mounts := mountedPartitions(source); len(mounts) > 0 {
+		return fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, source, strings.Join(mounts, ", "))
+	}
+	return nil
+}
+
+// sameDisk reports whether a and b, once their links are resolved, are the
+// same device or a device and one of its partitions.
+func sameDisk(a, b string) bool {
+	if r, err := filepath.EvalSymlinks(a); err == nil {
+		a = r
+	}
+	if r, err := filepath.EvalSymlinks(b); err == nil {
+		b = r
+	}
+	return isSameOrPartition(a, b) || isSameOrPartition(b, a)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSameDisk verifica il riconoscimento di un dispositivo e delle sue
+// partizioni, anche attraverso i link.
+func TestSameDisk(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/dev/sdb", "/dev/sdb", true},
+		{"/dev/sdb", "/dev/sdb1", true},
+		{"/dev/mmcblk0p2", "/dev/mmcblk0", true},
+		{"/dev/sdb", "/dev/sdc", false},
+		{"/dev/sda", "/dev/sdaa", false},
+	}
+	for _, tt := range tests {
+		if got := sameDisk(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameDisk(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+
+	dir := t.TempDir()
+	disk := filepath.Join(dir, "sdb")
+	if err := os.WriteFile(disk, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "usb-SanDisk")
+	if err := os.Symlink(disk, link); err != nil {
+		t.Fatal(err)
+	}
+	if !sameDisk(link, disk) {
+		t.Error("Un link al dispositivo dovrebbe essere lo stesso dispositivo")
+	}
+}
+
+// TestCheckTargets verifica che un clone non scriva due volte sullo stesso
+// dispositivo.
+func TestCheckTargets(t *testing.T) {
+	if err := checkTargets([]string{"/dev/sdb", "/dev/sdc", "/dev/sdd"}); err != nil {
+		t.Errorf("Dispositivi diversi dovrebbero essere accettati. Got: %v", err)
+	}
+	for _, devices := range [][]string{
+		{"/dev/sdb", "/dev/sdc", "/dev/sdb"},
+		{"/dev/sdc", "/dev/sdc1"},
+	} {
+		if err := checkTargets(devices); !errors.Is(err, errUsage) {
+			t.Errorf("checkTargets(%v) dovrebbe fallire con errUsage. Got: %v", devices, err)
+		}
+	}
+}
+
+// TestCheckManyOptions verifica le opzioni che valgono per un solo
+// dispositivo.
+func TestCheckManyOptions(t *testing.T) {
+	if err := checkManyOptions(flashOptions{Verify: true, Expand: true}, false); err != nil {
+		t.Errorf("Opzioni valide rifiutate: %v", err)
+	}
+	for _, tt := range []struct {
+		opts flashOptions
+		ab   bool
+	}{{flashOptions{Resume: true}, false}, {flashOptions{}, true}, {flashOptions{Probe: true}, false}} {
+		if err := checkManyOptions(tt.opts, tt.ab); !errors.Is(err, errUsage) {
+			t.Errorf("%+v, --ab %v dovrebbe essere un errore d'uso. Got: %v", tt.opts, tt.ab, err)
+		}
+	}
+}
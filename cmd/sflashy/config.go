@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the optional user configuration, read from
+// $SFLASHY_CONFIG or <user config dir>/sflashy/config.yaml.
+type config struct {
+	// Theme is the name of the color palette (default, high-contrast, colorblind, none).
+	Theme string `yaml:"theme"`
+	// Colors overrides the color of single roles (error, warning, success, progress).
+	Colors map[string]string `yaml:"colors"`
+	// LowMemory enables the low-memory mode, as --low-memory does.
+	LowMemory bool `yaml:"low_memory"`
+	// Hooks are shell commands run before and after writing.
+	Hooks hookCommands `yaml:"hooks"`
+	// Plugins are plugin executables loaded in addition to those in
+	// pluginDir().
+	Plugins []string `yaml:"plugins"`
+	// Decompressors are additional compressed formats, decompressed by
+	// external commands.
+	Decompressors []decompressorConfig `yaml:"decompressors"`
+	// USBQuirks are USB bridges to write to in a special way, in
+	// addition to the ones sflashy knows.
+	USBQuirks []quirkConfig `yaml:"usb_quirks"`
+	// Tracing exports the spans of the flashes with OTLP, as setting
+	// OTEL_EXPORTER_OTLP_ENDPOINT does.
+	Tracing bool `yaml:"tracing"`
+	// StateDir is where interrupted flashes are recorded
+	// (flasher.DefaultStateDir if empty).
+	StateDir string `yaml:"state_dir"`
+	// Ledger is the SQLite database where every flash is recorded, for
+	// `sflashy history`; none if empty.
+	Ledger string `yaml:"ledger"`
+	// Audit is the hash-chained log of the destructive operations.
+	Audit auditConfig `yaml:"audit"`
+	// MQTT publishes the events and the progress of the flashes.
+	MQTT mqttConfig `yaml:"mqtt"`
+	// Cache keeps the images downloaded, shared with the peer stations.
+	Cache cacheConfig `yaml:"cache"`
+	// Catalog is the Raspberry Pi Imager catalog of the rpi: images
+	// (defaultCatalog if empty).
+	Catalog string `yaml:"catalog"`
+	// Distros are the keyrings of the distributions known and the
+	// distributions added to them.
+	Distros []distroConfig `yaml:"distros"`
+}
+
+// configPath returns the path of the configuration file.
+func configPath() string {
+	if p := os.Getenv("SFLASHY_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sflashy", "config.yaml")
+}
+
+// loadConfig reads the configuration file at path. A missing file is not
+// an error and yields the zero configuration.
+func loadConfig(path string) (config, error) {
+	var cfg config
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("invalid configuration %s: %w", path, err)
+	}
+	return cfg, nil
+}
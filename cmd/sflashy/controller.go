@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// controller is the HTTP server of `sflashy controller`: the agents of the
+// flashing stations report their devices to it and take the jobs queued
+// for them, so that one operator drives them all.
+type controller struct {
+	// files keeps the images, which the agents download, and the token.
+	files *server
+	// offline is how long an agent can go without reporting before it is
+	// considered offline.
+	offline time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	agents map[string]*agentView
+	jobs   []*remoteJob
+	seq    int
+
+	// digests are the SHA-256 of the images, by name, as long as their
+	// file does not change.
+	digestMu sync.Mutex
+	digests  map[string]fileDigest
+}
+
+// fileDigest is the SHA-256 of a file, with the size and modification time
+// the file had.
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+// agentView is an agent as the controller returns it.
+type agentView struct {
+	Name    string       `json:"name"`
+	Online  bool         `json:"online"`
+	Seen    time.Time    `json:"seen"`
+	Devices []deviceInfo `json:"devices"`
+}
+
+// remoteJob is a job of an agent. Its state is "pending" until the agent
+// takes it, then the one the agent reports.
+type remoteJob struct {
+	jobView
+	Agent     string `json:"agent"`
+	ImageSize int64  `json:"image_size_bytes"`
+	// ImageSHA256 lets the agent reuse an image it has only if it is the
+	// same.
+	ImageSHA256 string `json:"image_sha256"`
+	Verify      bool   `json:"verify"`
+	// cancel is set by DELETE until the agent reports the job done.
+	cancel bool
+}
+
+// done reports whether the job has ended.
+func (j *remoteJob) done() bool {
+	return flasher.JobState(j.State).Done()
+}
+
+// agentReport is the body of POST /api/agents/{name}: the devices of the
+// agent and its jobs.
+type agentReport struct {
+	Devices []deviceInfo `json:"devices"`
+	Jobs    []jobView    `json:"jobs"`
+}
+
+// agentOrders is the reply to an agentReport: the jobs to start and the
+// ones to cancel.
+type agentOrders struct {
+	Jobs   []remoteJob `json:"jobs"`
+	Cancel []string    `json:"cancel"`
+}
+
+// remoteJobRequest is the body of POST /api/jobs of the controller.
+type remoteJobRequest struct {
+	jobRequest
+	Agent string `json:"agent"`
+}
+
+// handler returns the routes of c.
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/agents", c.listAgents)
+	mux.HandleFunc("POST /api/agents/{name}", c.report)
+	mux.HandleFunc("GET /api/images", c.files.listImages)
+	mux.HandleFunc("GET /api/images/{name}", c.sendImage)
+	mux.HandleFunc("PUT /api/images/{name}", c.files.uploadImage)
+	mux.HandleFunc("POST /api/images", c.files.downloadImage)
+	mux.HandleFunc("GET /api/jobs", c.listJobs)
+	mux.HandleFunc("POST /api/jobs", c.submitJob)
+	mux.HandleFunc("DELETE /api/jobs/{id}", c.cancelJob)
+	return c.files.authorize(mux)
+}
+
+// view returns the agentView of a, with the state of the moment; c.mu is
+// held.
+func (c *controller) view(a *agentView) agentView {
+	v := *a
+	v.Online = c.now().Sub(a.Seen) < c.offline
+	return v
+}
+
+func (c *controller) listAgents(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	agents := []agentView{}
+	for _, a := range c.agents {
+		agents = append(agents, c.view(a))
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	writeJSON(w, http.StatusOK, agents)
+}
+
+// report records the devices and the jobs of the agent of the request, and
+// replies with its orders.
+func (c *controller) report(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var rep agentReport
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.agents[name]
+	if a == nil {
+		a = &agentView{Name: name}
+		c.agents[name] = a
+		logger.Info("agent registered", "agent", name, "address", r.RemoteAddr)
+	} else if !c.view(a).Online {
+		logger.Info("agent back online", "agent", name)
+	}
+	a.Seen, a.Devices = c.now(), rep.Devices
+	if a.Devices == nil {
+		a.Devices = []deviceInfo{}
+	}
+
+	orders := agentOrders{Jobs: []remoteJob{}, Cancel: []string{}}
+	for _, j := range c.jobs {
+		if j.Agent != name {
+			continue
+		}
+		i := slices.IndexFunc(rep.Jobs, func(v jobView) bool { return v.ID == j.ID })
+		switch {
+		case i >= 0:
+			v := rep.Jobs[i]
+			v.Image, v.Device = j.Image, j.Device
+			j.jobView = v
+			if j.done() {
+				j.cancel = false
+				logger.Info("job done", "job", j.ID, "agent", name, "state", j.State, "err", j.Error)
+			}
+		case j.State == "pending":
+		case !j.done():
+			// L'agente non ha il job: la risposta che lo conteneva è
+			// andata persa, o l'agente è ripartito. Lo si manda di nuovo.
+			j.State = "pending"
+		}
+		if j.State == "pending" && !j.cancel {
+			orders.Jobs = append(orders.Jobs, *j)
+			j.State = "sent"
+		}
+		if j.cancel {
+			orders.Cancel = append(orders.Cancel, j.ID)
+		}
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// sendImage sends an image of the images directory, to an agent.
+func (c *controller) sendImage(w http.ResponseWriter, r *http.Request) {
+	name, err := imageName(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	f, err := os.Open(filepath.Join(c.files.images, name))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown image %q", name))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (c *controller) listJobs(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	jobs := []remoteJob{}
+	for _, j := range c.jobs {
+		jobs = append(jobs, *j)
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+// submitJob queues the flash of an image of the images directory to a
+// device of an online agent, which takes it at its next report.
+func (c *controller) submitJob(w http.ResponseWriter, r *http.Request) {
+	var req remoteJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	name, err := imageName(req.Image)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	info, err := os.Stat(filepath.Join(c.files.images, name))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown image %q", req.Image))
+		return
+	}
+	digest, err := c.imageDigest(name, info)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a := c.agents[req.Agent]
+	if a == nil || !c.view(a).Online {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("agent %q is not online", req.Agent))
+		return
+	}
+	if !slices.ContainsFunc(a.Devices, func(d deviceInfo) bool { return d.Path == req.Device }) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%s is not one of the devices of %s that can be flashed", req.Device, req.Agent))
+		return
+	}
+	if slices.ContainsFunc(c.jobs, func(j *remoteJob) bool { return j.Agent == req.Agent && j.Device == req.Device && !j.done() }) {
+		writeError(w, http.StatusConflict, fmt.Errorf("%w: %s of %s", flasher.ErrDeviceBusy, req.Device, req.Agent))
+		return
+	}
+	c.seq++
+	j := &remoteJob{
+		jobView:     jobView{ID: strconv.Itoa(c.seq), Image: name, Device: req.Device, State: "pending", Queued: c.now()},
+		Agent:       req.Agent,
+		ImageSize:   info.Size(),
+		ImageSHA256: digest,
+		Verify:      req.Verify,
+	}
+	c.jobs = append(c.jobs, j)
+	logger.Info("job submitted", "job", j.ID, "agent", req.Agent, "image", name, "device", req.Device, "verify", req.Verify)
+	writeJSON(w, http.StatusCreated, *j)
+}
+
+// imageDigest returns the SHA-256 of the image name of the images
+// directory, whose file has info, computed again only when the file
+// changes.
+func (c *controller) imageDigest(name string, info os.FileInfo) (string, error) {
+	c.digestMu.Lock()
+	defer c.digestMu.Unlock()
+	if d, ok := c.digests[name]; ok && d.size == info.Size() && d.modTime.Equal(info.ModTime()) {
+		return d.digest, nil
+	}
+	digest, err := hashFile(filepath.Join(c.files.images, name))
+	if err != nil {
+		return "", err
+	}
+	if c.digests == nil {
+		c.digests = map[string]fileDigest{}
+	}
+	c.digests[name] = fileDigest{size: info.Size(), modTime: info.ModTime(), digest: digest}
+	return digest, nil
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cancelJob cancels a job: at once if the agent has not taken it yet, or
+// at the next report of the agent.
+func (c *controller) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.IndexFunc(c.jobs, func(j *remoteJob) bool { return j.ID == id })
+	if i < 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w: %s", flasher.ErrJobNotFound, id))
+		return
+	}
+	switch j := c.jobs[i]; {
+	case j.State == "pending":
+		j.State = string(flasher.JobCancelled)
+	case !j.done():
+		j.cancel = true
+	}
+	logger.Info("job cancelled", "job", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runController implements the `controller` subcommand: the API that the
+// agents report to and that queues their jobs, until an interrupt.
+func runController(args []string) error {
+	fs := flag.NewFlagSet("controller", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:8090", "address of the API")
+	images := fs.String("images", "", "directory of the images sent to the agents (default ~/.cache/sflashy/controller)")
+	token := fs.String("token", os.Getenv("SFLASHY_TOKEN"), "token the agents and the API clients must send, $SFLASHY_TOKEN by default (a random one if neither is set)")
+	extraHosts := fs.String("allowed-hosts", "", "comma-separated names the controller is reached by, besides its addresses, localhost and the name of this machine")
+	offline := fs.Duration("offline-after", 10*time.Second, "consider an agent offline when it has not reported for this long")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("controller takes no arguments")
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if *images == "" {
+		if *images, err = defaultImagesDir("controller"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*images, 0o700); err != nil {
+		return err
+	}
+	if *token == "" {
+		if *token, err = newToken(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Token of the API (give it to the agents with --token): %s\n", *token)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	c := &controller{
+		files:   &server{images: *images, token: *token, hosts: allowedHosts(*listen, *extraHosts)},
+		offline: *offline,
+		now:     time.Now,
+		agents:  map[string]*agentView{},
+	}
+	srv := &http.Server{Addr: *listen, Handler: c.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	logger.Info("controller listening (press Ctrl+C to stop)", "url", "http://"+*listen, "images", *images)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestControllerAgent verifica il giro completo: l'agente si registra con
+// i suoi dispositivi, riceve un job dal controller, scarica l'immagine, la
+// scrive e riporta l'esito.
+func TestControllerAgent(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"controller", "agent"} {
+		os.Mkdir(filepath.Join(dir, d), 0o700)
+	}
+	now := time.Now()
+	c := &controller{
+		files:   &server{images: filepath.Join(dir, "controller"), token: "segreto"},
+		offline: 10 * time.Second,
+		now:     func() time.Time { return now },
+		agents:  map[string]*agentView{},
+	}
+	srv := httptest.NewServer(c.handler())
+	defer srv.Close()
+	call := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer segreto")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	device := filepath.Join(dir, "sdb")
+	os.WriteFile(device, make([]byte, 1024), 0o644)
+	local := &server{
+		ctx:    context.Background(),
+		jobs:   flasher.NewJobManager(1),
+		images: filepath.Join(dir, "agent"),
+		filter: deviceFilter{Removable: true},
+		devices: func() ([]deviceInfo, error) {
+			return []deviceInfo{{Path: device, Removable: true}, {Path: "/dev/sda"}}, nil
+		},
+		newFlasher: func(opts flashOptions) *flasher.Flasher { return &flasher.Flasher{Verify: opts.Verify} },
+		location:   func(device string) string { return device },
+		progress:   map[string]*jobProgress{},
+	}
+	a := &agent{controller: srv.URL, name: "stazione-1", token: "segreto", client: http.DefaultClient, local: local, jobs: map[string]*agentJob{}}
+	ctx := context.Background()
+
+	if err := (&agent{controller: srv.URL, name: "intruso", client: http.DefaultClient, local: local}).report(ctx); err == nil {
+		t.Error("Un agente senza token va rifiutato")
+	}
+	if err := a.report(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_, body := call("GET", "/api/agents", "")
+	var agents []agentView
+	if err := json.Unmarshal([]byte(body), &agents); err != nil || len(agents) != 1 || !agents[0].Online || len(agents[0].Devices) != 1 || agents[0].Devices[0].Path != device {
+		t.Fatalf("Agente non registrato con il solo dispositivo rimovibile. Got: %s", body)
+	}
+
+	if status, body := call("PUT", "/api/images/sd.img", "immagine di prova"); status != http.StatusCreated {
+		t.Fatalf("Caricamento fallito. Got: %d %s", status, body)
+	}
+	for _, bad := range []string{
+		`{"agent":"stazione-2","image":"sd.img","device":"` + device + `"}`,
+		`{"agent":"stazione-1","image":"sd.img","device":"/dev/sda"}`,
+		`{"agent":"stazione-1","image":"manca.img","device":"` + device + `"}`,
+	} {
+		if status, body := call("POST", "/api/jobs", bad); status != http.StatusBadRequest {
+			t.Errorf("%s dovrebbe essere rifiutato. Got: %d %s", bad, status, body)
+		}
+	}
+	status, body := call("POST", "/api/jobs", `{"agent":"stazione-1","image":"sd.img","device":"`+device+`","verify":true}`)
+	if status != http.StatusCreated {
+		t.Fatalf("Job rifiutato. Got: %d %s", status, body)
+	}
+	if status, _ := call("POST", "/api/jobs", `{"agent":"stazione-1","image":"sd.img","device":"`+device+`"}`); status != http.StatusConflict {
+		t.Errorf("Un dispositivo ha un job alla volta. Got: %d", status)
+	}
+
+	// Il job arriva con il resoconto successivo; l'immagine si scarica.
+	if err := a.report(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := a.report(ctx); err != nil {
+			t.Fatal(err)
+		}
+		_, body = call("GET", "/api/jobs", "")
+		if strings.Contains(body, `"state":"completed"`) || strings.Contains(body, `"state":"failed"`) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var jobs []remoteJob
+	if err := json.Unmarshal([]byte(body), &jobs); err != nil || len(jobs) != 1 || jobs[0].State != "completed" || jobs[0].Verified != "passed" || jobs[0].Image != "sd.img" {
+		t.Fatalf("Job non completato. Got: %s", body)
+	}
+	if data, _ := os.ReadFile(device); !strings.HasPrefix(string(data), "immagine di prova") {
+		t.Errorf("Dispositivo non scritto. Got: %q", data[:20])
+	}
+	if len(a.jobs) != 0 {
+		t.Errorf("I job riportati come finiti vanno dimenticati. Got: %d", len(a.jobs))
+	}
+
+	// Un agente che non riporta più risulta offline e non riceve job.
+	now = now.Add(time.Minute)
+	_, body = call("GET", "/api/agents", "")
+	if !strings.Contains(body, `"online":false`) {
+		t.Errorf("Agente ancora online. Got: %s", body)
+	}
+	if status, _ := call("POST", "/api/jobs", `{"agent":"stazione-1","image":"sd.img","device":"`+device+`"}`); status != http.StatusBadRequest {
+		t.Errorf("Job per un agente offline accettato. Got: %d", status)
+	}
+}
+
+// TestControllerCancel verifica l'annullamento dei job e il nuovo invio di
+// quelli di cui l'agente non sa nulla.
+func TestControllerCancel(t *testing.T) {
+	c := &controller{offline: time.Minute, now: time.Now, agents: map[string]*agentView{}}
+	c.agents["a"] = &agentView{Name: "a", Seen: time.Now()}
+	c.jobs = []*remoteJob{
+		{jobView: jobView{ID: "1", State: "pending"}, Agent: "a"},
+		{jobView: jobView{ID: "2", State: "sent"}, Agent: "a"},
+		{jobView: jobView{ID: "3", State: "running"}, Agent: "a"},
+	}
+	for _, id := range []string{"1", "3"} {
+		r := httptest.NewRequest("DELETE", "/api/jobs/"+id, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		c.cancelJob(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Annullamento di %s fallito. Got: %d", id, w.Code)
+		}
+	}
+	if c.jobs[0].State != "cancelled" {
+		t.Errorf("Un job in attesa si annulla subito. Got: %s", c.jobs[0].State)
+	}
+
+	r := httptest.NewRequest("POST", "/api/agents/a", strings.NewReader(`{"jobs":[{"id":"3","state":"running"}]}`))
+	r.SetPathValue("name", "a")
+	w := httptest.NewRecorder()
+	c.report(w, r)
+	var orders agentOrders
+	if err := json.Unmarshal(w.Body.Bytes(), &orders); err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Jobs) != 1 || orders.Jobs[0].ID != "2" {
+		t.Errorf("Il job 2, sconosciuto all'agente, va rimandato. Got: %+v", orders.Jobs)
+	}
+	if len(orders.Cancel) != 1 || orders.Cancel[0] != "3" {
+		t.Errorf("Il job 3 va annullato dall'agente. Got: %v", orders.Cancel)
+	}
+}
+
+// TestAgentImage verifica che l'agente riusi un'immagine già scaricata
+// solo se ha lo SHA-256 di quella del controller.
+func TestAgentImage(t *testing.T) {
+	image := []byte("immagine nuova")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	a := &agent{controller: srv.URL, client: http.DefaultClient, local: &server{images: dir}}
+	path := filepath.Join(dir, "sd.img")
+	os.WriteFile(path, []byte("immagine tolta"), 0o600)
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+
+	got, err := a.image(context.Background(), "sd.img", int64(len(image)), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(got); string(data) != string(image) {
+		t.Errorf("Un'immagine diversa con lo stesso nome e dimensione va riscaricata. Got: %q", data)
+	}
+	if _, err := a.image(context.Background(), "sd.img", int64(len(image)), strings.Repeat("0", 64)); err == nil {
+		t.Error("Un'immagine con un altro SHA-256 va rifiutata")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("L'immagine sbagliata va rimossa. Got: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// dataPartition is the partition of --data-partition, added in the space
+// left after the image; FSType is empty when there is none.
+type dataPartition struct {
+	FSType string
+	Label  string
+	// Size is the size of the partition, the rest of the device if 0.
+	Size int64
+}
+
+// dataLabelLimits are the longest label of each filesystem, in bytes for
+// ext4 and in characters for the others.
+var dataLabelLimits = map[string]int{"ext4": 16, "fat32": 11, "exfat": 11}
+
+// parseDataPartition parses <filesystem>[:label=<label>][,size=<size>],
+// e.g. ext4:label=DATA,size=16G.
+func parseDataPartition(s string) (dataPartition, error) {
+	fsType, options, _ := strings.Cut(s, ":")
+	p := dataPartition{FSType: strings.ToLower(fsType), Label: "DATA"}
+	if p.FSType == "vfat" {
+		p.FSType = "fat32"
+	}
+	limit, ok := dataLabelLimits[p.FSType]
+	if !ok {
+		return dataPartition{}, fmt.Errorf("unknown filesystem %q, expected ext4, fat32 or exfat", fsType)
+	}
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "label":
+				p.Label = value
+			case "size":
+				n, err := parseSize(value)
+				if err != nil || n == 0 {
+					return dataPartition{}, fmt.Errorf("invalid size %q of the data partition", value)
+				}
+				p.Size = int64(n)
+			default:
+				return dataPartition{}, fmt.Errorf("unknown option %q of the data partition, expected label= or size=", option)
+			}
+		}
+	}
+	n := len(p.Label)
+	if p.FSType != "ext4" {
+		n = utf8.RuneCountInString(p.Label)
+	}
+	if p.Label == "" || n > limit || strings.ContainsAny(p.Label, "/\\\"\t\n") {
+		return dataPartition{}, fmt.Errorf("invalid %s label %q, at most %d characters", p.FSType, p.Label, limit)
+	}
+	return p, nil
+}
+
+// dataPartitionFlag is --data-partition.
+type dataPartitionFlag struct {
+	part dataPartition
+}
+
+// addDataPartitionFlag registers --data-partition on fs.
+func addDataPartitionFlag(fs *flag.FlagSet) *dataPartitionFlag {
+	f := &dataPartitionFlag{}
+	fs.Func("data-partition", "add a partition for user data after the image, e.g. ext4:label=DATA,size=16G (ext4, fat32, exfat)", func(s string) error {
+		p, err := parseDataPartition(s)
+		if err != nil {
+			return err
+		}
+		f.part = p
+		return nil
+	})
+	return f
+}
+
+// apply sets the data partition of opts, once its other options are set.
+func (f dataPartitionFlag) apply(opts *flashOptions) error {
+	if f.part.FSType == "" {
+		return nil
+	}
+	switch {
+	case runtime.GOOS != "linux":
+		return usageError("--data-partition needs mkfs, on Linux")
+	case opts.Expand:
+		return usageError("--data-partition needs the space that --expand would take")
+	case opts.Seek > 0:
+		return usageError("--data-partition needs the image at the start of the device, it cannot be used with --seek")
+	case opts.Persistence && opts.PersistenceSize == 0:
+		return usageError("--persistence takes the rest of the device, set --persistence-size to leave room for --data-partition")
+	}
+	opts.DataPartition = f.part
+	return nil
+}
+
+// dataPartitionStep returns the customization step that adds p, recording
+// it in m.
+func dataPartitionStep(m *partitionMaker, p dataPartition) flasher.Step {
+	return m.step("add the data partition", func(d *flasher.Disk) (newPartition, error) {
+		part, err := d.AddDataPartition(p.Size, p.Label, p.FSType)
+		if err != nil {
+			return newPartition{}, err
+		}
+		return newPartition{number: part.Number, fsType: p.FSType, label: p.Label}, nil
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+// TestDataPartition verifica la lettura di --data-partition e le sue
+// combinazioni con le altre opzioni.
+func TestDataPartition(t *testing.T) {
+	for s, want := range map[string]dataPartition{
+		"ext4":                       {FSType: "ext4", Label: "DATA"},
+		"ext4:label=userdata":        {FSType: "ext4", Label: "userdata"},
+		"vfat:label=SHARED,size=16G": {FSType: "fat32", Label: "SHARED", Size: 16 << 30},
+		"exfat:size=2048s":           {FSType: "exfat", Label: "DATA", Size: 1 << 20},
+	} {
+		if got, err := parseDataPartition(s); err != nil || got != want {
+			t.Errorf("%s letto male. Got: %+v, %v, Want: %+v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"ntfs", "ext4:label=", "fat32:label=TROPPOLUNGA1", "ext4:size=0", "ext4:mode=rw"} {
+		if _, err := parseDataPartition(bad); err == nil {
+			t.Errorf("%s dovrebbe essere rifiutato", bad)
+		}
+	}
+
+	var opts flashOptions
+	if err := (dataPartitionFlag{}).apply(&opts); err != nil || opts.DataPartition.FSType != "" {
+		t.Errorf("Senza --data-partition non c'è partizione. Got: %+v, %v", opts, err)
+	}
+	f := dataPartitionFlag{part: dataPartition{FSType: "ext4", Label: "DATA"}}
+	for _, bad := range []flashOptions{{Expand: true}, {Seek: 512}, {Persistence: true}} {
+		if err := f.apply(&bad); !errors.Is(err, errUsage) {
+			t.Errorf("%+v dovrebbe essere un errore d'uso. Got: %v", bad, err)
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	opts = flashOptions{Persistence: true, PersistenceSize: 1 << 30}
+	if err := f.apply(&opts); err != nil || opts.DataPartition != f.part {
+		t.Errorf("Partizione dati errata. Got: %+v, %v", opts, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// ddOperands are the dd-style "key=value" operands accepted alongside the
+// regular flags, so that provisioning scripts calling dd can switch to
+// sflashy with minimal changes:
+//
+//	sflashy if=image.img of=/dev/sdb bs=4M seek=1 skip=0 count=100 conv=fsync
+//
+// As in dd, seek, skip and count are expressed in blocks of bs bytes
+// (512 when bs is not given) and accept the same multiplier suffixes.
+type ddOperands struct {
+	Input, Output string
+	BlockSize     uint64 // 0 when bs= is not given
+	Skip          uint64 // blocks
+	Seek          uint64 // blocks
+	Count         uint64 // blocks, 0 for the whole input
+	HasCount      bool
+	Pad           bool // conv=sync
+}
+
+// ddDefaultBlockSize is dd's default block size, used as the unit of
+// seek=, skip= and count= when bs= is not given.
+const ddDefaultBlockSize = 512
+
+// unit returns the size in bytes of the blocks counted by seek, skip and count.
+func (d ddOperands) unit() uint64 {
+	if d.BlockSize > 0 {
+		return d.BlockSize
+	}
+	return ddDefaultBlockSize
+}
+
+// parseDDOperands extracts the dd operands from the positional arguments
+// and returns the remaining ones.
+func parseDDOperands(args []string) ([]string, ddOperands, error) {
+	var d ddOperands
+	var rest []string
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			rest = append(rest, arg)
+			continue
+		}
+
+		var err error
+		switch key {
+		case "if":
+			d.Input = value
+		case "of":
+			d.Output = value
+		case "bs":
+			d.BlockSize, err = parseSize(value)
+			if err == nil && d.BlockSize == 0 {
+				err = fmt.Errorf("block size must be greater than zero")
+			}
+		case "skip":
+			d.Skip, err = parseSize(value)
+		case "seek":
+			d.Seek, err = parseSize(value)
+		case "count":
+			d.Count, err = parseSize(value)
+			d.HasCount = true
+		case "conv":
+			err = d.parseConv(value)
+		case "status", "iflag", "oflag":
+			// Il progresso è sempre mostrato e i flag di apertura sono
+			// gestiti da sflashy: accettiamo gli operandi per compatibilità.
+			logger.Debug("ignoring dd operand", "operand", arg)
+		case "ibs", "obs", "cbs":
+			err = fmt.Errorf("not supported, use bs= instead")
+		default:
+			// Non è un operando dd: per esempio un nome di file con "=".
+			rest = append(rest, arg)
+			continue
+		}
+		if err != nil {
+			return nil, d, usageError("invalid dd operand %q: %v", arg, err)
+		}
+	}
+	return rest, d, nil
+}
+
+// parseConv handles the comma separated conversions of conv=.
+func (d *ddOperands) parseConv(value string) error {
+	for _, conv := range strings.Split(value, ",") {
+		switch conv {
+		case "fsync", "fdatasync", "notrunc":
+			// sflashy sincronizza sempre il dispositivo e non tronca mai.
+		case "sync":
+			d.Pad = true
+		default:
+			return fmt.Errorf("conversion %q is not supported", conv)
+		}
+	}
+	return nil
+}
+
+// copyFlags are the byte-based counterparts of the dd operands.
+type copyFlags struct {
+	BlockSize sizeFlag
+	Seek      sizeFlag
+	Count     sizeFlag
+}
+
+// addCopyFlags registers --bs, --seek and --count (alias --length) on fs.
+func addCopyFlags(fs *flag.FlagSet) *copyFlags {
+	f := &copyFlags{}
+	fs.Var(&f.BlockSize, "bs", "size of each write to the device (default 32M)")
+	fs.Var(&f.Seek, "seek", "device offset where writing starts, e.g. 8192s or 4M")
+	fs.Var(&f.Count, "count", "write only the first bytes of the image, e.g. 1M")
+	fs.Var(&f.Count, "length", "alias for --count")
+	return f
+}
+
+// applyDDOperands sets the copy settings of opts from the dd operands and
+// the copy flags. Flags are in bytes while the operands are in blocks, so
+// setting both forms of the same value is rejected.
+func applyDDOperands(opts *flashOptions, d ddOperands, f copyFlags) error {
+	bs := f.BlockSize
+	if bs.set && d.BlockSize > 0 && bs.bytes != d.BlockSize {
+		return usageError("--bs and bs= disagree")
+	}
+	if bs.set {
+		if bs.bytes == 0 {
+			return usageError("--bs must be greater than zero")
+		}
+		d.BlockSize = bs.bytes
+	}
+	if d.HasCount && d.Count == 0 {
+		return usageError("count=0 would not write anything")
+	}
+	if f.Seek.set && d.Seek > 0 {
+		return usageError("--seek and seek= are mutually exclusive")
+	}
+	if f.Count.set && d.HasCount {
+		return usageError("--count and count= are mutually exclusive")
+	}
+	if f.Count.set && f.Count.bytes == 0 {
+		return usageError("--count must be greater than zero")
+	}
+
+	unit := d.unit()
+	opts.BlockSize = int(d.BlockSize)
+	opts.Skip = int64(d.Skip * unit)
+	opts.Seek = int64(d.Seek * unit)
+	opts.Count = int64(d.Count * unit)
+	opts.Pad = d.Pad
+	if f.Seek.set {
+		opts.Seek = int64(f.Seek.bytes)
+	}
+	if f.Count.set {
+		opts.Count = int64(f.Count.bytes)
+	}
+	return nil
+}
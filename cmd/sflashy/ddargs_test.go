@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseDDOperands verifica l'interpretazione degli operandi in stile dd.
+func TestParseDDOperands(t *testing.T) {
+	rest, d, err := parseDDOperands([]string{"if=image.img", "of=/dev/sdb", "bs=4M", "seek=2", "skip=1", "count=10", "conv=fsync,sync", "status=progress"})
+	if err != nil {
+		t.Fatalf("parseDDOperands ha restituito un errore: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("Non dovrebbero restare argomenti. Got: %v", rest)
+	}
+	want := ddOperands{Input: "image.img", Output: "/dev/sdb", BlockSize: 4 << 20, Seek: 2, Skip: 1, Count: 10, HasCount: true, Pad: true}
+	if d != want {
+		t.Errorf("Operandi errati. Got: %+v, Want: %+v", d, want)
+	}
+	if d.unit() != 4<<20 {
+		t.Errorf("unit() = %d, want %d", d.unit(), 4<<20)
+	}
+
+	rest, d, err = parseDDOperands([]string{"image.img", "/dev/sdb", "count=8"})
+	if err != nil || strings.Join(rest, " ") != "image.img /dev/sdb" || d.unit() != 512 {
+		t.Errorf("Argomenti misti: rest=%v d=%+v err=%v", rest, d, err)
+	}
+
+	for _, bad := range []string{"bs=0", "bs=12X", "conv=noerror", "obs=1M"} {
+		if _, _, err := parseDDOperands([]string{bad}); err == nil {
+			t.Errorf("parseDDOperands(%q) avrebbe dovuto restituire un errore", bad)
+		}
+	}
+}
+
+// TestApplyDDOperands verifica la conversione in byte e i conflitti tra
+// operandi dd e flag equivalenti.
+func TestApplyDDOperands(t *testing.T) {
+	var opts flashOptions
+	d := ddOperands{BlockSize: 1 << 20, Skip: 2, Seek: 3, Count: 4, HasCount: true}
+	if err := applyDDOperands(&opts, d, copyFlags{}); err != nil {
+		t.Fatalf("applyDDOperands ha restituito un errore: %v", err)
+	}
+	if opts.BlockSize != 1<<20 || opts.Skip != 2<<20 || opts.Seek != 3<<20 || opts.Count != 4<<20 {
+		t.Errorf("Conversione in byte errata. Got: %+v", opts)
+	}
+
+	opts = flashOptions{}
+	f := copyFlags{Seek: sizeFlag{bytes: 8192 * 512, set: true}, Count: sizeFlag{bytes: 446, set: true}}
+	if err := applyDDOperands(&opts, ddOperands{}, f); err != nil {
+		t.Fatalf("applyDDOperands ha restituito un errore: %v", err)
+	}
+	if opts.Seek != 8192*512 || opts.Count != 446 {
+		t.Errorf("Flag in byte ignorati. Got: seek=%d count=%d", opts.Seek, opts.Count)
+	}
+
+	conflicts := []struct {
+		d ddOperands
+		f copyFlags
+	}{
+		{ddOperands{Seek: 1}, copyFlags{Seek: sizeFlag{bytes: 512, set: true}}},
+		{ddOperands{Count: 1, HasCount: true}, copyFlags{Count: sizeFlag{bytes: 512, set: true}}},
+		{ddOperands{}, copyFlags{Count: sizeFlag{set: true}}},
+	}
+	for _, c := range conflicts {
+		if err := applyDDOperands(&flashOptions{}, c.d, c.f); exitCode(err) != exitUsage {
+			t.Errorf("applyDDOperands(%+v, %+v) avrebbe dovuto restituire un errore d'uso, got: %v", c.d, c.f, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// decompressorConfig is a compressed format decompressed by an external
+// command, from the decompressors section of the configuration.
+type decompressorConfig struct {
+	Name string `yaml:"name"`
+	// Magic is the hexadecimal signature of the format, spaces allowed
+	// ("56 5a 31").
+	Magic      string   `yaml:"magic"`
+	Extensions []string `yaml:"extensions"`
+	// Command reads the compressed image on stdin and writes the
+	// decompressed one on stdout.
+	Command string `yaml:"command"`
+}
+
+// registerDecompressors registers the configured decompressors.
+func registerDecompressors(configs []decompressorConfig) error {
+	for _, c := range configs {
+		magic, err := hex.DecodeString(strings.Join(strings.Fields(c.Magic), ""))
+		if err != nil {
+			return fmt.Errorf("decompressor %s: invalid magic %q: %w", c.Name, c.Magic, err)
+		}
+		if c.Command == "" {
+			return fmt.Errorf("decompressor %s: no command", c.Name)
+		}
+		err = flasher.RegisterDecompressor(flasher.Decompressor{
+			Name:       c.Name,
+			Magic:      magic,
+			Extensions: c.Extensions,
+			NewReader:  flasher.CommandDecompressor(c.Command),
+		})
+		if err != nil {
+			return err
+		}
+		logger.Debug("decompressor registered", "name", c.Name, "magic", c.Magic, "extensions", c.Extensions)
+	}
+	return nil
+}
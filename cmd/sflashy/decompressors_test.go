@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestRegisterDecompressors verifica i decompressori configurati.
+func TestRegisterDecompressors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("richiede sh")
+	}
+	if err := registerDecompressors([]decompressorConfig{{Name: "bad", Magic: "zz", Command: "cat"}}); err == nil {
+		t.Error("Un magic non esadecimale dovrebbe essere un errore")
+	}
+	if err := registerDecompressors([]decompressorConfig{{Name: "nocmd", Magic: "00"}}); err == nil {
+		t.Error("Un decompressore senza comando dovrebbe essere un errore")
+	}
+	err := registerDecompressors([]decompressorConfig{{Name: "clitest", Magic: "43 4c 49 54", Command: "tail -c +5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "image.clit")
+	if err := os.WriteFile(path, []byte("CLITdati"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := flasher.OpenImage(path, flasher.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if got, err := io.ReadAll(src); err != nil || string(got) != "dati" || src.Format != "clitest" {
+		t.Errorf("Immagine decompressa errata. Got: %q (%s), %v", got, src.Format, err)
+	}
+}
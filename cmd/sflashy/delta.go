@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// runDelta implements the `delta` subcommand: create makes the delta
+// between two versions of an image, apply writes it to a device that
+// holds the old one.
+func runDelta(args []string) error {
+	if len(args) == 0 {
+		return usageError("delta requires create or apply")
+	}
+	switch args[0] {
+	case "create":
+		return runDeltaCreate(args[1:])
+	case "apply":
+		return runDeltaApply(args[1:])
+	}
+	return usageError("unknown delta command %q, expected create or apply", args[0])
+}
+
+// runDeltaCreate runs `sflashy delta create <old-image> <new-image>
+// <delta-file>`. The images may be compressed like those of a flash.
+func runDeltaCreate(args []string) error {
+	fs := flag.NewFlagSet("delta create", flag.ContinueOnError)
+	bs := sizeFlag{bytes: flasher.DefaultDeltaBlockSize}
+	fs.Var(&bs, "block-size", "size of the blocks compared and written (default 64K)")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 3 {
+		return usageError("delta create requires the old image, the new image and the delta file to write")
+	}
+	if bs.bytes == 0 || bs.bytes > flasher.MaxDeltaBlockSize {
+		return usageError("--block-size must be between 1 and 64M")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	info, err := createDelta(ctx, positional[0], positional[1], positional[2], int(bs.bytes))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, ColorSuccess+"Delta written to %s"+ColorReset+"\n", positional[2])
+	writeDeltaInfo(os.Stderr, info)
+	return nil
+}
+
+// createDelta writes to output the delta from the image oldImage to
+// newImage. The file is removed if the delta cannot be completed.
+func createDelta(ctx context.Context, oldImage, newImage, output string, blockSize int) (info flasher.DeltaInfo, err error) {
+	usePlugins()
+	oldSrc, err := flasher.OpenImage(oldImage, flasher.OpenOptions{LowMemory: lowMemory})
+	if err != nil {
+		return info, err
+	}
+	defer oldSrc.Close()
+	newSrc, err := flasher.OpenImage(newImage, flasher.OpenOptions{LowMemory: lowMemory})
+	if err != nil {
+		return info, err
+	}
+	defer newSrc.Close()
+
+	out, err := os.Create(output)
+	if err != nil {
+		return info, err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	logger.Info("creating delta", "old", oldImage, "new", newImage, "block_size", blockSize)
+	info, err = flasher.CreateDelta(ctx, oldSrc, newSrc, out, blockSize)
+	if err != nil {
+		return info, fmt.Errorf("could not create the delta: %w", err)
+	}
+	logger.Info("delta created", "output", output, "blocks", info.Blocks, "bytes", info.Bytes)
+	return info, nil
+}
+
+// writeDeltaInfo shows what a delta changes.
+func writeDeltaInfo(w io.Writer, info flasher.DeltaInfo) {
+	var share float64
+	if info.NewSize > 0 {
+		share = 100 * float64(info.Bytes) / float64(info.NewSize)
+	}
+	fmt.Fprintf(w, "  %-9s %s, SHA-256 %s\n", "From:", formatSize(uint64(info.OldSize)), info.OldSHA256)
+	fmt.Fprintf(w, "  %-9s %s, SHA-256 %s\n", "To:", formatSize(uint64(info.NewSize)), info.NewSHA256)
+	fmt.Fprintf(w, "  %-9s %d blocks of %d bytes, %s (%.1f%% of the image)\n", "Changed:", info.Blocks, info.BlockSize, formatSize(uint64(info.Bytes)), share)
+}
+
+// deltaOptions collects the settings of `sflashy delta apply`.
+type deltaOptions struct {
+	// Delta is the path of the delta file.
+	Delta    string
+	Device   string
+	Yes      bool
+	Eject    bool
+	Verify   bool
+	Timeout  time.Duration
+	JSON     io.Writer
+	PauseKey bool
+}
+
+// runDeltaApply runs `sflashy delta apply <delta-file> <device>`, which
+// brings a device from the old image of the delta to the new one with the
+// same checks and confirmation as a flash.
+func runDeltaApply(args []string) error {
+	fs := flag.NewFlagSet("delta apply", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	eject := fs.Bool("eject", false, "power off / eject the device when done")
+	verify := fs.Bool("verify", false, "read the new image back once the delta is applied")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort if checking, writing and verifying take longer than this, e.g. 20m")
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 2 {
+		return usageError("delta apply requires a delta file and a device")
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+
+	// Un delta remoto passa dalla cache delle immagini, come i download.
+	path := positional[0]
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+		path, err = peerCache.fetch(ctx, positional[0], "")
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+	selector, err := parseTargetSelector(positional[1])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	device, err := findTarget(selector)
+	if err != nil {
+		return err
+	}
+	opts := deltaOptions{
+		Delta: path, Device: device, Yes: *yes, Eject: *eject, Verify: *verify,
+		Timeout: *timeout, PauseKey: flasher.IsTerminal(os.Stdin),
+	}
+	if *jsonOut {
+		opts.JSON = os.Stdout
+	}
+	return applyDelta(context.Background(), opts, os.Stdin, os.Stderr)
+}
+
+// applyDelta checks the device, asks for confirmation and applies the
+// delta.
+func applyDelta(ctx context.Context, opts deltaOptions, userInput io.Reader, termOut io.Writer) (err error) {
+	summary := flashSummary{Image: filepath.Base(opts.Delta), Device: opts.Device, Hash: "sha256", Verification: "skipped"}
+	if opts.JSON != nil {
+		defer func() { summary.writeJSON(opts.JSON, err) }()
+	}
+	if flashLedger != nil || flashAudit != nil || flashMetrics != nil {
+		dev := lookupDeviceInfo(opts.Device)
+		defer func() {
+			flashLedger.record(summary, dev, err)
+			flashAudit.record("delta", summary, dev, err)
+			flashMetrics.record(summary, dev, err)
+		}()
+	}
+	log := logger.With("delta", opts.Delta, "device", opts.Device)
+	file, err := os.Open(opts.Delta)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	defer file.Close()
+	delta, err := flasher.OpenDelta(file)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errUsage, opts.Delta, err)
+	}
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return err
+	}
+	mounts := mountedPartitions(opts.Device)
+	if len(mounts) > 0 && !autoUnmount {
+		return fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, opts.Device, strings.Join(mounts, ", "))
+	}
+	if !opts.Yes {
+		fmt.Fprintln(termOut, ColorProgress+"\nAbout to apply the delta"+ColorReset)
+		writeDeltaInfo(termOut, delta.Info)
+		writeTargetDetails(termOut, opts.Device, 0, lookupDeviceInfo(opts.Device))
+	}
+
+	f := newFlasher(flashOptions{Image: opts.Delta, Device: opts.Device, Verify: opts.Verify, Timeout: opts.Timeout}, termOut)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	f.Pauser = newPauser(opts.PauseKey, termOut)
+	defer pauseOnSignal(f.Pauser)()
+	stopInterrupt, stopPause := func() {}, func() {}
+	defer func() { stopInterrupt(); stopPause() }()
+	f.Confirm = func() error {
+		if !opts.Yes && !confirmAction(userInput, termOut, fmt.Sprintf("Writing %s of changed blocks to device.", formatSize(uint64(delta.Info.Bytes)))) {
+			fmt.Fprintln(termOut, "Operation cancelled.")
+			return errCancelled
+		}
+		if len(mounts) > 0 {
+			fmt.Fprintf(termOut, "Unmounting %s...\n", strings.Join(mounts, ", "))
+			if err := unmountDisk(opts.Device); err != nil {
+				return fmt.Errorf("%w: %v", errDeviceMounted, err)
+			}
+		}
+		if opts.PauseKey {
+			stopPause = pauseOnInput(f.Pauser, userInput)
+		}
+		stopInterrupt = cancelOnInterrupt(cancel)
+		return nil
+	}
+	defer reportOnSignal(f, termOut)()
+
+	res, err := f.ApplyDelta(ctx, delta, deviceLocation(opts.Device))
+	summary.Bytes, summary.Digest, summary.Elapsed, summary.Verification = res.Bytes, res.Digest, res.Elapsed, res.Verification
+	if res.Bytes > 0 {
+		summary.write(termOut)
+		log.Info("delta applied", "bytes", res.Bytes, "elapsed", res.Elapsed, "verification", res.Verification)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Eject {
+		fmt.Fprintf(termOut, "Ejecting %s...\n", opts.Device)
+		if err := ejectDevice(opts.Device); err != nil {
+			return err
+		}
+		fmt.Fprintf(termOut, ColorSuccess+"It is now safe to remove %s."+ColorReset+"\n", opts.Device)
+	}
+	return nil
+}
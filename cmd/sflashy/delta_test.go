@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestCreateDelta verifica il delta tra due immagini, anche compresse, e
+// le informazioni mostrate.
+func TestCreateDelta(t *testing.T) {
+	dir := t.TempDir()
+	old := bytes.Repeat([]byte{1}, 8192)
+	new := bytes.Clone(old)
+	new[5000] = 2
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(new)
+	zw.Close()
+	os.WriteFile(filepath.Join(dir, "v1.img"), old, 0o644)
+	os.WriteFile(filepath.Join(dir, "v2.img.gz"), compressed.Bytes(), 0o644)
+
+	output := filepath.Join(dir, "v1-v2.delta")
+	info, err := createDelta(context.Background(), filepath.Join(dir, "v1.img"), filepath.Join(dir, "v2.img.gz"), output, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Blocks != 1 || info.Bytes != 1024 || info.NewSize != 8192 {
+		t.Errorf("Delta errato. Got: %+v", info)
+	}
+	file, _ := os.Open(output)
+	defer file.Close()
+	if d, err := flasher.OpenDelta(file); err != nil || d.Info != info {
+		t.Errorf("Il file non contiene il delta. Got: %v", err)
+	}
+
+	var out strings.Builder
+	writeDeltaInfo(&out, info)
+	if !strings.Contains(out.String(), "1 blocks of 1024 bytes") || !strings.Contains(out.String(), "(12.5% of the image)") {
+		t.Errorf("Informazioni errate. Got: %q", out.String())
+	}
+
+	broken := filepath.Join(dir, "broken.delta")
+	if _, err := createDelta(context.Background(), filepath.Join(dir, "v1.img"), filepath.Join(dir, "manca.img"), broken, 1024); err == nil {
+		t.Error("Un'immagine mancante dovrebbe essere un errore")
+	}
+	if _, err := os.Stat(broken); err == nil {
+		t.Error("Il delta incompleto non dovrebbe restare")
+	}
+}
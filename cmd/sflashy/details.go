@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// writeFlashDetails shows what is about to be written where (offset is
+// the device offset of the write), so that the user confirms against real
+// information. dev may be nil when the device could not be enumerated.
+func writeFlashDetails(w io.Writer, image string, imageSize int64, device string, offset int64, dev *deviceInfo) {
+	fmt.Fprintln(w, ColorProgress+"\nAbout to flash"+ColorReset)
+	size := "size unknown"
+	if imageSize > 0 {
+		size = formatSize(uint64(imageSize))
+	}
+	fmt.Fprintf(w, "  %-8s %s (%s)\n", "Image:", filepath.Base(image), size)
+	writeTargetDetails(w, device, offset, dev)
+}
+
+// writeTargetDetails shows the device about to be written, and what it
+// holds, for the confirmation of a flash or of a wipe.
+func writeTargetDetails(w io.Writer, device string, offset int64, dev *deviceInfo) {
+	if dev == nil {
+		fmt.Fprintf(w, "  %-8s %s (no further information available)\n", "Target:", device)
+		return
+	}
+
+	fmt.Fprintf(w, "  %-8s %s\n", "Target:", dev.Path)
+	if dev.DriveType == "eMMC boot" {
+		fmt.Fprintf(w, "  %-8s eMMC boot partition, made writable for the flash\n", "")
+	}
+	if offset > 0 {
+		fmt.Fprintf(w, "  %-8s %d bytes (%d sectors)\n", "Offset:", offset, offset/512)
+	}
+	fmt.Fprintf(w, "  %-8s %s\n", "Model:", orUnknown(strings.TrimSpace(firstNonEmpty(dev.Vendor)+" "+firstNonEmpty(dev.Model))))
+	fmt.Fprintf(w, "  %-8s %s\n", "Serial:", orUnknown(firstNonEmpty(dev.Serial)))
+	fmt.Fprintf(w, "  %-8s %s (%s, removable: %t)\n", "Size:", formatSize(dev.SizeBytes), dev.Bus, dev.Removable)
+	if len(dev.Partitions) == 0 {
+		fmt.Fprintf(w, "  %-8s none\n", "Content:")
+		return
+	}
+	fmt.Fprintf(w, "  %-8s\n", "Content:")
+	for _, p := range dev.Partitions {
+		fs := p.Type
+		if fs == "" {
+			fs = "unknown"
+		}
+		line := fmt.Sprintf("    %-16s %10s  %-8s", p.Path, formatSize(p.SizeBytes), fs)
+		if p.Label != "" {
+			line += "  label=" + p.Label
+		}
+		if p.MountPoint != "" {
+			line += "  mounted on " + p.MountPoint
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// lookupDeviceInfo returns the enumerated metadata of device, or nil if
+// it is not available.
+func lookupDeviceInfo(device string) *deviceInfo {
+	devices, err := collectDevices()
+	if err != nil {
+		logger.Debug("device enumeration failed", "err", err)
+		return nil
+	}
+	dev, err := resolveTarget(targetSelector{Kind: "path", Value: blockDiskPath(device)}, devices)
+	if err != nil {
+		return nil
+	}
+	return &dev
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWriteFlashDetails verifica le informazioni mostrate prima della conferma.
+func TestWriteFlashDetails(t *testing.T) {
+	var out strings.Builder
+	dev := testDevices[0]
+	dev.Partitions[0].Label = "boot"
+	writeFlashDetails(&out, "/home/user/Downloads/raspios.img", 4<<30, dev.Path, 8192*512, &dev)
+
+	for _, want := range []string{"raspios.img (4.00 GiB)", "/dev/sdb", "Ultra", "ABC123", "32.00 GiB", "/dev/sdb1", "vfat", "8192 sectors", "label=boot", "mounted on /media/boot"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("I dettagli non contengono %q. Got: %q", want, out.String())
+		}
+	}
+
+	out.Reset()
+	writeFlashDetails(&out, "raspios.img", 1, "/dev/sdz", 0, nil)
+	if !strings.Contains(out.String(), "/dev/sdz (no further information available)") {
+		t.Errorf("Dettagli inattesi senza informazioni sul dispositivo. Got: %q", out.String())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+	"github.com/jaypipes/ghw"
+)
+
+// deviceEnumerator lists the block devices of the system. Listing, target
+// resolution and watch mode only see the devices through it, so that they
+// can run against a fixed list in the tests and other backends (sysfs
+// parsing, native Windows APIs) can replace ghw.
+type deviceEnumerator interface {
+	Devices() ([]deviceInfo, error)
+}
+
+// enumerator is the deviceEnumerator used by collectDevices.
+var enumerator = defaultEnumerator
+
+// collectDevices returns the block devices detected on the system.
+func collectDevices() ([]deviceInfo, error) {
+	return enumerator.Devices()
+}
+
+// fallbackEnumerator lists the devices with primary or, when it fails,
+// with fallback.
+type fallbackEnumerator struct {
+	primary, fallback deviceEnumerator
+}
+
+func (e fallbackEnumerator) Devices() ([]deviceInfo, error) {
+	devices, err := e.primary.Devices()
+	if err == nil {
+		return devices, nil
+	}
+	logger.Debug("device enumeration failed, using the fallback", "err", err)
+	devices, ferr := e.fallback.Devices()
+	if ferr != nil {
+		return nil, errors.Join(err, ferr)
+	}
+	return devices, nil
+}
+
+// ghwEnumerator enumerates the devices through ghw, which reads sysfs and
+// udev on Linux and WMI on Windows.
+type ghwEnumerator struct{}
+
+func (ghwEnumerator) Devices() ([]deviceInfo, error) {
+	block, err := ghw.Block()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]deviceInfo, 0, len(block.Disks))
+	for _, disk := range block.Disks {
+		// nvme0c0n1 è un percorso nascosto del namespace nvme0n1.
+		if flasher.IsNVMePath(disk.Name) {
+			continue
+		}
+		dev := newDeviceInfo(disk)
+		if flasher.IsNVMeNamespace(dev.Path) {
+			fillNVMeIdentity(&dev)
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// fillNVMeIdentity completes the model and serial of an NVMe namespace,
+// which ghw reads from the udev database, with the answer of the
+// controller to Identify or, without access to the device, its sysfs
+// attributes.
+func fillNVMeIdentity(dev *deviceInfo) {
+	if firstNonEmpty(dev.Model) != "" && firstNonEmpty(dev.Serial) != "" {
+		return
+	}
+	model, serial := "", ""
+	if info, err := flasher.NVMeIdentify(dev.Path); err == nil {
+		model, serial = info.Model, info.Serial
+	} else {
+		ctrl := filepath.Join("/sys/class/block", filepath.Base(dev.Path), "device")
+		model, serial = readSysfs(filepath.Join(ctrl, "model")), readSysfs(filepath.Join(ctrl, "serial"))
+	}
+	if firstNonEmpty(dev.Model) == "" {
+		dev.Model = model
+	}
+	if firstNonEmpty(dev.Serial) == "" {
+		dev.Serial = serial
+	}
+}
+
+// readSysfs returns the trimmed content of a sysfs attribute, or "".
+func readSysfs(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// newDeviceInfo converts a ghw disk into a deviceInfo.
+func newDeviceInfo(disk *ghw.Disk) deviceInfo {
+	dev := deviceInfo{
+		Path:        "/dev/" + disk.Name,
+		SizeBytes:   disk.SizeBytes,
+		Model:       disk.Model,
+		Vendor:      disk.Vendor,
+		Serial:      disk.SerialNumber,
+		Bus:         busName(disk.StorageController, disk.BusPath),
+		DriveType:   disk.DriveType.String(),
+		Removable:   disk.IsRemovable,
+		Partitions:  []partitionInfo{},
+		Mountpoints: []string{},
+	}
+	// Le partizioni di boot eMMC sono dischi a sé, di pochi MiB.
+	if flasher.IsBootPartition(dev.Path) {
+		dev.DriveType = "eMMC boot"
+	}
+	for _, p := range disk.Partitions {
+		dev.Partitions = append(dev.Partitions, partitionInfo{
+			Path:       "/dev/" + p.Name,
+			SizeBytes:  p.SizeBytes,
+			Type:       p.Type,
+			Label:      firstNonEmpty(p.FilesystemLabel, p.Label),
+			UUID:       p.UUID,
+			MountPoint: p.MountPoint,
+			ReadOnly:   p.IsReadOnly,
+		})
+		if p.MountPoint != "" {
+			dev.Mountpoints = append(dev.Mountpoints, p.MountPoint)
+		}
+	}
+	return dev
+}
+
+// busName returns a short lowercase name for the bus a disk is attached to.
+// USB mass storage shows up as SCSI in the storage controller, so the bus
+// path is checked first.
+func busName(controller ghw.StorageController, busPath string) string {
+	if strings.Contains(busPath, "-usb-") {
+		return "usb"
+	}
+	return strings.ToLower(controller.String())
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" && v != "unknown" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,5 @@
+package main
+
+// defaultEnumerator lists the physical disks through diskutil, since ghw
+// does not support macOS.
+var defaultEnumerator deviceEnumerator = diskutilEnumerator{run: runDiskutil}
@@ -0,0 +1,5 @@
+package main
+
+// defaultEnumerator lists the disks through GEOM, since ghw does not
+// support FreeBSD.
+var defaultEnumerator deviceEnumerator = geomEnumerator{run: runCommand}
@@ -0,0 +1,5 @@
+package main
+
+// defaultEnumerator lists the disks through ghw and, where ghw cannot read
+// sysfs or udev (containers, minimal initramfs), from /proc/partitions.
+var defaultEnumerator deviceEnumerator = fallbackEnumerator{ghwEnumerator{}, procEnumerator{root: "/"}}
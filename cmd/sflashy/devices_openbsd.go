@@ -0,0 +1,5 @@
+package main
+
+// defaultEnumerator lists the disks through sysctl and disklabel, since
+// ghw does not support OpenBSD.
+var defaultEnumerator deviceEnumerator = disklabelEnumerator{run: runCommand}
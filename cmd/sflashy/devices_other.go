@@ -0,0 +1,5 @@
+//go:build !darwin && !freebsd && !linux && !openbsd
+
+package main
+
+var defaultEnumerator deviceEnumerator = ghwEnumerator{}
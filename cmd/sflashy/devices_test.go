@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeEnumerator restituisce un elenco fisso di dispositivi, o err.
+type fakeEnumerator struct {
+	devices []deviceInfo
+	err     error
+}
+
+func (e fakeEnumerator) Devices() ([]deviceInfo, error) { return e.devices, e.err }
+
+// useEnumerator sostituisce l'enumeratore dei dispositivi per la durata
+// del test.
+func useEnumerator(t *testing.T, e deviceEnumerator) {
+	t.Helper()
+	saved := enumerator
+	enumerator = e
+	t.Cleanup(func() { enumerator = saved })
+}
+
+// TestFindTargetEnumerated verifica la risoluzione dei selettori sui
+// dispositivi forniti dall'enumeratore.
+func TestFindTargetEnumerated(t *testing.T) {
+	useEnumerator(t, fakeEnumerator{devices: testDevices})
+	path, err := findTarget(targetSelector{Kind: "serial", Value: "ABC123"})
+	if err != nil || path != "/dev/sdb" {
+		t.Errorf("findTarget(serial:ABC123) = %q, %v; want /dev/sdb", path, err)
+	}
+	if _, err := findTarget(targetSelector{Kind: "model", Value: "Extreme"}); !errors.Is(err, errNoMatchingDevice) {
+		t.Errorf("Un modello assente dovrebbe restituire errNoMatchingDevice. Got: %v", err)
+	}
+	if dev := lookupDeviceInfo("/dev/sdb"); dev == nil || dev.Serial != "ABC123" {
+		t.Errorf("lookupDeviceInfo(/dev/sdb) = %+v", dev)
+	}
+
+	broken := errors.New("enumeration failed")
+	useEnumerator(t, fakeEnumerator{err: broken})
+	if _, err := findTarget(targetSelector{Kind: "serial", Value: "ABC123"}); !errors.Is(err, broken) {
+		t.Errorf("L'errore dell'enumeratore dovrebbe essere restituito. Got: %v", err)
+	}
+	if dev := lookupDeviceInfo("/dev/sdb"); dev != nil {
+		t.Errorf("Senza enumerazione lookupDeviceInfo dovrebbe restituire nil. Got: %+v", dev)
+	}
+}
+
+// TestPollWatcherKnown verifica che i dispositivi già presenti non siano
+// considerati nuovi.
+func TestPollWatcherKnown(t *testing.T) {
+	useEnumerator(t, fakeEnumerator{devices: testDevices})
+	w, err := newPollWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.known["/dev/sdb"] || len(w.known) != 1 {
+		t.Errorf("Dispositivi noti errati. Got: %v", w.known)
+	}
+}
+
+// TestFallbackEnumerator verifica che l'enumeratore di riserva venga usato
+// solo quando il primo fallisce.
+func TestFallbackEnumerator(t *testing.T) {
+	broken := errors.New("ghw failed")
+	e := fallbackEnumerator{fakeEnumerator{err: broken}, fakeEnumerator{devices: testDevices}}
+	if devices, err := e.Devices(); err != nil || len(devices) != len(testDevices) {
+		t.Errorf("Dovrebbe usare l'enumeratore di riserva. Got: %v, %v", devices, err)
+	}
+	e = fallbackEnumerator{fakeEnumerator{devices: testDevices[:0]}, fakeEnumerator{err: broken}}
+	if devices, err := e.Devices(); err != nil || len(devices) != 0 {
+		t.Errorf("Dovrebbe usare il primo enumeratore. Got: %v, %v", devices, err)
+	}
+	e = fallbackEnumerator{fakeEnumerator{err: broken}, fakeEnumerator{err: errors.New("no /proc")}}
+	if _, err := e.Devices(); !errors.Is(err, broken) {
+		t.Errorf("Entrambi gli errori dovrebbero essere restituiti. Got: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// disklabelEnumerator enumerates the disks of OpenBSD: hw.disknames names
+// them, disklabel(8) describes them and the boot messages tell their
+// vendor, whether they are removable and which ones sit behind a USB mass
+// storage bridge. run executes a command and returns its output.
+type disklabelEnumerator struct {
+	run func(name string, args ...string) ([]byte, error)
+}
+
+func (e disklabelEnumerator) Devices() ([]deviceInfo, error) {
+	out, err := e.run("sysctl", "-n", "hw.disknames")
+	if err != nil {
+		return nil, err
+	}
+	dmesg, _ := e.run("dmesg")
+	attach := openbsdAttachments(string(dmesg))
+	mounts, _ := e.run("mount")
+	var devices []deviceInfo
+	for _, entry := range strings.Split(strings.TrimSpace(string(out)), ",") {
+		name, duid, _ := strings.Cut(entry, ":")
+		// I lettori ottici e i dischi virtuali non sono destinazioni.
+		if !strings.HasPrefix(name, "sd") && !strings.HasPrefix(name, "wd") {
+			continue
+		}
+		label, err := e.run("disklabel", name)
+		if err != nil {
+			continue // nessun supporto inserito nel lettore
+		}
+		dev := newDisklabelDeviceInfo(name, string(label), attach[name])
+		if duid != "" {
+			// Le partizioni si montano anche come <duid>.a in fstab.
+			for i, p := range dev.Partitions {
+				dev.Partitions[i].UUID = duid + "." + p.Path[len(p.Path)-1:]
+			}
+		}
+		fillMountpoints(&dev, string(mounts))
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// openbsdDisk is what the boot messages tell about a disk.
+type openbsdDisk struct {
+	Vendor, Model string
+	Removable     bool
+	USB           bool
+}
+
+var (
+	// sd1 at scsibus4 targ 1 lun 0: <SanDisk, Ultra Fit, 1.00> removable serial.07815583...
+	attachDisk = regexp.MustCompile(`^(\w+) at (\w+) [^<]*<([^,>]*),\s*([^,>]*)[^>]*>(.*)$`)
+	// scsibus4 at umass0: 2 targets, initiator 0
+	attachBus = regexp.MustCompile(`^(\w+) at (\w+?)\d+`)
+)
+
+// openbsdAttachments reads the disks attached in the boot messages.
+func openbsdAttachments(dmesg string) map[string]openbsdDisk {
+	disks := map[string]openbsdDisk{}
+	busDriver := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(dmesg))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := attachDisk.FindStringSubmatch(line); m != nil {
+			disks[m[1]] = openbsdDisk{
+				Vendor:    strings.TrimSpace(m[3]),
+				Model:     strings.TrimSpace(m[4]),
+				Removable: strings.Contains(m[5], "removable"),
+				USB:       busDriver[m[2]] == "umass",
+			}
+			continue
+		}
+		if m := attachBus.FindStringSubmatch(line); m != nil {
+			busDriver[m[1]] = m[2]
+		}
+	}
+	return disks
+}
+
+// newDisklabelDeviceInfo converts the disklabel of a disk into a
+// deviceInfo. The path is the raw device of the whole disk, /dev/rsd1c.
+func newDisklabelDeviceInfo(name, label string, attach openbsdDisk) deviceInfo {
+	dev := deviceInfo{
+		Path:        "/dev/r" + name + "c",
+		Vendor:      attach.Vendor,
+		Model:       attach.Model,
+		Bus:         "scsi",
+		DriveType:   "HDD",
+		Removable:   attach.Removable || attach.USB,
+		Partitions:  []partitionInfo{},
+		Mountpoints: []string{},
+	}
+	switch {
+	case attach.USB:
+		dev.Bus = "usb"
+	case strings.HasPrefix(name, "wd"):
+		dev.Bus = "ata"
+	}
+	var secsize, sectors uint64 = 512, 0
+	inPartitions := false
+	scanner := bufio.NewScanner(strings.NewReader(label))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, "partitions:") {
+			inPartitions = true
+			continue
+		}
+		if !inPartitions {
+			k, v, _ := strings.Cut(line, ":")
+			v = strings.TrimSpace(v)
+			switch k {
+			case "label":
+				if dev.Model == "" {
+					dev.Model = v
+				}
+			case "bytes/sector":
+				secsize, _ = strconv.ParseUint(v, 10, 64)
+			case "total sectors":
+				sectors, _ = strconv.ParseUint(v, 10, 64)
+			}
+			continue
+		}
+		// "a:  2097152  8192  4.2BSD  2048 16384 12960"
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields[0]) != 2 || fields[0][1] != ':' || fields[0][0] == 'c' {
+			continue
+		}
+		size, _ := strconv.ParseUint(fields[1], 10, 64)
+		dev.Partitions = append(dev.Partitions, partitionInfo{
+			Path:      "/dev/" + name + fields[0][:1],
+			SizeBytes: size * secsize,
+			Type:      fields[3],
+		})
+	}
+	dev.SizeBytes = sectors * secsize
+	return dev
+}
+
+// openbsdBlockDisk returns the block device name of an OpenBSD disk
+// (/dev/sd1 for /dev/rsd1c), to which the letter of a partition is
+// appended in the mount table.
+func openbsdBlockDisk(device string) string {
+	name, ok := strings.CutPrefix(device, "/dev/r")
+	if !ok {
+		name = strings.TrimPrefix(device, "/dev/")
+	}
+	return "/dev/" + strings.TrimRight(name, "abcdefghijklmnop")
+}
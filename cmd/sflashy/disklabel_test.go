@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestDisklabelEnumerator verifica l'elenco dei dischi di OpenBSD.
+func TestDisklabelEnumerator(t *testing.T) {
+	e := disklabelEnumerator{run: fakeCommands(map[string]string{
+		"sysctl -n hw.disknames": "sd0:3a9f0c1c2b3d4e5f,cd0:,sd1:\n",
+		"dmesg": `sd0 at scsibus1 targ 0 lun 0: <ATA, Samsung SSD 860, RVT0> naa.5002538e40a1b2c3
+scsibus4 at umass0: 2 targets, initiator 0
+sd1 at scsibus4 targ 1 lun 0: <SanDisk, Ultra Fit, 1.00> removable serial.07815583
+`,
+		"disklabel sd0": `# /dev/rsd0c:
+type: SCSI
+disk: SCSI disk
+label: Samsung SSD 860
+duid: 3a9f0c1c2b3d4e5f
+bytes/sector: 512
+total sectors: 976773168
+
+16 partitions:
+#                size           offset  fstype [fsize bsize   cpg]
+  a:          2097152               64  4.2BSD   2048 16384 12960 # /
+  c:        976773168                0  unused
+`,
+		"disklabel sd1": `# /dev/rsd1c:
+type: SCSI
+label: Ultra Fit
+bytes/sector: 512
+total sectors: 30310400
+
+16 partitions:
+#                size           offset  fstype [fsize bsize   cpg]
+  c:         30310400                0  unused
+  i:           524288             8192   MSDOS
+  j:          4194304           532480 ext2fs
+`,
+		"mount": "/dev/sd0a on / type ffs (local)\n/dev/sd1i on /mnt (msdos, local)\n",
+	})}
+	devices, err := e.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Attesi 2 dischi. Got: %+v", devices)
+	}
+	sd0, sd1 := devices[0], devices[1]
+	if sd0.Path != "/dev/rsd0c" || sd0.Vendor != "ATA" || sd0.Bus != "scsi" || sd0.Removable || sd0.SizeBytes != 976773168*512 {
+		t.Errorf("Disco sd0 errato. Got: %+v", sd0)
+	}
+	if len(sd0.Partitions) != 1 || sd0.Partitions[0].UUID != "3a9f0c1c2b3d4e5f.a" {
+		t.Errorf("Partizioni di sd0 errate. Got: %+v", sd0.Partitions)
+	}
+	if sd1.Path != "/dev/rsd1c" || sd1.Model != "Ultra Fit" || sd1.Bus != "usb" || !sd1.Removable {
+		t.Errorf("Disco sd1 errato. Got: %+v", sd1)
+	}
+	if len(sd1.Partitions) != 2 || sd1.Partitions[0].Path != "/dev/sd1i" || sd1.Partitions[1].Type != "ext2fs" || sd1.Partitions[0].SizeBytes != 524288*512 {
+		t.Errorf("Partizioni di sd1 errate. Got: %+v", sd1.Partitions)
+	}
+	if fmt.Sprint(sd1.Mountpoints) != "[/mnt]" {
+		t.Errorf("Mountpoint di sd1 errati. Got: %v", sd1.Mountpoints)
+	}
+	if got := openbsdBlockDisk("/dev/rsd1c"); got != "/dev/sd1" {
+		t.Errorf("openbsdBlockDisk(/dev/rsd1c) = %s", got)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// diskutilEnumerator enumerates the physical disks of macOS through
+// `diskutil list -plist` and `diskutil info -plist`. run executes diskutil
+// with the given arguments and returns its output.
+type diskutilEnumerator struct {
+	run func(args ...string) ([]byte, error)
+}
+
+// runDiskutil runs the diskutil command.
+func runDiskutil(args ...string) ([]byte, error) {
+	out, err := exec.Command("diskutil", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("diskutil %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (e diskutilEnumerator) Devices() ([]deviceInfo, error) {
+	list, err := e.plist("list", "-plist", "physical")
+	if err != nil {
+		return nil, err
+	}
+	disks, _ := list["AllDisksAndPartitions"].([]any)
+	devices := make([]deviceInfo, 0, len(disks))
+	for _, d := range disks {
+		disk, _ := d.(map[string]any)
+		id, _ := disk["DeviceIdentifier"].(string)
+		if id == "" {
+			continue
+		}
+		info, err := e.plist("info", "-plist", id)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, newDiskutilDeviceInfo(disk, info))
+	}
+	return devices, nil
+}
+
+// plist runs diskutil and decodes its property list output.
+func (e diskutilEnumerator) plist(args ...string) (map[string]any, error) {
+	out, err := e.run(args...)
+	if err != nil {
+		return nil, err
+	}
+	v, err := parsePlist(strings.NewReader(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("diskutil %s: %w", args[0], err)
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("diskutil %s: unexpected output", args[0])
+	}
+	return dict, nil
+}
+
+// newDiskutilDeviceInfo converts the entry of a disk in `diskutil list`
+// and its `diskutil info` into a deviceInfo.
+func newDiskutilDeviceInfo(disk, info map[string]any) deviceInfo {
+	id, _ := disk["DeviceIdentifier"].(string)
+	dev := deviceInfo{
+		Path:        "/dev/" + id,
+		SizeBytes:   plistUint(firstPresent(info["TotalSize"], info["Size"], disk["Size"])),
+		Model:       strings.TrimSpace(strings.TrimSuffix(plistString(info["MediaName"]), " Media")),
+		Bus:         strings.ToLower(plistString(info["BusProtocol"])),
+		DriveType:   "HDD",
+		Removable:   plistBool(info["RemovableMedia"]) || plistBool(info["Removable"]) || !plistBool(info["Internal"]),
+		Partitions:  []partitionInfo{},
+		Mountpoints: []string{},
+	}
+	if plistBool(info["SolidState"]) {
+		dev.DriveType = "SSD"
+	}
+	parts, _ := disk["Partitions"].([]any)
+	for _, p := range parts {
+		part, _ := p.(map[string]any)
+		pid := plistString(part["DeviceIdentifier"])
+		if pid == "" {
+			continue
+		}
+		mp := plistString(part["MountPoint"])
+		dev.Partitions = append(dev.Partitions, partitionInfo{
+			Path:       "/dev/" + pid,
+			SizeBytes:  plistUint(part["Size"]),
+			Type:       plistString(part["Content"]),
+			Label:      plistString(part["VolumeName"]),
+			UUID:       firstNonEmpty(plistString(part["VolumeUUID"]), plistString(part["DiskUUID"])),
+			MountPoint: mp,
+		})
+		if mp != "" {
+			dev.Mountpoints = append(dev.Mountpoints, mp)
+		}
+	}
+	return dev
+}
+
+func firstPresent(values ...any) any {
+	for _, v := range values {
+		if v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+func plistString(v any) string {
+	s, _ := v.(string)
+	return s
+}
+
+func plistBool(v any) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+func plistUint(v any) uint64 {
+	n, _ := v.(int64)
+	return uint64(max(n, 0))
+}
+
+// parsePlist decodes an XML property list into maps, slices, strings,
+// int64, float64 and bools. Dates are kept as strings and data as the
+// base64 text.
+func parsePlist(r io.Reader) (any, error) {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid property list: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return plistValue(dec, start)
+		}
+	}
+}
+
+// plistValue decodes the value starting at start.
+func plistValue(dec *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]any{}
+		var key string
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					if err := dec.DecodeElement(&key, &t); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				v, err := plistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = v
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		array := []any{}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				v, err := plistValue(dec, t)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		return start.Name.Local == "true", dec.Skip()
+	}
+	var text string
+	if err := dec.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+	switch start.Name.Local {
+	case "integer":
+		return strconv.ParseInt(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(text, 64)
+	}
+	return text, nil
+}
+
+// rawDiskPath returns the raw device of a macOS disk (/dev/rdisk2 for
+// /dev/disk2), which bypasses the buffer cache and is much faster to
+// write. Other paths are returned unchanged.
+func rawDiskPath(device string) string {
+	if rest, ok := strings.CutPrefix(device, "/dev/disk"); ok {
+		return "/dev/rdisk" + rest
+	}
+	return device
+}
+
+// blockDiskPath returns the block device of a macOS raw disk (/dev/disk2
+// for /dev/rdisk2), the name used by diskutil and the mount table.
+func blockDiskPath(device string) string {
+	if rest, ok := strings.CutPrefix(device, "/dev/rdisk"); ok {
+		return "/dev/disk" + rest
+	}
+	return device
+}
+
+// mountsOfMountOutput returns the mountpoints, read from the output of
+// mount(8) on macOS and the BSDs ("/dev/disk2s1 on /Volumes/boot (msdos,
+// local)"), of device itself and of its partitions.
+func mountsOfMountOutput(device string, output io.Reader) []string {
+	var mountpoints []string
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		source, rest, ok := strings.Cut(scanner.Text(), " on ")
+		if !ok || !isSameOrPartition(device, source) {
+			continue
+		}
+		if i := strings.LastIndex(rest, " ("); i >= 0 {
+			rest = rest[:i]
+		}
+		mountpoints = append(mountpoints, rest)
+	}
+	return mountpoints
+}
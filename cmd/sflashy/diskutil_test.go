@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const diskutilList = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>AllDisksAndPartitions</key>
+	<array>
+		<dict>
+			<key>Content</key>
+			<string>FDisk_partition_scheme</string>
+			<key>DeviceIdentifier</key>
+			<string>disk4</string>
+			<key>Partitions</key>
+			<array>
+				<dict>
+					<key>Content</key>
+					<string>Windows_FAT_32</string>
+					<key>DeviceIdentifier</key>
+					<string>disk4s1</string>
+					<key>MountPoint</key>
+					<string>/Volumes/bootfs</string>
+					<key>Size</key>
+					<integer>536870912</integer>
+					<key>VolumeName</key>
+					<string>bootfs</string>
+					<key>VolumeUUID</key>
+					<string>0B5F8E4C-3C1E-3B8A-9E2B-6A1F0C2D4E5F</string>
+				</dict>
+				<dict>
+					<key>Content</key>
+					<string>Linux</string>
+					<key>DeviceIdentifier</key>
+					<string>disk4s2</string>
+					<key>Size</key>
+					<integer>5368709120</integer>
+				</dict>
+			</array>
+			<key>Size</key>
+			<integer>31914983424</integer>
+		</dict>
+	</array>
+	<key>WholeDisks</key>
+	<array>
+		<string>disk4</string>
+	</array>
+</dict>
+</plist>
+`
+
+const diskutilInfo = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>BusProtocol</key>
+	<string>USB</string>
+	<key>DeviceNode</key>
+	<string>/dev/disk4</string>
+	<key>Internal</key>
+	<false/>
+	<key>MediaName</key>
+	<string>SanDisk Ultra Fit Media</string>
+	<key>RemovableMedia</key>
+	<true/>
+	<key>SolidState</key>
+	<false/>
+	<key>TotalSize</key>
+	<integer>31914983424</integer>
+</dict>
+</plist>
+`
+
+// TestDiskutilEnumerator verifica la conversione dell'output di diskutil
+// nei dispositivi elencati.
+func TestDiskutilEnumerator(t *testing.T) {
+	var calls []string
+	e := diskutilEnumerator{run: func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[0] == "list" {
+			return []byte(diskutilList), nil
+		}
+		return []byte(diskutilInfo), nil
+	}}
+	devices, err := e.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(calls) != "[list -plist physical info -plist disk4]" {
+		t.Errorf("Comandi diskutil errati. Got: %v", calls)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("Atteso un dispositivo. Got: %+v", devices)
+	}
+	dev := devices[0]
+	if dev.Path != "/dev/disk4" || dev.SizeBytes != 31914983424 || dev.Model != "SanDisk Ultra Fit" || dev.Bus != "usb" || !dev.Removable {
+		t.Errorf("Dispositivo errato. Got: %+v", dev)
+	}
+	if len(dev.Partitions) != 2 || dev.Partitions[0].Label != "bootfs" || dev.Partitions[0].Type != "Windows_FAT_32" {
+		t.Errorf("Partizioni errate. Got: %+v", dev.Partitions)
+	}
+	if fmt.Sprint(dev.Mountpoints) != "[/Volumes/bootfs]" {
+		t.Errorf("Mountpoint errati. Got: %v", dev.Mountpoints)
+	}
+
+	if _, err := (diskutilEnumerator{run: func(...string) ([]byte, error) { return []byte("<plist><dict>"), nil }}).Devices(); err == nil {
+		t.Error("Un output troncato dovrebbe restituire un errore")
+	}
+}
+
+// TestMountsOfMountOutput verifica la lettura dell'output di mount(8) e
+// la conversione tra disco e disco raw.
+func TestMountsOfMountOutput(t *testing.T) {
+	output := `/dev/disk3s1s1 on / (apfs, sealed, local, read-only, journaled)
+/dev/disk4s1 on /Volumes/NO NAME (msdos, local, nodev, nosuid, noowners, noatime)
+/dev/disk4s2 on /Volumes/rootfs (ext4, local)
+/dev/disk41s1 on /Volumes/other (msdos, local)
+`
+	got := mountsOfMountOutput("/dev/disk4", strings.NewReader(output))
+	if strings.Join(got, ",") != "/Volumes/NO NAME,/Volumes/rootfs" {
+		t.Errorf("Mountpoint di /dev/disk4 errati. Got: %v", got)
+	}
+	if rawDiskPath("/dev/disk4") != "/dev/rdisk4" || blockDiskPath("/dev/rdisk4") != "/dev/disk4" {
+		t.Errorf("Conversione disco/raw errata: %s %s", rawDiskPath("/dev/disk4"), blockDiskPath("/dev/rdisk4"))
+	}
+	if rawDiskPath("/dev/sdb") != "/dev/sdb" || blockDiskPath("/dev/sdb") != "/dev/sdb" {
+		t.Error("I percorsi non macOS non dovrebbero cambiare")
+	}
+}
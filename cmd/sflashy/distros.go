@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// distro resolves the image names of a distribution, like
+// "ubuntu-24.04-server-arm64", to the image published by the distribution
+// and its official checksum.
+type distro struct {
+	name string
+	// example is a name that pattern matches, for `sflashy catalog
+	// --distros`.
+	example string
+	pattern *regexp.Regexp
+	// source returns where the image of the submatches of pattern is.
+	source func(m []string) distroSource
+	// keyring, if set, has the keys the signature of the checksums must
+	// be made with.
+	keyring string
+}
+
+// distroSource is where a distribution publishes an image.
+type distroSource struct {
+	// Dir is the URL of the directory of the image and of its checksums.
+	Dir string
+	// Sums is the name of the checksum file in Dir or, when it changes
+	// with each build, SumsPattern matches it in the listing of Dir.
+	Sums, SumsPattern string
+	// File matches the name of the image in the checksum file; of
+	// several, the last in order is taken.
+	File string
+	// URL is the image, if it is not Dir followed by its name.
+	URL string
+	// Signature is the name in Dir of the signature of the checksum
+	// file, or "inline" for a checksum file signed in clear.
+	Signature string
+}
+
+// distroImage is an image resolved by a distro.
+type distroImage struct {
+	Distro, Name, URL, SHA256 string
+}
+
+// distros are the distributions known, tried in order: those of the
+// configuration come first.
+var distros = []*distro{
+	{
+		name:    "ubuntu",
+		example: "ubuntu-24.04-server-arm64",
+		pattern: regexp.MustCompile(`^ubuntu-(\d+\.\d+)-(server|desktop)-(amd64|arm64|raspi)$`),
+		source:  ubuntuSource,
+	},
+	{
+		name:    "fedora",
+		example: "fedora-42-workstation-x86_64",
+		pattern: regexp.MustCompile(`^fedora-(\d+)-(workstation|server)-(x86_64|aarch64)$`),
+		source:  fedoraSource,
+	},
+	{
+		name:    "debian",
+		example: "debian-13-netinst-amd64",
+		pattern: regexp.MustCompile(`^debian-(\d+)-netinst-(amd64|arm64)$`),
+		source: func(m []string) distroSource {
+			// Solo l'ultima versione è in current.
+			return distroSource{
+				Dir:  "https://cdimage.debian.org/debian-cd/current/" + m[2] + "/iso-cd/",
+				Sums: "SHA256SUMS", Signature: "SHA256SUMS.sign",
+				File: `debian-` + m[1] + `\.\d+(\.\d+)?-` + m[2] + `-netinst\.iso`,
+			}
+		},
+	},
+	{
+		name:    "armbian",
+		example: "armbian-rock-5b-bookworm-minimal",
+		pattern: regexp.MustCompile(`^armbian-([a-z0-9-]+)-(bookworm|trixie|jammy|noble)-(minimal|server|xfce|gnome|cinnamon|kde-neon)$`),
+		source: func(m []string) distroSource {
+			// dl.armbian.com rimanda all'ultima immagine della scheda, e il
+			// suo checksum è lo stesso indirizzo con .sha.
+			build := strings.ToUpper(m[2][:1]) + m[2][1:] + "_current_" + m[3]
+			dir := "https://dl.armbian.com/" + m[1] + "/"
+			return distroSource{Dir: dir, Sums: build + ".sha", File: `.*`, URL: dir + build}
+		},
+	},
+}
+
+// ubuntuSource returns where Ubuntu publishes the image of the version
+// m[1], kind m[2] (server or desktop) and architecture m[3], raspi for
+// the preinstalled images of the Raspberry Pi.
+func ubuntuSource(m []string) distroSource {
+	version, kind, arch := m[1], m[2], m[3]
+	src := distroSource{
+		Dir:  "https://cdimage.ubuntu.com/releases/" + version + "/release/",
+		Sums: "SHA256SUMS", Signature: "SHA256SUMS.gpg",
+	}
+	// Le versioni di manutenzione (24.04.2) hanno lo stesso nome.
+	prefix := `ubuntu-` + regexp.QuoteMeta(version) + `(\.\d+)*-`
+	switch {
+	case arch == "raspi":
+		src.File = prefix + `preinstalled-` + kind + `-arm64\+raspi\.img\.xz`
+	case kind == "server":
+		src.File = prefix + `live-server-` + arch + `\.iso`
+	default:
+		src.File = prefix + `desktop-` + arch + `\.iso`
+	}
+	if arch == "amd64" {
+		src.Dir = "https://releases.ubuntu.com/" + version + "/"
+	}
+	return src
+}
+
+// fedoraSource returns where Fedora publishes the image of the release
+// m[1], edition m[2] and architecture m[3]: the live ISO of Workstation,
+// the installer of Server or, on aarch64, its raw image for boards.
+func fedoraSource(m []string) distroSource {
+	release, arch := m[1], m[3]
+	src := distroSource{Signature: "inline"}
+	base := "https://download.fedoraproject.org/pub/fedora/linux/releases/" + release + "/"
+	switch {
+	case m[2] == "workstation":
+		src.Dir = base + "Workstation/" + arch + "/iso/"
+		src.SumsPattern, src.File = `Fedora-Workstation-.*-CHECKSUM`, `Fedora-Workstation-Live-.*\.iso`
+	case arch == "aarch64":
+		src.Dir = base + "Server/" + arch + "/images/"
+		src.SumsPattern, src.File = `Fedora-Server-.*-CHECKSUM`, `Fedora-Server-.*\.raw\.xz`
+	default:
+		src.Dir = base + "Server/" + arch + "/iso/"
+		src.SumsPattern, src.File = `Fedora-Server-.*-CHECKSUM`, `Fedora-Server-dvd-.*\.iso`
+	}
+	return src
+}
+
+// distroConfig is an entry of the distros key of the configuration: the
+// keyring of a distribution known, or a distribution to add, whose
+// fields can refer to the submatches of pattern as $1, $2...
+type distroConfig struct {
+	Name        string `yaml:"name"`
+	Keyring     string `yaml:"keyring"`
+	Pattern     string `yaml:"pattern"`
+	Dir         string `yaml:"dir"`
+	Sums        string `yaml:"sums"`
+	SumsPattern string `yaml:"sums_pattern"`
+	File        string `yaml:"file"`
+	URL         string `yaml:"url"`
+	Signature   string `yaml:"signature"`
+}
+
+// registerDistros adds the distributions of the configuration, or sets
+// the keyrings of those known.
+func registerDistros(configs []distroConfig) error {
+	added := 0
+	for _, c := range configs {
+		if c.Keyring != "" && !filepath.IsAbs(c.Keyring) {
+			return fmt.Errorf("distro %s: the keyring must be an absolute path", c.Name)
+		}
+		if c.Pattern == "" {
+			i := slices.IndexFunc(distros, func(d *distro) bool { return d.name == c.Name })
+			if i < 0 {
+				return fmt.Errorf("distro %s: unknown, set its pattern", c.Name)
+			}
+			distros[i].keyring = c.Keyring
+			continue
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return fmt.Errorf("distro %s: %w", c.Name, err)
+		}
+		if c.Dir == "" || c.File == "" || (c.Sums == "") == (c.SumsPattern == "") {
+			return fmt.Errorf("distro %s: dir, file and one of sums and sums_pattern are needed", c.Name)
+		}
+		distros = slices.Insert(distros, added, &distro{name: c.Name, pattern: re, keyring: c.Keyring, source: func(m []string) distroSource {
+			expand := func(s string) string {
+				return os.Expand(s, func(k string) string {
+					if i, err := strconv.Atoi(k); err == nil && i < len(m) {
+						return m[i]
+					}
+					return "$" + k
+				})
+			}
+			return distroSource{
+				Dir: expand(c.Dir), Sums: expand(c.Sums), SumsPattern: expand(c.SumsPattern),
+				File: expand(c.File), URL: expand(c.URL), Signature: c.Signature,
+			}
+		}})
+		added++
+		logger.Debug("distro registered", "name", c.Name, "pattern", c.Pattern)
+	}
+	return nil
+}
+
+// matchDistro returns the distribution whose pattern matches name, and the
+// submatches; nil if none does.
+func matchDistro(name string) (*distro, []string) {
+	for _, d := range distros {
+		if m := d.pattern.FindStringSubmatch(name); m != nil {
+			return d, m
+		}
+	}
+	return nil, nil
+}
+
+// resolveDistro returns the image of name, with the SHA-256 of its
+// checksum file, checking the signature of the file if the distribution
+// has a keyring. It fails with errNoDistro if no distribution knows name.
+func resolveDistro(ctx context.Context, name string) (distroImage, error) {
+	d, m := matchDistro(name)
+	if d == nil {
+		return distroImage{}, fmt.Errorf("%w: %s", errNoDistro, name)
+	}
+	src := d.source(m)
+	sumsName := src.Sums
+	if src.SumsPattern != "" {
+		var err error
+		if sumsName, err = findListed(ctx, src.Dir, src.SumsPattern); err != nil {
+			return distroImage{}, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	sums, err := fetchURL(ctx, src.Dir+sumsName)
+	if err != nil {
+		return distroImage{}, fmt.Errorf("%s: %w", name, err)
+	}
+	switch {
+	case d.keyring == "":
+		logger.Warn("the signature of the checksums is not checked: set a keyring for the distro in the configuration", "distro", d.name)
+	case src.Signature == "":
+		logger.Warn("the distro does not sign its checksums", "distro", d.name)
+	case src.Signature == "inline":
+		err = checkSignature(ctx, d.keyring, sums, nil)
+	default:
+		var sig []byte
+		if sig, err = fetchURL(ctx, src.Dir+src.Signature); err == nil {
+			err = checkSignature(ctx, d.keyring, sums, sig)
+		}
+	}
+	if err != nil {
+		return distroImage{}, fmt.Errorf("%s: checksums of %s%s: %w", name, src.Dir, sumsName, err)
+	}
+
+	file, digest, err := findChecksum(sums, src.File)
+	if err != nil {
+		return distroImage{}, fmt.Errorf("%s: %s%s: %w", name, src.Dir, sumsName, err)
+	}
+	img := distroImage{Distro: d.name, Name: name, URL: src.URL, SHA256: digest}
+	if img.URL == "" {
+		img.URL = src.Dir + url.PathEscape(file)
+	}
+	return img, nil
+}
+
+// fetchDistroImage downloads the image of name to cache, checking its
+// SHA-256, and returns its path.
+func fetchDistroImage(ctx context.Context, cache *imageCache, name string) (string, error) {
+	img, err := resolveDistro(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("image of the distro found", "distro", img.Distro, "image", name, "url", img.URL, "sha256", img.SHA256)
+	return cache.fetch(ctx, img.URL, img.SHA256)
+}
+
+// errNoDistro is returned by resolveDistro for a name no distribution
+// knows.
+var errNoDistro = errors.New("not the name of an image of a known distro")
+
+// linkPattern matches the links of a directory listing.
+var linkPattern = regexp.MustCompile(`href="([^"/?#]+)"`)
+
+// findListed returns the latest version (see compareVersions) matching
+// pattern among the links of the listing of the directory dir.
+func findListed(ctx context.Context, dir, pattern string) (string, error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return "", err
+	}
+	page, err := fetchURL(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, m := range linkPattern.FindAllSubmatch(page, -1) {
+		if name, err := url.PathUnescape(string(m[1])); err == nil && re.MatchString(name) {
+			found = append(found, name)
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no file of %s matches %s", dir, pattern)
+	}
+	slices.SortFunc(found, compareVersions)
+	return found[len(found)-1], nil
+}
+
+// compareVersions compares two file names as versions: the runs of digits
+// by their value, the rest as text, so that debian-12.10.0 comes after
+// debian-12.9.0.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		x, restA := versionPart(a)
+		y, restB := versionPart(b)
+		if isDigit(x[0]) && isDigit(y[0]) {
+			// Senza gli zeri iniziali il numero più lungo è il maggiore.
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if c := cmp.Compare(len(x), len(y)); c != 0 {
+				return c
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// versionPart splits s after its leading run of digits, or of other
+// characters.
+func versionPart(s string) (part, rest string) {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// bsdChecksum matches a line of a checksum file in the BSD format, as
+// Fedora writes them.
+var bsdChecksum = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+
+// findChecksum returns the latest version of the files matching pattern
+// in the checksum file sums, and its SHA-256. Both the format of sha256sum
+// ("<digest>  <file>", with a '*' before binary files) and the BSD
+// one are read; a line with a digest alone is a file without a name.
+func findChecksum(sums []byte, pattern string) (file, digest string, err error) {
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return "", "", err
+	}
+	found := map[string]string{}
+	for _, line := range strings.Split(string(sums), "\n") {
+		line = strings.TrimSpace(line)
+		var name, sum string
+		if m := bsdChecksum.FindStringSubmatch(line); m != nil {
+			name, sum = m[1], m[2]
+		} else if fields := strings.Fields(line); len(fields) > 0 && digestPattern.MatchString(strings.ToLower(fields[0])) {
+			sum = fields[0]
+			name = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, fields[0])), "*")
+		} else {
+			continue
+		}
+		if re.MatchString(name) {
+			found[name] = strings.ToLower(sum)
+		}
+	}
+	if len(found) == 0 {
+		return "", "", fmt.Errorf("no image matches %s", pattern)
+	}
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, compareVersions)
+	file = names[len(names)-1]
+	return file, found[file], nil
+}
+
+// writeDistros writes the distributions known, with the pattern of their
+// names and an example.
+func writeDistros(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DISTRO\tEXAMPLE\tPATTERN\tSIGNATURE")
+	for _, d := range distros {
+		keyring := "not checked"
+		if d.keyring != "" {
+			keyring = d.keyring
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.name, cmp.Or(d.example, "-"), d.pattern, keyring)
+	}
+	return tw.Flush()
+}
+
+// checkSignature checks with gpgv that sig, or sums itself if sig is nil,
+// is a signature of sums made with a key of keyring.
+func checkSignature(ctx context.Context, keyring string, sums, sig []byte) error {
+	gpgv, err := exec.LookPath("gpgv")
+	if err != nil {
+		return fmt.Errorf("gpgv is needed to check the signature: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "sflashy-sums-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	files := []string{filepath.Join(dir, "sums")}
+	if err := os.WriteFile(files[0], sums, 0o600); err != nil {
+		return err
+	}
+	if sig != nil {
+		files = append([]string{filepath.Join(dir, "sums.sig")}, files...)
+		if err := os.WriteFile(files[0], sig, 0o600); err != nil {
+			return err
+		}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gpgv, append([]string{"--keyring", keyring}, files...)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("invalid signature: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	logger.Info("signature of the checksums checked", "keyring", keyring)
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestDistroSources verifica dove vengono cercate le immagini delle
+// distribuzioni note.
+func TestDistroSources(t *testing.T) {
+	for name, want := range map[string]struct{ dir, file string }{
+		"ubuntu-24.04-server-arm64":        {"https://cdimage.ubuntu.com/releases/24.04/release/", "ubuntu-24.04.2-live-server-arm64.iso"},
+		"ubuntu-24.04-desktop-amd64":       {"https://releases.ubuntu.com/24.04/", "ubuntu-24.04-desktop-amd64.iso"},
+		"ubuntu-24.04-server-raspi":        {"https://cdimage.ubuntu.com/releases/24.04/release/", "ubuntu-24.04.1-preinstalled-server-arm64+raspi.img.xz"},
+		"fedora-42-server-aarch64":         {"https://download.fedoraproject.org/pub/fedora/linux/releases/42/Server/aarch64/images/", "Fedora-Server-Host-Generic-42-1.1.aarch64.raw.xz"},
+		"debian-13-netinst-arm64":          {"https://cdimage.debian.org/debian-cd/current/arm64/iso-cd/", "debian-13.1.0-arm64-netinst.iso"},
+		"armbian-rock-5b-bookworm-minimal": {"https://dl.armbian.com/rock-5b/", "Armbian_25.8.1_Rock-5b_bookworm_vendor_6.1.115_minimal.img.xz"},
+	} {
+		d, m := matchDistro(name)
+		if d == nil {
+			t.Errorf("%s: nessuna distribuzione", name)
+			continue
+		}
+		src := d.source(m)
+		if src.Dir != want.dir || !regexp.MustCompile(`^(?:`+src.File+`)$`).MatchString(want.file) {
+			t.Errorf("%s: got %+v", name, src)
+		}
+	}
+	if d, _ := matchDistro("armbian-rock-5b-bookworm-minimal"); d.source(d.pattern.FindStringSubmatch("armbian-rock-5b-bookworm-minimal")).URL != "https://dl.armbian.com/rock-5b/Bookworm_current_minimal" {
+		t.Error("Indirizzo di Armbian errato")
+	}
+	for _, name := range []string{"ubuntu-24.04", "raspios.img.xz", "debian-13-netinst-i386"} {
+		if d, _ := matchDistro(name); d != nil {
+			t.Errorf("%s non è un'immagine di una distribuzione. Got: %s", name, d.name)
+		}
+	}
+	if _, err := resolveDistro(context.Background(), "ubuntu"); !errors.Is(err, errNoDistro) {
+		t.Errorf("Errore atteso errNoDistro. Got: %v", err)
+	}
+}
+
+// TestFindChecksum verifica la lettura dei file di checksum nei formati
+// di sha256sum e BSD, anche firmati in chiaro.
+func TestFindChecksum(t *testing.T) {
+	a, b, c := strings.Repeat("a", 64), strings.Repeat("B", 64), strings.Repeat("c", 64)
+	sums := "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\n" +
+		"# Fedora-Server-42-1.1-aarch64-CHECKSUM\n" +
+		"SHA256 (Fedora-Server-Host-Generic-42-1.1.aarch64.raw.xz) = " + a + "\n" +
+		b + " *ubuntu-24.04.2-live-server-arm64.iso\n" +
+		c + "  ubuntu-24.04.10-live-server-arm64.iso\n" +
+		"-----BEGIN PGP SIGNATURE-----\n"
+	for pattern, want := range map[string]string{
+		`Fedora-Server-.*\.raw\.xz`:                    "Fedora-Server-Host-Generic-42-1.1.aarch64.raw.xz " + a,
+		`ubuntu-24\.04(\.\d+)*-live-server-arm64\.iso`: "ubuntu-24.04.10-live-server-arm64.iso " + c,
+		`ubuntu-24\.04\.\d-live-server-arm64\.iso`:     "ubuntu-24.04.2-live-server-arm64.iso " + strings.ToLower(b),
+	} {
+		if file, digest, err := findChecksum([]byte(sums), pattern); err != nil || file+" "+digest != want {
+			t.Errorf("%s: got %s %s, %v", pattern, file, digest, err)
+		}
+	}
+	if file, digest, err := findChecksum([]byte(a+"\n"), `.*`); err != nil || file != "" || digest != a {
+		t.Errorf("Checksum senza nome. Got: %q %s, %v", file, digest, err)
+	}
+	if _, _, err := findChecksum([]byte(sums), `debian-.*\.iso`); err == nil {
+		t.Error("Nessuna immagine doveva corrispondere")
+	}
+}
+
+// TestCompareVersions verifica che le versioni si confrontino per
+// valore e non come testo.
+func TestCompareVersions(t *testing.T) {
+	names := []string{
+		"debian-12.10.0-arm64-netinst.iso", "debian-12.9.0-arm64-netinst.iso", "debian-12.9.0-arm64-netinst.iso.zsync",
+		"ubuntu-24.04.10-live-server-arm64.iso", "ubuntu-24.04.9-live-server-arm64.iso", "debian-12.09.1-arm64-netinst.iso",
+	}
+	slices.SortFunc(names, compareVersions)
+	want := []string{
+		"debian-12.9.0-arm64-netinst.iso", "debian-12.9.0-arm64-netinst.iso.zsync", "debian-12.09.1-arm64-netinst.iso",
+		"debian-12.10.0-arm64-netinst.iso", "ubuntu-24.04.9-live-server-arm64.iso", "ubuntu-24.04.10-live-server-arm64.iso",
+	}
+	if !slices.Equal(names, want) {
+		t.Errorf("Ordine errato. Got: %q", names)
+	}
+}
+
+// TestResolveDistro verifica una distribuzione della configurazione, con
+// il file di checksum cercato nell'elenco della cartella, e lo
+// scaricamento della sua immagine.
+func TestResolveDistro(t *testing.T) {
+	saved := slices.Clone(distros)
+	t.Cleanup(func() { distros = saved })
+	image := []byte("immagine della distribuzione")
+	sum := sha256.Sum256(image)
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/releases/7/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="../">../</a> <a href="Acme-7-1.2-CHECKSUM">x</a> <a href="Acme-7-1.10-CHECKSUM">x</a> <a href="acme-7.1-arm64.img.xz">x</a>`)
+	})
+	mux.HandleFunc("/releases/7/Acme-7-1.2-CHECKSUM", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  acme-7.1-arm64.img.xz\n", hex.EncodeToString(sum[:]))
+	})
+	mux.HandleFunc("/releases/7/acme-7.1-arm64.img.xz", func(w http.ResponseWriter, r *http.Request) { w.Write(image) })
+
+	err := registerDistros([]distroConfig{{
+		Name: "acme", Pattern: `^acme-(\d+)-(arm64|amd64)$`, Dir: srv.URL + "/releases/$1/",
+		SumsPattern: `Acme-$1-1\.2-CHECKSUM`, File: `acme-$1\.\d+-${2}\.img\.xz`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := resolveDistro(context.Background(), "acme-7-arm64")
+	if err != nil || img.URL != srv.URL+"/releases/7/acme-7.1-arm64.img.xz" || img.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Immagine risolta errata. Got: %+v, %v", img, err)
+	}
+	path, err := fetchDistroImage(context.Background(), newImageCache(cacheConfig{Dir: t.TempDir()}), "acme-7-arm64")
+	if data, _ := os.ReadFile(path); err != nil || string(data) != string(image) {
+		t.Errorf("Immagine non scaricata. Got: %q, %v", data, err)
+	}
+
+	for _, bad := range []distroConfig{
+		{Name: "nessuna"},
+		{Name: "ubuntu", Keyring: "keyring.gpg"},
+		{Name: "acme", Pattern: `^acme$`, Dir: srv.URL},
+	} {
+		if err := registerDistros([]distroConfig{bad}); err == nil {
+			t.Errorf("Configurazione non valida accettata: %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ejectCommands returns the commands tried, in order, to detach a device
+// cleanly once it has been written.
+func ejectCommands(device string) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"diskutil", "eject", device}}
+	case "linux":
+		return [][]string{
+			{"udisksctl", "power-off", "--no-user-interaction", "-b", device},
+			{"eject", device},
+		}
+	case "freebsd":
+		return [][]string{{"camcontrol", "eject", strings.TrimPrefix(device, "/dev/")}}
+	default:
+		return [][]string{{"eject", device}}
+	}
+}
+
+// ejectDevice detaches the device (udisks power-off, eject or diskutil),
+// so that it can be unplugged without losing the last blocks written.
+func ejectDevice(device string) error {
+	var failures []string
+	for _, cmd := range ejectCommands(device) {
+		path, err := exec.LookPath(cmd[0])
+		if err != nil {
+			continue
+		}
+		out, err := exec.Command(path, cmd[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v %s", cmd[0], err, strings.TrimSpace(string(out))))
+	}
+	if len(failures) == 0 {
+		return fmt.Errorf("no eject tool found (tried %d commands)", len(ejectCommands(device)))
+	}
+	return fmt.Errorf("could not eject %s: %s", device, strings.Join(failures, "; "))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// Exit codes, documented in the README so that provisioning scripts can
+// branch on the class of failure.
+const (
+	exitOK               = 0
+	exitFailure          = 1   // any other error
+	exitUsage            = 2   // invalid command line
+	exitCancelled        = 3   // the user did not confirm the operation
+	exitPermission       = 4   // not root / permission denied on the device
+	exitDeviceBusy       = 5   // the device is mounted or in use
+	exitWriteError       = 6   // writing or syncing the device failed
+	exitVerifyFailed     = 7   // the data read back differs from the image
+	exitChecksumMismatch = 8   // the image does not match the expected checksum
+	exitTimeout          = 9   // the flash did not complete within --timeout
+	exitDeviceTooSmall   = 10  // the image does not fit on the device
+	exitDeviceRemoved    = 11  // the device disappeared during the flash
+	exitHookFailed       = 12  // a pre/post flash hook failed
+	exitNotBootable      = 13  // --lint found that the device would not boot
+	exitPartialFailure   = 14  // some of the devices or jobs of a batch failed
+	exitInterrupted      = 130 // stopped by Ctrl+C or SIGTERM (128+SIGINT)
+)
+
+// Sentinel errors identifying the failure classes above. They are wrapped
+// with context where they happen and mapped back with errors.Is; the
+// failures of the flash itself come from the flasher package.
+var (
+	errUsage            = errors.New("invalid usage")
+	errPermission       = errors.New("permission denied")
+	errInterrupted      = errors.New("operation interrupted")
+	errPartialFailure   = errors.New("partial failure")
+	errCancelled        = flasher.ErrUserCancelled
+	errDeviceBusy       = flasher.ErrDeviceBusy
+	errDeviceMounted    = flasher.ErrDeviceMounted
+	errDeviceTooSmall   = flasher.ErrDeviceTooSmall
+	errDeviceRemoved    = flasher.ErrDeviceRemoved
+	errWrite            = flasher.ErrWrite
+	errVerifyFailed     = flasher.ErrVerifyFailed
+	errChecksumMismatch = flasher.ErrChecksumMismatch
+	errTimeout          = flasher.ErrTimeout
+	errHookFailed       = flasher.ErrHookFailed
+	errNotBootable      = flasher.ErrNotBootable
+)
+
+// exitCode returns the process exit code for err.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, errCancelled):
+		return exitCancelled
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.Is(err, errPartialFailure):
+		return exitPartialFailure
+	case errors.Is(err, errPermission), errors.Is(err, os.ErrPermission):
+		return exitPermission
+	case errors.Is(err, errDeviceBusy), errors.Is(err, errDeviceMounted):
+		return exitDeviceBusy
+	case errors.Is(err, errDeviceTooSmall):
+		return exitDeviceTooSmall
+	case errors.Is(err, errDeviceRemoved):
+		return exitDeviceRemoved
+	case errors.Is(err, errVerifyFailed):
+		return exitVerifyFailed
+	case errors.Is(err, errChecksumMismatch):
+		return exitChecksumMismatch
+	case errors.Is(err, errTimeout), errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(err, errHookFailed):
+		return exitHookFailed
+	case errors.Is(err, errNotBootable):
+		return exitNotBootable
+	case errors.Is(err, errWrite):
+		return exitWriteError
+	default:
+		return exitFailure
+	}
+}
+
+// fatal prints err and exits with the code matching its failure class.
+// A cancellation is not reported as an error, the prompt already said so.
+func fatal(err error) {
+	code := exitCode(err)
+	if errors.Is(err, errCancelled) {
+		logger.Debug("operation cancelled", "exit_code", code)
+	} else {
+		logger.Error(err.Error(), "exit_code", code)
+	}
+	statusMQTT.close()
+	shutdownTracing()
+	os.Exit(code)
+}
+
+// batchError returns the error of a batch whose items, the devices or
+// jobs named by what, failed with errs: nil if none failed, an
+// errPartialFailure if only some did, and the first error, with its exit
+// code, if all of them failed.
+func batchError(errs []error, what string) error {
+	failed := 0
+	var first error
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			first = cmp.Or(first, err)
+		}
+	}
+	switch failed {
+	case 0:
+		return nil
+	case len(errs):
+		if failed == 1 {
+			return first
+		}
+		return fmt.Errorf("all %d %s failed: %w", failed, what, first)
+	default:
+		return fmt.Errorf("%w: %d of %d %s failed", errPartialFailure, failed, len(errs), what)
+	}
+}
+
+// usageError returns an errUsage with the given message.
+func usageError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"testing"
+)
+
+// TestExitCode verifica la mappatura tra classi di errore e codici di uscita.
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{fmt.Errorf("boom"), exitFailure},
+		{usageError("missing image"), exitUsage},
+		{errCancelled, exitCancelled},
+		{fmt.Errorf("could not open device: %w", fs.ErrPermission), exitPermission},
+		{fmt.Errorf("%w: /dev/sdb1 is mounted", errDeviceBusy), exitDeviceBusy},
+		{fmt.Errorf("%w: /dev/sdb1 on /media", errDeviceMounted), exitDeviceBusy},
+		{fmt.Errorf("%w: needs 8G", errDeviceTooSmall), exitDeviceTooSmall},
+		{fmt.Errorf("%w: /dev/sdb: %w", errDeviceRemoved, fmt.Errorf("%w: EIO", errWrite)), exitDeviceRemoved},
+		{fmt.Errorf("%w: short write", errWrite), exitWriteError},
+		{fmt.Errorf("%w: digest differs", errVerifyFailed), exitVerifyFailed},
+		{fmt.Errorf("%w: got abc", errChecksumMismatch), exitChecksumMismatch},
+		{fmt.Errorf("%w: no progress", errTimeout), exitTimeout},
+		{fmt.Errorf("downloading: %w", context.DeadlineExceeded), exitTimeout},
+		{fmt.Errorf("%w: post-write hook: exit status 1", errHookFailed), exitHookFailed},
+		{fmt.Errorf("%w: fstab mounts LABEL=DATA on /data", errNotBootable), exitNotBootable},
+		{fmt.Errorf("write interrupted: %w", errInterrupted), exitInterrupted},
+		{fmt.Errorf("%w: 1 of 3 devices failed", errPartialFailure), exitPartialFailure},
+	}
+	for _, tc := range cases {
+		if got := exitCode(tc.err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+// TestBatchError verifica il codice di uscita di un lotto: parziale se
+// solo alcuni falliscono, quello del primo errore se falliscono tutti.
+func TestBatchError(t *testing.T) {
+	verify := fmt.Errorf("%w: /dev/sdc", errVerifyFailed)
+	removed := fmt.Errorf("%w: /dev/sdd", errDeviceRemoved)
+	if err := batchError([]error{nil, nil}, "devices"); err != nil {
+		t.Errorf("Nessun errore atteso. Got: %v", err)
+	}
+	err := batchError([]error{nil, verify, nil}, "devices")
+	if exitCode(err) != exitPartialFailure || err.Error() != "partial failure: 1 of 3 devices failed" {
+		t.Errorf("Fallimento parziale errato. Got: %v (%d)", err, exitCode(err))
+	}
+	err = batchError([]error{verify, removed}, "jobs")
+	if exitCode(err) != exitVerifyFailed || err.Error() != "all 2 jobs failed: verification failed: /dev/sdc" {
+		t.Errorf("Fallimento totale errato. Got: %v (%d)", err, exitCode(err))
+	}
+	if err := batchError([]error{removed}, "devices"); err != removed {
+		t.Errorf("Con un solo elemento l'errore è il suo. Got: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// rawFile is a file of --extra, written at offset bytes of the device.
+type rawFile struct {
+	path   string
+	offset int64
+}
+
+// rawFiles are the files of --extra.
+type rawFiles []rawFile
+
+// addRawFilesFlag registers --extra on fs.
+func addRawFilesFlag(fs *flag.FlagSet) *rawFiles {
+	files := &rawFiles{}
+	fs.Func("extra", "write a file at an offset of the device, <file>@<offset>, e.g. u-boot.bin@8192s (repeatable)", func(s string) error {
+		i := strings.LastIndex(s, "@")
+		if i <= 0 {
+			return fmt.Errorf("expected <file>@<offset>, e.g. u-boot.bin@8192s, not %q", s)
+		}
+		offset, err := parseSize(s[i+1:])
+		if err != nil {
+			return err
+		}
+		*files = append(*files, rawFile{path: s[:i], offset: int64(offset)})
+		return nil
+	})
+	return files
+}
+
+// steps returns the steps that write the files, read now so that a
+// missing one is reported before the flash.
+func (r rawFiles) steps() ([]flasher.Step, error) {
+	var steps []flasher.Step
+	for _, f := range r {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the file to write: %w", err)
+		}
+		steps = append(steps, flasher.WriteRaw{Offset: f.offset, Data: data})
+	}
+	return steps, nil
+}
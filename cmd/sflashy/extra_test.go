@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestRawFilesFlag verifica la lettura di --extra e dei file da scrivere.
+func TestRawFilesFlag(t *testing.T) {
+	spl := filepath.Join(t.TempDir(), "u-boot@sunxi.bin")
+	os.WriteFile(spl, []byte("spl"), 0o644)
+
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	files := addRawFilesFlag(fs)
+	if err := fs.Parse([]string{"--extra", spl + "@8192s", "--extra", spl + "@8K"}); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := files.steps()
+	if err != nil || len(steps) != 2 {
+		t.Fatalf("Un passo per file. Got: %v, %v", steps, err)
+	}
+	if w := steps[0].(flasher.WriteRaw); w.Offset != 8192*512 || string(w.Data) != "spl" {
+		t.Errorf("Scrittura errata. Got: %d, %q", w.Offset, w.Data)
+	}
+	if w := steps[1].(flasher.WriteRaw); w.Offset != 8192 {
+		t.Errorf("Offset errato. Got: %d", w.Offset)
+	}
+	if _, err := (rawFiles{{path: filepath.Join(t.TempDir(), "manca")}}).steps(); err == nil {
+		t.Error("Un file mancante va segnalato prima del flash")
+	}
+
+	for _, bad := range []string{"u-boot.bin", "@8192s", "u-boot.bin@8x", "u-boot.bin@"} {
+		fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		addRawFilesFlag(fs)
+		if err := fs.Parse([]string{"--extra", bad}); err == nil {
+			t.Errorf("--extra %s dovrebbe essere rifiutato", bad)
+		}
+	}
+}
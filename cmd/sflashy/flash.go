@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// flashOptions collects the settings of a single flash operation.
+type flashOptions struct {
+	Image  string
+	Device string
+	// Yes skips the confirmation prompt.
+	Yes bool
+	// Eject detaches the device once it has been synced.
+	Eject bool
+	// Verify reads the device back and compares it with the image.
+	Verify bool
+	// Hash names the hash of the digest and of the verification
+	// (flasher.DefaultHash if empty).
+	Hash string
+	// Checksum is the expected hexadecimal digest of the image, if any.
+	Checksum string
+	// Probe measures the device speed before asking for confirmation, to
+	// show the expected duration of the flash.
+	Probe bool
+
+	// BlockSize is the size of each write (copyBlockSize() if 0).
+	BlockSize int
+	// Skip is the number of bytes skipped at the start of the image.
+	Skip int64
+	// Seek is the device offset, in bytes, where writing starts.
+	Seek int64
+	// Count limits the number of bytes written (0 for the whole image).
+	Count int64
+	// Room is the space at Seek that the image may take, e.g. the
+	// partition of an A/B slot (0 for the rest of the device); Slot
+	// describes that slot for the details.
+	Room int64
+	Slot string
+	// Pad fills the last partial block with zeros (dd conv=sync).
+	Pad bool
+	// ImageSize overrides the uncompressed image size used for the
+	// progress, when it cannot be estimated from a compressed image.
+	ImageSize int64
+	// Timeout aborts the flash when writing, syncing and verifying take
+	// longer than this (0 for no limit).
+	Timeout time.Duration
+	// JSON, if set, receives the result of the run as a JSON object, on
+	// success and on failure alike.
+	JSON io.Writer
+	// PauseKey lets the operator pause and resume the copy by typing "p"
+	// on userInput.
+	PauseKey bool
+	// Retry retries the transient errors of the image and of the device.
+	Retry flasher.RetryPolicy
+	// Resume continues an interrupted flash of the same image to the same
+	// device, as recorded in stateStore.
+	Resume bool
+	// Clone tells that Image is a block device, copied as is to Device.
+	Clone bool
+	// Expand grows the last partition of the image, and its filesystem,
+	// to the end of the device once it is written.
+	Expand bool
+	// Persistence adds a persistence partition for the live system of the
+	// image, of PersistenceSize bytes or the rest of the device if 0.
+	Persistence     bool
+	PersistenceSize int64
+	// DataPartition is added after the image, and after the persistence
+	// partition, if its FSType is set.
+	DataPartition dataPartition
+	// Steps customize the device once it is written, after Expand.
+	Steps []flasher.Step
+	// Lint checks the device once it is written, customized and closed,
+	// if set.
+	Lint *bootLint
+	// Asset exports the unit after a successful flash, if set.
+	Asset *assetExport
+	// Index is the position of the device in the batch, for the templates
+	// of Steps; the devices of runFlashMany follow it.
+	Index int
+}
+
+// checkCapacity verifies that size bytes written at offset fit on device.
+// The check is skipped, with a warning, when the size of the image is not
+// known; an estimated size only produces a warning.
+func checkCapacity(device string, offset, size int64, exact bool) error {
+	if size == 0 {
+		logger.Warn("image size unknown, skipping the device capacity check", "device", device)
+		return nil
+	}
+	capacity, err := deviceSize(device)
+	if err != nil {
+		logger.Warn("could not read the device size, skipping the capacity check", "device", device, "err", err)
+		return nil
+	}
+	if offset+size <= capacity {
+		return nil
+	}
+	if !exact {
+		logger.Warn("the estimated image size exceeds the device size", "device", device, "image_size", size, "device_size", capacity)
+		return nil
+	}
+	return fmt.Errorf("%w: the image needs %d bytes but %s has only %d", errDeviceTooSmall, offset+size, device, capacity)
+}
+
+// checkRoom verifies that size bytes fit in the opts.Room bytes at the
+// offset of opts. Unlike checkCapacity, the size must be known exactly:
+// writing past the room would overwrite what follows, e.g. the active
+// slot of an A/B device.
+func checkRoom(opts flashOptions, size int64, exact bool) error {
+	if size == 0 || !exact {
+		return usageError("the exact size of the image is needed to write it to %s, set it with --size", opts.Slot)
+	}
+	if size > opts.Room {
+		return fmt.Errorf("%w: the image needs %d bytes but %s has only %d", errDeviceTooSmall, size, opts.Slot, opts.Room)
+	}
+	return nil
+}
+
+// deviceSize returns the size in bytes of the block device at path.
+func deviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return flasher.DeviceSize(f)
+}
+
+// checkBlockDevice verifies that path exists and is a device file.
+func checkBlockDevice(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("device not found: %s", path)
+	}
+	if err != nil {
+		return err
+	}
+	// os.ModeDevice indicates it's a device file (/dev/...).
+	// We check that this bit is set in the file mode.
+	if (info.Mode() & os.ModeDevice) == 0 {
+		return fmt.Errorf("the provided path is not a block device: %s", path)
+	}
+	return nil
+}
+
+// checksumOptions returns the hash and the expected digest selected by
+// --hash, --checksum and --sha256, which is a shorthand for
+// --hash sha256 --checksum.
+func checksumOptions(hashName, checksum, sha string) (string, string, error) {
+	if sha != "" {
+		if checksum != "" {
+			return "", "", usageError("--sha256 and --checksum cannot be used together")
+		}
+		if hashName != "" && !strings.EqualFold(hashName, "sha256") {
+			return "", "", usageError("--sha256 cannot be used with --hash %s, use --checksum", hashName)
+		}
+		return "sha256", sha, nil
+	}
+	if hashName == "" {
+		hashName = flasher.DefaultHash
+	}
+	if _, err := flasher.LookupHash(hashName); err != nil {
+		return "", "", fmt.Errorf("%w: %w", errUsage, err)
+	}
+	return strings.ToLower(hashName), checksum, nil
+}
+
+// newFlasher returns a Flasher configured from opts and from the display
+// settings, printing on termOut. opts.Hash must name a registered hash.
+func newFlasher(opts flashOptions, termOut io.Writer) *flasher.Flasher {
+	var newHash func() hash.Hash
+	if opts.Hash != "" {
+		newHash, _ = flasher.LookupHash(opts.Hash)
+	}
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = copyBlockSize()
+	}
+	log := logger.With("image", opts.Image, "device", opts.Device)
+	events := &flasher.EventBus{}
+	events.Subscribe(flasher.SubscriberFunc(func(e flasher.Event) {
+		log.Debug("flash event", "event", e.Type, "bytes", e.Bytes)
+	}))
+	f := &flasher.Flasher{
+		BlockSize:    blockSize,
+		Pad:          opts.Pad,
+		Skip:         opts.Skip,
+		Seek:         opts.Seek,
+		Count:        opts.Count,
+		Hash:         newHash,
+		Checksum:     opts.Checksum,
+		Verify:       opts.Verify,
+		Timeout:      opts.Timeout,
+		Retry:        opts.Retry,
+		Output:       termOut,
+		Colors:       flasher.Colors{Progress: ColorProgress, Success: ColorSuccess, Reset: ColorReset},
+		ProgressStep: progressStep,
+		FormatSize:   formatSize,
+		Logger:       log,
+		Events:       events,
+		Tracer:       tracer,
+		Hooks:        hooks.flasherHooks(termOut, opts.Verify),
+		Metadata:     map[string]string{"image": opts.Image},
+		State:        stateStore,
+		Continue:     opts.Resume,
+	}
+	statusMQTT.watch(f, opts.Image, opts.Device)
+	return f
+}
+
+// addSteps adds to f the customization steps of opts, and returns what
+// finishes them once the device is closed: the filesystem growth of
+// --expand and the filesystems of the partitions of --persistence and
+// --data-partition.
+func addSteps(f *flasher.Flasher, opts flashOptions) finishers {
+	grow := &fsGrower{}
+	if opts.Expand {
+		f.Steps = append(f.Steps, flasher.ExpandPartition{}, grow.step())
+	}
+	parts := &partitionMaker{}
+	if opts.Persistence {
+		f.Steps = append(f.Steps, persistenceStep(parts, opts.PersistenceSize))
+	}
+	if opts.DataPartition.FSType != "" {
+		f.Steps = append(f.Steps, dataPartitionStep(parts, opts.DataPartition))
+	}
+	f.Steps = append(f.Steps, opts.Steps...)
+	if opts.Lint != nil {
+		return finishers{grow, parts, opts.Lint}
+	}
+	return finishers{grow, parts}
+}
+
+// finisher completes on the closed device, written through location, what
+// a customization step could not do, e.g. with resize2fs.
+type finisher interface {
+	finish(location, device string, out io.Writer) error
+}
+
+// finishers run in order, stopping at the first error.
+type finishers []finisher
+
+func (fs finishers) finish(location, device string, out io.Writer) error {
+	for _, f := range fs {
+		if err := f.finish(location, device, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelOnInterrupt cancels a running flash with errInterrupted when one
+// of interruptSignals is received. Only the first signal is caught: a
+// second one, e.g. during a long sync, kills the process as usual. The
+// returned function stops listening.
+func cancelOnInterrupt(cancel context.CancelCauseFunc) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, interruptSignals...)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			logger.Warn("interrupt received, stopping the copy", "signal", sig.String())
+			cancel(fmt.Errorf("%w: received %v", errInterrupted, sig))
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// openSource opens the image of opts, or the source device of a clone.
+func openSource(ctx context.Context, opts flashOptions) (source *flasher.Source, err error) {
+	log := logger.With("image", opts.Image)
+	// Le immagini compresse vengono decompresse al volo; la dimensione
+	// decompressa è stimata dalle intestazioni per mostrare la percentuale.
+	_, openSpan := tracer.Start(ctx, "open")
+	usePlugins()
+	if opts.Clone {
+		source, err = flasher.OpenDeviceSource(deviceLocation(opts.Image))
+	} else {
+		source, err = flasher.OpenImage(opts.Image, flasher.OpenOptions{LowMemory: lowMemory, Retry: opts.Retry})
+	}
+	openSpan.End(err)
+	if err != nil {
+		return nil, err
+	}
+	openSpan.SetAttribute(flasher.AttrImageFormat, source.Format)
+	if source.SizeErr != nil {
+		log.Warn("could not estimate the uncompressed image size, use --size to set it", "err", source.SizeErr)
+	}
+	if source.Format != "" {
+		log.Info("decompressing image", "format", source.Format, "estimated_size", source.Size)
+	}
+	if opts.ImageSize > 0 {
+		source.Size, source.Exact = opts.ImageSize, true
+	}
+	return source, nil
+}
+
+// runFlash checks the target, writes the image to it and syncs the device.
+// Once ctx is done, or an interrupt is received after the confirmation,
+// the copy stops cleanly between two blocks.
+func runFlash(ctx context.Context, opts flashOptions, userInput io.Reader, termOut io.Writer) (err error) {
+	summary := flashSummary{Image: opts.Image, Device: opts.Device, Hash: opts.Hash, Verification: "skipped"}
+	if opts.JSON != nil {
+		defer func() { summary.writeJSON(opts.JSON, err) }()
+	}
+	if flashLedger != nil || flashAudit != nil || flashMetrics != nil || opts.Asset != nil {
+		// Il dispositivo si identifica ora: alla fine può essere espulso.
+		dev := lookupDeviceInfo(opts.Device)
+		defer func() {
+			flashLedger.record(summary, dev, err)
+			flashAudit.record(opts.operation(), summary, dev, err)
+			flashMetrics.record(summary, dev, err)
+			opts.Asset.done(summary, dev, err)
+		}()
+	}
+	log := logger.With("image", opts.Image, "device", opts.Device)
+	log.Debug("flash requested")
+	ctx, span := tracer.Start(ctx, "sflashy")
+	span.SetAttribute("sflashy.image", opts.Image)
+	defer func() { span.End(err) }()
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return err
+	}
+	mounts := mountedPartitions(opts.Device)
+	if len(mounts) > 0 && !autoUnmount {
+		return fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, opts.Device, strings.Join(mounts, ", "))
+	}
+
+	if opts.Clone {
+		if err := checkCloneSource(opts.Image, opts.Device); err != nil {
+			return err
+		}
+	}
+
+	log.Debug("checks passed: block device, not mounted")
+
+	source, err := openSource(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	f := newFlasher(opts, termOut)
+	finish := addSteps(f, opts)
+	defer batch.add(deviceLocation(opts.Device), opts.Device, opts.Index)()
+	applyQuirk(f, opts.Device)
+	size := f.WriteSize(source.Size)
+	if err := checkCapacity(opts.Device, opts.Seek, size, source.Exact); err != nil {
+		return err
+	}
+	if opts.Room > 0 {
+		if err := checkRoom(opts, size, source.Exact); err != nil {
+			return err
+		}
+		// Nemmeno un'immagine più grande del dichiarato esce dallo slot.
+		f.Count = opts.Room
+	}
+	if !opts.Yes {
+		writeFlashDetails(termOut, opts.Image, size, opts.Device, opts.Seek, lookupDeviceInfo(opts.Device))
+		if opts.Slot != "" {
+			fmt.Fprintf(termOut, "  %-8s %s\n", "Slot:", opts.Slot)
+		}
+	}
+	if opts.Probe {
+		if err := runProbe(opts.Device, size, opts.Verify, termOut); err != nil {
+			logger.Warn("speed probe failed", "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	f.Pauser = newPauser(opts.PauseKey, termOut)
+	defer pauseOnSignal(f.Pauser)()
+	wd := newWatchdog(cancel)
+	defer wd.stop()
+	stopInterrupt, stopPause := func() {}, func() {}
+	defer func() { stopInterrupt(); stopPause() }()
+	f.Confirm = func() error {
+		if !opts.Yes && !confirm(userInput, termOut) {
+			fmt.Fprintln(termOut, "Operation cancelled.")
+			return errCancelled
+		}
+		if len(mounts) > 0 {
+			fmt.Fprintf(termOut, "Unmounting %s...\n", strings.Join(mounts, ", "))
+			if err := unmountDisk(opts.Device); err != nil {
+				return fmt.Errorf("%w: %v", errDeviceMounted, err)
+			}
+		}
+		// Il tasto p si legge solo dopo la conferma, che usa lo stesso input.
+		if opts.PauseKey {
+			stopPause = pauseOnInput(f.Pauser, userInput)
+		}
+		// Ctrl+C interrompe il prompt come sempre; da qui in poi ferma la
+		// copia senza lasciare scritture a metà.
+		stopInterrupt = cancelOnInterrupt(cancel)
+		wd.start(opts.Device, opts.Timeout)
+		return nil
+	}
+	defer reportOnSignal(f, termOut)()
+
+	res, err := untilExpired(wd, func() (flasher.Result, error) {
+		return f.Flash(ctx, source, deviceLocation(opts.Device))
+	})
+	if errors.Is(err, errInterrupted) {
+		fmt.Fprintln(termOut, "Run the same command with --resume to continue from where the write stopped.")
+	}
+	if res.Digest != nil {
+		summary.Bytes, summary.Digest, summary.Elapsed, summary.Verification = res.Bytes, res.Digest, res.Elapsed, res.Verification
+		summary.write(termOut)
+		log.Info("flash finished", "elapsed", summary.Elapsed, "verification", summary.Verification)
+	}
+	if err != nil {
+		return err
+	}
+	if err := finish.finish(deviceLocation(opts.Device), opts.Device, termOut); err != nil {
+		return err
+	}
+
+	if opts.Eject {
+		fmt.Fprintf(termOut, "Ejecting %s...\n", opts.Device)
+		if err := ejectDevice(opts.Device); err != nil {
+			return err
+		}
+		fmt.Fprintf(termOut, ColorSuccess+"It is now safe to remove %s."+ColorReset+"\n", opts.Device)
+	}
+	return nil
+}
+
+// stepFlags are the flags that customize the device once it is written.
+type stepFlags struct {
+	raw       *rawFiles
+	partition *partitionFlags
+	copy      bootFiles
+	templates *templateFlags
+	setup     *setupFlags
+	settings  *string
+	identity  *identityFlag
+	patches   *bootPatches
+}
+
+// addStepFlags registers the customization flags on fs.
+func addStepFlags(fs *flag.FlagSet) stepFlags {
+	return stepFlags{
+		raw:       addRawFilesFlag(fs),
+		partition: addPartitionFlags(fs),
+		copy:      addBootFilesFlag(fs),
+		templates: addTemplateFlags(fs),
+		setup:     addSetupFlags(fs),
+		settings:  fs.String("device-settings", "", "CSV or YAML file of hostname, ip and ssh_keys by device serial number"),
+		identity:  addIdentityFlag(fs),
+		patches:   addPatchFlag(fs),
+	}
+}
+
+// steps returns the customization steps of the flags, in order: the raw
+// writes and the partition table first, then the files, the setup and the
+// rows of --device-settings that override it, the identity reset, and the
+// patches last, so that they apply to what the setup wrote too.
+func (f stepFlags) steps() ([]flasher.Step, error) {
+	var settings deviceSettings
+	if *f.settings != "" {
+		var err error
+		if settings, err = loadDeviceSettings(*f.settings); err != nil {
+			return nil, fmt.Errorf("%w: %w", errUsage, err)
+		}
+	}
+	steps, err := f.raw.steps()
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, f.partition.steps()...)
+	copySteps, err := f.copy.steps()
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, copySteps...)
+	templateSteps, err := f.templates.steps(f.setup.Hostname, settings)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, templateSteps...)
+	setupSteps, err := f.setup.steps()
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, setupSteps...)
+	if settings != nil {
+		steps = append(steps, settings.step(*f.settings))
+	}
+	steps = append(steps, f.identity.steps()...)
+	return append(steps, f.patches.steps()...), nil
+}
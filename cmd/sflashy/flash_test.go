@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCheckCapacity verifica il controllo dello spazio sul dispositivo.
+func TestCheckCapacity(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(device, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCapacity(device, 0, 1000, true); err != nil {
+		t.Errorf("Un'immagine della stessa dimensione dovrebbe entrare: %v", err)
+	}
+	if err := checkCapacity(device, 512, 1000, true); !errors.Is(err, errDeviceTooSmall) {
+		t.Errorf("Con l'offset l'immagine non entra: atteso errDeviceTooSmall. Got: %v", err)
+	}
+	if err := checkCapacity(device, 0, 2000, false); err != nil {
+		t.Errorf("Una dimensione stimata dovrebbe solo generare un avviso: %v", err)
+	}
+	if err := checkCapacity(device, 0, 0, true); err != nil {
+		t.Errorf("Con dimensione ignota il controllo va saltato: %v", err)
+	}
+}
+
+// TestChecksumOptions verifica la combinazione di --hash, --checksum e --sha256.
+func TestChecksumOptions(t *testing.T) {
+	cases := []struct {
+		hash, checksum, sha string
+		wantHash, wantSum   string
+		wantErr             bool
+	}{
+		{"", "", "", "sha256", "", false},
+		{"SHA512", "ab", "", "sha512", "ab", false},
+		{"", "", "cd", "sha256", "cd", false},
+		{"sha256", "", "cd", "sha256", "cd", false},
+		{"sha512", "", "cd", "", "", true},
+		{"", "ab", "cd", "", "", true},
+		{"whirlpool", "", "", "", "", true},
+	}
+	for _, c := range cases {
+		hash, sum, err := checksumOptions(c.hash, c.checksum, c.sha)
+		if c.wantErr {
+			if !errors.Is(err, errUsage) {
+				t.Errorf("checksumOptions(%q, %q, %q) dovrebbe restituire errUsage. Got: %v", c.hash, c.checksum, c.sha, err)
+			}
+			continue
+		}
+		if err != nil || hash != c.wantHash || sum != c.wantSum {
+			t.Errorf("checksumOptions(%q, %q, %q) = %q, %q, %v; Want: %q, %q", c.hash, c.checksum, c.sha, hash, sum, err, c.wantHash, c.wantSum)
+		}
+	}
+}
+
+// TestRetryFlags verifica la politica di ripetizione scelta dai flag.
+func TestRetryFlags(t *testing.T) {
+	p, err := retryFlags{Retries: 3, Backoff: time.Second, MaxBackoff: time.Minute}.policy()
+	if err != nil || p.MaxAttempts != 4 || p.Backoff != time.Second || p.MaxBackoff != time.Minute {
+		t.Errorf("Politica errata: %+v, %v", p, err)
+	}
+	if _, err := (retryFlags{Retries: -1}).policy(); !errors.Is(err, errUsage) {
+		t.Errorf("Un numero negativo di tentativi dovrebbe essere un errore d'uso. Got: %v", err)
+	}
+}
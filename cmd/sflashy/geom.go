@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// geomEnumerator enumerates the disks of FreeBSD: kern.disks names them,
+// `geom disk list` and `geom part list` describe them and `camcontrol
+// devlist -v` tells which ones sit behind a USB mass storage bridge. run
+// executes a command and returns its output.
+type geomEnumerator struct {
+	run func(name string, args ...string) ([]byte, error)
+}
+
+// runCommand runs a command and returns its standard output.
+func runCommand(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (e geomEnumerator) Devices() ([]deviceInfo, error) {
+	out, err := e.run("sysctl", "-n", "kern.disks")
+	if err != nil {
+		return nil, err
+	}
+	// camcontrol manca sui sistemi senza CAM: i dischi restano senza bus USB.
+	usb := map[string]bool{}
+	if cam, err := e.run("camcontrol", "devlist", "-v"); err == nil {
+		usb = umassDisks(string(cam))
+	}
+	mounts, _ := e.run("mount")
+	names := strings.Fields(string(out))
+	devices := make([]deviceInfo, 0, len(names))
+	// kern.disks elenca i dischi dal più recente.
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		disk, err := e.run("geom", "disk", "list", name)
+		if err != nil {
+			return nil, err
+		}
+		providers := geomProviders(string(disk))
+		if len(providers) == 0 {
+			continue
+		}
+		dev := newGeomDeviceInfo(name, providers[0], usb[name])
+		// Un disco senza tabella delle partizioni non compare in geom part.
+		if part, err := e.run("geom", "part", "list", name); err == nil {
+			for _, p := range geomProviders(string(part)) {
+				dev.Partitions = append(dev.Partitions, partitionInfo{
+					Path:      "/dev/" + p["Name"],
+					SizeBytes: geomSize(p["Mediasize"]),
+					Type:      p["type"],
+					Label:     geomLabel(p["label"]),
+					UUID:      p["rawuuid"],
+				})
+			}
+		}
+		fillMountpoints(&dev, string(mounts))
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// newGeomDeviceInfo converts the provider of a disk in `geom disk list`
+// into a deviceInfo.
+func newGeomDeviceInfo(name string, p map[string]string, usb bool) deviceInfo {
+	dev := deviceInfo{
+		Path:        "/dev/" + name,
+		SizeBytes:   geomSize(p["Mediasize"]),
+		Model:       p["descr"],
+		Serial:      p["ident"],
+		Bus:         geomBus(name, usb),
+		DriveType:   "HDD",
+		Partitions:  []partitionInfo{},
+		Mountpoints: []string{},
+	}
+	if p["rotationrate"] == "0" || strings.HasPrefix(dev.Bus, "nvme") {
+		dev.DriveType = "SSD"
+	}
+	dev.Removable = dev.Bus == "usb" || dev.Bus == "mmc"
+	return dev
+}
+
+// geomBus returns the bus of a FreeBSD disk from its driver name.
+func geomBus(name string, usb bool) string {
+	driver := strings.TrimRight(name, "0123456789")
+	switch {
+	case usb:
+		return "usb"
+	case driver == "ada":
+		return "ata"
+	case driver == "nvd" || driver == "nda":
+		return "nvme"
+	case driver == "mmcsd" || driver == "sdda":
+		return "mmc"
+	case driver == "da":
+		return "scsi"
+	case driver == "vtbd":
+		return "virtio"
+	}
+	return driver
+}
+
+// geomProviders returns the attributes of each provider listed in the
+// output of `geom disk list` or `geom part list`.
+func geomProviders(output string) []map[string]string {
+	var providers []map[string]string
+	var current map[string]string
+	inProviders := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "Providers:":
+			inProviders = true
+			continue
+		case line == "Consumers:" || strings.HasPrefix(line, "Geom name:"):
+			inProviders, current = false, nil
+			continue
+		}
+		if !inProviders {
+			continue
+		}
+		field := strings.TrimSpace(line)
+		// Ogni provider inizia con "1. Name: da0".
+		if n, rest, ok := strings.Cut(field, ". "); ok && strings.Trim(n, "0123456789") == "" && strings.HasPrefix(rest, "Name:") {
+			current = map[string]string{}
+			providers = append(providers, current)
+			field = rest
+		}
+		if current == nil {
+			continue
+		}
+		if k, v, ok := strings.Cut(field, ":"); ok {
+			current[k] = strings.TrimSpace(v)
+		}
+	}
+	return providers
+}
+
+// geomSize parses a geom size like "15518924800 (14G)".
+func geomSize(s string) uint64 {
+	bytes, _, _ := strings.Cut(s, " ")
+	n, _ := strconv.ParseUint(bytes, 10, 64)
+	return n
+}
+
+// geomLabel returns a geom label, empty for "(null)".
+func geomLabel(s string) string {
+	if s == "(null)" {
+		return ""
+	}
+	return s
+}
+
+// umassDisks returns the disks that `camcontrol devlist -v` lists on a
+// bus of the umass driver, i.e. behind a USB mass storage bridge.
+func umassDisks(output string) map[string]bool {
+	disks := map[string]bool{}
+	umass := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "scbus") {
+			umass = strings.Contains(line, "umass-sim")
+			continue
+		}
+		lp, rp := strings.LastIndex(line, "("), strings.LastIndex(line, ")")
+		if !umass || lp < 0 || rp < lp {
+			continue
+		}
+		for _, name := range strings.Split(line[lp+1:rp], ",") {
+			if !strings.HasPrefix(name, "pass") {
+				disks[name] = true
+			}
+		}
+	}
+	return disks
+}
+
+// fillMountpoints sets the mountpoints of dev and of its partitions from
+// the output of mount(8).
+func fillMountpoints(dev *deviceInfo, mounts string) {
+	if len(dev.Partitions) == 0 {
+		dev.Mountpoints = append(dev.Mountpoints, mountsOfMountOutput(dev.Path, strings.NewReader(mounts))...)
+	}
+	for i, p := range dev.Partitions {
+		mp := mountsOfMountOutput(p.Path, strings.NewReader(mounts))
+		if len(mp) > 0 {
+			dev.Partitions[i].MountPoint = mp[0]
+			dev.Mountpoints = append(dev.Mountpoints, mp...)
+		}
+	}
+}
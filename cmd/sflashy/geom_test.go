@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeCommands restituisce l'output fisso di ogni comando, o un errore
+// per i comandi sconosciuti.
+func fakeCommands(outputs map[string]string) func(string, ...string) ([]byte, error) {
+	return func(name string, args ...string) ([]byte, error) {
+		cmd := strings.Join(append([]string{name}, args...), " ")
+		out, ok := outputs[cmd]
+		if !ok {
+			return nil, fmt.Errorf("%s: not found", cmd)
+		}
+		return []byte(out), nil
+	}
+}
+
+// TestGeomEnumerator verifica l'elenco dei dischi di FreeBSD.
+func TestGeomEnumerator(t *testing.T) {
+	e := geomEnumerator{run: fakeCommands(map[string]string{
+		"sysctl -n kern.disks": "da0 ada0\n",
+		"camcontrol devlist -v": `scbus0 on ahcich0 bus 0:
+<Samsung SSD 860 EVO 500GB RVT04B6Q>  at scbus0 target 0 lun 0 (ada0,pass0)
+scbus7 on umass-sim0 bus 0:
+<SanDisk Ultra Fit 1.00>           at scbus7 target 0 lun 0 (pass1,da0)
+`,
+		"geom disk list ada0": `Geom name: ada0
+Providers:
+1. Name: ada0
+   Mediasize: 500107862016 (466G)
+   Sectorsize: 512
+   descr: Samsung SSD 860 EVO 500GB
+   ident: S3Z2NB0K123456
+   rotationrate: 0
+`,
+		"geom disk list da0": `Geom name: da0
+Providers:
+1. Name: da0
+   Mediasize: 15518924800 (14G)
+   Sectorsize: 512
+   Mode: r1w1e2
+   descr: SanDisk Ultra Fit
+   ident: 4C530001231
+   rotationrate: unknown
+`,
+		"geom part list da0": `Geom name: da0
+modified: false
+scheme: MBR
+Providers:
+1. Name: da0s1
+   Mediasize: 268435456 (256M)
+   Sectorsize: 512
+   Mode: r1w1e2
+   rawtype: 12
+   length: 268435456
+   offset: 4194304
+   type: fat32lba
+   index: 1
+   end: 532479
+   start: 8192
+2. Name: da0s2
+   Mediasize: 4026531840 (3.8G)
+   type: linux-data
+   label: (null)
+Consumers:
+1. Name: da0
+   Mediasize: 15518924800 (14G)
+`,
+		"mount": "/dev/ada0p2 on / (ufs, local)\n/dev/da0s1 on /mnt/boot (msdosfs, local)\n",
+	})}
+	devices, err := e.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Attesi 2 dischi. Got: %+v", devices)
+	}
+	ssd, usb := devices[0], devices[1]
+	if ssd.Path != "/dev/ada0" || ssd.Bus != "ata" || ssd.DriveType != "SSD" || ssd.Removable || ssd.Serial != "S3Z2NB0K123456" {
+		t.Errorf("Disco ada0 errato. Got: %+v", ssd)
+	}
+	if usb.Path != "/dev/da0" || usb.Bus != "usb" || !usb.Removable || usb.SizeBytes != 15518924800 || usb.Model != "SanDisk Ultra Fit" {
+		t.Errorf("Disco da0 errato. Got: %+v", usb)
+	}
+	if len(usb.Partitions) != 2 || usb.Partitions[0].Path != "/dev/da0s1" || usb.Partitions[0].Type != "fat32lba" || usb.Partitions[0].SizeBytes != 268435456 {
+		t.Errorf("Partizioni di da0 errate. Got: %+v", usb.Partitions)
+	}
+	if usb.Partitions[0].MountPoint != "/mnt/boot" || fmt.Sprint(usb.Mountpoints) != "[/mnt/boot]" {
+		t.Errorf("Mountpoint di da0 errati. Got: %+v %v", usb.Partitions[0], usb.Mountpoints)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// fsGrower grows the filesystem of the last partition once --expand has
+// grown the partition: FAT32 in place, as a step of the flash, and ext4
+// with resize2fs once the device is closed, since resize2fs needs the
+// device of the partition.
+type fsGrower struct {
+	mu sync.Mutex
+	// ext4 is the number of the ext4 partition left to grow, by location.
+	ext4 map[string]int
+}
+
+// step returns the customization step that grows the filesystem, or
+// records it for finish.
+func (g *fsGrower) step() flasher.Step {
+	return flasher.StepFunc("grow the filesystem of the last partition", func(ctx context.Context, d *flasher.Disk) error {
+		p, err := d.Partition(0)
+		if err != nil {
+			return err
+		}
+		fsys, err := d.Filesystem(p.Number)
+		if err != nil {
+			logger.Warn("unknown filesystem, it keeps its size", "device", d.Device, "partition", p.Number)
+			return nil
+		}
+		switch fsys.Type() {
+		case "fat32":
+			return flasher.GrowFilesystem{Number: p.Number}.Apply(ctx, d)
+		case "ext4":
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.ext4 == nil {
+				g.ext4 = make(map[string]int)
+			}
+			g.ext4[d.Device] = p.Number
+			return nil
+		}
+		logger.Warn("cannot grow this filesystem, it keeps its size", "device", d.Device, "partition", p.Number, "type", fsys.Type())
+		return nil
+	})
+}
+
+// finish grows the ext4 filesystem that step left to grow on device,
+// written through location, if any.
+func (g *fsGrower) finish(location, device string, out io.Writer) error {
+	g.mu.Lock()
+	number, ok := g.ext4[location]
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	fmt.Fprintf(out, "Growing the ext4 filesystem of partition %d...\n", number)
+	if err := growExt4(device, number); err != nil {
+		return fmt.Errorf("could not grow the filesystem of %s: %w", device, err)
+	}
+	logger.Info("filesystem grown", "device", device, "partition", number)
+	return nil
+}
+
+// partitionPath returns the device of the partition number of device:
+// sdb2, but mmcblk0p2 and nvme0n1p2 after a digit.
+func partitionPath(device string, number int) string {
+	if r, err := filepath.EvalSymlinks(device); err == nil {
+		device = r
+	}
+	if c := device[len(device)-1]; c >= '0' && c <= '9' {
+		return device + "p" + strconv.Itoa(number)
+	}
+	return device + strconv.Itoa(number)
+}
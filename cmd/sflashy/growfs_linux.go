@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// blkrrpart is the BLKRRPART ioctl, which makes the kernel read the
+// partition table of a device again.
+const blkrrpart = 0x125f
+
+// growExt4 grows the ext4 filesystem of the partition number of device to
+// the size of the partition, with e2fsck and resize2fs, once the kernel
+// knows the new partition table.
+func growExt4(device string, number int) error {
+	part, err := preparePartition(device, number)
+	if err != nil {
+		return err
+	}
+	// resize2fs vuole un filesystem appena controllato; e2fsck esce con 1
+	// quando ha corretto qualcosa.
+	out, err := exec.Command("e2fsck", "-f", "-p", part).CombinedOutput()
+	var exit *exec.ExitError
+	if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 1) {
+		return fmt.Errorf("e2fsck %s: %v %s", part, err, strings.TrimSpace(string(out)))
+	}
+	if out, err := exec.Command("resize2fs", part).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs %s: %v %s", part, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// preparePartition makes the kernel read the partition table of device
+// again, and returns the device of the partition number once it appears
+// and the disk is unmounted again.
+func preparePartition(device string, number int) (string, error) {
+	if err := rereadPartitions(device); err != nil {
+		return "", err
+	}
+	part := partitionPath(device, number)
+	// udev crea il dispositivo della partizione poco dopo la rilettura.
+	for i := 0; ; i++ {
+		if _, err := os.Stat(part); err == nil {
+			break
+		} else if i == 50 {
+			return "", fmt.Errorf("%s did not appear: %w", part, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if mounts := mountedPartitions(device); len(mounts) > 0 {
+		if err := unmountDisk(device); err != nil {
+			return "", fmt.Errorf("%w: %s was mounted on %s again", errDeviceMounted, device, strings.Join(mounts, ", "))
+		}
+	}
+	return part, nil
+}
+
+// rereadPartitions asks the kernel to read the partition table of device
+// again, retrying while udev still has it open.
+func rereadPartitions(device string) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i := 0; ; i++ {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkrrpart, 0)
+		if errno == 0 {
+			return nil
+		}
+		if errno != syscall.EBUSY || i == 10 {
+			return fmt.Errorf("could not read the partition table of %s again: %w", device, errno)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
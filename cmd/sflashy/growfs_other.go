@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// growExt4 is only supported on Linux, where resize2fs can reach the
+// partitions of the device.
+func growExt4(string, int) error {
+	return fmt.Errorf("%w: growing ext4 needs resize2fs, on Linux", errors.ErrUnsupported)
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+// TestPartitionPath verifica i nomi dei dispositivi delle partizioni.
+func TestPartitionPath(t *testing.T) {
+	tests := []struct {
+		device string
+		number int
+		want   string
+	}{
+		{"/dev/sdb", 2, "/dev/sdb2"},
+		{"/dev/mmcblk0", 2, "/dev/mmcblk0p2"},
+		{"/dev/nvme0n1", 1, "/dev/nvme0n1p1"},
+		{"/dev/loop3", 12, "/dev/loop3p12"},
+	}
+	for _, tt := range tests {
+		if got := partitionPath(tt.device, tt.number); got != tt.want {
+			t.Errorf("partitionPath(%s, %d) = %s, want %s", tt.device, tt.number, got, tt.want)
+		}
+	}
+}
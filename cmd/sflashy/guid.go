@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// partitionFlags are the flags that change the GPT partition table once
+// the image is written.
+type partitionFlags struct {
+	RandomizeGUIDs bool
+	Names          []flasher.SetPartitionName
+}
+
+// addPartitionFlags registers --randomize-guids and --part-name on fs.
+func addPartitionFlags(fs *flag.FlagSet) *partitionFlags {
+	f := &partitionFlags{}
+	fs.BoolVar(&f.RandomizeGUIDs, "randomize-guids", false, "give the GPT disk and its partitions new random GUIDs")
+	fs.Func("part-name", "set the GPT name of a partition, e.g. 2=data (repeatable)", func(s string) error {
+		number, name, ok := strings.Cut(s, "=")
+		n, err := strconv.Atoi(number)
+		if !ok || err != nil || n < 1 {
+			return fmt.Errorf("expected <partition number>=<name>, e.g. 2=data, not %q", s)
+		}
+		step := flasher.SetPartitionName{Number: n, PartitionName: name}
+		if err := step.Validate(); err != nil {
+			return err
+		}
+		f.Names = append(f.Names, step)
+		return nil
+	})
+	return f
+}
+
+// steps returns the partition table steps selected by the flags.
+func (f partitionFlags) steps() []flasher.Step {
+	var steps []flasher.Step
+	if f.RandomizeGUIDs {
+		steps = append(steps, flasher.RandomizeGUIDs{})
+	}
+	for _, name := range f.Names {
+		steps = append(steps, name)
+	}
+	return steps
+}
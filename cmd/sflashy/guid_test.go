@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestPartitionFlags verifica i passi scelti da --randomize-guids e
+// --part-name.
+func TestPartitionFlags(t *testing.T) {
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := addPartitionFlags(fs)
+	if err := fs.Parse([]string{"--randomize-guids", "--part-name", "2=dati", "--part-name", "1=boot"}); err != nil {
+		t.Fatal(err)
+	}
+	steps := f.steps()
+	if len(steps) != 3 {
+		t.Fatalf("Numero di passi errato. Got: %v", steps)
+	}
+	if _, ok := steps[0].(flasher.RandomizeGUIDs); !ok {
+		t.Errorf("I GUID vanno cambiati per primi. Got: %T", steps[0])
+	}
+	if name := steps[1].(flasher.SetPartitionName); name.Number != 2 || name.PartitionName != "dati" {
+		t.Errorf("Nome errato. Got: %+v", name)
+	}
+
+	for _, bad := range []string{"dati", "0=dati", "x=dati", "2=un-nome-decisamente-troppo-lungo-per-gpt"} {
+		fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		addPartitionFlags(fs)
+		if err := fs.Parse([]string{"--part-name", bad}); err == nil {
+			t.Errorf("--part-name %s dovrebbe essere rifiutato", bad)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+func init() {
+	flasher.RegisterDestination("helper", openHelper)
+}
+
+// openHelper opens the device of a helper:// location read-write through
+// sflashy-helper, started by pkexec, which checks that the device is a
+// safe target and sends the open descriptor back.
+func openHelper(location string) (flasher.Destination, error) {
+	path := strings.TrimPrefix(location, "helper://")
+	ours, theirs, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer ours.Close()
+	var stderr bytes.Buffer
+	cmd := exec.Command("pkexec", helperPath, path)
+	cmd.Stdout, cmd.Stderr = theirs, &stderr
+	err = cmd.Start()
+	theirs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not run pkexec: %w", err)
+	}
+	f, rerr := flasher.ReceiveFile(ours, path)
+	if err := cmd.Wait(); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		msg := strings.TrimPrefix(strings.TrimSpace(stderr.String()), "sflashy-helper: ")
+		// pkexec esce con 126 se l'autorizzazione è negata o annullata.
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && (exit.ExitCode() == 126 || exit.ExitCode() == 127) {
+			return nil, fmt.Errorf("%w: not authorized to open %s: %s", errPermission, path, msg)
+		}
+		return nil, fmt.Errorf("sflashy-helper could not open %s: %s", path, msg)
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	return flasher.NewFileDestination(f), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"io"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// hookCommands are shell commands run at the stages of a flash, from the
+// hooks section of the configuration and from the --*-hook flags.
+type hookCommands struct {
+	PreWrite   []string `yaml:"pre_write"`
+	PostWrite  []string `yaml:"post_write"`
+	PostVerify []string `yaml:"post_verify"`
+}
+
+// hooks are the hook commands of every flash of the run.
+var hooks hookCommands
+
+// addHookFlags registers --pre-write-hook, --post-write-hook and
+// --post-verify-hook on fs; each can be repeated and adds to the
+// commands of the configuration.
+func addHookFlags(fs *flag.FlagSet) {
+	fs.Func("pre-write-hook", "shell command run before writing (repeatable)", func(s string) error {
+		hooks.PreWrite = append(hooks.PreWrite, s)
+		return nil
+	})
+	fs.Func("post-write-hook", "shell command run once the image is written and synced (repeatable)", func(s string) error {
+		hooks.PostWrite = append(hooks.PostWrite, s)
+		return nil
+	})
+	fs.Func("post-verify-hook", "shell command run after a successful --verify (repeatable)", func(s string) error {
+		hooks.PostVerify = append(hooks.PostVerify, s)
+		return nil
+	})
+}
+
+// flasherHooks returns the commands as flasher hooks writing on out,
+// followed by the post-flash steps of the plugins, which run once the
+// image is written and, with verify, verified.
+func (h hookCommands) flasherHooks(out io.Writer, verify bool) flasher.Hooks {
+	usePlugins()
+	commands := func(list []string) []flasher.Hook {
+		var hooks []flasher.Hook
+		for _, c := range list {
+			hooks = append(hooks, flasher.CommandHook(c, out))
+		}
+		return hooks
+	}
+	fh := flasher.Hooks{
+		PreWrite:   commands(h.PreWrite),
+		PostWrite:  commands(h.PostWrite),
+		PostVerify: commands(h.PostVerify),
+	}
+	for _, p := range postFlashPlugins {
+		if verify {
+			fh.PostVerify = append(fh.PostVerify, p.Hook(out))
+		} else {
+			fh.PostWrite = append(fh.PostWrite, p.Hook(out))
+		}
+	}
+	return fh
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// identityFlag is the value of --reset-identity. It behaves like a boolean
+// flag, so that "--reset-identity" alone resets everything and
+// "--reset-identity=machine-id,ssh-keys" only some of it.
+type identityFlag struct {
+	reset flasher.ResetIdentity
+}
+
+func (f *identityFlag) IsBoolFlag() bool { return true }
+
+func (f *identityFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var what []string
+	if f.reset.MachineID {
+		what = append(what, "machine-id")
+	}
+	if f.reset.SSHHostKeys {
+		what = append(what, "ssh-keys")
+	}
+	if f.reset.NetNames {
+		what = append(what, "net-names")
+	}
+	return strings.Join(what, ",")
+}
+
+func (f *identityFlag) Set(s string) error {
+	f.reset = flasher.ResetIdentity{}
+	switch s {
+	case "false":
+		return nil
+	case "true", "all":
+		f.reset = flasher.ResetIdentity{MachineID: true, SSHHostKeys: true, NetNames: true}
+		return nil
+	}
+	for _, what := range strings.Split(s, ",") {
+		switch strings.TrimSpace(what) {
+		case "machine-id":
+			f.reset.MachineID = true
+		case "ssh-keys":
+			f.reset.SSHHostKeys = true
+		case "net-names":
+			f.reset.NetNames = true
+		default:
+			return fmt.Errorf("unknown identity %q, expected machine-id, ssh-keys, net-names or all", what)
+		}
+	}
+	return nil
+}
+
+// addIdentityFlag registers --reset-identity on fs.
+func addIdentityFlag(fs *flag.FlagSet) *identityFlag {
+	f := &identityFlag{}
+	fs.Var(f, "reset-identity", "clear the machine-id, SSH host keys and network interface names of the image (or --reset-identity=machine-id,ssh-keys,net-names)")
+	return f
+}
+
+// steps returns the customization step of the flag, none if it is unset.
+func (f *identityFlag) steps() []flasher.Step {
+	if f.reset == (flasher.ResetIdentity{}) {
+		return nil
+	}
+	return []flasher.Step{f.reset}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestIdentityFlag verifica la lettura di --reset-identity, da solo o con
+// l'elenco di cosa azzerare.
+func TestIdentityFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want flasher.ResetIdentity
+	}{
+		{nil, flasher.ResetIdentity{}},
+		{[]string{"--reset-identity"}, flasher.ResetIdentity{MachineID: true, SSHHostKeys: true, NetNames: true}},
+		{[]string{"--reset-identity=machine-id,net-names"}, flasher.ResetIdentity{MachineID: true, NetNames: true}},
+		{[]string{"--reset-identity=ssh-keys"}, flasher.ResetIdentity{SSHHostKeys: true}},
+	} {
+		fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		f := addIdentityFlag(fs)
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		steps := f.steps()
+		if tc.want == (flasher.ResetIdentity{}) {
+			if len(steps) != 0 {
+				t.Errorf("%v: nessun passo atteso. Got: %v", tc.args, steps)
+			}
+			continue
+		}
+		if len(steps) != 1 || steps[0] != tc.want {
+			t.Errorf("%v: passo errato. Got: %+v, Want: %+v", tc.args, steps, tc.want)
+		}
+	}
+
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	addIdentityFlag(fs)
+	if err := fs.Parse([]string{"--reset-identity=hostname"}); err == nil {
+		t.Error("--reset-identity=hostname dovrebbe essere rifiutato")
+	}
+}
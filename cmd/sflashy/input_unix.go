@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// cancellableInput returns a reader of the terminal f whose reads can be
+// stopped, and the function that stops them and leaves f as it was.
+func cancellableInput(f *os.File) (io.Reader, func(), error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Un descrittore non bloccante va nel poller del runtime, e Close
+	// sblocca la Read in corso.
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	in := os.NewFile(uintptr(fd), f.Name())
+	return in, func() {
+		in.Close()
+		// Il flag è del file aperto, condiviso con f: le richieste
+		// successive leggono f in modo bloccante.
+		syscall.SetNonblock(int(f.Fd()), false)
+	}, nil
+}
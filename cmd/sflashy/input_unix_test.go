@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestCancellableInput verifica che la lettura si fermi senza consumare
+// l'input che arriva dopo.
+func TestCancellableInput(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	in, stop, err := cancellableInput(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error)
+	go func() {
+		_, err := io.ReadAll(in)
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("La lettura non si è fermata")
+	}
+
+	w.WriteString("y\n")
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil || line != "y\n" {
+		t.Errorf("La risposta successiva va a chi la chiede. Got: %q, %v", line, err)
+	}
+}
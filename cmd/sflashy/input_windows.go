@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	kernel32                          = syscall.NewLazyDLL("kernel32.dll")
+	procGetNumberOfConsoleInputEvents = kernel32.NewProc("GetNumberOfConsoleInputEvents")
+	procPeekConsoleInputW             = kernel32.NewProc("PeekConsoleInputW")
+)
+
+// inputRecord is the INPUT_RECORD of a key event.
+type inputRecord struct {
+	eventType   uint16
+	_           uint16
+	keyDown     int32
+	repeatCount uint16
+	virtualKey  uint16
+	scanCode    uint16
+	char        uint16
+	controlKeys uint32
+}
+
+const (
+	keyEvent = 0x1
+	vkReturn = 0x0d
+)
+
+// consoleReader reads the console only when a line has been typed, so
+// that a Read never blocks past stop.
+type consoleReader struct {
+	f    *os.File
+	done chan struct{}
+}
+
+// lineReady reports whether Enter is among the pending console events:
+// in line mode, a read then returns at once.
+func (r *consoleReader) lineReady() bool {
+	var n uint32
+	if ok, _, _ := procGetNumberOfConsoleInputEvents.Call(r.f.Fd(), uintptr(unsafe.Pointer(&n))); ok == 0 || n == 0 {
+		return false
+	}
+	records := make([]inputRecord, min(n, 256))
+	var read uint32
+	if ok, _, _ := procPeekConsoleInputW.Call(r.f.Fd(), uintptr(unsafe.Pointer(&records[0])), uintptr(len(records)), uintptr(unsafe.Pointer(&read))); ok == 0 {
+		return false
+	}
+	for _, rec := range records[:read] {
+		if rec.eventType == keyEvent && rec.keyDown != 0 && rec.virtualKey == vkReturn {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *consoleReader) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		default:
+		}
+		if r.lineReady() {
+			return r.f.Read(b)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// cancellableInput returns a reader of the console f whose reads can be
+// stopped, and the function that stops them.
+func cancellableInput(f *os.File) (io.Reader, func(), error) {
+	r := &consoleReader{f: f, done: make(chan struct{})}
+	var once sync.Once
+	return r, func() { once.Do(func() { close(r.done) }) }, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+	"gopkg.in/yaml.v3"
+)
+
+// layoutFile is a flash layout, in YAML or JSON: the images that make up
+// the content of a device and where each of them goes, e.g.
+//
+//	images:
+//	  - name: u-boot
+//	    file: u-boot-sunxi-with-spl.bin
+//	    offset: 16s
+//	  - name: rootfs
+//	    file: rootfs.ext4.xz
+//	    partition: 2
+type layoutFile struct {
+	Images []layoutImage `yaml:"images"`
+}
+
+// layoutImage is an image of a layoutFile.
+type layoutImage struct {
+	Name string `yaml:"name"`
+	// File is the image, relative to the layout file; compressed images
+	// are decompressed as for a flash.
+	File string `yaml:"file"`
+	// Offset is where the image starts on the device, or within
+	// Partition, with the suffixes of --seek.
+	Offset    string `yaml:"offset"`
+	Partition int    `yaml:"partition"`
+	// SHA256 is the expected digest of the (uncompressed) image.
+	SHA256 string `yaml:"sha256"`
+
+	offset int64
+}
+
+// loadLayout reads the layout file at path and checks its images.
+func loadLayout(path string) ([]layoutImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var layout layoutFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&layout); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid layout %s: %w", path, err)
+	}
+	if len(layout.Images) == 0 {
+		return nil, fmt.Errorf("the layout %s has no images", path)
+	}
+	dir := filepath.Dir(path)
+	for i := range layout.Images {
+		img := &layout.Images[i]
+		if img.Name == "" {
+			img.Name = fmt.Sprintf("image %d", i+1)
+		}
+		if img.File == "" {
+			return nil, fmt.Errorf("%s: %s has no file", path, img.Name)
+		}
+		if !filepath.IsAbs(img.File) && img.File != flasher.StdinImage && !strings.Contains(img.File, "://") {
+			img.File = filepath.Join(dir, img.File)
+		}
+		if img.Offset != "" {
+			n, err := parseSize(img.Offset)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid offset of %s: %w", path, img.Name, err)
+			}
+			img.offset = int64(n)
+		}
+		if img.Partition < 0 {
+			return nil, fmt.Errorf("%s: invalid partition %d of %s", path, img.Partition, img.Name)
+		}
+		if img.SHA256 != "" {
+			if b, err := hex.DecodeString(img.SHA256); err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("%s: invalid sha256 of %s", path, img.Name)
+			}
+		}
+	}
+	return layout.Images, nil
+}
+
+// layoutOptions collects the settings of `sflashy layout`.
+type layoutOptions struct {
+	Layout    string
+	Images    []layoutImage
+	Device    string
+	Yes       bool
+	Eject     bool
+	Verify    bool
+	BlockSize int
+	Timeout   time.Duration
+	JSON      io.Writer
+	PauseKey  bool
+}
+
+// runLayout runs `sflashy layout <layout-file> <device>`, which writes all
+// the images of a layout file to a device as a single flash.
+func runLayout(args []string) error {
+	fs := flag.NewFlagSet("layout", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	eject := fs.Bool("eject", false, "power off / eject the device when done")
+	verify := fs.Bool("verify", false, "read every image back once all are written")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort if writing and verifying take longer than this, e.g. 20m")
+	var bs sizeFlag
+	fs.Var(&bs, "bs", "size of each write to the device (default 32M)")
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 2 {
+		return usageError("layout requires a layout file and a device")
+	}
+	images, err := loadLayout(positional[0])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+
+	selector, err := parseTargetSelector(positional[1])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	device, err := findTarget(selector)
+	if err != nil {
+		return err
+	}
+	opts := layoutOptions{
+		Layout: positional[0], Images: images, Device: device, Yes: *yes, Eject: *eject, Verify: *verify,
+		BlockSize: int(bs.bytes), Timeout: *timeout, PauseKey: flasher.IsTerminal(os.Stdin),
+	}
+	if *jsonOut {
+		opts.JSON = os.Stdout
+	}
+	return flashLayout(context.Background(), opts, os.Stdin, os.Stderr)
+}
+
+// flashLayout checks the device, opens the images, asks for confirmation
+// and writes the layout.
+func flashLayout(ctx context.Context, opts layoutOptions, userInput io.Reader, termOut io.Writer) (err error) {
+	summary := flashSummary{Image: filepath.Base(opts.Layout), Device: opts.Device, Verification: "skipped"}
+	if opts.JSON != nil {
+		defer func() { summary.writeJSON(opts.JSON, err) }()
+	}
+	if flashAudit != nil {
+		dev := lookupDeviceInfo(opts.Device)
+		defer func() { flashAudit.record("layout", summary, dev, err) }()
+	}
+	log := logger.With("layout", opts.Layout, "device", opts.Device)
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return err
+	}
+	mounts := mountedPartitions(opts.Device)
+	if len(mounts) > 0 && !autoUnmount {
+		return fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, opts.Device, strings.Join(mounts, ", "))
+	}
+
+	usePlugins()
+	entries := make([]flasher.LayoutEntry, len(opts.Images))
+	for i, img := range opts.Images {
+		src, err := flasher.OpenImage(img.File, flasher.OpenOptions{LowMemory: lowMemory})
+		if err != nil {
+			return fmt.Errorf("could not open %s: %w", img.File, err)
+		}
+		defer src.Close()
+		entries[i] = flasher.LayoutEntry{Name: img.Name, Source: src, Offset: img.offset, Partition: img.Partition, Checksum: img.SHA256}
+	}
+	if !opts.Yes {
+		writeLayoutDetails(termOut, opts.Images, entries, opts.Device, lookupDeviceInfo(opts.Device))
+	}
+
+	f := newFlasher(flashOptions{Image: opts.Layout, Device: opts.Device, Verify: opts.Verify, BlockSize: opts.BlockSize, Timeout: opts.Timeout}, termOut)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	f.Pauser = newPauser(opts.PauseKey, termOut)
+	defer pauseOnSignal(f.Pauser)()
+	stopInterrupt, stopPause := func() {}, func() {}
+	defer func() { stopInterrupt(); stopPause() }()
+	f.Confirm = func() error {
+		if !opts.Yes && !confirmAction(userInput, termOut, fmt.Sprintf("Flashing %d images to device.", len(entries))) {
+			fmt.Fprintln(termOut, "Operation cancelled.")
+			return errCancelled
+		}
+		if len(mounts) > 0 {
+			fmt.Fprintf(termOut, "Unmounting %s...\n", strings.Join(mounts, ", "))
+			if err := unmountDisk(opts.Device); err != nil {
+				return fmt.Errorf("%w: %v", errDeviceMounted, err)
+			}
+		}
+		if opts.PauseKey {
+			stopPause = pauseOnInput(f.Pauser, userInput)
+		}
+		stopInterrupt = cancelOnInterrupt(cancel)
+		return nil
+	}
+	defer reportOnSignal(f, termOut)()
+
+	results, err := f.FlashLayout(ctx, entries, deviceLocation(opts.Device))
+	if len(results) > 0 {
+		summary.Elapsed, summary.Verification = results[0].Elapsed, results[len(results)-1].Verification
+		for _, r := range results {
+			summary.Bytes += r.Bytes
+		}
+		writeLayoutSummary(termOut, summary, results)
+		log.Info("layout written", "images", len(results), "bytes", summary.Bytes, "elapsed", summary.Elapsed, "verification", summary.Verification)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Eject {
+		fmt.Fprintf(termOut, "Ejecting %s...\n", opts.Device)
+		if err := ejectDevice(opts.Device); err != nil {
+			return err
+		}
+		fmt.Fprintf(termOut, ColorSuccess+"It is now safe to remove %s."+ColorReset+"\n", opts.Device)
+	}
+	return nil
+}
+
+// writeLayoutDetails shows the images of a layout and where each of them
+// goes, like writeFlashDetails does for a single image.
+func writeLayoutDetails(w io.Writer, images []layoutImage, entries []flasher.LayoutEntry, device string, dev *deviceInfo) {
+	fmt.Fprintln(w, ColorProgress+"\nAbout to flash a layout"+ColorReset)
+	for i, img := range images {
+		size := "size unknown"
+		if s := entries[i].Source.Size; s > 0 {
+			size = formatSize(uint64(s))
+		}
+		where := fmt.Sprintf("offset %d", img.offset)
+		if img.Partition != 0 {
+			where = fmt.Sprintf("partition %d", img.Partition)
+			if img.offset > 0 {
+				where += fmt.Sprintf(" + %d", img.offset)
+			}
+		}
+		fmt.Fprintf(w, "  %-8s %s: %s (%s) at %s\n", "Image:", img.Name, filepath.Base(img.File), size, where)
+	}
+	writeTargetDetails(w, device, 0, dev)
+}
+
+// writeLayoutSummary prints the summary of a layout: the totals of s and
+// a line for each image written.
+func writeLayoutSummary(w io.Writer, s flashSummary, results []flasher.LayoutResult) {
+	var speed float64
+	if s.Elapsed > 0 {
+		speed = float64(s.Bytes) / s.Elapsed.Seconds() / 1e6
+	}
+	fmt.Fprintln(w, ColorSuccess+"\nSummary"+ColorReset)
+	fmt.Fprintf(w, "  %-14s %s\n", "Layout:", s.Image)
+	fmt.Fprintf(w, "  %-14s %s\n", "Device:", s.Device)
+	fmt.Fprintf(w, "  %-14s %d (%s)\n", "Bytes written:", s.Bytes, formatSize(uint64(s.Bytes)))
+	fmt.Fprintf(w, "  %-14s %s\n", "Elapsed:", s.Elapsed.Round(100*time.Millisecond))
+	fmt.Fprintf(w, "  %-14s %.1f MB/s\n", "Average speed:", speed)
+	for _, r := range results {
+		fmt.Fprintf(w, "  %-14s %d bytes at offset %d, %s %s, verification %s\n", r.Name+":", r.Bytes, r.Offset,
+			strings.ToUpper(s.hash()), hex.EncodeToString(r.Digest), r.Verification)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestLoadLayout verifica la lettura di un file di layout, in YAML e in
+// JSON, e il rifiuto di quelli non validi.
+func TestLoadLayout(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "board.yaml")
+	os.WriteFile(yamlPath, []byte("images:\n  - name: u-boot\n    file: u-boot.bin\n    offset: 16s\n  - file: /abs/rootfs.img\n    partition: 2\n    offset: 1M\n"), 0o644)
+	images, err := loadLayout(yamlPath)
+	if err != nil {
+		t.Fatalf("loadLayout ha restituito un errore: %v", err)
+	}
+	if len(images) != 2 || images[0].File != filepath.Join(dir, "u-boot.bin") || images[0].offset != 8192 {
+		t.Errorf("Prima immagine errata. Got: %+v", images)
+	}
+	if images[1].Name != "image 2" || images[1].File != "/abs/rootfs.img" || images[1].Partition != 2 || images[1].offset != 1<<20 {
+		t.Errorf("Seconda immagine errata. Got: %+v", images[1])
+	}
+
+	jsonPath := filepath.Join(dir, "board.json")
+	os.WriteFile(jsonPath, []byte(`{"images": [{"name": "env", "file": "env.bin", "offset": 4096}]}`), 0o644)
+	if images, err := loadLayout(jsonPath); err != nil || len(images) != 1 || images[0].offset != 4096 {
+		t.Errorf("Layout JSON letto male. Got: %+v, %v", images, err)
+	}
+
+	for name, content := range map[string]string{
+		"vuoto":             "images: []\n",
+		"senza file":        "images:\n  - name: env\n",
+		"offset":            "images:\n  - file: a.img\n    offset: tanti\n",
+		"sha256":            "images:\n  - file: a.img\n    sha256: abc\n",
+		"campo sconosciuto": "images:\n  - file: a.img\n    sede: 2\n",
+	} {
+		path := filepath.Join(dir, "bad.yaml")
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := loadLayout(path); err == nil {
+			t.Errorf("Il layout %q dovrebbe essere rifiutato", name)
+		}
+	}
+}
+
+// TestWriteLayoutDetails verifica le informazioni mostrate prima di
+// scrivere un layout.
+func TestWriteLayoutDetails(t *testing.T) {
+	images := []layoutImage{
+		{Name: "u-boot", File: "/tmp/u-boot.bin", offset: 8192},
+		{Name: "rootfs", File: "/tmp/rootfs.img", Partition: 2},
+	}
+	entries := []flasher.LayoutEntry{
+		{Source: flasher.NewSource(strings.NewReader(""), 1024)},
+		{Source: flasher.NewSource(strings.NewReader(""), 0)},
+	}
+	var out strings.Builder
+	dev := testDevices[0]
+	writeLayoutDetails(&out, images, entries, dev.Path, &dev)
+	for _, want := range []string{"About to flash a layout", "u-boot: u-boot.bin", "at offset 8192", "rootfs.img (size unknown) at partition 2", "/dev/sdb", "ABC123"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("I dettagli non contengono %q. Got: %q", want, out.String())
+		}
+	}
+}
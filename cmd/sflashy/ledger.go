@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ledgerSchema is the table of the flashes in the ledger database.
+const ledgerSchema = `CREATE TABLE IF NOT EXISTS flashes (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	device TEXT NOT NULL,
+	serial TEXT NOT NULL DEFAULT '',
+	model TEXT NOT NULL DEFAULT '',
+	image TEXT NOT NULL,
+	hash TEXT NOT NULL DEFAULT '',
+	digest TEXT NOT NULL DEFAULT '',
+	bytes INTEGER NOT NULL DEFAULT 0,
+	operator TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	verification TEXT NOT NULL DEFAULT '',
+	duration_seconds REAL NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS flashes_serial ON flashes (serial);
+`
+
+// ledger records every flash in a SQLite database, so that `sflashy
+// history` can tell which image is on a unit. The database is written
+// and queried with the sqlite3 command.
+type ledger struct {
+	path string
+	// operator is who runs sflashy, recorded with each flash.
+	operator string
+}
+
+// flashLedger is the ledger of the configuration, nil if there is none.
+var flashLedger *ledger
+
+// minSQLite is the first sqlite3 with -json.
+var minSQLite = [2]int{3, 33}
+
+// newLedger returns the ledger at path, after checking that the sqlite3
+// command is there and recent enough.
+func newLedger(path string) (*ledger, error) {
+	out, err := exec.Command("sqlite3", "-version").Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("the ledger needs the sqlite3 command, %d.%d or later: install it, or remove ledger from the configuration", minSQLite[0], minSQLite[1])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 -version: %w", err)
+	}
+	if err := checkSQLiteVersion(string(out)); err != nil {
+		return nil, err
+	}
+	return &ledger{path: path, operator: ledgerOperator()}, nil
+}
+
+// checkSQLiteVersion checks the output of `sqlite3 -version`, such as
+// "3.45.1 2024-01-30 ...".
+func checkSQLiteVersion(version string) error {
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return errors.New("sqlite3 -version printed nothing")
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(fields[0], "%d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("unexpected sqlite3 version %q", fields[0])
+	}
+	if major < minSQLite[0] || major == minSQLite[0] && minor < minSQLite[1] {
+		return fmt.Errorf("the ledger needs sqlite3 %d.%d or later, found %s", minSQLite[0], minSQLite[1], fields[0])
+	}
+	return nil
+}
+
+// ledgerEntry is a flash recorded in the ledger.
+type ledgerEntry struct {
+	ID           int64   `json:"id"`
+	Time         string  `json:"time"`
+	Device       string  `json:"device"`
+	Serial       string  `json:"serial"`
+	Model        string  `json:"model"`
+	Image        string  `json:"image"`
+	Hash         string  `json:"hash"`
+	Digest       string  `json:"digest"`
+	Bytes        int64   `json:"bytes"`
+	Operator     string  `json:"operator"`
+	Status       string  `json:"status"`
+	Error        string  `json:"error"`
+	Verification string  `json:"verification"`
+	Duration     float64 `json:"duration_seconds"`
+}
+
+// ledgerOperator returns who runs sflashy: $SFLASHY_OPERATOR, or the user
+// who ran sudo, or the current user.
+func ledgerOperator() string {
+	for _, name := range []string{"SFLASHY_OPERATOR", "SUDO_USER", "USER", "USERNAME"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// sqlQuote returns s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// exec runs the SQL statements sql on the database, and returns what
+// sqlite3 prints, in JSON.
+func (l *ledger) exec(sql string) ([]byte, error) {
+	cmd := exec.Command("sqlite3", "-bail", "-json", l.path)
+	// .timeout attende le scritture di un'altra istanza di sflashy.
+	cmd.Stdin = strings.NewReader(".timeout 5000\n" + ledgerSchema + sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("the ledger needs the sqlite3 command: %w", err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3 %s: %v %s", l.path, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// add records e, at the current time, by the operator of l.
+func (l *ledger) add(e ledgerEntry) error {
+	_, err := l.exec(fmt.Sprintf("INSERT INTO flashes (time, device, serial, model, image, hash, digest, bytes, operator, status, error, verification, duration_seconds) VALUES (%s, %s, %s, %s, %s, %s, %s, %d, %s, %s, %s, %s, %f);\n",
+		sqlQuote(time.Now().UTC().Format(time.RFC3339)), sqlQuote(e.Device), sqlQuote(e.Serial), sqlQuote(e.Model), sqlQuote(e.Image),
+		sqlQuote(e.Hash), sqlQuote(e.Digest), e.Bytes, sqlQuote(l.operator), sqlQuote(e.Status), sqlQuote(e.Error), sqlQuote(e.Verification), e.Duration))
+	return err
+}
+
+// record adds the flash of s to the ledger, if any: dev, which may be
+// nil, identifies the device, and err is the outcome of the flash. A
+// flash cancelled at the confirmation is not recorded; a ledger that
+// cannot be written is only a warning, the flash is done by then.
+func (l *ledger) record(s flashSummary, dev *deviceInfo, err error) {
+	if l == nil || errors.Is(err, errCancelled) {
+		return
+	}
+	e := ledgerEntry{Device: s.Device, Image: s.Image, Bytes: s.Bytes, Status: "ok", Verification: s.Verification, Duration: s.Elapsed.Seconds()}
+	if dev != nil {
+		e.Serial, e.Model = dev.Serial, strings.TrimSpace(dev.Vendor+" "+dev.Model)
+	}
+	if len(s.Digest) > 0 {
+		e.Hash, e.Digest = s.hash(), hex.EncodeToString(s.Digest)
+	}
+	if err != nil {
+		e.Status, e.Error = "failed", err.Error()
+	}
+	if err := l.add(e); err != nil {
+		logger.Warn("could not record the flash in the ledger", "ledger", l.path, "device", s.Device, "err", err)
+	}
+}
+
+// historyQuery selects the flashes shown by `sflashy history`.
+type historyQuery struct {
+	Serial, Device, Image, Status string
+	Since                         time.Time
+	Limit                         int
+}
+
+// sql returns the SELECT of the flashes matching q, the latest first.
+func (q historyQuery) sql() string {
+	var where []string
+	if q.Serial != "" {
+		where = append(where, "serial = "+sqlQuote(q.Serial)+" COLLATE NOCASE")
+	}
+	if q.Device != "" {
+		where = append(where, "device = "+sqlQuote(q.Device))
+	}
+	if q.Image != "" {
+		where = append(where, "instr(image, "+sqlQuote(q.Image)+") > 0")
+	}
+	if q.Status != "" {
+		where = append(where, "status = "+sqlQuote(q.Status))
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "time >= "+sqlQuote(q.Since.UTC().Format(time.RFC3339)))
+	}
+	sql := "SELECT * FROM flashes"
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	sql += " ORDER BY id DESC"
+	if q.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return sql + ";\n"
+}
+
+// query returns the flashes matching q.
+func (l *ledger) query(q historyQuery) ([]ledgerEntry, error) {
+	out, err := l.exec(q.sql())
+	if err != nil {
+		return nil, err
+	}
+	var entries []ledgerEntry
+	// Senza righe sqlite3 non stampa nulla.
+	if len(bytes.TrimSpace(out)) == 0 {
+		return entries, nil
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("unexpected output of sqlite3: %w", err)
+	}
+	return entries, nil
+}
+
+// writeHistory prints entries as a table, or as JSON.
+func writeHistory(w io.Writer, entries []ledgerEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []ledgerEntry{}
+		}
+		return enc.Encode(entries)
+	case "table", "":
+	default:
+		return usageError("unknown format %q, expected table or json", format)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No flashes recorded.")
+		return nil
+	}
+	fmt.Fprintf(w, "%-20s  %-12s  %-20s  %-7s  %-16s  %-10s  %s\n", "TIME", "DEVICE", "SERIAL", "STATUS", "DIGEST", "OPERATOR", "IMAGE")
+	for _, e := range entries {
+		digest := e.Digest
+		if len(digest) > 16 {
+			digest = digest[:16]
+		}
+		fmt.Fprintf(w, "%-20s  %-12s  %-20s  %-7s  %-16s  %-10s  %s\n", e.Time, e.Device, e.Serial, e.Status, digest, e.Operator, e.Image)
+	}
+	return nil
+}
+
+// runHistory implements the `history` subcommand: the flashes recorded
+// in the ledger, e.g. the image on the unit with a serial number.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	var q historyQuery
+	fs.StringVar(&q.Serial, "serial", "", "only the flashes of the device with this serial number")
+	fs.StringVar(&q.Device, "device", "", "only the flashes of this device path")
+	fs.StringVar(&q.Image, "image", "", "only the images whose path contains this")
+	fs.StringVar(&q.Status, "status", "", "only the flashes with this result: ok or failed")
+	since := fs.Duration("since", 0, "only the flashes of this last period, e.g. 24h")
+	fs.IntVar(&q.Limit, "limit", 20, "show at most this many flashes, the latest first (0 for all)")
+	format := fs.String("format", "table", "output format: table or json")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("history takes no arguments")
+	}
+	if flashLedger == nil {
+		return usageError("no ledger: set ledger in the configuration file")
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+	entries, err := flashLedger.query(q)
+	if err != nil {
+		return err
+	}
+	return writeHistory(os.Stdout, entries, *format)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLedger verifica la registrazione delle scritture e le ricerche del
+// registro, con il comando sqlite3.
+func TestLedger(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 non disponibile")
+	}
+	l := &ledger{path: filepath.Join(t.TempDir(), "ledger.db"), operator: "o'neill"}
+	dev := &deviceInfo{Serial: "SN-1", Vendor: "SanDisk", Model: "Ultra"}
+	l.record(flashSummary{Image: "/srv/os-1.2.img", Device: "/dev/sdb", Bytes: 1024, Elapsed: 2 * time.Second, Digest: []byte{0xab, 0xcd}, Verification: "passed"}, dev, nil)
+	l.record(flashSummary{Image: "/srv/os-1.3.img", Device: "/dev/sdb", Verification: "skipped"}, dev, errors.New("write failed"))
+	l.record(flashSummary{Image: "/srv/os-1.3.img", Device: "/dev/sdc"}, nil, errCancelled)
+	l.record(flashSummary{Image: "/srv/os-1.3.img", Device: "/dev/sdc"}, &deviceInfo{Serial: "SN-2"}, nil)
+
+	entries, err := l.query(historyQuery{Serial: "sn-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Attese 2 scritture di SN-1. Got: %+v", entries)
+	}
+	// La più recente per prima.
+	if e := entries[0]; e.Status != "failed" || e.Error != "write failed" || e.Image != "/srv/os-1.3.img" {
+		t.Errorf("Scrittura fallita errata. Got: %+v", e)
+	}
+	e := entries[1]
+	if e.Status != "ok" || e.Digest != "abcd" || e.Hash != "sha256" || e.Model != "SanDisk Ultra" || e.Operator != "o'neill" || e.Bytes != 1024 || e.Duration != 2 {
+		t.Errorf("Scrittura riuscita errata. Got: %+v", e)
+	}
+
+	entries, err = l.query(historyQuery{Image: "1.3", Status: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Serial != "SN-2" {
+		t.Errorf("Filtro per immagine e risultato errato. Got: %+v", entries)
+	}
+	entries, err = l.query(historyQuery{Serial: "SN-3"})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Nessuna scrittura attesa. Got: %+v, %v", entries, err)
+	}
+	entries, err = l.query(historyQuery{Limit: 1})
+	if err != nil || len(entries) != 1 || entries[0].Device != "/dev/sdc" {
+		t.Errorf("Limite errato. Got: %+v, %v", entries, err)
+	}
+}
+
+// TestSQLiteVersion verifica il controllo della versione di sqlite3.
+func TestSQLiteVersion(t *testing.T) {
+	for version, ok := range map[string]bool{
+		"3.45.1 2024-01-30 16:01:20 e876e51a0ed5c5b3126f52e532044363a014bc594cfefa87ffb5b82257cc467a (64-bit)\n": true,
+		"3.33.0 2020-08-14 13:23:32 fca8dc8b578f215a969cd899336378966156154710873e68b3d9ac5881b0ff3f":            true,
+		"4.0.0": true,
+		"3.31.1 2020-01-27 19:55:54 3bfa9cc97da10598521b342961df8f5f68c7388fa117345eeb516eaa837bb4d6": false,
+		"":       false,
+		"sqlite": false,
+	} {
+		if err := checkSQLiteVersion(version); (err == nil) != ok {
+			t.Errorf("Versione %q: atteso ok=%v. Got: %v", version, ok, err)
+		}
+	}
+}
+
+// TestWriteHistory verifica la tabella e il JSON di sflashy history.
+func TestWriteHistory(t *testing.T) {
+	var out strings.Builder
+	if err := writeHistory(&out, nil, "table"); err != nil || !strings.Contains(out.String(), "No flashes recorded.") {
+		t.Errorf("Registro vuoto errato. Got: %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := writeHistory(&out, nil, "json"); err != nil || strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("JSON vuoto errato. Got: %q, %v", out.String(), err)
+	}
+	entries := []ledgerEntry{{Time: "2026-01-02T03:04:05Z", Device: "/dev/sdb", Serial: "SN-1", Status: "ok", Digest: strings.Repeat("ab", 32), Image: "os.img"}}
+	out.Reset()
+	if err := writeHistory(&out, entries, "table"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SERIAL", "SN-1", "abababababababab ", "os.img"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("La tabella non contiene %q. Got: %q", want, out.String())
+		}
+	}
+	out.Reset()
+	if err := writeHistory(&out, entries, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got []ledgerEntry
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil || len(got) != 1 || got[0].Serial != "SN-1" {
+		t.Errorf("JSON errato. Got: %q, %v", out.String(), err)
+	}
+	if err := writeHistory(&out, entries, "xml"); !errors.Is(err, errUsage) {
+		t.Errorf("Formato sconosciuto accettato. Got: %v", err)
+	}
+}
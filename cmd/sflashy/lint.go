@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// lintFlags are --lint and --lint-require, which check once the device is
+// written and customized that it would boot.
+type lintFlags struct {
+	Enabled  bool
+	Required []string
+}
+
+// addLintFlags registers the boot check flags on fs.
+func addLintFlags(fs *flag.FlagSet) *lintFlags {
+	f := &lintFlags{}
+	fs.BoolVar(&f.Enabled, "lint", false, "check that the flashed device would boot: boot partition, fstab and root= of the kernel command line")
+	fs.Func("lint-require", "with --lint, a file that one of the partitions must have, e.g. /overlays/my-hat.dtbo (repeatable)", func(s string) error {
+		if !strings.HasPrefix(s, "/") {
+			return fmt.Errorf("expected an absolute path, not %q", s)
+		}
+		f.Required = append(f.Required, s)
+		return nil
+	})
+	return f
+}
+
+// apply sets the boot check of opts.
+func (f lintFlags) apply(opts *flashOptions) error {
+	if !f.Enabled {
+		if len(f.Required) > 0 {
+			return usageError("--lint-require needs --lint")
+		}
+		return nil
+	}
+	opts.Lint = &bootLint{required: f.Required}
+	return nil
+}
+
+// bootLint checks the closed device with flasher.LintDevice, once the
+// other finishers have created their filesystems.
+type bootLint struct {
+	required []string
+}
+
+func (l *bootLint) finish(location, device string, out io.Writer) error {
+	fmt.Fprintf(out, "Checking that %s would boot...\n", device)
+	problems, err := flasher.LintDevice(location, l.required)
+	if err != nil {
+		return fmt.Errorf("could not check %s: %w", device, err)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(out, ColorError+"  %s"+ColorReset+"\n", p)
+		}
+		return fmt.Errorf("%w: %s", errNotBootable, strings.Join(problems, "; "))
+	}
+	logger.Info("boot check passed", "device", device)
+	return nil
+}
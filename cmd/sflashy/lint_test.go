@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// TestLintFlags verifica --lint e il controllo del dispositivo chiuso.
+func TestLintFlags(t *testing.T) {
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := addLintFlags(fs)
+	if err := fs.Parse([]string{"--lint", "--lint-require", "/config.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	var opts flashOptions
+	if err := f.apply(&opts); err != nil || opts.Lint == nil || len(opts.Lint.required) != 1 {
+		t.Fatalf("Controllo non impostato. Got: %+v, %v", opts.Lint, err)
+	}
+	if err := (lintFlags{Required: []string{"/config.txt"}}).apply(&opts); !errors.Is(err, errUsage) {
+		t.Errorf("--lint-require senza --lint dovrebbe essere un errore d'uso. Got: %v", err)
+	}
+
+	image := filepath.Join(t.TempDir(), "sd.img")
+	d, err := diskfs.Create(image, 16<<20, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Fat32LBA, Start: 2048, Size: 30000},
+	}}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	boot, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := boot.OpenFile("/config.txt", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Write([]byte("arm_64bit=1\n"))
+	d.Close()
+
+	if err := (&bootLint{required: []string{"/config.txt"}}).finish(image, image, io.Discard); err != nil {
+		t.Errorf("Il dispositivo dovrebbe superare il controllo. Got: %v", err)
+	}
+	err = (&bootLint{required: []string{"/kernel8.img"}}).finish(image, image, io.Discard)
+	if !errors.Is(err, errNotBootable) || exitCode(err) != exitNotBootable {
+		t.Errorf("Un file mancante dovrebbe far fallire il controllo. Got: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// partitionInfo describes a single partition of a block device.
+type partitionInfo struct {
+	Path       string `json:"path" yaml:"path"`
+	SizeBytes  uint64 `json:"size_bytes" yaml:"size_bytes"`
+	Type       string `json:"type,omitempty" yaml:"type,omitempty"`
+	Label      string `json:"label,omitempty" yaml:"label,omitempty"`
+	UUID       string `json:"uuid,omitempty" yaml:"uuid,omitempty"`
+	MountPoint string `json:"mountpoint,omitempty" yaml:"mountpoint,omitempty"`
+	ReadOnly   bool   `json:"read_only" yaml:"read_only"`
+}
+
+// deviceInfo is the machine-readable description of a block device,
+// as printed by `sflashy list --format json|yaml`.
+type deviceInfo struct {
+	Path        string          `json:"path" yaml:"path"`
+	SizeBytes   uint64          `json:"size_bytes" yaml:"size_bytes"`
+	Model       string          `json:"model" yaml:"model"`
+	Vendor      string          `json:"vendor" yaml:"vendor"`
+	Serial      string          `json:"serial" yaml:"serial"`
+	Bus         string          `json:"bus" yaml:"bus"`
+	DriveType   string          `json:"drive_type" yaml:"drive_type"`
+	Removable   bool            `json:"removable" yaml:"removable"`
+	Partitions  []partitionInfo `json:"partitions" yaml:"partitions"`
+	Mountpoints []string        `json:"mountpoints" yaml:"mountpoints"`
+}
+
+// deviceFilter narrows a device list down to realistic flash targets.
+// The zero value matches every device.
+type deviceFilter struct {
+	Removable bool
+	Bus       string
+	MinSize   uint64
+	MaxSize   uint64
+}
+
+// match reports whether dev satisfies every criterion of the filter.
+func (f deviceFilter) match(dev deviceInfo) bool {
+	if f.Removable && !dev.Removable {
+		return false
+	}
+	if f.Bus != "" && !strings.EqualFold(f.Bus, dev.Bus) {
+		return false
+	}
+	if f.MinSize > 0 && dev.SizeBytes < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && dev.SizeBytes > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+// filterDevices returns the devices matching f, preserving their order.
+func filterDevices(devices []deviceInfo, f deviceFilter) []deviceInfo {
+	matched := []deviceInfo{}
+	for _, dev := range devices {
+		if f.match(dev) {
+			matched = append(matched, dev)
+		}
+	}
+	return matched
+}
+
+// addFilterFlags registers the device filter flags on fs.
+func addFilterFlags(fs *flag.FlagSet, f *deviceFilter) (minSize, maxSize *sizeFlag) {
+	minSize, maxSize = &sizeFlag{}, &sizeFlag{}
+	fs.BoolVar(&f.Removable, "removable", false, "only show removable devices")
+	fs.StringVar(&f.Bus, "bus", "", "only show devices on the given bus (usb, nvme, mmc, scsi, ...)")
+	fs.Var(minSize, "min-size", "only show devices at least this large (e.g. 1G)")
+	fs.Var(maxSize, "max-size", "only show devices at most this large (e.g. 128G)")
+	return minSize, maxSize
+}
+
+// writeDevices prints the devices in the requested format (table, json or yaml).
+func writeDevices(w io.Writer, devices []deviceInfo, format string) error {
+	switch format {
+	case "table", "":
+		fmt.Fprintf(w, "%-15s %12s  %s\n", "NAME", "SIZE", "MODEL")
+		fmt.Fprintln(w, strings.Repeat("-", 42))
+		for _, dev := range devices {
+			fmt.Fprintf(w, "%-15s %12s  %s\n", dev.Path, formatSize(dev.SizeBytes), dev.Model)
+		}
+		return nil
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(devices)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(devices)
+	default:
+		return usageError("unknown format %q (expected table, json or yaml)", format)
+	}
+}
+
+// runList implements the `list` subcommand.
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	format := fs.String("format", "table", "output format: table, json or yaml")
+	var filter deviceFilter
+	minSize, maxSize := addFilterFlags(fs, &filter)
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	filter.MinSize, filter.MaxSize = minSize.bytes, maxSize.bytes
+
+	devices, err := collectDevices()
+	if err != nil {
+		return fmt.Errorf("error getting block device info: %w", err)
+	}
+	return writeDevices(os.Stdout, filterDevices(devices, filter), *format)
+}
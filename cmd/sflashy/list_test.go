@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jaypipes/ghw"
+)
+
+var testDevices = []deviceInfo{
+	{
+		Path:      "/dev/sdb",
+		SizeBytes: 32 * 1024 * 1024 * 1024,
+		Model:     "Ultra",
+		Serial:    "ABC123",
+		Bus:       "usb",
+		Removable: true,
+		Partitions: []partitionInfo{
+			{Path: "/dev/sdb1", SizeBytes: 512 * 1024 * 1024, Type: "vfat", MountPoint: "/media/boot"},
+		},
+		Mountpoints: []string{"/media/boot"},
+	},
+}
+
+// TestWriteDevicesJSON verifica che l'output JSON contenga tutti i metadati.
+func TestWriteDevicesJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeDevices(&out, testDevices, "json"); err != nil {
+		t.Fatalf("writeDevices ha restituito un errore: %v", err)
+	}
+
+	var got []deviceInfo
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("L'output non è JSON valido: %v\n%s", err, out.String())
+	}
+	if len(got) != 1 || got[0].Serial != "ABC123" || got[0].Partitions[0].MountPoint != "/media/boot" {
+		t.Errorf("Metadati JSON errati. Got: %+v", got)
+	}
+}
+
+// TestWriteDevicesFormats verifica i formati tabella e YAML e il rifiuto dei formati sconosciuti.
+func TestWriteDevicesFormats(t *testing.T) {
+	var table bytes.Buffer
+	if err := writeDevices(&table, testDevices, "table"); err != nil {
+		t.Fatalf("writeDevices(table) ha restituito un errore: %v", err)
+	}
+	if !strings.Contains(table.String(), "/dev/sdb") || !strings.Contains(table.String(), "32.00 GiB") {
+		t.Errorf("Tabella inattesa. Got: %q", table.String())
+	}
+
+	var yml bytes.Buffer
+	if err := writeDevices(&yml, testDevices, "yaml"); err != nil {
+		t.Fatalf("writeDevices(yaml) ha restituito un errore: %v", err)
+	}
+	if !strings.Contains(yml.String(), "serial: ABC123") {
+		t.Errorf("YAML inatteso. Got: %q", yml.String())
+	}
+
+	if err := writeDevices(&bytes.Buffer{}, testDevices, "xml"); err == nil {
+		t.Error("Un formato sconosciuto dovrebbe restituire un errore")
+	}
+}
+
+// TestBusName verifica che i dischi USB vengano riconosciuti dal bus path.
+func TestBusName(t *testing.T) {
+	if got := busName(ghw.StorageControllerSCSI, "pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0"); got != "usb" {
+		t.Errorf("busName(usb) = %q, want %q", got, "usb")
+	}
+	if got := busName(ghw.StorageControllerNVMe, "pci-0000:01:00.0-nvme-1"); got != "nvme" {
+		t.Errorf("busName(nvme) = %q, want %q", got, "nvme")
+	}
+}
+
+// TestFilterDevices verifica i filtri per removibilità, bus e dimensione.
+func TestFilterDevices(t *testing.T) {
+	devices := []deviceInfo{
+		{Path: "/dev/nvme0n1", SizeBytes: 512 << 30, Bus: "nvme"},
+		{Path: "/dev/sdb", SizeBytes: 32 << 30, Bus: "usb", Removable: true},
+		{Path: "/dev/sdc", SizeBytes: 2 << 40, Bus: "usb", Removable: true},
+		{Path: "/dev/mmcblk0", SizeBytes: 16 << 30, Bus: "mmc", Removable: true},
+	}
+
+	cases := []struct {
+		name   string
+		filter deviceFilter
+		want   []string
+	}{
+		{"nessun filtro", deviceFilter{}, []string{"/dev/nvme0n1", "/dev/sdb", "/dev/sdc", "/dev/mmcblk0"}},
+		{"removibili", deviceFilter{Removable: true}, []string{"/dev/sdb", "/dev/sdc", "/dev/mmcblk0"}},
+		{"bus usb", deviceFilter{Bus: "USB"}, []string{"/dev/sdb", "/dev/sdc"}},
+		{"dimensione", deviceFilter{MinSize: 8 << 30, MaxSize: 256 << 30}, []string{"/dev/sdb", "/dev/mmcblk0"}},
+	}
+	for _, tc := range cases {
+		got := filterDevices(devices, tc.filter)
+		var paths []string
+		for _, dev := range got {
+			paths = append(paths, dev.Path)
+		}
+		if strings.Join(paths, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%s: Got: %v, Want: %v", tc.name, paths, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// defaultLogPath is used when --log is given without a value.
+const defaultLogPath = "/var/log/sflashy.log"
+
+// logger receives the diagnostic messages of sflashy: checks, resolved
+// targets, progress milestones, warnings and errors. Interactive output
+// (prompts, progress bars, summaries) is still written to the terminal
+// directly. Until setupLogging is called it prints warnings and errors
+// to stderr.
+var logger = slog.New(newConsoleHandler(os.Stderr, slog.LevelWarn))
+
+// logFlag is the value of --log. It behaves like a boolean flag, so that
+// "--log" alone selects defaultLogPath and "--log=path" another file.
+type logFlag struct {
+	path string
+}
+
+func (f *logFlag) String() string   { return f.path }
+func (f *logFlag) IsBoolFlag() bool { return true }
+
+func (f *logFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.path = defaultLogPath
+	case "false":
+		f.path = ""
+	default:
+		f.path = s
+	}
+	return nil
+}
+
+// logConfig holds the logging flags shared by the subcommands.
+type logConfig struct {
+	// Format of the stderr output: console (human friendly), text or json.
+	Format string
+	Level  slog.Level
+	// File receives a debug-level log of the run, in Format (text for console).
+	File logFlag
+}
+
+// addLogFlags registers --log, --log-format and --log-level on fs.
+func addLogFlags(fs *flag.FlagSet) *logConfig {
+	cfg := &logConfig{}
+	fs.Var(&cfg.File, "log", "append a log of the run to "+defaultLogPath+" (or --log=<file>)")
+	fs.StringVar(&cfg.Format, "log-format", "console", "log output format: console, text or json")
+	fs.TextVar(&cfg.Level, "log-level", slog.LevelInfo, "minimum level printed on stderr: debug, info, warn or error")
+	return cfg
+}
+
+// setupLogging configures logger from cfg. The returned function closes
+// the log file, if any.
+func setupLogging(cfg *logConfig) (func(), error) {
+	newHandler := func(w io.Writer, level slog.Level) (slog.Handler, error) {
+		opts := &slog.HandlerOptions{Level: level}
+		switch cfg.Format {
+		case "console":
+			return newConsoleHandler(w, level), nil
+		case "text":
+			return slog.NewTextHandler(w, opts), nil
+		case "json":
+			return slog.NewJSONHandler(w, opts), nil
+		}
+		return nil, usageError("unknown log format %q (expected console, text or json)", cfg.Format)
+	}
+
+	console, err := newHandler(os.Stderr, cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.File.path == "" {
+		logger = slog.New(console)
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(cfg.File.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file: %w", err)
+	}
+	var file slog.Handler = slog.NewTextHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug})
+	if cfg.Format == "json" {
+		file = slog.NewJSONHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug})
+	}
+	logger = slog.New(multiHandler{console, file})
+	logger.Debug("sflashy started", "args", strings.Join(os.Args, " "))
+	return func() { f.Close() }, nil
+}
+
+// consoleHandler renders records for a human: errors and warnings are
+// colored and prefixed, attributes follow the message as key=value.
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func newConsoleHandler(w io.Writer, level slog.Level) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString(ColorError + "Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString(ColorWarning + "Warning: ")
+	}
+	b.WriteString(r.Message)
+
+	writeAttr := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+
+	if r.Level >= slog.LevelWarn {
+		b.WriteString(ColorReset)
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+// WithGroup is not supported by the console output: attributes are
+// printed flat.
+func (h *consoleHandler) WithGroup(string) slog.Handler { return h }
+
+// multiHandler sends each record to all of its handlers.
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLogFlag verifica che --log funzioni con e senza valore.
+func TestLogFlag(t *testing.T) {
+	var f logFlag
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&f, "log", "")
+
+	if err := fs.Parse([]string{"--log"}); err != nil || f.path != defaultLogPath {
+		t.Errorf("--log senza valore: Got: %q (%v), Want: %q", f.path, err, defaultLogPath)
+	}
+	if err := fs.Parse([]string{"--log=/tmp/flash.log"}); err != nil || f.path != "/tmp/flash.log" {
+		t.Errorf("--log=percorso: Got: %q (%v)", f.path, err)
+	}
+}
+
+// TestConsoleHandler verifica il formato leggibile dei messaggi sul terminale.
+func TestConsoleHandler(t *testing.T) {
+	var out strings.Builder
+	l := slog.New(newConsoleHandler(&out, slog.LevelInfo)).With("device", "/dev/sdb")
+
+	l.Debug("non deve comparire")
+	l.Info("target resolved")
+	l.Error("could not open device", "exit_code", 5)
+
+	got := out.String()
+	if strings.Contains(got, "non deve comparire") {
+		t.Errorf("I messaggi di debug non devono essere stampati. Got: %q", got)
+	}
+	if !strings.Contains(got, "target resolved device=/dev/sdb\n") {
+		t.Errorf("Messaggio info inatteso. Got: %q", got)
+	}
+	if !strings.Contains(got, "Error: could not open device device=/dev/sdb exit_code=5") {
+		t.Errorf("Messaggio di errore inatteso. Got: %q", got)
+	}
+}
+
+// TestSetupLoggingJSONFile verifica che il file di log riceva record JSON strutturati.
+func TestSetupLoggingJSONFile(t *testing.T) {
+	defer func(l *slog.Logger) { logger = l }(logger)
+
+	path := filepath.Join(t.TempDir(), "sflashy.log")
+	cfg := &logConfig{Format: "json", Level: slog.LevelError, File: logFlag{path: path}}
+	closeLog, err := setupLogging(cfg)
+	if err != nil {
+		t.Fatalf("setupLogging ha restituito un errore: %v", err)
+	}
+	logger.Info("device synced", "device", "/dev/sdb")
+	closeLog()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &rec); err != nil {
+		t.Fatalf("Il log non è JSON valido: %v\n%s", err, data)
+	}
+	if rec["msg"] != "device synced" || rec["device"] != "/dev/sdb" {
+		t.Errorf("Record inatteso. Got: %v", rec)
+	}
+
+	if _, err := setupLogging(&logConfig{Format: "xml"}); err == nil {
+		t.Error("Un formato di log sconosciuto dovrebbe restituire un errore")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"runtime/debug"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// lowMemory selects small buffers and a single decoding goroutine, so
+// that sflashy fits on small boards (256 MB of RAM) that flash attached
+// media themselves. It is set with --low-memory or low_memory: true in
+// the configuration.
+var lowMemory bool
+
+const (
+	// lowMemoryBlockSize replaces flasher.DefaultBlockSize in low-memory mode.
+	lowMemoryBlockSize = 1024 * 1024
+	// lowMemoryProbeSize replaces probeSize in low-memory mode.
+	lowMemoryProbeSize = 4 * 1024 * 1024
+	// lowMemoryLimit is the soft memory limit of the Go runtime in
+	// low-memory mode: the garbage collector runs harder near it.
+	lowMemoryLimit = 64 * 1024 * 1024
+)
+
+// enableLowMemory switches to low-memory mode.
+func enableLowMemory() {
+	lowMemory = true
+	debug.SetMemoryLimit(lowMemoryLimit)
+}
+
+// addLowMemoryFlag registers --low-memory on fs.
+func addLowMemoryFlag(fs *flag.FlagSet) {
+	fs.BoolFunc("low-memory", "use small buffers and a single decoding thread, for devices with little RAM", func(string) error {
+		enableLowMemory()
+		return nil
+	})
+}
+
+// copyBlockSize is the size of the writes when none is requested.
+func copyBlockSize() int {
+	if lowMemory {
+		return lowMemoryBlockSize
+	}
+	return flasher.DefaultBlockSize
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"runtime/debug"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestLowMemoryFlag verifica che --low-memory riduca la dimensione dei
+// blocchi scritti.
+func TestLowMemoryFlag(t *testing.T) {
+	defer func(prev bool, limit int64) {
+		lowMemory = prev
+		debug.SetMemoryLimit(limit)
+	}(lowMemory, debug.SetMemoryLimit(-1))
+
+	lowMemory = false
+	if copyBlockSize() != flasher.DefaultBlockSize {
+		t.Errorf("Dimensione dei blocchi predefinita errata. Got: %d", copyBlockSize())
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addLowMemoryFlag(fs)
+	if err := fs.Parse([]string{"--low-memory"}); err != nil {
+		t.Fatal(err)
+	}
+	if !lowMemory || copyBlockSize() != lowMemoryBlockSize {
+		t.Errorf("--low-memory non è stato applicato. Got: lowMemory=%t, blocchi da %d", lowMemory, copyBlockSize())
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != lowMemoryLimit {
+		t.Errorf("Limite di memoria errato. Got: %d, Want: %d", limit, lowMemoryLimit)
+	}
+}
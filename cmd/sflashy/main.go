@@ -6,68 +6,111 @@ package main
 
 import (
 	"bufio"
+	"cmp"
+	"context"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
 
-	"github.com/jaypipes/ghw"
-)
-
-// (I codici colore e le altre funzioni come usage() e listBlockDevices() rimangono invariate)
-const (
-	ColorRed    = "\033[31m"
-	ColorGreen  = "\033[32m"
-	ColorYellow = "\033[33m"
-	ColorReset  = "\033[0m"
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
 )
 
 // usage prints the help message, including available block devices.
 func usage() {
-	fmt.Println("Usage: flash <image-file> <device>")
+	fmt.Println("Usage: flash <image-file> <device>...")
+	fmt.Println("       flash list [--format table|json|yaml] [--removable] [--bus usb] [--min-size 1G] [--max-size 128G]")
+	fmt.Println("       flash <image-file> --target serial:<serial>|model:<model>|label:<label>")
+	fmt.Println("       flash watch [--station] [--yes] [--eject] [--expand] [--persistence] [--data-partition ext4] [--bus usb] [--min-size 1G] [--max-size 128G] [--metrics :9110] <image-file>")
+	fmt.Println("       flash backup [--force] [--skip-free] [--trim] [--split 4G] [--skip 0] [--count 8G] <device> <image-file>[.gz|.xz|.zst]")
+	fmt.Println("       flash clone [--yes] [--verify] [--eject] [--expand] [--randomize-guids] <source-device> <target-device>...")
+	fmt.Println("       flash wipe [--mode zero|random|quick|secure|discard|secdiscard] [--passes 3] [--yes] [--verify] <device>")
+	fmt.Println("       flash delta create [--block-size 64K] <old-image> <new-image> <delta-file>")
+	fmt.Println("       flash delta apply [--yes] [--verify] [--eject] <delta-file|url> <device>")
+	fmt.Println("       flash layout [--yes] [--verify] [--eject] <layout.yaml|json> <device>")
+	fmt.Println("       flash run [--yes] [--json] [--concurrency 2] [--max-per-controller 2] <jobs.yaml>")
+	fmt.Println("       flash serve [--listen 127.0.0.1:8080] [--token <token>] [--max-jobs 4] [--max-per-controller 2] [--images <dir>] [--interrupted ask|resume|requeue|discard] [--metrics :9110]")
+	fmt.Println("       flash controller [--listen 127.0.0.1:8090] [--token <token>] [--images <dir>]")
+	fmt.Println("       flash agent --controller <url> [--name <name>] [--token <token>] [--max-jobs 4] [--max-per-controller 2] [--metrics :9110]")
+	fmt.Println("       flash multicast send [--group 239.255.77.77:7777] [--rate 10M] [--rounds 3] <image>")
+	fmt.Println("       flash multicast receive [--group 239.255.77.77:7777] [--interface <name>] [--output <file>]")
+	fmt.Println("       flash cache fetch [--sha256 <digest>] [--output <file>] <url>")
+	fmt.Println("       flash cache serve [--listen :8091]")
+	fmt.Println("       flash cache ls [--format table|json]")
+	fmt.Println("       flash cache prune [--older-than 720h] [--max-size 50G] [--dry-run]")
+	fmt.Println("       flash history [--serial <serial>] [--device <device>] [--image <name>] [--since 24h] [--limit 20] [--format table|json]")
+	fmt.Println("       flash audit verify [--key <public.pem>] [<audit-log>]")
+	fmt.Println("       flash catalog [--url <os_list.json>] [--format table|json] [<search>]")
+	fmt.Println("       flash catalog --distros")
+	fmt.Println("       flash rpi:<os name> <device>  download an OS of the Raspberry Pi Imager catalog, check and flash it")
+	fmt.Println("       flash ubuntu-24.04-server-arm64 <device>  download an image of a distro, check and flash it")
+	fmt.Println("       flash version")
+	fmt.Println("Options:")
+	fmt.Println("  --wait    wait for the target device to be plugged in")
+	fmt.Println("  --eject   power off / eject the device when done")
+	fmt.Println("  --verify  read the device back and compare it with the image")
+	fmt.Println("  --sha256  expected SHA-256 of the image")
+	fmt.Println("  --hash sha512 --checksum <hex>  verify with another hash (" + strings.Join(flasher.HashNames(), ", ") + ")")
+	fmt.Println("  --yes     do not ask for confirmation")
+	fmt.Println("  --json    print the result as JSON on stdout (progress and prompts go to stderr)")
+	fmt.Println("  --timeout 20m  abort the flash if writing and verifying take longer")
+	fmt.Println("  --resume  continue an interrupted flash from where it stopped")
+	fmt.Println("  --expand  grow the last partition (MBR or GPT) and its filesystem to fill the device")
+	fmt.Println("  --persistence  add a persistence partition for a live ISO (--persistence-size 8G, default all)")
+	fmt.Println("  --data-partition ext4:label=DATA,size=16G  add a partition for user data after the image (ext4, fat32, exfat)")
+	fmt.Println("  --randomize-guids, --part-name 2=data  new GPT GUIDs, GPT partition names")
+	fmt.Println("  --ab [--ab-slot rootfs] [--ab-switch]  write the inactive slot of A/B partitions (rootfs_a, rootfs_b)")
+	fmt.Println("  --extra u-boot.bin@8192s  write a file at an offset of the device, e.g. a bootloader (repeatable)")
+	fmt.Println("  --copy overlay.dtbo:/overlays/  copy a file to the boot partition (repeatable)")
+	fmt.Println("  --copy-template user-data:/  copy a file rendering {{.Serial}}, {{.Index}}, {{.Hostname}} (--index-start 1)")
+	fmt.Println("  --patch config.txt:dtoverlay=vc4-kms-v3d  set (or -key: remove) a setting of cmdline.txt, config.txt or fstab (repeatable)")
+	fmt.Println("  --ssh, --user pi --password <pw>, --wifi-ssid <ssid> --wifi-password <pw> --wifi-country IT")
+	fmt.Println("  --ssh-key ~/.ssh/id_ed25519.pub")
+	fmt.Println("            set up Raspberry Pi OS for a headless first boot")
+	fmt.Println("  --hostname kiosk-01  set the hostname of the flashed system (or a template: kiosk-{{.Index}})")
+	fmt.Println("  --static-ip 192.168.1.50/24 --gateway <ip> --dns <ip,ip> --interface eth0")
+	fmt.Println("            give Raspberry Pi OS a static address instead of DHCP")
+	fmt.Println("  --device-settings devices.csv  hostname, ip and ssh_keys of each device by serial number")
+	fmt.Println("  --reset-identity  clear machine-id, SSH host keys and network interface names of a cloned system")
+	fmt.Println("            (or --reset-identity=machine-id,ssh-keys,net-names)")
+	fmt.Println("  --lint [--lint-require /overlays/my-hat.dtbo]  check that the device would boot once flashed")
+	fmt.Println("  --asset-log <file.csv|file.jsonl> [--label <template>] [--label-output <file>]  export each unit flashed, for asset labels")
+	fmt.Println("  --probe   measure the device speed and show the estimated duration first")
+	fmt.Println("  --log     append a log of the run to " + defaultLogPath + " (or --log=<file>)")
+	fmt.Println("  --log-format console|text|json, --log-level debug|info|warn|error")
+	fmt.Println("  --si, --binary          show sizes in GB (powers of 1000) or GiB (powers of 1024, default)")
+	fmt.Println("  --progress-interval 2M  bytes copied between two progress updates")
+	fmt.Println("  --pre-write-hook, --post-write-hook, --post-verify-hook <cmd>  run a shell command at that stage")
+	fmt.Println("  --retries 3   retry transient read/write errors (--retry-backoff 1s, --retry-max-backoff 30s)")
+	fmt.Println("  --low-memory  small buffers and no parallel decoding, for boards with little RAM")
+	fmt.Println("  --bs 4M   size of each write to the device (default 32M)")
+	fmt.Println("  --seek 8192s  start writing at this device offset (suffixes: s, K, M, G, ...)")
+	fmt.Println("  --count 1M    write only the first bytes of the image (alias: --length)")
+	fmt.Println("  --size 8G     uncompressed image size, if it cannot be estimated")
+	fmt.Println("gzip, xz, zstd and configured formats are decompressed on the fly; use - as <image-file> to read stdin.")
+	fmt.Println("Type p and Enter while writing to pause or resume (or send SIGUSR2).")
+	fmt.Println("dd-style operands are accepted too: if=, of=, bs=, seek=, skip=, count=, conv=sync,fsync,notrunc")
 	fmt.Println("Example: flash ~/Downloads/ubuntu.img /dev/sdb")
+	fmt.Println("Example: flash ~/Downloads/ubuntu.img --target serial:4C530001231")
 	fmt.Println("\nIf the device is mounted, please unmount it first.")
 	fmt.Println("Example: umount /dev/sdb1")
 
-	fmt.Println(ColorGreen + "\nAvailable devices:" + ColorReset)
+	fmt.Println(ColorSuccess + "\nAvailable devices:" + ColorReset)
 	listBlockDevices()
 }
 
 // listBlockDevices prints a list of available block storage devices.
 // It replaces the 'lsblk -p' command.
 func listBlockDevices() {
-	block, err := ghw.Block()
+	devices, err := collectDevices()
 	if err != nil {
-		log.Fatalf("Error getting block device info: %v", err)
-	}
-
-	fmt.Printf("%-15s %10s  %s\n", "NAME", "SIZE", "MODEL")
-	fmt.Println(strings.Repeat("-", 40))
-
-	for _, disk := range block.Disks {
-		// ghw.Disk.SizeBytes is an uint64, we convert it to float64 for division
-		sizeGB := float64(disk.SizeBytes) / (1024 * 1024 * 1024)
-		fmt.Printf("%-15s %9.2f GB  %s\n", "/dev/"+disk.Name, sizeGB, disk.Model)
+		logger.Error("could not get block device info", "err", err)
+		return
 	}
-}
-
-// progressWriter rimane invariato
-type progressWriter struct {
-	total     int64
-	out       io.Writer // Scriviamo il progresso su un output generico
-	lastShown int64
-}
-
-func (pw *progressWriter) Write(p []byte) (int, error) {
-	n := len(p)
-	pw.total += int64(n)
-	if pw.total-pw.lastShown > 2*1024*1024 {
-		// Scrive il progresso sull'output specificato (es. os.Stdout)
-		fmt.Fprintf(pw.out, "\r%sWriting... %.2f GB copied%s", ColorYellow, float64(pw.total)/(1024*1024*1024), ColorReset)
-		pw.lastShown = pw.total
+	if err := writeDevices(os.Stdout, devices, "table"); err != nil {
+		logger.Error("could not print block device info", "err", err)
 	}
-	return n, nil
 }
 
 // flashDevice ora accetta interfacce, rendendola testabile.
@@ -75,110 +118,353 @@ func (pw *progressWriter) Write(p []byte) (int, error) {
 // dest: Lo stream di dati del dispositivo di destinazione.
 // userInput: Lo stream per leggere l'input dell'utente (la conferma 'y/N').
 // termOut: Lo stream per scrivere i messaggi all'utente.
-func flashDevice(source io.Reader, dest io.Writer, userInput io.Reader, termOut io.Writer) error {
-	fmt.Fprintln(termOut, "Flashing image to device. This will erase all data on the device.")
-	fmt.Fprint(termOut, "Are you sure? [y/N]: ")
-
-	reader := bufio.NewReader(userInput)
-	response, _ := reader.ReadString('\n')
-	response = strings.TrimSpace(response)
-
-	if response != "y" && response != "Y" {
+func flashDevice(source io.Reader, dest io.Writer, userInput io.Reader, termOut io.Writer) (flasher.Result, error) {
+	if !confirm(userInput, termOut) {
 		fmt.Fprintln(termOut, "Operation cancelled.")
-		return nil
+		return flasher.Result{}, errCancelled
 	}
+	return newFlasher(flashOptions{}, termOut).Copy(context.Background(), source, dest, 0)
+}
 
-	fmt.Fprintln(termOut, "Starting flash operation...")
-
-	pw := &progressWriter{out: termOut}
-	readerWithProgress := io.TeeReader(source, pw)
+// confirm asks the user to confirm the destructive operation and reports
+// whether they answered yes. A *bufio.Reader is used as is, so that
+// repeated prompts (watch mode) share the same buffered input.
+func confirm(userInput io.Reader, termOut io.Writer) bool {
+	return confirmAction(userInput, termOut, "Flashing image to device.")
+}
 
-	// Usiamo io.CopyBuffer per un maggiore controllo e potenziale efficienza
-	buf := make([]byte, 32*1024*1024) // Buffer da 32MB come in dd bs=32M
-	_, err := io.CopyBuffer(dest, readerWithProgress, buf)
+// confirmAction is confirm for the operation described by action.
+func confirmAction(userInput io.Reader, termOut io.Writer, action string) bool {
+	fmt.Fprintln(termOut, action+" This will erase all data on the device.")
+	fmt.Fprint(termOut, "Are you sure? [y/N]: ")
 
-	if err != nil {
-		fmt.Fprintln(termOut) // Nuova riga per non sovrascrivere il progresso
-		return fmt.Errorf("error while writing to device: %w", err)
+	reader, ok := userInput.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(userInput)
 	}
+	response, _ := reader.ReadString('\n')
+	response = strings.TrimSpace(response)
 
-	// La chiamata a Sync() deve essere fatta sul file reale, non sull'interfaccia.
-	// La gestiamo nel chiamante (la funzione main).
+	return response == "y" || response == "Y"
+}
 
-	fmt.Fprintln(termOut) // Nuova riga finale
-	fmt.Fprintln(termOut, ColorGreen+"\nFlash completed successfully!"+ColorReset)
-	return nil
+// parseInterspersed parses fs allowing flags to appear before, between or
+// after the positional arguments, which are returned in order. A "--"
+// argument ends flag parsing.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
 }
 
 func main() {
-	// Configure logger to not print timestamps
-	log.SetFlags(0)
-
-	// --- Argument and Permission Checks ---
-
+	// Help and version do not read the configuration: they must work even
+	// when it is broken, e.g. to report the version in a bug.
 	args := os.Args
 	if len(args) > 1 && (args[1] == "--help" || args[1] == "-h") {
+		applyTheme("", nil, os.Getenv("NO_COLOR") != "")
 		usage()
 		os.Exit(0)
 	}
-
-	// Check for root privileges (EUID == 0 on Unix-like systems)
-	if os.Geteuid() != 0 {
-		log.Fatal(ColorRed + "Error: This program must be run as root." + ColorReset)
+	if len(args) > 1 && (args[1] == "--version" || args[1] == "version") {
+		writeVersion(os.Stdout, currentBuildInfo())
+		return
 	}
 
-	if len(args) != 3 {
-		usage()
-		os.Exit(1)
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		fatal(err)
 	}
-
-	imageFile := args[1]
-	devicePath := args[2]
-
-	// Check if the image file exists and is a regular file
-	info, err := os.Stat(imageFile)
-	if os.IsNotExist(err) {
-		log.Fatalf(ColorRed+"Error: Image file not found: %s"+ColorReset, imageFile)
+	noColor := os.Getenv("NO_COLOR") != ""
+	if err := applyTheme(cfg.Theme, cfg.Colors, noColor); err != nil {
+		fatal(fmt.Errorf("configuration: %w", err))
 	}
-	if info.IsDir() {
-		log.Fatalf(ColorRed+"Error: The provided image path is a directory, not a file: %s"+ColorReset, imageFile)
+	if cfg.LowMemory {
+		enableLowMemory()
 	}
-
-	// Check if the device exists and is a block device
-	info, err = os.Stat(devicePath)
-	if os.IsNotExist(err) {
-		log.Fatalf(ColorRed+"Error: Device not found: %s"+ColorReset, devicePath)
+	hooks = cfg.Hooks
+	configuredPlugins = pluginPaths(pluginDir(), cfg.Plugins)
+	if err := registerDecompressors(cfg.Decompressors); err != nil {
+		fatal(fmt.Errorf("configuration: %w", err))
+	}
+	if err := registerQuirks(cfg.USBQuirks); err != nil {
+		fatal(fmt.Errorf("configuration: %w", err))
+	}
+	if cfg.StateDir != "" {
+		stateStore = flasher.NewFileStore(cfg.StateDir)
+	}
+	if cfg.Ledger != "" {
+		if flashLedger, err = newLedger(cfg.Ledger); err != nil {
+			fatal(fmt.Errorf("configuration: %w", err))
+		}
+	}
+	if cfg.Audit.Log != "" {
+		if flashAudit, err = newAuditLog(cfg.Audit); err != nil {
+			fatal(fmt.Errorf("configuration: %w", err))
+		}
 	}
-	// os.ModeDevice indicates it's a device file (/dev/...).
-	// We check that this bit is set in the file mode.
-	if (info.Mode() & os.ModeDevice) == 0 {
-		log.Fatalf(ColorRed+"Error: The provided path is not a block device: %s"+ColorReset, devicePath)
+	mqttSettings = cfg.MQTT
+	cfg.Cache.Dir = cmp.Or(cfg.Cache.Dir, defaultCacheDir())
+	peerCache = newImageCache(cfg.Cache)
+	if cfg.Catalog != "" {
+		catalogLocation = cfg.Catalog
+	}
+	if err := registerDistros(cfg.Distros); err != nil {
+		fatal(fmt.Errorf("configuration: %w", err))
+	}
+	if tracingEnabled(cfg.Tracing) {
+		if err := setupTracing(); err != nil {
+			fatal(err)
+		}
+		defer shutdownTracing()
 	}
 
-	// --- Logica di esecuzione ---
+	// --- Argument and Permission Checks ---
+
+	if len(args) > 1 {
+		var run func([]string) error
+		switch args[1] {
+		case "list":
+			run = runList
+		case "watch":
+			run = runWatch
+		case "backup":
+			run = runBackup
+		case "clone":
+			run = runClone
+		case "wipe":
+			run = runWipe
+		case "layout":
+			run = runLayout
+		case "serve":
+			run = runServe
+		case "run":
+			run = runRun
+		case "history":
+			run = runHistory
+		case "controller":
+			run = runController
+		case "agent":
+			run = runAgent
+		case "multicast":
+			run = runMulticast
+		case "cache":
+			run = runCache
+		case "audit":
+			run = runAudit
+		case "catalog":
+			run = runCatalog
+		case "delta":
+			run = runDelta
+		}
+		if run != nil {
+			if err := run(args[2:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
 
-	// Apriamo i file/device reali qui
-	source, err := os.Open(imageFile)
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.Usage = usage
+	target := fs.String("target", "", "target device: a /dev path or serial:<serial>, model:<model>, label:<label>")
+	wait := fs.Bool("wait", false, "wait for the target device to appear before flashing")
+	eject := fs.Bool("eject", false, "power off / eject the device after flashing")
+	verify := fs.Bool("verify", false, "read the device back and compare it with the image")
+	sha := fs.String("sha256", "", "expected SHA-256 of the image (same as --hash sha256 --checksum)")
+	hashName := fs.String("hash", "", "hash of the digest and of --verify: "+strings.Join(flasher.HashNames(), ", ")+" (default "+flasher.DefaultHash+")")
+	checksum := fs.String("checksum", "", "expected digest of the image, computed with --hash")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort the flash if it takes longer than this, e.g. 20m")
+	probe := fs.Bool("probe", false, "measure the device speed and show the estimated duration before confirming")
+	resume := fs.Bool("resume", false, "continue an interrupted flash of the same image to the same device")
+	expand := fs.Bool("expand", false, "grow the last partition of the image to the end of the device")
+	persistence := addPersistenceFlags(fs)
+	data := addDataPartitionFlag(fs)
+	lint := addLintFlags(fs)
+	asset := addAssetFlags(fs)
+	custom := addStepFlags(fs)
+	slots := addSlotFlags(fs)
+	copyFlags := addCopyFlags(fs)
+	retry := addRetryFlags(fs)
+	addHookFlags(fs)
+	addLowMemoryFlag(fs)
+	var imageSize sizeFlag
+	fs.Var(&imageSize, "size", "uncompressed size of a compressed image, for the progress")
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args[1:])
 	if err != nil {
-		log.Fatalf(ColorRed+"Error: Could not open image file %s: %v"+ColorReset, imageFile, err)
+		os.Exit(exitUsage)
+	}
+	if err := display.apply(); err != nil {
+		fatal(err)
 	}
-	defer source.Close()
 
-	dest, err := os.OpenFile(devicePath, os.O_WRONLY|os.O_EXCL, 0666)
+	closeLog, err := setupLogging(logCfg)
 	if err != nil {
-		log.Fatalf(ColorRed+"Error: Could not open device %s for writing: %v"+ColorReset, devicePath, err)
+		fatal(err)
 	}
-	defer dest.Close()
+	defer closeLog()
 
-	// Eseguiamo la logica passando gli stream reali
-	err = flashDevice(source, dest, os.Stdin, os.Stdout)
+	// Check for root privileges (EUID == 0 on Unix-like systems)
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		fatal(err)
+	}
+
+	positional, dd, err := parseDDOperands(positional)
 	if err != nil {
-		log.Fatalf(ColorRed+"\nAn error occurred: %v"+ColorReset, err)
+		fatal(err)
+	}
+	if dd.Input != "" {
+		positional = append([]string{dd.Input}, positional...)
+	}
+	if dd.Output != "" {
+		positional = append(positional, dd.Output)
+	}
+	if *target != "" {
+		positional = append(positional, *target)
+	}
+	if len(positional) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	imageFile := positional[0]
+	var catalogImage *catalogEntry
+	if name, ok := strings.CutPrefix(imageFile, catalogPrefix); ok {
+		path, entry, err := fetchCatalogImage(context.Background(), peerCache, catalogLocation, name)
+		if err != nil {
+			fatal(err)
+		}
+		imageFile, catalogImage = path, &entry
+	} else if _, err := os.Stat(imageFile); os.IsNotExist(err) {
+		// Un nome come ubuntu-24.04-server-arm64 si scarica dalla distribuzione.
+		if d, _ := matchDistro(imageFile); d != nil {
+			if imageFile, err = fetchDistroImage(context.Background(), peerCache, imageFile); err != nil {
+				fatal(err)
+			}
+		}
+	}
+	selectors := make([]targetSelector, len(positional)-1)
+	for i, arg := range positional[1:] {
+		if selectors[i], err = parseTargetSelector(arg); err != nil {
+			fatal(fmt.Errorf("%w: %w", errUsage, err))
+		}
+	}
+	// Check if the image file exists and is a regular file
+	if imageFile == flasher.StdinImage || strings.Contains(imageFile, "://") {
+		// The image comes from stdin or from a handler: nothing to check.
+	} else if info, err := os.Stat(imageFile); os.IsNotExist(err) {
+		fatal(fmt.Errorf("image file not found: %s", imageFile))
+	} else if err == nil && info.IsDir() {
+		fatal(fmt.Errorf("the provided image path is a directory, not a file: %s", imageFile))
 	}
 
-	// Eseguiamo Sync sul file descriptor reale dopo che flashDevice ha terminato
-	fmt.Println("Finalizing write (syncing)...")
-	if err := dest.Sync(); err != nil {
-		log.Fatalf(ColorRed+"Failed to sync data to device: %v"+ColorReset, err)
+	devices := make([]string, len(selectors))
+	for i, selector := range selectors {
+		if *wait {
+			logger.Info("waiting for the target to appear", "target", selector)
+			devices[i], err = waitFor(func() (string, error) { return findTarget(selector) }, waitInterval)
+		} else {
+			devices[i], err = findTarget(selector)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if devices[i] != selector.Value {
+			logger.Info("target resolved", "target", selector, "device", devices[i])
+		}
+	}
+	devicePath := devices[0]
+
+	// With the image on stdin, the prompts are read from the terminal.
+	var input io.Reader = os.Stdin
+	if imageFile == flasher.StdinImage {
+		tty, err := os.Open("/dev/tty")
+		if err != nil && !*yes {
+			fatal(usageError("reading the image from stdin needs --yes when there is no terminal to confirm on"))
+		}
+		if err == nil {
+			defer tty.Close()
+			input = tty
+		} else {
+			input = strings.NewReader("")
+		}
+	}
+	opts := flashOptions{Image: imageFile, Device: devicePath, Yes: *yes, Eject: *eject, Verify: *verify, Probe: *probe, Resume: *resume, Expand: *expand, ImageSize: int64(imageSize.bytes), Timeout: *timeout, PauseKey: flasher.IsTerminal(input)}
+	if opts.Hash, opts.Checksum, err = checksumOptions(*hashName, *checksum, *sha); err != nil {
+		fatal(err)
+	}
+	// Un'immagine del catalogo si controlla con il suo SHA-256 ufficiale.
+	if catalogImage != nil && opts.Checksum == "" && opts.Hash == "sha256" && catalogImage.ExtractSHA256 != "" {
+		opts.Checksum = catalogImage.ExtractSHA256
+		opts.ImageSize = cmp.Or(opts.ImageSize, catalogImage.ExtractSize)
+	}
+	if opts.Retry, err = retry.policy(); err != nil {
+		fatal(err)
+	}
+	if err := applyDDOperands(&opts, dd, *copyFlags); err != nil {
+		fatal(err)
+	}
+	if opts.Expand && opts.Seek > 0 {
+		fatal(usageError("--expand needs the image at the start of the device, it cannot be used with --seek"))
+	}
+	if err := persistence.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if err := data.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if err := lint.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if err := asset.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if opts.Steps, err = custom.steps(); err != nil {
+		fatal(err)
+	}
+	opts.Index = custom.templates.start
+	if len(devices) > 1 {
+		if err := checkManyOptions(opts, slots.Enabled); err != nil {
+			fatal(err)
+		}
+	}
+	if err := slots.apply(&opts); err != nil {
+		fatal(err)
+	}
+	if *jsonOut {
+		opts.JSON = os.Stdout
+	}
+	stopMQTT, err := startMQTT()
+	if err != nil {
+		fatal(err)
+	}
+	defer stopMQTT()
+	// Progress and prompts go to stderr, so that stdout only carries the
+	// result (--json) and can be piped.
+	if len(devices) > 1 {
+		err = runFlashMany(context.Background(), opts, devices, input, os.Stderr)
+	} else {
+		err = runFlash(context.Background(), opts, input, os.Stderr)
+	}
+	if err != nil {
+		fatal(err)
 	}
+	logger.Debug("completed successfully")
 }
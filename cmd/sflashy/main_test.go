@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"strings"
 	"testing"
 )
@@ -19,7 +21,7 @@ func TestFlashDeviceSuccess(t *testing.T) {
 	var termOut bytes.Buffer // Fake terminale per catturare l'output
 
 	// 2. Esecuzione: Chiamiamo la funzione da testare con i nostri fake
-	err := flashDevice(source, &dest, userInput, &termOut)
+	_, err := flashDevice(source, &dest, userInput, &termOut)
 
 	// 3. Asserzioni: Verifichiamo che tutto sia andato come previsto
 	if err != nil {
@@ -47,11 +49,11 @@ func TestFlashDeviceCancel(t *testing.T) {
 	var termOut bytes.Buffer
 
 	// 2. Esecuzione
-	err := flashDevice(source, &dest, userInput, &termOut)
+	_, err := flashDevice(source, &dest, userInput, &termOut)
 
-	// 3. Asserzioni
-	if err != nil {
-		t.Errorf("flashDevice ha restituito un errore inaspettato in caso di annullamento: %v", err)
+	// 3. Asserzioni: l'annullamento ha un codice di uscita dedicato
+	if !errors.Is(err, errCancelled) {
+		t.Errorf("flashDevice dovrebbe restituire errCancelled in caso di annullamento. Got: %v", err)
 	}
 
 	// La cosa più importante: il buffer di destinazione deve essere vuoto!
@@ -66,33 +68,20 @@ func TestFlashDeviceCancel(t *testing.T) {
 	}
 }
 
-// TestProgressWriter verifica che il contatore di progresso funzioni correttamente.
-func TestProgressWriter(t *testing.T) {
-	// Setup
-	var capturedOutput bytes.Buffer
-	pw := &progressWriter{out: &capturedOutput}
+// TestParseInterspersed verifica che i flag possano comparire dopo gli argomenti posizionali.
+func TestParseInterspersed(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	target := fs.String("target", "", "")
+	verbose := fs.Bool("v", false, "")
 
-	// Esecuzione
-	testData := make([]byte, 1024) // 1KB di dati
-	n, err := pw.Write(testData)
+	positional, err := parseInterspersed(fs, []string{"image.img", "--target", "serial:ABC", "-v", "--", "-strano"})
 	if err != nil {
-		t.Fatalf("pw.Write ha restituito un errore: %v", err)
-	}
-
-	// Asserzioni
-	if n != 1024 {
-		t.Errorf("Write ha restituito un numero di byte errato. Got: %d, Want: %d", n, 1024)
+		t.Fatalf("parseInterspersed ha restituito un errore: %v", err)
 	}
-
-	if pw.total != 1024 {
-		t.Errorf("Il totale dei byte non è stato aggiornato correttamente. Got: %d, Want: %d", pw.total, 1024)
+	if *target != "serial:ABC" || !*verbose {
+		t.Errorf("Flag non interpretati correttamente: target=%q v=%v", *target, *verbose)
 	}
-
-	// Scriviamo abbastanza dati da triggerare la stampa del progresso
-	largeData := make([]byte, 3*1024*1024) // 3MB
-	_, _ = pw.Write(largeData)
-
-	if !strings.Contains(capturedOutput.String(), "Writing...") {
-		t.Error("Il messaggio di progresso non è stato scritto sull'output")
+	if strings.Join(positional, " ") != "image.img -strano" {
+		t.Errorf("Argomenti posizionali errati. Got: %q", positional)
 	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"time"
+)
+
+// manifestChunkSize is the size of the chunks of the image whose digests
+// the manifest of a backup lists.
+const manifestChunkSize = 64 << 20
+
+// backupManifest describes a backup: the device it was read from, when,
+// and the digests that let a restore be verified end to end, as a whole
+// or chunk by chunk.
+type backupManifest struct {
+	Image   string         `json:"image"`
+	Format  string         `json:"format,omitempty"`
+	Created time.Time      `json:"created"`
+	Sflashy string         `json:"sflashy_version"`
+	Device  manifestDevice `json:"device"`
+	// Offset is the device offset where the image starts, Bytes the size
+	// of the uncompressed image.
+	Offset int64  `json:"offset"`
+	Bytes  int64  `json:"bytes"`
+	Hash   string `json:"hash"`
+	Digest string `json:"digest"`
+	// Chunks are the digests of the ChunkSize-byte chunks of the
+	// uncompressed image, the last one possibly shorter.
+	ChunkSize int64    `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+	// Parts are the files of a split image, as written.
+	Parts []manifestPart `json:"parts,omitempty"`
+}
+
+// manifestDevice is the identity of the device a backup was read from.
+type manifestDevice struct {
+	Path      string `json:"path"`
+	Model     string `json:"model,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	Bus       string `json:"bus,omitempty"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
+}
+
+// manifestPart is a file of a split image.
+type manifestPart struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	Digest string `json:"digest"`
+}
+
+// newManifestDevice returns the identity of device, as far as dev, which
+// may be nil, tells.
+func newManifestDevice(device string, dev *deviceInfo) manifestDevice {
+	d := manifestDevice{Path: device}
+	if dev != nil {
+		d.Model, d.Vendor, d.Serial, d.Bus, d.SizeBytes = dev.Model, dev.Vendor, dev.Serial, dev.Bus, dev.SizeBytes
+	}
+	return d
+}
+
+// write saves the manifest as indented JSON at path.
+func (m *backupManifest) write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("could not write the manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+// chunkHasher computes the digest of every size bytes written to it.
+type chunkHasher struct {
+	size    int64
+	newHash func() hash.Hash
+
+	h       hash.Hash
+	n       int64 // bytes in h
+	digests []string
+	lengths []int64
+}
+
+func (c *chunkHasher) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if c.h == nil {
+			c.h, c.n = c.newHash(), 0
+		}
+		chunk := p[:min(int64(len(p)), c.size-c.n)]
+		c.h.Write(chunk)
+		c.n += int64(len(chunk))
+		p = p[len(chunk):]
+		if c.n == c.size {
+			c.finish()
+		}
+	}
+	return written, nil
+}
+
+// finish ends the chunk in progress, if any.
+func (c *chunkHasher) finish() {
+	if c.h == nil {
+		return
+	}
+	c.digests = append(c.digests, hex.EncodeToString(c.h.Sum(nil)))
+	c.lengths = append(c.lengths, c.n)
+	c.h = nil
+}
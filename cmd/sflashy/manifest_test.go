@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestChunkHasher verifica i digest dei blocchi, anche quando le scritture
+// non sono allineate ai blocchi.
+func TestChunkHasher(t *testing.T) {
+	c := &chunkHasher{size: 4, newHash: sha256.New}
+	for _, s := range []string{"ab", "cdefghi", "j"} {
+		c.Write([]byte(s))
+	}
+	c.finish()
+	want := []string{"abcd", "efgh", "ij"}
+	if len(c.digests) != len(want) {
+		t.Fatalf("Numero di blocchi errato. Got: %d", len(c.digests))
+	}
+	for i, chunk := range want {
+		sum := sha256.Sum256([]byte(chunk))
+		if c.digests[i] != hex.EncodeToString(sum[:]) || c.lengths[i] != int64(len(chunk)) {
+			t.Errorf("Blocco %d errato. Got: %s (%d byte)", i, c.digests[i], c.lengths[i])
+		}
+	}
+}
+
+// TestBackupManifest verifica il file JSON del manifest.
+func TestBackupManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "golden.img.manifest.json")
+	dev := testDevices[0]
+	m := &backupManifest{Image: "golden.img", Device: newManifestDevice(dev.Path, &dev), Bytes: 10, Hash: "sha256", Digest: "abcd", Chunks: []string{"abcd"}}
+	if err := m.write(path); err != nil {
+		t.Fatalf("write ha restituito un errore: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Manifest non valido: %v", err)
+	}
+	device, _ := got["device"].(map[string]any)
+	if got["digest"] != "abcd" || device["serial"] != "ABC123" || device["path"] != "/dev/sdb" {
+		t.Errorf("Manifest errato. Got: %s", data)
+	}
+	if _, ok := got["parts"]; ok {
+		t.Errorf("Un'immagine non divisa non dovrebbe avere parti. Got: %s", data)
+	}
+}
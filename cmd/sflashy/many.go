@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// checkTargets verifies that no two of devices are the same disk, or a
+// disk and one of its partitions.
+func checkTargets(devices []string) error {
+	for i, a := range devices {
+		for _, b := range devices[i+1:] {
+			if sameDisk(a, b) {
+				return usageError("%s and %s are the same device", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// checkManyOptions verifies that opts, and --ab if ab, can be used to
+// flash several devices at once: resuming, the A/B slots and the speed
+// probe follow a single device.
+func checkManyOptions(opts flashOptions, ab bool) error {
+	switch {
+	case opts.Resume:
+		return usageError("--resume continues the flash of a single device")
+	case ab:
+		return usageError("--ab writes the inactive slot of a single device")
+	case opts.Probe:
+		return usageError("--probe measures a single device")
+	}
+	return nil
+}
+
+// checkManyTarget runs the checks of a flash of opts on device, one of
+// several, and returns its mounted partitions.
+func checkManyTarget(opts flashOptions, device string) ([]string, error) {
+	if err := checkBlockDevice(device); err != nil {
+		return nil, err
+	}
+	mounts := mountedPartitions(device)
+	if len(mounts) > 0 && !autoUnmount {
+		return nil, fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, device, strings.Join(mounts, ", "))
+	}
+	if opts.Clone {
+		if err := checkCloneSource(opts.Image, device); err != nil {
+			return nil, err
+		}
+	}
+	return mounts, nil
+}
+
+// activeTargets returns the indexes of the devices that passed their
+// checks, i.e. without an error in errs.
+func activeTargets(devices []string, errs []error) []int {
+	var active []int
+	for i := range devices {
+		if errs[i] == nil {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+// activeDevices returns the devices at the indexes active.
+func activeDevices(devices []string, active []int) []string {
+	names := make([]string, len(active))
+	for k, i := range active {
+		names[k] = devices[i]
+	}
+	return names
+}
+
+// runFlashMany is runFlash for several devices at once: the source is read
+// a single time and written to all of them, with the checks of a flash on
+// each and a single confirmation. A device that fails, its checks or the
+// flash, is left behind, and the others go on; the summary at the end
+// reports them all, and the error is a batchError.
+func runFlashMany(ctx context.Context, opts flashOptions, devices []string, userInput io.Reader, termOut io.Writer) (err error) {
+	log := logger.With("image", opts.Image, "devices", devices)
+	log.Debug("flash to several devices requested")
+	ctx, span := tracer.Start(ctx, "sflashy")
+	span.SetAttribute("sflashy.image", opts.Image)
+	defer func() { span.End(err) }()
+	// Con --json ogni dispositivo ha la sua riga, anche se si ferma prima;
+	// così anche nel registro.
+	var results []flasher.TargetResult
+	var flashErr error
+	var infos []*deviceInfo
+	// checkErrs sono i dispositivi scartati dai controlli: gli altri
+	// vanno avanti senza di loro.
+	checkErrs := make([]error, len(devices))
+	if flashLedger != nil || flashAudit != nil || flashMetrics != nil || opts.Asset != nil {
+		infos = make([]*deviceInfo, len(devices))
+		for i, device := range devices {
+			infos[i] = lookupDeviceInfo(device)
+		}
+	}
+	if opts.JSON != nil || infos != nil {
+		defer func() {
+			for i, device := range devices {
+				summary, targetErr := flashSummary{Image: opts.Image, Device: device, Hash: opts.Hash, Verification: "skipped"}, err
+				if checkErrs[i] != nil {
+					targetErr = checkErrs[i]
+				} else if i < len(results) {
+					r := results[i]
+					summary.Bytes, summary.Digest, summary.Elapsed, summary.Verification = r.Bytes, r.Digest, r.Elapsed, r.Verification
+					if targetErr = r.Err; targetErr == nil {
+						targetErr = flashErr
+					}
+				}
+				if opts.JSON != nil {
+					summary.writeJSON(opts.JSON, targetErr)
+				}
+				if infos != nil {
+					flashLedger.record(summary, infos[i], targetErr)
+					flashAudit.record(opts.operation(), summary, infos[i], targetErr)
+					flashMetrics.record(summary, infos[i], targetErr)
+					opts.Asset.done(summary, infos[i], targetErr)
+				}
+			}
+		}()
+	}
+	if err := checkTargets(devices); err != nil {
+		return err
+	}
+	mounts := make([][]string, len(devices))
+	for i, device := range devices {
+		if mounts[i], checkErrs[i] = checkManyTarget(opts, device); checkErrs[i] != nil {
+			logger.Warn("device left out", "device", device, "err", checkErrs[i])
+		}
+	}
+	active := activeTargets(devices, checkErrs)
+	if len(active) == 0 {
+		return batchError(checkErrs, "devices")
+	}
+
+	source, err := openSource(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	f := newFlasher(opts, termOut)
+	finish := addSteps(f, opts)
+	size := f.WriteSize(source.Size)
+	for _, i := range active {
+		if err := checkCapacity(devices[i], opts.Seek, size, source.Exact); err != nil {
+			checkErrs[i] = err
+			logger.Warn("device left out", "device", devices[i], "err", err)
+		}
+	}
+	if active = activeTargets(devices, checkErrs); len(active) == 0 {
+		return batchError(checkErrs, "devices")
+	}
+	// Le correzioni dei bridge si sommano: valgono per tutti i dispositivi.
+	for _, i := range active {
+		applyQuirk(f, devices[i])
+	}
+	if !opts.Yes {
+		for _, i := range active {
+			writeFlashDetails(termOut, opts.Image, size, devices[i], opts.Seek, lookupDeviceInfo(devices[i]))
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	f.Pauser = newPauser(opts.PauseKey, termOut)
+	defer pauseOnSignal(f.Pauser)()
+	wd := newWatchdog(cancel)
+	defer wd.stop()
+	stopInterrupt, stopPause := func() {}, func() {}
+	defer func() { stopInterrupt(); stopPause() }()
+	f.Confirm = func() error {
+		if !opts.Yes && !confirmAction(userInput, termOut, fmt.Sprintf("Flashing image to %d devices.", len(active))) {
+			fmt.Fprintln(termOut, "Operation cancelled.")
+			return errCancelled
+		}
+		for _, i := range active {
+			if len(mounts[i]) == 0 {
+				continue
+			}
+			fmt.Fprintf(termOut, "Unmounting %s...\n", strings.Join(mounts[i], ", "))
+			if err := unmountDisk(devices[i]); err != nil {
+				return fmt.Errorf("%w: %v", errDeviceMounted, err)
+			}
+		}
+		if opts.PauseKey {
+			stopPause = pauseOnInput(f.Pauser, userInput)
+		}
+		stopInterrupt = cancelOnInterrupt(cancel)
+		wd.start(strings.Join(activeDevices(devices, active), ", "), opts.Timeout)
+		return nil
+	}
+	defer reportOnSignal(f, termOut)()
+
+	locations := make([]string, len(active))
+	for k, i := range active {
+		locations[k] = deviceLocation(devices[i])
+		defer batch.add(locations[k], devices[i], opts.Index+i)()
+	}
+	flashed, flashErr := untilExpired(wd, func() ([]flasher.TargetResult, error) {
+		return f.FlashMany(ctx, source, locations)
+	})
+	if errors.Is(flashErr, errCancelled) {
+		return flashErr
+	}
+	// I risultati tornano al posto del loro dispositivo, con quelli
+	// scartati dai controlli.
+	results = make([]flasher.TargetResult, len(devices))
+	for i, device := range devices {
+		results[i] = flasher.TargetResult{Device: device, Result: flasher.Result{Verification: "skipped"}, Err: checkErrs[i]}
+	}
+	for k, i := range active {
+		// Se il watchdog ha rinunciato non c'è alcun risultato.
+		if k < len(flashed) {
+			results[i] = flashed[k]
+		}
+		switch {
+		case results[i].Err != nil:
+		case flashErr != nil:
+			results[i].Err = flashErr
+		default:
+			if err := finish.finish(locations[k], devices[i], termOut); err != nil {
+				results[i].Err = err
+			}
+		}
+	}
+	if flashErr == nil && opts.Eject {
+		for _, i := range active {
+			if results[i].Err != nil {
+				continue
+			}
+			fmt.Fprintf(termOut, "Ejecting %s...\n", devices[i])
+			if err := ejectDevice(devices[i]); err != nil {
+				results[i].Err = err
+				continue
+			}
+			fmt.Fprintf(termOut, ColorSuccess+"It is now safe to remove %s."+ColorReset+"\n", devices[i])
+		}
+	}
+	errs := make([]error, len(devices))
+	for i, r := range results {
+		if errs[i] = r.Err; r.Err != nil {
+			log.Warn("device failed", "device", devices[i], "err", r.Err)
+		} else {
+			log.Info("flash finished", "device", devices[i], "elapsed", r.Elapsed, "verification", r.Verification)
+		}
+	}
+	// Un riepilogo unico, a fine lavoro, per tutti i dispositivi.
+	writeManySummary(termOut, opts.Image, opts.Hash, devices, results)
+	if flashErr != nil {
+		return flashErr
+	}
+	return batchError(errs, "devices")
+}
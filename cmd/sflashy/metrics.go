@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stationMetrics counts the flashes of a station, by model of the
+// device, and exports them to Prometheus with the devices attached and
+// the jobs running: a reader whose verifications start failing, or that
+// gets slower, stands out among the others.
+type stationMetrics struct {
+	// devices returns the devices attached that the station flashes, and
+	// running the number of flashes in progress, at each scrape.
+	devices func() ([]deviceInfo, error)
+	running func() int
+
+	mu     sync.Mutex
+	models map[string]*modelMetrics
+}
+
+// modelMetrics are the counters of a model.
+type modelMetrics struct {
+	ok, failed             int64
+	verified, verifyFailed int64
+	bytes                  int64
+	seconds                float64
+}
+
+// flashMetrics are the metrics of watch, serve or agent with --metrics,
+// nil otherwise.
+var flashMetrics *stationMetrics
+
+// addMetricsFlag registers --metrics on fs.
+func addMetricsFlag(fs *flag.FlagSet) *string {
+	return fs.String("metrics", "", "serve Prometheus metrics at /metrics on this address, e.g. :9110")
+}
+
+// newStationMetrics returns the metrics of a station with devices and
+// running.
+func newStationMetrics(devices func() ([]deviceInfo, error), running func() int) *stationMetrics {
+	return &stationMetrics{devices: devices, running: running, models: map[string]*modelMetrics{}}
+}
+
+// metricsModel returns the model label of dev, which may be nil.
+func metricsModel(dev *deviceInfo) string {
+	if dev == nil {
+		return "unknown"
+	}
+	return firstNonEmpty(strings.TrimSpace(dev.Vendor+" "+dev.Model), "unknown")
+}
+
+// record counts the flash of s to dev, which may be nil, with err. A
+// flash cancelled at the confirmation is not counted.
+func (m *stationMetrics) record(s flashSummary, dev *deviceInfo, err error) {
+	if m == nil || errors.Is(err, errCancelled) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	model := metricsModel(dev)
+	c := m.models[model]
+	if c == nil {
+		c = &modelMetrics{}
+		m.models[model] = c
+	}
+	if err != nil {
+		c.failed++
+	} else {
+		c.ok++
+	}
+	switch {
+	case errors.Is(err, errVerifyFailed) || s.Verification == "FAILED":
+		c.verified++
+		c.verifyFailed++
+	case s.Verification == "passed":
+		c.verified++
+	}
+	if s.Bytes > 0 && s.Elapsed > 0 {
+		c.bytes += s.Bytes
+		c.seconds += s.Elapsed.Seconds()
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *stationMetrics) write(w io.Writer) {
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	if m.devices != nil {
+		metric("sflashy_devices_attached", "gauge", "Devices attached that the station flashes.")
+		if devices, err := m.devices(); err == nil {
+			fmt.Fprintf(w, "sflashy_devices_attached %d\n", len(devices))
+		} else {
+			logger.Warn("could not list the devices", "err", err)
+		}
+	}
+	if m.running != nil {
+		metric("sflashy_jobs_running", "gauge", "Flashes in progress.")
+		fmt.Fprintf(w, "sflashy_jobs_running %d\n", m.running())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	models := make([]string, 0, len(m.models))
+	for model := range m.models {
+		models = append(models, model)
+	}
+	slices.Sort(models)
+	each := func(f func(label string, c *modelMetrics)) {
+		for _, model := range models {
+			f(`model="`+metricsLabel(model)+`"`, m.models[model])
+		}
+	}
+	metric("sflashy_flashes_total", "counter", "Flashes finished, by model of the device and result.")
+	each(func(l string, c *modelMetrics) {
+		fmt.Fprintf(w, "sflashy_flashes_total{%s,result=\"ok\"} %d\n", l, c.ok)
+		fmt.Fprintf(w, "sflashy_flashes_total{%s,result=\"failed\"} %d\n", l, c.failed)
+	})
+	metric("sflashy_verifications_total", "counter", "Devices read back, by model of the device and result.")
+	each(func(l string, c *modelMetrics) {
+		fmt.Fprintf(w, "sflashy_verifications_total{%s,result=\"passed\"} %d\n", l, c.verified-c.verifyFailed)
+		fmt.Fprintf(w, "sflashy_verifications_total{%s,result=\"failed\"} %d\n", l, c.verifyFailed)
+	})
+	metric("sflashy_verify_failure_ratio", "gauge", "Share of the verifications that failed, by model of the device.")
+	each(func(l string, c *modelMetrics) {
+		if c.verified > 0 {
+			fmt.Fprintf(w, "sflashy_verify_failure_ratio{%s} %g\n", l, float64(c.verifyFailed)/float64(c.verified))
+		}
+	})
+	metric("sflashy_written_bytes_total", "counter", "Bytes written, by model of the device.")
+	each(func(l string, c *modelMetrics) { fmt.Fprintf(w, "sflashy_written_bytes_total{%s} %d\n", l, c.bytes) })
+	metric("sflashy_flash_seconds_total", "counter", "Time spent writing and verifying those bytes, by model of the device.")
+	each(func(l string, c *modelMetrics) { fmt.Fprintf(w, "sflashy_flash_seconds_total{%s} %g\n", l, c.seconds) })
+	metric("sflashy_throughput_bytes_per_second", "gauge", "Average throughput of the flashes, by model of the device.")
+	each(func(l string, c *modelMetrics) {
+		if c.seconds > 0 {
+			fmt.Fprintf(w, "sflashy_throughput_bytes_per_second{%s} %g\n", l, float64(c.bytes)/c.seconds)
+		}
+	})
+}
+
+// metricsLabel escapes s for a label value.
+func metricsLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// handler serves the metrics at /metrics.
+func (m *stationMetrics) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	return mux
+}
+
+// listen serves the metrics on addr, in the background, and returns the
+// function that stops them.
+func (m *stationMetrics) listen(addr string) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics: %w", err)
+	}
+	srv := &http.Server{Handler: m.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	logger.Info("serving the metrics", "url", "http://"+ln.Addr().String()+"/metrics")
+	return func() { srv.Close() }, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStationMetrics verifica i contatori per modello e il formato di
+// Prometheus.
+func TestStationMetrics(t *testing.T) {
+	m := newStationMetrics(func() ([]deviceInfo, error) {
+		return []deviceInfo{{Path: "/dev/sdb"}, {Path: "/dev/sdc"}}, nil
+	}, func() int { return 1 })
+	reader := &deviceInfo{Vendor: "Generic", Model: `STORAGE "SD"`}
+	m.record(flashSummary{Bytes: 400e6, Elapsed: 10 * time.Second, Verification: "passed"}, reader, nil)
+	m.record(flashSummary{Bytes: 100e6, Elapsed: 10 * time.Second, Verification: "FAILED"}, reader, fmt.Errorf("%w: /dev/sdb", errVerifyFailed))
+	m.record(flashSummary{}, reader, errCancelled)
+	m.record(flashSummary{}, nil, errors.New("device busy"))
+
+	var out strings.Builder
+	m.write(&out)
+	for _, want := range []string{
+		"# TYPE sflashy_devices_attached gauge\nsflashy_devices_attached 2\n",
+		"sflashy_jobs_running 1\n",
+		`sflashy_flashes_total{model="Generic STORAGE \"SD\"",result="ok"} 1`,
+		`sflashy_flashes_total{model="Generic STORAGE \"SD\"",result="failed"} 1`,
+		`sflashy_flashes_total{model="unknown",result="failed"} 1`,
+		`sflashy_verifications_total{model="Generic STORAGE \"SD\"",result="failed"} 1`,
+		`sflashy_verify_failure_ratio{model="Generic STORAGE \"SD\""} 0.5`,
+		`sflashy_written_bytes_total{model="Generic STORAGE \"SD\""} 500000000`,
+		`sflashy_throughput_bytes_per_second{model="Generic STORAGE \"SD\""} 2.5e+07`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Manca %q. Got:\n%s", want, out.String())
+		}
+	}
+	// Senza verifiche né byte scritti non c'è un rapporto da esportare.
+	if strings.Contains(out.String(), `ratio{model="unknown"}`) || strings.Contains(out.String(), `per_second{model="unknown"}`) {
+		t.Errorf("Metriche senza dati. Got:\n%s", out.String())
+	}
+
+	srv := httptest.NewServer(m.handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") || string(body) != out.String() {
+		t.Errorf("Risposta errata di /metrics. Got: %s %q", resp.Status, body)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// makeFilesystem creates a filesystem of type fsType ("ext4", "fat32" or
+// "exfat") labelled label on the partition number of device, once the
+// kernel knows the new partition table. files, copied to its root, are
+// only supported on ext4.
+func makeFilesystem(device string, number int, fsType, label string, files map[string][]byte) error {
+	part, err := preparePartition(device, number)
+	if err != nil {
+		return err
+	}
+	var cmd string
+	var args []string
+	switch fsType {
+	case "ext4":
+		cmd, args = "mkfs.ext4", []string{"-F", "-q", "-L", label}
+	case "fat32":
+		cmd, args = "mkfs.vfat", []string{"-F", "32", "-n", label}
+	case "exfat":
+		cmd, args = "mkfs.exfat", []string{"-L", label}
+	default:
+		return fmt.Errorf("unknown filesystem %q", fsType)
+	}
+	if len(files) > 0 {
+		if fsType != "ext4" {
+			return fmt.Errorf("cannot copy files to a new %s filesystem", fsType)
+		}
+		// mkfs.ext4 -d copia i file nel nuovo filesystem.
+		dir, err := os.MkdirTemp("", "sflashy-mkfs-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0o644); err != nil {
+				return err
+			}
+		}
+		args = append(args, "-d", dir)
+	}
+	if out, err := exec.Command(cmd, append(args, part)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v %s", cmd, part, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// makeFilesystem is only supported on Linux, where mkfs can reach the
+// partitions of the device.
+func makeFilesystem(_ string, _ int, fsType, _ string, _ map[string][]byte) error {
+	return fmt.Errorf("%w: creating %s needs mkfs, on Linux", errors.ErrUnsupported, fsType)
+}
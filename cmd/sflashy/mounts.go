@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// mountsOf returns the mountpoints, read from a /proc/mounts style table,
+// of device itself and of its partitions (sdb1, mmcblk0p1, nvme0n1p1...).
+func mountsOf(device string, table io.Reader) []string {
+	var mountpoints []string
+	scanner := bufio.NewScanner(table)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if isSameOrPartition(device, fields[0]) {
+			mountpoints = append(mountpoints, fields[1])
+		}
+	}
+	return mountpoints
+}
+
+// isSameOrPartition reports whether source is device or one of its partitions.
+func isSameOrPartition(device, source string) bool {
+	if source == device {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(source, device)
+	if !ok || suffix == "" {
+		return false
+	}
+	// sdb1, mmcblk0p1 e, su macOS, disk2s1.
+	if suffix[0] == 'p' || suffix[0] == 's' {
+		suffix = suffix[1:]
+	}
+	return suffix != "" && strings.Trim(suffix, "0123456789") == ""
+}
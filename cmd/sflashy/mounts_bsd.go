@@ -0,0 +1,37 @@
+//go:build freebsd || openbsd
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"runtime"
+)
+
+// autoUnmount is set where runFlash unmounts a mounted device once the
+// flash is confirmed, instead of refusing it.
+const autoUnmount = false
+
+// mountedPartitions returns where device or its partitions are mounted,
+// from the output of mount(8). On OpenBSD the partitions of /dev/rsd1c
+// are mounted as /dev/sd1a to /dev/sd1p.
+func mountedPartitions(device string) []string {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil
+	}
+	if runtime.GOOS != "openbsd" {
+		return mountsOfMountOutput(device, bytes.NewReader(out))
+	}
+	var mountpoints []string
+	for _, letter := range "abcdefghijklmnop" {
+		mountpoints = append(mountpoints, mountsOfMountOutput(openbsdBlockDisk(device)+string(letter), bytes.NewReader(out))...)
+	}
+	return mountpoints
+}
+
+// unmountDisk is only used where autoUnmount is set.
+func unmountDisk(string) error {
+	return errors.ErrUnsupported
+}
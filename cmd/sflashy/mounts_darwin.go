@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// autoUnmount is set where runFlash unmounts a mounted device once the
+// flash is confirmed, instead of refusing it: macOS mounts every volume it
+// recognizes as soon as a card is inserted.
+const autoUnmount = true
+
+// mountedPartitions returns where device or its partitions are mounted,
+// from the output of mount(8).
+func mountedPartitions(device string) []string {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil
+	}
+	return mountsOfMountOutput(blockDiskPath(device), bytes.NewReader(out))
+}
+
+// unmountDisk unmounts every volume of device through diskutil, which
+// asks DiskArbitration, so that the volumes are not mounted again while
+// the device is written.
+func unmountDisk(device string) error {
+	out, err := exec.Command("diskutil", "unmountDisk", blockDiskPath(device)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("diskutil unmountDisk %s: %v %s", device, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !darwin && !freebsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// autoUnmount is set where runFlash unmounts a mounted device once the
+// flash is confirmed, instead of refusing it.
+const autoUnmount = false
+
+// mountedPartitions returns where device or its partitions are mounted.
+// It returns nil where /proc/self/mounts is not available.
+func mountedPartitions(device string) []string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return mountsOf(device, f)
+}
+
+// unmountDisk is only used where autoUnmount is set.
+func unmountDisk(string) error {
+	return errors.ErrUnsupported
+}
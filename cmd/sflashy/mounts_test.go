@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMountsOf verifica il riconoscimento delle partizioni montate di un dispositivo.
+func TestMountsOf(t *testing.T) {
+	table := `/dev/sda2 / ext4 rw,relatime 0 0
+/dev/sdb1 /media/boot vfat rw 0 0
+/dev/sdb2 /media/rootfs ext4 rw 0 0
+/dev/sdb10 /media/data ext4 rw 0 0
+/dev/sdbb1 /media/other ext4 rw 0 0
+/dev/mmcblk0p1 /boot vfat rw 0 0
+tmpfs /tmp tmpfs rw 0 0
+`
+	got := mountsOf("/dev/sdb", strings.NewReader(table))
+	if strings.Join(got, ",") != "/media/boot,/media/rootfs,/media/data" {
+		t.Errorf("Mountpoint di /dev/sdb errati. Got: %v", got)
+	}
+
+	got = mountsOf("/dev/mmcblk0", strings.NewReader(table))
+	if strings.Join(got, ",") != "/boot" {
+		t.Errorf("Mountpoint di /dev/mmcblk0 errati. Got: %v", got)
+	}
+
+	if got := mountsOf("/dev/sdc", strings.NewReader(table)); len(got) != 0 {
+		t.Errorf("/dev/sdc non dovrebbe risultare montato. Got: %v", got)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// mqttConfig is the mqtt section of the configuration.
+type mqttConfig struct {
+	// Broker is the address of the broker: tcp://host:1883, or
+	// tls://host:8883; none if empty.
+	Broker   string `yaml:"broker"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Topic is the prefix of the topics of the station (sflashy/<host>
+	// if empty).
+	Topic string `yaml:"topic"`
+}
+
+// MQTT 3.1.1 control packets, in the first byte of the fixed header.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xc0
+	mqttDisconnect = 0xe0
+)
+
+// mqttKeepAlive is the keep alive of the connection: a PINGREQ is sent
+// when nothing else was for half of it.
+const mqttKeepAlive = 60 * time.Second
+
+// mqttMessage is a message to publish.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// mqttEvent is published on <topic>/events for each step of a job.
+type mqttEvent struct {
+	Time   string `json:"time"`
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Image  string `json:"image"`
+	Job    string `json:"job,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+}
+
+// mqttProgress is published on <topic>/progress while a device is
+// written and verified.
+type mqttProgress struct {
+	Time       string  `json:"time"`
+	Device     string  `json:"device"`
+	Image      string  `json:"image"`
+	Phase      string  `json:"phase"`
+	Bytes      int64   `json:"bytes"`
+	Total      int64   `json:"total"`
+	Percent    int64   `json:"percent"`
+	Rate       float64 `json:"rate"`
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+// mqttPublisher publishes the events and the progress of the flashes of
+// the station to an MQTT broker, with QoS 0. The messages are sent by a
+// goroutine, which reconnects when the broker goes away: publishing never
+// blocks a flash, and the messages that do not fit in the queue are lost.
+// <topic>/status is "online" while sflashy runs and "offline" after, the
+// will of the connection if it ends abruptly.
+type mqttPublisher struct {
+	cfg    mqttConfig
+	topic  string
+	queue  chan mqttMessage
+	closed chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	// dial connects to the broker, net.Dial or tls.Dial by default.
+	dial func(network, addr string) (net.Conn, error)
+}
+
+// statusMQTT is the publisher of the configuration, nil if there is none
+// or the command does not run jobs.
+var statusMQTT *mqttPublisher
+
+// mqttSettings is the mqtt section of the configuration.
+var mqttSettings mqttConfig
+
+// startMQTT starts statusMQTT, when the configuration has a broker, and
+// returns the function that stops it. Only the commands that run jobs
+// (flash, watch, serve, agent and run) call it, once their arguments are
+// parsed: the others must not mark the station online, then offline,
+// while another sflashy may be flashing on the same host.
+func startMQTT() (func(), error) {
+	if mqttSettings.Broker == "" {
+		return func() {}, nil
+	}
+	p, err := newMQTTPublisher(mqttSettings)
+	if err != nil {
+		return nil, fmt.Errorf("configuration: %w", err)
+	}
+	statusMQTT = p
+	return p.close, nil
+}
+
+// newMQTTPublisher returns the publisher of cfg, and starts connecting
+// to the broker.
+func newMQTTPublisher(cfg mqttConfig) (*mqttPublisher, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || (u.Scheme != "tcp" && u.Scheme != "mqtt" && u.Scheme != "tls" && u.Scheme != "mqtts") || u.Host == "" {
+		return nil, fmt.Errorf("mqtt: the broker must be tcp://host:port or tls://host:port, got %q", cfg.Broker)
+	}
+	p := &mqttPublisher{
+		cfg:    cfg,
+		topic:  strings.TrimSuffix(cfg.Topic, "/"),
+		queue:  make(chan mqttMessage, 256),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if p.topic == "" {
+		host, _ := os.Hostname()
+		p.topic = "sflashy/" + host
+	}
+	addr := u.Host
+	switch u.Scheme {
+	case "tls", "mqtts":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(addr, "8883")
+		}
+		p.dial = func(network, addr string) (net.Conn, error) {
+			return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, network, addr, &tls.Config{ServerName: u.Hostname()})
+		}
+	default:
+		if u.Port() == "" {
+			addr = net.JoinHostPort(addr, "1883")
+		}
+		p.dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 10*time.Second)
+		}
+	}
+	p.publish("status", []byte("online"), true)
+	go p.run(addr)
+	return p, nil
+}
+
+// publish queues payload for <topic>/<sub>, or drops it if the queue is
+// full.
+func (p *mqttPublisher) publish(sub string, payload []byte, retain bool) {
+	select {
+	case p.queue <- mqttMessage{topic: p.topic + "/" + sub, payload: payload, retain: retain}:
+	default:
+		logger.Debug("mqtt queue full, message dropped", "topic", p.topic+"/"+sub)
+	}
+}
+
+// event publishes a step of the job of image on device; job is the ID
+// of the job of serve, if any.
+func (p *mqttPublisher) event(typ, device, image, job string, bytes int64, err error) {
+	if p == nil {
+		return
+	}
+	e := mqttEvent{Time: time.Now().UTC().Format(time.RFC3339Nano), Type: typ, Device: device, Image: image, Job: job, Bytes: bytes}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	payload, _ := json.Marshal(e)
+	p.publish("events", payload, false)
+}
+
+// watch publishes the events and the progress of f, flashing image to
+// device (to the devices of its events if empty). The progress of a
+// device is published at most once a second, and at the end of each
+// phase.
+func (p *mqttPublisher) watch(f *flasher.Flasher, image, device string) {
+	if p == nil {
+		return
+	}
+	if f.Events == nil {
+		f.Events = &flasher.EventBus{}
+	}
+	f.Events.Subscribe(flasher.SubscriberFunc(func(e flasher.Event) {
+		p.event(string(e.Type), firstNonEmpty(device, e.Device), image, "", e.Bytes, e.Err)
+	}))
+	if device == "" {
+		// Il progresso di FlashMany non dice di quale dispositivo è.
+		return
+	}
+	var last time.Time
+	next := f.OnProgress
+	f.OnProgress = func(pr flasher.Progress) {
+		if next != nil {
+			next(pr)
+		}
+		now := time.Now()
+		if now.Sub(last) < time.Second && (pr.Total == 0 || pr.Bytes < pr.Total) {
+			return
+		}
+		last = now
+		payload, _ := json.Marshal(mqttProgress{
+			Time: now.UTC().Format(time.RFC3339Nano), Device: device, Image: image, Phase: pr.Phase,
+			Bytes: pr.Bytes, Total: pr.Total, Percent: pr.Percent, Rate: pr.Rate, ETASeconds: pr.ETA.Seconds(),
+		})
+		p.publish("progress", payload, false)
+	}
+}
+
+// close publishes "offline" and the messages still queued, waiting at
+// most a few seconds for the broker, and disconnects.
+func (p *mqttPublisher) close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() {
+		p.publish("status", []byte("offline"), true)
+		close(p.closed)
+		select {
+		case <-p.done:
+		case <-time.After(5 * time.Second):
+			logger.Warn("mqtt: the broker did not take the last messages", "broker", p.cfg.Broker)
+		}
+	})
+}
+
+// run sends the queued messages to the broker at addr until close,
+// reconnecting when the connection fails.
+func (p *mqttPublisher) run(addr string) {
+	defer close(p.done)
+	var pending *mqttMessage
+	reachable := true
+	for {
+		conn, err := p.connect(addr)
+		if err == nil {
+			if !reachable {
+				logger.Info("mqtt broker reachable again", "broker", p.cfg.Broker)
+			}
+			reachable = true
+			pending, err = p.send(conn, pending)
+			conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		if reachable {
+			logger.Warn("mqtt: could not publish to the broker, retrying", "broker", p.cfg.Broker, "err", err)
+		}
+		reachable = false
+		select {
+		case <-p.closed:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// connect opens the MQTT connection to addr, with "offline" as will.
+func (p *mqttPublisher) connect(addr string) (net.Conn, error) {
+	conn, err := p.dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	var flags byte = 0x02 | 0x04 | 0x20 // clean session, will, will retain
+	payload := mqttString(nil, fmt.Sprintf("sflashy-%s-%d", host, os.Getpid()))
+	payload = mqttString(payload, p.topic+"/status")
+	payload = mqttString(payload, "offline")
+	if p.cfg.Username != "" {
+		flags |= 0x80
+		payload = mqttString(payload, p.cfg.Username)
+	}
+	if p.cfg.Password != "" {
+		flags |= 0x40
+		payload = mqttString(payload, p.cfg.Password)
+	}
+	header := mqttString(nil, "MQTT")
+	header = append(header, 4, flags)
+	header = binary.BigEndian.AppendUint16(header, uint16(mqttKeepAlive/time.Second))
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(mqttConnect, append(header, payload...))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, body, err := readMQTTPacket(bufio.NewReader(conn))
+	switch {
+	case err != nil:
+	case typ&0xf0 != mqttConnack || len(body) != 2:
+		err = fmt.Errorf("unexpected packet %#x instead of CONNACK", typ)
+	case body[1] != 0:
+		err = fmt.Errorf("connection refused by the broker, code %d", body[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// send publishes pending, if not nil, and the queued messages on conn
+// until close, pinging the broker when idle. It returns the message it
+// could not send, if any, with the error of conn.
+func (p *mqttPublisher) send(conn net.Conn, pending *mqttMessage) (*mqttMessage, error) {
+	// Le risposte del broker (PINGRESP) si scartano; una connessione
+	// chiusa dal broker si scopre qui.
+	broken := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			if _, _, err := readMQTTPacket(r); err != nil {
+				broken <- err
+				return
+			}
+		}
+	}()
+	write := func(packet []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(packet)
+		return err
+	}
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		if pending != nil {
+			if err := write(pending.packet()); err != nil {
+				return pending, err
+			}
+			pending = nil
+			ping.Reset(mqttKeepAlive / 2)
+		}
+		select {
+		case m := <-p.queue:
+			pending = &m
+		case <-ping.C:
+			if err := write([]byte{mqttPingreq, 0}); err != nil {
+				return nil, err
+			}
+		case err := <-broken:
+			return nil, err
+		case <-p.closed:
+			// Si svuota la coda, poi si saluta il broker.
+			for {
+				select {
+				case m := <-p.queue:
+					if err := write(m.packet()); err != nil {
+						return nil, nil
+					}
+					continue
+				default:
+				}
+				write([]byte{mqttDisconnect, 0})
+				return nil, nil
+			}
+		}
+	}
+}
+
+// packet returns the PUBLISH packet of m.
+func (m mqttMessage) packet() []byte {
+	typ := byte(mqttPublish)
+	if m.retain {
+		typ |= 0x01
+	}
+	return mqttPacket(typ, append(mqttString(nil, m.topic), m.payload...))
+}
+
+// mqttString appends s to b, prefixed by its length.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket returns the packet of type typ with body, after the
+// remaining length.
+func mqttPacket(typ byte, body []byte) []byte {
+	packet := []byte{typ}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads a packet from r, and returns its first byte and
+// its body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("mqtt: invalid remaining length")
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// mqttBroker è un broker finto: accetta una connessione e raccoglie i
+// messaggi pubblicati, per argomento.
+func mqttBroker(t *testing.T) (addr string, connect <-chan []byte, messages <-chan [2]string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	connCh, msgCh := make(chan []byte, 1), make(chan [2]string, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		typ, body, err := readMQTTPacket(r)
+		if err != nil || typ != mqttConnect {
+			return
+		}
+		connCh <- body
+		conn.Write([]byte{mqttConnack, 2, 0, 0})
+		for {
+			typ, body, err := readMQTTPacket(r)
+			if err != nil || typ == mqttDisconnect {
+				close(msgCh)
+				return
+			}
+			if typ&0xf0 == mqttPublish {
+				n := binary.BigEndian.Uint16(body)
+				msgCh <- [2]string{string(body[2 : 2+n]), string(body[2+n:])}
+			}
+		}
+	}()
+	return ln.Addr().String(), connCh, msgCh
+}
+
+// TestMQTTPublisher verifica la connessione, con utente e testamento, e
+// i messaggi degli eventi e del progresso di una scrittura.
+func TestMQTTPublisher(t *testing.T) {
+	addr, connect, messages := mqttBroker(t)
+	p, err := newMQTTPublisher(mqttConfig{Broker: "tcp://" + addr, Username: "mes", Password: "segreto", Topic: "fabbrica/linea-1/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-connect:
+		for _, want := range []string{"MQTT", "fabbrica/linea-1/status", "offline", "mes", "segreto"} {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("CONNECT senza %q. Got: %q", want, body)
+			}
+		}
+		if flags := body[7]; flags != 0x02|0x04|0x20|0x80|0x40 {
+			t.Errorf("Flag di CONNECT errati. Got: %#x", flags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nessuna connessione al broker")
+	}
+
+	f := &flasher.Flasher{}
+	p.watch(f, "os.img", "/dev/sdb")
+	f.Events.Publish(flasher.Event{Type: flasher.EventWriteStarted, Device: "/dev/fd/3"})
+	f.OnProgress(flasher.Progress{Phase: "Writing", Bytes: 10, Total: 100, Percent: 10})
+	f.OnProgress(flasher.Progress{Phase: "Writing", Bytes: 50, Total: 100, Percent: 50})
+	f.OnProgress(flasher.Progress{Phase: "Writing", Bytes: 100, Total: 100, Percent: 100})
+	f.Events.Publish(flasher.Event{Type: flasher.EventFailed, Bytes: 100, Err: errors.New("errore di scrittura")})
+	p.close()
+
+	var got []string
+	for m := range messages {
+		got = append(got, m[0])
+		switch m[0] {
+		case "fabbrica/linea-1/events":
+			var e mqttEvent
+			if err := json.Unmarshal([]byte(m[1]), &e); err != nil || e.Device != "/dev/sdb" || e.Image != "os.img" {
+				t.Errorf("Evento errato. Got: %s", m[1])
+			}
+			if e.Type == "failed" && e.Error != "errore di scrittura" {
+				t.Errorf("Errore mancante. Got: %s", m[1])
+			}
+		case "fabbrica/linea-1/progress":
+			var pr mqttProgress
+			if err := json.Unmarshal([]byte(m[1]), &pr); err != nil || pr.Phase != "Writing" || pr.Total != 100 {
+				t.Errorf("Progresso errato. Got: %s", m[1])
+			}
+		}
+	}
+	// Il progresso al 50% cade nello stesso secondo del primo: non si
+	// pubblica, la fine della fase sì.
+	want := "fabbrica/linea-1/status fabbrica/linea-1/events fabbrica/linea-1/progress fabbrica/linea-1/progress fabbrica/linea-1/events fabbrica/linea-1/status"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Messaggi errati. Got: %v", got)
+	}
+}
+
+// TestMQTTPacket verifica la lunghezza residua dei pacchetti.
+func TestMQTTPacket(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 300000} {
+		packet := mqttPacket(mqttPublish, make([]byte, n))
+		typ, body, err := readMQTTPacket(bufio.NewReader(strings.NewReader(string(packet))))
+		if err != nil || typ != mqttPublish || len(body) != n {
+			t.Errorf("Pacchetto di %d byte errato. Got: %#x, %d, %v", n, typ, len(body), err)
+		}
+	}
+	if _, err := newMQTTPublisher(mqttConfig{Broker: "http://broker"}); err == nil {
+		t.Error("Un broker http va rifiutato")
+	}
+}
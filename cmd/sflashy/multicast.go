@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// The image is multicast as a carousel: the sender repeats all its chunks
+// for a number of rounds, announcing the image at the start of each and
+// every so often, and the receivers keep the chunks they miss from the
+// next rounds. There is no feedback channel, so a receiver that still
+// misses chunks at the end fails.
+const (
+	// defaultMulticastGroup is an administratively scoped group, which
+	// does not leave the LAN.
+	defaultMulticastGroup = "239.255.77.77:7777"
+	multicastMagic        = "SFMC"
+	// multicastChunk is the data in a datagram, which fits in an Ethernet
+	// frame with the header and the IP and UDP ones.
+	multicastChunk  = 1400
+	multicastHeader = len(multicastMagic) + 1 + 4 + 4
+	// announceEvery is how many chunks are sent between two announcements.
+	announceEvery = 1024
+	// maxMulticastSize bounds the size a receiver accepts from an
+	// announcement, which anyone on the LAN can send.
+	maxMulticastSize = 64 << 30
+)
+
+// Kinds of packet.
+const (
+	packetAnnounce byte = iota
+	packetData
+	packetEnd
+)
+
+// multicastAnnounce describes the image of a session: the receivers need
+// it to place the chunks.
+type multicastAnnounce struct {
+	Name   string
+	Size   int64
+	Digest [sha256.Size]byte
+}
+
+// chunks returns the number of chunks of the image.
+func (a multicastAnnounce) chunks() uint32 {
+	return uint32((a.Size + multicastChunk - 1) / multicastChunk)
+}
+
+// chunkSize returns the length of the chunk index: the last one is short.
+func (a multicastAnnounce) chunkSize(index uint32) int64 {
+	return min(multicastChunk, a.Size-int64(index)*multicastChunk)
+}
+
+// validate checks an announcement received before sizing anything on it.
+func (a multicastAnnounce) validate() error {
+	if a.Size <= 0 || a.Size > maxMulticastSize {
+		return fmt.Errorf("invalid size %d", a.Size)
+	}
+	if a.Name == "" || a.Name == "." || a.Name == ".." || strings.ContainsAny(a.Name, `/\`) {
+		return fmt.Errorf("invalid name %q", a.Name)
+	}
+	return nil
+}
+
+func (a multicastAnnounce) marshal() []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(a.Size))
+	b = append(b, a.Digest[:]...)
+	return append(b, a.Name...)
+}
+
+func (a *multicastAnnounce) unmarshal(b []byte) error {
+	if len(b) < 8+sha256.Size {
+		return errors.New("short announcement")
+	}
+	a.Size = int64(binary.BigEndian.Uint64(b))
+	copy(a.Digest[:], b[8:])
+	a.Name = string(b[8+sha256.Size:])
+	return nil
+}
+
+// encodePacket returns the datagram of a packet of session: magic, kind,
+// session, index of the chunk, payload.
+func encodePacket(kind byte, session, index uint32, payload []byte) []byte {
+	b := make([]byte, 0, multicastHeader+len(payload))
+	b = append(b, multicastMagic...)
+	b = append(b, kind)
+	b = binary.BigEndian.AppendUint32(b, session)
+	b = binary.BigEndian.AppendUint32(b, index)
+	return append(b, payload...)
+}
+
+// decodePacket is the inverse of encodePacket.
+func decodePacket(b []byte) (kind byte, session, index uint32, payload []byte, err error) {
+	if len(b) < multicastHeader || string(b[:len(multicastMagic)]) != multicastMagic {
+		return 0, 0, 0, nil, errors.New("not an sflashy packet")
+	}
+	b = b[len(multicastMagic):]
+	return b[0], binary.BigEndian.Uint32(b[1:]), binary.BigEndian.Uint32(b[5:]), b[9:], nil
+}
+
+// multicastSender sends an image to a group.
+type multicastSender struct {
+	conn    io.Writer
+	image   io.ReaderAt
+	ann     multicastAnnounce
+	session uint32
+	// rate is the bytes sent per second, unlimited if 0.
+	rate   int64
+	rounds int
+	// progress, if set, is called after each chunk sent.
+	progress func(round int, sent int64)
+}
+
+// send sends the rounds of the carousel, then the end of the session.
+func (s *multicastSender) send(ctx context.Context) error {
+	announce := encodePacket(packetAnnounce, s.session, 0, s.ann.marshal())
+	buf := make([]byte, multicastChunk)
+	start := time.Now()
+	var total int64
+	write := func(packet []byte) error {
+		if _, err := s.conn.Write(packet); err != nil {
+			return err
+		}
+		total += int64(len(packet))
+		// Si va alla velocità richiesta: troppi datagrammi insieme
+		// vengono persi dai ricevitori e dagli switch.
+		if s.rate > 0 {
+			if ahead := time.Duration(total*int64(time.Second)/s.rate) - time.Since(start); ahead > time.Millisecond {
+				time.Sleep(ahead)
+			}
+		}
+		return nil
+	}
+	for round := 1; round <= s.rounds; round++ {
+		var sent int64
+		for i := uint32(0); i < s.ann.chunks(); i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if i%announceEvery == 0 {
+				if err := write(announce); err != nil {
+					return err
+				}
+			}
+			n, err := s.image.ReadAt(buf, int64(i)*multicastChunk)
+			if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+				return fmt.Errorf("reading chunk %d: %w", i, err)
+			}
+			if err := write(encodePacket(packetData, s.session, i, buf[:n])); err != nil {
+				return err
+			}
+			sent += int64(n)
+			if s.progress != nil {
+				s.progress(round, sent)
+			}
+		}
+	}
+	// La fine si ripete: un solo datagramma può andare perso.
+	for range 3 {
+		if err := write(encodePacket(packetEnd, s.session, 0, nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multicastReceiver assembles the image of the first session it hears
+// into a file.
+type multicastReceiver struct {
+	// file is created by open once the image is announced.
+	open func(ann multicastAnnounce) (*os.File, error)
+	// want, if set, is the only digest accepted in an announcement.
+	want *[sha256.Size]byte
+
+	ann      multicastAnnounce
+	session  uint32
+	file     *os.File
+	have     []bool
+	missing  uint32
+	received int64
+}
+
+// announced reports whether the receiver knows the image.
+func (r *multicastReceiver) announced() bool {
+	return r.file != nil
+}
+
+// handle processes a datagram, and reports whether the image is complete.
+// The datagrams of other sessions, the invalid announcements and chunks,
+// and the chunks before the announcement are ignored; the end of the
+// session with chunks missing is an error.
+func (r *multicastReceiver) handle(datagram []byte) (done bool, err error) {
+	kind, session, index, payload, err := decodePacket(datagram)
+	if err != nil {
+		return false, nil
+	}
+	if r.announced() && session != r.session {
+		return false, nil
+	}
+	switch kind {
+	case packetAnnounce:
+		if r.announced() {
+			return false, nil
+		}
+		var ann multicastAnnounce
+		if err := ann.unmarshal(payload); err != nil {
+			return false, nil
+		}
+		if err := ann.validate(); err != nil {
+			logger.Debug("ignoring announcement", "session", session, "error", err)
+			return false, nil
+		}
+		if r.want != nil && ann.Digest != *r.want {
+			logger.Debug("ignoring announcement of another image", "session", session, "image", ann.Name, "sha256", hex.EncodeToString(ann.Digest[:]))
+			return false, nil
+		}
+		r.ann = ann
+		if r.file, err = r.open(r.ann); err != nil {
+			return false, err
+		}
+		if err := r.file.Truncate(r.ann.Size); err != nil {
+			return false, err
+		}
+		r.session = session
+		r.have = make([]bool, r.ann.chunks())
+		r.missing = r.ann.chunks()
+		logger.Info("receiving image", "image", r.ann.Name, "size", r.ann.Size, "chunks", r.missing)
+	case packetData:
+		if !r.announced() || index >= uint32(len(r.have)) || r.have[index] {
+			return false, nil
+		}
+		if int64(len(payload)) != r.ann.chunkSize(index) {
+			return false, nil
+		}
+		if _, err := r.file.WriteAt(payload, int64(index)*multicastChunk); err != nil {
+			return false, err
+		}
+		r.have[index] = true
+		r.missing--
+		r.received += int64(len(payload))
+	case packetEnd:
+		if !r.announced() {
+			return false, nil
+		}
+		if r.missing > 0 {
+			return false, fmt.Errorf("the sender finished with %d of %d chunks missing: send more --rounds, or at a lower --rate", r.missing, len(r.have))
+		}
+	}
+	if !r.announced() || r.missing > 0 {
+		return false, nil
+	}
+	return true, r.check()
+}
+
+// check compares the digest of the file with the one announced.
+func (r *multicastReceiver) check() error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r.file, 0, r.ann.Size)); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), r.ann.Digest[:]) {
+		return fmt.Errorf("%w: the image received does not match the SHA-256 of the sender", flasher.ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// runMulticast implements the `multicast` subcommand: `multicast send`
+// and `multicast receive`.
+func runMulticast(args []string) error {
+	if len(args) == 0 {
+		return usageError("multicast requires send or receive")
+	}
+	switch args[0] {
+	case "send":
+		return runMulticastSend(args[1:])
+	case "receive":
+		return runMulticastReceive(args[1:])
+	}
+	return usageError("unknown multicast command %q, expected send or receive", args[0])
+}
+
+// runMulticastSend sends an image file to the stations listening on the
+// group.
+func runMulticastSend(args []string) error {
+	fs := flag.NewFlagSet("multicast send", flag.ContinueOnError)
+	group := fs.String("group", defaultMulticastGroup, "multicast group and port")
+	rounds := fs.Int("rounds", 3, "times the whole image is sent, for the receivers that lose some datagrams")
+	rate := &sizeFlag{}
+	rate.Set("10M")
+	fs.Var(rate, "rate", "bytes sent per second (0 for no limit)")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) != 1 {
+		return usageError("multicast send requires exactly one image")
+	}
+	if *rounds < 1 {
+		return usageError("--rounds must be at least 1")
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	f, err := os.Open(positional[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Il digest si calcola prima: va nell'annuncio.
+	ann := multicastAnnounce{Name: filepath.Base(positional[0])}
+	h := sha256.New()
+	if ann.Size, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	copy(ann.Digest[:], h.Sum(nil))
+	addr, err := net.ResolveUDPAddr("udp4", *group)
+	if err != nil {
+		return usageError("invalid --group: %v", err)
+	}
+	if !addr.IP.IsMulticast() {
+		return usageError("--group %s is not a multicast address", *group)
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var session [4]byte
+	rand.Read(session[:])
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	s := &multicastSender{conn: conn, image: f, ann: ann, session: binary.BigEndian.Uint32(session[:]), rate: int64(rate.bytes), rounds: *rounds}
+	terminal := flasher.IsTerminal(os.Stderr)
+	last := time.Now()
+	s.progress = func(round int, sent int64) {
+		if terminal && (time.Since(last) > 200*time.Millisecond || sent == ann.Size) {
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "\rRound %d of %d: %s of %s (%d%%)  ", round, *rounds, formatSize(uint64(sent)), formatSize(uint64(ann.Size)), sent*100/max(ann.Size, 1))
+		}
+	}
+	logger.Info("multicasting image", "image", positional[0], "group", *group, "size", ann.Size, "rounds", *rounds, "rate", rate.bytes)
+	err = s.send(ctx)
+	if terminal {
+		fmt.Fprintln(os.Stderr)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", errInterrupted, context.Cause(ctx))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, ColorSuccess+"Sent %s to %s %d times."+ColorReset+"\n", ann.Name, *group, *rounds)
+	return nil
+}
+
+// runMulticastReceive receives the image multicast on the group, and
+// saves it once it is complete and its digest checked.
+func runMulticastReceive(args []string) error {
+	fs := flag.NewFlagSet("multicast receive", flag.ContinueOnError)
+	group := fs.String("group", defaultMulticastGroup, "multicast group and port")
+	iface := fs.String("interface", "", "network interface to listen on (default: the system's choice)")
+	output := fs.String("output", "", "where to save the image (default: its name, in the current directory)")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up when nothing is received for this long")
+	pin := fs.String("sha256", "", "accept only the image with this SHA-256")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("multicast receive takes no arguments")
+	}
+	var want *[sha256.Size]byte
+	if *pin != "" {
+		digest, err := checkDigest(*pin)
+		if err != nil {
+			return usageError("--sha256: %v", err)
+		}
+		want = new([sha256.Size]byte)
+		hex.Decode(want[:], []byte(digest))
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	addr, err := net.ResolveUDPAddr("udp4", *group)
+	if err != nil {
+		return usageError("invalid --group: %v", err)
+	}
+	if !addr.IP.IsMulticast() {
+		return usageError("--group %s is not a multicast address", *group)
+	}
+	var ifi *net.Interface
+	if *iface != "" {
+		if ifi, err = net.InterfaceByName(*iface); err != nil {
+			return usageError("invalid --interface: %v", err)
+		}
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifi, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Un buffer ampio regge le raffiche mentre il disco è occupato.
+	conn.SetReadBuffer(8 << 20)
+
+	var path string
+	r := &multicastReceiver{want: want, open: func(ann multicastAnnounce) (*os.File, error) {
+		path = *output
+		if path == "" {
+			name, err := imageName(filepath.Base(ann.Name))
+			if err != nil {
+				return nil, err
+			}
+			path = name
+		}
+		return os.CreateTemp(filepath.Dir(path), ".sflashy-receive-*")
+	}}
+	defer func() {
+		if r.file != nil {
+			r.file.Close()
+			os.Remove(r.file.Name())
+		}
+	}()
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Waiting for an image on %s...\n", *group)
+	terminal := flasher.IsTerminal(os.Stderr)
+	last := time.Now()
+	buf := make([]byte, 64<<10)
+	for {
+		conn.SetReadDeadline(time.Now().Add(*timeout))
+		n, _, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", errInterrupted, context.Cause(ctx))
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !r.announced() {
+				return fmt.Errorf("nothing received on %s for %s", *group, *timeout)
+			}
+			return fmt.Errorf("the sender stopped with %d of %d chunks missing", r.missing, len(r.have))
+		}
+		if err != nil {
+			return err
+		}
+		done, err := r.handle(buf[:n])
+		if err != nil {
+			return err
+		}
+		if terminal && r.announced() && (time.Since(last) > 200*time.Millisecond || done) {
+			last = time.Now()
+			fmt.Fprintf(os.Stderr, "\rReceived %s of %s (%d%%)  ", formatSize(uint64(r.received)), formatSize(uint64(r.ann.Size)), r.received*100/max(r.ann.Size, 1))
+		}
+		if done {
+			break
+		}
+	}
+	if terminal {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.file.Name(), path); err != nil {
+		return err
+	}
+	r.file = nil
+	logger.Info("image received", "image", path, "size", r.ann.Size)
+	fmt.Fprintf(os.Stderr, ColorSuccess+"Received %s, SHA-256 checked."+ColorReset+"\n", path)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// packetLog raccoglie i datagrammi inviati, perdendo quelli indicati.
+type packetLog struct {
+	packets [][]byte
+	drop    func(n int) bool
+	n       int
+}
+
+func (l *packetLog) Write(b []byte) (int, error) {
+	l.n++
+	if l.drop == nil || !l.drop(l.n) {
+		l.packets = append(l.packets, bytes.Clone(b))
+	}
+	return len(b), nil
+}
+
+// multicastImage restituisce un'immagine di prova e il suo annuncio.
+func multicastImage(size int) ([]byte, multicastAnnounce) {
+	image := bytes.Repeat([]byte("sflashy multicast "), size/18+1)[:size]
+	return image, multicastAnnounce{Name: "sd.img", Size: int64(size), Digest: sha256.Sum256(image)}
+}
+
+// receive passa i datagrammi a un ricevitore che scrive in dir.
+func receive(t *testing.T, dir string, packets [][]byte) (*multicastReceiver, error) {
+	t.Helper()
+	r := &multicastReceiver{open: func(ann multicastAnnounce) (*os.File, error) {
+		return os.Create(filepath.Join(dir, ann.Name))
+	}}
+	t.Cleanup(func() {
+		if r.file != nil {
+			r.file.Close()
+		}
+	})
+	for _, p := range packets {
+		done, err := r.handle(p)
+		if done || err != nil {
+			return r, err
+		}
+	}
+	return r, errors.New("immagine incompleta")
+}
+
+// TestMulticastPacket verifica la codifica dei datagrammi e dell'annuncio.
+func TestMulticastPacket(t *testing.T) {
+	kind, session, index, payload, err := decodePacket(encodePacket(packetData, 7, 42, []byte("dati")))
+	if err != nil || kind != packetData || session != 7 || index != 42 || string(payload) != "dati" {
+		t.Errorf("Datagramma errato. Got: %d %d %d %q %v", kind, session, index, payload, err)
+	}
+	if _, _, _, _, err := decodePacket([]byte("HTTP/1.1 200 OK")); err == nil {
+		t.Error("Un datagramma estraneo va scartato")
+	}
+	_, ann := multicastImage(3000)
+	var got multicastAnnounce
+	if err := got.unmarshal(ann.marshal()); err != nil || got != ann {
+		t.Errorf("Annuncio errato. Got: %+v, %v", got, err)
+	}
+	if ann.chunks() != 3 {
+		t.Errorf("3000 byte sono 3 blocchi. Got: %d", ann.chunks())
+	}
+}
+
+// TestMulticastCarousel verifica che i blocchi persi in un giro arrivino
+// con il successivo, e che un ricevitore arrivato tardi riceva tutto.
+func TestMulticastCarousel(t *testing.T) {
+	image, ann := multicastImage(10*multicastChunk + 123)
+	// Al primo giro si perdono un datagramma su tre, annuncio compreso.
+	conn := &packetLog{drop: func(n int) bool { return n <= 12 && n%3 == 1 }}
+	s := &multicastSender{conn: conn, image: bytes.NewReader(image), ann: ann, session: 1, rounds: 2}
+	if err := s.send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if _, err := receive(t, dir, conn.packets); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "sd.img")); !bytes.Equal(got, image) {
+		t.Error("Immagine ricevuta diversa")
+	}
+
+	// Con un solo giro e dei datagrammi persi, la fine è un errore.
+	conn = &packetLog{drop: func(n int) bool { return n == 5 }}
+	s = &multicastSender{conn: conn, image: bytes.NewReader(image), ann: ann, session: 2, rounds: 1}
+	s.send(context.Background())
+	if _, err := receive(t, t.TempDir(), conn.packets); err == nil || !strings.Contains(err.Error(), "1 of 11 chunks missing") {
+		t.Errorf("Blocchi mancanti non segnalati. Got: %v", err)
+	}
+}
+
+// TestMulticastDigest verifica il controllo dello SHA-256 annunciato.
+func TestMulticastDigest(t *testing.T) {
+	image, ann := multicastImage(2 * multicastChunk)
+	ann.Digest[0] ^= 0xff
+	conn := &packetLog{}
+	s := &multicastSender{conn: conn, image: bytes.NewReader(image), ann: ann, session: 3, rounds: 1}
+	s.send(context.Background())
+	if _, err := receive(t, t.TempDir(), conn.packets); !errors.Is(err, flasher.ErrChecksumMismatch) {
+		t.Errorf("Digest errato non segnalato. Got: %v", err)
+	}
+}
+
+// TestMulticastUntrusted verifica che annunci e blocchi non validi, e le
+// immagini diverse da quella attesa, vengano ignorati.
+func TestMulticastUntrusted(t *testing.T) {
+	image, ann := multicastImage(2*multicastChunk + 100)
+	for _, bad := range []multicastAnnounce{
+		{Name: "sd.img", Size: 0},
+		{Name: "sd.img", Size: -1},
+		{Name: "sd.img", Size: maxMulticastSize + 1},
+		{Name: "../sd.img", Size: 10},
+		{Name: "", Size: 10},
+	} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("Annuncio non valido accettato: %+v", bad)
+		}
+	}
+	if err := ann.validate(); err != nil {
+		t.Errorf("Annuncio valido rifiutato: %v", err)
+	}
+
+	other := ann
+	other.Digest[0] ^= 0xff
+	var packets [][]byte
+	packets = append(packets,
+		// Un annuncio enorme e uno di un'altra immagine, ignorati.
+		encodePacket(packetAnnounce, 1, 0, multicastAnnounce{Name: "sd.img", Size: 1 << 62}.marshal()),
+		encodePacket(packetAnnounce, 2, 0, other.marshal()),
+		encodePacket(packetAnnounce, 3, 0, ann.marshal()),
+		// Blocchi troppo lunghi, troppo corti o fuori dall'immagine.
+		encodePacket(packetData, 3, 0, make([]byte, multicastChunk+1)),
+		encodePacket(packetData, 3, 2, image[2*multicastChunk:2*multicastChunk+99]),
+		encodePacket(packetData, 3, 3, []byte("x")),
+	)
+	for i := range uint32(3) {
+		packets = append(packets, encodePacket(packetData, 3, i, image[i*multicastChunk:min(int(i+1)*multicastChunk, len(image))]))
+	}
+	dir := t.TempDir()
+	r := &multicastReceiver{want: &ann.Digest, open: func(a multicastAnnounce) (*os.File, error) {
+		return os.Create(filepath.Join(dir, a.Name))
+	}}
+	t.Cleanup(func() {
+		if r.file != nil {
+			r.file.Close()
+		}
+	})
+	var done bool
+	for _, p := range packets {
+		var err error
+		if done, err = r.handle(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !done || r.session != 3 {
+		t.Fatalf("Immagine attesa non ricevuta. Got: %v, sessione %d", done, r.session)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "sd.img")); !bytes.Equal(got, image) {
+		t.Error("Immagine ricevuta diversa")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// bootPatches are the edits of --patch, in the order they were given.
+type bootPatches []flasher.PatchBootConfig
+
+// addPatchFlag registers --patch on fs.
+func addPatchFlag(fs *flag.FlagSet) *bootPatches {
+	p := &bootPatches{}
+	fs.Func("patch", "set a setting of cmdline.txt, config.txt or fstab, e.g. config.txt:dtoverlay=vc4-kms-v3d, or remove it, config.txt:-<key> (repeatable)", func(s string) error {
+		patch, err := parsePatch(s)
+		if err != nil {
+			return err
+		}
+		*p = append(*p, patch)
+		return nil
+	})
+	return p
+}
+
+// parsePatch parses <file>:<key>[=<value>], or <file>:-<key>[=<value>]
+// for a removal.
+func parsePatch(s string) (flasher.PatchBootConfig, error) {
+	file, setting, ok := strings.Cut(s, ":")
+	if !ok || setting == "" {
+		return flasher.PatchBootConfig{}, fmt.Errorf("expected <file>:<key>=<value>, e.g. config.txt:dtoverlay=vc4-kms-v3d, not %q", s)
+	}
+	patch := flasher.PatchBootConfig{File: file}
+	setting, patch.Remove = strings.CutPrefix(setting, "-")
+	patch.Key, patch.Value, _ = strings.Cut(setting, "=")
+	if err := patch.Validate(); err != nil {
+		return flasher.PatchBootConfig{}, err
+	}
+	return patch, nil
+}
+
+// steps returns the customization steps of the patches.
+func (p bootPatches) steps() []flasher.Step {
+	steps := make([]flasher.Step, 0, len(p))
+	for _, patch := range p {
+		steps = append(steps, patch)
+	}
+	return steps
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestPatchFlag verifica la lettura di --patch.
+func TestPatchFlag(t *testing.T) {
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	p := addPatchFlag(fs)
+	args := []string{
+		"--patch", "config.txt:dtoverlay=vc4-kms-v3d",
+		"--patch", "cmdline.txt:-quiet",
+		"--patch", "fstab:/data=LABEL=DATA ext4 defaults,nofail 0 2",
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	want := []flasher.PatchBootConfig{
+		{File: "config.txt", Key: "dtoverlay", Value: "vc4-kms-v3d"},
+		{File: "cmdline.txt", Key: "quiet", Remove: true},
+		{File: "fstab", Key: "/data", Value: "LABEL=DATA ext4 defaults,nofail 0 2"},
+	}
+	steps := p.steps()
+	if len(steps) != len(want) {
+		t.Fatalf("Numero di passi errato. Got: %v", steps)
+	}
+	for i, s := range steps {
+		if s != want[i] {
+			t.Errorf("Modifica %d errata. Got: %+v, Want: %+v", i, s, want[i])
+		}
+	}
+
+	for _, bad := range []string{"config.txt", "config.txt:", "boot.ini:a=b", "config.txt:arm_64bit", "fstab:/data=LABEL=DATA"} {
+		fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		addPatchFlag(fs)
+		if err := fs.Parse([]string{"--patch", bad}); err == nil {
+			t.Errorf("--patch %s dovrebbe essere rifiutato", bad)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// newPauser returns a Pauser that tells the operator on out how to resume
+// a paused copy. keyboard tells whether it can be resumed by typing "p".
+func newPauser(keyboard bool, out io.Writer) *flasher.Pauser {
+	p := flasher.NewPauser()
+	p.OnPause = func() {
+		fmt.Fprintf(out, "\nPaused. To resume, %s.\n", resumeHint(keyboard))
+		logger.Info("copy paused")
+	}
+	p.OnResume = func() {
+		fmt.Fprintln(out, "Resuming...")
+		logger.Info("copy resumed")
+	}
+	return p
+}
+
+// resumeHint tells the operator how to resume a paused copy.
+func resumeHint(keyboard bool) string {
+	var ways []string
+	if keyboard {
+		ways = append(ways, "type p and Enter")
+	}
+	if len(pauseSignals) > 0 {
+		ways = append(ways, fmt.Sprintf("send SIGUSR2 to pid %d", os.Getpid()))
+	}
+	return strings.Join(ways, " or ")
+}
+
+// pauseOnSignal toggles p each time one of pauseSignals is received. The
+// returned function stops listening.
+func pauseOnSignal(p *flasher.Pauser) (stop func()) {
+	if len(pauseSignals) == 0 {
+		return func() {}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, pauseSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				p.Toggle()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// pauseOnInput toggles p each time a line containing just "p" is read
+// from r. The terminal is left in line mode, so the key must be followed
+// by Enter. Only a terminal is read, and the returned function stops the
+// reading, so that it does not take the answers to the prompts after the
+// copy.
+func pauseOnInput(p *flasher.Pauser, r io.Reader) (stop func()) {
+	f, ok := r.(*os.File)
+	if !ok || !flasher.IsTerminal(f) {
+		return func() {}
+	}
+	in, stopInput, err := cancellableInput(f)
+	if err != nil {
+		logger.Debug("cannot pause from the keyboard", "err", err)
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			if strings.EqualFold(strings.TrimSpace(scanner.Text()), "p") {
+				p.Toggle()
+			}
+		}
+	}()
+	return func() {
+		stopInput()
+		<-done
+	}
+}
+
+// reportOnSignal prints the status of f each time one of statusSignals
+// (SIGUSR1, or SIGINFO on BSD/macOS) is received, like dd does. The
+// returned function stops the reporting.
+func reportOnSignal(f *flasher.Flasher, out io.Writer) (stop func()) {
+	if len(statusSignals) == 0 {
+		return func() {}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, statusSignals...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				if status := f.Status(); status != "" {
+					fmt.Fprintf(out, "\n%s\n", status)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
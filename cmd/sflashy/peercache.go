@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// cacheConfig is the cache key of the configuration: where the images
+// downloaded are kept, and the stations to ask for them first.
+type cacheConfig struct {
+	Dir   string   `yaml:"dir"`
+	Peers []string `yaml:"peers"`
+}
+
+// imageCache keeps the images downloaded by their SHA-256, and shares them
+// with the other stations over HTTP: a station that needs an image asks
+// its peers before the upstream URL.
+//
+// The images are in <dir>/sha256/<digest>; <dir>/urls/<SHA-256 of the
+// URL> has the digest of the image last downloaded from a URL.
+type imageCache struct {
+	dir   string
+	peers []string
+	// client downloads the images, from the peers and upstream.
+	client *http.Client
+	// probe is how long a peer has to answer whether it has an image.
+	probe time.Duration
+}
+
+// peerCache is the cache of the configuration, in defaultCacheDir
+// without cache.dir.
+var peerCache *imageCache
+
+// newImageCache returns the cache of cfg.
+func newImageCache(cfg cacheConfig) *imageCache {
+	return &imageCache{dir: cfg.Dir, peers: cfg.Peers, client: http.DefaultClient, probe: 2 * time.Second}
+}
+
+// defaultCacheDir is the directory of the cache without cache.dir in the
+// configuration: sflashy in the cache directory of the user, e.g.
+// ~/.cache/sflashy.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "sflashy-cache")
+	}
+	return filepath.Join(dir, "sflashy")
+}
+
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// checkDigest checks digest as a hex SHA-256, and returns it in lowercase.
+func checkDigest(digest string) (string, error) {
+	digest = strings.ToLower(digest)
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("invalid SHA-256 %q", digest)
+	}
+	return digest, nil
+}
+
+// blob returns the path of the image with digest.
+func (c *imageCache) blob(digest string) string {
+	return filepath.Join(c.dir, "sha256", digest)
+}
+
+// urlKey returns the path of the record of the digest of the URL u.
+func (c *imageCache) urlKey(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return filepath.Join(c.dir, "urls", hex.EncodeToString(sum[:]))
+}
+
+// has reports whether the cache has the image with digest.
+func (c *imageCache) has(digest string) bool {
+	info, err := os.Stat(c.blob(digest))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// lookup returns the digest of the image last downloaded from u, if any.
+func (c *imageCache) lookup(u string) string {
+	data, err := os.ReadFile(c.urlKey(u))
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	digest, err := checkDigest(strings.TrimSpace(line))
+	if err != nil || !c.has(digest) {
+		return ""
+	}
+	return digest
+}
+
+// store copies r to the cache and returns its digest, which must be want
+// if set; a partial or wrong copy is removed.
+func (c *imageCache) store(r io.Reader, want string) (string, error) {
+	dir := filepath.Join(c.dir, "sha256")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if want != "" && digest != want {
+		return "", fmt.Errorf("downloaded image has SHA-256 %s, expected %s", digest, want)
+	}
+	if err := os.Rename(tmp.Name(), c.blob(digest)); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// remember records that u has the image with digest, which has just been
+// used.
+func (c *imageCache) remember(u, digest string) error {
+	now := time.Now()
+	os.Chtimes(c.blob(digest), now, now)
+	if err := os.MkdirAll(filepath.Join(c.dir, "urls"), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.urlKey(u), []byte(digest+"\n"+u+"\n"), 0o644)
+}
+
+// download stores the image at u, which must have digest if set.
+func (c *imageCache) download(ctx context.Context, u, digest string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not download %s: %s", u, resp.Status)
+	}
+	return c.store(resp.Body, digest)
+}
+
+// ask asks peer for path, and returns the response if it is 200 OK. The
+// peer has c.probe to answer: a station that is off does not hold up the
+// download.
+func (c *imageCache) ask(ctx context.Context, method, peer, path string) (*http.Response, error) {
+	probe, cancel := context.WithTimeout(ctx, c.probe)
+	defer cancel()
+	req, err := http.NewRequestWithContext(probe, method, strings.TrimSuffix(peer, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s%s: %s", peer, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// fetch returns the path in the cache of the image at the URL u, which
+// must have digest if set. It is downloaded from a peer that has it, or
+// else from u. Only a digest given by the caller (--sha256, a catalog or
+// the checksums of a distribution) or recorded by the cache itself
+// selects the image of a peer: a peer cannot tell which image u has.
+func (c *imageCache) fetch(ctx context.Context, u, digest string) (string, error) {
+	if digest == "" {
+		digest = c.lookup(u)
+	}
+	if digest != "" && c.has(digest) {
+		logger.Info("image found in the cache", "url", u, "sha256", digest)
+		return c.blob(digest), c.remember(u, digest)
+	}
+	if digest != "" {
+		for _, peer := range c.peers {
+			if _, err := c.ask(ctx, http.MethodHead, peer, "/sha256/"+digest); err != nil {
+				logger.Debug("peer does not have the image", "peer", peer, "sha256", digest, "err", err)
+				continue
+			}
+			src := strings.TrimSuffix(peer, "/") + "/sha256/" + digest
+			logger.Info("downloading image from a peer", "peer", peer, "sha256", digest)
+			if _, err := c.download(ctx, src, digest); err != nil {
+				logger.Warn("download from a peer failed", "peer", peer, "err", err)
+				continue
+			}
+			return c.blob(digest), c.remember(u, digest)
+		}
+	}
+	logger.Info("downloading image", "url", u)
+	got, err := c.download(ctx, u, digest)
+	if err != nil {
+		return "", err
+	}
+	return c.blob(got), c.remember(u, got)
+}
+
+// cachedImage is an image of the cache.
+type cachedImage struct {
+	SHA256 string    `json:"sha256"`
+	Size   int64     `json:"size"`
+	Used   time.Time `json:"last_used"`
+	// URLs are those the image was last downloaded from.
+	URLs []string `json:"urls,omitempty"`
+}
+
+// list returns the images of the cache, the least recently used first.
+func (c *imageCache) list() ([]cachedImage, error) {
+	entries, err := os.ReadDir(filepath.Join(c.dir, "sha256"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	urls := c.urls()
+	var images []cachedImage
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !digestPattern.MatchString(e.Name()) {
+			continue
+		}
+		images = append(images, cachedImage{SHA256: e.Name(), Size: info.Size(), Used: info.ModTime(), URLs: urls[e.Name()]})
+	}
+	slices.SortFunc(images, func(a, b cachedImage) int { return a.Used.Compare(b.Used) })
+	return images, nil
+}
+
+// urls returns the URLs recorded for each digest.
+func (c *imageCache) urls() map[string][]string {
+	urls := map[string][]string{}
+	entries, _ := os.ReadDir(filepath.Join(c.dir, "urls"))
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(c.dir, "urls", e.Name()))
+		if err != nil {
+			continue
+		}
+		// I record scritti prima di `cache ls` hanno solo il digest.
+		digest, u, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+		if u != "" {
+			urls[digest] = append(urls[digest], u)
+		}
+	}
+	return urls
+}
+
+// prune removes the images not used for longer than olderThan, if
+// positive, and then the least recently used ones until the cache takes
+// at most maxSize bytes, if positive, and returns them; with dryRun
+// nothing is removed. The records of the URLs of the images removed and
+// the partial downloads older than a day go as well.
+func (c *imageCache) prune(olderThan time.Duration, maxSize int64, dryRun bool) ([]cachedImage, error) {
+	images, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, img := range images {
+		total += img.Size
+	}
+	var removed []cachedImage
+	for _, img := range images {
+		old := olderThan > 0 && time.Since(img.Used) > olderThan
+		if !old && (maxSize <= 0 || total <= maxSize) {
+			break
+		}
+		if !dryRun {
+			if err := os.Remove(c.blob(img.SHA256)); err != nil {
+				return removed, err
+			}
+		}
+		total -= img.Size
+		removed = append(removed, img)
+	}
+	if dryRun {
+		return removed, nil
+	}
+	entries, _ := os.ReadDir(filepath.Join(c.dir, "urls"))
+	for _, e := range entries {
+		path := filepath.Join(c.dir, "urls", e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		digest, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+		if !c.has(digest) {
+			os.Remove(path)
+		}
+	}
+	partial, _ := filepath.Glob(filepath.Join(c.dir, "sha256", ".download-*"))
+	for _, path := range partial {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+			os.Remove(path)
+		}
+	}
+	return removed, nil
+}
+
+// handler returns the routes on which the cache is shared with the peers:
+// GET /sha256/<digest>.
+func (c *imageCache) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sha256/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		digest, err := checkDigest(r.PathValue("digest"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !c.has(digest) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no image with SHA-256 %s", digest))
+			return
+		}
+		http.ServeFile(w, r, c.blob(digest))
+	})
+	return mux
+}
+
+// linkOrCopy makes dst the same file as src, or a copy of it on another
+// file system.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// runCache implements the `cache` subcommand: `cache fetch`, `cache
+// serve`, `cache ls` and `cache prune`.
+func runCache(args []string) error {
+	if len(args) == 0 {
+		return usageError("cache requires fetch, serve, ls or prune")
+	}
+	switch args[0] {
+	case "fetch":
+		return runCacheFetch(args[1:])
+	case "serve":
+		return runCacheServe(args[1:])
+	case "ls":
+		return runCacheList(args[1:])
+	case "prune":
+		return runCachePrune(args[1:])
+	}
+	return usageError("unknown cache command %q, expected fetch, serve, ls or prune", args[0])
+}
+
+// writeCachedImages writes images as a table or as JSON.
+func writeCachedImages(w io.Writer, images []cachedImage, format string) error {
+	switch format {
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SHA256\tSIZE\tLAST USED\tURL")
+		for _, img := range images {
+			u := "-"
+			if len(img.URLs) > 0 {
+				u = strings.Join(img.URLs, " ")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", img.SHA256[:12], formatSize(uint64(img.Size)), img.Used.Format(time.DateTime), u)
+		}
+		return tw.Flush()
+	case "json":
+		if images == nil {
+			images = []cachedImage{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	default:
+		return usageError("unknown format %q (expected table or json)", format)
+	}
+}
+
+// runCacheList lists the images of the cache.
+func runCacheList(args []string) error {
+	fs := flag.NewFlagSet("cache ls", flag.ContinueOnError)
+	format := fs.String("format", "table", "output format: table or json")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("cache ls takes no arguments")
+	}
+	images, err := peerCache.list()
+	if err != nil {
+		return err
+	}
+	return writeCachedImages(os.Stdout, images, *format)
+}
+
+// runCachePrune removes the images of the cache that were not used for a
+// while, or that take more room than allowed.
+func runCachePrune(args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	olderThan := fs.Duration("older-than", 0, "remove the images not used for longer than this, e.g. 720h")
+	var maxSize sizeFlag
+	fs.Var(&maxSize, "max-size", "then remove the least recently used images until the cache takes at most this, e.g. 50G")
+	dryRun := fs.Bool("dry-run", false, "only print the images that would be removed")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("cache prune takes no arguments")
+	}
+	if *olderThan <= 0 && maxSize.bytes == 0 {
+		return usageError("cache prune needs --older-than or --max-size")
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	removed, err := peerCache.prune(*olderThan, int64(maxSize.bytes), *dryRun)
+	var freed int64
+	for _, img := range removed {
+		freed += img.Size
+		logger.Info("image removed from the cache", "sha256", img.SHA256, "size", img.Size, "last_used", img.Used, "dry_run", *dryRun)
+	}
+	if err != nil {
+		return err
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Fprintf(os.Stderr, ColorSuccess+"%s %d images, %s."+ColorReset+"\n", verb, len(removed), formatSize(uint64(freed)))
+	return nil
+}
+
+// runCacheFetch downloads an image through the cache, from a peer if one
+// has it.
+func runCacheFetch(args []string) error {
+	fs := flag.NewFlagSet("cache fetch", flag.ContinueOnError)
+	digest := fs.String("sha256", "", "expected SHA-256 of the image: the peers that have it are asked first")
+	output := fs.String("output", "", "where to save the image (default: its name, in the current directory)")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) != 1 {
+		return usageError("cache fetch requires exactly one URL")
+	}
+	u, err := url.Parse(positional[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return usageError("not an http or https URL: %q", positional[0])
+	}
+	if *digest != "" {
+		if *digest, err = checkDigest(*digest); err != nil {
+			return fmt.Errorf("%w: %w", errUsage, err)
+		}
+	}
+	if *output == "" {
+		if *output, err = imageName(path.Base(u.Path)); err != nil {
+			return fmt.Errorf("%w: %w, use --output", errUsage, err)
+		}
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	blob, err := peerCache.fetch(ctx, u.String(), *digest)
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", errInterrupted, context.Cause(ctx))
+	}
+	if err != nil {
+		return err
+	}
+	if err := linkOrCopy(blob, *output); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, ColorSuccess+"Saved %s (SHA-256 %s)."+ColorReset+"\n", *output, filepath.Base(blob))
+	return nil
+}
+
+// runCacheServe shares the cache with the peers until an interrupt.
+func runCacheServe(args []string) error {
+	fs := flag.NewFlagSet("cache serve", flag.ContinueOnError)
+	listen := fs.String("listen", ":8091", "address to share the cache on")
+	logCfg := addLogFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("cache serve takes no arguments")
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	srv := &http.Server{Addr: *listen, Handler: peerCache.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	logger.Info("sharing the image cache (press Ctrl+C to stop)", "listen", *listen, "dir", peerCache.dir)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestImageCache verifica che una stazione scarichi dalla sorgente solo la
+// prima volta, e che le altre prendano l'immagine da lei.
+func TestImageCache(t *testing.T) {
+	image := strings.Repeat("immagine di prova ", 1000)
+	sum := sha256.Sum256([]byte(image))
+	digest := hex.EncodeToString(sum[:])
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHits.Add(1)
+		w.Write([]byte(image))
+	}))
+	defer upstream.Close()
+	u := upstream.URL + "/sd.img"
+	ctx := context.Background()
+
+	first := newImageCache(cacheConfig{Dir: t.TempDir(), Peers: []string{"http://127.0.0.1:1"}})
+	first.probe = 200 * time.Millisecond
+	blob, err := first.fetch(ctx, u, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(blob); string(data) != image || blob != first.blob(digest) {
+		t.Errorf("Immagine errata in %s", blob)
+	}
+	if _, err := first.fetch(ctx, u, ""); err != nil || upstreamHits.Load() != 1 {
+		t.Errorf("La seconda volta l'immagine viene dalla cache. Got: %d download, %v", upstreamHits.Load(), err)
+	}
+	peer := httptest.NewServer(first.handler())
+	defer peer.Close()
+
+	// Con il digest basta il peer.
+	second := newImageCache(cacheConfig{Dir: t.TempDir(), Peers: []string{"http://127.0.0.1:1", peer.URL}})
+	second.probe = 200 * time.Millisecond
+	if blob, err := second.fetch(ctx, "http://sorgente.invalid/sd.img", digest); err != nil || blob != second.blob(digest) {
+		t.Fatalf("Download dal peer fallito. Got: %s, %v", blob, err)
+	}
+	if upstreamHits.Load() != 1 {
+		t.Errorf("La sorgente va usata una volta sola. Got: %d", upstreamHits.Load())
+	}
+
+	// Senza digest un peer non può indicare l'immagine dell'URL: si va
+	// alla sorgente.
+	forged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha256":"` + digest + `"}`))
+	}))
+	defer forged.Close()
+	third := newImageCache(cacheConfig{Dir: t.TempDir(), Peers: []string{forged.URL, peer.URL}})
+	if blob, err := third.fetch(ctx, u, ""); err != nil || blob != third.blob(digest) {
+		t.Fatalf("Download dalla sorgente fallito. Got: %s, %v", blob, err)
+	}
+	if upstreamHits.Load() != 2 {
+		t.Errorf("Senza digest l'immagine viene dalla sorgente. Got: %d download", upstreamHits.Load())
+	}
+
+	// Un digest che nessuno ha porta alla sorgente, che non lo rispetta.
+	other := strings.Repeat("0", 64)
+	if _, err := third.fetch(ctx, u, other); err == nil || !strings.Contains(err.Error(), "expected "+other) {
+		t.Errorf("Digest diverso non segnalato. Got: %v", err)
+	}
+	resp, err := http.Get(peer.URL + "/sha256/" + other)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Immagine sconosciuta. Got: %v, %v", resp.Status, err)
+	}
+	if resp, err := http.Get(peer.URL + "/sha256/..%2F..%2Fetc%2Fpasswd"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Digest non valido accettato. Got: %v, %v", resp.Status, err)
+	}
+}
+
+// TestImageCachePrune verifica l'elenco delle immagini della cache e la
+// rimozione di quelle non usate da tempo o di troppo.
+func TestImageCachePrune(t *testing.T) {
+	c := newImageCache(cacheConfig{Dir: t.TempDir()})
+	var digests []string
+	for i, age := range []time.Duration{30 * 24 * time.Hour, 48 * time.Hour, time.Hour} {
+		digest, err := c.store(strings.NewReader(strings.Repeat("x", 1000*(i+1))), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.remember("https://example.com/"+strconv.Itoa(i)+".img", digest)
+		used := time.Now().Add(-age)
+		os.Chtimes(c.blob(digest), used, used)
+		digests = append(digests, digest)
+	}
+	// Un record scritto da una versione precedente ha solo il digest.
+	os.WriteFile(c.urlKey("https://example.com/vecchio.img"), []byte(digests[2]+"\n"), 0o644)
+	if c.lookup("https://example.com/vecchio.img") != digests[2] {
+		t.Error("Record senza URL non letto")
+	}
+
+	images, err := c.list()
+	if err != nil || len(images) != 3 || images[0].SHA256 != digests[0] || images[2].Size != 3000 || len(images[1].URLs) != 1 || images[1].URLs[0] != "https://example.com/1.img" {
+		t.Fatalf("Elenco errato. Got: %+v, %v", images, err)
+	}
+	if removed, err := c.prune(7*24*time.Hour, 0, true); err != nil || len(removed) != 1 || !c.has(digests[0]) {
+		t.Errorf("Con --dry-run non si rimuove nulla. Got: %+v, %v", removed, err)
+	}
+	if removed, err := c.prune(7*24*time.Hour, 0, false); err != nil || len(removed) != 1 || c.has(digests[0]) || c.lookup("https://example.com/0.img") != "" {
+		t.Errorf("L'immagine non usata da un mese va rimossa. Got: %+v, %v", removed, err)
+	}
+	if _, err := os.Stat(c.urlKey("https://example.com/0.img")); !os.IsNotExist(err) {
+		t.Errorf("Il record dell'URL dell'immagine rimossa resta: %v", err)
+	}
+	if removed, err := c.prune(0, 4000, false); err != nil || len(removed) != 1 || removed[0].SHA256 != digests[1] || !c.has(digests[2]) {
+		t.Errorf("Va rimossa la meno usata di recente. Got: %+v, %v", removed, err)
+	}
+	var out strings.Builder
+	images, _ = c.list()
+	if err := writeCachedImages(&out, images, "table"); err != nil || !strings.Contains(out.String(), digests[2][:12]) || !strings.Contains(out.String(), "https://example.com/2.img") {
+		t.Errorf("Tabella errata. Got: %q, %v", out.String(), err)
+	}
+}
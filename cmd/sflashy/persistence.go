@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// persistenceFlags are --persistence and --persistence-size.
+type persistenceFlags struct {
+	Enabled bool
+	Size    sizeFlag
+}
+
+// addPersistenceFlags registers the persistence flags on fs.
+func addPersistenceFlags(fs *flag.FlagSet) *persistenceFlags {
+	f := &persistenceFlags{}
+	fs.BoolVar(&f.Enabled, "persistence", false, "add a persistence partition for the live system of the image")
+	fs.Var(&f.Size, "persistence-size", "size of the --persistence partition (default the rest of the device)")
+	return f
+}
+
+// apply sets the persistence of opts, once its other options are set.
+func (f persistenceFlags) apply(opts *flashOptions) error {
+	if !f.Enabled {
+		if f.Size.bytes > 0 {
+			return usageError("--persistence-size needs --persistence")
+		}
+		return nil
+	}
+	switch {
+	case runtime.GOOS != "linux":
+		return usageError("--persistence needs mkfs.ext4, on Linux")
+	case opts.Expand:
+		return usageError("--persistence needs the space that --expand would take")
+	case opts.Seek > 0:
+		return usageError("--persistence needs the image at the start of the device, it cannot be used with --seek")
+	}
+	opts.Persistence, opts.PersistenceSize = true, int64(f.Size.bytes)
+	return nil
+}
+
+// persistenceStep returns the customization step that adds the
+// persistence partition of the live system of the image, of size bytes or
+// the rest of the device if 0, recording it in m.
+func persistenceStep(m *partitionMaker, size int64) flasher.Step {
+	return m.step("add the persistence partition", func(d *flasher.Disk) (newPartition, error) {
+		p, err := flasher.LivePersistence(d)
+		if err != nil {
+			return newPartition{}, err
+		}
+		part, err := d.AddPartition(size, p.Label)
+		if err != nil {
+			return newPartition{}, err
+		}
+		return newPartition{number: part.Number, fsType: "ext4", label: p.Label, files: p.Files}, nil
+	})
+}
+
+// partitionMaker adds partitions after those of the image, e.g. the
+// persistence partition of a live image, as steps of the flash, and
+// creates their filesystems with mkfs once the device is closed.
+type partitionMaker struct {
+	mu sync.Mutex
+	// parts are the partitions left to format, by location.
+	parts map[string][]newPartition
+}
+
+// newPartition is a partition added by a step of partitionMaker.
+type newPartition struct {
+	number        int
+	fsType, label string
+	files         map[string][]byte
+}
+
+// step returns the customization step name, which adds the partition
+// that add returns, recording it for finish.
+func (m *partitionMaker) step(name string, add func(*flasher.Disk) (newPartition, error)) flasher.Step {
+	return flasher.StepFunc(name, func(_ context.Context, d *flasher.Disk) error {
+		part, err := add(d)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.parts == nil {
+			m.parts = make(map[string][]newPartition)
+		}
+		m.parts[d.Device] = append(m.parts[d.Device], part)
+		return nil
+	})
+}
+
+// finish creates the filesystems of the partitions that the steps added
+// on device, written through location, if any.
+func (m *partitionMaker) finish(location, device string, out io.Writer) error {
+	m.mu.Lock()
+	parts := m.parts[location]
+	m.mu.Unlock()
+	for _, part := range parts {
+		fmt.Fprintf(out, "Creating the %s filesystem %s of partition %d...\n", part.fsType, part.label, part.number)
+		if err := makeFilesystem(device, part.number, part.fsType, part.label, part.files); err != nil {
+			return fmt.Errorf("could not create the %s filesystem of partition %d of %s: %w", part.fsType, part.number, device, err)
+		}
+		logger.Info("partition created", "device", device, "partition", part.number, "filesystem", part.fsType, "label", part.label)
+	}
+	return nil
+}
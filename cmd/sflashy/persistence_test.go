@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+// TestPersistenceFlags verifica le combinazioni di --persistence con le
+// altre opzioni.
+func TestPersistenceFlags(t *testing.T) {
+	var opts flashOptions
+	if err := (persistenceFlags{}).apply(&opts); err != nil || opts.Persistence {
+		t.Errorf("Senza --persistence non c'è persistenza. Got: %+v, %v", opts, err)
+	}
+	if err := (persistenceFlags{Size: sizeFlag{bytes: 1 << 30}}).apply(&opts); !errors.Is(err, errUsage) {
+		t.Errorf("--persistence-size da solo dovrebbe essere un errore d'uso. Got: %v", err)
+	}
+	f := persistenceFlags{Enabled: true, Size: sizeFlag{bytes: 1 << 30}}
+	for _, bad := range []flashOptions{{Expand: true}, {Seek: 512}} {
+		if err := f.apply(&bad); !errors.Is(err, errUsage) {
+			t.Errorf("%+v dovrebbe essere un errore d'uso. Got: %v", bad, err)
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if err := f.apply(&opts); err != nil || !opts.Persistence || opts.PersistenceSize != 1<<30 {
+		t.Errorf("Persistenza errata. Got: %+v, %v", opts, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// postFlashPlugins are the loaded plugins with a post-flash step, run at
+// the end of every flash.
+var postFlashPlugins []*flasher.Plugin
+
+// configuredPlugins are the paths of the plugins, loaded by usePlugins.
+var configuredPlugins []string
+
+var pluginsOnce sync.Once
+
+// usePlugins loads the plugins the first time it is called. Only the
+// commands that open images or run the post-flash steps call it: the
+// others, and --help, do not start every plugin.
+func usePlugins() {
+	pluginsOnce.Do(func() { loadPlugins(configuredPlugins) })
+}
+
+// pluginDir returns the directory whose executables are loaded as plugins.
+func pluginDir() string {
+	if p := os.Getenv("SFLASHY_PLUGIN_DIR"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sflashy", "plugins")
+}
+
+// pluginPaths returns the executables of dir followed by the configured
+// paths. A missing dir yields only the configured paths.
+func pluginPaths(dir string, configured []string) []string {
+	var paths []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err == nil && info.Mode().IsRegular() && info.Mode()&0o111 != 0 {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return append(paths, configured...)
+}
+
+// loadPlugins loads the plugins at paths, registers their source handlers
+// and keeps their post-flash steps. A plugin that cannot be loaded is
+// skipped with a warning, so that it cannot prevent flashing.
+func loadPlugins(paths []string) {
+	for _, path := range paths {
+		p, err := flasher.LoadPlugin(path)
+		if err != nil {
+			logger.Warn("skipping plugin", "path", path, "err", err)
+			continue
+		}
+		p.Stderr = os.Stderr
+		p.Register()
+		if p.PostFlash {
+			postFlashPlugins = append(postFlashPlugins, p)
+		}
+		logger.Debug("plugin loaded", "name", p.Name, "path", path, "sources", p.Sources, "post_flash", p.PostFlash)
+	}
+}
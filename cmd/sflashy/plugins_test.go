@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestPluginPaths verifica che della directory dei plugin siano presi
+// solo gli eseguibili, prima di quelli configurati.
+func TestPluginPaths(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "vendor"), []byte("#!/bin/sh\n"), 0o755)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("docs"), 0o644)
+	os.Mkdir(filepath.Join(dir, "lib"), 0o755)
+
+	got := pluginPaths(dir, []string{"/opt/other"})
+	want := []string{filepath.Join(dir, "vendor"), "/opt/other"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pluginPaths = %v, want %v", got, want)
+	}
+	if got := pluginPaths(filepath.Join(dir, "missing"), nil); len(got) != 0 {
+		t.Errorf("Una directory mancante non dovrebbe contenere plugin. Got: %v", got)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// authopenPath is the macOS tool that opens a file on behalf of a user
+// authorized by an administrator password, and passes the descriptor back.
+const authopenPath = "/usr/libexec/authopen"
+
+func init() {
+	flasher.RegisterDestination("authopen", openAuthorized)
+}
+
+// checkRoot lets a user that is not root go on when authopen is
+// available: the device is then opened through it, which asks for an
+// administrator password instead of requiring sudo.
+func checkRoot() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if _, err := os.Stat(authopenPath); err != nil {
+		return fmt.Errorf("%w: this program must be run as root", errPermission)
+	}
+	return nil
+}
+
+// deviceLocation returns the location passed to Flasher.Flash to write
+// device: its raw device, opened through authopen unless running as root.
+func deviceLocation(device string) string {
+	raw := rawDiskPath(device)
+	if os.Geteuid() == 0 {
+		return raw
+	}
+	return "authopen://" + raw
+}
+
+// openAuthorized opens the device of an authopen:// location read-write
+// through authopen, which receives the authorization of the user and
+// sends the open descriptor over a socket.
+func openAuthorized(location string) (flasher.Destination, error) {
+	path := strings.TrimPrefix(location, "authopen://")
+	ours, theirs, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer ours.Close()
+	var stderr bytes.Buffer
+	cmd := exec.Command(authopenPath, "-stdoutpipe", "-o", strconv.Itoa(os.O_RDWR), path)
+	cmd.Stdout, cmd.Stderr = theirs, &stderr
+	err = cmd.Start()
+	theirs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not run authopen: %w", err)
+	}
+	f, rerr := flasher.ReceiveFile(ours, path)
+	if err := cmd.Wait(); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, fmt.Errorf("%w: authopen could not open %s: %v %s", errPermission, path, err, strings.TrimSpace(stderr.String()))
+	}
+	if rerr != nil {
+		return nil, fmt.Errorf("%w: %v", errPermission, rerr)
+	}
+	return flasher.NewFileDestination(f), nil
+}
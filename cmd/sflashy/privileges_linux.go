@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// helperPath is where packages install sflashy-helper, as declared in its
+// polkit policy; it can be changed at build time with -ldflags
+// "-X main.helperPath=...".
+var helperPath = "/usr/libexec/sflashy-helper"
+
+// checkRoot lets a user that is not root go on when the device can be
+// opened on their behalf: by sflashy-helper through pkexec if it is
+// installed, else by UDisks2. polkit then asks for the authorization.
+func checkRoot() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if helperAvailable() {
+		logger.Debug("not running as root, the device will be opened by sflashy-helper", "helper", helperPath)
+		return nil
+	}
+	if err := udisksAvailable(); err != nil {
+		logger.Debug("UDisks2 not available", "err", err)
+		return fmt.Errorf("%w: this program must be run as root", errPermission)
+	}
+	logger.Debug("not running as root, the device will be opened through UDisks2")
+	return nil
+}
+
+// helperAvailable reports whether sflashy-helper and pkexec are installed.
+func helperAvailable() bool {
+	if _, err := os.Stat(helperPath); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("pkexec")
+	return err == nil
+}
+
+// deviceLocation returns the location passed to Flasher.Flash to write
+// device: the device itself as root, else its helper:// or udisks2://
+// location.
+func deviceLocation(device string) string {
+	switch {
+	case os.Geteuid() == 0:
+		return device
+	case helperAvailable():
+		return "helper://" + device
+	}
+	return "udisks2://" + device
+}
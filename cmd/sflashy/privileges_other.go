@@ -0,0 +1,23 @@
+//go:build !darwin && !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkRoot verifies that the program runs with root privileges
+// (EUID == 0 on Unix-like systems).
+func checkRoot() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%w: this program must be run as root", errPermission)
+	}
+	return nil
+}
+
+// deviceLocation returns the location passed to Flasher.Flash to write
+// device.
+func deviceLocation(device string) string {
+	return device
+}
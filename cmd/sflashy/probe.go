@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// probeSize is the size of the region measured by the pre-flight probe.
+const probeSize = 32 * 1024 * 1024
+
+// probeResult holds the throughput measured by probeDevice, in bytes/s.
+type probeResult struct {
+	Read  float64
+	Write float64
+}
+
+// probeDevice measures the throughput of the device opened read-write in
+// f. The write speed is measured by writing back, synchronously, the data
+// just read from the same region, so the content of the device does not
+// change and no confirmation is needed yet.
+func probeDevice(f *os.File, size int64) (probeResult, error) {
+	if size <= 0 {
+		size = probeSize
+	}
+	flasher.DropCache(f)
+
+	buf := make([]byte, size)
+	start := time.Now()
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return probeResult{}, fmt.Errorf("probe read failed: %w", err)
+	}
+	if n == 0 {
+		return probeResult{}, fmt.Errorf("probe read failed: device is empty")
+	}
+	readTime := time.Since(start)
+
+	start = time.Now()
+	if _, err := f.WriteAt(buf[:n], 0); err != nil {
+		return probeResult{}, fmt.Errorf("probe write failed: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return probeResult{}, fmt.Errorf("probe sync failed: %w", err)
+	}
+	writeTime := time.Since(start)
+
+	return probeResult{
+		Read:  float64(n) / readTime.Seconds(),
+		Write: float64(n) / writeTime.Seconds(),
+	}, nil
+}
+
+// estimate returns the predicted duration of writing size bytes and, if
+// verify is set, of reading them back.
+func (p probeResult) estimate(size int64, verify bool) time.Duration {
+	if p.Write <= 0 {
+		return 0
+	}
+	secs := float64(size) / p.Write
+	if verify && p.Read > 0 {
+		secs += float64(size) / p.Read
+	}
+	return time.Duration(secs * float64(time.Second)).Round(time.Second)
+}
+
+// runProbe opens device, measures it and prints the predicted duration of
+// the flash of an image of imageSize bytes.
+func runProbe(device string, imageSize int64, verify bool, termOut io.Writer) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("could not open device %s for the speed probe: %w", device, err)
+	}
+	defer f.Close()
+
+	fmt.Fprintln(termOut, "Measuring device speed...")
+	size := int64(probeSize)
+	if lowMemory {
+		size = lowMemoryProbeSize
+	}
+	p, err := probeDevice(f, size)
+	if err != nil {
+		return err
+	}
+	logger.Debug("speed probe", "device", device, "read_bps", int64(p.Read), "write_bps", int64(p.Write))
+	fmt.Fprintf(termOut, "Device speed: write %.1f MB/s, read %.1f MB/s\n", p.Write/1e6, p.Read/1e6)
+	if imageSize > 0 {
+		fmt.Fprintf(termOut, "Estimated duration: %s\n", p.estimate(imageSize, verify))
+	} else {
+		fmt.Fprintln(termOut, "Estimated duration: unknown (the image size is unknown)")
+	}
+	return nil
+}
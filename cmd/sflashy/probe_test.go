@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestProbeDevice verifica che la misura della velocità non modifichi i dati.
+func TestProbeDevice(t *testing.T) {
+	data := bytes.Repeat([]byte("sflashy"), 100000)
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	p, err := probeDevice(f, 64*1024)
+	if err != nil {
+		t.Fatalf("probeDevice ha restituito un errore: %v", err)
+	}
+	if p.Read <= 0 || p.Write <= 0 {
+		t.Errorf("Velocità non valide: %+v", p)
+	}
+
+	after, _ := os.ReadFile(path)
+	if !bytes.Equal(after, data) {
+		t.Error("La misura della velocità ha modificato il contenuto del dispositivo")
+	}
+}
+
+// TestProbeEstimate verifica il calcolo della durata stimata.
+func TestProbeEstimate(t *testing.T) {
+	p := probeResult{Read: 100e6, Write: 20e6}
+	if got := p.estimate(2e9, false); got != 100*time.Second {
+		t.Errorf("Stima senza verifica: Got: %s, Want: 1m40s", got)
+	}
+	if got := p.estimate(2e9, true); got != 120*time.Second {
+		t.Errorf("Stima con verifica: Got: %s, Want: 2m0s", got)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// procEnumerator lists the disks from /proc/partitions, completing them
+// with what /sys/block and /proc/self/mounts tell, when they are readable.
+// It is the fallback of ghw, which gives up on a partial sysfs.
+type procEnumerator struct {
+	// root is "/", or a directory with proc and sys trees in the tests.
+	root string
+}
+
+// procPartition is a line of /proc/partitions.
+type procPartition struct {
+	name string
+	size uint64
+}
+
+func (e procEnumerator) Devices() ([]deviceInfo, error) {
+	entries, err := e.partitions()
+	if err != nil {
+		return nil, err
+	}
+	mounts := e.mounts()
+	devices := []deviceInfo{}
+	for _, disk := range entries {
+		if !e.isDisk(disk.name, entries) {
+			continue
+		}
+		devices = append(devices, e.device(disk, entries, mounts))
+	}
+	return devices, nil
+}
+
+// partitions reads /proc/partitions, where the sizes are in KiB.
+func (e procEnumerator) partitions() ([]procPartition, error) {
+	f, err := os.Open(filepath.Join(e.root, "proc", "partitions"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []procPartition
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// major minor #blocks name
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+		blocks, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue // l'intestazione
+		}
+		entries = append(entries, procPartition{name: fields[3], size: blocks * 1024})
+	}
+	return entries, scanner.Err()
+}
+
+// isDisk reports whether name is a whole disk worth listing: one in
+// /sys/block or, without sysfs, one that is not a partition of another
+// entry. Loop devices and RAM disks are left out, as ghw does.
+func (e procEnumerator) isDisk(name string, entries []procPartition) bool {
+	for _, prefix := range []string{"loop", "ram", "zram"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	if flasher.IsNVMePath(name) {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(e.root, "sys", "block")); err == nil {
+		_, err := os.Stat(filepath.Join(e.root, "sys", "block", name))
+		return err == nil
+	}
+	for _, other := range entries {
+		if other.name != name && isSameOrPartition(other.name, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// device describes the disk and its partitions.
+func (e procEnumerator) device(disk procPartition, entries []procPartition, mounts map[string]string) deviceInfo {
+	dev := deviceInfo{
+		Path:        "/dev/" + disk.name,
+		SizeBytes:   disk.size,
+		DriveType:   "Unknown",
+		Partitions:  []partitionInfo{},
+		Mountpoints: []string{},
+	}
+	sys := filepath.Join(e.root, "sys", "block", disk.name)
+	if sectors, err := strconv.ParseUint(readSysfs(filepath.Join(sys, "size")), 10, 64); err == nil {
+		dev.SizeBytes = sectors * 512
+	}
+	dev.Model = readSysfs(filepath.Join(sys, "device", "model"))
+	if dev.Model == "" {
+		// Le schede SD e MMC espongono il nome al posto del modello.
+		dev.Model = readSysfs(filepath.Join(sys, "device", "name"))
+	}
+	dev.Vendor = readSysfs(filepath.Join(sys, "device", "vendor"))
+	dev.Serial = readSysfs(filepath.Join(sys, "device", "serial"))
+	dev.Removable = readSysfs(filepath.Join(sys, "removable")) == "1"
+	switch readSysfs(filepath.Join(sys, "queue", "rotational")) {
+	case "1":
+		dev.DriveType = "HDD"
+	case "0":
+		dev.DriveType = "SSD"
+	}
+	if flasher.IsBootPartition(dev.Path) {
+		dev.DriveType = "eMMC boot"
+	}
+	dev.Bus = sysfsBus(sys)
+
+	if mp := mounts[dev.Path]; mp != "" {
+		dev.Mountpoints = append(dev.Mountpoints, mp)
+	}
+	for _, p := range entries {
+		if p.name == disk.name || !isSameOrPartition(disk.name, p.name) {
+			continue
+		}
+		part := partitionInfo{Path: "/dev/" + p.name, SizeBytes: p.size, MountPoint: mounts["/dev/"+p.name]}
+		if part.MountPoint != "" {
+			dev.Mountpoints = append(dev.Mountpoints, part.MountPoint)
+		}
+		dev.Partitions = append(dev.Partitions, part)
+	}
+	return dev
+}
+
+// sysfsBus returns the bus of the disk at sys from the path of its device
+// in sysfs, or "" if it cannot be resolved.
+func sysfsBus(sys string) string {
+	path, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return ""
+	}
+	// Stessi nomi di busName: i dischi SATA risultano SCSI.
+	for _, b := range []struct{ dir, bus string }{
+		{"/usb", "usb"}, {"/nvme", "nvme"}, {"/mmc", "mmc"}, {"/virtio", "virtio"}, {"/ata", "scsi"}, {"/host", "scsi"},
+	} {
+		if strings.Contains(path, b.dir) {
+			return b.bus
+		}
+	}
+	return ""
+}
+
+// mounts returns the first mountpoint of each device in /proc/self/mounts.
+func (e procEnumerator) mounts() map[string]string {
+	mounts := map[string]string{}
+	f, err := os.Open(filepath.Join(e.root, "proc", "self", "mounts"))
+	if err != nil {
+		return mounts
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && mounts[fields[0]] == "" {
+			mounts[fields[0]] = fields[1]
+		}
+	}
+	return mounts
+}
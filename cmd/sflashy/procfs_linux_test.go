@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testProcPartitions = `major minor  #blocks  name
+
+   7        0      65536 loop0
+   8        0  500107608 sda
+   8        1     524288 sda1
+   8        2  499582279 sda2
+   8       16   15558144 sdb
+   8       17     262144 sdb1
+   8       18   15294976 sdb2
+ 179        0   31166976 mmcblk0
+ 179        1     524288 mmcblk0p1
+`
+
+// writeFiles crea i file indicati sotto root.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestProcEnumeratorNoSysfs verifica l'elenco ricavato dal solo
+// /proc/partitions.
+func TestProcEnumeratorNoSysfs(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"proc/partitions":  testProcPartitions,
+		"proc/self/mounts": "/dev/sdb1 /media/boot vfat rw 0 0\n/dev/sda2 / ext4 rw 0 0\n",
+	})
+	devices, err := procEnumerator{root: root}.Devices()
+	if err != nil {
+		t.Fatalf("Devices ha restituito un errore: %v", err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("Dispositivi errati. Got: %+v", devices)
+	}
+	sdb := devices[1]
+	if sdb.Path != "/dev/sdb" || sdb.SizeBytes != 15558144*1024 || len(sdb.Partitions) != 2 {
+		t.Errorf("Disco errato. Got: %+v", sdb)
+	}
+	if sdb.Partitions[0].MountPoint != "/media/boot" || len(sdb.Mountpoints) != 1 {
+		t.Errorf("Punti di montaggio errati. Got: %+v", sdb.Partitions)
+	}
+	if mmc := devices[2]; mmc.Path != "/dev/mmcblk0" || len(mmc.Partitions) != 1 || mmc.Partitions[0].Path != "/dev/mmcblk0p1" {
+		t.Errorf("Scheda SD errata. Got: %+v", mmc)
+	}
+}
+
+// TestProcEnumeratorSysfs verifica che i dischi e i loro attributi
+// vengano letti da /sys/block quando è disponibile.
+func TestProcEnumeratorSysfs(t *testing.T) {
+	root := t.TempDir()
+	usb := "sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/host6/target6:0:0/6:0:0:0/block/sdb"
+	writeFiles(t, root, map[string]string{
+		"proc/partitions":                testProcPartitions,
+		usb + "/size":                    "31116288\n",
+		usb + "/removable":               "1\n",
+		usb + "/queue/rotational":        "0\n",
+		usb + "/device/model":            "Ultra Fit\n",
+		usb + "/device/vendor":           "SanDisk\n",
+		"sys/block/sda/removable":        "0\n",
+		"sys/block/sda/queue/rotational": "1\n",
+	})
+	if err := os.Symlink(filepath.Join(root, usb), filepath.Join(root, "sys/block/sdb")); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := procEnumerator{root: root}.Devices()
+	if err != nil {
+		t.Fatalf("Devices ha restituito un errore: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("Solo i dischi in /sys/block dovrebbero essere elencati. Got: %+v", devices)
+	}
+	sdb := devices[1]
+	if sdb.Model != "Ultra Fit" || sdb.Vendor != "SanDisk" || !sdb.Removable || sdb.Bus != "usb" ||
+		sdb.DriveType != "SSD" || sdb.SizeBytes != 31116288*512 {
+		t.Errorf("Attributi errati. Got: %+v", sdb)
+	}
+	if devices[0].DriveType != "HDD" || devices[0].Removable {
+		t.Errorf("Attributi errati. Got: %+v", devices[0])
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// quirkConfig is a USB bridge written to in a special way, from the
+// usb_quirks section of the configuration.
+type quirkConfig struct {
+	// USBID is the vendor and product ID, as shown by lsusb ("152d:0578").
+	USBID        string `yaml:"usb_id"`
+	Name         string `yaml:"name"`
+	SectorSize   int    `yaml:"sector_size"`
+	MaxBlockSize int    `yaml:"max_block_size"`
+	NoFlush      bool   `yaml:"no_flush"`
+	Warning      string `yaml:"warning"`
+}
+
+// registerQuirks adds the configured bridges to the quirks of the library.
+func registerQuirks(configs []quirkConfig) error {
+	for _, c := range configs {
+		vendor, product, ok := strings.Cut(c.USBID, ":")
+		if !ok {
+			return fmt.Errorf("usb quirk %s: invalid usb_id %q, want vendor:product", c.Name, c.USBID)
+		}
+		err := flasher.RegisterQuirk(flasher.Quirk{
+			VendorID: vendor, ProductID: product, Name: c.Name,
+			SectorSize: c.SectorSize, MaxBlockSize: c.MaxBlockSize, NoFlush: c.NoFlush, Warning: c.Warning,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Debug("usb quirk registered", "usb_id", c.USBID, "name", c.Name)
+	}
+	return nil
+}
+
+// applyQuirk adapts f to the USB bridge of device, if it is a known one,
+// and warns about the bridges known to misbehave.
+func applyQuirk(f *flasher.Flasher, device string) {
+	q, ok := flasher.QuirkFor(device)
+	if !ok {
+		return
+	}
+	f.ApplyQuirk(q)
+	logger.Info("applying the quirks of the USB bridge", "bridge", q.Name, "sector_size", q.SectorSize,
+		"max_block_size", q.MaxBlockSize, "no_flush", q.NoFlush)
+	if q.Warning != "" {
+		logger.Warn(q.Name + ": " + q.Warning)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestRegisterQuirks verifica i bridge configurati.
+func TestRegisterQuirks(t *testing.T) {
+	if err := registerQuirks([]quirkConfig{{Name: "bad", USBID: "152d0578"}}); err == nil {
+		t.Error("Un usb_id senza due punti dovrebbe essere un errore")
+	}
+	if err := registerQuirks([]quirkConfig{{Name: "clitest", USBID: "1234:ABCD", SectorSize: 4096, NoFlush: true}}); err != nil {
+		t.Fatalf("registerQuirks ha restituito un errore: %v", err)
+	}
+	if q, ok := flasher.LookupQuirk("1234", "abcd"); !ok || q.SectorSize != 4096 || !q.NoFlush {
+		t.Errorf("Quirk registrato errato. Got: %+v (%v)", q, ok)
+	}
+}
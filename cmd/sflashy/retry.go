@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// retryFlags are the values of --retries, --retry-backoff and
+// --retry-max-backoff.
+type retryFlags struct {
+	Retries             int
+	Backoff, MaxBackoff time.Duration
+}
+
+// addRetryFlags registers the retry flags on fs.
+func addRetryFlags(fs *flag.FlagSet) *retryFlags {
+	f := &retryFlags{}
+	fs.IntVar(&f.Retries, "retries", 0, "retry transient read, write and download errors this many times")
+	fs.DurationVar(&f.Backoff, "retry-backoff", time.Second, "wait before the first retry, doubled at each retry")
+	fs.DurationVar(&f.MaxBackoff, "retry-max-backoff", 30*time.Second, "longest wait between two retries")
+	return f
+}
+
+// policy returns the flasher.RetryPolicy selected by the flags.
+func (f retryFlags) policy() (flasher.RetryPolicy, error) {
+	if f.Retries < 0 {
+		return flasher.RetryPolicy{}, usageError("--retries cannot be negative")
+	}
+	if f.Backoff < 0 || f.MaxBackoff < 0 {
+		return flasher.RetryPolicy{}, usageError("the retry backoff cannot be negative")
+	}
+	return flasher.RetryPolicy{MaxAttempts: f.Retries + 1, Backoff: f.Backoff, MaxBackoff: f.MaxBackoff}, nil
+}
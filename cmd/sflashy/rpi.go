@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// setupFlags are the flags of the headless setup of Raspberry Pi OS.
+type setupFlags struct {
+	SSH            bool
+	SSHKeys        []string
+	User, Password string
+	WiFi           flasher.WiFi
+	Hostname       string
+	Network        flasher.StaticNetwork
+	DNS            string
+}
+
+// addSetupFlags registers the Raspberry Pi setup flags on fs.
+func addSetupFlags(fs *flag.FlagSet) *setupFlags {
+	f := &setupFlags{}
+	fs.BoolVar(&f.SSH, "ssh", false, "Raspberry Pi OS: enable the SSH server")
+	fs.Func("ssh-key", "Raspberry Pi OS: authorize the public keys of this file for SSH (repeatable)", func(s string) error {
+		f.SSHKeys = append(f.SSHKeys, s)
+		return nil
+	})
+	fs.StringVar(&f.User, "user", "", "Raspberry Pi OS: create this first user, with --password")
+	fs.StringVar(&f.Password, "password", "", "password of --user, or its hash from `openssl passwd -6`")
+	fs.StringVar(&f.WiFi.SSID, "wifi-ssid", "", "Raspberry Pi OS: connect to this Wi-Fi network")
+	fs.StringVar(&f.WiFi.Password, "wifi-password", "", "WPA passphrase of --wifi-ssid")
+	fs.StringVar(&f.WiFi.Country, "wifi-country", "", "Wi-Fi country code, e.g. IT")
+	fs.BoolVar(&f.WiFi.Hidden, "wifi-hidden", false, "the --wifi-ssid network is hidden")
+	fs.StringVar(&f.Hostname, "hostname", "", "set the hostname of the flashed system, a template such as kiosk-{{.Index}} for a batch")
+	fs.StringVar(&f.Network.Address, "static-ip", "", "Raspberry Pi OS: static IPv4 address with prefix, e.g. 192.168.1.50/24")
+	fs.StringVar(&f.Network.Gateway, "gateway", "", "default gateway of --static-ip")
+	fs.StringVar(&f.DNS, "dns", "", "comma-separated DNS servers of --static-ip")
+	fs.StringVar(&f.Network.Interface, "interface", "", "network interface of --static-ip (default eth0)")
+	return f
+}
+
+// steps returns the customization steps selected by the flags, in the
+// order they must run: the static address goes after the Wi-Fi it may
+// change.
+func (f setupFlags) steps() ([]flasher.Step, error) {
+	if f.Password != "" && f.User == "" {
+		return nil, usageError("--password needs --user")
+	}
+	if f.WiFi.SSID == "" && (f.WiFi.Password != "" || f.WiFi.Country != "" || f.WiFi.Hidden) {
+		return nil, usageError("the Wi-Fi flags need --wifi-ssid")
+	}
+	if f.Network.Address == "" && (f.Network.Gateway != "" || f.DNS != "" || f.Network.Interface != "") {
+		return nil, usageError("--gateway, --dns and --interface need --static-ip")
+	}
+
+	var keys []string
+	for _, path := range f.SSHKeys {
+		k, err := readPublicKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+
+	var steps []flasher.Step
+	if f.SSH || len(keys) > 0 || f.User != "" || f.WiFi.SSID != "" {
+		setup := flasher.RaspberryPiSetup{SSH: f.SSH, AuthorizedKeys: keys, User: f.User, Password: f.Password, WiFi: f.WiFi}
+		setup.WiFi.Country = strings.ToUpper(setup.WiFi.Country)
+		if err := setup.Validate(); err != nil {
+			return nil, usageError("%v", err)
+		}
+		steps = append(steps, setup)
+	}
+	if strings.Contains(f.Hostname, "{{") {
+		hostname, err := hostnameStep(f.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, hostname)
+	} else if f.Hostname != "" {
+		hostname := flasher.SetHostname{Hostname: f.Hostname}
+		if err := hostname.Validate(); err != nil {
+			return nil, usageError("%v", err)
+		}
+		steps = append(steps, hostname)
+	}
+	if f.Network.Address != "" {
+		network := f.Network
+		network.DNS = nil
+		for _, dns := range strings.Split(f.DNS, ",") {
+			if dns = strings.TrimSpace(dns); dns != "" {
+				network.DNS = append(network.DNS, dns)
+			}
+		}
+		if err := network.Validate(); err != nil {
+			return nil, usageError("%v", err)
+		}
+		steps = append(steps, network)
+	}
+	return steps, nil
+}
+
+// readPublicKeys returns the keys of a public key or authorized_keys file,
+// skipping blank lines and comments.
+func readPublicKeys(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the SSH key: %w", err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, usageError("%s has no SSH public key", path)
+	}
+	return keys, nil
+}
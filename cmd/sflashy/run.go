@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jobManifest is the file of `sflashy run`, in YAML or JSON: the flashes
+// to run and how many at once, e.g.
+//
+//	concurrency: 2
+//	jobs:
+//	  - name: kiosk-a
+//	    image: raspios.img.xz
+//	    target: serial:4C530001231
+//	    verify: true
+//	    options:
+//	      hostname: kiosk-a
+//	      ssh-key: [keys/admin.pub]
+//	      expand: true
+type jobManifest struct {
+	// Concurrency is how many jobs run at once (1 if not set).
+	Concurrency int `yaml:"concurrency"`
+	// MaxPerController is how many of them write to the devices of the
+	// same USB controller (no limit if 0).
+	MaxPerController int           `yaml:"max_per_controller"`
+	Jobs             []manifestJob `yaml:"jobs"`
+}
+
+// manifestJob is a flash of a jobManifest.
+type manifestJob struct {
+	Name string `yaml:"name"`
+	// Image is relative to the manifest.
+	Image string `yaml:"image"`
+	// Target is a device, or a selector as for --target.
+	Target string `yaml:"target"`
+	Verify bool   `yaml:"verify"`
+	SHA256 string `yaml:"sha256"`
+	// Options are flags of a flash, by name without the dashes: a list
+	// sets a repeatable flag once for each of its values.
+	Options map[string]any `yaml:"options"`
+
+	selector targetSelector
+}
+
+// loadJobManifest reads the manifest at path and checks its jobs.
+func loadJobManifest(path string) (*jobManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m jobManifest
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid job manifest %s: %w", path, err)
+	}
+	if len(m.Jobs) == 0 {
+		return nil, fmt.Errorf("the job manifest %s has no jobs", path)
+	}
+	if m.Concurrency < 0 {
+		return nil, fmt.Errorf("%s: invalid concurrency %d", path, m.Concurrency)
+	}
+	m.Concurrency = max(m.Concurrency, 1)
+	if m.MaxPerController < 0 {
+		return nil, fmt.Errorf("%s: invalid max_per_controller %d", path, m.MaxPerController)
+	}
+	names := map[string]bool{}
+	for i := range m.Jobs {
+		job := &m.Jobs[i]
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("job %d", i+1)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("%s: the job name %q appears twice", path, job.Name)
+		}
+		names[job.Name] = true
+		if job.Image == "" || job.Target == "" {
+			return nil, fmt.Errorf("%s: %s needs an image and a target", path, job.Name)
+		}
+		if !filepath.IsAbs(job.Image) && !strings.Contains(job.Image, "://") {
+			job.Image = filepath.Join(filepath.Dir(path), job.Image)
+		}
+		if job.selector, err = parseTargetSelector(job.Target); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, job.Name, err)
+		}
+		// Le opzioni si controllano subito, prima di scrivere qualcosa.
+		if _, err := job.flashOptions(""); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, job.Name, err)
+		}
+	}
+	return &m, nil
+}
+
+// optionValues returns the values of an option of a job, as given to
+// flag.Set.
+func optionValues(v any) []string {
+	switch v := v.(type) {
+	case []any:
+		var values []string
+		for _, item := range v {
+			values = append(values, optionValues(item)...)
+		}
+		return values
+	case nil:
+		return []string{"true"}
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+// flashOptions returns the options of the flash of the job to device,
+// parsing its Options with the flags of a flash.
+func (j manifestJob) flashOptions(device string) (flashOptions, error) {
+	fs := flag.NewFlagSet(j.Name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	eject := fs.Bool("eject", false, "")
+	expand := fs.Bool("expand", false, "")
+	timeout := fs.Duration("timeout", 0, "")
+	hashName := fs.String("hash", "", "")
+	checksum := fs.String("checksum", "", "")
+	var imageSize sizeFlag
+	fs.Var(&imageSize, "size", "")
+	persistence := addPersistenceFlags(fs)
+	data := addDataPartitionFlag(fs)
+	lint := addLintFlags(fs)
+	asset := addAssetFlags(fs)
+	custom := addStepFlags(fs)
+	retry := addRetryFlags(fs)
+	names := make([]string, 0, len(j.Options))
+	for name := range j.Options {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return flashOptions{}, usageError("unknown option %q", name)
+		}
+		for _, value := range optionValues(j.Options[name]) {
+			if err := fs.Set(name, value); err != nil {
+				return flashOptions{}, usageError("invalid option %s: %v", name, err)
+			}
+		}
+	}
+
+	opts := flashOptions{Image: j.Image, Device: device, Yes: true, Eject: *eject, Verify: j.Verify, Expand: *expand, ImageSize: int64(imageSize.bytes), Timeout: *timeout}
+	var err error
+	if opts.Hash, opts.Checksum, err = checksumOptions(*hashName, *checksum, j.SHA256); err != nil {
+		return flashOptions{}, err
+	}
+	if opts.Retry, err = retry.policy(); err != nil {
+		return flashOptions{}, err
+	}
+	if err := persistence.apply(&opts); err != nil {
+		return flashOptions{}, err
+	}
+	if err := data.apply(&opts); err != nil {
+		return flashOptions{}, err
+	}
+	if err := lint.apply(&opts); err != nil {
+		return flashOptions{}, err
+	}
+	if err := asset.apply(&opts); err != nil {
+		return flashOptions{}, err
+	}
+	if opts.Steps, err = custom.steps(); err != nil {
+		return flashOptions{}, err
+	}
+	opts.Index = custom.templates.start
+	return opts, nil
+}
+
+// jobReport is the outcome of a job of a manifest: the --json summary of
+// its flash, with the name of the job.
+type jobReport struct {
+	Job string `json:"job"`
+	jsonSummary
+}
+
+// runJob flashes job to device, with its output on out, and returns its
+// report.
+func runJob(job manifestJob, device string, out io.Writer) (jobReport, error) {
+	report := jobReport{Job: job.Name}
+	opts, err := job.flashOptions(device)
+	var summary bytes.Buffer
+	if err == nil {
+		opts.JSON = &summary
+		err = runFlash(context.Background(), opts, strings.NewReader(""), out)
+	}
+	if jerr := json.Unmarshal(summary.Bytes(), &report.jsonSummary); jerr != nil {
+		report.jsonSummary = jsonSummary{Status: "failed", ExitCode: exitCode(err), Image: job.Image, Device: device}
+		if err != nil {
+			report.Error = err.Error()
+		}
+	}
+	return report, err
+}
+
+// writeJobReports prints the consolidated report of a manifest: a line
+// for each job, and how many failed.
+func writeJobReports(w io.Writer, reports []jobReport) {
+	width := 0
+	for _, r := range reports {
+		width = max(width, len(r.Job))
+	}
+	failed, notRun := 0, 0
+	fmt.Fprintln(w, ColorSuccess+"\nReport"+ColorReset)
+	for _, r := range reports {
+		switch r.Status {
+		case "ok":
+			fmt.Fprintf(w, "  %-*s  ok      %s, %s, %s, verification %s\n", width, r.Job, r.Device, formatSize(uint64(r.Bytes)), (time.Duration(r.ElapsedSeconds * float64(time.Second))).Round(100*time.Millisecond), r.Verification)
+		case "":
+			notRun++
+			fmt.Fprintf(w, "  %-*s  not run\n", width, r.Job)
+		default:
+			failed++
+			fmt.Fprintf(w, ColorError+"  %-*s  %-6s  %s: %s"+ColorReset+"\n", width, r.Job, r.Status, r.Device, r.Error)
+		}
+	}
+	if failed > 0 || notRun > 0 {
+		fmt.Fprintf(w, ColorError+"%d of %d jobs failed, %d not run."+ColorReset+"\n", failed, len(reports), notRun)
+	} else {
+		fmt.Fprintf(w, ColorSuccess+"All %d jobs completed."+ColorReset+"\n", len(reports))
+	}
+}
+
+// runRun implements the `run` subcommand: the jobs of a manifest, up to
+// its concurrency at once, after a single confirmation.
+func runRun(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	jsonOut := fs.Bool("json", false, "print the report of each job as a JSON line on stdout")
+	concurrency := fs.Int("concurrency", 0, "jobs run at once, overriding the manifest")
+	perController := fs.Int("max-per-controller", 0, "jobs on the same USB controller run at once, overriding the manifest")
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	addLowMemoryFlag(fs)
+	addHookFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 1 {
+		return usageError("run requires exactly one job manifest")
+	}
+	manifest, err := loadJobManifest(positional[0])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if *concurrency > 0 {
+		manifest.Concurrency = *concurrency
+	}
+	if *perController > 0 {
+		manifest.MaxPerController = *perController
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+	stopMQTT, err := startMQTT()
+	if err != nil {
+		return err
+	}
+	defer stopMQTT()
+
+	// Un job senza il suo dispositivo fallisce da solo: gli altri vanno
+	// avanti.
+	devices := make([]string, len(manifest.Jobs))
+	errs := make([]error, len(manifest.Jobs))
+	reports := make([]jobReport, len(manifest.Jobs))
+	for i, job := range manifest.Jobs {
+		if devices[i], errs[i] = findTarget(job.selector); errs[i] != nil {
+			logger.Warn("job left out", "job", job.Name, "err", errs[i])
+			reports[i].jsonSummary = jsonSummary{Status: "failed", ExitCode: exitCode(errs[i]), Image: job.Image, Device: job.Target, Error: errs[i].Error()}
+		}
+	}
+	found := activeTargets(devices, errs)
+	if len(found) == 0 {
+		return batchError(errs, "jobs")
+	}
+	if err := checkTargets(activeDevices(devices, found)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Jobs of %s:\n", positional[0])
+	for i, job := range manifest.Jobs {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, ColorError+"  %s: %s to %s, not found: %v"+ColorReset+"\n", job.Name, filepath.Base(job.Image), job.Target, errs[i])
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %s: %s to %s\n", job.Name, filepath.Base(job.Image), devices[i])
+	}
+	if !*yes && !confirmAction(bufio.NewReader(os.Stdin), os.Stderr, fmt.Sprintf("Running %d jobs.", len(found))) {
+		fmt.Fprintln(os.Stderr, "Operation cancelled.")
+		return errCancelled
+	}
+
+	// Con più job insieme il progresso si confonderebbe: ognuno scrive
+	// nel suo buffer, mostrato se fallisce.
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		interrupted bool
+	)
+	// I job partono in ordine, saltando quelli di un controller USB già
+	// al limite.
+	slots := newGroupSlots(manifest.Concurrency, manifest.MaxPerController)
+	groups := make([]string, len(devices))
+	pending := found
+	for _, i := range pending {
+		if manifest.MaxPerController > 0 {
+			groups[i] = usbController(devices[i])
+		}
+	}
+	for len(pending) > 0 {
+		k := slots.next(pending, groups)
+		i, job := pending[k], manifest.Jobs[pending[k]]
+		pending = slices.Delete(pending, k, k+1)
+		mu.Lock()
+		stop := interrupted
+		mu.Unlock()
+		if stop {
+			slots.release(groups[i])
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { slots.release(groups[i]); wg.Done() }()
+			var out io.Writer = os.Stderr
+			var buf bytes.Buffer
+			if manifest.Concurrency > 1 {
+				out = &buf
+				fmt.Fprintf(os.Stderr, "Starting %s: %s to %s\n", job.Name, filepath.Base(job.Image), devices[i])
+			} else {
+				fmt.Fprintf(os.Stderr, ColorSuccess+"\nJob %s"+ColorReset+"\n", job.Name)
+			}
+			report, err := runJob(job, devices[i], out)
+			mu.Lock()
+			defer mu.Unlock()
+			reports[i], errs[i] = report, err
+			switch {
+			case err != nil:
+				logger.Error("job failed", "job", job.Name, "device", devices[i], "err", err)
+				interrupted = interrupted || errors.Is(err, errInterrupted)
+				if manifest.Concurrency > 1 {
+					fmt.Fprintf(os.Stderr, ColorError+"%s failed: %v"+ColorReset+"\n", job.Name, err)
+					os.Stderr.Write(buf.Bytes())
+				}
+			case manifest.Concurrency > 1:
+				fmt.Fprintf(os.Stderr, ColorSuccess+"%s completed"+ColorReset+"\n", job.Name)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range reports {
+		reports[i].Job = manifest.Jobs[i].Name
+		if *jsonOut {
+			json.NewEncoder(os.Stdout).Encode(reports[i])
+		}
+	}
+	writeJobReports(os.Stderr, reports)
+	if interrupted {
+		failed := 0
+		for _, r := range reports {
+			if r.Status != "ok" {
+				failed++
+			}
+		}
+		return fmt.Errorf("%w: %d of %d jobs did not complete", errInterrupted, failed, len(reports))
+	}
+	return batchError(errs, "jobs")
+}
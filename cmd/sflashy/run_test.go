@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLoadJobManifest verifica la lettura del file di `run` e delle
+// opzioni dei job.
+func TestLoadJobManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobs.yaml")
+	os.WriteFile(path, []byte(`concurrency: 2
+jobs:
+  - name: kiosk-a
+    image: raspios.img.xz
+    target: serial:4C530001231
+    verify: true
+    options:
+      hostname: kiosk-a
+      expand: true
+      retries: 3
+  - image: /srv/debian.img
+    target: /dev/sdc
+`), 0o644)
+	m, err := loadJobManifest(path)
+	if err != nil {
+		t.Fatalf("loadJobManifest ha restituito un errore: %v", err)
+	}
+	if m.Concurrency != 2 || len(m.Jobs) != 2 || m.Jobs[1].Name != "job 2" {
+		t.Errorf("Manifest errato. Got: %+v", m)
+	}
+	a := m.Jobs[0]
+	if a.Image != filepath.Join(dir, "raspios.img.xz") || a.selector.Kind != "serial" {
+		t.Errorf("Immagine o destinazione errate. Got: %s, %+v", a.Image, a.selector)
+	}
+	opts, err := a.flashOptions("/dev/sdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.Yes || !opts.Verify || !opts.Expand || opts.Device != "/dev/sdb" || len(opts.Steps) != 1 {
+		t.Errorf("Opzioni errate. Got: %+v", opts)
+	}
+
+	for name, bad := range map[string]string{
+		"vuoto.yaml":   "jobs: []\n",
+		"target.yaml":  "jobs:\n  - image: a.img\n",
+		"doppio.yaml":  "jobs:\n  - {name: a, image: a.img, target: /dev/sdb}\n  - {name: a, image: a.img, target: /dev/sdc}\n",
+		"opzione.yaml": "jobs:\n  - {image: a.img, target: /dev/sdb, options: {colore: rosso}}\n",
+		"valore.yaml":  "jobs:\n  - {image: a.img, target: /dev/sdb, options: {hostname: kiosk_a}}\n",
+		"campo.yaml":   "jobs:\n  - {image: a.img, target: /dev/sdb, immagine: b.img}\n",
+	} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(bad), 0o644)
+		if _, err := loadJobManifest(p); err == nil {
+			t.Errorf("%s dovrebbe essere rifiutato", name)
+		}
+	}
+}
+
+// TestWriteJobReports verifica il resoconto finale dei job.
+func TestWriteJobReports(t *testing.T) {
+	var out strings.Builder
+	writeJobReports(&out, []jobReport{
+		{Job: "kiosk-a", jsonSummary: jsonSummary{Status: "ok", Device: "/dev/sdb", Bytes: 1 << 30, ElapsedSeconds: 10, Verification: "passed"}},
+		{Job: "b", jsonSummary: jsonSummary{Status: "failed", Device: "/dev/sdc", Error: errors.New("errore di scrittura").Error()}},
+		{Job: "c"},
+	})
+	for _, want := range []string{"kiosk-a  ok      /dev/sdb, 1.00 GiB, 10s, verification passed", "b        failed  /dev/sdc: errore di scrittura", "c        not run", "1 of 3 jobs failed, 1 not run."} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Il resoconto non contiene %q. Got: %q", want, out.String())
+		}
+	}
+}
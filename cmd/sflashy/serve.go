@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// indexHTML is the web UI of `sflashy serve`.
+//
+//go:embed web/index.html
+var indexHTML []byte
+
+// server is the HTTP server of `sflashy serve`: a JSON API over a
+// JobManager, and the web UI that uses it.
+type server struct {
+	// ctx bounds the jobs: they stop when the server does.
+	ctx  context.Context
+	jobs *flasher.JobManager
+	// images is the directory of the uploaded and downloaded images: the
+	// jobs can only write those.
+	images string
+	// token must be sent by the API clients as a bearer token.
+	token string
+	// hosts are the names by which the clients reach s, besides its IP
+	// addresses and localhost: a request for another Host is refused, so
+	// that a site cannot reach s through a name of its own (DNS rebinding).
+	hosts  []string
+	filter deviceFilter
+	// devices enumerates the devices (collectDevices).
+	devices func() ([]deviceInfo, error)
+	// newFlasher returns the Flasher of a job.
+	newFlasher func(opts flashOptions) *flasher.Flasher
+	// location returns where a device is written (deviceLocation).
+	location func(device string) string
+	// controller returns the USB controller of a device (usbController),
+	// the group of its jobs; nil for none.
+	controller func(device string) string
+
+	mu       sync.Mutex
+	progress map[string]*jobProgress
+}
+
+// jobProgress is the last Progress of a job.
+type jobProgress struct {
+	mu sync.Mutex
+	p  flasher.Progress
+}
+
+// jobRequest is the body of POST /api/jobs.
+type jobRequest struct {
+	// Image is the name of an image of the images directory.
+	Image  string `json:"image"`
+	Device string `json:"device"`
+	Verify bool   `json:"verify"`
+}
+
+// jobView is a job as the API returns it.
+type jobView struct {
+	ID       string    `json:"id"`
+	Image    string    `json:"image"`
+	Device   string    `json:"device"`
+	State    string    `json:"state"`
+	Phase    string    `json:"phase,omitempty"`
+	Percent  int64     `json:"percent"`
+	Bytes    int64     `json:"bytes"`
+	Total    int64     `json:"total"`
+	Rate     float64   `json:"rate"`
+	ETA      float64   `json:"eta_seconds"`
+	Verified string    `json:"verification,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Queued   time.Time `json:"queued"`
+}
+
+// imageView is an image of the images directory.
+type imageView struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// handler returns the routes of s.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(indexHTML)
+	})
+	mux.HandleFunc("GET /api/devices", s.listDevices)
+	mux.HandleFunc("GET /api/images", s.listImages)
+	mux.HandleFunc("PUT /api/images/{name}", s.uploadImage)
+	mux.HandleFunc("POST /api/images", s.downloadImage)
+	mux.HandleFunc("GET /api/jobs", s.listJobs)
+	mux.HandleFunc("POST /api/jobs", s.submitJob)
+	mux.HandleFunc("DELETE /api/jobs/{id}", s.cancelJob)
+	return s.authorize(mux)
+}
+
+// authorize lets the requests to the API through only with the token of
+// s, for one of its hosts and not from the page of another site. The
+// POST requests must be JSON, which a form of another site cannot send.
+// The page itself is public: it asks for the token.
+func (s *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := s.checkOrigin(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("the body must be application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin returns an error if r is for a Host that is not one of s, or
+// comes from a page of another origin.
+func (s *server) checkOrigin(r *http.Request) error {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	known := net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") ||
+		slices.ContainsFunc(s.hosts, func(h string) bool { return strings.EqualFold(h, host) })
+	if !known {
+		return fmt.Errorf("unknown host %q: add it to --allowed-hosts", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return fmt.Errorf("requests from %s are not allowed", origin)
+		}
+	}
+	return nil
+}
+
+// allowedHosts returns the hosts of a server listening on listen: the
+// host of listen, the name of this machine and the names of extra, a
+// comma-separated list.
+func allowedHosts(listen, extra string) []string {
+	var hosts []string
+	if host, _, err := net.SplitHostPort(listen); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	if name, err := os.Hostname(); err == nil {
+		short, _, _ := strings.Cut(name, ".")
+		hosts = append(hosts, name, short, short+".local")
+	}
+	for _, h := range strings.Split(extra, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// newToken returns a random token for an API started without one.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// defaultImagesDir returns the images directory of the server name
+// without --images: name in the cache directory of the user, e.g.
+// ~/.cache/sflashy/serve, or else a new temporary directory, which no
+// other user can fill with images.
+func defaultImagesDir(name string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return os.MkdirTemp("", "sflashy-"+name+"-")
+	}
+	return filepath.Join(dir, "sflashy", name), nil
+}
+
+// writeJSON sends v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends err as {"error": "..."}.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *server) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := s.devices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, filterDevices(devices, s.filter))
+}
+
+func (s *server) listImages(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s.images)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	images := []imageView{}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		images = append(images, imageView{Name: e.Name(), SizeBytes: info.Size()})
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+// imageName checks name, given by a client, as the name of a file of the
+// images directory.
+func imageName(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid image name %q", name)
+	}
+	return name, nil
+}
+
+// saveImage copies r to the image name; a partial copy is removed.
+func (s *server) saveImage(name string, r io.Reader) (imageView, error) {
+	tmp, err := os.CreateTemp(s.images, ".upload-*")
+	if err != nil {
+		return imageView{}, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return imageView{}, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.images, name)); err != nil {
+		return imageView{}, err
+	}
+	logger.Info("image received", "image", name, "bytes", n)
+	return imageView{Name: name, SizeBytes: n}, nil
+}
+
+// uploadImage stores the body of the request as an image, e.g. one
+// dropped on the page.
+func (s *server) uploadImage(w http.ResponseWriter, r *http.Request) {
+	name, err := imageName(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := s.saveImage(name, r.Body)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, img)
+}
+
+// downloadImage downloads the image at the http(s) URL of the body,
+// {"url": "..."}, to the images directory, through the image cache.
+func (s *server) downloadImage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("not an http or https URL: %q", req.URL))
+		return
+	}
+	name, err := imageName(path.Base(u.Path))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.fetchImage(w, r, name, u.String(), req.SHA256)
+}
+
+// fetchImage saves the image at the URL u as name through the cache,
+// from a peer station if one has it.
+func (s *server) fetchImage(w http.ResponseWriter, r *http.Request, name, u, digest string) {
+	var err error
+	if digest != "" {
+		if digest, err = checkDigest(digest); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	blob, err := peerCache.fetch(r.Context(), u, digest)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	f, err := os.Open(blob)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	img, err := s.saveImage(name, f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, img)
+}
+
+// view returns the jobView of st.
+func (s *server) view(st flasher.JobStatus) jobView {
+	v := jobView{ID: st.ID, Image: filepath.Base(st.Image), Device: st.Device, State: string(st.State), Queued: st.Queued}
+	s.mu.Lock()
+	p := s.progress[st.ID]
+	s.mu.Unlock()
+	if p != nil {
+		p.mu.Lock()
+		v.Phase, v.Percent, v.Bytes, v.Total, v.Rate, v.ETA = p.p.Phase, p.p.Percent, p.p.Bytes, p.p.Total, p.p.Rate, p.p.ETA.Seconds()
+		p.mu.Unlock()
+	}
+	if st.State.Done() {
+		v.Verified = st.Result.Verification
+	}
+	if st.State == flasher.JobCompleted {
+		v.Percent = 100
+	}
+	if st.Err != nil {
+		v.Error = st.Err.Error()
+	}
+	return v
+}
+
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	views := []jobView{}
+	for _, st := range s.jobs.Jobs() {
+		views = append(views, s.view(st))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// submitJob queues the flash of an image of the images directory to a
+// device that matches the filter of s and is not mounted.
+func (s *server) submitJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	name, err := imageName(req.Image)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	image := filepath.Join(s.images, name)
+	if _, err := os.Stat(image); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown image %q", req.Image))
+		return
+	}
+	dev, status, err := s.jobDevice(req.Device)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	id, err := s.start(image, req.Device, req.Verify, dev)
+	if errors.Is(err, flasher.ErrDeviceBusy) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("job submitted", "job", id, "image", name, "device", req.Device, "verify", req.Verify)
+	st, _ := s.jobs.Job(id)
+	writeJSON(w, http.StatusCreated, s.view(st))
+}
+
+// jobDevice returns the device of a job, which must match the filter of s
+// and not be mounted; status is the HTTP status of err.
+func (s *server) jobDevice(device string) (dev *deviceInfo, status int, err error) {
+	devices, err := s.devices()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	devices = filterDevices(devices, s.filter)
+	i := slices.IndexFunc(devices, func(d deviceInfo) bool { return d.Path == device })
+	if i < 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("%s is not one of the devices that can be flashed", device)
+	}
+	if mounts := mountedPartitions(device); len(mounts) > 0 {
+		return nil, http.StatusConflict, fmt.Errorf("%s is mounted on %s", device, strings.Join(mounts, ", "))
+	}
+	return &devices[i], http.StatusOK, nil
+}
+
+// start submits the flash of image to device, dev, and returns the ID of
+// the job.
+func (s *server) start(image, device string, verify bool, dev *deviceInfo) (string, error) {
+	spec := flasher.JobSpec{Image: image, Device: s.location(device)}
+	progress := s.prepare(&spec, device, verify, false)
+	id, err := s.jobs.Submit(s.ctx, spec)
+	if err != nil {
+		return "", err
+	}
+	s.track(id, image, device, progress, dev)
+	return id, nil
+}
+
+// prepare sets the Flasher and the group of spec, the flash of device,
+// and returns where its progress goes; resume continues an interrupted
+// write from its checkpoint.
+func (s *server) prepare(spec *flasher.JobSpec, device string, verify, resume bool) *jobProgress {
+	progress := &jobProgress{}
+	f := s.newFlasher(flashOptions{Image: spec.Image, Device: device, Verify: verify, Resume: resume})
+	next := f.OnProgress
+	f.OnProgress = func(p flasher.Progress) {
+		progress.mu.Lock()
+		progress.p = p
+		progress.mu.Unlock()
+		if next != nil {
+			next(p)
+		}
+	}
+	spec.Flasher = f
+	if s.controller != nil {
+		spec.Group = s.controller(device)
+	}
+	return progress
+}
+
+// track follows the job id, the flash of image to device, dev: its
+// progress and, once it is done, its records.
+func (s *server) track(id, image, device string, progress *jobProgress, dev *deviceInfo) {
+	s.mu.Lock()
+	s.progress[id] = progress
+	s.mu.Unlock()
+	statusMQTT.event("queued", device, image, id, 0, nil)
+	if flashLedger != nil || flashAudit != nil || flashMetrics != nil {
+		go s.record(id, device, dev)
+	}
+}
+
+// interruptedActions are the values of serve --interrupted.
+var interruptedActions = []string{"ask", "resume", "requeue", "discard"}
+
+// restore submits again the jobs that the previous serve left queued or
+// running, as how says: resume continues the interrupted writes from
+// their checkpoint, requeue starts them over, discard drops them and ask
+// asks on termOut. A job whose device is gone, or no longer matches the
+// filter of s, fails without writing. It returns the IDs of the jobs.
+func (s *server) restore(how string, userInput io.Reader, termOut io.Writer) ([]string, error) {
+	pending, err := s.jobs.Pending()
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	if how == "ask" {
+		how = askInterrupted(pending, userInput, termOut)
+	}
+	if how == "discard" {
+		logger.Info("discarding the interrupted jobs", "jobs", len(pending))
+		return nil, s.jobs.Discard()
+	}
+	devices, err := s.devices()
+	if err != nil {
+		return nil, err
+	}
+	devices = filterDevices(devices, s.filter)
+	type restored struct {
+		image, device string
+		dev           *deviceInfo
+		progress      *jobProgress
+	}
+	var jobs []restored
+	ids, err := s.jobs.Restore(s.ctx, func(spec *flasher.JobSpec) {
+		// Lo Store conserva la posizione scritta: si risale al dispositivo.
+		r := restored{image: spec.Image, device: spec.Device}
+		if i := slices.IndexFunc(devices, func(d deviceInfo) bool { return s.location(d.Path) == spec.Device }); i >= 0 {
+			r.device, r.dev = devices[i].Path, &devices[i]
+		}
+		r.progress = s.prepare(spec, r.device, spec.Flasher.Verify, how == "resume")
+		if r.dev == nil {
+			missing := fmt.Errorf("%s is no longer one of the devices that can be flashed", r.device)
+			spec.Flasher.Confirm = func() error { return missing }
+		}
+		jobs = append(jobs, r)
+	})
+	for i, id := range ids {
+		r := jobs[i]
+		s.track(id, r.image, r.device, r.progress, r.dev)
+		logger.Info("job restored", "job", id, "image", filepath.Base(r.image), "device", r.device, "resume", how == "resume")
+	}
+	return ids, err
+}
+
+// askInterrupted lists the interrupted jobs on termOut and asks whether
+// to resume (the default), requeue or discard them.
+func askInterrupted(pending []flasher.JobStatus, userInput io.Reader, termOut io.Writer) string {
+	fmt.Fprintf(termOut, "%d job(s) were interrupted when the server last stopped:\n", len(pending))
+	for _, j := range pending {
+		fmt.Fprintf(termOut, "  job %s: %s to %s\n", j.ID, filepath.Base(j.Image), j.Device)
+	}
+	fmt.Fprint(termOut, "Resume them, requeue them from the start or discard them? [R/q/d]: ")
+	response, _ := bufio.NewReader(userInput).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(response)) {
+	case "q", "requeue":
+		return "requeue"
+	case "d", "discard":
+		return "discard"
+	}
+	return "resume"
+}
+
+// record adds the job id, flashing device, to the ledger, the audit log
+// and the metrics once it is done.
+// A job cancelled before it started is not recorded.
+func (s *server) record(id, device string, dev *deviceInfo) {
+	st, err := s.jobs.Wait(context.Background(), id)
+	if err != nil || (st.State == flasher.JobCancelled && st.Started.IsZero()) {
+		return
+	}
+	r := st.Result
+	summary := flashSummary{Image: st.Image, Device: device, Bytes: r.Bytes, Elapsed: r.Elapsed, Digest: r.Digest, Verification: r.Verification}
+	flashLedger.record(summary, dev, st.Err)
+	flashAudit.record("flash", summary, dev, st.Err)
+	flashMetrics.record(summary, dev, st.Err)
+}
+
+func (s *server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.jobs.Cancel(id); errors.Is(err, flasher.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Info("job cancelled", "job", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newServer returns a server that flashes the devices of this machine
+// matching filter, maxJobs at once and perController of them on the same
+// USB controller (no limit if 0), with the images of the images
+// directory; its jobs stop with ctx.
+func newServer(ctx context.Context, images string, maxJobs, perController int, filter deviceFilter) *server {
+	jobs := flasher.NewJobManager(maxJobs)
+	jobs.MaxPerGroup = perController
+	return &server{
+		ctx:        ctx,
+		jobs:       jobs,
+		images:     images,
+		filter:     filter,
+		devices:    collectDevices,
+		location:   deviceLocation,
+		controller: usbController,
+		progress:   map[string]*jobProgress{},
+		newFlasher: func(opts flashOptions) *flasher.Flasher {
+			return newFlasher(opts, io.Discard)
+		},
+	}
+}
+
+// runServe implements the `serve` subcommand: the web UI and its API,
+// until an interrupt.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "address of the web UI")
+	images := fs.String("images", "", "directory of the images uploaded or downloaded from the web UI (default ~/.cache/sflashy/serve)")
+	maxJobs := fs.Int("max-jobs", 4, "number of devices flashed at once")
+	perController := fs.Int("max-per-controller", 0, "number of devices on the same USB controller flashed at once (0 for no limit)")
+	token := fs.String("token", os.Getenv("SFLASHY_TOKEN"), "token the API clients must send, $SFLASHY_TOKEN by default (a random one if neither is set)")
+	extraHosts := fs.String("allowed-hosts", "", "comma-separated names the web UI is reached by, besides its addresses, localhost and the name of this machine")
+	interrupted := fs.String("interrupted", "ask", "what to do with the jobs the last run left unfinished: ask, resume, requeue or discard")
+	metricsAddr := addMetricsFlag(fs)
+	logCfg := addLogFlags(fs)
+	var filter deviceFilter
+	minSize, maxSize := addFilterFlags(fs, &filter)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if len(positional) > 0 {
+		return usageError("serve takes no arguments")
+	}
+	if !slices.Contains(interruptedActions, *interrupted) {
+		return usageError("--interrupted must be one of %s", strings.Join(interruptedActions, ", "))
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	filter.MinSize, filter.MaxSize = minSize.bytes, maxSize.bytes
+	// Come watch, solo i supporti rimovibili se non richiesto altrimenti.
+	removableSet := false
+	fs.Visit(func(f *flag.Flag) { removableSet = removableSet || f.Name == "removable" })
+	if !removableSet {
+		filter.Removable = true
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+	stopMQTT, err := startMQTT()
+	if err != nil {
+		return err
+	}
+	defer stopMQTT()
+	if *images == "" {
+		if *images, err = defaultImagesDir("serve"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*images, 0o700); err != nil {
+		return err
+	}
+	if *token == "" {
+		if *token, err = newToken(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Token of the API (the page asks for it once): %s\n", *token)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), interruptSignals...)
+	defer stop()
+	s := newServer(ctx, *images, *maxJobs, *perController, filter)
+	s.token, s.hosts = *token, allowedHosts(*listen, *extraHosts)
+	stopMetrics, err := s.metrics(*metricsAddr)
+	if err != nil {
+		return err
+	}
+	defer stopMetrics()
+	// I job in coda o in corsa sopravvivono a un riavvio o a un blackout.
+	s.jobs.Store = stateStore
+	how := *interrupted
+	if how == "ask" && !flasher.IsTerminal(os.Stdin) {
+		how = "resume"
+	}
+	if _, err := s.restore(how, os.Stdin, os.Stderr); err != nil {
+		return fmt.Errorf("could not restore the interrupted jobs: %w", err)
+	}
+	srv := &http.Server{Addr: *listen, Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	logger.Info("serving the web UI (press Ctrl+C to stop)", "url", "http://"+*listen, "images", *images)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	s.wait()
+	return nil
+}
+
+// metrics starts the metrics of the jobs of s on addr, if set, and
+// returns the function that stops them.
+func (s *server) metrics(addr string) (func(), error) {
+	if addr == "" {
+		return func() {}, nil
+	}
+	devices := func() ([]deviceInfo, error) {
+		devices, err := s.devices()
+		return filterDevices(devices, s.filter), err
+	}
+	running := func() int {
+		n := 0
+		for _, st := range s.jobs.Jobs() {
+			if st.State == flasher.JobRunning {
+				n++
+			}
+		}
+		return n
+	}
+	flashMetrics = newStationMetrics(devices, running)
+	return flashMetrics.listen(addr)
+}
+
+// wait waits for the jobs of s: they stop with its ctx, once they have
+// synced the data written.
+func (s *server) wait() {
+	for _, st := range s.jobs.Jobs() {
+		if !st.State.Done() {
+			s.jobs.Wait(context.Background(), st.ID)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestServe verifica l'API della UI web: caricamento di un'immagine,
+// elenco dei dispositivi, flash e token.
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	images := filepath.Join(dir, "images")
+	os.Mkdir(images, 0o700)
+	device := filepath.Join(dir, "sdb")
+	os.WriteFile(device, make([]byte, 1024), 0o644)
+	s := &server{
+		ctx:    context.Background(),
+		jobs:   flasher.NewJobManager(1),
+		images: images,
+		token:  "segreto",
+		filter: deviceFilter{Removable: true},
+		devices: func() ([]deviceInfo, error) {
+			return []deviceInfo{{Path: device, Removable: true}, {Path: "/dev/sda"}}, nil
+		},
+		newFlasher: func(opts flashOptions) *flasher.Flasher { return &flasher.Flasher{Verify: opts.Verify} },
+		location:   func(device string) string { return device },
+		progress:   map[string]*jobProgress{},
+	}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	call := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer segreto")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if resp, err := http.Get(srv.URL + "/api/jobs"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Senza token l'API va rifiutata. Got: %v, %v", resp.Status, err)
+	}
+	if resp, err := http.Get(srv.URL + "/"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("La pagina non richiede il token. Got: %v, %v", resp.Status, err)
+	}
+	foreign := func(header, value string) int {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/jobs", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer segreto")
+		req.Header.Set("Content-Type", "application/json")
+		if header == "Host" {
+			req.Host = value
+		} else {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := foreign("Origin", "http://evil.example"); status != http.StatusForbidden {
+		t.Errorf("Una richiesta da un altro sito va rifiutata. Got: %d", status)
+	}
+	if status := foreign("Host", "evil.example"); status != http.StatusForbidden {
+		t.Errorf("Un host sconosciuto va rifiutato. Got: %d", status)
+	}
+	if status := foreign("Content-Type", "text/plain"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("Un POST non JSON va rifiutato. Got: %d", status)
+	}
+	if status, body := call("GET", "/api/devices", ""); status != http.StatusOK || strings.Contains(body, "/dev/sda") || !strings.Contains(body, device) {
+		t.Errorf("Solo i dispositivi rimovibili attesi. Got: %d %s", status, body)
+	}
+	if status, _ := call("PUT", "/api/images/.nascosta", "x"); status != http.StatusBadRequest {
+		t.Errorf("Nome d'immagine non valido accettato. Got: %d", status)
+	}
+	if status, body := call("PUT", "/api/images/sd.img", "immagine di prova"); status != http.StatusCreated {
+		t.Fatalf("Caricamento fallito. Got: %d %s", status, body)
+	}
+	if status, body := call("GET", "/api/images", ""); status != http.StatusOK || !strings.Contains(body, `"name":"sd.img"`) {
+		t.Errorf("Immagine non elencata. Got: %d %s", status, body)
+	}
+
+	for _, bad := range []string{`{"image":"sd.img","device":"/dev/sda"}`, `{"image":"manca.img","device":"` + device + `"}`, `{"image":"../sd.img","device":"` + device + `"}`} {
+		if status, body := call("POST", "/api/jobs", bad); status != http.StatusBadRequest {
+			t.Errorf("%s dovrebbe essere rifiutato. Got: %d %s", bad, status, body)
+		}
+	}
+	status, body := call("POST", "/api/jobs", `{"image":"sd.img","device":"`+device+`","verify":true}`)
+	if status != http.StatusCreated {
+		t.Fatalf("Job rifiutato. Got: %d %s", status, body)
+	}
+	var job jobView
+	json.Unmarshal([]byte(body), &job)
+	if _, err := s.jobs.Wait(context.Background(), job.ID); err != nil {
+		t.Fatal(err)
+	}
+	_, body = call("GET", "/api/jobs", "")
+	var jobs []jobView
+	if err := json.Unmarshal([]byte(body), &jobs); err != nil || len(jobs) != 1 || jobs[0].State != "completed" || jobs[0].Percent != 100 || jobs[0].Verified != "passed" {
+		t.Errorf("Job non completato. Got: %s", body)
+	}
+	if data, _ := os.ReadFile(device); !strings.HasPrefix(string(data), "immagine di prova") {
+		t.Errorf("Dispositivo non scritto. Got: %q", data[:20])
+	}
+	if status, _ := call("DELETE", "/api/jobs/99", ""); status != http.StatusNotFound {
+		t.Errorf("Job sconosciuto. Got: %d", status)
+	}
+}
+
+// TestServeRestore verifica che i job interrotti di un server vengano
+// ripresi al riavvio, e che quelli senza più il dispositivo falliscano
+// senza scrivere.
+func TestServeRestore(t *testing.T) {
+	dir := t.TempDir()
+	image := filepath.Join(dir, "sd.img")
+	os.WriteFile(image, []byte("immagine di prova"), 0o644)
+	device, other := filepath.Join(dir, "sdb"), filepath.Join(dir, "sdc")
+	os.WriteFile(device, make([]byte, 1024), 0o644)
+	os.WriteFile(other, make([]byte, 1024), 0o644)
+	store := flasher.NewFileStore(filepath.Join(dir, "state"))
+
+	// Il primo server si ferma con due job in coda; poi sdc non è più uno
+	// dei dispositivi da scrivere.
+	ctx, cancel := context.WithCancel(context.Background())
+	before := flasher.NewJobManager(1)
+	before.Store = store
+	for _, dev := range []string{device, other} {
+		blocking := &flasher.Flasher{Verify: true, Confirm: func() error { <-ctx.Done(); return ctx.Err() }}
+		if _, err := before.Submit(ctx, flasher.JobSpec{Image: image, Device: dev, Flasher: blocking}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	for _, st := range before.Jobs() {
+		before.Wait(context.Background(), st.ID)
+	}
+
+	jobs := flasher.NewJobManager(1)
+	jobs.Store = store
+	s := &server{
+		ctx:  context.Background(),
+		jobs: jobs,
+		devices: func() ([]deviceInfo, error) {
+			return []deviceInfo{{Path: device}}, nil
+		},
+		newFlasher: func(opts flashOptions) *flasher.Flasher { return &flasher.Flasher{Verify: opts.Verify} },
+		location:   func(device string) string { return device },
+		progress:   map[string]*jobProgress{},
+	}
+	var out strings.Builder
+	ids, err := s.restore("ask", strings.NewReader("\n"), &out)
+	if err != nil || len(ids) != 2 || !strings.Contains(out.String(), "2 job(s) were interrupted") {
+		t.Fatalf("Job non ripresi. Got: %v, %v, %q", ids, err, out.String())
+	}
+	if st, _ := jobs.Wait(context.Background(), ids[0]); st.State != flasher.JobCompleted || st.Result.Verification != "passed" {
+		t.Errorf("Job ripreso non completato: %+v", st)
+	}
+	if st, _ := jobs.Wait(context.Background(), ids[1]); st.State != flasher.JobFailed || st.Err == nil || !strings.Contains(st.Err.Error(), "no longer one of the devices") {
+		t.Errorf("Il job senza dispositivo doveva fallire: %+v", st)
+	}
+	if data, _ := os.ReadFile(other); strings.Contains(string(data), "immagine") {
+		t.Error("Il dispositivo di un job fallito è stato scritto")
+	}
+	if pending, _ := jobs.Pending(); len(pending) != 0 {
+		t.Errorf("Job finiti ancora in attesa: %+v", pending)
+	}
+}
+
+// TestAskInterrupted verifica le risposte alla domanda sui job interrotti.
+func TestAskInterrupted(t *testing.T) {
+	pending := []flasher.JobStatus{{ID: "3", Image: "/srv/os.img", Device: "/dev/sdb"}}
+	for answer, want := range map[string]string{"\n": "resume", "r\n": "resume", "q\n": "requeue", "D\n": "discard", "": "resume"} {
+		var out strings.Builder
+		if got := askInterrupted(pending, strings.NewReader(answer), &out); got != want || !strings.Contains(out.String(), "job 3: os.img to /dev/sdb") {
+			t.Errorf("Risposta %q: got %s, %q", answer, got, out.String())
+		}
+	}
+}
+
+// TestServeWithoutToken verifica che l'API resti chiusa se il server non
+// ha un token.
+func TestServeWithoutToken(t *testing.T) {
+	s := &server{hosts: allowedHosts("flasher.lan:8080", "box.example")}
+	srv := httptest.NewServer(s.handler())
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/api/jobs", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Senza token l'API va rifiutata. Got: %d", resp.StatusCode)
+	}
+	for _, host := range []string{"flasher.lan:8080", "BOX.example", "localhost:8080", "[::1]:8080"} {
+		if err := s.checkOrigin(&http.Request{Host: host, Header: http.Header{}}); err != nil {
+			t.Errorf("%s dovrebbe essere accettato. Got: %v", host, err)
+		}
+	}
+}
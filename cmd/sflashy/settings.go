@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+	"gopkg.in/yaml.v3"
+)
+
+// deviceSetting is the row of a device in a --device-settings file: the
+// settings that --hostname, --static-ip and --ssh-key would give it.
+type deviceSetting struct {
+	Hostname  string   `yaml:"hostname"`
+	IP        string   `yaml:"ip"`
+	Gateway   string   `yaml:"gateway"`
+	DNS       []string `yaml:"dns"`
+	Interface string   `yaml:"interface"`
+	// SSHKeys are public keys, or files of them relative to the settings
+	// file.
+	SSHKeys []string `yaml:"ssh_keys"`
+}
+
+// deviceSettings are the rows of a --device-settings file, by serial
+// number in upper case, e.g.
+//
+//	serial,hostname,ip,gateway,dns,ssh_keys
+//	4C530001230119117311,kiosk-01,192.168.1.51/24,192.168.1.1,1.1.1.1,keys/kiosk.pub
+//
+// or, in YAML, a map of the serial numbers to their deviceSetting.
+type deviceSettings map[string]deviceSetting
+
+// settingsColumns are the columns of a CSV settings file, besides serial.
+var settingsColumns = []string{"hostname", "ip", "gateway", "dns", "interface", "ssh_keys"}
+
+// loadDeviceSettings reads the settings file at path, CSV if it ends in
+// .csv and YAML otherwise, and checks its rows.
+func loadDeviceSettings(path string) (deviceSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]deviceSetting)
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = parseSettingsCSV(data, rows)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(&rows); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid device settings %s: %w", path, err)
+	}
+	settings := make(deviceSettings, len(rows))
+	for serial, row := range rows {
+		key := strings.ToUpper(strings.TrimSpace(serial))
+		if key == "" {
+			return nil, fmt.Errorf("%s: a row has no serial number", path)
+		}
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("%s: the serial number %s appears twice", path, serial)
+		}
+		var keys []string
+		for _, k := range row.SSHKeys {
+			if keyPrefix(k) {
+				keys = append(keys, k)
+				continue
+			}
+			if !filepath.IsAbs(k) {
+				k = filepath.Join(filepath.Dir(path), k)
+			}
+			fileKeys, err := readPublicKeys(k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, serial, err)
+			}
+			keys = append(keys, fileKeys...)
+		}
+		row.SSHKeys = keys
+		if _, err := row.steps(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, serial, err)
+		}
+		settings[key] = row
+	}
+	return settings, nil
+}
+
+// parseSettingsCSV adds to rows those of a CSV settings file, whose first
+// line names the columns. dns and ssh_keys hold several values separated
+// by spaces and by semicolons.
+func parseSettingsCSV(data []byte, rows map[string]deviceSetting) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := records[0]
+	serialColumn := -1
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		header[i] = name
+		switch {
+		case name == "serial":
+			serialColumn = i
+		case !slices.Contains(settingsColumns, name):
+			return fmt.Errorf("unknown column %q, expected serial, %s", name, strings.Join(settingsColumns, ", "))
+		}
+	}
+	if serialColumn < 0 {
+		return errors.New("no serial column")
+	}
+	for line, record := range records[1:] {
+		var row deviceSetting
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch header[i] {
+			case "hostname":
+				row.Hostname = value
+			case "ip":
+				row.IP = value
+			case "gateway":
+				row.Gateway = value
+			case "dns":
+				row.DNS = strings.Fields(strings.ReplaceAll(value, ",", " "))
+			case "interface":
+				row.Interface = value
+			case "ssh_keys":
+				for _, k := range strings.Split(value, ";") {
+					if k = strings.TrimSpace(k); k != "" {
+						row.SSHKeys = append(row.SSHKeys, k)
+					}
+				}
+			}
+		}
+		serial := record[serialColumn]
+		if _, ok := rows[serial]; ok {
+			return fmt.Errorf("line %d: the serial number %s appears twice", line+2, serial)
+		}
+		rows[serial] = row
+	}
+	return nil
+}
+
+// keyPrefix reports whether s is an SSH public key rather than the path
+// of a file of them.
+func keyPrefix(s string) bool {
+	for _, p := range []string{"ssh-", "ecdsa-", "sk-"} {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// steps returns the customization steps of the row, checked, in the order
+// of the flags they stand for.
+func (s deviceSetting) steps() ([]flasher.Step, error) {
+	var steps []flasher.Step
+	if len(s.SSHKeys) > 0 {
+		setup := flasher.RaspberryPiSetup{AuthorizedKeys: s.SSHKeys}
+		if err := setup.Validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, setup)
+	}
+	if s.Hostname != "" {
+		hostname := flasher.SetHostname{Hostname: s.Hostname}
+		if err := hostname.Validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, hostname)
+	}
+	if s.IP != "" {
+		network := flasher.StaticNetwork{Interface: s.Interface, Address: s.IP, Gateway: s.Gateway, DNS: s.DNS}
+		if err := network.Validate(); err != nil {
+			return nil, err
+		}
+		steps = append(steps, network)
+	} else if s.Gateway != "" || len(s.DNS) > 0 || s.Interface != "" {
+		return nil, errors.New("gateway, dns and interface need an ip")
+	}
+	return steps, nil
+}
+
+// lookup returns the row of the device with the serial number serial.
+func (s deviceSettings) lookup(serial string) (deviceSetting, bool) {
+	row, ok := s[strings.ToUpper(strings.TrimSpace(serial))]
+	return row, ok && serial != ""
+}
+
+// step returns the customization step that applies to each device its row
+// of the settings file name. A device without one, or whose serial number
+// cannot be read, keeps the settings of the other flags.
+func (s deviceSettings) step(name string) flasher.Step {
+	return flasher.StepFunc("apply the device settings of "+filepath.Base(name), func(ctx context.Context, d *flasher.Disk) error {
+		serial, err := batch.serial(d)
+		if err != nil {
+			return err
+		}
+		row, ok := s.lookup(serial)
+		if !ok {
+			logger.Warn("the device has no row in the device settings", "device", d.Device, "serial", serial, "settings", name)
+			return nil
+		}
+		logger.Info("applying the device settings", "device", d.Device, "serial", serial, "hostname", row.Hostname, "ip", row.IP)
+		steps, err := row.steps()
+		if err != nil {
+			return err
+		}
+		return d.Apply(ctx, steps...)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestLoadDeviceSettings verifica la lettura delle impostazioni per numero
+// di serie, in CSV e in YAML.
+func TestLoadDeviceSettings(t *testing.T) {
+	dir := t.TempDir()
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGq0cQx6yGv5vPFh+0pSAl8p9i8zqKq3VZ4m5n2WcV4e tecnico@laboratorio"
+	os.MkdirAll(filepath.Join(dir, "keys"), 0o755)
+	os.WriteFile(filepath.Join(dir, "keys", "kiosk.pub"), []byte(key+"\n"), 0o644)
+
+	csvFile := filepath.Join(dir, "devices.csv")
+	os.WriteFile(csvFile, []byte("# schede della sala A\nSerial,Hostname,IP,Gateway,DNS,SSH_Keys\n"+
+		"4c5300012301,kiosk-01,192.168.1.51/24,192.168.1.1,\"1.1.1.1,9.9.9.9\",keys/kiosk.pub\n"+
+		"4C5300012302,kiosk-02,,,,\n"), 0o644)
+	settings, err := loadDeviceSettings(csvFile)
+	if err != nil {
+		t.Fatalf("loadDeviceSettings ha restituito un errore: %v", err)
+	}
+	row, ok := settings.lookup("4C5300012301")
+	if !ok || row.Hostname != "kiosk-01" || row.IP != "192.168.1.51/24" || len(row.DNS) != 2 || len(row.SSHKeys) != 1 || row.SSHKeys[0] != key {
+		t.Errorf("Riga errata. Got: %+v, %v", row, ok)
+	}
+	if steps, err := row.steps(); err != nil || len(steps) != 3 {
+		t.Errorf("Chiavi, hostname e rete attesi. Got: %v, %v", steps, err)
+	}
+	if steps, _ := settings["4C5300012302"].steps(); len(steps) != 1 || steps[0] != (flasher.SetHostname{Hostname: "kiosk-02"}) {
+		t.Errorf("Solo l'hostname atteso. Got: %v", steps)
+	}
+	if _, ok := settings.lookup(""); ok {
+		t.Error("Un numero di serie sconosciuto non ha impostazioni")
+	}
+
+	yamlFile := filepath.Join(dir, "devices.yaml")
+	os.WriteFile(yamlFile, []byte("4C5300012301:\n  hostname: kiosk-01\n  ssh_keys: [\""+key+"\"]\n"), 0o644)
+	if settings, err := loadDeviceSettings(yamlFile); err != nil || settings["4C5300012301"].Hostname != "kiosk-01" {
+		t.Errorf("YAML non letto. Got: %+v, %v", settings, err)
+	}
+
+	for name, bad := range map[string]string{
+		"colonna.csv":   "serial,nome\nA,x\n",
+		"seriale.csv":   "hostname\nkiosk-01\n",
+		"doppio.csv":    "serial,hostname\nA,kiosk-01\nA,kiosk-02\n",
+		"hostname.csv":  "serial,hostname\nA,kiosk_01\n",
+		"gateway.csv":   "serial,gateway\nA,192.168.1.1\n",
+		"chiave.csv":    "serial,ssh_keys\nA,keys/manca.pub\n",
+		"campo.yaml":    "A:\n  nome: kiosk-01\n",
+		"indirizzo.yml": "A:\n  ip: 192.168.1.51\n",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := loadDeviceSettings(path); err == nil {
+			t.Errorf("%s dovrebbe essere rifiutato", name)
+		}
+	}
+}
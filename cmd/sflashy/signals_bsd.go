@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals trigger a progress report during the copy. SIGINFO is
+// sent by the terminal on Ctrl+T.
+var statusSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINFO}
+
+// pauseSignals pause or resume the copy. SIGTSTP is left alone so that
+// Ctrl+Z keeps suspending the whole process as usual.
+var pauseSignals = []os.Signal{syscall.SIGUSR2}
+
+// interruptSignals stop a running copy cleanly, between two blocks.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statusSignals is empty: there is no SIGUSR1 equivalent on this platform.
+var statusSignals []os.Signal
+
+// pauseSignals is empty for the same reason: pausing is keyboard-only.
+var pauseSignals []os.Signal
+
+// interruptSignals stop a running copy cleanly, between two blocks.
+var interruptSignals = []os.Signal{os.Interrupt}
@@ -0,0 +1,18 @@
+//go:build unix && !(darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals trigger a progress report during the copy.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
+
+// pauseSignals pause or resume the copy. SIGTSTP is left alone so that
+// Ctrl+Z keeps suspending the whole process as usual.
+var pauseSignals = []os.Signal{syscall.SIGUSR2}
+
+// interruptSignals stop a running copy cleanly, between two blocks.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
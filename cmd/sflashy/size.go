@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// sizeSuffixes maps the accepted size suffixes to their multiplier.
+// Single letters and the IEC forms are powers of 1024 (like dd), the
+// two-letter SI forms are powers of 1000 and "s" counts 512-byte sectors.
+var sizeSuffixes = map[string]uint64{
+	"":    1,
+	"b":   1,
+	"s":   512,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1000,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1000 * 1000,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+}
+
+// parseSize parses a byte size such as "4096", "8192s", "4M" or "16GB".
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	n, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	mult, ok := sizeSuffixes[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size suffix in %q", s)
+	}
+	if n != 0 && n*mult/n != mult {
+		return 0, fmt.Errorf("size %q overflows", s)
+	}
+	return n * mult, nil
+}
+
+// sizeFlag is a flag.Value holding a byte size parsed with parseSize.
+type sizeFlag struct {
+	bytes uint64
+	set   bool
+}
+
+func (f *sizeFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return strconv.FormatUint(f.bytes, 10)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	f.bytes, f.set = n, true
+	return nil
+}
+
+// progressStep is how many bytes are copied between two redraws of the
+// progress line on a terminal.
+var progressStep int64 = flasher.DefaultProgressStep
+
+// siUnits selects powers of 1000 (GB) instead of powers of 1024 (GiB)
+// when sizes are displayed. It is set with --si / --binary.
+var siUnits = false
+
+// formatSize formats a byte count in GB or GiB with two decimals.
+func formatSize(n uint64) string {
+	if siUnits {
+		return fmt.Sprintf("%.2f GB", float64(n)/1e9)
+	}
+	return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+}
+
+// displayConfig holds the flags controlling how sizes and progress are shown.
+type displayConfig struct {
+	si, binary       bool
+	progressInterval sizeFlag
+}
+
+// addDisplayFlags registers --si, --binary and --progress-interval on fs.
+func addDisplayFlags(fs *flag.FlagSet) *displayConfig {
+	c := &displayConfig{}
+	fs.BoolVar(&c.si, "si", false, "show sizes in GB (powers of 1000)")
+	fs.BoolVar(&c.binary, "binary", false, "show sizes in GiB (powers of 1024, default)")
+	fs.Var(&c.progressInterval, "progress-interval", "bytes copied between two progress updates (default 2M)")
+	return c
+}
+
+// apply sets the display globals from the parsed flags.
+func (c *displayConfig) apply() error {
+	if c.si && c.binary {
+		return usageError("--si and --binary are mutually exclusive")
+	}
+	siUnits = c.si
+	if c.progressInterval.set {
+		if c.progressInterval.bytes == 0 {
+			return usageError("--progress-interval must be greater than zero")
+		}
+		progressStep = int64(c.progressInterval.bytes)
+	}
+	return nil
+}
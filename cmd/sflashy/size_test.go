@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// TestParseSize verifica i suffissi supportati e il rifiuto degli input non validi.
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"4096":  4096,
+		"8192s": 8192 * 512,
+		"4M":    4 << 20,
+		"4MiB":  4 << 20,
+		"16GB":  16 * 1000 * 1000 * 1000,
+		"1g":    1 << 30,
+		"2T":    2 << 40,
+	}
+	for in, want := range cases {
+		got, err := parseSize(in)
+		if err != nil {
+			t.Errorf("parseSize(%q) ha restituito un errore: %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseSize(%q) = %d, want %d", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"", "M", "12X", "-1", "99999999999999999999T"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) avrebbe dovuto restituire un errore", in)
+		}
+	}
+}
+
+// TestFormatSize verifica le unità SI e binarie.
+func TestFormatSize(t *testing.T) {
+	defer func() { siUnits = false }()
+
+	if got := formatSize(64 << 30); got != "64.00 GiB" {
+		t.Errorf("formatSize binario = %q, want %q", got, "64.00 GiB")
+	}
+	siUnits = true
+	if got := formatSize(64 << 30); got != "68.72 GB" {
+		t.Errorf("formatSize SI = %q, want %q", got, "68.72 GB")
+	}
+}
+
+// TestDisplayConfig verifica i flag --si, --binary e --progress-interval.
+func TestDisplayConfig(t *testing.T) {
+	defer func(step int64) { siUnits, progressStep = false, step }(progressStep)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := addDisplayFlags(fs)
+	if err := fs.Parse([]string{"--si", "--progress-interval", "16M"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(); err != nil {
+		t.Fatalf("apply ha restituito un errore: %v", err)
+	}
+	if !siUnits || progressStep != 16<<20 {
+		t.Errorf("Impostazioni inattese: si=%v step=%d", siUnits, progressStep)
+	}
+
+	c = &displayConfig{si: true, binary: true}
+	if err := c.apply(); err == nil {
+		t.Error("--si e --binary insieme dovrebbero restituire un errore")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// slotFlags are --ab, --ab-slot and --ab-switch, which write the image
+// to the inactive slot of an A/B device instead of over the whole device.
+type slotFlags struct {
+	Enabled bool
+	Base    string
+	Switch  bool
+}
+
+// addSlotFlags registers the A/B flags on fs.
+func addSlotFlags(fs *flag.FlagSet) *slotFlags {
+	f := &slotFlags{}
+	fs.BoolVar(&f.Enabled, "ab", false, "write the image to the inactive slot of the A/B partitions of the device")
+	fs.StringVar(&f.Base, "ab-slot", "", "name of the A/B pair to write, e.g. rootfs for rootfs_a and rootfs_b")
+	fs.BoolVar(&f.Switch, "ab-switch", false, "make the slot just written the active one")
+	return f
+}
+
+// apply points opts at the inactive slot of the device, once its other
+// options are set.
+func (f slotFlags) apply(opts *flashOptions) error {
+	if !f.Enabled {
+		if f.Base != "" || f.Switch {
+			return usageError("--ab-slot and --ab-switch need --ab")
+		}
+		return nil
+	}
+	switch {
+	case opts.Seek > 0 || opts.Skip > 0 || opts.Count > 0:
+		return usageError("--ab writes the whole image at the start of the slot, it cannot be used with --seek, --skip or --count")
+	case opts.Expand || opts.Persistence || opts.DataPartition.FSType != "":
+		return usageError("--ab keeps the partitions of the device, it cannot be used with --expand, --persistence or --data-partition")
+	case len(opts.Steps) > 0:
+		return usageError("--ab cannot be used with the customization flags, which change the whole device")
+	}
+	pairs, err := flasher.ReadSlotPairs(deviceLocation(opts.Device))
+	if err != nil {
+		return fmt.Errorf("could not read the A/B partitions of %s: %w", opts.Device, err)
+	}
+	pair, err := f.pick(pairs, opts.Device)
+	if err != nil {
+		return err
+	}
+	slot, part := pair.Inactive()
+	logger.Info("writing to the inactive slot", "device", opts.Device, "pair", pair.Base, "active", pair.Active, "slot", slot, "partition", part.Number)
+	opts.Seek, opts.Room = part.Start, part.Size
+	opts.Slot = fmt.Sprintf("%s_%s (partition %d, active: %s)", pair.Base, slot, part.Number, pair.Active)
+	if f.Switch {
+		opts.Steps = append(opts.Steps, flasher.SetActiveSlot{Base: pair.Base, Slot: slot})
+	}
+	return nil
+}
+
+// pick returns the pair of pairs named by --ab-slot, or the only one.
+func (f slotFlags) pick(pairs []flasher.SlotPair, device string) (flasher.SlotPair, error) {
+	var bases []string
+	for _, p := range pairs {
+		if f.Base == "" || strings.EqualFold(p.Base, f.Base) {
+			bases = append(bases, p.Base)
+		}
+	}
+	switch {
+	case len(bases) == 1:
+		for _, p := range pairs {
+			if p.Base == bases[0] {
+				return p, nil
+			}
+		}
+	case len(pairs) == 0:
+		return flasher.SlotPair{}, fmt.Errorf("%s has no A/B partitions, named e.g. rootfs_a and rootfs_b", device)
+	case f.Base != "":
+		return flasher.SlotPair{}, fmt.Errorf("%s has no A/B partitions named %s_a and %s_b", device, f.Base, f.Base)
+	}
+	return flasher.SlotPair{}, usageError("%s has several A/B pairs (%s), choose one with --ab-slot", device, strings.Join(bases, ", "))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestSlotFlags verifica le combinazioni di opzioni rifiutate da --ab e
+// la scelta della coppia A/B da scrivere.
+func TestSlotFlags(t *testing.T) {
+	for name, c := range map[string]struct {
+		flags slotFlags
+		opts  flashOptions
+	}{
+		"slot senza --ab":   {slotFlags{Base: "rootfs"}, flashOptions{}},
+		"switch senza --ab": {slotFlags{Switch: true}, flashOptions{}},
+		"seek":              {slotFlags{Enabled: true}, flashOptions{Seek: 512}},
+		"expand":            {slotFlags{Enabled: true}, flashOptions{Expand: true}},
+		"passi":             {slotFlags{Enabled: true}, flashOptions{Steps: []flasher.Step{flasher.RandomizeGUIDs{}}}},
+	} {
+		if err := c.flags.apply(&c.opts); !errors.Is(err, errUsage) {
+			t.Errorf("%s: atteso un errore di utilizzo. Got: %v", name, err)
+		}
+	}
+	if err := (slotFlags{}).apply(&flashOptions{}); err != nil {
+		t.Errorf("Senza --ab non dovrebbe esserci errore. Got: %v", err)
+	}
+
+	pairs := []flasher.SlotPair{{Base: "boot"}, {Base: "rootfs", Active: "b"}}
+	if p, err := (slotFlags{Base: "ROOTFS"}).pick(pairs, "/dev/sdb"); err != nil || p.Base != "rootfs" {
+		t.Errorf("Coppia errata. Got: %+v, %v", p, err)
+	}
+	if _, err := (slotFlags{}).pick(pairs, "/dev/sdb"); !errors.Is(err, errUsage) {
+		t.Errorf("Con più coppie serve --ab-slot. Got: %v", err)
+	}
+	if p, err := (slotFlags{}).pick(pairs[1:], "/dev/sdb"); err != nil || p.Base != "rootfs" {
+		t.Errorf("L'unica coppia dovrebbe essere scelta. Got: %+v, %v", p, err)
+	}
+	if _, err := (slotFlags{Base: "data"}).pick(pairs, "/dev/sdb"); err == nil {
+		t.Error("Una coppia inesistente dovrebbe essere rifiutata")
+	}
+
+	opts := flashOptions{Room: 1000, Slot: "rootfs_b"}
+	if err := checkRoom(opts, 1000, true); err != nil {
+		t.Errorf("L'immagine entra nello slot. Got: %v", err)
+	}
+	if err := checkRoom(opts, 1001, true); !errors.Is(err, errDeviceTooSmall) {
+		t.Errorf("L'immagine non entra nello slot. Got: %v", err)
+	}
+	if err := checkRoom(opts, 500, false); !errors.Is(err, errUsage) {
+		t.Errorf("Una dimensione stimata dovrebbe essere rifiutata. Got: %v", err)
+	}
+}
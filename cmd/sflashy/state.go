@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// stateStore records the interrupted flashes, for --resume, and the
+// devices being flashed in watch mode. It is set from state_dir in the
+// configuration.
+var stateStore flasher.StateStore = flasher.NewFileStore(flasher.DefaultStateDir)
+
+// watchRecord marks a device that watch mode started flashing. Serial
+// and Size identify the device, since after a restart another one may be
+// at the same path.
+type watchRecord struct {
+	Image  string `json:"image"`
+	Serial string `json:"serial,omitempty"`
+	Size   uint64 `json:"size"`
+}
+
+// watchKey is the stateStore key of a device flashed in watch mode.
+func watchKey(device string) string {
+	return "watch/" + device
+}
+
+// pendingWatchDevices returns the devices, still present, that a previous
+// watch of image was flashing when it stopped. The record of a device
+// replaced by another one at the same path is dropped.
+func pendingWatchDevices(image string) []deviceInfo {
+	keys, err := stateStore.Keys("watch/")
+	if err != nil || len(keys) == 0 {
+		return nil
+	}
+	devices, err := collectDevices()
+	if err != nil {
+		logger.Warn("could not look for interrupted devices", "err", err)
+		return nil
+	}
+	var pending []deviceInfo
+	for _, key := range keys {
+		var rec watchRecord
+		if stateStore.Load(key, &rec) != nil || rec.Image != image {
+			continue
+		}
+		for _, dev := range devices {
+			if watchKey(dev.Path) != key {
+				continue
+			}
+			if dev.Serial != rec.Serial || dev.SizeBytes != rec.Size {
+				logger.Warn("not resuming: the device differs from the interrupted one", "device", dev.Path, "serial", dev.Serial)
+				stateStore.Delete(key)
+				continue
+			}
+			pending = append(pending, dev)
+		}
+	}
+	return pending
+}
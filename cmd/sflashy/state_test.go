@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestPendingWatchDevices verifica che vengano ripresi solo i dispositivi
+// uguali a quelli interrotti.
+func TestPendingWatchDevices(t *testing.T) {
+	useEnumerator(t, fakeEnumerator{devices: testDevices})
+	saved := stateStore
+	stateStore = flasher.NewFileStore(t.TempDir())
+	t.Cleanup(func() { stateStore = saved })
+
+	sdb := testDevices[0]
+	stateStore.Save(watchKey(sdb.Path), watchRecord{Image: "a.img", Serial: sdb.Serial, Size: sdb.SizeBytes})
+	if pending := pendingWatchDevices("a.img"); len(pending) != 1 || pending[0].Path != sdb.Path {
+		t.Errorf("Il dispositivo interrotto va ripreso. Got: %+v", pending)
+	}
+	if pending := pendingWatchDevices("b.img"); len(pending) != 0 {
+		t.Errorf("Un'altra immagine non va ripresa. Got: %+v", pending)
+	}
+
+	// Un'altra scheda allo stesso percorso si scrive da capo.
+	stateStore.Save(watchKey(sdb.Path), watchRecord{Image: "a.img", Serial: "ALTRA", Size: sdb.SizeBytes})
+	if pending := pendingWatchDevices("a.img"); len(pending) != 0 {
+		t.Errorf("Un dispositivo diverso non va ripreso. Got: %+v", pending)
+	}
+	var rec watchRecord
+	if err := stateStore.Load(watchKey(sdb.Path), &rec); err == nil {
+		t.Errorf("Il record del dispositivo diverso va rimosso. Got: %+v", rec)
+	}
+}
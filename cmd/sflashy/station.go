@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// stationSession counts the devices flashed by watch --station since it
+// started, and tells the operator when each of them can be removed.
+type stationSession struct {
+	out        io.Writer
+	beep       bool // il terminale suona a ogni dispositivo
+	start      time.Time
+	ok, failed int
+}
+
+// newStationSession starts a session that reports on out, ringing its bell
+// if it is a terminal.
+func newStationSession(out io.Writer) *stationSession {
+	return &stationSession{out: out, beep: flasher.IsTerminal(out), start: time.Now()}
+}
+
+// done counts the flash of device, failed if err is set, and tells the
+// operator that it can be removed: the device is closed and synced, or
+// ejected, by then. A failure rings the bell three times.
+func (s *stationSession) done(device string, err error) {
+	if err != nil {
+		s.failed++
+		s.ring(3)
+		fmt.Fprintf(s.out, ColorError+"\nFAILED: %s: %v"+ColorReset+"\n", device, err)
+		fmt.Fprintf(s.out, ColorError+"Remove %s and set it aside."+ColorReset+"\n", device)
+	} else {
+		s.ok++
+		s.ring(1)
+		fmt.Fprintf(s.out, ColorSuccess+"\nDONE: %s is flashed and verified, it is safe to remove it."+ColorReset+"\n", device)
+	}
+	fmt.Fprintf(s.out, "Session: %d flashed, %d failed.\n", s.ok, s.failed)
+}
+
+// ring rings the bell of the terminal n times.
+func (s *stationSession) ring(n int) {
+	if s.beep {
+		fmt.Fprint(s.out, strings.Repeat("\a", n))
+	}
+}
+
+// summary prints the counts of the session once it ends.
+func (s *stationSession) summary() {
+	fmt.Fprintf(s.out, "\nSession summary: %d flashed, %d failed in %s.\n", s.ok, s.failed, time.Since(s.start).Round(time.Second))
+	logger.Info("station session ended", "flashed", s.ok, "failed", s.failed, "elapsed", time.Since(s.start).Round(time.Second))
+}
+
+// watchEvent is a device reported by a deviceWatcher, or why it stopped.
+type watchEvent struct {
+	path string
+	err  error
+}
+
+// watchEvents calls w.Next until it fails, and sends what it returns on
+// the channel, so that the wait for a device can be stopped by a signal.
+func watchEvents(w deviceWatcher) <-chan watchEvent {
+	events := make(chan watchEvent)
+	go func() {
+		for {
+			path, err := w.Next()
+			events <- watchEvent{path, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// nextDevice waits for the next event of events. With stop set, an
+// interrupt received meanwhile ends the wait: ok is then false. The
+// flashes handle their own interrupts.
+func nextDevice(events <-chan watchEvent, stop bool) (ev watchEvent, ok bool) {
+	if !stop {
+		return <-events, true
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, interruptSignals...)
+	defer signal.Stop(sigs)
+	select {
+	case ev := <-events:
+		return ev, true
+	case sig := <-sigs:
+		logger.Info("interrupt received, stopping the station", "signal", sig.String())
+		return watchEvent{}, false
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeWatcher restituisce i dispositivi indicati, poi un errore.
+type fakeWatcher struct{ paths []string }
+
+func (w *fakeWatcher) Next() (string, error) {
+	if len(w.paths) == 0 {
+		return "", errors.New("fine")
+	}
+	path := w.paths[0]
+	w.paths = w.paths[1:]
+	return path, nil
+}
+
+func (w *fakeWatcher) Close() error { return nil }
+
+// TestStationSession verifica i conteggi della sessione e gli avvisi di
+// rimozione.
+func TestStationSession(t *testing.T) {
+	var out strings.Builder
+	s := newStationSession(&out)
+	s.done("/dev/sdb", nil)
+	s.done("/dev/sdc", errors.New("verifica fallita"))
+	s.done("/dev/sdd", nil)
+	if s.ok != 2 || s.failed != 1 {
+		t.Errorf("Conteggi errati. Got: %d riusciti, %d falliti", s.ok, s.failed)
+	}
+	for _, want := range []string{"DONE: /dev/sdb", "safe to remove", "FAILED: /dev/sdc: verifica fallita", "Session: 2 flashed, 1 failed."} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("L'output non contiene %q. Got: %q", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "\a") {
+		t.Error("Fuori da un terminale non si suona")
+	}
+	out.Reset()
+	s.summary()
+	if !strings.Contains(out.String(), "2 flashed, 1 failed") {
+		t.Errorf("Riepilogo errato. Got: %q", out.String())
+	}
+}
+
+// TestWatchEvents verifica l'inoltro dei dispositivi del watcher.
+func TestWatchEvents(t *testing.T) {
+	events := watchEvents(&fakeWatcher{paths: []string{"/dev/sdb", "/dev/sdc"}})
+	for _, want := range []string{"/dev/sdb", "/dev/sdc"} {
+		if ev, ok := nextDevice(events, true); !ok || ev.path != want || ev.err != nil {
+			t.Errorf("Dispositivo errato. Got: %+v, %v, Want: %s", ev, ok, want)
+		}
+	}
+	if ev, _ := nextDevice(events, false); ev.err == nil {
+		t.Error("L'errore del watcher va inoltrato")
+	}
+}
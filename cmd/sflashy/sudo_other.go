@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// offerSudo does nothing where there is no sudo.
+func offerSudo() {}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// sudoEnv lists the variables that sudo is asked to keep, since they
+// change what sflashy does.
+var sudoEnv = []string{"SFLASHY_CONFIG", "NO_COLOR", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}
+
+// offerSudo is called when sflashy is not allowed to write devices. If
+// sudo is installed and a terminal is available, it asks whether to run
+// sflashy again under sudo and, if so, replaces the process with
+// `sudo sflashy <the same arguments>`, which keeps stdin, so that an
+// image piped into sflashy is still read. It returns if the user declines
+// or sudo cannot be used.
+func offerSudo() {
+	// Già sotto sudo: un nuovo tentativo non cambierebbe nulla.
+	if os.Getenv("SUDO_USER") != "" {
+		return
+	}
+	sudo, err := exec.LookPath("sudo")
+	if err != nil {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	ok := askSudo(tty)
+	tty.Close()
+	if !ok {
+		return
+	}
+	// La configurazione resta quella dell'utente, non quella di root.
+	os.Setenv("SFLASHY_CONFIG", configPath())
+	argv := sudoArgs(exe, os.Args[1:], os.Getenv)
+	logger.Debug("running again under sudo", "args", argv)
+	if err := syscall.Exec(sudo, argv, os.Environ()); err != nil {
+		logger.Warn("could not run sudo", "err", err)
+	}
+}
+
+// askSudo asks on tty whether to run sflashy under sudo; the default is
+// yes.
+func askSudo(tty io.ReadWriter) bool {
+	fmt.Fprint(tty, "sflashy needs root privileges to write the device. Run it again with sudo? [Y/n]: ")
+	response, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && response == "" {
+		return false
+	}
+	response = strings.TrimSpace(response)
+	return response == "" || response == "y" || response == "Y"
+}
+
+// sudoArgs returns the argv of sudo running exe with args, keeping the
+// variables of sudoEnv that are set.
+func sudoArgs(exe string, args []string, getenv func(string) string) []string {
+	argv := []string{"sudo"}
+	var keep []string
+	for _, name := range sudoEnv {
+		if getenv(name) != "" {
+			keep = append(keep, name)
+		}
+	}
+	if len(keep) > 0 {
+		argv = append(argv, "--preserve-env="+strings.Join(keep, ","))
+	}
+	return append(append(argv, "--", exe), args...)
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestSudoArgs verifica gli argomenti passati a sudo.
+func TestSudoArgs(t *testing.T) {
+	env := map[string]string{"SFLASHY_CONFIG": "/home/anna/.config/sflashy/config.yaml", "NO_COLOR": "1"}
+	got := sudoArgs("/usr/bin/sflashy", []string{"image.img", "/dev/sdb", "--verify"}, func(k string) string { return env[k] })
+	want := "[sudo --preserve-env=SFLASHY_CONFIG,NO_COLOR -- /usr/bin/sflashy image.img /dev/sdb --verify]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Argomenti di sudo errati.\nGot:  %v\nWant: %s", got, want)
+	}
+	got = sudoArgs("/usr/bin/sflashy", []string{"-"}, func(string) string { return "" })
+	if fmt.Sprint(got) != "[sudo -- /usr/bin/sflashy -]" {
+		t.Errorf("Senza variabili non dovrebbe essere preservato nulla. Got: %v", got)
+	}
+}
+
+// TestAskSudo verifica le risposte alla proposta di usare sudo.
+func TestAskSudo(t *testing.T) {
+	for input, want := range map[string]bool{"\n": true, "y\n": true, "Y\n": true, "n\n": false, "no\n": false, "": false} {
+		var out bytes.Buffer
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(input), &out}
+		if got := askSudo(rw); got != want {
+			t.Errorf("askSudo(%q) = %t, want %t", input, got, want)
+		}
+		if !strings.Contains(out.String(), "sudo?") {
+			t.Errorf("La domanda non è stata mostrata. Got: %q", out.String())
+		}
+	}
+}
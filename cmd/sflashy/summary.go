@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// flashSummary is the end-of-run report of a flash operation.
+type flashSummary struct {
+	Image   string
+	Device  string
+	Bytes   int64
+	Elapsed time.Duration
+	Digest  []byte
+	// Hash names the hash of Digest (flasher.DefaultHash if empty).
+	Hash string
+	// Verification is "passed", "FAILED" or "skipped".
+	Verification string
+}
+
+// write prints the summary as an aligned key/value block.
+func (s flashSummary) write(w io.Writer) {
+	var speed float64
+	if s.Elapsed > 0 {
+		speed = float64(s.Bytes) / s.Elapsed.Seconds() / 1e6
+	}
+
+	fmt.Fprintln(w, ColorSuccess+"\nSummary"+ColorReset)
+	fmt.Fprintf(w, "  %-14s %s\n", "Image:", s.Image)
+	fmt.Fprintf(w, "  %-14s %s\n", "Device:", s.Device)
+	fmt.Fprintf(w, "  %-14s %d (%s)\n", "Bytes written:", s.Bytes, formatSize(uint64(s.Bytes)))
+	fmt.Fprintf(w, "  %-14s %s\n", "Elapsed:", s.Elapsed.Round(100*time.Millisecond))
+	fmt.Fprintf(w, "  %-14s %.1f MB/s\n", "Average speed:", speed)
+	fmt.Fprintf(w, "  %-14s %s\n", strings.ToUpper(s.hash())+":", hex.EncodeToString(s.Digest))
+	fmt.Fprintf(w, "  %-14s %s\n", "Verification:", s.Verification)
+}
+
+// writeManySummary prints the report of a flash of image to several
+// devices: the digest once, then a line for each device, with its speed
+// and verification or why it failed.
+func writeManySummary(w io.Writer, image, hashName string, devices []string, results []flasher.TargetResult) {
+	s := flashSummary{Image: image, Hash: hashName}
+	width, failed := 0, 0
+	for i, r := range results {
+		width = max(width, len(devices[i]))
+		if r.Digest != nil && s.Digest == nil {
+			s.Bytes, s.Digest = r.Bytes, r.Digest
+		}
+	}
+	fmt.Fprintln(w, ColorSuccess+"\nSummary"+ColorReset)
+	fmt.Fprintf(w, "  %-14s %s\n", "Image:", s.Image)
+	if s.Digest != nil {
+		fmt.Fprintf(w, "  %-14s %d (%s)\n", "Bytes written:", s.Bytes, formatSize(uint64(s.Bytes)))
+		fmt.Fprintf(w, "  %-14s %s\n", strings.ToUpper(s.hash())+":", hex.EncodeToString(s.Digest))
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Fprintf(w, ColorError+"  %-*s  failed: %v"+ColorReset+"\n", width, devices[i], r.Err)
+			continue
+		}
+		var speed float64
+		if r.Elapsed > 0 {
+			speed = float64(r.Bytes) / r.Elapsed.Seconds() / 1e6
+		}
+		fmt.Fprintf(w, "  %-*s  ok, %s, %.1f MB/s, verification %s\n", width, devices[i], r.Elapsed.Round(100*time.Millisecond), speed, r.Verification)
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, ColorError+"%d of %d devices failed."+ColorReset+"\n", failed, len(results))
+	} else {
+		fmt.Fprintf(w, ColorSuccess+"All %d devices were flashed."+ColorReset+"\n", len(results))
+	}
+}
+
+// hash returns the name of the hash of Digest.
+func (s flashSummary) hash() string {
+	if s.Hash == "" {
+		return flasher.DefaultHash
+	}
+	return s.Hash
+}
+
+// jsonSummary is the machine-readable result printed by --json.
+type jsonSummary struct {
+	Status         string  `json:"status"` // "ok", "cancelled" or "failed"
+	Error          string  `json:"error,omitempty"`
+	ExitCode       int     `json:"exit_code"`
+	Image          string  `json:"image"`
+	Device         string  `json:"device"`
+	Bytes          int64   `json:"bytes"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	SHA256         string  `json:"sha256,omitempty"`
+	Hash           string  `json:"hash,omitempty"`
+	Digest         string  `json:"digest,omitempty"`
+	Verification   string  `json:"verification"`
+}
+
+// writeJSON prints the summary and the outcome err of the run as a single
+// JSON object on its own line.
+func (s flashSummary) writeJSON(w io.Writer, err error) error {
+	out := jsonSummary{
+		Status:         "ok",
+		ExitCode:       exitCode(err),
+		Image:          s.Image,
+		Device:         s.Device,
+		Bytes:          s.Bytes,
+		ElapsedSeconds: s.Elapsed.Seconds(),
+		Verification:   s.Verification,
+	}
+	// sha256 resta per gli script scritti prima di --hash.
+	if len(s.Digest) > 0 {
+		out.Hash, out.Digest = s.hash(), hex.EncodeToString(s.Digest)
+		if out.Hash == "sha256" {
+			out.SHA256 = out.Digest
+		}
+	}
+	if err != nil {
+		out.Status, out.Error = "failed", err.Error()
+		if errors.Is(err, errCancelled) {
+			out.Status = "cancelled"
+		}
+	}
+	return json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestFlashSummary verifica il contenuto del riepilogo finale.
+func TestFlashSummary(t *testing.T) {
+	var out strings.Builder
+	flashSummary{
+		Image:        "ubuntu.img",
+		Device:       "/dev/sdb",
+		Bytes:        100 * 1000 * 1000,
+		Elapsed:      10 * time.Second,
+		Digest:       []byte{0xde, 0xad, 0xbe, 0xef},
+		Verification: "passed",
+	}.write(&out)
+
+	for _, want := range []string{"ubuntu.img", "/dev/sdb", "100000000", "10s", "10.0 MB/s", "deadbeef", "passed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Il riepilogo non contiene %q. Got: %q", want, out.String())
+		}
+	}
+}
+
+// TestManySummary verifica il riepilogo di un flash su più dispositivi:
+// il digest una volta e una riga per dispositivo.
+func TestManySummary(t *testing.T) {
+	var out strings.Builder
+	ok := flasher.Result{Bytes: 100 * 1000 * 1000, Elapsed: 10 * time.Second, Digest: []byte{0xde, 0xad, 0xbe, 0xef}, Verification: "passed"}
+	writeManySummary(&out, "ubuntu.img", "", []string{"/dev/sdb", "/dev/mmcblk0"}, []flasher.TargetResult{
+		{Device: "/dev/sdb", Result: ok},
+		{Device: "/dev/mmcblk0", Err: errors.New("errore di scrittura")},
+	})
+	for _, want := range []string{"ubuntu.img", "deadbeef", "/dev/sdb      ok, 10s, 10.0 MB/s, verification passed", "/dev/mmcblk0  failed: errore di scrittura", "1 of 2 devices failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Il riepilogo non contiene %q. Got: %q", want, out.String())
+		}
+	}
+	if strings.Count(out.String(), "deadbeef") != 1 {
+		t.Errorf("Il digest va mostrato una volta sola. Got: %q", out.String())
+	}
+}
+
+// TestFlashSummaryJSON verifica il risultato in formato JSON, anche in
+// caso di errore.
+func TestFlashSummaryJSON(t *testing.T) {
+	s := flashSummary{Image: "ubuntu.img", Device: "/dev/sdb", Bytes: 512, Elapsed: 2 * time.Second, Digest: []byte{0xab}, Verification: "passed"}
+
+	var out strings.Builder
+	if err := s.writeJSON(&out, nil); err != nil {
+		t.Fatal(err)
+	}
+	var got jsonSummary
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatalf("JSON non valido: %v\n%s", err, out.String())
+	}
+	want := jsonSummary{Status: "ok", Image: "ubuntu.img", Device: "/dev/sdb", Bytes: 512, ElapsedSeconds: 2, SHA256: "ab", Hash: "sha256", Digest: "ab", Verification: "passed"}
+	if got != want {
+		t.Errorf("Risultato errato. Got: %+v, Want: %+v", got, want)
+	}
+
+	out.Reset()
+	s.writeJSON(&out, fmt.Errorf("%w: short write", errWrite))
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != "failed" || got.ExitCode != exitWriteError || !strings.Contains(got.Error, "short write") {
+		t.Errorf("Risultato di errore inatteso: %+v", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// errNoMatchingDevice is returned when a target selector matches no device.
+var errNoMatchingDevice = errors.New("no matching device")
+
+// waitInterval is how often --wait polls for the target device.
+const waitInterval = time.Second
+
+// targetSelector identifies a flash target either by its /dev path or by a
+// stable attribute such as "serial:ABC123", "model:SanDisk Ultra" or
+// "label:BOOT", which is resolved against the enumerated devices at run
+// time so that scripts do not depend on sdX numbering.
+type targetSelector struct {
+	Kind  string // path, serial, model or label
+	Value string
+}
+
+// parseTargetSelector parses a --target or device argument. Anything that
+// does not start with one of the selector kinds is a path, including the
+// /dev/disk/by-path names, which contain colons.
+func parseTargetSelector(s string) (targetSelector, error) {
+	kind, value, found := strings.Cut(s, ":")
+	switch {
+	case !found, strings.HasPrefix(s, "/"):
+		return targetSelector{Kind: "path", Value: s}, nil
+	case kind != "path" && kind != "serial" && kind != "model" && kind != "label":
+		return targetSelector{Kind: "path", Value: s}, nil
+	}
+	value = strings.Trim(value, `"'`)
+	if value == "" {
+		return targetSelector{}, fmt.Errorf("empty value for target selector %q", kind)
+	}
+	return targetSelector{Kind: kind, Value: value}, nil
+}
+
+func (t targetSelector) String() string {
+	if t.Kind == "path" {
+		return t.Value
+	}
+	return t.Kind + ":" + t.Value
+}
+
+// match reports whether dev is selected by t.
+func (t targetSelector) match(dev deviceInfo) bool {
+	switch t.Kind {
+	case "path":
+		return dev.Path == t.Value
+	case "serial":
+		return dev.Serial == t.Value
+	case "model":
+		return strings.EqualFold(strings.TrimSpace(dev.Model), strings.TrimSpace(t.Value))
+	case "label":
+		for _, p := range dev.Partitions {
+			if p.Label == t.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveTarget returns the single device selected by t. It fails if no
+// device or more than one device matches, since guessing the wrong disk
+// would be destructive.
+func resolveTarget(t targetSelector, devices []deviceInfo) (deviceInfo, error) {
+	var matches []deviceInfo
+	for _, dev := range devices {
+		if t.match(dev) {
+			matches = append(matches, dev)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return deviceInfo{}, fmt.Errorf("%w for target %s", errNoMatchingDevice, t)
+	case 1:
+		return matches[0], nil
+	default:
+		paths := make([]string, len(matches))
+		for i, dev := range matches {
+			paths[i] = dev.Path
+		}
+		return deviceInfo{}, fmt.Errorf("target %s is ambiguous, it matches %s", t, strings.Join(paths, ", "))
+	}
+}
+
+// findTarget returns the device path selected by t. Plain paths are only
+// checked for existence, other selectors go through device enumeration.
+func findTarget(t targetSelector) (string, error) {
+	if t.Kind == "path" {
+		if _, err := os.Stat(t.Value); os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: %s not found", errNoMatchingDevice, t.Value)
+		}
+		return t.Value, nil
+	}
+
+	devices, err := collectDevices()
+	if err != nil {
+		return "", fmt.Errorf("error getting block device info: %w", err)
+	}
+	dev, err := resolveTarget(t, devices)
+	if err != nil {
+		return "", err
+	}
+	return dev.Path, nil
+}
+
+// waitFor calls probe every interval until it stops reporting
+// errNoMatchingDevice, i.e. until the device shows up or a real error occurs.
+func waitFor(probe func() (string, error), interval time.Duration) (string, error) {
+	for {
+		path, err := probe()
+		if !errors.Is(err, errNoMatchingDevice) {
+			return path, err
+		}
+		time.Sleep(interval)
+	}
+}
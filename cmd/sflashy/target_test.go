@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestParseTargetSelector verifica il parsing dei selettori --target.
+func TestParseTargetSelector(t *testing.T) {
+	cases := map[string]targetSelector{
+		"/dev/sdb":              {Kind: "path", Value: "/dev/sdb"},
+		"serial:ABC123":         {Kind: "serial", Value: "ABC123"},
+		`model:"SanDisk Ultra"`: {Kind: "model", Value: "SanDisk Ultra"},
+		"label:BOOT":            {Kind: "label", Value: "BOOT"},
+		// I nomi stabili dei dispositivi contengono ':' ma restano percorsi.
+		"/dev/disk/by-path/pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0": {Kind: "path", Value: "/dev/disk/by-path/pci-0000:00:14.0-usb-0:1:1.0-scsi-0:0:0:0"},
+		"/dev/disk/by-id/usb-Generic_STORAGE_DEVICE_000000000819-0:0": {Kind: "path", Value: "/dev/disk/by-id/usb-Generic_STORAGE_DEVICE_000000000819-0:0"},
+		"uuid:1234": {Kind: "path", Value: "uuid:1234"},
+	}
+	for in, want := range cases {
+		got, err := parseTargetSelector(in)
+		if err != nil {
+			t.Errorf("parseTargetSelector(%q) ha restituito un errore: %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseTargetSelector(%q) = %+v, want %+v", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"serial:", "label:"} {
+		if _, err := parseTargetSelector(in); err == nil {
+			t.Errorf("parseTargetSelector(%q) avrebbe dovuto restituire un errore", in)
+		}
+	}
+}
+
+// TestResolveTarget verifica la risoluzione dei selettori sui dispositivi enumerati.
+func TestResolveTarget(t *testing.T) {
+	devices := []deviceInfo{
+		{Path: "/dev/sdb", Serial: "ABC123", Model: "SanDisk Ultra", Partitions: []partitionInfo{{Label: "BOOT"}}},
+		{Path: "/dev/sdc", Serial: "XYZ789", Model: "SanDisk Ultra"},
+	}
+
+	dev, err := resolveTarget(targetSelector{Kind: "serial", Value: "XYZ789"}, devices)
+	if err != nil || dev.Path != "/dev/sdc" {
+		t.Errorf("serial: Got: %q (%v), Want: /dev/sdc", dev.Path, err)
+	}
+
+	dev, err = resolveTarget(targetSelector{Kind: "label", Value: "BOOT"}, devices)
+	if err != nil || dev.Path != "/dev/sdb" {
+		t.Errorf("label: Got: %q (%v), Want: /dev/sdb", dev.Path, err)
+	}
+
+	if _, err := resolveTarget(targetSelector{Kind: "model", Value: "sandisk ultra"}, devices); err == nil {
+		t.Error("Un selettore ambiguo dovrebbe restituire un errore")
+	}
+	if _, err := resolveTarget(targetSelector{Kind: "serial", Value: "NOPE"}, devices); err == nil {
+		t.Error("Un selettore senza corrispondenze dovrebbe restituire un errore")
+	}
+}
+
+// TestWaitFor verifica che waitFor continui a interrogare finché il dispositivo non compare.
+func TestWaitFor(t *testing.T) {
+	calls := 0
+	probe := func() (string, error) {
+		calls++
+		if calls < 3 {
+			return "", errNoMatchingDevice
+		}
+		return "/dev/sdb", nil
+	}
+
+	path, err := waitFor(probe, time.Millisecond)
+	if err != nil || path != "/dev/sdb" {
+		t.Errorf("waitFor = %q, %v; want /dev/sdb", path, err)
+	}
+	if calls != 3 {
+		t.Errorf("Numero di tentativi errato. Got: %d, Want: 3", calls)
+	}
+
+	boom := errors.New("boom")
+	if _, err := waitFor(func() (string, error) { return "", boom }, time.Millisecond); !errors.Is(err, boom) {
+		t.Errorf("waitFor dovrebbe propagare gli errori non legati all'assenza del dispositivo. Got: %v", err)
+	}
+}
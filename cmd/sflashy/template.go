@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// templateVars are the values of the device being customized that the
+// files of --copy-template and --hostname can use as Go templates, e.g.
+// kiosk-{{printf "%02d" .Index}}.
+type templateVars struct {
+	// Serial is the serial number of the device, empty if unknown.
+	Serial string
+	// Index is the position of the device in the batch, from
+	// --index-start: watch numbers the devices in the order they are
+	// flashed successfully.
+	Index int
+	// Hostname is the hostname of the row of the device in
+	// --device-settings, the one given with --hostname, or that of the
+	// image.
+	Hostname string
+}
+
+// batchTarget is a device being flashed, as templateVars need it.
+type batchTarget struct {
+	device string
+	index  int
+}
+
+// batchTargets are the devices being flashed, by location, since the
+// customization steps only get the location of theirs.
+type batchTargets struct {
+	mu      sync.Mutex
+	targets map[string]batchTarget
+}
+
+// batch holds the devices of the running flashes.
+var batch = &batchTargets{}
+
+// add records device, written through location, as the device index of
+// the batch; the returned function forgets it.
+func (b *batchTargets) add(location, device string, index int) (remove func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.targets == nil {
+		b.targets = make(map[string]batchTarget)
+	}
+	b.targets[location] = batchTarget{device: device, index: index}
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.targets, location)
+	}
+}
+
+// serial returns the serial number of the device of d, empty if unknown.
+func (b *batchTargets) serial(d *flasher.Disk) (string, error) {
+	b.mu.Lock()
+	t, ok := b.targets[d.Device]
+	b.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("%s is not a device being flashed", d.Device)
+	}
+	if dev := lookupDeviceInfo(t.device); dev != nil {
+		return firstNonEmpty(dev.Serial), nil
+	}
+	return "", nil
+}
+
+// vars returns the templateVars of the device of d. The hostname is that
+// of its row of settings, or the one rendered from the --hostname
+// template, if any.
+func (b *batchTargets) vars(d *flasher.Disk, hostname *template.Template, settings deviceSettings) (templateVars, error) {
+	serial, err := b.serial(d)
+	if err != nil {
+		return templateVars{}, err
+	}
+	b.mu.Lock()
+	v := templateVars{Serial: serial, Index: b.targets[d.Device].index}
+	b.mu.Unlock()
+	if row, ok := settings.lookup(serial); ok && row.Hostname != "" {
+		v.Hostname = row.Hostname
+	} else if hostname != nil {
+		name, err := renderTemplate(hostname, v)
+		if err != nil {
+			return templateVars{}, err
+		}
+		v.Hostname = string(name)
+	} else if _, root, err := d.FindFile("/etc/hostname"); err == nil {
+		name, _ := root.ReadFile("/etc/hostname")
+		v.Hostname = strings.TrimSpace(string(name))
+	}
+	return v, nil
+}
+
+// parseTemplate parses text, the template of the flag name, and checks
+// that it only uses the fields of templateVars.
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, usageError("invalid template: %v", err)
+	}
+	// I campi sconosciuti emergono solo all'esecuzione.
+	if err := t.Execute(io.Discard, templateVars{}); err != nil {
+		return nil, usageError("invalid template: %v", err)
+	}
+	return t, nil
+}
+
+// renderTemplate executes t with the values v.
+func renderTemplate(t *template.Template, v templateVars) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, v); err != nil {
+		return nil, fmt.Errorf("could not render %s: %w", t.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// templateFlags are --copy-template, which copies files to the boot
+// partition as --copy does but renders them for each device first, and
+// --index-start.
+type templateFlags struct {
+	files bootFiles
+	start int
+}
+
+// addTemplateFlags registers the template flags on fs.
+func addTemplateFlags(fs *flag.FlagSet) *templateFlags {
+	f := &templateFlags{files: bootFiles{}}
+	fs.Func("copy-template", "copy a file to the boot partition, rendering {{.Serial}}, {{.Index}} and {{.Hostname}} for each device, <file>:/<path> (repeatable)", f.files.add)
+	fs.IntVar(&f.start, "index-start", 1, "{{.Index}} of the first device flashed")
+	return f
+}
+
+// steps returns the customization step that renders the templates to the
+// boot partition, if any, with the --hostname template hostname and the
+// rows of --device-settings. The templates are read and parsed now, so
+// that an error in one is reported before the flash.
+func (f *templateFlags) steps(hostname string, settings deviceSettings) ([]flasher.Step, error) {
+	if len(f.files) == 0 {
+		return nil, nil
+	}
+	var host *template.Template
+	if hostname != "" {
+		var err error
+		if host, err = parseTemplate("--hostname", hostname); err != nil {
+			return nil, err
+		}
+	}
+	templates := make(map[string]*template.Template, len(f.files))
+	for dst, src := range f.files {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the template: %w", err)
+		}
+		if templates[dst], err = parseTemplate(src, string(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", src, err)
+		}
+	}
+	step := flasher.StepFunc(fmt.Sprintf("render %d templates to the boot partition", len(templates)), func(ctx context.Context, d *flasher.Disk) error {
+		v, err := batch.vars(d, host, settings)
+		if err != nil {
+			return err
+		}
+		logger.Info("rendering templates", "device", d.Device, "serial", v.Serial, "index", v.Index, "hostname", v.Hostname)
+		files := make(map[string][]byte, len(templates))
+		for dst, t := range templates {
+			if files[dst], err = renderTemplate(t, v); err != nil {
+				return err
+			}
+		}
+		p, _, err := d.BootPartition()
+		if err != nil {
+			return err
+		}
+		return flasher.WriteFiles{Partition: p.Number, Files: files}.Apply(ctx, d)
+	})
+	return []flasher.Step{step}, nil
+}
+
+// hostnameStep returns the step that sets the hostname rendered from the
+// --hostname template for each device.
+func hostnameStep(hostname string) (flasher.Step, error) {
+	t, err := parseTemplate("--hostname", hostname)
+	if err != nil {
+		return nil, err
+	}
+	// Un nome d'esempio scopre subito i modelli che non producono un
+	// hostname valido.
+	sample, err := renderTemplate(t, templateVars{Serial: "0123456789", Index: 1})
+	if err != nil {
+		return nil, usageError("%v", err)
+	}
+	if err := (flasher.SetHostname{Hostname: string(sample)}).Validate(); err != nil {
+		return nil, usageError("the --hostname template renders an %v", err)
+	}
+	return flasher.StepFunc("set the hostname from "+hostname, func(ctx context.Context, d *flasher.Disk) error {
+		v, err := batch.vars(d, t, nil)
+		if err != nil {
+			return err
+		}
+		return flasher.SetHostname{Hostname: v.Hostname}.Apply(ctx, d)
+	}), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// sizedDestination è un file normale con la capacità di un dispositivo.
+type sizedDestination struct {
+	flasher.Destination
+	size int64
+}
+
+func (d sizedDestination) Size() int64 { return d.size }
+
+// TestTemplateFlags verifica che --copy-template scriva nella partizione
+// di boot i file con i valori del dispositivo.
+func TestTemplateFlags(t *testing.T) {
+	dir := t.TempDir()
+	userData := filepath.Join(dir, "user-data")
+	os.WriteFile(userData, []byte("#cloud-config\nhostname: {{.Hostname}}\n# {{.Index}} {{.Serial}}\n"), 0o644)
+
+	fs := flag.NewFlagSet("flash", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := addTemplateFlags(fs)
+	if err := fs.Parse([]string{"--copy-template", userData + ":/", "--index-start", "7"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.start != 7 || f.files["/user-data"] != userData {
+		t.Errorf("Opzioni errate. Got: %+v", f)
+	}
+	steps, err := f.steps(`kiosk-{{printf "%02d" .Index}}`, nil)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("Un passo per tutti i modelli. Got: %v, %v", steps, err)
+	}
+
+	image := filepath.Join(dir, "sd.img")
+	d, err := diskfs.Create(image, 16<<20, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Fat32LBA, Start: 2048, Size: 30000},
+	}}
+	if err := d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32}); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	file, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sd, err := flasher.NewDisk(image, sizedDestination{flasher.NewFileDestination(file), 16 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.Apply(context.Background(), steps...); err == nil {
+		t.Error("Un dispositivo che non si sta scrivendo dovrebbe essere rifiutato")
+	}
+	defer batch.add(image, image, 7)()
+	if err := sd.Apply(context.Background(), steps...); err != nil {
+		t.Fatalf("Il passo ha restituito un errore: %v", err)
+	}
+	boot, err := sd.Filesystem(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := boot.ReadFile("/user-data")
+	if want := "#cloud-config\nhostname: kiosk-07\n# 7 \n"; string(got) != want {
+		t.Errorf("Modello non compilato. Got: %q, Want: %q", got, want)
+	}
+
+	if _, err := (&templateFlags{files: bootFiles{"/x": filepath.Join(dir, "manca")}}).steps("", nil); err == nil {
+		t.Error("Un modello mancante va segnalato prima del flash")
+	}
+	for _, bad := range []string{"{{.Nome}}", "{{.Index"} {
+		os.WriteFile(userData, []byte(bad), 0o644)
+		if _, err := f.steps("", nil); !errors.Is(err, errUsage) {
+			t.Errorf("Il modello %q dovrebbe essere un errore d'uso. Got: %v", bad, err)
+		}
+	}
+}
+
+// TestHostnameTemplate verifica --hostname con un modello.
+func TestHostnameTemplate(t *testing.T) {
+	steps, err := setupFlags{Hostname: "kiosk-{{.Index}}"}.steps()
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("Modello valido rifiutato: %v", err)
+	}
+	for _, bad := range []string{"kiosk_{{.Index}}", "kiosk-{{.Numero}}"} {
+		if _, err := (setupFlags{Hostname: bad}).steps(); !errors.Is(err, errUsage) {
+			t.Errorf("--hostname %s dovrebbe essere un errore d'uso. Got: %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ANSI escape sequences used to color the terminal output, by role. They
+// are set from the selected theme by applyTheme.
+var (
+	ColorError    = "\033[31m"
+	ColorWarning  = "\033[33m"
+	ColorSuccess  = "\033[32m"
+	ColorProgress = "\033[33m"
+	ColorReset    = "\033[0m"
+)
+
+// theme maps each output role to the SGR parameters of its color
+// (the part between "\033[" and "m").
+type theme struct {
+	Error, Warning, Success, Progress string
+}
+
+// themes are the built-in palettes selectable with `theme:` in the config.
+var themes = map[string]theme{
+	"default":       {Error: "31", Warning: "33", Success: "32", Progress: "33"},
+	"high-contrast": {Error: "1;97;41", Warning: "1;30;103", Success: "1;97;42", Progress: "1;96"},
+	// Okabe-Ito inspired: vermillion/orange/blue instead of red/green.
+	"colorblind": {Error: "38;5;166", Warning: "38;5;214", Success: "38;5;32", Progress: "38;5;38"},
+	"none":       {},
+}
+
+// colorNames are the color names accepted in the `colors:` config section.
+var colorNames = map[string]string{
+	"black": "30", "red": "31", "green": "32", "yellow": "33",
+	"blue": "34", "magenta": "35", "cyan": "36", "white": "37",
+	"bright-red": "91", "bright-green": "92", "bright-yellow": "93",
+	"bright-blue": "94", "bright-magenta": "95", "bright-cyan": "96",
+	"bold": "1", "none": "",
+}
+
+var sgrParams = regexp.MustCompile(`^[0-9]+(;[0-9]+)*$`)
+
+// sgr returns the escape sequence for the given SGR parameters.
+func sgr(params string) string {
+	if params == "" {
+		return ""
+	}
+	return "\033[" + params + "m"
+}
+
+// parseColor accepts a color name ("bright-red") or raw SGR parameters ("1;35").
+func parseColor(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if params, ok := colorNames[s]; ok {
+		return params, nil
+	}
+	if sgrParams.MatchString(s) {
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid color %q", s)
+}
+
+// applyTheme selects the palette named by name (empty for the default)
+// and applies the per-role overrides (error, warning, success, progress).
+// With noColor set all colors are disabled.
+func applyTheme(name string, overrides map[string]string, noColor bool) error {
+	if name == "" {
+		name = "default"
+	}
+	t, ok := themes[name]
+	if !ok {
+		names := make([]string, 0, len(themes))
+		for n := range themes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown theme %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	for role, value := range overrides {
+		params, err := parseColor(value)
+		if err != nil {
+			return fmt.Errorf("color for %q: %w", role, err)
+		}
+		switch role {
+		case "error":
+			t.Error = params
+		case "warning":
+			t.Warning = params
+		case "success":
+			t.Success = params
+		case "progress":
+			t.Progress = params
+		default:
+			return fmt.Errorf("unknown color role %q (expected error, warning, success or progress)", role)
+		}
+	}
+	if noColor {
+		t = themes["none"]
+	}
+
+	ColorError, ColorWarning = sgr(t.Error), sgr(t.Warning)
+	ColorSuccess, ColorProgress = sgr(t.Success), sgr(t.Progress)
+	ColorReset = "\033[0m"
+	if t == (theme{}) {
+		ColorReset = ""
+	}
+	return nil
+}
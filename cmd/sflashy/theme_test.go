@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestApplyTheme verifica la selezione dei temi e gli override per ruolo.
+func TestApplyTheme(t *testing.T) {
+	defer applyTheme("", nil, false)
+
+	if err := applyTheme("colorblind", map[string]string{"error": "bright-magenta", "success": "1;34"}, false); err != nil {
+		t.Fatalf("applyTheme ha restituito un errore: %v", err)
+	}
+	if ColorError != "\033[95m" || ColorSuccess != "\033[1;34m" || ColorProgress != "\033[38;5;38m" {
+		t.Errorf("Colori inattesi: %q %q %q", ColorError, ColorSuccess, ColorProgress)
+	}
+
+	if err := applyTheme("high-contrast", nil, true); err != nil {
+		t.Fatalf("applyTheme ha restituito un errore: %v", err)
+	}
+	if ColorError != "" || ColorReset != "" {
+		t.Errorf("Con NO_COLOR non deve essere emesso alcun colore: %q %q", ColorError, ColorReset)
+	}
+
+	for _, bad := range []struct {
+		name      string
+		overrides map[string]string
+	}{
+		{"sgargiante", nil},
+		{"default", map[string]string{"error": "rosso"}},
+		{"default", map[string]string{"title": "red"}},
+	} {
+		if err := applyTheme(bad.name, bad.overrides, false); err == nil {
+			t.Errorf("applyTheme(%q, %v) avrebbe dovuto restituire un errore", bad.name, bad.overrides)
+		}
+	}
+}
+
+// TestLoadConfig verifica la lettura del file di configurazione.
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("theme: colorblind\ncolors:\n  error: bright-red\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig ha restituito un errore: %v", err)
+	}
+	if cfg.Theme != "colorblind" || cfg.Colors["error"] != "bright-red" {
+		t.Errorf("Configurazione inattesa: %+v", cfg)
+	}
+
+	if cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || cfg.Theme != "" {
+		t.Errorf("Un file mancante deve dare la configurazione vuota. Got: %+v, %v", cfg, err)
+	}
+}
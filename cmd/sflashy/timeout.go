@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// timeoutGrace is how long a flash may overrun --timeout, stuck in a
+// write or a sync that cannot be interrupted, before it is given up.
+const timeoutGrace = 30 * time.Second
+
+// watchdog gives up on a flash that is still running timeoutGrace after
+// --timeout has elapsed: a hung USB bridge can block a write or a sync
+// forever, beyond the reach of the checks between blocks.
+type watchdog struct {
+	cancel  context.CancelCauseFunc
+	expired chan struct{}
+	err     error
+	timer   *time.Timer
+}
+
+// newWatchdog returns a watchdog that, once started, cancels the flash
+// with cancel.
+func newWatchdog(cancel context.CancelCauseFunc) *watchdog {
+	return &watchdog{cancel: cancel, expired: make(chan struct{})}
+}
+
+// start arms w for the flash of device, if there is a timeout.
+func (w *watchdog) start(device string, timeout time.Duration) {
+	if timeout > 0 {
+		w.arm(device, timeout+timeoutGrace)
+	}
+}
+
+// arm cancels the flash of device with errTimeout after d.
+func (w *watchdog) arm(device string, d time.Duration) {
+	w.timer = time.AfterFunc(d, func() {
+		w.err = fmt.Errorf("%w: %s is not responding, giving up", errTimeout, device)
+		logger.Error("flash stuck past the timeout, giving up", "device", device)
+		w.cancel(w.err)
+		close(w.expired)
+	})
+}
+
+// stop disarms w.
+func (w *watchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// untilExpired returns what run returns, or the timeout error if w
+// expires first: run is then left blocked on the device, and the caller
+// returns so that the process exits with the timeout code.
+func untilExpired[T any](w *watchdog, run func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := run()
+		done <- result{v, err}
+	}()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-w.expired:
+		var zero T
+		return zero, w.err
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestWatchdog verifica che il watchdog annulli la scrittura e la
+// abbandoni se resta bloccata, e che non intervenga se finisce in tempo.
+func TestWatchdog(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	w := newWatchdog(cancel)
+	w.arm("/dev/sdb", 10*time.Millisecond)
+	stuck := make(chan struct{})
+	defer close(stuck)
+	_, err := untilExpired(w, func() (int, error) {
+		<-stuck
+		return 0, nil
+	})
+	if !errors.Is(err, errTimeout) || exitCode(err) != exitTimeout {
+		t.Errorf("Atteso il timeout. Got: %v", err)
+	}
+	if !errors.Is(context.Cause(ctx), errTimeout) {
+		t.Errorf("La scrittura va annullata. Got: %v", context.Cause(ctx))
+	}
+
+	w = newWatchdog(func(error) { t.Error("Il watchdog non deve intervenire") })
+	w.start("/dev/sdb", time.Hour)
+	n, err := untilExpired(w, func() (int, error) { return 42, nil })
+	w.stop()
+	if n != 42 || err != nil {
+		t.Errorf("Risultato errato. Got: %d, %v", n, err)
+	}
+}
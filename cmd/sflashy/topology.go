@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+// groupSlots hands out up to total slots, and at most perGroup of them to
+// the jobs of the same group (no limit if perGroup is 0), e.g. the devices
+// behind one USB controller, which are slower all together than one after
+// the other.
+type groupSlots struct {
+	mu              sync.Mutex
+	cond            *sync.Cond
+	total, perGroup int
+	used            int
+	groups          map[string]int
+}
+
+// newGroupSlots returns total slots, perGroup for each group.
+func newGroupSlots(total, perGroup int) *groupSlots {
+	s := &groupSlots{total: max(total, 1), perGroup: perGroup, groups: map[string]int{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// fits reports whether a job of group can take a slot; s.mu is held. The
+// jobs without a group only count towards total.
+func (s *groupSlots) fits(group string) bool {
+	return s.used < s.total && (s.perGroup <= 0 || group == "" || s.groups[group] < s.perGroup)
+}
+
+// next waits until one of the pending jobs, whose groups are in groups,
+// can take a slot, takes it and returns its position in pending: the first
+// job that fits, so that the jobs start in order unless their group is
+// full.
+func (s *groupSlots) next(pending []int, groups []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for k, i := range pending {
+			if s.fits(groups[i]) {
+				s.used++
+				s.groups[groups[i]]++
+				return k
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+// release gives back the slot of a job of group.
+func (s *groupSlots) release(group string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.groups[group]--
+	s.cond.Broadcast()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// usbRootHub matches the root hub of a USB bus in a sysfs path: usb1, usb2...
+var usbRootHub = regexp.MustCompile(`^usb\d+$`)
+
+// usbController returns the USB controller of device, e.g.
+// "usb2 (0000:00:14.0)", or "" if it is not on USB.
+func usbController(device string) string {
+	if resolved, err := filepath.EvalSymlinks(device); err == nil {
+		device = resolved
+	}
+	return sysfsController(filepath.Join("/sys/block", filepath.Base(device)))
+}
+
+// sysfsController returns the USB controller of the disk at sys from the
+// path of its device in sysfs: the bus of its root hub, and the PCI
+// device of the controller.
+func sysfsController(sys string) string {
+	path, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if usbRootHub.MatchString(part) && i > 0 {
+			return part + " (" + parts[i-1] + ")"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSysfsController verifica il controller USB ricavato da sysfs.
+func TestSysfsController(t *testing.T) {
+	root := t.TempDir()
+	for name, dir := range map[string]string{
+		"sdb":     "devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1.3/2-1.3:1.0/host6/target6:0:0/6:0:0:0/block/sdb",
+		"sdc":     "devices/pci0000:00/0000:00:14.0/usb2/2-2/2-2:1.0/host7/target7:0:0/7:0:0:0/block/sdc",
+		"sda":     "devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda",
+		"mmcblk0": "devices/platform/fe340000.mmc/mmc_host/mmc0/mmc0:0001/block/mmcblk0",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(root, dir), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"sdb": "usb2 (0000:00:14.0)", "sdc": "usb2 (0000:00:14.0)", "sda": "", "mmcblk0": "", "sdz": ""} {
+		if got := sysfsController(filepath.Join(root, name)); got != want {
+			t.Errorf("Controller di %s errato. Got: %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// usbController returns the USB controller of device: the topology is only
+// read from the sysfs of Linux.
+func usbController(device string) string {
+	return ""
+}
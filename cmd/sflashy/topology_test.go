@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestGroupSlots verifica i posti per gruppo: un job del gruppo pieno
+// lascia partire quelli degli altri gruppi.
+func TestGroupSlots(t *testing.T) {
+	s := newGroupSlots(3, 1)
+	groups := []string{"usb1", "usb1", "usb2", "", ""}
+	if k := s.next([]int{0, 1, 2, 3, 4}, groups); k != 0 {
+		t.Errorf("Il primo job parte per primo. Got: %d", k)
+	}
+	if k := s.next([]int{1, 2, 3, 4}, groups); k != 1 {
+		t.Errorf("Con usb1 pieno parte il job di usb2. Got: %d", k)
+	}
+	if k := s.next([]int{1, 3, 4}, groups); k != 1 {
+		t.Errorf("Un job senza gruppo conta solo nel totale. Got: %d", k)
+	}
+
+	// Tutti i posti sono occupati: si attende un rilascio.
+	started := make(chan int)
+	go func() { started <- s.next([]int{1, 4}, groups) }()
+	select {
+	case k := <-started:
+		t.Fatalf("Nessun posto libero, ma è partito %d", k)
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.release("usb2")
+	if k := <-started; k != 1 {
+		t.Errorf("Liberato un posto di usb2, parte il job senza gruppo. Got: %d", k)
+	}
+	s.release("usb1")
+	if k := s.next([]int{1}, groups); k != 0 {
+		t.Errorf("Liberato usb1, parte il suo secondo job. Got: %d", k)
+	}
+}
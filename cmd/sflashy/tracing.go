@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// tracer records the flashes as spans; it is replaced by setupTracing
+// when tracing is enabled.
+var tracer flasher.Tracer = nopTracer{}
+
+// shutdownTracing exports the spans still buffered. fatal calls it before
+// exiting.
+var shutdownTracing = func() {}
+
+// tracingEnabled reports whether the spans are exported: when the
+// configuration asks for it or an OTLP endpoint is set in the environment.
+func tracingEnabled(configured bool) bool {
+	return configured || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing exports the spans with OTLP over HTTP, configured through
+// the standard OTEL_EXPORTER_OTLP_* environment variables.
+func setupTracing() error {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not set up tracing: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "sflashy"),
+		attribute.String("service.version", currentBuildInfo().Version),
+	))
+	if err != nil {
+		return fmt.Errorf("could not set up tracing: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	tracer = otelTracer{provider.Tracer("github.com/SoundFoodPhygital/sflashy")}
+	shutdownTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logger.Warn("could not export the traces", "err", err)
+		}
+	}
+	return nil
+}
+
+// otelTracer adapts an OpenTelemetry tracer to flasher.Tracer.
+type otelTracer struct {
+	t trace.Tracer
+}
+
+func (o otelTracer) Start(ctx context.Context, name string) (context.Context, flasher.Span) {
+	ctx, span := o.t.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+// otelSpan adapts an OpenTelemetry span to flasher.Span.
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value any) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case float64:
+		s.span.SetAttributes(attribute.Float64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// nopTracer discards the spans.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string) (context.Context, flasher.Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) End(error)                {}
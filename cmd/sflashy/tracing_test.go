@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestOtelTracer verifica la conversione di span e attributi verso
+// OpenTelemetry.
+func TestOtelTracer(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tr := otelTracer{provider.Tracer("test")}
+
+	ctx, parent := tr.Start(context.Background(), "flash")
+	_, child := tr.Start(ctx, "write")
+	child.SetAttribute("sflashy.bytes", int64(42))
+	child.SetAttribute("sflashy.throughput", 1.5)
+	child.End(errors.New("scrittura fallita"))
+	parent.End(nil)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Attesi 2 span. Got: %d", len(spans))
+	}
+	write := spans[0]
+	if write.Name() != "write" || write.Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("Span figlio errato: %s", write.Name())
+	}
+	if write.Status().Code != codes.Error || len(write.Attributes()) != 2 || write.Attributes()[0].Value.AsInt64() != 42 {
+		t.Errorf("Stato o attributi errati: %v, %v", write.Status(), write.Attributes())
+	}
+	if spans[1].Status().Code == codes.Error {
+		t.Error("Lo span senza errore non dovrebbe fallire")
+	}
+}
+
+// TestTracingEnabled verifica l'attivazione del tracing.
+func TestTracingEnabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tracingEnabled(false) || !tracingEnabled(true) {
+		t.Error("Senza endpoint il tracing dipende solo dalla configurazione")
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	if !tracingEnabled(false) {
+		t.Error("Un endpoint OTLP dovrebbe attivare il tracing")
+	}
+}
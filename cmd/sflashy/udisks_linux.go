@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	udisksName    = "org.freedesktop.UDisks2"
+	udisksManager = dbus.ObjectPath("/org/freedesktop/UDisks2/Manager")
+	udisksBlock   = "org.freedesktop.UDisks2.Block"
+)
+
+func init() {
+	flasher.RegisterDestination("udisks2", openUDisks)
+}
+
+// udisksAvailable checks that UDisks2 answers on the system bus, starting
+// it if it is activatable.
+func udisksAvailable() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Object(udisksName, udisksManager).Call("org.freedesktop.DBus.Peer.Ping", 0).Err
+}
+
+// openUDisks opens the device of a udisks2:// location read-write through
+// the OpenDevice method of UDisks2, which checks with polkit that the user
+// may write it (asking for a password through the polkit agent of the
+// session if needed) and returns the open descriptor. Closing the
+// Destination asks UDisks2 to rescan the device, so that the new
+// partitions show up.
+func openUDisks(location string) (flasher.Destination, error) {
+	path := strings.TrimPrefix(location, "udisks2://")
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the system bus: %w", err)
+	}
+	var objects []dbus.ObjectPath
+	err = conn.Object(udisksName, udisksManager).Call(udisksName+".Manager.ResolveDevice", 0,
+		map[string]dbus.Variant{"path": dbus.MakeVariant(path)}, map[string]dbus.Variant{}).Store(&objects)
+	if err == nil && len(objects) == 0 {
+		err = errors.New("unknown device")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("UDisks2 could not find %s: %w", path, err)
+	}
+	block := conn.Object(udisksName, objects[0])
+	var fd dbus.UnixFD
+	err = block.Call(udisksBlock+".OpenDevice", 0, "rw",
+		map[string]dbus.Variant{"flags": dbus.MakeVariant(int32(syscall.O_EXCL))}).Store(&fd)
+	if err != nil {
+		conn.Close()
+		var derr dbus.Error
+		errors.As(err, &derr)
+		switch {
+		case strings.Contains(derr.Name, ".NotAuthorized"):
+			return nil, fmt.Errorf("%w: UDisks2 refused to open %s: %v", errPermission, path, err)
+		case strings.HasSuffix(derr.Name, ".DeviceBusy"):
+			return nil, fmt.Errorf("%w: %s is in use: %v", flasher.ErrDeviceBusy, path, err)
+		}
+		return nil, fmt.Errorf("UDisks2 could not open %s: %w", path, err)
+	}
+	return &udisksDestination{
+		Destination: flasher.NewFileDestination(os.NewFile(uintptr(fd), path)),
+		conn:        conn,
+		block:       block,
+	}, nil
+}
+
+// udisksDestination is a device opened through UDisks2.
+type udisksDestination struct {
+	flasher.Destination
+	conn  *dbus.Conn
+	block dbus.BusObject
+}
+
+// DropCache discards the cached pages of the device before the
+// verification.
+func (d *udisksDestination) DropCache() {
+	if dc, ok := d.Destination.(interface{ DropCache() }); ok {
+		dc.DropCache()
+	}
+}
+
+func (d *udisksDestination) Close() error {
+	err := d.Destination.Close()
+	if rerr := d.block.Call(udisksBlock+".Rescan", 0, map[string]dbus.Variant{}).Err; rerr != nil {
+		logger.Debug("UDisks2 rescan failed", "err", rerr)
+	}
+	d.conn.Close()
+	return err
+}
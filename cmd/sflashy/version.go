@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.date=2025-06-19T10:00:00Z"
+//
+// When they are not set, they are filled from the module build info.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo describes the running binary.
+type buildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+	Platform  string
+}
+
+// currentBuildInfo combines the ldflags metadata with debug.ReadBuildInfo.
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && info.Commit != "":
+				info.Commit += "-dirty"
+			}
+		}
+	}
+
+	for _, field := range []*string{&info.Version, &info.Commit, &info.Date} {
+		if *field == "" {
+			*field = "unknown"
+		}
+	}
+	if info.Version == "(devel)" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// writeVersion prints the build metadata, one field per line.
+func writeVersion(w io.Writer, info buildInfo) {
+	fmt.Fprintf(w, "sflashy %s\n", info.Version)
+	fmt.Fprintf(w, "  commit:     %s\n", info.Commit)
+	fmt.Fprintf(w, "  built:      %s\n", info.Date)
+	fmt.Fprintf(w, "  go version: %s\n", info.GoVersion)
+	fmt.Fprintf(w, "  platform:   %s\n", info.Platform)
+}
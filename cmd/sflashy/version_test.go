@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCurrentBuildInfo verifica che i metadati impostati via ldflags abbiano la precedenza.
+func TestCurrentBuildInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "v1.2.3", "abc1234", "2025-06-19T10:00:00Z"
+
+	info := currentBuildInfo()
+	if info.Version != "v1.2.3" || info.Commit != "abc1234" || info.Date != "2025-06-19T10:00:00Z" {
+		t.Errorf("Metadati inattesi: %+v", info)
+	}
+	if !strings.HasPrefix(info.GoVersion, "go") {
+		t.Errorf("Versione di Go inattesa: %q", info.GoVersion)
+	}
+
+	var out strings.Builder
+	writeVersion(&out, info)
+	for _, want := range []string{"sflashy v1.2.3", "commit:     abc1234", "go version: go"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("L'output non contiene %q. Got: %q", want, out.String())
+		}
+	}
+}
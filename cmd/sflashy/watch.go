@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// settleDelay gives udev time to create the device node and to probe the
+// partition table of a freshly inserted device before it is inspected.
+const settleDelay = 2 * time.Second
+
+// deviceWatcher reports the paths of newly added whole-disk block devices.
+type deviceWatcher interface {
+	Next() (string, error)
+	Close() error
+}
+
+// pollWatcher detects new devices by periodically enumerating them. It is
+// used where kernel uevents are not available.
+type pollWatcher struct {
+	known   map[string]bool
+	pending []string
+}
+
+func newPollWatcher() (*pollWatcher, error) {
+	devices, err := collectDevices()
+	if err != nil {
+		return nil, err
+	}
+	w := &pollWatcher{known: map[string]bool{}}
+	for _, dev := range devices {
+		w.known[dev.Path] = true
+	}
+	return w, nil
+}
+
+func (w *pollWatcher) Next() (string, error) {
+	for len(w.pending) == 0 {
+		time.Sleep(waitInterval)
+		devices, err := collectDevices()
+		if err != nil {
+			return "", err
+		}
+		present := map[string]bool{}
+		for _, dev := range devices {
+			present[dev.Path] = true
+			if !w.known[dev.Path] {
+				w.pending = append(w.pending, dev.Path)
+			}
+		}
+		// Forget removed devices so that re-inserting them is noticed.
+		w.known = present
+	}
+
+	path := w.pending[0]
+	w.pending = w.pending[1:]
+	return path, nil
+}
+
+func (w *pollWatcher) Close() error { return nil }
+
+// parseUevent parses a kernel uevent message ("add@/devices/...\0KEY=value\0...")
+// into its key/value environment.
+func parseUevent(msg []byte) map[string]string {
+	env := map[string]string{}
+	for i, field := range bytes.Split(msg, []byte{0}) {
+		if i == 0 {
+			continue // header: action@devpath
+		}
+		if k, v, ok := bytes.Cut(field, []byte("=")); ok {
+			env[string(k)] = string(v)
+		}
+	}
+	return env
+}
+
+// addedDisk returns the device path announced by a uevent, if the event
+// is the addition of a whole disk.
+func addedDisk(env map[string]string) (string, bool) {
+	if env["ACTION"] != "add" || env["SUBSYSTEM"] != "block" || env["DEVTYPE"] != "disk" || env["DEVNAME"] == "" {
+		return "", false
+	}
+	return "/dev/" + env["DEVNAME"], true
+}
+
+// lookupDevice returns the enumerated metadata of the device at path,
+// waiting for it to settle first.
+func lookupDevice(path string) (deviceInfo, error) {
+	if _, err := waitForPath(path, settleDelay); err != nil {
+		return deviceInfo{}, err
+	}
+	time.Sleep(settleDelay)
+
+	devices, err := collectDevices()
+	if err != nil {
+		return deviceInfo{}, err
+	}
+	return resolveTarget(targetSelector{Kind: "path", Value: path}, devices)
+}
+
+// waitForPath waits up to timeout for a device node to appear.
+func waitForPath(path string, timeout time.Duration) (os.FileInfo, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := os.Stat(path)
+		if err == nil || time.Now().After(deadline) {
+			return info, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// runWatch implements the `watch` subcommand: every newly inserted device
+// matching the filter is flashed with the given image.
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "flash every matching device without asking for confirmation")
+	eject := fs.Bool("eject", false, "power off / eject each device after flashing")
+	verify := fs.Bool("verify", false, "read each device back and compare it with the image")
+	jsonOut := fs.Bool("json", false, "print the result of each flash as a JSON line on stdout")
+	timeout := fs.Duration("timeout", 0, "abort a flash that takes longer than this, e.g. 20m")
+	expand := fs.Bool("expand", false, "grow the last partition of the image to the end of each device")
+	station := fs.Bool("station", false, "duplication station: flash and verify every device without asking, beep when each can be removed and count the session")
+	persistence := addPersistenceFlags(fs)
+	data := addDataPartitionFlag(fs)
+	lint := addLintFlags(fs)
+	asset := addAssetFlags(fs)
+	custom := addStepFlags(fs)
+	addLowMemoryFlag(fs)
+	addHookFlags(fs)
+	retry := addRetryFlags(fs)
+	metricsAddr := addMetricsFlag(fs)
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	var filter deviceFilter
+	minSize, maxSize := addFilterFlags(fs, &filter)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 1 {
+		return usageError("watch requires exactly one image file")
+	}
+	if *station {
+		*yes, *verify = true, true
+	}
+	filter.MinSize, filter.MaxSize = minSize.bytes, maxSize.bytes
+	// Only removable media are flashed unless explicitly asked otherwise.
+	removableSet := false
+	fs.Visit(func(f *flag.Flag) { removableSet = removableSet || f.Name == "removable" })
+	if !removableSet {
+		filter.Removable = true
+	}
+
+	retryPolicy, err := retry.policy()
+	if err != nil {
+		return err
+	}
+	steps, err := custom.steps()
+	if err != nil {
+		return err
+	}
+	persist := flashOptions{Expand: *expand}
+	if err := persistence.apply(&persist); err != nil {
+		return err
+	}
+	if err := data.apply(&persist); err != nil {
+		return err
+	}
+	if err := lint.apply(&persist); err != nil {
+		return err
+	}
+	if err := asset.apply(&persist); err != nil {
+		return err
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+	stopMQTT, err := startMQTT()
+	if err != nil {
+		return err
+	}
+	defer stopMQTT()
+	imageFile := positional[0]
+	if _, err := os.Stat(imageFile); err != nil {
+		return fmt.Errorf("image file not found: %s", imageFile)
+	}
+
+	watcher, err := newDeviceWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var running atomic.Int32
+	if *metricsAddr != "" {
+		flashMetrics = newStationMetrics(func() ([]deviceInfo, error) {
+			devices, err := collectDevices()
+			return filterDevices(devices, filter), err
+		}, func() int { return int(running.Load()) })
+		stopMetrics, err := flashMetrics.listen(*metricsAddr)
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	var session *stationSession
+	if *station {
+		session = newStationSession(os.Stderr)
+		defer session.summary()
+	}
+	input := bufio.NewReader(os.Stdin)
+	index := custom.templates.start
+	flash := func(dev deviceInfo, resume bool) error {
+		opts := flashOptions{Image: imageFile, Device: dev.Path, Yes: *yes, Eject: *eject, Verify: *verify, Expand: *expand, Persistence: persist.Persistence, PersistenceSize: persist.PersistenceSize, DataPartition: persist.DataPartition, Lint: persist.Lint, Asset: persist.Asset, Steps: steps, Timeout: *timeout, Retry: retryPolicy, Resume: resume, Index: index}
+		if *jsonOut {
+			opts.JSON = os.Stdout
+		}
+		// Il dispositivo resta registrato finché la scrittura non termina,
+		// così che dopo un riavvio venga ripresa.
+		if err := stateStore.Save(watchKey(dev.Path), watchRecord{Image: imageFile, Serial: dev.Serial, Size: dev.SizeBytes}); err != nil {
+			logger.Warn("could not record the device being flashed", "device", dev.Path, "err", err)
+		}
+		running.Add(1)
+		err := runFlash(context.Background(), opts, input, os.Stderr)
+		running.Add(-1)
+		if errors.Is(err, errInterrupted) {
+			// Un'interruzione ferma anche l'attesa dei dispositivi successivi.
+			return err
+		}
+		stateStore.Delete(watchKey(dev.Path))
+		if session != nil && !errors.Is(err, errCancelled) {
+			session.done(dev.Path, err)
+		}
+		if err != nil && !errors.Is(err, errCancelled) {
+			logger.Error("flash failed", "device", dev.Path, "err", err)
+		} else if err == nil {
+			logger.Info("device flashed", "device", dev.Path, "index", index)
+			index++
+		}
+		return nil
+	}
+
+	for _, dev := range pendingWatchDevices(imageFile) {
+		if !filter.match(dev) {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, ColorSuccess+"\nResuming interrupted device: %s (%s, %s)"+ColorReset+"\n", dev.Path, dev.Model, formatSize(dev.SizeBytes))
+		if err := flash(dev, true); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("watching for new devices (press Ctrl+C to stop)", "image", imageFile)
+	events := watchEvents(watcher)
+	for {
+		ev, ok := nextDevice(events, session != nil)
+		if !ok {
+			return nil
+		}
+		path, err := ev.path, ev.err
+		if err != nil {
+			return err
+		}
+
+		dev, err := lookupDevice(path)
+		if err != nil {
+			logger.Warn("skipping device", "device", path, "err", err)
+			continue
+		}
+		if !filter.match(dev) {
+			logger.Info("ignoring device: it does not match the filter", "device", path)
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, ColorSuccess+"\nNew device: %s (%s, %s)"+ColorReset+"\n", dev.Path, dev.Model, formatSize(dev.SizeBytes))
+		if err := flash(dev, false); err != nil {
+			return err
+		}
+		logger.Info("waiting for the next device")
+	}
+}
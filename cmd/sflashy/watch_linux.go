@@ -0,0 +1,45 @@
+package main
+
+import "syscall"
+
+// ueventWatcher listens for kernel uevents on a netlink socket.
+type ueventWatcher struct {
+	fd int
+}
+
+// newDeviceWatcher listens for kernel uevents, falling back to polling
+// when netlink sockets are not available (e.g. in some containers).
+func newDeviceWatcher() (deviceWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1})
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}
+	if err != nil {
+		logger.Warn("uevents not available, polling for devices instead", "err", err)
+		return newPollWatcher()
+	}
+	return &ueventWatcher{fd: fd}, nil
+}
+
+func (w *ueventWatcher) Next() (string, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(w.fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if path, ok := addedDisk(parseUevent(buf[:n])); ok {
+			return path, nil
+		}
+	}
+}
+
+func (w *ueventWatcher) Close() error {
+	return syscall.Close(w.fd)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// newDeviceWatcher polls the device list, since kernel uevents are Linux only.
+func newDeviceWatcher() (deviceWatcher, error) {
+	return newPollWatcher()
+}
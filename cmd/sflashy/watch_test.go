@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// TestParseUevent verifica il parsing dei messaggi uevent del kernel.
+func TestParseUevent(t *testing.T) {
+	msg := []byte("add@/devices/pci0000:00/usb1/1-1/host6/target6:0:0/6:0:0:0/block/sdb\x00" +
+		"ACTION=add\x00DEVPATH=/devices/pci0000:00/usb1/1-1/host6/target6:0:0/6:0:0:0/block/sdb\x00" +
+		"SUBSYSTEM=block\x00MAJOR=8\x00MINOR=16\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SEQNUM=4242\x00")
+
+	env := parseUevent(msg)
+	if env["DEVNAME"] != "sdb" || env["SEQNUM"] != "4242" {
+		t.Errorf("Ambiente uevent errato. Got: %v", env)
+	}
+
+	path, ok := addedDisk(env)
+	if !ok || path != "/dev/sdb" {
+		t.Errorf("addedDisk = %q, %v; want /dev/sdb, true", path, ok)
+	}
+
+	env["DEVTYPE"] = "partition"
+	if _, ok := addedDisk(env); ok {
+		t.Error("Le partizioni non devono essere considerate nuovi dischi")
+	}
+	env["DEVTYPE"], env["ACTION"] = "disk", "remove"
+	if _, ok := addedDisk(env); ok {
+		t.Error("Gli eventi di rimozione non devono essere considerati nuovi dischi")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// wipeOptions collects the settings of `sflashy wipe`.
+type wipeOptions struct {
+	Device string
+	Mode   flasher.WipeMode
+	// Passes is the number of random passes of the random mode.
+	Passes int
+	Yes    bool
+	Eject  bool
+	// Verify reads the device back after the last pass.
+	Verify    bool
+	BlockSize int
+	Timeout   time.Duration
+	JSON      io.Writer
+	PauseKey  bool
+}
+
+// runWipe runs `sflashy wipe <device>`, which erases a device with the
+// same checks and confirmation as a flash.
+func runWipe(args []string) error {
+	fs := flag.NewFlagSet("wipe", flag.ContinueOnError)
+	modes := make([]string, 0, len(flasher.WipeModes()))
+	for _, m := range flasher.WipeModes() {
+		modes = append(modes, string(m))
+	}
+	mode := fs.String("mode", string(flasher.WipeZero), "how to erase the device: "+strings.Join(modes, ", "))
+	passes := fs.Int("passes", 1, "number of passes of --mode random")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	eject := fs.Bool("eject", false, "power off / eject the device after wiping")
+	verify := fs.Bool("verify", false, "read the device back after the last pass")
+	jsonOut := fs.Bool("json", false, "print the result as JSON on stdout")
+	timeout := fs.Duration("timeout", 0, "abort the wipe if it takes longer than this, e.g. 2h")
+	var bs sizeFlag
+	fs.Var(&bs, "bs", "size of each write to the device (default 32M)")
+	logCfg := addLogFlags(fs)
+	display := addDisplayFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := display.apply(); err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(logCfg)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+	if len(positional) != 1 {
+		return usageError("wipe requires a device")
+	}
+	if !slices.Contains(modes, *mode) {
+		return usageError("unknown wipe mode %q, use one of %s", *mode, strings.Join(modes, ", "))
+	}
+	if *passes < 1 {
+		return usageError("--passes must be at least 1")
+	}
+	if err := checkRoot(); err != nil {
+		offerSudo()
+		return err
+	}
+
+	selector, err := parseTargetSelector(positional[0])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	device, err := findTarget(selector)
+	if err != nil {
+		return err
+	}
+	opts := wipeOptions{
+		Device: device, Mode: flasher.WipeMode(*mode), Passes: *passes, Yes: *yes, Eject: *eject, Verify: *verify,
+		BlockSize: int(bs.bytes), Timeout: *timeout, PauseKey: flasher.IsTerminal(os.Stdin),
+	}
+	if *jsonOut {
+		opts.JSON = os.Stdout
+	}
+	return wipeDevice(context.Background(), opts, os.Stdin, os.Stderr)
+}
+
+// wipeDevice checks the device, asks for confirmation and erases it.
+func wipeDevice(ctx context.Context, opts wipeOptions, userInput io.Reader, termOut io.Writer) (err error) {
+	summary := flashSummary{Image: "(" + string(opts.Mode) + " wipe)", Device: opts.Device, Verification: "skipped"}
+	if opts.JSON != nil {
+		defer func() { summary.writeJSON(opts.JSON, err) }()
+	}
+	if flashAudit != nil {
+		dev := lookupDeviceInfo(opts.Device)
+		defer func() { flashAudit.record("wipe", summary, dev, err) }()
+	}
+	log := logger.With("device", opts.Device, "mode", opts.Mode)
+	if err := checkBlockDevice(opts.Device); err != nil {
+		return err
+	}
+	mounts := mountedPartitions(opts.Device)
+	if len(mounts) > 0 && !autoUnmount {
+		return fmt.Errorf("%w: %s is mounted on %s, please unmount it first", errDeviceMounted, opts.Device, strings.Join(mounts, ", "))
+	}
+	if !opts.Yes {
+		writeWipeDetails(termOut, opts, lookupDeviceInfo(opts.Device))
+	}
+
+	f := newFlasher(flashOptions{Device: opts.Device, Verify: opts.Verify, BlockSize: opts.BlockSize, Timeout: opts.Timeout}, termOut)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	f.Pauser = newPauser(opts.PauseKey, termOut)
+	defer pauseOnSignal(f.Pauser)()
+	stopInterrupt, stopPause := func() {}, func() {}
+	defer func() { stopInterrupt(); stopPause() }()
+	f.Confirm = func() error {
+		if !opts.Yes && !confirmAction(userInput, termOut, "Wiping device.") {
+			fmt.Fprintln(termOut, "Operation cancelled.")
+			return errCancelled
+		}
+		if len(mounts) > 0 {
+			fmt.Fprintf(termOut, "Unmounting %s...\n", strings.Join(mounts, ", "))
+			if err := unmountDisk(opts.Device); err != nil {
+				return fmt.Errorf("%w: %v", errDeviceMounted, err)
+			}
+		}
+		if opts.PauseKey {
+			stopPause = pauseOnInput(f.Pauser, userInput)
+		}
+		stopInterrupt = cancelOnInterrupt(cancel)
+		return nil
+	}
+	defer reportOnSignal(f, termOut)()
+
+	// I comandi di cancellazione vanno al disco, senza helper o udisks.
+	location := deviceLocation(opts.Device)
+	if opts.Mode == flasher.WipeSecure {
+		location = opts.Device
+	}
+	res, err := f.Wipe(ctx, location, flasher.WipeOptions{Mode: opts.Mode, Passes: opts.Passes})
+	if res.Bytes > 0 {
+		summary.Bytes, summary.Digest, summary.Elapsed, summary.Verification = res.Bytes, res.Digest, res.Elapsed, res.Verification
+		summary.write(termOut)
+		log.Info("wipe finished", "bytes", res.Bytes, "elapsed", res.Elapsed, "verification", res.Verification)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Mode == flasher.WipeSecure {
+		fmt.Fprintln(termOut, ColorSuccess+"\nThe drive reported the end of the erase."+ColorReset)
+		log.Info("wipe finished", "elapsed", res.Elapsed)
+	}
+	if opts.Eject {
+		fmt.Fprintf(termOut, "Ejecting %s...\n", opts.Device)
+		if err := ejectDevice(opts.Device); err != nil {
+			return err
+		}
+		fmt.Fprintf(termOut, ColorSuccess+"It is now safe to remove %s."+ColorReset+"\n", opts.Device)
+	}
+	return nil
+}
+
+// writeWipeDetails shows how the device is about to be erased, like
+// writeFlashDetails does for a flash.
+func writeWipeDetails(w io.Writer, opts wipeOptions, dev *deviceInfo) {
+	fmt.Fprintln(w, ColorProgress+"\nAbout to wipe"+ColorReset)
+	mode := string(opts.Mode)
+	switch opts.Mode {
+	case flasher.WipeRandom:
+		mode += fmt.Sprintf(", %d pass(es)", opts.Passes)
+	case flasher.WipeQuick:
+		mode += ", partition tables and filesystem signatures only"
+	case flasher.WipeDiscard:
+		mode += ", every block discarded by the device"
+	case flasher.WipeSecureDiscard:
+		mode += ", every block discarded and erased by the device"
+	case flasher.WipeSecure:
+		mode += ", by the drive (ATA Security Erase, NVMe Sanitize of the whole controller)"
+	}
+	fmt.Fprintf(w, "  %-8s %s\n", "Mode:", mode)
+	writeTargetDetails(w, opts.Device, 0, dev)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/SoundFoodPhygital/sflashy/pkg/flasher"
+)
+
+// TestWriteWipeDetails verifica le informazioni mostrate prima di
+// cancellare un dispositivo.
+func TestWriteWipeDetails(t *testing.T) {
+	var out strings.Builder
+	dev := testDevices[0]
+	writeWipeDetails(&out, wipeOptions{Device: dev.Path, Mode: flasher.WipeRandom, Passes: 3}, &dev)
+	for _, want := range []string{"About to wipe", "random, 3 pass(es)", "/dev/sdb", "ABC123", "/dev/sdb1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("I dettagli non contengono %q. Got: %q", want, out.String())
+		}
+	}
+}
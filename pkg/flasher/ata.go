@@ -0,0 +1,51 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ATASecurity is what IDENTIFY DEVICE tells about the ATA Security feature
+// set of a SATA drive, which Security Erase Unit belongs to.
+type ATASecurity struct {
+	Supported bool `json:"supported"`
+	// Enabled is set while the drive has a user password.
+	Enabled bool `json:"enabled"`
+	Locked  bool `json:"locked"`
+	// Frozen drives refuse every security command until their next power
+	// cycle: many BIOSes freeze them at boot.
+	Frozen bool `json:"frozen"`
+	// EnhancedErase reports whether the drive supports the enhanced
+	// erase, which also erases the reallocated sectors.
+	EnhancedErase bool `json:"enhanced_erase"`
+	// EraseTime and EnhancedEraseTime are the durations the drive
+	// announces, 0 when it does not.
+	EraseTime         time.Duration `json:"erase_time"`
+	EnhancedEraseTime time.Duration `json:"enhanced_erase_time"`
+}
+
+// parseATASecurity reads the security words of the 512 bytes of an
+// IDENTIFY DEVICE response.
+func parseATASecurity(id []byte) ATASecurity {
+	word := func(n int) uint16 { return binary.LittleEndian.Uint16(id[2*n:]) }
+	status := word(128)
+	return ATASecurity{
+		Supported:         word(82)&0x2 != 0 && status&0x1 != 0,
+		Enabled:           status&0x2 != 0,
+		Locked:            status&0x4 != 0,
+		Frozen:            status&0x8 != 0,
+		EnhancedErase:     status&0x20 != 0,
+		EraseTime:         ataEraseTime(word(89)),
+		EnhancedEraseTime: ataEraseTime(word(90)),
+	}
+}
+
+// ataEraseTime decodes the erase time of IDENTIFY DEVICE words 89 and 90,
+// in units of 2 minutes, with 15 bits in the extended format.
+func ataEraseTime(w uint16) time.Duration {
+	n := w & 0xff
+	if w&0x8000 != 0 {
+		n = w & 0x7fff
+	}
+	return time.Duration(n) * 2 * time.Minute
+}
@@ -0,0 +1,198 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// sgIO is the SG_IO ioctl of Linux, which passes a SCSI command to a
+// device: ATA commands travel in an ATA PASS-THROUGH(16) command, which
+// libata and most USB-SATA bridges translate.
+const sgIO = 0x2285
+
+// The data directions of sgIOHdr.
+const (
+	sgDxferNone    = -1
+	sgDxferToDev   = -2
+	sgDxferFromDev = -3
+)
+
+// The ATA commands used here.
+const (
+	ataIdentifyDevice      = 0xec
+	ataSecuritySetPassword = 0xf1
+	ataSecurityErasePrep   = 0xf3
+	ataSecurityEraseUnit   = 0xf4
+)
+
+// ataPassword is the temporary user password set to erase the drive: the
+// erase removes it.
+const ataPassword = "sflashy"
+
+// sgIOHdr is struct sg_io_hdr of scsi/sg.h.
+type sgIOHdr struct {
+	interfaceID    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         uintptr
+	cmdp           uintptr
+	sbp            uintptr
+	timeout        uint32
+	flags          uint32
+	packID         int32
+	usrPtr         uintptr
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+// ataCmd sends the ATA command cmd, with feature, to the device f through
+// ATA PASS-THROUGH(16). data, if not empty, is a single 512-byte sector
+// read from the drive (in) or written to it.
+func ataCmd(f *os.File, cmd, feature uint8, data []byte, in bool, timeout time.Duration) error {
+	cdb := [16]byte{0: 0x85, 4: feature, 14: cmd}
+	direction := int32(sgDxferNone)
+	switch {
+	case len(data) == 0:
+		cdb[1] = 3 << 1 // non-data
+	case in:
+		cdb[1], cdb[2], cdb[6] = 4<<1, 0x0e, 1 // PIO data-in, un settore
+		direction = sgDxferFromDev
+	default:
+		cdb[1], cdb[2], cdb[6] = 5<<1, 0x06, 1 // PIO data-out, un settore
+		direction = sgDxferToDev
+	}
+	var sense [32]byte
+	hdr := sgIOHdr{
+		interfaceID:    'S',
+		dxferDirection: direction,
+		cmdLen:         uint8(len(cdb)),
+		mxSbLen:        uint8(len(sense)),
+		cmdp:           uintptr(unsafe.Pointer(&cdb[0])),
+		sbp:            uintptr(unsafe.Pointer(&sense[0])),
+		timeout:        uint32(timeout / time.Millisecond),
+	}
+	if len(data) > 0 {
+		hdr.dxferp, hdr.dxferLen = uintptr(unsafe.Pointer(&data[0])), uint32(len(data))
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), sgIO, uintptr(unsafe.Pointer(&hdr)))
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(&cdb)
+	runtime.KeepAlive(&sense)
+	if errno != 0 {
+		return errno
+	}
+	if hdr.hostStatus != 0 || hdr.driverStatus&^0x08 != 0 {
+		return fmt.Errorf("ATA command %#x failed: host status %#x, driver status %#x", cmd, hdr.hostStatus, hdr.driverStatus)
+	}
+	if hdr.status != 0 && ataSenseError(sense[:hdr.sbLenWr]) {
+		return fmt.Errorf("ATA command %#x aborted by the drive", cmd)
+	}
+	return nil
+}
+
+// ataSenseError reports whether the sense data of a pass-through command
+// tells that it failed: a sense key other than no sense and recovered
+// error, or the ERR bit in the ATA status of the descriptor.
+func ataSenseError(sense []byte) bool {
+	if len(sense) < 2 {
+		return true
+	}
+	var key byte
+	switch sense[0] & 0x7f {
+	case 0x72, 0x73:
+		key = sense[1] & 0xf
+		if len(sense) >= 22 && sense[8] == 0x09 {
+			return sense[21]&0x01 != 0
+		}
+	case 0x70, 0x71:
+		if len(sense) < 3 {
+			return true
+		}
+		key = sense[2] & 0xf
+	default:
+		return true
+	}
+	return key > 1
+}
+
+// ATASecurityInfo sends IDENTIFY DEVICE to the SATA drive at path and
+// returns the state of its ATA Security feature set.
+func ATASecurityInfo(path string) (*ATASecurity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	id := make([]byte, 512)
+	if err := ataCmd(f, ataIdentifyDevice, 0, id, true, 10*time.Second); err != nil {
+		return nil, fmt.Errorf("ATA identify %s: %w", path, err)
+	}
+	sec := parseATASecurity(id)
+	return &sec, nil
+}
+
+// ATASecureErase erases the SATA drive at path with SECURITY ERASE UNIT,
+// enhanced if requested: it sets a temporary user password, which the
+// erase removes, and blocks until the drive reports the end of the erase,
+// which takes as long as the drive announces.
+func ATASecureErase(path string, enhanced bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	id := make([]byte, 512)
+	if err := ataCmd(f, ataIdentifyDevice, 0, id, true, 10*time.Second); err != nil {
+		return fmt.Errorf("ATA identify %s: %w", path, err)
+	}
+	sec := parseATASecurity(id)
+	switch {
+	case !sec.Supported:
+		return fmt.Errorf("ATA secure erase %s: %w: the drive does not support the security feature set", path, errors.ErrUnsupported)
+	case sec.Frozen:
+		return fmt.Errorf("ATA secure erase %s: the drive is frozen; suspend and resume the machine, or unplug and plug the drive back, and try again", path)
+	case sec.Locked:
+		return fmt.Errorf("ATA secure erase %s: the drive is locked by a password", path)
+	case sec.Enabled:
+		return fmt.Errorf("ATA secure erase %s: the drive already has a user password", path)
+	case enhanced && !sec.EnhancedErase:
+		return fmt.Errorf("ATA secure erase %s: %w: the drive does not support the enhanced erase", path, errors.ErrUnsupported)
+	}
+
+	password := make([]byte, 512)
+	copy(password[2:34], ataPassword)
+	if err := ataCmd(f, ataSecuritySetPassword, 0, password, false, 10*time.Second); err != nil {
+		return fmt.Errorf("ATA secure erase %s: could not set the password: %w", path, err)
+	}
+	if err := ataCmd(f, ataSecurityErasePrep, 0, nil, false, 10*time.Second); err != nil {
+		return fmt.Errorf("ATA secure erase %s: %w", path, err)
+	}
+	// Il disco non risponde fino alla fine: il timeout segue la sua stima.
+	timeout := sec.EraseTime
+	if enhanced {
+		timeout = sec.EnhancedEraseTime
+		password[0] = 0x2
+	}
+	if timeout <= 0 {
+		timeout = 12 * time.Hour
+	}
+	if err := ataCmd(f, ataSecurityEraseUnit, 0, password, false, 2*timeout); err != nil {
+		return fmt.Errorf("ATA secure erase %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package flasher
+
+import "testing"
+
+// TestATASenseError verifica l'interpretazione dei dati di sense di un
+// comando ATA PASS-THROUGH.
+func TestATASenseError(t *testing.T) {
+	ok := make([]byte, 22)
+	ok[0], ok[1], ok[8], ok[21] = 0x72, 0x1, 0x09, 0x50 // recovered, DRDY|DSC
+	aborted := append([]byte(nil), ok...)
+	aborted[21] = 0x51 // ERR
+	for name, c := range map[string]struct {
+		sense []byte
+		want  bool
+	}{
+		"descrittore ok":      {ok, false},
+		"descrittore errore":  {aborted, true},
+		"fisso, no sense":     {[]byte{0x70, 0, 0}, false},
+		"fisso, illegal req.": {[]byte{0x70, 0, 0x5}, true},
+		"vuoto":               {nil, true},
+	} {
+		if got := ataSenseError(c.sense); got != c.want {
+			t.Errorf("%s: Got: %v, Want: %v", name, got, c.want)
+		}
+	}
+}
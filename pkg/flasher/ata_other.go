@@ -0,0 +1,18 @@
+//go:build !linux
+
+package flasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ATASecurityInfo is only implemented on Linux.
+func ATASecurityInfo(path string) (*ATASecurity, error) {
+	return nil, fmt.Errorf("ATA identify %s: %w", path, errors.ErrUnsupported)
+}
+
+// ATASecureErase is only implemented on Linux.
+func ATASecureErase(path string, enhanced bool) error {
+	return fmt.Errorf("ATA secure erase %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,27 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// TestParseATASecurity verifica la lettura delle parole di sicurezza di
+// IDENTIFY DEVICE.
+func TestParseATASecurity(t *testing.T) {
+	id := make([]byte, 512)
+	binary.LittleEndian.PutUint16(id[2*82:], 0x2)
+	binary.LittleEndian.PutUint16(id[2*128:], 0x29) // supportato, congelato, enhanced
+	binary.LittleEndian.PutUint16(id[2*89:], 30)
+	binary.LittleEndian.PutUint16(id[2*90:], 0x8000|300)
+	got := parseATASecurity(id)
+	want := ATASecurity{Supported: true, Frozen: true, EnhancedErase: true, EraseTime: time.Hour, EnhancedEraseTime: 10 * time.Hour}
+	if got != want {
+		t.Errorf("Stato di sicurezza errato. Got: %+v, Want: %+v", got, want)
+	}
+
+	binary.LittleEndian.PutUint16(id[2*82:], 0)
+	if parseATASecurity(id).Supported {
+		t.Error("Senza il bit della parola 82 la sicurezza non è supportata")
+	}
+}
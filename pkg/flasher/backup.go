@@ -0,0 +1,211 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// Backup reads the device at device (or the Destination registered for its
+// scheme or extension) into out, the reverse of Flash, e.g. to capture a
+// golden image. Skip is the device offset where reading starts and Count
+// limits the bytes read (the whole device if 0); with SkipFree the free
+// blocks of the filesystems are not read, and with Trim the image ends
+// with its last data. The digest, computed with Hash, covers the data
+// written to out. Once ctx is done the backup stops
+// between two blocks and the returned error wraps the cause of ctx.
+func (f *Flasher) Backup(ctx context.Context, device string, out io.Writer) (res Result, err error) {
+	res = Result{Verification: "skipped"}
+	ctx, span := f.startSpan(ctx, "backup")
+	span.SetAttribute(AttrDevice, device)
+	defer func() {
+		span.SetAttribute(AttrBytes, res.Bytes)
+		span.End(err)
+	}()
+
+	src, err := openForReading(device)
+	if err != nil {
+		return res, err
+	}
+	defer src.Close()
+	var data io.ReaderAt = src
+	if f.SkipFree {
+		used, err := deviceUsedExtents(device, src)
+		if err != nil {
+			return res, fmt.Errorf("could not find the used blocks of %s: %w", device, err)
+		}
+		var n int64
+		for _, e := range used {
+			n += e.Size
+		}
+		f.logger().Info("reading only the used blocks", "device", device, "used", n, "size", src.Size())
+		data = usedReader{src, used}
+	}
+	end := src.Size()
+	if f.Trim {
+		if parts, ok := partitionsEnd(device, src); ok && parts < end {
+			f.logger().Info("reading up to the end of the last partition", "device", device, "end", parts, "size", end)
+			end = parts
+		}
+	}
+	size := end - f.Skip
+	if f.Count > 0 {
+		size = min(size, f.Count)
+	}
+	if size <= 0 {
+		return res, fmt.Errorf("nothing to read from %s: %d bytes after offset %d", device, src.Size(), f.Skip)
+	}
+
+	start := time.Now()
+	defer func() { res.Elapsed = time.Since(start) }()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	// Con Trim gli zeri finali vengono trattenuti: il digest copre
+	// l'immagine scritta, non i dati letti.
+	var trim *trimWriter
+	var hasher hash.Hash
+	if f.Trim {
+		hasher = f.newHash()
+		trim = &trimWriter{w: io.MultiWriter(out, hasher)}
+		out = trim
+	}
+	copied, err := f.copy(ctx, backupOp, io.NewSectionReader(data, f.Skip, size), out, size, nil, &copyState{hasher: f.newHash()})
+	res.Bytes, res.Digest = copied.Bytes, copied.Digest
+	if trim != nil && err == nil {
+		err = trim.finish()
+		res.Bytes, res.Digest = trim.written, hasher.Sum(nil)
+		f.logger().Info("trailing zeros left out of the image", "read", copied.Bytes, "written", res.Bytes)
+	}
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return res, fmt.Errorf("%w: the backup did not complete within %s (%d bytes read)", ErrTimeout, f.Timeout, copied.Bytes)
+	case err != nil && ctx.Err() != nil:
+		return res, fmt.Errorf("backup interrupted (%d bytes read): %w", copied.Bytes, err)
+	case err != nil:
+		return res, checkRemoved(device, err)
+	}
+	if copied.Bytes != size {
+		return res, fmt.Errorf("read %d bytes of %s, expected %d", copied.Bytes, device, size)
+	}
+	return res, nil
+}
+
+// partitionsEnd returns the end of the last partition of dest, the
+// device at location, if it has a partition table.
+func partitionsEnd(location string, dest Destination) (int64, bool) {
+	disk, err := NewDisk(location, dest)
+	if err != nil {
+		return 0, false
+	}
+	parts, err := disk.Partitions()
+	if err != nil || len(parts) == 0 {
+		return 0, false
+	}
+	var end int64
+	for _, p := range parts {
+		end = max(end, p.Start+p.Size)
+	}
+	return end, true
+}
+
+// trimSector is the unit a trimmed image is rounded up to.
+const trimSector = 512
+
+// trimWriter writes to w all but the zeros at the end of the data: a run
+// of zeros is only written once data follows it.
+type trimWriter struct {
+	w io.Writer
+	// written is the number of bytes written to w, zeros is the length
+	// of the run of zeros held back.
+	written, zeros int64
+}
+
+func (t *trimWriter) Write(p []byte) (int, error) {
+	last := len(p) - 1
+	for last >= 0 && p[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		t.zeros += int64(len(p))
+		return len(p), nil
+	}
+	if err := t.writeZeros(t.zeros); err != nil {
+		return 0, err
+	}
+	n, err := t.w.Write(p[:last+1])
+	t.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	t.zeros = int64(len(p) - last - 1)
+	return len(p), nil
+}
+
+// finish writes the zeros that complete the last sector of the data.
+func (t *trimWriter) finish() error {
+	pad := (trimSector - t.written%trimSector) % trimSector
+	return t.writeZeros(min(pad, t.zeros))
+}
+
+func (t *trimWriter) writeZeros(n int64) error {
+	zeros := make([]byte, min(n, 1<<20))
+	for n > 0 {
+		w, err := t.w.Write(zeros[:min(n, int64(len(zeros)))])
+		t.written += int64(w)
+		n -= int64(w)
+		if err != nil {
+			return err
+		}
+	}
+	t.zeros = 0
+	return nil
+}
+
+// openForReading opens the device at location for Backup: through the
+// Destination registered for it, or read-only, so that write-protected
+// cards can be read too.
+func openForReading(location string) (Destination, error) {
+	open, err := lookup(destinations, location, openDeviceReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return open(location)
+}
+
+// openDeviceReadOnly opens the block device, or the regular file, at path
+// for reading.
+func openDeviceReadOnly(path string) (Destination, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open device %s for reading: %w", path, err)
+	}
+	d := NewFileDestination(f).(*fileDestination)
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		d.size = info.Size()
+	}
+	return d, nil
+}
+
+// OpenDeviceSource opens the device at location (or the Destination
+// registered for its scheme or extension) as the Source of a Flash, to
+// clone it to another device. Its whole capacity is read, as is: a device
+// is never decompressed.
+func OpenDeviceSource(location string) (*Source, error) {
+	d, err := openForReading(location)
+	if err != nil {
+		return nil, err
+	}
+	size := d.Size()
+	if size <= 0 {
+		d.Close()
+		return nil, fmt.Errorf("could not read the size of %s", location)
+	}
+	return &Source{Reader: io.NewSectionReader(d, 0, size), Size: size, Exact: true, closers: []io.Closer{d}}, nil
+}
@@ -0,0 +1,154 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBackup verifica la lettura di un dispositivo in un'immagine, intera
+// o a partire da un offset.
+func TestBackup(t *testing.T) {
+	dest := &memDest{data: []byte("0123456789abcdef")}
+	RegisterDestination("backuptest", func(string) (Destination, error) { return dest, nil })
+
+	var out bytes.Buffer
+	f := &Flasher{BlockSize: 5}
+	res, err := f.Backup(context.Background(), "backuptest://device", &out)
+	if err != nil {
+		t.Fatalf("Backup ha restituito un errore: %v", err)
+	}
+	want := sha256.Sum256(dest.data)
+	if out.String() != string(dest.data) || res.Bytes != 16 || !bytes.Equal(res.Digest, want[:]) {
+		t.Errorf("Backup errato. Got: %q (%d byte, digest %x)", out.String(), res.Bytes, res.Digest)
+	}
+
+	out.Reset()
+	f = &Flasher{Skip: 4, Count: 6}
+	if _, err := f.Backup(context.Background(), "backuptest://device", &out); err != nil || out.String() != "456789" {
+		t.Errorf("Backup parziale errato. Got: %q, %v", out.String(), err)
+	}
+
+	f = &Flasher{Skip: 16}
+	if _, err := f.Backup(context.Background(), "backuptest://device", io.Discard); err == nil {
+		t.Error("Un offset oltre la fine del dispositivo dovrebbe essere un errore")
+	}
+}
+
+// TestBackupFile verifica la lettura di un file normale, aperto in sola
+// lettura.
+func TestBackupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, []byte("contenuto del disco"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := (&Flasher{}).Backup(context.Background(), path, &out); err != nil || out.String() != "contenuto del disco" {
+		t.Errorf("Backup del file errato. Got: %q, %v", out.String(), err)
+	}
+}
+
+// TestNewCompressor verifica che le immagini compresse vengano riaperte
+// da OpenImage.
+func TestNewCompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("backup "), 1000)
+	for _, name := range []string{"image.img.gz", "image.img.xz", "image.img.zst"} {
+		format := CompressionOf(name)
+		path := filepath.Join(t.TempDir(), name)
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewCompressor(format, file)
+		if err != nil {
+			t.Fatalf("NewCompressor(%s) ha restituito un errore: %v", format, err)
+		}
+		w.Write(data)
+		w.Close()
+		file.Close()
+
+		src, err := OpenImage(path, OpenOptions{})
+		if err != nil {
+			t.Fatalf("OpenImage(%s) ha restituito un errore: %v", name, err)
+		}
+		got, err := io.ReadAll(src.Reader)
+		src.Close()
+		if err != nil || !bytes.Equal(got, data) || src.Format != format {
+			t.Errorf("%s: dati errati (%d byte, formato %s): %v", name, len(got), src.Format, err)
+		}
+	}
+	if CompressionOf("image.img") != "" {
+		t.Error("Un'immagine .img non dovrebbe essere compressa")
+	}
+	if _, err := NewCompressor("lz4", io.Discard); err == nil {
+		t.Error("Un formato sconosciuto dovrebbe essere un errore")
+	}
+}
+
+// TestOpenDeviceSource verifica la copia da un dispositivo a un altro.
+func TestOpenDeviceSource(t *testing.T) {
+	src := &memDest{data: []byte{0x1f, 0x8b, 'n', 'o', 'n', ' ', 'g', 'z'}}
+	dst := &memDest{data: make([]byte, 8)}
+	RegisterDestination("clonesrc", func(string) (Destination, error) { return src, nil })
+	RegisterDestination("clonedst", func(string) (Destination, error) { return dst, nil })
+	s, err := OpenDeviceSource("clonesrc://a")
+	if err != nil {
+		t.Fatalf("OpenDeviceSource ha restituito un errore: %v", err)
+	}
+	defer s.Close()
+	if s.Size != 8 || !s.Exact || s.Format != "" {
+		t.Errorf("Sorgente errata. Got: %d byte (esatta: %v, formato %q)", s.Size, s.Exact, s.Format)
+	}
+	res, err := (&Flasher{Verify: true}).Flash(context.Background(), s, "clonedst://b")
+	if err != nil || !bytes.Equal(dst.data, src.data) || res.Verification != "passed" {
+		t.Errorf("Copia errata. Got: %q (verifica %s), %v", dst.data, res.Verification, err)
+	}
+}
+
+// TestTrimWriter verifica che gli zeri finali vengano omessi, tranne
+// quelli che completano l'ultimo settore.
+func TestTrimWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &trimWriter{w: &out}
+	for _, chunk := range [][]byte{{1, 0, 0}, make([]byte, 600), {2, 0}, make([]byte, 1000)} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 1024)
+	want[0], want[603] = 1, 2
+	if !bytes.Equal(out.Bytes(), want) || w.written != 1024 {
+		t.Errorf("Dati errati: %d byte scritti, Want: 1024", out.Len())
+	}
+}
+
+// TestBackupTrim verifica che con Trim il backup si fermi all'ultimo dato
+// dell'ultima partizione e che il digest copra l'immagine scritta.
+func TestBackupTrim(t *testing.T) {
+	dest := &memDest{data: newTestImage(t)}
+	copy(dest.data[len(dest.data)-512:], "dopo le partizioni")
+	RegisterDestination("trimtest", func(string) (Destination, error) { return dest, nil })
+	var out bytes.Buffer
+	res, err := (&Flasher{Trim: true}).Backup(context.Background(), "trimtest://device", &out)
+	if err != nil {
+		t.Fatalf("Backup ha restituito un errore: %v", err)
+	}
+	end, _ := partitionsEnd("image", dest)
+	n := out.Len()
+	if n%512 != 0 || int64(n) > end || res.Bytes != int64(n) {
+		t.Fatalf("Dimensione errata: %d byte (fine delle partizioni: %d)", n, end)
+	}
+	if !bytes.Equal(out.Bytes(), dest.data[:n]) || !bytes.Equal(dest.data[n:end], make([]byte, end-int64(n))) {
+		t.Error("L'immagine non corrisponde al dispositivo")
+	}
+	if want := sha256.Sum256(out.Bytes()); !bytes.Equal(res.Digest, want[:]) {
+		t.Errorf("Digest errato. Got: %x, Want: %x", res.Digest, want)
+	}
+}
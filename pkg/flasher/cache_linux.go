@@ -0,0 +1,15 @@
+package flasher
+
+import (
+	"os"
+	"syscall"
+)
+
+// blkflsbuf is the BLKFLSBUF ioctl, which flushes the buffer cache of a block device.
+const blkflsbuf = 0x1261
+
+// DropCache discards cached pages of the block device, so that the
+// following reads hit the media.
+func DropCache(f *os.File) {
+	_, _, _ = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkflsbuf, 0)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package flasher
+
+import "os"
+
+// DropCache is a no-op: raw/character devices are not cached on these platforms.
+func DropCache(*os.File) {}
@@ -0,0 +1,41 @@
+package flasher
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// CompressionOf returns the format, among gzip, xz and zstd, that the
+// extension of path (.gz, .xz, .zst) asks for, or "" for a raw image.
+func CompressionOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return "gzip"
+	case ".xz":
+		return "xz"
+	case ".zst":
+		return "zstd"
+	}
+	return ""
+}
+
+// NewCompressor returns a writer compressing to w in format (gzip, xz or
+// zstd), which OpenImage decompresses back. Closing it flushes the
+// compressed stream but does not close w.
+func NewCompressor(format string, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "xz":
+		return xz.NewWriter(w)
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression format %q", format)
+}
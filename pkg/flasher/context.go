@@ -0,0 +1,29 @@
+package flasher
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader fails with the cause of ctx once ctx is done. It is
+// checked before each read, i.e. between two blocks of the copy.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// withContext wraps r so that it fails once ctx is done; a context that
+// can never be done returns r unchanged.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,149 @@
+package flasher
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+)
+
+// cryptAlphabet is the base64 alphabet of crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512CryptRounds is the default number of rounds of SHA-crypt.
+const sha512CryptRounds = 5000
+
+// sha512CryptOrder is the order in which SHA-crypt encodes the bytes of
+// the final digest, three at a time.
+var sha512CryptOrder = [...][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// hashPassword returns the crypt(3) hash of password that /etc/shadow,
+// and userconf.txt, expect: SHA-512 with a random salt, as
+// `openssl passwd -6` computes it.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	for i, b := range salt {
+		salt[i] = cryptAlphabet[b&0x3f]
+	}
+	return sha512Crypt(password, string(salt)), nil
+}
+
+// sha512Crypt returns the SHA-crypt hash ($6$) of key with salt, at most
+// 16 characters, and the default rounds.
+func sha512Crypt(key, salt string) string {
+	p, s := []byte(key), []byte(salt[:min(len(salt), 16)])
+
+	h := sha512.New()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= 64 {
+		h.Write(b[:min(n, 64)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range len(p) {
+		h.Write(p)
+	}
+	pSeq := repeatDigest(h.Sum(nil), len(p))
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(s)
+	}
+	sSeq := repeatDigest(h.Sum(nil), len(s))
+
+	c := a
+	for r := range sha512CryptRounds {
+		h.Reset()
+		if r%2 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(sSeq)
+		}
+		if r%7 != 0 {
+			h.Write(pSeq)
+		}
+		if r%2 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$6$" + string(s) + "$")
+	for _, o := range sha512CryptOrder {
+		cryptEncode(&out, uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	cryptEncode(&out, uint(c[63]), 2)
+	return out.String()
+}
+
+// repeatDigest returns n bytes of d repeated.
+func repeatDigest(d []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, d[:min(len(d), n-len(out))]...)
+	}
+	return out
+}
+
+// cryptEncode writes the n low 6-bit groups of w, from the lowest.
+func cryptEncode(out *strings.Builder, w uint, n int) {
+	for range n {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// wpaPSK returns the WPA pre-shared key of a network, in hex as
+// wpa_passphrase prints it: PBKDF2-HMAC-SHA1 of the passphrase, salted
+// with the SSID, 4096 iterations, 32 bytes.
+func wpaPSK(ssid, passphrase string) string {
+	mac := hmac.New(sha1.New, []byte(passphrase))
+	key := make([]byte, 0, 40)
+	for block := uint32(1); len(key) < 32; block++ {
+		mac.Reset()
+		mac.Write([]byte(ssid))
+		mac.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for range 4095 {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return hex.EncodeToString(key[:32])
+}
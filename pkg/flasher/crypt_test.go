@@ -0,0 +1,30 @@
+package flasher
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSHA512Crypt verifica l'hash delle password con i valori di
+// `openssl passwd -6`.
+func TestSHA512Crypt(t *testing.T) {
+	if got, want := sha512Crypt("Hello world!", "saltstring"), "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"; got != want {
+		t.Errorf("Hash errato. Got: %s, Want: %s", got, want)
+	}
+	a, err := hashPassword("raspberry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := hashPassword("raspberry")
+	if !strings.HasPrefix(a, "$6$") || len(a) != 3+16+1+86 || a == b {
+		t.Errorf("Ogni hash dovrebbe avere un sale casuale di 16 caratteri. Got: %s, %s", a, b)
+	}
+}
+
+// TestWPAPSK verifica la chiave WPA con il vettore di prova di IEEE
+// 802.11i.
+func TestWPAPSK(t *testing.T) {
+	if got, want := wpaPSK("IEEE", "password"), "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e"; got != want {
+		t.Errorf("Chiave errata. Got: %s, Want: %s", got, want)
+	}
+}
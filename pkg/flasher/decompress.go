@@ -0,0 +1,335 @@
+package flasher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Decompressor is a compressed image format that is decompressed on the
+// fly while flashing.
+type Decompressor struct {
+	Name string
+	// Magic are the first bytes of an image in this format, if it has any.
+	Magic []byte
+	// Extensions (e.g. ".vz") recognize the images of formats without
+	// Magic, or whose Magic is not found.
+	Extensions []string
+	// NewReader returns the decompressed stream of r.
+	NewReader func(r io.Reader, opts OpenOptions) (io.ReadCloser, error)
+	// Size, if set, estimates the uncompressed size from the headers or
+	// trailers of a compressed file of size bytes, without decompressing
+	// it.
+	Size func(r io.ReaderAt, size int64) (int64, error)
+	// ExactSize tells whether Size returns the exact size.
+	ExactSize bool
+}
+
+// compressions are the known formats, the registered ones first.
+var compressions = []*Decompressor{
+	{Name: "gzip", Magic: []byte{0x1f, 0x8b}, Extensions: []string{".gz"}, NewReader: newGzipReader, Size: gzipSize},
+	{Name: "xz", Magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, Extensions: []string{".xz"}, NewReader: newXZReader, Size: xzSize, ExactSize: true},
+	{Name: "zstd", Magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, Extensions: []string{".zst"}, NewReader: newZstdReader, Size: zstdSize, ExactSize: true},
+}
+
+// RegisterDecompressor makes OpenImage decompress the images in format d,
+// recognized from d.Magic or, failing that, from d.Extensions. A format
+// registered later takes precedence, also over gzip, xz and zstd, and
+// replaces any previous one with the same name.
+func RegisterDecompressor(d Decompressor) error {
+	if d.Name == "" || d.NewReader == nil {
+		return errors.New("a decompressor needs a name and a reader")
+	}
+	if len(d.Magic) == 0 && len(d.Extensions) == 0 {
+		return fmt.Errorf("decompressor %s: no magic bytes and no extensions", d.Name)
+	}
+	d.Extensions = slices.Clone(d.Extensions)
+	for i, ext := range d.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		d.Extensions[i] = strings.ToLower(ext)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	compressions = slices.DeleteFunc(compressions, func(c *Decompressor) bool { return c.Name == d.Name })
+	compressions = slices.Insert(compressions, 0, &d)
+	return nil
+}
+
+// magicLen is the number of bytes OpenImage reads to recognize a format.
+func magicLen() int {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	n := 8
+	for _, c := range compressions {
+		n = max(n, len(c.Magic))
+	}
+	return n
+}
+
+// detectCompression returns the format of the image at location starting
+// with head, found from its magic bytes or else from the extension of
+// location, or nil for a raw image.
+func detectCompression(location string, head []byte) *Decompressor {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, c := range compressions {
+		if len(c.Magic) > 0 && bytes.HasPrefix(head, c.Magic) {
+			return c
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(location))
+	if ext == "" {
+		return nil
+	}
+	for _, c := range compressions {
+		// Le estensioni dei formati con magic servono solo a chi ne è privo:
+		// un file .gz che non inizia con 1f 8b non è gzip.
+		if len(c.Magic) == 0 && slices.Contains(c.Extensions, ext) {
+			return c
+		}
+	}
+	return nil
+}
+
+// CommandDecompressor returns a Decompressor.NewReader that pipes the
+// compressed image through command, run with the system shell as by
+// CommandHook, and reads the decompressed image from its output. A
+// non-zero exit status fails the flash.
+func CommandDecompressor(command string) func(io.Reader, OpenOptions) (io.ReadCloser, error) {
+	return func(r io.Reader, _ OpenOptions) (io.ReadCloser, error) {
+		cmd := shellCommand(context.Background(), command)
+		cmd.Stdin = r
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("could not run %s: %w", command, err)
+		}
+		return &commandReader{command: command, cmd: cmd, r: stdout}, nil
+	}
+}
+
+// commandReader is the output of a CommandDecompressor.
+type commandReader struct {
+	command string
+	cmd     *exec.Cmd
+	r       io.Reader
+	done    bool  // the command has exited
+	err     error // returned once done
+}
+
+// Read reports a command that fails as an error rather than as the end of
+// the image.
+func (c *commandReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		c.done, c.err = true, io.EOF
+		if werr := c.cmd.Wait(); werr != nil {
+			c.err = fmt.Errorf("%s: %w", c.command, werr)
+		}
+		err = c.err
+	}
+	return n, err
+}
+
+// Close stops the command if its output was not read to the end.
+func (c *commandReader) Close() error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func newGzipReader(r io.Reader, _ OpenOptions) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func newXZReader(r io.Reader, _ OpenOptions) (io.ReadCloser, error) {
+	zr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(zr), nil
+}
+
+func newZstdReader(r io.Reader, opts OpenOptions) (io.ReadCloser, error) {
+	var dopts []zstd.DOption
+	if opts.LowMemory {
+		dopts = append(dopts, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	}
+	zr, err := zstd.NewReader(r, dopts...)
+	if err != nil {
+		return nil, err
+	}
+	return zr.IOReadCloser(), nil
+}
+
+// gzipSize reads the ISIZE trailer, the uncompressed size modulo 2^32.
+// Images are often larger than 4 GiB, so the smallest size with that
+// remainder that is not clearly below the compressed size is returned
+// (incompressible data grows by a few bytes per block): this is an
+// estimate rather than an exact value.
+func gzipSize(r io.ReaderAt, size int64) (int64, error) {
+	if size < 18 {
+		return 0, errors.New("gzip file too short")
+	}
+	var trailer [4]byte
+	if _, err := r.ReadAt(trailer[:], size-4); err != nil {
+		return 0, err
+	}
+	n := int64(binary.LittleEndian.Uint32(trailer[:]))
+	for n < size-size/64-64 {
+		n += 1 << 32
+	}
+	return n, nil
+}
+
+// xzSize adds up the uncompressed sizes recorded in the index of the last
+// stream of an xz file.
+func xzSize(r io.ReaderAt, size int64) (int64, error) {
+	// Lo stream può essere seguito da padding di zeri, a multipli di 4 byte.
+	end := size
+	var word [4]byte
+	for end >= 12 {
+		if _, err := r.ReadAt(word[:], end-4); err != nil {
+			return 0, err
+		}
+		if word != [4]byte{} {
+			break
+		}
+		end -= 4
+	}
+	if end < 12 {
+		return 0, errors.New("xz file too short")
+	}
+
+	// Stream footer: CRC32, backward size, flags, "YZ".
+	var footer [12]byte
+	if _, err := r.ReadAt(footer[:], end-12); err != nil {
+		return 0, err
+	}
+	if footer[10] != 'Y' || footer[11] != 'Z' {
+		return 0, errors.New("xz stream footer not found")
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > end-12 {
+		return 0, errors.New("xz index size out of range")
+	}
+	index := make([]byte, indexSize)
+	if _, err := r.ReadAt(index, end-12-indexSize); err != nil {
+		return 0, err
+	}
+	if index[0] != 0 {
+		return 0, errors.New("xz index not found")
+	}
+
+	buf := bytes.NewReader(index[1:])
+	records, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return 0, fmt.Errorf("xz index: %w", err)
+	}
+	var total int64
+	for range records {
+		if _, err := binary.ReadUvarint(buf); err != nil { // unpadded size
+			return 0, fmt.Errorf("xz index: %w", err)
+		}
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return 0, fmt.Errorf("xz index: %w", err)
+		}
+		total += int64(n)
+	}
+	return total, nil
+}
+
+// zstdSize adds up the content sizes declared in the frame headers of a
+// zstd file, skipping the compressed blocks of each frame.
+func zstdSize(r io.ReaderAt, size int64) (int64, error) {
+	var total, off int64
+	var hdr [18]byte
+	for off < size {
+		n, err := r.ReadAt(hdr[:], off)
+		if n < 8 && err != nil {
+			return 0, fmt.Errorf("zstd frame at %d: %w", off, err)
+		}
+		magic := binary.LittleEndian.Uint32(hdr[:4])
+		if magic&0xfffffff0 == 0x184d2a50 { // skippable frame
+			off += 8 + int64(binary.LittleEndian.Uint32(hdr[4:8]))
+			continue
+		}
+		if magic != 0xfd2fb528 {
+			return 0, fmt.Errorf("zstd frame at %d: bad magic", off)
+		}
+
+		desc := hdr[4]
+		single := desc&0x20 != 0
+		pos := 5
+		if !single {
+			pos++ // window descriptor
+		}
+		pos += []int{0, 1, 2, 4}[desc&0x03] // dictionary ID
+		var content uint64
+		switch desc >> 6 {
+		case 0:
+			if !single {
+				return 0, errors.New("zstd frame without content size")
+			}
+			content = uint64(hdr[pos])
+			pos++
+		case 1:
+			content = uint64(binary.LittleEndian.Uint16(hdr[pos:])) + 256
+			pos += 2
+		case 2:
+			content = uint64(binary.LittleEndian.Uint32(hdr[pos:]))
+			pos += 4
+		case 3:
+			content = binary.LittleEndian.Uint64(hdr[pos:])
+			pos += 8
+		}
+		total += int64(content)
+
+		// Saltiamo i blocchi fino all'ultimo del frame.
+		off += int64(pos)
+		var bh [3]byte
+		for {
+			if _, err := r.ReadAt(bh[:], off); err != nil {
+				return 0, fmt.Errorf("zstd block at %d: %w", off, err)
+			}
+			h := uint32(bh[0]) | uint32(bh[1])<<8 | uint32(bh[2])<<16
+			blockSize := int64(h >> 3)
+			if (h>>1)&0x03 == 1 { // RLE: un solo byte ripetuto
+				blockSize = 1
+			}
+			off += 3 + blockSize
+			if h&1 != 0 {
+				break
+			}
+		}
+		if desc&0x04 != 0 { // content checksum
+			off += 4
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,136 @@
+package flasher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// TestCompressions verifica il riconoscimento dei formati compressi, la
+// stima della dimensione decompressa e la decompressione.
+func TestCompressions(t *testing.T) {
+	data := bytes.Repeat([]byte("sflashy image "), 10000)
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(data)
+	xw.Close()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(data) / 2
+	// Due frame concatenati, come produce pzstd.
+	zst := enc.EncodeAll(data[half:], enc.EncodeAll(data[:half], nil))
+
+	for _, c := range []struct {
+		name string
+		file []byte
+	}{{"gzip", gz.Bytes()}, {"xz", xzBuf.Bytes()}, {"zstd", zst}} {
+		r := bytes.NewReader(c.file)
+		format := detectCompression("image", c.file)
+		if format == nil || format.Name != c.name {
+			t.Errorf("%s: formato non riconosciuto. Got: %v", c.name, format)
+			continue
+		}
+		size, err := format.Size(r, int64(len(c.file)))
+		if err != nil || size != int64(len(data)) {
+			t.Errorf("%s: dimensione stimata errata. Got: %d (%v), Want: %d", c.name, size, err, len(data))
+		}
+		zr, err := format.NewReader(r, OpenOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: dati decompressi errati (%d byte, err %v)", c.name, len(got), err)
+		}
+	}
+
+	if format := detectCompression("image", data); format != nil {
+		t.Errorf("Un'immagine raw non dovrebbe risultare compressa. Got: %s", format.Name)
+	}
+}
+
+// TestRegisterDecompressor verifica i formati registrati, riconosciuti dai
+// magic byte o dall'estensione.
+func TestRegisterDecompressor(t *testing.T) {
+	upper := func(r io.Reader, _ OpenOptions) (io.ReadCloser, error) {
+		data, err := io.ReadAll(r)
+		return io.NopCloser(bytes.NewReader(bytes.ToUpper(bytes.TrimPrefix(data, []byte("UPPR"))))), err
+	}
+	if err := RegisterDecompressor(Decompressor{Name: "upper", Magic: []byte("UPPR"), NewReader: upper}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterDecompressor(Decompressor{Name: "rot", Extensions: []string{"ROT"}, NewReader: upper}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterDecompressor(Decompressor{Name: "nothing", NewReader: upper}); err == nil {
+		t.Error("Un formato senza magic né estensioni dovrebbe essere un errore")
+	}
+
+	dir := t.TempDir()
+	for _, c := range []struct{ name, content, format string }{
+		{"image.img", "UPPRdati", "upper"},
+		{"image.rot", "dati", "rot"},
+		{"image.gz", "dati", ""}, // l'estensione non basta per i formati con magic
+	} {
+		path := filepath.Join(dir, c.name)
+		if err := os.WriteFile(path, []byte(c.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		src, err := OpenImage(path, OpenOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got, _ := io.ReadAll(src)
+		src.Close()
+		if src.Format != c.format {
+			t.Errorf("%s: formato errato. Got: %q, Want: %q", c.name, src.Format, c.format)
+		}
+		if c.format != "" && (string(got) != "DATI" || src.SizeErr == nil) {
+			t.Errorf("%s: dati errati o dimensione stimata. Got: %q, %v", c.name, got, src.SizeErr)
+		}
+	}
+}
+
+// TestCommandDecompressor verifica la decompressione con un comando esterno.
+func TestCommandDecompressor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("richiede sh")
+	}
+	zr, err := CommandDecompressor("tr a-z A-Z")(strings.NewReader("dati"), OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || string(got) != "DATI" {
+		t.Errorf("Output errato. Got: %q, %v", got, err)
+	}
+	zr.Close()
+
+	zr, err = CommandDecompressor("exit 3")(strings.NewReader("dati"), OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(zr); err == nil {
+		t.Error("Un comando fallito dovrebbe essere un errore")
+	}
+}
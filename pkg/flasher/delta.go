@@ -0,0 +1,444 @@
+package flasher
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// A delta holds the blocks that differ between two versions of an image,
+// so that a device holding the old version is brought to the new one by
+// writing only those. It is a gzip stream made of the deltaMagic line, the
+// DeltaInfo as a JSON line and, for each changed block, its index as a
+// big-endian uint64 followed by its BlockSize bytes (fewer for the last
+// block of the new image).
+const deltaMagic = "SFLASHY-DELTA 1\n"
+
+// DefaultDeltaBlockSize is the block size of CreateDelta unless given:
+// small enough that a changed file rewrites little around it, large
+// enough that the indexes cost nothing.
+const DefaultDeltaBlockSize = 64 * 1024
+
+// MaxDeltaBlockSize bounds the block size of a delta, so that reading one
+// does not allocate whatever its header claims.
+const MaxDeltaBlockSize = 64 << 20
+
+// DeltaInfo describes a delta: the images it goes between and the blocks
+// it writes. The digests are SHA-256, whatever Flasher.Hash.
+type DeltaInfo struct {
+	BlockSize int    `json:"block_size"`
+	OldSize   int64  `json:"old_size"`
+	OldSHA256 string `json:"old_sha256"`
+	NewSize   int64  `json:"new_size"`
+	NewSHA256 string `json:"new_sha256"`
+	// Blocks is the number of changed blocks and Bytes their total size,
+	// what applying the delta writes.
+	Blocks int64 `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// CreateDelta compares the old and new versions of an image block by block
+// and writes to w the delta from the first to the second. blockSize is
+// DefaultDeltaBlockSize if 0. Blocks past the end of old count as changed;
+// when new is shorter, the data of old after it is left on the device. The
+// changed blocks are staged in a temporary file, since the header with the
+// digests comes first.
+func CreateDelta(ctx context.Context, old, new io.Reader, w io.Writer, blockSize int) (DeltaInfo, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultDeltaBlockSize
+	}
+	info := DeltaInfo{BlockSize: blockSize}
+	if blockSize > MaxDeltaBlockSize {
+		return info, fmt.Errorf("block size %d is larger than %d", blockSize, MaxDeltaBlockSize)
+	}
+	tmp, err := os.CreateTemp("", "sflashy-delta-*")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	blocks := bufio.NewWriter(tmp)
+
+	oldHash, newHash := sha256.New(), sha256.New()
+	oldr := withContext(ctx, io.TeeReader(old, oldHash))
+	newr := withContext(ctx, io.TeeReader(new, newHash))
+	oldBuf, newBuf := make([]byte, blockSize), make([]byte, blockSize)
+	oldDone := false
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(newr, newBuf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return info, fmt.Errorf("error while reading the new image: %w", err)
+		}
+		if n == 0 {
+			break
+		}
+		m := 0
+		if !oldDone {
+			m, err = io.ReadFull(oldr, oldBuf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return info, fmt.Errorf("error while reading the old image: %w", err)
+			}
+			oldDone = m < blockSize
+			info.OldSize += int64(m)
+		}
+		info.NewSize += int64(n)
+		if m >= n && bytes.Equal(oldBuf[:n], newBuf[:n]) {
+			continue
+		}
+		blocks.Write(binary.BigEndian.AppendUint64(nil, index))
+		if _, err := blocks.Write(newBuf[:n]); err != nil {
+			return info, err
+		}
+		info.Blocks++
+		info.Bytes += int64(n)
+	}
+	// Il digest dell'immagine vecchia copre anche la parte oltre la nuova.
+	if !oldDone {
+		n, err := io.Copy(io.Discard, oldr)
+		if err != nil {
+			return info, fmt.Errorf("error while reading the old image: %w", err)
+		}
+		info.OldSize += n
+	}
+	if err := blocks.Flush(); err != nil {
+		return info, err
+	}
+	info.OldSHA256, info.NewSHA256 = hex.EncodeToString(oldHash.Sum(nil)), hex.EncodeToString(newHash.Sum(nil))
+
+	header, err := json.Marshal(info)
+	if err != nil {
+		return info, err
+	}
+	zw := gzip.NewWriter(w)
+	io.WriteString(zw, deltaMagic)
+	zw.Write(append(header, '\n'))
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+	if _, err := io.Copy(zw, withContext(ctx, tmp)); err != nil {
+		return info, err
+	}
+	return info, zw.Close()
+}
+
+// Delta is a delta being read, as returned by OpenDelta.
+type Delta struct {
+	Info DeltaInfo
+	r    *bufio.Reader
+	// read is the number of blocks read so far, bytes their size and end
+	// the offset after the last one: the blocks come in order.
+	read, bytes, end int64
+}
+
+// OpenDelta reads the header of the delta in r; the blocks are read by
+// Flasher.ApplyDelta.
+func OpenDelta(r io.Reader) (*Delta, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a delta: %w", err)
+	}
+	d := &Delta{r: bufio.NewReader(zr)}
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != deltaMagic {
+		return nil, errors.New("not a delta: wrong header")
+	}
+	line, err := d.r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid delta header: %w", err)
+	}
+	if err := json.Unmarshal(line, &d.Info); err != nil {
+		return nil, fmt.Errorf("invalid delta header: %w", err)
+	}
+	info := d.Info
+	if info.BlockSize <= 0 || info.BlockSize > MaxDeltaBlockSize || info.OldSize < 0 || info.NewSize < 0 ||
+		info.Blocks < 0 || info.Bytes < 0 || info.Bytes > info.NewSize ||
+		info.Blocks > (info.NewSize+int64(info.BlockSize)-1)/int64(info.BlockSize) {
+		return nil, errors.New("invalid delta header")
+	}
+	for _, digest := range []string{info.OldSHA256, info.NewSHA256} {
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, errors.New("invalid delta header: wrong SHA-256")
+		}
+	}
+	return d, nil
+}
+
+// next returns the next changed block and its offset in the image,
+// io.EOF after the last one.
+func (d *Delta) next(buf []byte) (int64, []byte, error) {
+	var index [8]byte
+	if _, err := io.ReadFull(d.r, index[:]); err == io.EOF {
+		if d.read != d.Info.Blocks {
+			return 0, nil, fmt.Errorf("truncated delta: %d of %d blocks", d.read, d.Info.Blocks)
+		}
+		if d.bytes != d.Info.Bytes {
+			return 0, nil, fmt.Errorf("invalid delta: %d bytes of blocks, the header says %d", d.bytes, d.Info.Bytes)
+		}
+		return 0, nil, io.EOF
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("truncated delta: %w", err)
+	}
+	if d.read == d.Info.Blocks {
+		return 0, nil, fmt.Errorf("invalid delta: more than %d blocks", d.Info.Blocks)
+	}
+	// L'indice si controlla prima di moltiplicarlo, che non trabocchi.
+	size := int64(d.Info.BlockSize)
+	i := binary.BigEndian.Uint64(index[:])
+	if i >= uint64((d.Info.NewSize+size-1)/size) {
+		return 0, nil, fmt.Errorf("invalid delta: block %d past the end of the image", i)
+	}
+	off := int64(i) * size
+	if off < d.end {
+		return 0, nil, fmt.Errorf("invalid delta: block %d out of order", i)
+	}
+	// Solo l'ultimo blocco dell'immagine può essere più corto.
+	block := buf[:min(size, d.Info.NewSize-off)]
+	if _, err := io.ReadFull(d.r, block); err != nil {
+		return 0, nil, fmt.Errorf("truncated delta: %w", err)
+	}
+	d.read++
+	d.bytes += int64(len(block))
+	d.end = off + int64(len(block))
+	return off, block, nil
+}
+
+// ApplyDelta brings the device at device (or the Destination registered
+// for its scheme or extension) from the old image of delta to the new one
+// by writing the changed blocks only, asking Confirm first, and syncs it.
+// The device is read first: it must hold either image, and nothing is
+// written when it already holds the new one; otherwise the error wraps
+// ErrChecksumMismatch. The new image is hashed as it is written, the
+// blocks of the delta and the data of the device between them, and a
+// digest other than the one of the delta is an error that wraps
+// ErrChecksumMismatch too. With Verify, the new image is read back. Count,
+// Seek and Skip are ignored. Once ctx is done the writes stop between two
+// blocks and the returned error wraps the cause of ctx.
+func (f *Flasher) ApplyDelta(ctx context.Context, delta *Delta, device string) (res Result, err error) {
+	info := delta.Info
+	res = Result{Verification: "skipped"}
+	ctx, span := f.startSpan(ctx, "delta")
+	span.SetAttribute(AttrDevice, device)
+	defer func() {
+		span.SetAttribute(AttrBytes, res.Bytes)
+		span.End(err)
+		if err != nil {
+			f.publish(Event{Type: EventFailed, Device: device, Bytes: res.Bytes, Err: err})
+		} else {
+			f.publish(Event{Type: EventCompleted, Device: device, Bytes: res.Bytes})
+		}
+	}()
+
+	dest, err := OpenDestination(device)
+	if err != nil {
+		return res, err
+	}
+	defer dest.Close()
+	if capacity := dest.Size(); capacity > 0 && capacity < info.NewSize {
+		return res, fmt.Errorf("%w: the image needs %d bytes but %s has only %d", ErrDeviceTooSmall, info.NewSize, device, capacity)
+	}
+	res.Digest, _ = hex.DecodeString(info.NewSHA256)
+	// Un dispositivo più piccolo dell'immagine vecchia non può contenerla.
+	oldSize := info.OldSize
+	if capacity := dest.Size(); capacity > 0 && capacity < oldSize {
+		oldSize = 0
+	}
+
+	start := time.Now()
+	defer func() { res.Elapsed = time.Since(start) }()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	fmt.Fprintln(f.output(), "Checking the image on the device...")
+	sums, err := f.readDigests(ctx, dest, device, "Checking", oldSize, info.NewSize)
+	if err != nil {
+		return res, err
+	}
+	switch {
+	case sums[1] == info.NewSHA256:
+		fmt.Fprintln(f.output(), f.Colors.Success+"The device already holds the new image."+f.Colors.Reset)
+		f.logger().Info("device already up to date", "sha256", info.NewSHA256)
+		return res, nil
+	case sums[0] != info.OldSHA256:
+		return res, fmt.Errorf("%w: %s does not hold the image the delta was made from (SHA-256 %s), flash the whole image instead", ErrChecksumMismatch, device, info.OldSHA256)
+	}
+	if err := f.confirm(device); err != nil {
+		return res, err
+	}
+
+	f.publish(Event{Type: EventWriteStarted, Device: device})
+	res.Bytes, err = f.writeDelta(ctx, delta, dest)
+	switch {
+	case errors.Is(err, ErrTimeout):
+		dest.Sync()
+		return res, fmt.Errorf("%w: the delta was not applied within %s (%d bytes written)", ErrTimeout, f.Timeout, res.Bytes)
+	case errors.Is(err, ErrChecksumMismatch):
+		dest.Sync()
+		return res, err
+	case err != nil && ctx.Err() != nil:
+		fmt.Fprintln(f.output(), "Interrupted, syncing the data written so far...")
+		dest.Sync()
+		return res, fmt.Errorf("delta interrupted (%d bytes written), the device holds neither image: %w", res.Bytes, err)
+	case err != nil:
+		return res, checkRemoved(device, err)
+	}
+
+	fmt.Fprintln(f.output(), "Finalizing write (syncing)...")
+	if err := dest.Sync(); err != nil {
+		return res, checkRemoved(device, fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+	}
+	f.publish(Event{Type: EventSynced, Device: device, Bytes: res.Bytes})
+	f.logger().Info("delta applied", "blocks", info.Blocks, "bytes", res.Bytes)
+
+	if f.Verify {
+		f.publish(Event{Type: EventVerifyStarted, Device: device, Bytes: res.Bytes})
+		// Rileggiamo dal dispositivo, non dalla cache.
+		if c, ok := dest.(interface{ DropCache() }); ok {
+			c.DropCache()
+		}
+		fmt.Fprintln(f.output(), "Verifying written data...")
+		sums, err := f.readDigests(ctx, dest, device, "Verifying", info.NewSize)
+		if err == nil && sums[0] != info.NewSHA256 {
+			err = fmt.Errorf("%w: device digest is %s, image digest is %s", ErrVerifyFailed, sums[0], info.NewSHA256)
+		}
+		if err != nil {
+			res.Verification = "FAILED"
+			return res, err
+		}
+		fmt.Fprintln(f.output(), f.Colors.Success+"Verification successful."+f.Colors.Reset)
+		res.Verification = "passed"
+	}
+	return res, nil
+}
+
+// writeDelta writes the blocks of delta to dest and returns the bytes
+// written. The new image, the blocks and the data of dest between them,
+// must have the SHA-256 of delta: otherwise the error wraps
+// ErrChecksumMismatch.
+func (f *Flasher) writeDelta(ctx context.Context, delta *Delta, dest Destination) (int64, error) {
+	out := f.output()
+	fmt.Fprintln(out, "Starting delta operation...")
+	pauser := f.pauser()
+	pw := f.newProgress("Writing", delta.Info.Bytes, nil)
+	buf := make([]byte, delta.Info.BlockSize)
+	h, between := sha256.New(), make([]byte, DefaultDeltaBlockSize*16)
+	var n, hashed int64
+	for {
+		if err := context.Cause(ctx); err != nil {
+			fmt.Fprintln(out)
+			return n, err
+		}
+		off, block, err := delta.next(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(out)
+			return n, err
+		}
+		if err := pauser.wait(ctx, dest.Sync); err != nil {
+			return n, err
+		}
+		if err := hashRange(ctx, dest, h, hashed, off, between); err != nil {
+			fmt.Fprintln(out)
+			return n, err
+		}
+		h.Write(block)
+		hashed = off + int64(len(block))
+		w, err := dest.WriteAt(block, off)
+		n += int64(w)
+		if err != nil {
+			fmt.Fprintln(out)
+			return n, fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+		pw.add(int64(w))
+	}
+	pw.finish()
+	fmt.Fprintln(out)
+	if err := hashRange(ctx, dest, h, hashed, delta.Info.NewSize, between); err != nil {
+		return n, err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != delta.Info.NewSHA256 {
+		return n, fmt.Errorf("%w: the device now has SHA-256 %s instead of %s, it holds neither image: flash the whole image", ErrChecksumMismatch, got, delta.Info.NewSHA256)
+	}
+	fmt.Fprintln(out, f.Colors.Success+"\nDelta applied successfully!"+f.Colors.Reset)
+	return n, nil
+}
+
+// hashRange adds the bytes of dest from start to end to h, read through
+// buf.
+func hashRange(ctx context.Context, dest Destination, h hash.Hash, start, end int64, buf []byte) error {
+	for start < end {
+		n, err := dest.ReadAt(buf[:min(int64(len(buf)), end-start)], start)
+		h.Write(buf[:n])
+		start += int64(n)
+		if (err == io.EOF && start < end) || (err == nil && n == 0) {
+			return fmt.Errorf("%w: the device ends after %d bytes, the image has %d", ErrDeviceTooSmall, start, end)
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error while reading the device: %w", err)
+		}
+		if err := context.Cause(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDigests reads dest, the device at location, once up to the largest
+// of sizes and returns the hex SHA-256 of its first size bytes for each
+// of sizes.
+func (f *Flasher) readDigests(ctx context.Context, dest Destination, location, label string, sizes ...int64) ([]string, error) {
+	end := max(0, sizes[0])
+	for _, size := range sizes {
+		end = max(end, size)
+	}
+	hashes := make([]hash.Hash, len(sizes))
+	for i := range hashes {
+		hashes[i] = sha256.New()
+	}
+	pw := f.newProgress(label, end, nil)
+	buf := make([]byte, DefaultDeltaBlockSize*16)
+	var off int64
+	for off < end {
+		n, err := dest.ReadAt(buf[:min(int64(len(buf)), end-off)], off)
+		for i, size := range sizes {
+			if off < size {
+				hashes[i].Write(buf[:min(int64(n), size-off)])
+			}
+		}
+		off += int64(n)
+		pw.add(int64(n))
+		if cerr := context.Cause(ctx); cerr != nil {
+			fmt.Fprintln(f.output())
+			return nil, cerr
+		}
+		if err == io.EOF && off < end {
+			fmt.Fprintln(f.output())
+			return nil, fmt.Errorf("%w: %s ends after %d bytes, the image has %d", ErrDeviceTooSmall, location, off, end)
+		}
+		if err != nil && err != io.EOF {
+			fmt.Fprintln(f.output())
+			return nil, checkRemoved(location, fmt.Errorf("error while reading %s: %w", location, err))
+		}
+	}
+	pw.finish()
+	fmt.Fprintln(f.output())
+	sums := make([]string, len(hashes))
+	for i, h := range hashes {
+		sums[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
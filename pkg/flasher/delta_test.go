@@ -0,0 +1,129 @@
+package flasher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestDelta verifica che un delta porti un dispositivo dalla vecchia alla
+// nuova versione scrivendo solo i blocchi cambiati.
+func TestDelta(t *testing.T) {
+	old := bytes.Repeat([]byte("versione uno "), 1000)
+	new := bytes.Clone(old)
+	copy(new[100:], "cambiato")
+	copy(new[5000:], "anche qui")
+	new = append(new, "coda della versione due"...)
+
+	var delta bytes.Buffer
+	info, err := CreateDelta(context.Background(), bytes.NewReader(old), bytes.NewReader(new), &delta, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cambiano i blocchi 0 e 4, più l'ultimo che si allunga.
+	if info.Blocks != 3 || info.Bytes != 2048+int64(len(new))-12*1024 || info.OldSize != int64(len(old)) || info.NewSize != int64(len(new)) {
+		t.Errorf("Delta errato. Got: %+v", info)
+	}
+
+	dest := &memDest{data: append(bytes.Clone(old), make([]byte, 4096)...)}
+	RegisterDestination("deltatest", func(string) (Destination, error) { return dest, nil })
+	f := &Flasher{Verify: true}
+	d, err := OpenDelta(bytes.NewReader(delta.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := f.ApplyDelta(context.Background(), d, "deltatest://dev")
+	if err != nil {
+		t.Fatalf("ApplyDelta ha restituito un errore: %v", err)
+	}
+	if !bytes.Equal(dest.data[:len(new)], new) || res.Bytes != info.Bytes || res.Verification != "passed" || !dest.synced {
+		t.Errorf("Delta applicato male. Got: %+v", res)
+	}
+
+	// Un dispositivo già aggiornato non viene riscritto.
+	dest.synced = false
+	d, _ = OpenDelta(bytes.NewReader(delta.Bytes()))
+	if res, err := f.ApplyDelta(context.Background(), d, "deltatest://dev"); err != nil || res.Bytes != 0 || dest.synced {
+		t.Errorf("Il dispositivo era già aggiornato. Got: %+v, %v", res, err)
+	}
+
+	dest.data[0] = 'X'
+	d, _ = OpenDelta(bytes.NewReader(delta.Bytes()))
+	if _, err := f.ApplyDelta(context.Background(), d, "deltatest://dev"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Senza l'immagine vecchia il delta va rifiutato. Got: %v", err)
+	}
+
+	if _, err := OpenDelta(bytes.NewReader(old)); err == nil {
+		t.Error("Un file qualsiasi non è un delta")
+	}
+	truncated := delta.Bytes()[:delta.Len()-40]
+	copy(dest.data, old)
+	d, err = OpenDelta(bytes.NewReader(truncated))
+	if err == nil {
+		_, err = f.ApplyDelta(context.Background(), d, "deltatest://dev")
+	}
+	if err == nil {
+		t.Error("Un delta troncato va rifiutato")
+	}
+}
+
+// TestDeltaInvalid verifica che un delta costruito male venga rifiutato:
+// blocchi enormi o fuori dall'immagine, e un risultato diverso dalla
+// nuova versione, anche senza Verify.
+func TestDeltaInvalid(t *testing.T) {
+	old := bytes.Repeat([]byte("versione uno "), 100)
+	sum := sha256.Sum256(old)
+	digest := hex.EncodeToString(sum[:])
+	forge := func(info DeltaInfo, blocks ...uint64) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		header, _ := json.Marshal(info)
+		zw.Write([]byte(deltaMagic))
+		zw.Write(append(header, '\n'))
+		for _, i := range blocks {
+			zw.Write(binary.BigEndian.AppendUint64(nil, i))
+			zw.Write(bytes.Repeat([]byte("x"), info.BlockSize))
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	info := DeltaInfo{BlockSize: 512, OldSize: int64(len(old)), OldSHA256: digest, NewSize: int64(len(old)), NewSHA256: digest, Blocks: 1, Bytes: 512}
+
+	huge := info
+	huge.BlockSize = 1 << 40
+	if _, err := OpenDelta(bytes.NewReader(forge(huge))); err == nil {
+		t.Error("Un blocco troppo grande va rifiutato")
+	}
+	dest := &memDest{data: bytes.Clone(old)}
+	RegisterDestination("deltainvalid", func(string) (Destination, error) { return dest, nil })
+	f := &Flasher{}
+	// new_sha256 uguale all'immagine vecchia farebbe saltare la scrittura.
+	info.NewSHA256 = strings.Repeat("0", 64)
+	for _, index := range []uint64{3, 1 << 62, 1<<64 - 1} {
+		d, err := OpenDelta(bytes.NewReader(forge(info, index)))
+		if err == nil {
+			_, err = f.ApplyDelta(context.Background(), d, "deltainvalid://dev")
+		}
+		if err == nil || !strings.Contains(err.Error(), "past the end") {
+			t.Errorf("Il blocco %d è fuori dall'immagine. Got: %v", index, err)
+		}
+	}
+	if !bytes.Equal(dest.data, old) {
+		t.Error("Un delta non valido non deve scrivere")
+	}
+
+	d, err := OpenDelta(bytes.NewReader(forge(info, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ApplyDelta(context.Background(), d, "deltainvalid://dev"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Un risultato diverso dalla nuova versione va segnalato. Got: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Destination is where an image is written: a block device, unless the
+// location passed to Flasher.Flash has a registered scheme or extension.
+// If it has a DropCache() method, it is called before the data is read
+// back, so that the verification hits the media.
+type Destination interface {
+	io.WriterAt
+	// ReadAt reads the written data back for the verification.
+	io.ReaderAt
+	Sync() error
+	Close() error
+	// Size returns the capacity in bytes, or 0 if the destination grows
+	// as it is written.
+	Size() int64
+}
+
+// OpenDestination opens the destination at location.
+func OpenDestination(location string) (Destination, error) {
+	open, err := lookup(destinations, location, openDevice)
+	if err != nil {
+		return nil, err
+	}
+	return open(location)
+}
+
+// fileDestination is a block device or a regular file.
+type fileDestination struct {
+	*os.File
+	size int64
+	// restore, if set, is called once the file is closed, e.g. to make an
+	// eMMC boot partition read-only again.
+	restore func() error
+}
+
+func (d *fileDestination) Close() error {
+	err := d.File.Close()
+	if d.restore != nil {
+		if rerr := d.restore(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (d *fileDestination) Size() int64 { return d.size }
+
+// DropCache discards the cached pages of a block device.
+func (d *fileDestination) DropCache() { DropCache(d.File) }
+
+// openDevice opens the block device at path exclusively, for writing and
+// for the verification. An eMMC boot partition is made writable until the
+// device is closed.
+func openDevice(path string) (Destination, error) {
+	restore, err := unlockBootPartition(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0666)
+	if err != nil && restore != nil {
+		restore()
+	}
+	if errors.Is(err, syscall.EBUSY) {
+		return nil, fmt.Errorf("%w: could not open %s exclusively, it is in use", ErrDeviceBusy, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open device %s for writing: %w", path, err)
+	}
+	d := NewFileDestination(f).(*fileDestination)
+	d.restore = restore
+	return d, nil
+}
+
+// NewFileDestination returns a Destination writing to f, a device or a
+// regular file opened read-write, e.g. a file descriptor received from a
+// privileged helper. Closing the Destination closes f.
+func NewFileDestination(f *os.File) Destination {
+	d := &fileDestination{File: f}
+	// Un file normale cresce con la scrittura: la capacità vale solo per
+	// i dispositivi.
+	if info, err := f.Stat(); err == nil && info.Mode()&os.ModeDevice != 0 {
+		if d.size, err = DeviceSize(f); err != nil {
+			d.size = 0
+		}
+	}
+	return d
+}
+
+// createFileURL writes the image to the regular file of a file:// URL,
+// creating it if needed.
+func createFileURL(location string) (Destination, error) {
+	path := strings.TrimPrefix(location, "file://")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %w", path, err)
+	}
+	return &fileDestination{File: f}, nil
+}
+
+// destWriter writes a Destination sequentially, starting at an offset.
+type destWriter struct {
+	*io.OffsetWriter
+	dest Destination
+}
+
+// Sync lets a paused copy flush the data written so far.
+func (w destWriter) Sync() error { return w.dest.Sync() }
@@ -0,0 +1,159 @@
+package flasher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DeviceDetails describes a block device beyond what a device list
+// usually shows, to tell a flash target from a system disk with
+// confidence. Fields that cannot be read are left empty.
+type DeviceDetails struct {
+	// Path is the device node, Name its kernel name (sdb, mmcblk0).
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	Vendor string `json:"vendor,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Serial string `json:"serial,omitempty"`
+	// WWN is the World Wide Name of the device, e.g. "naa.5000c500a1b2c3d4".
+	WWN string `json:"wwn,omitempty"`
+	// NVMe is set for an NVMe namespace whose controller answered the
+	// Identify commands, which needs read access to the device.
+	NVMe *NVMeInfo `json:"nvme,omitempty"`
+
+	Removable  bool `json:"removable"`
+	Rotational bool `json:"rotational"`
+	ReadOnly   bool `json:"read_only"`
+	// LogicalSectorSize and PhysicalSectorSize are in bytes.
+	LogicalSectorSize  int `json:"logical_sector_size,omitempty"`
+	PhysicalSectorSize int `json:"physical_sector_size,omitempty"`
+
+	// Holders are the devices built on top of this one, e.g. dm-0 for
+	// LVM or dm-crypt, md0 for RAID.
+	Holders     []string `json:"holders"`
+	Mountpoints []string `json:"mountpoints"`
+	// Filesystem is set for a device without partition table.
+	Filesystem *FilesystemDetails `json:"filesystem,omitempty"`
+	Partitions []PartitionDetails `json:"partitions"`
+	// USB is set for a device attached through USB.
+	USB *USBDetails `json:"usb,omitempty"`
+}
+
+// PartitionDetails describes a partition of a device.
+type PartitionDetails struct {
+	Path   string `json:"path"`
+	Number int    `json:"number"`
+	// Start and Size are in bytes.
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+	// Name and UUID are the GPT partition name and unique GUID (or the
+	// MBR disk signature followed by the partition number).
+	Name        string             `json:"name,omitempty"`
+	UUID        string             `json:"uuid,omitempty"`
+	Filesystem  *FilesystemDetails `json:"filesystem,omitempty"`
+	Holders     []string           `json:"holders"`
+	Mountpoints []string           `json:"mountpoints"`
+}
+
+// FilesystemDetails identifies a filesystem, as blkid does.
+type FilesystemDetails struct {
+	// Type is e.g. "ext4", "vfat", "exfat", "ntfs", "swap".
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+	UUID  string `json:"uuid,omitempty"`
+}
+
+// USBDetails locates a USB device in the USB topology.
+type USBDetails struct {
+	// Bus is the USB bus number; Port the port path, e.g. "2-1.3" for
+	// port 3 of the hub on port 1 of bus 2.
+	Bus  int    `json:"bus"`
+	Port string `json:"port"`
+	// VendorID and ProductID are hexadecimal, e.g. "0bda" and "9210".
+	VendorID     string `json:"vendor_id"`
+	ProductID    string `json:"product_id"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	// Speed is the negotiated speed in Mbit/s (480 for USB 2.0).
+	Speed int `json:"speed,omitempty"`
+	// Hubs are the port paths of the hubs between the device and the
+	// host, the nearest first.
+	Hubs []string `json:"hubs"`
+}
+
+// ProbeFilesystem identifies the filesystem at the start of r from its
+// signature, or returns nil if it is not recognized.
+func ProbeFilesystem(r io.ReaderAt) *FilesystemDetails {
+	read := func(off int64, n int) []byte {
+		b := make([]byte, n)
+		if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+			return nil
+		}
+		return b
+	}
+	if sb := read(1024, 256); len(sb) == 256 && binary.LittleEndian.Uint16(sb[56:]) == 0xef53 {
+		fsType := "ext2"
+		switch {
+		case binary.LittleEndian.Uint32(sb[96:])&0x2c0 != 0: // extents, 64bit, flex_bg
+			fsType = "ext4"
+		case binary.LittleEndian.Uint32(sb[92:])&0x4 != 0: // has_journal
+			fsType = "ext3"
+		}
+		u := sb[104:120]
+		return &FilesystemDetails{Type: fsType, Label: cString(sb[120:136]),
+			UUID: fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])}
+	}
+	boot := read(0, 512)
+	if len(boot) < 512 {
+		return nil
+	}
+	switch {
+	case bytes.Equal(boot[3:11], []byte("EXFAT   ")):
+		return &FilesystemDetails{Type: "exfat", UUID: fmt.Sprintf("%04X-%04X", binary.LittleEndian.Uint16(boot[102:]), binary.LittleEndian.Uint16(boot[100:]))}
+	case bytes.Equal(boot[3:11], []byte("NTFS    ")):
+		return &FilesystemDetails{Type: "ntfs", UUID: fmt.Sprintf("%016X", binary.LittleEndian.Uint64(boot[72:]))}
+	case bytes.Equal(boot[82:87], []byte("FAT32")):
+		return fatDetails(boot[67:71], boot[71:82])
+	case bytes.Equal(boot[54:59], []byte("FAT12")), bytes.Equal(boot[54:59], []byte("FAT16")):
+		return fatDetails(boot[39:43], boot[43:54])
+	case bytes.Equal(boot[0:4], []byte("XFSB")):
+		return &FilesystemDetails{Type: "xfs", Label: cString(boot[108:120])}
+	case bytes.Equal(boot[0:4], []byte("hsqs")):
+		return &FilesystemDetails{Type: "squashfs"}
+	}
+	if b := read(0x10040, 8); bytes.Equal(b, []byte("_BHRfS_M")) {
+		return &FilesystemDetails{Type: "btrfs"}
+	}
+	if b := read(0x8001, 5); bytes.Equal(b, []byte("CD001")) {
+		return &FilesystemDetails{Type: "iso9660"}
+	}
+	if b := read(4096-10, 10); bytes.Equal(b, []byte("SWAPSPACE2")) {
+		return &FilesystemDetails{Type: "swap"}
+	}
+	return nil
+}
+
+// fatDetails returns the details of a FAT filesystem with the given
+// volume serial and label fields of its boot sector.
+func fatDetails(serial, label []byte) *FilesystemDetails {
+	l := strings.TrimSpace(string(label))
+	if l == "NO NAME" {
+		l = ""
+	}
+	return &FilesystemDetails{Type: "vfat", Label: l,
+		UUID: fmt.Sprintf("%04X-%04X", binary.LittleEndian.Uint16(serial[2:]), binary.LittleEndian.Uint16(serial[0:]))}
+}
+
+// cString returns b up to its first NUL byte.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
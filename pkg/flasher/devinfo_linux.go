@@ -0,0 +1,234 @@
+package flasher
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReadDeviceDetails returns the details of the block device at path, e.g.
+// /dev/sdb or a /dev/disk/by-id link, read from sysfs, the udev database
+// and the mount table. Filesystems unknown to udev are probed, which needs
+// read access to the device.
+func ReadDeviceDetails(path string) (*DeviceDetails, error) {
+	return sysRoot("/").details(path)
+}
+
+// sysRoot is the root of the sysfs, /run/udev and /proc trees, a
+// directory other than "/" in tests.
+type sysRoot string
+
+func (r sysRoot) path(elem ...string) string {
+	return filepath.Join(append([]string{string(r)}, elem...)...)
+}
+
+// read returns the trimmed content of a sysfs attribute, or "".
+func (r sysRoot) read(elem ...string) string {
+	data, err := os.ReadFile(r.path(elem...))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readInt returns a numeric sysfs attribute, or 0.
+func (r sysRoot) readInt(elem ...string) int64 {
+	n, _ := strconv.ParseInt(r.read(elem...), 10, 64)
+	return n
+}
+
+func (r sysRoot) details(path string) (*DeviceDetails, error) {
+	node, err := filepath.EvalSymlinks(r.path(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", path, err)
+	}
+	name := filepath.Base(node)
+	block := filepath.Join("sys", "class", "block", name)
+	if _, err := os.Stat(r.path(block)); err != nil {
+		return nil, fmt.Errorf("%s is not a block device: %w", path, err)
+	}
+	if _, err := os.Stat(r.path(block, "partition")); err == nil {
+		return nil, fmt.Errorf("%s is a partition, not a whole device", path)
+	}
+	mounts := r.mounts()
+	udev := r.udev(block)
+	d := &DeviceDetails{
+		Path:               "/dev/" + name,
+		Name:               name,
+		Size:               r.readInt(block, "size") * 512,
+		Vendor:             r.read(block, "device", "vendor"),
+		Model:              r.read(block, "device", "model"),
+		Serial:             r.read(block, "device", "serial"),
+		WWN:                r.read(block, "device", "wwid"),
+		Removable:          r.read(block, "removable") == "1",
+		Rotational:         r.read(block, "queue", "rotational") == "1",
+		ReadOnly:           r.read(block, "ro") == "1",
+		LogicalSectorSize:  int(r.readInt(block, "queue", "logical_block_size")),
+		PhysicalSectorSize: int(r.readInt(block, "queue", "physical_block_size")),
+		Holders:            r.holders(block),
+		Mountpoints:        mounts[r.read(block, "dev")],
+		Partitions:         []PartitionDetails{},
+	}
+	if d.Model == "" {
+		// Le schede SD e MMC espongono il nome al posto del modello.
+		d.Model = r.read(block, "device", "name")
+	}
+	if d.Vendor == "" {
+		d.Vendor = udev["ID_VENDOR"]
+	}
+	if d.Model == "" {
+		d.Model = udev["ID_MODEL"]
+	}
+	if d.Serial == "" {
+		d.Serial = udev["ID_SERIAL_SHORT"]
+	}
+	if d.WWN == "" {
+		d.WWN = udev["ID_WWN"]
+	}
+
+	entries, _ := os.ReadDir(r.path(block))
+	for _, e := range entries {
+		part := filepath.Join(block, e.Name())
+		number := r.readInt(part, "partition")
+		if number == 0 {
+			continue
+		}
+		pudev := r.udev(part)
+		p := PartitionDetails{
+			Path:        "/dev/" + e.Name(),
+			Number:      int(number),
+			Start:       r.readInt(part, "start") * 512,
+			Size:        r.readInt(part, "size") * 512,
+			Name:        pudev["ID_PART_ENTRY_NAME"],
+			UUID:        pudev["ID_PART_ENTRY_UUID"],
+			Filesystem:  r.filesystem(pudev, e.Name()),
+			Holders:     r.holders(part),
+			Mountpoints: mounts[r.read(part, "dev")],
+		}
+		d.Partitions = append(d.Partitions, p)
+	}
+	slices.SortFunc(d.Partitions, func(a, b PartitionDetails) int { return a.Number - b.Number })
+	if len(d.Partitions) == 0 {
+		d.Filesystem = r.filesystem(udev, name)
+	}
+	d.USB = r.usb(block)
+	if IsNVMeNamespace(name) {
+		d.NVMe, _ = NVMeIdentify(r.path("dev", name))
+	}
+	return d, nil
+}
+
+// udev returns the properties of the device in the udev database.
+func (r sysRoot) udev(block string) map[string]string {
+	props := map[string]string{}
+	data, err := os.ReadFile(r.path("run", "udev", "data", "b"+r.read(block, "dev")))
+	if err != nil {
+		return props
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if kv, ok := strings.CutPrefix(line, "E:"); ok {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				props[k] = v
+			}
+		}
+	}
+	return props
+}
+
+// filesystem returns the filesystem known to udev, or else the one
+// probed on the device node name.
+func (r sysRoot) filesystem(udev map[string]string, name string) *FilesystemDetails {
+	if t := udev["ID_FS_TYPE"]; t != "" {
+		return &FilesystemDetails{Type: t, Label: udev["ID_FS_LABEL"], UUID: udev["ID_FS_UUID"]}
+	}
+	f, err := os.Open(r.path("dev", name))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return ProbeFilesystem(f)
+}
+
+// holders returns the devices holding the device.
+func (r sysRoot) holders(block string) []string {
+	holders := []string{}
+	entries, _ := os.ReadDir(r.path(block, "holders"))
+	for _, e := range entries {
+		holders = append(holders, e.Name())
+	}
+	return holders
+}
+
+// mounts returns the mount points of each device number ("8:17") from
+// the mount table.
+func (r sysRoot) mounts() map[string][]string {
+	mounts := map[string][]string{}
+	f, err := os.Open(r.path("proc", "self", "mountinfo"))
+	if err != nil {
+		return mounts
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts[fields[2]] = append(mounts[fields[2]], unescapeMount(fields[4]))
+	}
+	return mounts
+}
+
+// unescapeMount decodes the octal escapes (\040 for a space) of a path in
+// the mount table.
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// usb walks up the sysfs path of the device to the USB device it belongs
+// to, and the hubs above it.
+func (r sysRoot) usb(block string) *USBDetails {
+	dir, err := filepath.EvalSymlinks(r.path(block))
+	if err != nil {
+		return nil
+	}
+	var u *USBDetails
+	root := filepath.Clean(r.path("sys", "devices"))
+	for ; strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "idVendor")); err != nil {
+			continue
+		}
+		if u == nil {
+			rel, _ := filepath.Rel(string(r), dir)
+			u = &USBDetails{
+				Bus:          int(r.readInt(rel, "busnum")),
+				Port:         filepath.Base(dir),
+				VendorID:     r.read(rel, "idVendor"),
+				ProductID:    r.read(rel, "idProduct"),
+				Manufacturer: r.read(rel, "manufacturer"),
+				Product:      r.read(rel, "product"),
+				Serial:       r.read(rel, "serial"),
+				Speed:        int(r.readInt(rel, "speed")),
+				Hubs:         []string{},
+			}
+			continue
+		}
+		u.Hubs = append(u.Hubs, filepath.Base(dir))
+	}
+	return u
+}
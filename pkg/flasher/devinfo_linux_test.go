@@ -0,0 +1,132 @@
+package flasher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTree crea i file di files sotto root e i collegamenti simbolici di
+// links.
+func writeTree(t *testing.T, root string, files, links map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReadDeviceDetails verifica i dettagli letti da un albero sysfs
+// simulato di una chiavetta USB dietro un hub.
+func TestReadDeviceDetails(t *testing.T) {
+	root := t.TempDir()
+	usb := "sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1.3"
+	scsi := usb + "/2-1.3:1.0/host6/target6:0:0/6:0:0:0"
+	sdb := scsi + "/block/sdb"
+
+	// Un superblocco ext4 per la partizione che udev non conosce.
+	ext := make([]byte, 2048)
+	binary.LittleEndian.PutUint16(ext[1024+56:], 0xef53)
+	binary.LittleEndian.PutUint32(ext[1024+96:], 0x40)
+	copy(ext[1024+104:], bytes.Repeat([]byte{0xab}, 16))
+	copy(ext[1024+120:], "rootfs")
+
+	writeTree(t, root, map[string]string{
+		usb + "/idVendor":     "0781",
+		usb + "/idProduct":    "5583",
+		usb + "/manufacturer": "SanDisk",
+		usb + "/product":      "Ultra Fit",
+		usb + "/serial":       "4C530001",
+		usb + "/busnum":       "2",
+		usb + "/speed":        "480",
+		"sys/devices/pci0000:00/0000:00:14.0/usb2/2-1/idVendor": "05e3",
+		"sys/devices/pci0000:00/0000:00:14.0/usb2/idVendor":     "1d6b",
+		scsi + "/vendor":                   "SanDisk ",
+		scsi + "/model":                    "Ultra Fit       ",
+		sdb + "/dev":                       "8:16",
+		sdb + "/size":                      "61056",
+		sdb + "/removable":                 "1",
+		sdb + "/ro":                        "0",
+		sdb + "/queue/rotational":          "0",
+		sdb + "/queue/logical_block_size":  "512",
+		sdb + "/queue/physical_block_size": "512",
+		sdb + "/sdb1/partition":            "1",
+		sdb + "/sdb1/dev":                  "8:17",
+		sdb + "/sdb1/start":                "8192",
+		sdb + "/sdb1/size":                 "1024",
+		sdb + "/sdb2/partition":            "2",
+		sdb + "/sdb2/dev":                  "8:18",
+		sdb + "/sdb2/start":                "9216",
+		sdb + "/sdb2/size":                 "51840",
+		sdb + "/sdb2/holders/dm-0/dev":     "253:0",
+		"run/udev/data/b8:16":              "E:ID_SERIAL_SHORT=4C530001\nE:ID_WWN=0x5000000000000001\n",
+		"run/udev/data/b8:17":              "E:ID_FS_TYPE=vfat\nE:ID_FS_LABEL=bootfs\nE:ID_FS_UUID=1234-ABCD\nE:ID_PART_ENTRY_UUID=deadbeef-01\n",
+		"dev/sdb2":                         string(ext),
+		"proc/self/mountinfo":              "36 25 8:17 / /media/boot\\040fs rw - vfat /dev/sdb1 rw\n37 25 8:1 / / rw - ext4 /dev/sda1 rw\n",
+	}, map[string]string{
+		"sys/class/block/sdb":                  "../../../" + sdb,
+		"sys/class/block/sdb1":                 "../../../" + sdb + "/sdb1",
+		sdb + "/device":                        "../../../6:0:0:0",
+		"dev/disk/by-id/usb-SanDisk_Ultra_Fit": "../../sdb",
+	})
+	for _, name := range []string{"dev/sdb", "dev/sdb1"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := sysRoot(root).details("/dev/disk/by-id/usb-SanDisk_Ultra_Fit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/dev/sdb" || d.Size != 61056*512 || d.Vendor != "SanDisk" || d.Model != "Ultra Fit" {
+		t.Errorf("Dettagli del dispositivo errati. Got: %+v", d)
+	}
+	if d.Serial != "4C530001" || d.WWN != "0x5000000000000001" || !d.Removable || d.Rotational || d.PhysicalSectorSize != 512 {
+		t.Errorf("Seriale, WWN o flag errati. Got: %+v", d)
+	}
+	if len(d.Partitions) != 2 {
+		t.Fatalf("Attese 2 partizioni. Got: %+v", d.Partitions)
+	}
+	p1, p2 := d.Partitions[0], d.Partitions[1]
+	if p1.Start != 8192*512 || p1.Filesystem == nil || *p1.Filesystem != (FilesystemDetails{Type: "vfat", Label: "bootfs", UUID: "1234-ABCD"}) {
+		t.Errorf("Prima partizione errata. Got: %+v %+v", p1, p1.Filesystem)
+	}
+	if len(p1.Mountpoints) != 1 || p1.Mountpoints[0] != "/media/boot fs" {
+		t.Errorf("Punto di mount errato. Got: %v", p1.Mountpoints)
+	}
+	want := FilesystemDetails{Type: "ext4", Label: "rootfs", UUID: "abababab-abab-abab-abab-abababababab"}
+	if p2.Filesystem == nil || *p2.Filesystem != want {
+		t.Errorf("Il filesystem della seconda partizione dovrebbe essere rilevato dal superblocco. Got: %+v", p2.Filesystem)
+	}
+	if len(p2.Holders) != 1 || p2.Holders[0] != "dm-0" {
+		t.Errorf("Holder errati. Got: %v", p2.Holders)
+	}
+	if d.USB == nil {
+		t.Fatal("Il dispositivo dovrebbe risultare collegato via USB")
+	}
+	if d.USB.Port != "2-1.3" || d.USB.Bus != 2 || d.USB.VendorID != "0781" || d.USB.Speed != 480 || len(d.USB.Hubs) != 2 || d.USB.Hubs[0] != "2-1" {
+		t.Errorf("Topologia USB errata. Got: %+v", d.USB)
+	}
+
+	if _, err := sysRoot(root).details("/dev/sdb1"); err == nil || !strings.Contains(err.Error(), "partition") {
+		t.Errorf("Una partizione non dovrebbe essere accettata. Got: %v", err)
+	}
+}
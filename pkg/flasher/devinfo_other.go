@@ -0,0 +1,13 @@
+//go:build !linux
+
+package flasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ReadDeviceDetails is only implemented on Linux.
+func ReadDeviceDetails(path string) (*DeviceDetails, error) {
+	return nil, fmt.Errorf("could not read the details of %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,21 @@
+package flasher
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// diocgmediasize is the DIOCGMEDIASIZE ioctl, which returns the size of a
+// GEOM provider in bytes.
+const diocgmediasize = 0x40086481
+
+// DeviceSize returns the capacity in bytes of the device f. Disk devices
+// are character devices on FreeBSD, whose end cannot be sought.
+func DeviceSize(f *os.File) (int64, error) {
+	var size int64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), diocgmediasize, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return size, nil
+}
@@ -0,0 +1,28 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// diocgpdinfo is the DIOCGPDINFO ioctl, which returns the disklabel the
+// driver builds from the device geometry, and disklabelSize the size of
+// struct disklabel.
+const (
+	diocgpdinfo   = 0x41946472
+	disklabelSize = 404
+)
+
+// DeviceSize returns the capacity in bytes of the device f, a raw disk
+// like /dev/rsd1c, from its disklabel.
+func DeviceSize(f *os.File) (int64, error) {
+	var label [disklabelSize]byte
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), diocgpdinfo, uintptr(unsafe.Pointer(&label[0]))); errno != 0 {
+		return 0, errno
+	}
+	secsize := int64(binary.NativeEndian.Uint32(label[40:]))
+	sectors := int64(binary.NativeEndian.Uint16(label[112:]))<<32 | int64(binary.NativeEndian.Uint32(label[60:]))
+	return secsize * sectors, nil
+}
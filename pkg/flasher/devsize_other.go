@@ -0,0 +1,14 @@
+//go:build !freebsd && !openbsd
+
+package flasher
+
+import (
+	"io"
+	"os"
+)
+
+// DeviceSize returns the capacity in bytes of the device f. Seeking to
+// the end of a block device gives its size on Linux, macOS and Windows.
+func DeviceSize(f *os.File) (int64, error) {
+	return f.Seek(0, io.SeekEnd)
+}
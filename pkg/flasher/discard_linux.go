@@ -0,0 +1,26 @@
+package flasher
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The discard ioctls of Linux: BLKDISCARD tells the device that a range
+// is unused, BLKSECDISCARD also asks it to erase every copy of the data.
+const (
+	blkdiscard    = 0x1277
+	blksecdiscard = 0x127d
+)
+
+// discardRange discards n bytes at offset off of the block device fd.
+func discardRange(fd uintptr, off, n int64, secure bool) error {
+	req := uintptr(blkdiscard)
+	if secure {
+		req = blksecdiscard
+	}
+	r := [2]uint64{uint64(off), uint64(n)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package flasher
+
+import "errors"
+
+// discardRange is only implemented on Linux.
+func discardRange(fd uintptr, off, n int64, secure bool) error {
+	return errors.ErrUnsupported
+}
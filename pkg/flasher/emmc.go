@@ -0,0 +1,47 @@
+package flasher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sysBlockDir is where the kernel lists the block devices.
+var sysBlockDir = "/sys/class/block"
+
+// bootPartitionName matches the hardware boot partitions of an eMMC.
+var bootPartitionName = regexp.MustCompile(`^mmcblk\d+boot\d+$`)
+
+// IsBootPartition reports whether path is a hardware boot partition of an
+// eMMC, like /dev/mmcblk0boot0, where i.MX and Rockchip boards can load
+// their bootloader from. The kernel exposes them read-only.
+func IsBootPartition(path string) bool {
+	return bootPartitionName.MatchString(filepath.Base(path))
+}
+
+// unlockBootPartition makes the eMMC boot partition at path writable by
+// clearing its force_ro flag, and returns the function that sets it again.
+// It returns a nil function for any other device, or if the flag is
+// already clear.
+func unlockBootPartition(path string) (restore func() error, err error) {
+	if !IsBootPartition(path) {
+		return nil, nil
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	flag := filepath.Join(sysBlockDir, filepath.Base(path), "force_ro")
+	data, err := os.ReadFile(flag)
+	if os.IsNotExist(err) || strings.TrimSpace(string(data)) == "0" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(flag, []byte("0"), 0o644); err != nil {
+		return nil, fmt.Errorf("could not make the eMMC boot partition %s writable: %w", path, err)
+	}
+	return func() error { return os.WriteFile(flag, []byte("1"), 0o644) }, nil
+}
@@ -0,0 +1,47 @@
+package flasher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestBootPartition verifica che una partizione di boot eMMC sia resa
+// scrivibile per la scrittura e di nuovo di sola lettura alla chiusura.
+func TestBootPartition(t *testing.T) {
+	for path, want := range map[string]bool{"/dev/mmcblk0boot0": true, "/dev/mmcblk1boot1": true, "/dev/mmcblk0": false, "/dev/mmcblk0p1": false, "/dev/sdb": false} {
+		if IsBootPartition(path) != want {
+			t.Errorf("IsBootPartition(%s) = %t, want %t", path, !want, want)
+		}
+	}
+
+	dir := t.TempDir()
+	saved := sysBlockDir
+	sysBlockDir = filepath.Join(dir, "sys")
+	t.Cleanup(func() { sysBlockDir = saved })
+	flag := filepath.Join(sysBlockDir, "mmcblk0boot0", "force_ro")
+	if err := os.MkdirAll(filepath.Dir(flag), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(flag, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	device := filepath.Join(dir, "mmcblk0boot0")
+	if err := os.WriteFile(device, make([]byte, 4096), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := openDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(flag); string(data) != "0" {
+		t.Errorf("force_ro dovrebbe essere 0 durante la scrittura. Got: %q", data)
+	}
+	if err := dest.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(flag); string(data) != "1" {
+		t.Errorf("force_ro dovrebbe tornare 1 alla chiusura. Got: %q", data)
+	}
+}
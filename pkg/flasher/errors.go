@@ -0,0 +1,59 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Errors identifying the classes of failure of a flash. They are wrapped
+// with context where they happen: match them with errors.Is.
+var (
+	// ErrDeviceBusy means the device could not be opened exclusively.
+	ErrDeviceBusy = errors.New("device is busy")
+	// ErrDeviceMounted means the device or one of its partitions is
+	// mounted. The flasher does not check mounts itself: callers wrap it.
+	ErrDeviceMounted = errors.New("device is mounted")
+	// ErrDeviceTooSmall means the image does not fit on the device.
+	ErrDeviceTooSmall = errors.New("device is too small for the image")
+	// ErrDeviceRemoved means the device disappeared during the flash.
+	ErrDeviceRemoved = errors.New("device was removed")
+	// ErrUserCancelled is returned by Flasher.Confirm when the user does
+	// not confirm the flash.
+	ErrUserCancelled = errors.New("operation cancelled by the user")
+	// ErrWrite means writing or syncing the device failed.
+	ErrWrite = errors.New("error while writing to device")
+	// ErrVerifyFailed means the data read back differs from the image.
+	ErrVerifyFailed = errors.New("verification failed")
+	// ErrChecksumMismatch means the image does not match Flasher.Checksum.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrHookFailed means a hook of Flasher.Hooks returned an error.
+	ErrHookFailed = errors.New("hook failed")
+	// ErrStepFailed means a customization Step returned an error.
+	ErrStepFailed = errors.New("customization step failed")
+	// ErrNotBootable means the check of CheckBoot found that the device
+	// would not boot.
+	ErrNotBootable = errors.New("device would not boot")
+	// ErrTimeout means the flash did not complete within Flasher.Timeout.
+	ErrTimeout = errors.New("operation timed out")
+)
+
+// checkRemoved wraps err, an I/O error on device, with ErrDeviceRemoved
+// when the device is gone: unplugged media fail with ENODEV or ENXIO, or
+// with EIO once their node has been deleted.
+func checkRemoved(device string, err error) error {
+	if err == nil {
+		return nil
+	}
+	gone := false
+	if schemeOf(device) == "" {
+		_, statErr := os.Stat(device)
+		gone = errors.Is(statErr, fs.ErrNotExist)
+	}
+	if gone || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("%w: %s: %w", ErrDeviceRemoved, device, err)
+	}
+	return err
+}
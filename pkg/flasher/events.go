@@ -0,0 +1,92 @@
+package flasher
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is a step in the life of a flash.
+type EventType string
+
+// The lifecycle events of Flasher.Flash, in the order they happen. A flash
+// ends with EventCompleted or EventFailed; the events in between are
+// published only if the flash gets that far.
+const (
+	// EventValidated: the destination is open and the image fits on it.
+	EventValidated EventType = "validated"
+	// EventConfirmed: Confirm accepted the flash (or there is no Confirm).
+	EventConfirmed EventType = "confirmed"
+	// EventWriteStarted: the image is about to be written.
+	EventWriteStarted EventType = "write-started"
+	// EventSynced: the image is written and synced to the device.
+	EventSynced EventType = "synced"
+	// EventVerifyStarted: the device is about to be read back.
+	EventVerifyStarted EventType = "verify-started"
+	// EventCompleted: the flash succeeded.
+	EventCompleted EventType = "completed"
+	// EventFailed: the flash failed, Event.Err tells why.
+	EventFailed EventType = "failed"
+)
+
+// Event is published on a Flasher's EventBus.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Device string
+	// Bytes is the number of bytes written so far.
+	Bytes int64
+	// Err is the error of an EventFailed.
+	Err error
+}
+
+// Subscriber receives the events published on an EventBus.
+type Subscriber interface {
+	HandleEvent(Event)
+}
+
+// SubscriberFunc adapts a function to the Subscriber interface.
+type SubscriberFunc func(Event)
+
+// HandleEvent calls fn(e).
+func (fn SubscriberFunc) HandleEvent(e Event) { fn(e) }
+
+// EventBus delivers events to its subscribers, synchronously and in the
+// order they were subscribed: subscribers must return quickly. The zero
+// value is ready to use and may be shared by several Flashers.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs []*subscription
+}
+
+type subscription struct{ s Subscriber }
+
+// Subscribe adds s to the bus. The returned function removes it.
+func (b *EventBus) Subscribe(s Subscriber) (unsubscribe func()) {
+	sub := &subscription{s}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, other := range b.subs {
+			if other == sub {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers e to every subscriber, setting its Time if it is zero.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, sub := range subs {
+		sub.s.HandleEvent(e)
+	}
+}
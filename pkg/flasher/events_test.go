@@ -0,0 +1,46 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestFlashEvents verifica la sequenza degli eventi di una scrittura
+// riuscita e di una annullata alla conferma.
+func TestFlashEvents(t *testing.T) {
+	var bus EventBus
+	var got []EventType
+	unsubscribe := bus.Subscribe(SubscriberFunc(func(e Event) { got = append(got, e.Type) }))
+
+	dest := &memDest{data: make([]byte, 16)}
+	RegisterDestination("eventtest", func(string) (Destination, error) { return dest, nil })
+	f := &Flasher{Verify: true, Events: &bus}
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "eventtest://device"); err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	want := []EventType{EventValidated, EventConfirmed, EventWriteStarted, EventSynced, EventVerifyStarted, EventCompleted}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Eventi errati. Got: %v, Want: %v", got, want)
+	}
+
+	got = nil
+	var failure error
+	bus.Subscribe(SubscriberFunc(func(e Event) { failure = e.Err }))
+	f.Confirm = func() error { return ErrUserCancelled }
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "eventtest://device"); !errors.Is(err, ErrUserCancelled) {
+		t.Fatalf("Flash dovrebbe restituire ErrUserCancelled. Got: %v", err)
+	}
+	if want := []EventType{EventValidated, EventFailed}; !reflect.DeepEqual(got, want) || !errors.Is(failure, ErrUserCancelled) {
+		t.Errorf("Eventi errati. Got: %v (%v), Want: %v", got, failure, want)
+	}
+
+	unsubscribe()
+	got = nil
+	bus.Publish(Event{Type: EventCompleted})
+	if len(got) != 0 {
+		t.Errorf("Un iscritto rimosso ha ricevuto eventi: %v", got)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// SendFile passes the descriptor of f over the Unix socket sock, e.g. from
+// a privileged helper that opened a device to the process that writes it.
+func SendFile(sock, f *os.File) error {
+	return syscall.Sendmsg(int(sock.Fd()), []byte{0}, syscall.UnixRights(int(f.Fd())), nil, 0)
+}
+
+// ReceiveFile receives a descriptor sent over the Unix socket sock, as by
+// SendFile or by macOS authopen, and returns it as a file named name.
+func ReceiveFile(sock *os.File, name string) (*os.File, error) {
+	buf, oob := make([]byte, 1), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(sock.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not receive %s: %w", name, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("could not receive %s: %w", name, err)
+	}
+	for _, msg := range msgs {
+		if fds, err := syscall.ParseUnixRights(&msg); err == nil && len(fds) > 0 {
+			return os.NewFile(uintptr(fds[0]), name), nil
+		}
+	}
+	return nil, fmt.Errorf("could not receive %s: %w", name, errors.New("no descriptor sent"))
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package flasher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestSendFile verifica il passaggio di un descrittore su un socket Unix.
+func TestSendFile(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := os.NewFile(uintptr(fds[0]), "a"), os.NewFile(uintptr(fds[1]), "b")
+	defer a.Close()
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SendFile(a, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	got, err := ReceiveFile(b, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Close()
+	if _, err := got.WriteString("ciao"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "ciao" {
+		t.Errorf("La scrittura sul descrittore ricevuto non è arrivata al file. Got: %q", data)
+	}
+
+	// Un messaggio senza descrittore è un errore.
+	if _, err := a.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReceiveFile(b, path); err == nil {
+		t.Error("Un messaggio senza descrittore dovrebbe restituire un errore")
+	}
+}
@@ -0,0 +1,574 @@
+// Package flasher writes disk images to block devices: the copy loop,
+// the read-back verification and the progress reporting used by the
+// sflashy command, in a form that other Go programs can embed.
+//
+//	src, err := flasher.OpenImage("raspios.img.xz", flasher.OpenOptions{})
+//	...
+//	defer src.Close()
+//	f := &flasher.Flasher{Verify: true, Output: os.Stderr}
+//	res, err := f.Flash(ctx, src, "/dev/sdb")
+package flasher
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBlockSize is the size of the blocks written to the device when
+// Flasher.BlockSize is not set.
+const DefaultBlockSize = 32 * 1024 * 1024 // 32MB come in dd bs=32M
+
+// discardLogger is used when Flasher.Logger is nil.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Colors are the ANSI sequences used in Output. The zero value prints
+// no colors.
+type Colors struct {
+	Progress, Success, Reset string
+}
+
+// Flasher writes images to block devices. The zero value writes the whole
+// image in DefaultBlockSize blocks and prints nothing; the fields tune it
+// and must not be changed while a flash is running.
+type Flasher struct {
+	// BlockSize is the size of each write (DefaultBlockSize if 0).
+	BlockSize int
+	// Pad fills the last partial block with zeros (dd conv=sync).
+	Pad bool
+	// Skip is the number of bytes skipped at the start of the image.
+	Skip int64
+	// Seek is the device offset, in bytes, where writing starts.
+	Seek int64
+	// Count limits the number of bytes written (0 for the whole image).
+	Count int64
+	// Align is the logical sector size of the device, when it must be
+	// respected (see ApplyQuirk): Seek must be a multiple of it, the
+	// blocks are rounded up to it and the last one is padded with zeros.
+	Align int
+	// NoFlush does not sync the device when the copy is paused, for the
+	// bridges that hang on cache flushes in the middle of a write; the
+	// device is still synced at the end.
+	NoFlush bool
+	// SkipFree makes Backup read only the blocks in use by the ext2/3/4,
+	// FAT and NTFS filesystems of the device, and zeros in place of the
+	// free ones; the partition table, the gaps between the partitions and
+	// the other filesystems are read whole.
+	SkipFree bool
+	// Trim makes Backup stop at the end of the last partition, when the
+	// device has a partition table, and leave out the zeros at the end of
+	// the image, but for those that complete its last sector.
+	Trim bool
+
+	// Hash creates the hash of the digest computed while writing, which
+	// the verification compares with the data read back (SHA-256 if nil).
+	Hash func() hash.Hash
+	// Checksum is the expected hexadecimal digest, computed with Hash, of
+	// the written data. A raw image file is checked before the device is
+	// opened, a streamed image once it is written.
+	Checksum string
+	// Verify reads the device back and compares it with the image.
+	Verify bool
+	// Timeout aborts the flash when writing, syncing and verifying take
+	// longer than this (0 for no limit).
+	Timeout time.Duration
+	// Retry retries the failed reads of the image and writes to the device
+	// (no retry if zero). Retries are logged when Retry.OnRetry is nil.
+	Retry RetryPolicy
+
+	// Confirm, if set, is called once the device has been opened and
+	// before anything is written to it; an error, ErrUserCancelled when
+	// the user declines, aborts the flash.
+	Confirm func() error
+	// Pauser, if set, can suspend the copy between two blocks; one is
+	// created by the first call to Pause or Resume otherwise.
+	Pauser *Pauser
+
+	// Output receives the progress and the messages meant for a human;
+	// nil discards them.
+	Output io.Writer
+	// Colors are used in Output.
+	Colors Colors
+	// ProgressStep is how many bytes are copied between two redraws of
+	// the progress on a terminal (DefaultProgressStep if 0).
+	ProgressStep int64
+	// FormatSize formats the sizes shown in the progress (FormatGiB if nil).
+	FormatSize func(uint64) string
+	// OnProgress, if set, is called with the progress every ProgressStep
+	// bytes and at the end of each phase, to draw a custom UI. It is
+	// called from the copying goroutine and must return quickly.
+	OnProgress func(Progress)
+	// Logger receives the operation log; nil discards it.
+	Logger *slog.Logger
+	// Events, if set, receives the lifecycle events of Flash.
+	Events *EventBus
+	// Tracer, if set, records the stages of Flash as spans.
+	Tracer Tracer
+	// Hooks run before the write, after the write and after the
+	// verification; their errors abort the flash.
+	Hooks Hooks
+	// Metadata is passed to the hooks, e.g. the image name or a work order.
+	Metadata map[string]string
+	// Steps customize the device once the image is written and, with
+	// Verify, verified; the device is synced again after them, before
+	// the post-verify hooks.
+	Steps []Step
+	// State, if set, records how far an interrupted flash got, once the
+	// data written so far is synced, and Continue makes the next flash of
+	// the same image to the same device resume from there.
+	State    StateStore
+	Continue bool
+
+	mu       sync.Mutex
+	progress *progressWriter // fase in corso, per Status
+}
+
+// Result describes a flash. Digest is nil when the image was not written
+// completely.
+type Result struct {
+	Bytes   int64
+	Digest  []byte // digest (Flasher.Hash) of the data read from the source
+	Elapsed time.Duration
+	// Verification is "passed", "FAILED" or "skipped".
+	Verification string
+}
+
+// WriteSize returns how many bytes of an image of imageSize bytes (0 if
+// unknown) are going to be written.
+func (f *Flasher) WriteSize(imageSize int64) int64 {
+	if imageSize == 0 {
+		return f.Count
+	}
+	size := max(imageSize-f.Skip, 0)
+	if f.Count > 0 && f.Count < size {
+		size = f.Count
+	}
+	return size
+}
+
+// Pause suspends a running flash before its next block: the data written
+// so far is flushed to the device first, so that it can be left paused
+// safely. It can be called before the flash starts; the verification
+// phase is not paused.
+func (f *Flasher) Pause() { f.pauser().Pause() }
+
+// Resume restarts a flash suspended by Pause.
+func (f *Flasher) Resume() { f.pauser().Resume() }
+
+// Paused reports whether the flash is paused, or about to be.
+func (f *Flasher) Paused() bool { return f.pauser().Paused() }
+
+// pauser returns f.Pauser, creating it if needed.
+func (f *Flasher) pauser() *Pauser {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Pauser == nil {
+		f.Pauser = NewPauser()
+	}
+	return f.Pauser
+}
+
+// Status returns a dd-like one-line summary of the phase in progress, or
+// an empty string when nothing is being copied.
+func (f *Flasher) Status() string {
+	f.mu.Lock()
+	pw := f.progress
+	f.mu.Unlock()
+	if pw == nil {
+		return ""
+	}
+	return pw.status()
+}
+
+// publish sends e to f.Events, if set.
+func (f *Flasher) publish(e Event) {
+	if f.Events != nil {
+		f.Events.Publish(e)
+	}
+}
+
+func (f *Flasher) output() io.Writer {
+	if f.Output == nil {
+		return io.Discard
+	}
+	return f.Output
+}
+
+func (f *Flasher) logger() *slog.Logger {
+	if f.Logger == nil {
+		return discardLogger
+	}
+	return f.Logger
+}
+
+// newProgress returns the progressWriter of a phase, configured from f and
+// reported by Status.
+func (f *Flasher) newProgress(label string, size int64, phase *progressPhase) *progressWriter {
+	pw := newProgressWriter(f.output(), label, size)
+	pw.phase, pw.step, pw.sizeFmt, pw.colors, pw.log = phase, f.ProgressStep, f.FormatSize, f.Colors, f.logger()
+	pw.onProgress = f.OnProgress
+	f.mu.Lock()
+	f.progress = pw
+	f.mu.Unlock()
+	return pw
+}
+
+// Flash writes src to the block device at device (or to the Destination
+// registered for its scheme or extension), syncs it and, when requested,
+// checks the checksum and reads the data back. Once ctx is done
+// the flash stops between two blocks: the data written so far is synced
+// and the returned error wraps the cause of ctx.
+func (f *Flasher) Flash(ctx context.Context, src *Source, device string) (res Result, err error) {
+	res = Result{Verification: "skipped"}
+	log := f.logger()
+	out := f.output()
+	ctx, span := f.startSpan(ctx, "flash")
+	span.SetAttribute(AttrDevice, device)
+	span.SetAttribute(AttrImageFormat, src.Format)
+	span.SetAttribute(AttrImageSize, src.Size)
+	defer func() {
+		span.SetAttribute(AttrBytes, res.Bytes)
+		span.End(err)
+		if err != nil {
+			f.publish(Event{Type: EventFailed, Device: device, Bytes: res.Bytes, Err: err})
+		} else {
+			f.publish(Event{Type: EventCompleted, Device: device, Bytes: res.Bytes})
+		}
+	}()
+
+	if f.Align > 0 && f.Seek%int64(f.Align) != 0 {
+		return res, fmt.Errorf("the offset %d is not a multiple of the %d-byte sectors of %s", f.Seek, f.Align, device)
+	}
+	checked, err := f.precheck(ctx, src, f.Skip, f.WriteSize(src.Size), f.Checksum)
+	if err != nil {
+		return res, err
+	}
+	dest, err := OpenDestination(device)
+	if err != nil {
+		return res, err
+	}
+	defer dest.Close()
+
+	var r io.Reader = src.Reader
+	if f.Skip > 0 {
+		if err := skipInput(ctx, r, f.Skip); err != nil {
+			return res, fmt.Errorf("could not skip %d bytes of the image: %w", f.Skip, err)
+		}
+	}
+	if f.Count > 0 {
+		r = io.LimitReader(r, f.Count)
+	}
+	// Solo una dimensione esatta basta a rifiutare il dispositivo.
+	size := f.WriteSize(src.Size)
+	if capacity := dest.Size(); capacity > 0 && src.Exact && f.Seek+size > capacity {
+		return res, fmt.Errorf("%w: the image needs %d bytes but %s has only %d", ErrDeviceTooSmall, f.Seek+size, device, capacity)
+	}
+	f.publish(Event{Type: EventValidated, Device: device})
+
+	if f.Confirm != nil {
+		if err := f.Confirm(); err != nil {
+			return res, err
+		}
+	}
+	f.publish(Event{Type: EventConfirmed, Device: device})
+
+	start := time.Now()
+	defer func() { res.Elapsed = time.Since(start) }()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	// Con la verifica i dati vengono percorsi due volte: il progresso e
+	// l'ETA mostrati coprono entrambe le fasi.
+	var writePhase, verifyPhase *progressPhase
+	if f.Verify && size > 0 {
+		writePhase = &progressPhase{Index: 1, Count: 2, Total: 2 * size, Start: start}
+		verifyPhase = &progressPhase{Index: 2, Count: 2, Done: size, Total: 2 * size, Start: start}
+	}
+	if err := f.runHooks(ctx, HookInfo{Stage: HookPreWrite, Device: device, Verification: res.Verification}); err != nil {
+		return res, err
+	}
+	st := &copyState{hasher: f.newHash()}
+	if f.State != nil && f.Continue {
+		if err := f.resume(ctx, r, dest, device, st); err != nil {
+			return res, err
+		}
+		if writePhase != nil {
+			writePhase.Done = st.written
+		}
+	}
+	f.publish(Event{Type: EventWriteStarted, Device: device})
+	wctx, wspan := f.startSpan(ctx, "write")
+	wstart, resumed := time.Now(), st.written
+	copied, err := f.copy(wctx, flashOp, r, destWriter{io.NewOffsetWriter(dest, f.Seek+st.written), dest}, max(size-st.written, 0), writePhase, st)
+	res.Bytes = copied.Bytes
+	wspan.SetAttribute(AttrReadSeconds, st.readTime.Seconds())
+	wspan.SetAttribute(AttrWriteSeconds, st.writeTime.Seconds())
+	endTransfer(wspan, copied.Bytes-resumed, wstart, err)
+	if errors.Is(err, ErrTimeout) {
+		f.checkpoint(dest, device, st)
+		return res, fmt.Errorf("%w: the write did not complete within %s (%d bytes written)", ErrTimeout, f.Timeout, copied.Bytes)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Il dispositivo resta a metà, ma i dati già scritti vengono
+		// scaricati così che si possa rimuovere senza attendere la cache.
+		fmt.Fprintln(out, "Interrupted, syncing the data written so far...")
+		f.checkpoint(dest, device, st)
+		return res, fmt.Errorf("write interrupted (%d bytes written): %w", copied.Bytes, err)
+	}
+	if err != nil {
+		f.checkpoint(dest, device, st)
+		return res, checkRemoved(device, err)
+	}
+	res.Digest = copied.Digest
+	log.Info("image written", "bytes", res.Bytes, "digest", hex.EncodeToString(res.Digest))
+
+	// Eseguiamo Sync sul file descriptor reale dopo che la copia ha terminato
+	fmt.Fprintln(out, "Finalizing write (syncing)...")
+	_, sspan := f.startSpan(ctx, "sync")
+	if err := dest.Sync(); err != nil {
+		err = checkRemoved(device, fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+		sspan.End(err)
+		return res, err
+	}
+	sspan.End(nil)
+	log.Debug("device synced")
+	if f.State != nil {
+		if err := f.State.Delete(checkpointKey(device)); err != nil {
+			log.Warn("could not delete the flash checkpoint", "err", err)
+		}
+	}
+	f.publish(Event{Type: EventSynced, Device: device, Bytes: res.Bytes})
+
+	// Un'immagine letta una sola volta si può confrontare con il checksum
+	// atteso solo dopo averla scritta.
+	if f.Checksum != "" && !checked {
+		if err := checkDigest(res.Digest, f.Checksum); err != nil {
+			return res, err
+		}
+		fmt.Fprintln(out, "Image checksum matches.")
+	}
+	info := HookInfo{Stage: HookPostWrite, Device: device, Bytes: res.Bytes, Digest: res.Digest, Verification: res.Verification}
+	if err := f.runHooks(ctx, info); err != nil {
+		return res, err
+	}
+	if f.Verify {
+		f.publish(Event{Type: EventVerifyStarted, Device: device, Bytes: res.Bytes})
+		vctx, vspan := f.startSpan(ctx, "verify")
+		vstart := time.Now()
+		err := f.verify(vctx, dest, device, f.Seek, res.Bytes, res.Digest, verifyPhase)
+		endTransfer(vspan, res.Bytes, vstart, err)
+		if err != nil {
+			res.Verification = "FAILED"
+			return res, err
+		}
+		res.Verification = "passed"
+	}
+	if len(f.Steps) > 0 {
+		cctx, cspan := f.startSpan(ctx, "customize")
+		err := f.runSteps(cctx, dest, device)
+		cspan.End(err)
+		if err != nil {
+			return res, err
+		}
+	}
+	if f.Verify {
+		info.Stage, info.Verification = HookPostVerify, res.Verification
+		if err := f.runHooks(ctx, info); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// Copy writes src to dest in blocks, showing the progress on Output, and
+// returns the number of bytes and the digest of the data read from src.
+// size is the number of bytes expected, for the progress (0 if unknown).
+// Unlike Flash, dest can be any writer and is neither synced nor verified.
+// Once ctx is done the copy stops between two blocks with the cause of ctx.
+func (f *Flasher) Copy(ctx context.Context, src io.Reader, dest io.Writer, size int64) (Result, error) {
+	return f.copy(ctx, flashOp, src, dest, size, nil, &copyState{hasher: f.newHash()})
+}
+
+// copyState is what a copy has done so far: the bytes written to dest and
+// their digest. A resumed copy starts from the state of the interrupted one.
+type copyState struct {
+	hasher  hash.Hash
+	written int64
+	// readTime and writeTime are the time spent reading source and
+	// writing dest.
+	readTime, writeTime time.Duration
+	// render, if set, draws the progress line in place of the output of
+	// the Flasher.
+	render func(line string)
+}
+
+// operation names the copy and its source in the messages: an image
+// written to a device, a device read into an image, or the data a device
+// is wiped with.
+type operation struct {
+	name, progress, source string
+}
+
+var (
+	flashOp  = operation{"Flash", "Writing", "the image"}
+	backupOp = operation{"Backup", "Reading", "the device"}
+	wipeOp   = operation{"Wipe", "Erasing", "the random data"}
+)
+
+// copy writes source to dest, continuing from st, which it keeps up to
+// date; size is the number of bytes left to copy.
+func (f *Flasher) copy(ctx context.Context, op operation, source io.Reader, dest io.Writer, size int64, phase *progressPhase, st *copyState) (Result, error) {
+	out := f.output()
+	fmt.Fprintf(out, "Starting %s operation...\n", strings.ToLower(op.name))
+
+	if size == 0 {
+		size = sourceSize(source)
+	}
+	blockSize := f.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if f.Align > 0 {
+		blockSize = (blockSize + f.Align - 1) / f.Align * f.Align
+	}
+
+	pauser := f.pauser()
+	pw := f.newProgress(op.progress, size, phase)
+	pw.render = st.render
+	if retry := f.retryPolicy(); retry.MaxAttempts > 1 {
+		source = retryReader{ctx, source, retry}
+		dest = retryWriter{ctx, dest, retry}
+	}
+	// Il digest copre solo i blocchi scritti, così da poter riprendere la
+	// copia interrotta da dove era arrivata.
+	readerWithProgress := io.TeeReader(withContext(ctx, source), pw)
+
+	// Leggiamo blocchi interi, così ogni scrittura sul dispositivo ha la
+	// dimensione richiesta (tranne al più l'ultima).
+	buf := make([]byte, blockSize)
+	for {
+		t := time.Now()
+		read, rerr := io.ReadFull(readerWithProgress, buf)
+		st.readTime += time.Since(t)
+		if read > 0 {
+			data := buf[:read]
+			if f.Pad && read < len(buf) {
+				clear(buf[read:])
+				read = len(buf)
+			} else if f.Align > 0 && read%f.Align != 0 {
+				// Il bridge rifiuta le scritture che non coprono settori interi.
+				padded := (read + f.Align - 1) / f.Align * f.Align
+				clear(buf[read:padded])
+				read = padded
+			}
+			flush := flushFunc(dest)
+			if f.NoFlush {
+				flush = nil
+			}
+			if err := pauser.wait(ctx, flush); err != nil {
+				return Result{Bytes: st.written}, err
+			}
+			t = time.Now()
+			_, err := dest.Write(buf[:read])
+			st.writeTime += time.Since(t)
+			if err != nil {
+				fmt.Fprintln(out) // Nuova riga per non sovrascrivere il progresso
+				return Result{Bytes: st.written}, fmt.Errorf("%w: %w", ErrWrite, err)
+			}
+			st.hasher.Write(data)
+			st.written += int64(len(data))
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			fmt.Fprintln(out)
+			if ctx.Err() != nil {
+				return Result{Bytes: st.written}, rerr
+			}
+			return Result{Bytes: st.written}, fmt.Errorf("error while reading %s: %w", op.source, rerr)
+		}
+	}
+
+	pw.finish()
+	fmt.Fprintln(out) // Nuova riga finale
+	fmt.Fprintln(out, f.Colors.Success+"\n"+op.name+" completed successfully!"+f.Colors.Reset)
+	return Result{Bytes: st.written, Digest: st.hasher.Sum(nil)}, nil
+}
+
+// retryPolicy returns f.Retry, logging the retries if it does not report
+// them itself.
+func (f *Flasher) retryPolicy() RetryPolicy {
+	p := f.Retry
+	if p.OnRetry == nil {
+		log := f.logger()
+		p.OnRetry = func(attempt int, err error, wait time.Duration) {
+			log.Warn("retrying after a transient error", "attempt", attempt, "max_attempts", p.MaxAttempts, "wait", wait, "err", err)
+		}
+	}
+	return p
+}
+
+// flushFunc returns the Sync method of w, or nil if w cannot be synced.
+func flushFunc(w io.Writer) func() error {
+	if s, ok := w.(interface{ Sync() error }); ok {
+		return s.Sync
+	}
+	return nil
+}
+
+// skipInput discards the first n bytes of r, seeking when r allows it.
+func skipInput(ctx context.Context, r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, withContext(ctx, r), n)
+	return err
+}
+
+// precheck compares want with the digest (Hash) of the size bytes of src
+// after skip, before the device is opened, when src is a raw image file
+// that can be read again, so that a wrong image leaves the device
+// untouched. It reports whether it compared them: the streamed images
+// (a pipe, a compressed image) are read once, and only checked once
+// written.
+func (f *Flasher) precheck(ctx context.Context, src *Source, skip, size int64, want string) (bool, error) {
+	ra, ok := src.Reader.(io.ReaderAt)
+	if want == "" || !ok || src.Format != "" || !src.Exact || size <= 0 {
+		return false, nil
+	}
+	out := f.output()
+	fmt.Fprintln(out, "Checking the image checksum...")
+	hasher := f.newHash()
+	pw := f.newProgress("Checking", size, nil)
+	_, err := io.Copy(io.MultiWriter(hasher, pw), withContext(ctx, io.NewSectionReader(ra, skip, size)))
+	fmt.Fprintln(out)
+	if err != nil {
+		return false, fmt.Errorf("error while reading the image: %w", err)
+	}
+	if err := checkDigest(hasher.Sum(nil), want); err != nil {
+		return true, err
+	}
+	fmt.Fprintln(out, "Image checksum matches.")
+	return true, nil
+}
+
+// checkDigest compares the digest of the image with the expected
+// hexadecimal digest.
+func checkDigest(digest []byte, want string) error {
+	got := hex.EncodeToString(digest)
+	if !strings.EqualFold(got, strings.TrimSpace(want)) {
+		return fmt.Errorf("%w: image digest is %s, expected %s", ErrChecksumMismatch, got, want)
+	}
+	return nil
+}
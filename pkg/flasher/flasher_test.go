@@ -0,0 +1,75 @@
+package flasher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestCopy verifica la copia a blocchi, il riempimento dell'ultimo blocco
+// e il checksum dei dati letti.
+func TestCopy(t *testing.T) {
+	var out, dest strings.Builder
+	f := &Flasher{BlockSize: 4, Pad: true, Output: &out}
+	res, err := f.Copy(context.Background(), strings.NewReader("abcdef"), &dest, 0)
+	if err != nil {
+		t.Fatalf("Copy ha restituito un errore: %v", err)
+	}
+	if dest.String() != "abcdef\x00\x00" {
+		t.Errorf("Dati scritti errati. Got: %q", dest.String())
+	}
+	if want := sha256.Sum256([]byte("abcdef")); res.Bytes != 6 || string(res.Digest) != string(want[:]) {
+		t.Errorf("Risultato errato: %d byte, digest %x", res.Bytes, res.Digest)
+	}
+	if !strings.Contains(out.String(), "Flash completed successfully!") {
+		t.Errorf("L'output non contiene il messaggio di successo. Got: %q", out.String())
+	}
+}
+
+// TestWriteSize verifica il calcolo dei byte da scrivere con Skip e Count.
+func TestWriteSize(t *testing.T) {
+	cases := []struct {
+		skip, count, imageSize int64
+		want                   int64
+	}{
+		{0, 0, 1000, 1000},
+		{200, 0, 1000, 800},
+		{200, 100, 1000, 100},
+		{2000, 0, 1000, 0},
+		{0, 100, 0, 100},
+	}
+	for _, c := range cases {
+		f := &Flasher{Skip: c.skip, Count: c.count}
+		if got := f.WriteSize(c.imageSize); got != c.want {
+			t.Errorf("WriteSize(%d) con skip=%d count=%d: Got: %d, Want: %d", c.imageSize, c.skip, c.count, got, c.want)
+		}
+	}
+}
+
+// cancelAfter annulla il contesto dopo la prima lettura.
+type cancelAfter struct {
+	r      *strings.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.r.Read(p)
+}
+
+// TestCopyCancelled verifica che la copia si fermi tra due blocchi quando
+// il contesto viene annullato.
+func TestCopyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var dest strings.Builder
+	f := &Flasher{BlockSize: 4}
+	res, err := f.Copy(ctx, &cancelAfter{r: strings.NewReader("abcdefgh"), cancel: cancel}, &dest, 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Copy dovrebbe restituire context.Canceled. Got: %v", err)
+	}
+	if res.Digest != nil || res.Bytes >= 8 {
+		t.Errorf("La copia annullata non dovrebbe essere completa. Got: %d byte, digest %x", res.Bytes, res.Digest)
+	}
+}
@@ -0,0 +1,127 @@
+package flasher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// GrowFilesystem grows the filesystem of a partition, the last one if
+// Number is 0, to the size of the partition, e.g. after ExpandPartition.
+// Only FAT32 is grown, in place: its allocation tables are sized when it
+// is created, so it grows as far as they can address and no further (a
+// larger one needs fatresize). Other filesystems fail with an error that
+// wraps errors.ErrUnsupported: ext4 is grown by resize2fs, once the
+// device is closed.
+type GrowFilesystem struct {
+	Number int
+}
+
+func (s GrowFilesystem) Name() string {
+	if s.Number == 0 {
+		return "grow the filesystem of the last partition"
+	}
+	return fmt.Sprintf("grow the filesystem of partition %d", s.Number)
+}
+
+func (s GrowFilesystem) Apply(_ context.Context, disk *Disk) error {
+	p, err := disk.Partition(s.Number)
+	if err != nil {
+		return err
+	}
+	fsys, err := disk.Filesystem(p.Number)
+	if err != nil {
+		return err
+	}
+	if fsys.Type() != "fat32" {
+		return fmt.Errorf("%w: cannot grow the %s filesystem of partition %d", errors.ErrUnsupported, fsys.Type(), p.Number)
+	}
+	return growFAT32(&diskBackend{dest: disk.dest, base: p.Start, size: p.Size}, p.Size)
+}
+
+// fat32MaxClusters is the largest number of clusters of FAT32, whose
+// cluster numbers are 28 bits, from 2, below the reserved values.
+const fat32MaxClusters = 0x0ffffff5 - 2
+
+// growFAT32 grows the FAT32 filesystem of rw, a partition of size bytes,
+// to the size of the partition or to the number of clusters its FATs can
+// address, whichever is smaller. The new clusters are marked free in
+// every FAT and counted in the FSInfo sector, if it keeps count.
+func growFAT32(rw interface {
+	io.ReaderAt
+	io.WriterAt
+}, size int64) error {
+	boot := make([]byte, 512)
+	if _, err := rw.ReadAt(boot, 0); err != nil {
+		return fmt.Errorf("could not read the FAT32 boot sector: %w", err)
+	}
+	le := binary.LittleEndian
+	bps := int64(le.Uint16(boot[11:]))
+	spc := int64(boot[13])
+	reserved := int64(le.Uint16(boot[14:]))
+	fats := int64(boot[16])
+	total := int64(le.Uint32(boot[32:]))
+	fatSize := int64(le.Uint32(boot[36:]))
+	if boot[510] != 0x55 || boot[511] != 0xaa || bps < 512 || bps&(bps-1) != 0 || spc == 0 || fats == 0 || fatSize == 0 {
+		return errors.New("invalid FAT32 boot sector")
+	}
+	dataStart := reserved + fats*fatSize
+	if total <= dataStart {
+		return errors.New("invalid FAT32 boot sector")
+	}
+	clusters := (total - dataStart) / spc
+	maxClusters := min(fatSize*bps/4-2, fat32MaxClusters)
+	newTotal := min(size/bps, dataStart+maxClusters*spc, 1<<32-1)
+	newClusters := (newTotal - dataStart) / spc
+	if newTotal <= total {
+		return nil
+	}
+
+	// Le voci dei nuovi cluster dovrebbero essere già a zero: mkfs azzera
+	// tutta la FAT, ma non è detto che lo faccia ogni strumento.
+	free := make([]byte, (newClusters-clusters)*4)
+	for i := range fats {
+		off := (reserved+i*fatSize)*bps + (clusters+2)*4
+		if _, err := rw.WriteAt(free, off); err != nil {
+			return fmt.Errorf("could not write the FAT: %w", err)
+		}
+	}
+	le.PutUint32(boot[32:], uint32(newTotal))
+	backup := int64(le.Uint16(boot[50:]))
+	if err := writeFATSector(rw, boot, bps, 0, backup); err != nil {
+		return err
+	}
+
+	info := int64(le.Uint16(boot[48:]))
+	if info == 0 || info == 0xffff {
+		return nil
+	}
+	sector := make([]byte, 512)
+	if _, err := rw.ReadAt(sector, info*bps); err != nil {
+		return fmt.Errorf("could not read the FSInfo sector: %w", err)
+	}
+	if le.Uint32(sector[0:]) != 0x41615252 || le.Uint32(sector[484:]) != 0x61417272 {
+		return nil
+	}
+	if count := le.Uint32(sector[488:]); count != 0xffffffff {
+		le.PutUint32(sector[488:], count+uint32(newClusters-clusters))
+	}
+	return writeFATSector(rw, sector, bps, info, backup)
+}
+
+// writeFATSector writes sector to the sector n and, unless the boot
+// sector backup is 0 or 0xffff (none), to its copy, backup sectors after.
+func writeFATSector(w io.WriterAt, sector []byte, bps, n, backup int64) error {
+	if _, err := w.WriteAt(sector, n*bps); err != nil {
+		return fmt.Errorf("could not write the FAT32 boot sectors: %w", err)
+	}
+	if backup == 0 || backup == 0xffff {
+		return nil
+	}
+	if _, err := w.WriteAt(sector, (n+backup)*bps); err != nil {
+		return fmt.Errorf("could not write the FAT32 boot sectors: %w", err)
+	}
+	return nil
+}
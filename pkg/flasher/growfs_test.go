@@ -0,0 +1,84 @@
+package flasher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// TestGrowFilesystem verifica che un FAT32 cresca fin dove le sue FAT
+// arrivano, restando leggibile, e che gli altri filesystem siano rifiutati.
+func TestGrowFilesystem(t *testing.T) {
+	dest := &memDest{data: make([]byte, 96*mib)}
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Fat32LBA, Start: 2048, Size: 40 * mib / 512},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "data"}); err != nil {
+		t.Fatal(err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), WriteFiles{Files: map[string][]byte{"/config.txt": []byte("arm_64bit=1\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	boot := dest.data[2048*512:]
+	le := binary.LittleEndian
+	before, fatSize := le.Uint32(boot[32:]), le.Uint32(boot[36:])
+	// go-diskfs non tiene il conto dei cluster liberi: se ne imposta uno.
+	const freeBefore = 1000
+	le.PutUint32(boot[512+488:], freeBefore)
+
+	if err := d.Apply(context.Background(), ExpandPartition{}, GrowFilesystem{}); err != nil {
+		t.Fatalf("GrowFilesystem ha restituito un errore: %v", err)
+	}
+	// Le FAT (2 da fatSize settori) indirizzano fatSize*128-2 cluster di
+	// un settore.
+	want := 32 + 2*fatSize + fatSize*128 - 2
+	if got := le.Uint32(boot[32:]); got != want || got <= before {
+		t.Errorf("Numero di settori errato. Got: %d, Want: %d (prima %d)", got, want, before)
+	}
+	if le.Uint32(boot[6*512+32:]) != want {
+		t.Error("Il settore di boot di backup va aggiornato")
+	}
+	if got := le.Uint32(boot[512+488:]); got != freeBefore+want-before {
+		t.Errorf("Cluster liberi nel settore FSInfo errati. Got: %d, Want: %d", got, freeBefore+want-before)
+	}
+
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := d.Filesystem(1)
+	if err != nil {
+		t.Fatalf("Il filesystem ingrandito non è leggibile: %v", err)
+	}
+	if got, err := fsys.ReadFile("/config.txt"); err != nil || string(got) != "arm_64bit=1\n" {
+		t.Errorf("File errato dopo l'ingrandimento. Got: %q, %v", got, err)
+	}
+	if err := d.Apply(context.Background(), GrowFilesystem{Number: 1}); err != nil {
+		t.Errorf("Un filesystem già ingrandito va lasciato com'è. Got: %v", err)
+	}
+
+	image := newTestImage(t)
+	d, err = NewDisk("dev", &memDest{data: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), GrowFilesystem{}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Un filesystem ext4 dovrebbe restituire ErrUnsupported. Got: %v", err)
+	}
+}
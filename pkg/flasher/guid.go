@@ -0,0 +1,100 @@
+package flasher
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// RandomizeGUIDs gives the GPT disk and each of its partitions a new
+// random GUID, so that several devices flashed from the same image do not
+// share them when plugged into the same host. A system that finds its
+// partitions by PARTUUID, e.g. root=PARTUUID= in the kernel command line
+// or in fstab, no longer finds them. MBR fails with an error that wraps
+// errors.ErrUnsupported.
+type RandomizeGUIDs struct{}
+
+func (RandomizeGUIDs) Name() string { return "randomize the GPT GUIDs" }
+
+func (RandomizeGUIDs) Apply(_ context.Context, disk *Disk) error {
+	t, err := disk.gptTable()
+	if err != nil {
+		return err
+	}
+	if t.GUID, err = randomGUID(); err != nil {
+		return err
+	}
+	for _, p := range t.Partitions {
+		if p.Type == gpt.Unused {
+			continue
+		}
+		if p.GUID, err = randomGUID(); err != nil {
+			return err
+		}
+	}
+	return disk.writeTable()
+}
+
+// SetPartitionName sets the GPT name of the partition Number, the last
+// one if 0, e.g. the PARTLABEL that udev links in /dev/disk/by-partlabel.
+type SetPartitionName struct {
+	Number int
+	// PartitionName is at most 36 UTF-16 characters.
+	PartitionName string
+}
+
+func (s SetPartitionName) Name() string {
+	if s.Number == 0 {
+		return fmt.Sprintf("name the last partition %q", s.PartitionName)
+	}
+	return fmt.Sprintf("name partition %d %q", s.Number, s.PartitionName)
+}
+
+// Validate checks the name, which Apply does before writing anything.
+func (s SetPartitionName) Validate() error {
+	if n := len(utf16.Encode([]rune(s.PartitionName))); n > 36 {
+		return fmt.Errorf("the partition name %q is longer than 36 characters", s.PartitionName)
+	}
+	return nil
+}
+
+func (s SetPartitionName) Apply(_ context.Context, disk *Disk) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	t, err := disk.gptTable()
+	if err != nil {
+		return err
+	}
+	p, err := disk.Partition(s.Number)
+	if err != nil {
+		return err
+	}
+	t.Partitions[p.Number-1].Name = s.PartitionName
+	return disk.writeTable()
+}
+
+// gptTable returns the partition table of d, if it is GPT.
+func (d *Disk) gptTable() (*gpt.Table, error) {
+	t, ok := d.d.Table.(*gpt.Table)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no GPT partition table", errors.ErrUnsupported, d.Device)
+	}
+	return t, nil
+}
+
+// randomGUID returns a random (version 4) GUID, in upper case as go-diskfs
+// reads them.
+func randomGUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
@@ -0,0 +1,68 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestRandomizeGUIDs verifica che disco e partizioni GPT abbiano nuovi
+// GUID e che il nome della partizione sia scritto.
+func TestRandomizeGUIDs(t *testing.T) {
+	dest := &memDest{data: make([]byte, 8*mib)}
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.EFISystemPartition, Start: 2048, End: 4095, Name: "boot"},
+		{Type: gpt.LinuxFilesystem, Start: 4096, End: 8191, Name: "root"},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskGUID := d.d.Table.(*gpt.Table).GUID
+	before, _ := d.Partitions()
+
+	err = d.Apply(context.Background(), RandomizeGUIDs{}, SetPartitionName{PartitionName: "dati-01"})
+	if err != nil {
+		t.Fatalf("RandomizeGUIDs ha restituito un errore: %v", err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.d.Table.(*gpt.Table).GUID; strings.EqualFold(got, diskGUID) {
+		t.Errorf("Il GUID del disco non è cambiato: %s", got)
+	}
+	after, err := d.Partitions()
+	if err != nil || len(after) != 2 {
+		t.Fatalf("Partizioni illeggibili dopo il cambio: %+v, %v", after, err)
+	}
+	for i, p := range after {
+		if p.UUID == before[i].UUID || p.Start != before[i].Start || p.Size != before[i].Size {
+			t.Errorf("Partizione %d errata. Got: %+v, prima: %+v", p.Number, p, before[i])
+		}
+	}
+	if after[0].Name != "boot" || after[1].Name != "dati-01" {
+		t.Errorf("Nomi errati. Got: %q, %q", after[0].Name, after[1].Name)
+	}
+
+	if err := (SetPartitionName{PartitionName: strings.Repeat("x", 37)}).Validate(); err == nil {
+		t.Error("Un nome di 37 caratteri dovrebbe essere rifiutato")
+	}
+	d, err = NewDisk("dev", &memDest{data: newTestImage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), RandomizeGUIDs{}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Una tabella MBR dovrebbe restituire ErrUnsupported. Got: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package flasher
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+// DefaultHash is the name of the hash used when Flasher.Hash is nil.
+const DefaultHash = "sha256"
+
+// hashes maps the names accepted by LookupHash to their constructors.
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// RegisterHash makes LookupHash return newHash for name, e.g. to add
+// BLAKE3 or xxHash, replacing any previous hash with that name.
+func RegisterHash(name string, newHash func() hash.Hash) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	hashes[strings.ToLower(name)] = newHash
+}
+
+// LookupHash returns the constructor of the hash called name, as
+// registered with RegisterHash.
+func LookupHash(name string) (func() hash.Hash, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	newHash, ok := hashes[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q (expected %s)", name, strings.Join(hashNames(), ", "))
+	}
+	return newHash, nil
+}
+
+// HashNames returns the names of the registered hashes, sorted.
+func HashNames() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return hashNames()
+}
+
+// hashNames returns the sorted names of hashes; registryMu must be held.
+func hashNames() []string {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// newHash returns a new hash of the data written and read back.
+func (f *Flasher) newHash() hash.Hash {
+	if f.Hash == nil {
+		return sha256.New()
+	}
+	return f.Hash()
+}
@@ -0,0 +1,81 @@
+package flasher
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFlashHash verifica il digest e la verifica con un hash diverso da
+// SHA-256.
+func TestFlashHash(t *testing.T) {
+	dest := &memDest{data: make([]byte, 16)}
+	RegisterDestination("hashtest", func(string) (Destination, error) { return dest, nil })
+	want := sha512.Sum512([]byte("dati"))
+	f := &Flasher{Hash: sha512.New, Checksum: hex.EncodeToString(want[:]), Verify: true}
+	res, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "hashtest://device")
+	if err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if string(res.Digest) != string(want[:]) || res.Verification != "passed" {
+		t.Errorf("Risultato errato: digest %x, verifica %s", res.Digest, res.Verification)
+	}
+
+	f.Checksum = strings.Repeat("0", 128)
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "hashtest://device"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Flash dovrebbe restituire ErrChecksumMismatch. Got: %v", err)
+	}
+}
+
+// TestLookupHash verifica gli hash predefiniti e la registrazione di uno nuovo.
+func TestLookupHash(t *testing.T) {
+	if _, err := LookupHash("SHA512"); err != nil {
+		t.Errorf("sha512 dovrebbe essere disponibile: %v", err)
+	}
+	if _, err := LookupHash("whirlpool"); err == nil {
+		t.Error("Un hash sconosciuto dovrebbe restituire un errore")
+	}
+	RegisterHash("crc32", func() hash.Hash { return crc32.NewIEEE() })
+	if _, err := LookupHash("crc32"); err != nil {
+		t.Errorf("crc32 registrato dovrebbe essere disponibile: %v", err)
+	}
+}
+
+// TestFlashChecksumFirst verifica che un file immagine con un checksum
+// diverso venga rifiutato prima di scrivere sul dispositivo.
+func TestFlashChecksumFirst(t *testing.T) {
+	dest := &memDest{data: []byte("dati da conservare")}
+	RegisterDestination("checksumtest", func(string) (Destination, error) { return dest, nil })
+	path := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(path, []byte("immagine"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	src, err := OpenImage(path, OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	confirmed := false
+	f := &Flasher{Checksum: strings.Repeat("0", 64), Confirm: func() error { confirmed = true; return nil }}
+	if _, err := f.Flash(context.Background(), src, "checksumtest://device"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Flash dovrebbe restituire ErrChecksumMismatch. Got: %v", err)
+	}
+	if confirmed || string(dest.data) != "dati da conservare" {
+		t.Errorf("Il dispositivo non doveva essere toccato. Got: %q", dest.data)
+	}
+
+	// Con il checksum giusto il file viene letto di nuovo per la scrittura.
+	sum := sha256.Sum256([]byte("immagine"))
+	f.Checksum = hex.EncodeToString(sum[:])
+	if res, err := f.Flash(context.Background(), src, "checksumtest://device"); err != nil || string(dest.data[:8]) != "immagine" || res.Bytes != 8 {
+		t.Errorf("Flash errato. Got: %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,130 @@
+package flasher
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HookStage is the point of a flash where a Hook runs.
+type HookStage string
+
+const (
+	// HookPreWrite runs once the flash is confirmed, before the first write.
+	HookPreWrite HookStage = "pre-write"
+	// HookPostWrite runs once the image is written, synced and matches
+	// Flasher.Checksum.
+	HookPostWrite HookStage = "post-write"
+	// HookPostVerify runs after a successful verification.
+	HookPostVerify HookStage = "post-verify"
+)
+
+// HookInfo describes the flash to a Hook.
+type HookInfo struct {
+	Stage  HookStage
+	Device string
+	// Bytes and Digest are set from HookPostWrite on.
+	Bytes  int64
+	Digest []byte
+	// Verification is "passed" in HookPostVerify, "skipped" before.
+	Verification string
+	// Metadata is Flasher.Metadata.
+	Metadata map[string]string
+}
+
+// Hook runs at a stage of a flash, e.g. to notify a tracking system or
+// to run a custom check. An error aborts the flash with ErrHookFailed;
+// ctx is the context of the flash.
+type Hook func(ctx context.Context, info HookInfo) error
+
+// Hooks are run, in order, at each stage of Flasher.Flash.
+type Hooks struct {
+	PreWrite, PostWrite, PostVerify []Hook
+}
+
+// stage returns the hooks of stage.
+func (h Hooks) stage(stage HookStage) []Hook {
+	switch stage {
+	case HookPreWrite:
+		return h.PreWrite
+	case HookPostWrite:
+		return h.PostWrite
+	case HookPostVerify:
+		return h.PostVerify
+	}
+	return nil
+}
+
+// runHooks runs the hooks of info.Stage, stopping at the first error.
+func (f *Flasher) runHooks(ctx context.Context, info HookInfo) error {
+	info.Metadata = f.Metadata
+	for i, hook := range f.Hooks.stage(info.Stage) {
+		f.logger().Debug("running hook", "stage", info.Stage, "index", i)
+		if err := hook(ctx, info); err != nil {
+			return fmt.Errorf("%w: %s hook: %w", ErrHookFailed, info.Stage, err)
+		}
+	}
+	return nil
+}
+
+// CommandHook returns a Hook running command with the system shell (sh -c,
+// or cmd /C on Windows). Its output goes to out, nil to discard it. The
+// flash is described in the environment: SFLASHY_HOOK (the stage),
+// SFLASHY_DEVICE, SFLASHY_BYTES, SFLASHY_DIGEST, SFLASHY_VERIFICATION and
+// one SFLASHY_<KEY> for each Metadata entry, the key uppercased. A non-zero
+// exit status aborts the flash.
+func CommandHook(command string, out io.Writer) Hook {
+	return func(ctx context.Context, info HookInfo) error {
+		cmd := shellCommand(ctx, command)
+		cmd.Env = append(os.Environ(), info.environ()...)
+		if out != nil {
+			cmd.Stdout, cmd.Stderr = out, out
+		}
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+		return nil
+	}
+}
+
+// shellCommand returns command run with the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	return exec.CommandContext(ctx, shell, flag, command)
+}
+
+// environ returns info as SFLASHY_ environment variables.
+func (info HookInfo) environ() []string {
+	env := []string{
+		"SFLASHY_HOOK=" + string(info.Stage),
+		"SFLASHY_DEVICE=" + info.Device,
+		"SFLASHY_BYTES=" + strconv.FormatInt(info.Bytes, 10),
+		"SFLASHY_DIGEST=" + hex.EncodeToString(info.Digest),
+		"SFLASHY_VERIFICATION=" + info.Verification,
+	}
+	keys := make([]string, 0, len(info.Metadata))
+	for k := range info.Metadata {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		name := strings.ToUpper(strings.Map(func(r rune) rune {
+			if r == '-' || r == '.' || r == ' ' {
+				return '_'
+			}
+			return r
+		}, k))
+		env = append(env, "SFLASHY_"+name+"="+info.Metadata[k])
+	}
+	return env
+}
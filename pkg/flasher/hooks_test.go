@@ -0,0 +1,60 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestFlashHooks verifica l'ordine degli hook e l'interruzione della
+// scrittura quando uno fallisce.
+func TestFlashHooks(t *testing.T) {
+	dest := &memDest{data: make([]byte, 16)}
+	RegisterDestination("hooktest", func(string) (Destination, error) { return dest, nil })
+	var got []string
+	record := func(_ context.Context, info HookInfo) error {
+		got = append(got, string(info.Stage)+":"+info.Verification+":"+info.Metadata["image"])
+		return nil
+	}
+	f := &Flasher{Verify: true, Metadata: map[string]string{"image": "test.img"}, Hooks: Hooks{
+		PreWrite: []Hook{record}, PostWrite: []Hook{record}, PostVerify: []Hook{record},
+	}}
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "hooktest://device"); err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	want := []string{"pre-write:skipped:test.img", "post-write:skipped:test.img", "post-verify:passed:test.img"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Hook errati. Got: %v, Want: %v", got, want)
+	}
+
+	dest.data = make([]byte, 16)
+	f.Hooks.PreWrite = []Hook{func(context.Context, HookInfo) error { return errors.New("rifiutato") }}
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "hooktest://device"); !errors.Is(err, ErrHookFailed) {
+		t.Fatalf("Flash dovrebbe restituire ErrHookFailed. Got: %v", err)
+	}
+	if string(dest.data[:4]) == "dati" {
+		t.Error("Il dispositivo non dovrebbe essere scritto se un hook pre-write fallisce")
+	}
+}
+
+// TestCommandHook verifica l'ambiente passato ai comandi e il loro esito.
+func TestCommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("richiede sh")
+	}
+	var out strings.Builder
+	info := HookInfo{Stage: HookPostWrite, Device: "/dev/sdb", Bytes: 4, Digest: []byte{0xab}, Metadata: map[string]string{"work-order": "42"}}
+	hook := CommandHook(`echo "$SFLASHY_HOOK $SFLASHY_DEVICE $SFLASHY_BYTES $SFLASHY_DIGEST $SFLASHY_WORK_ORDER"`, &out)
+	if err := hook(context.Background(), info); err != nil {
+		t.Fatalf("Il comando ha restituito un errore: %v", err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "post-write /dev/sdb 4 ab 42" {
+		t.Errorf("Ambiente errato. Got: %q", got)
+	}
+	if err := CommandHook("exit 3", nil)(context.Background(), info); err == nil {
+		t.Error("Un comando fallito dovrebbe restituire un errore")
+	}
+}
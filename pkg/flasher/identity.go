@@ -0,0 +1,132 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sshHostKeys are the SSH host keys that ResetIdentity replaces, in
+// /etc/ssh.
+var sshHostKeys = []string{"rsa", "ecdsa", "ed25519", "dsa"}
+
+// sshKeygenUnits are the systemd units that create the SSH host keys
+// missing or empty at boot, as on Fedora.
+var sshKeygenUnits = []string{"/usr/lib/systemd/system/sshd-keygen@.service", "/lib/systemd/system/sshd-keygen@.service"}
+
+// persistentNetRules binds the names of the network interfaces to the MAC
+// addresses of the machine the image was made on.
+const persistentNetRules = "/etc/udev/rules.d/70-persistent-net.rules"
+
+// sshKeysScript is the firstrun.sh command that replaces the SSH host keys.
+const sshKeysScript = `if [ -d /etc/ssh ]; then
+   rm -f /etc/ssh/ssh_host_*_key /etc/ssh/ssh_host_*_key.pub
+   ssh-keygen -A
+fi`
+
+// ResetIdentity clears what makes the system on the device a machine of
+// its own, so that the devices flashed from an image made out of a
+// running system do not show up as the same machine on the network.
+// What an image does not have is left alone.
+type ResetIdentity struct {
+	// MachineID empties /etc/machine-id, which systemd fills with a new
+	// ID at the next boot. /var/lib/dbus/machine-id is usually a link to
+	// it and is not changed.
+	MachineID bool
+	// SSHHostKeys replaces the SSH host keys at the first boot: with
+	// firstrun.sh on Raspberry Pi OS, by emptying them where the
+	// sshd-keygen units create them again, as on Fedora. Other systems
+	// are not supported.
+	SSHHostKeys bool
+	// NetNames empties the persistent names of the network interfaces of
+	// udev, 70-persistent-net.rules, written by older Debian and Ubuntu.
+	NetNames bool
+}
+
+func (s ResetIdentity) Name() string {
+	var what []string
+	if s.MachineID {
+		what = append(what, "machine-id")
+	}
+	if s.SSHHostKeys {
+		what = append(what, "SSH host keys")
+	}
+	if s.NetNames {
+		what = append(what, "network interface names")
+	}
+	return "reset " + strings.Join(what, ", ")
+}
+
+func (s ResetIdentity) Apply(_ context.Context, disk *Disk) error {
+	_, root, err := disk.FindFile("/etc/fstab")
+	if err != nil {
+		return fmt.Errorf("no root filesystem found: %w", err)
+	}
+	if s.MachineID {
+		if err := emptyFile(root, "/etc/machine-id"); err != nil {
+			return err
+		}
+	}
+	if s.NetNames {
+		if err := emptyFile(root, persistentNetRules); err != nil {
+			return err
+		}
+	}
+	if s.SSHHostKeys {
+		return s.resetSSHHostKeys(disk, root)
+	}
+	return nil
+}
+
+// resetSSHHostKeys has the SSH host keys of the system in root replaced at
+// its first boot.
+func (s ResetIdentity) resetSSHHostKeys(disk *Disk, root Filesystem) error {
+	var keys []string
+	for _, k := range sshHostKeys {
+		name := "/etc/ssh/ssh_host_" + k + "_key"
+		if data, err := root.ReadFile(name); err == nil && len(data) > 0 {
+			keys = append(keys, name)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, boot, err := disk.FindFile("/cmdline.txt"); err == nil {
+		files := make(map[string][]byte)
+		if err := addFirstRun(disk, boot, files, []string{sshKeysScript}); err != nil {
+			return err
+		}
+		for _, name := range []string{"/cmdline.txt", "/firstrun.sh"} {
+			if err := boot.WriteFile(name, files[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, unit := range sshKeygenUnits {
+		if _, err := root.ReadFile(unit); err != nil {
+			continue
+		}
+		// sshd-keygen@.service crea le chiavi mancanti o vuote.
+		for _, name := range keys {
+			for _, f := range []string{name, name + ".pub"} {
+				if err := emptyFile(root, f); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: the system on %s does not create new SSH host keys at boot", errors.ErrUnsupported, disk.Device)
+}
+
+// emptyFile truncates the file name of fsys, if it exists and is not
+// empty already.
+func emptyFile(fsys Filesystem, name string) error {
+	data, err := fsys.ReadFile(name)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	return fsys.WriteFile(name, nil)
+}
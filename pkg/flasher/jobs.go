@@ -0,0 +1,385 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JobState is the state of a job in a JobManager.
+type JobState string
+
+// The states of a job: queued, then running, then completed, failed or
+// cancelled (possibly straight from queued).
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Done reports whether the job has ended.
+func (s JobState) Done() bool {
+	return s == JobCompleted || s == JobFailed || s == JobCancelled
+}
+
+// ErrJobNotFound is returned for an unknown job ID.
+var ErrJobNotFound = errors.New("job not found")
+
+// JobSpec describes a flash to run in a JobManager.
+type JobSpec struct {
+	// Image is the location opened with OpenImage when the job starts.
+	Image   string
+	Options OpenOptions
+	// Device is the location of the destination, as given to Flash.
+	Device string
+	// Flasher runs the job (a zero Flasher if nil). Each job needs its
+	// own Flasher, since Status and Pause refer to a single flash.
+	Flasher *Flasher
+	// Group is what the device shares with the devices of other jobs,
+	// e.g. the USB controller, for JobManager.MaxPerGroup; none if empty.
+	Group string
+}
+
+// JobStatus is a snapshot of a job.
+type JobStatus struct {
+	ID     string
+	Image  string
+	Device string
+	State  JobState
+	// Status is the Flasher.Status of a running job.
+	Status string
+	// Result and Err are set once the job is done.
+	Result Result
+	Err    error
+
+	Queued, Started, Finished time.Time
+}
+
+// job is a submitted JobSpec.
+type job struct {
+	spec   JobSpec
+	status JobStatus
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// dropped is set by Cancel: the job is not restored.
+	dropped bool
+}
+
+// pendingJob is the record of a queued or running job in JobManager.Store.
+type pendingJob struct {
+	ID        int    `json:"id"`
+	Image     string `json:"image"`
+	Device    string `json:"device"`
+	LowMemory bool   `json:"low_memory,omitempty"`
+	Verify    bool   `json:"verify,omitempty"`
+}
+
+// jobKey is the StateStore key of the job id.
+func jobKey(id string) string {
+	return "job/" + id
+}
+
+// JobManager queues flash jobs and runs them, at most maxConcurrent at a
+// time, in the order they were submitted. A device has at most one job
+// queued or running. Create it with NewJobManager.
+type JobManager struct {
+	// Store, if set, keeps the jobs that are queued or running, so that
+	// Restore can submit them again after a restart. Set it before the
+	// first Submit.
+	Store StateStore
+	// MaxPerGroup, if positive, is how many jobs of the same JobSpec.Group
+	// run at once: the devices behind one USB controller are slower all
+	// together than one after the other. The queued jobs of other groups
+	// start meanwhile. Set it before the first Submit.
+	MaxPerGroup int
+
+	mu            sync.Mutex
+	jobs          map[string]*job
+	order         []string
+	next          int
+	queue         []*job
+	running       int
+	maxConcurrent int
+	// groups counts the running jobs of each group.
+	groups map[string]int
+}
+
+// NewJobManager returns a JobManager running up to maxConcurrent jobs at
+// once (1 if maxConcurrent is not positive).
+func NewJobManager(maxConcurrent int) *JobManager {
+	return &JobManager{jobs: map[string]*job{}, maxConcurrent: max(maxConcurrent, 1), groups: map[string]int{}}
+}
+
+// Submit queues spec and returns the ID of the job. ctx bounds the whole
+// job, including the wait in the queue. It fails with ErrDeviceBusy if
+// the device already has a job queued or running.
+func (m *JobManager) Submit(ctx context.Context, spec JobSpec) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.submit(ctx, spec, m.next+1)
+}
+
+// submit queues spec as the job number; m.mu must be held.
+func (m *JobManager) submit(ctx context.Context, spec JobSpec, number int) (string, error) {
+	if spec.Flasher == nil {
+		spec.Flasher = &Flasher{}
+	}
+	for _, j := range m.jobs {
+		if j.spec.Device == spec.Device && !j.status.State.Done() {
+			return "", fmt.Errorf("%w: %s already has job %s", ErrDeviceBusy, spec.Device, j.status.ID)
+		}
+	}
+	m.next = max(m.next, number)
+	id := strconv.Itoa(number)
+	if m.Store != nil {
+		rec := pendingJob{ID: number, Image: spec.Image, Device: spec.Device, LowMemory: spec.Options.LowMemory, Verify: spec.Flasher.Verify}
+		if err := m.Store.Save(jobKey(id), rec); err != nil {
+			return "", err
+		}
+	}
+	j := &job{
+		spec:   spec,
+		status: JobStatus{ID: id, Image: spec.Image, Device: spec.Device, State: JobQueued, Queued: time.Now()},
+		done:   make(chan struct{}),
+	}
+	j.ctx, j.cancel = context.WithCancel(ctx)
+	// Un job annullato in coda termina subito, senza attendere un posto.
+	context.AfterFunc(j.ctx, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if i := slices.Index(m.queue, j); i >= 0 {
+			m.queue = slices.Delete(m.queue, i, i+1)
+			m.finish(j, Result{}, context.Cause(j.ctx))
+		}
+	})
+	m.jobs[id] = j
+	m.order = append(m.order, id)
+	m.queue = append(m.queue, j)
+	m.dispatch()
+	return id, nil
+}
+
+// dispatch starts the queued jobs while there are free slots, in order,
+// skipping those of a group at MaxPerGroup; m.mu must be held.
+func (m *JobManager) dispatch() {
+	for m.running < m.maxConcurrent {
+		i := slices.IndexFunc(m.queue, m.canStart)
+		if i < 0 {
+			return
+		}
+		j := m.queue[i]
+		m.queue = slices.Delete(m.queue, i, i+1)
+		m.running++
+		m.groups[j.spec.Group]++
+		j.status.State, j.status.Started = JobRunning, time.Now()
+		go m.run(j)
+	}
+}
+
+// canStart reports whether the group of j has room for it; m.mu must be
+// held.
+func (m *JobManager) canStart(j *job) bool {
+	return m.MaxPerGroup <= 0 || j.spec.Group == "" || m.groups[j.spec.Group] < m.MaxPerGroup
+}
+
+// run flashes j and starts the next queued job.
+func (m *JobManager) run(j *job) {
+	res, err := m.flash(j)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+	m.groups[j.spec.Group]--
+	m.finish(j, res, err)
+	m.dispatch()
+}
+
+// flash opens the image of j and writes it.
+func (m *JobManager) flash(j *job) (Result, error) {
+	src, err := OpenImage(j.spec.Image, j.spec.Options)
+	if err != nil {
+		return Result{}, err
+	}
+	defer src.Close()
+	return j.spec.Flasher.Flash(j.ctx, src, j.spec.Device)
+}
+
+// finish records the outcome of j; m.mu must be held.
+func (m *JobManager) finish(j *job, res Result, err error) {
+	j.status.Result, j.status.Err, j.status.Finished = res, err, time.Now()
+	switch {
+	case err == nil:
+		j.status.State = JobCompleted
+	case errors.Is(err, context.Canceled):
+		j.status.State = JobCancelled
+	default:
+		j.status.State = JobFailed
+	}
+	// Un job interrotto dal contesto, ad esempio allo spegnimento, resta
+	// nello Store per essere ripreso; uno annullato con Cancel no.
+	if m.Store != nil && (j.status.State != JobCancelled || j.dropped) {
+		m.Store.Delete(jobKey(j.status.ID))
+	}
+	j.cancel()
+	close(j.done)
+}
+
+// Restore submits again the jobs left in Store by a previous run, with
+// their IDs, and returns their IDs. prepare, if set, completes each spec
+// before it is submitted, e.g. with a Flasher that resumes the write; only
+// the image, the device, Options.LowMemory and Flasher.Verify are stored.
+// Call it before Submit, so that the new jobs do not take the stored IDs.
+func (m *JobManager) Restore(ctx context.Context, prepare func(*JobSpec)) ([]string, error) {
+	pending, err := m.pending()
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for _, rec := range pending {
+		spec := JobSpec{Image: rec.Image, Device: rec.Device, Options: OpenOptions{LowMemory: rec.LowMemory}, Flasher: &Flasher{Verify: rec.Verify}}
+		if prepare != nil {
+			prepare(&spec)
+		}
+		id, err := m.submit(ctx, spec, rec.ID)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Pending returns the jobs left in Store by a previous run, queued, in
+// the order they were submitted, without submitting them: Restore
+// submits them, Discard drops them.
+func (m *JobManager) Pending() ([]JobStatus, error) {
+	pending, err := m.pending()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]JobStatus, 0, len(pending))
+	for _, rec := range pending {
+		jobs = append(jobs, JobStatus{ID: strconv.Itoa(rec.ID), Image: rec.Image, Device: rec.Device, State: JobQueued})
+	}
+	return jobs, nil
+}
+
+// Discard removes the jobs left in Store by a previous run.
+func (m *JobManager) Discard() error {
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+	for _, rec := range pending {
+		if err := m.Store.Delete(jobKey(strconv.Itoa(rec.ID))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pending reads the jobs left in Store, sorted by ID.
+func (m *JobManager) pending() ([]pendingJob, error) {
+	if m.Store == nil {
+		return nil, nil
+	}
+	keys, err := m.Store.Keys("job/")
+	if err != nil {
+		return nil, err
+	}
+	var pending []pendingJob
+	for _, key := range keys {
+		var rec pendingJob
+		if err := m.Store.Load(key, &rec); err != nil {
+			return nil, err
+		}
+		pending = append(pending, rec)
+	}
+	slices.SortFunc(pending, func(a, b pendingJob) int { return a.ID - b.ID })
+	return pending, nil
+}
+
+// snapshot returns the status of j; m.mu must be held.
+func (j *job) snapshot() JobStatus {
+	s := j.status
+	if s.State == JobRunning {
+		s.Status = j.spec.Flasher.Status()
+	}
+	return s
+}
+
+// Jobs returns the status of every job, in the order they were submitted.
+func (m *JobManager) Jobs() []JobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]JobStatus, 0, len(m.order))
+	for _, id := range m.order {
+		jobs = append(jobs, m.jobs[id].snapshot())
+	}
+	return jobs
+}
+
+// Job returns the status of the job id.
+func (m *JobManager) Job(id string) (JobStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return JobStatus{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return j.snapshot(), nil
+}
+
+// Cancel stops the job id: a queued job never starts, a running one stops
+// between two blocks as when its context is cancelled. Cancelling a job
+// that is done does nothing.
+func (m *JobManager) Cancel(id string) error {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	m.mu.Lock()
+	j.dropped = true
+	m.mu.Unlock()
+	j.cancel()
+	return nil
+}
+
+// Wait blocks until the job id is done, or ctx is, and returns its status.
+func (m *JobManager) Wait(ctx context.Context, id string) (JobStatus, error) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return JobStatus{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return JobStatus{}, context.Cause(ctx)
+	}
+	return m.Job(id)
+}
+
+// Prune forgets the jobs that are done, e.g. after reporting them.
+func (m *JobManager) Prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order = slices.DeleteFunc(m.order, func(id string) bool {
+		if m.jobs[id].status.State.Done() {
+			delete(m.jobs, id)
+			return true
+		}
+		return false
+	})
+}
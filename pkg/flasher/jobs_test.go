@@ -0,0 +1,179 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitState attende che il job id raggiunga lo stato want.
+func waitState(t *testing.T, m *JobManager, id string, want JobState) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, err := m.Job(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.State == want {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Il job %s è %s, atteso %s", id, s.State, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestJobManager verifica la coda, il limite di concorrenza e
+// l'annullamento dei job.
+func TestJobManager(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(image, []byte("dati"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dests := map[string]*memDest{"jobtest://a": {data: make([]byte, 16)}, "jobtest://b": {data: make([]byte, 16)}}
+	RegisterDestination("jobtest", func(location string) (Destination, error) { return dests[location], nil })
+
+	release := make(chan struct{})
+	blocking := &Flasher{Confirm: func() error { <-release; return nil }}
+	m := NewJobManager(1)
+	ctx := context.Background()
+	first, err := m.Submit(ctx, JobSpec{Image: image, Device: "jobtest://a", Flasher: blocking})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Submit(ctx, JobSpec{Image: image, Device: "jobtest://a"}); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("Un secondo job sullo stesso dispositivo dovrebbe restituire ErrDeviceBusy. Got: %v", err)
+	}
+	second, err := m.Submit(ctx, JobSpec{Image: image, Device: "jobtest://b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, first, JobRunning)
+	if s, _ := m.Job(second); s.State != JobQueued {
+		t.Errorf("Con un solo posto il secondo job dovrebbe restare in coda. Got: %s", s.State)
+	}
+
+	if err := m.Cancel(second); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, second, JobCancelled)
+	close(release)
+	s, err := m.Wait(ctx, first)
+	if err != nil || s.State != JobCompleted || s.Result.Bytes != 4 || string(dests["jobtest://a"].data[:4]) != "dati" {
+		t.Errorf("Job non completato: %+v, %v", s, err)
+	}
+	if string(dests["jobtest://b"].data[:4]) == "dati" {
+		t.Error("Il job annullato in coda non dovrebbe scrivere")
+	}
+
+	if jobs := m.Jobs(); len(jobs) != 2 || jobs[0].ID != first || jobs[1].ID != second {
+		t.Errorf("Elenco dei job errato: %+v", jobs)
+	}
+	m.Prune()
+	if jobs := m.Jobs(); len(jobs) != 0 {
+		t.Errorf("Prune dovrebbe rimuovere i job terminati: %+v", jobs)
+	}
+	if err := m.Cancel(first); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Un job rimosso dovrebbe restituire ErrJobNotFound. Got: %v", err)
+	}
+}
+
+// TestJobManagerGroups verifica il limite di job per gruppo: un job del
+// gruppo pieno aspetta, quelli degli altri gruppi partono.
+func TestJobManagerGroups(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(image, []byte("dati"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dests := map[string]*memDest{}
+	for _, d := range []string{"a", "b", "c"} {
+		dests["grouptest://"+d] = &memDest{data: make([]byte, 16)}
+	}
+	RegisterDestination("grouptest", func(location string) (Destination, error) { return dests[location], nil })
+
+	release := make(chan struct{})
+	m := NewJobManager(3)
+	m.MaxPerGroup = 1
+	ctx := context.Background()
+	first, err := m.Submit(ctx, JobSpec{Image: image, Device: "grouptest://a", Group: "usb1", Flasher: &Flasher{Confirm: func() error { <-release; return nil }}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, first, JobRunning)
+	second, _ := m.Submit(ctx, JobSpec{Image: image, Device: "grouptest://b", Group: "usb1"})
+	third, _ := m.Submit(ctx, JobSpec{Image: image, Device: "grouptest://c", Group: "usb2"})
+	waitState(t, m, third, JobCompleted)
+	if s, _ := m.Job(second); s.State != JobQueued {
+		t.Errorf("Il secondo job di usb1 dovrebbe attendere il primo. Got: %s", s.State)
+	}
+	close(release)
+	waitState(t, m, second, JobCompleted)
+}
+
+// TestJobManagerRestore verifica che i job interrotti vengano ripresi da
+// un nuovo JobManager con lo stesso Store.
+func TestJobManagerRestore(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "image.img")
+	if err := os.WriteFile(image, []byte("dati"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dest := &memDest{data: make([]byte, 16)}
+	RegisterDestination("restoretest", func(string) (Destination, error) { return dest, nil })
+	store := NewFileStore(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	blocking := &Flasher{Verify: true, Confirm: func() error { <-ctx.Done(); return ctx.Err() }}
+	m := NewJobManager(1)
+	m.Store = store
+	id, err := m.Submit(ctx, JobSpec{Image: image, Device: "restoretest://a", Flasher: blocking})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, id, JobRunning)
+	cancel()
+	waitState(t, m, id, JobCancelled)
+
+	restored := NewJobManager(1)
+	restored.Store = store
+	if pending, err := restored.Pending(); err != nil || len(pending) != 1 || pending[0].ID != id || pending[0].Device != "restoretest://a" {
+		t.Fatalf("Job interrotti errati. Got: %+v, %v", pending, err)
+	}
+	ids, err := restored.Restore(context.Background(), func(spec *JobSpec) {
+		if !spec.Flasher.Verify {
+			t.Error("La verifica del job interrotto non è stata conservata")
+		}
+		spec.Flasher = &Flasher{}
+	})
+	if err != nil || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Job ripresi errati. Got: %v, %v", ids, err)
+	}
+	if s, err := restored.Wait(context.Background(), id); err != nil || s.State != JobCompleted || string(dest.data[:4]) != "dati" {
+		t.Errorf("Job ripreso non completato: %+v, %v", s, err)
+	}
+	if keys, _ := store.Keys("job/"); len(keys) != 0 {
+		t.Errorf("Un job completato non dovrebbe restare nello Store: %v", keys)
+	}
+	if next, _ := restored.Submit(context.Background(), JobSpec{Image: image, Device: "restoretest://b"}); next == id {
+		t.Errorf("Un nuovo job non dovrebbe riusare l'ID %s", id)
+	}
+}
+
+// TestJobManagerDiscard verifica che i job scartati non vengano ripresi.
+func TestJobManagerDiscard(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	store.Save(jobKey("1"), pendingJob{ID: 1, Image: "a.img", Device: "/dev/sdb"})
+	store.Save(jobKey("2"), pendingJob{ID: 2, Image: "b.img", Device: "/dev/sdc"})
+	m := NewJobManager(1)
+	m.Store = store
+	if err := m.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := m.Pending(); err != nil || len(pending) != 0 {
+		t.Errorf("Job scartati ancora in attesa. Got: %+v, %v", pending, err)
+	}
+}
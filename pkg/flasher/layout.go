@@ -0,0 +1,310 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// LayoutEntry is an image of a flash layout and where it goes on the
+// device, e.g. a bootloader at a fixed offset or a rootfs in a partition.
+type LayoutEntry struct {
+	// Name describes the image in the messages, e.g. "u-boot".
+	Name   string
+	Source *Source
+	// Offset is where the image starts on the device, in bytes, or
+	// within Partition when that is set.
+	Offset int64
+	// Partition, if not 0, writes the image into that partition, as the
+	// partition table reads once the previous entries are written: an
+	// entry can write the table that the next ones refer to. The image
+	// must fit in the partition.
+	Partition int
+	// Checksum is the expected digest (Flasher.Hash) of the image, if
+	// any.
+	Checksum string
+}
+
+// label returns the name of the entry i in the messages.
+func (e LayoutEntry) label(i int) string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return fmt.Sprintf("image %d", i+1)
+}
+
+// LayoutResult is the outcome of FlashLayout for one of its entries.
+type LayoutResult struct {
+	Name string
+	// Offset is where the image was written on the device.
+	Offset int64
+	Result
+}
+
+// FlashLayout writes several images to device, each at its own offset or
+// partition, as a single job: every entry is checked before anything is
+// written, Confirm is asked once, the progress covers all of the images
+// and, with Verify, each of them is read back once all are written, so
+// that an entry that overwrote a previous one is caught. Seek, Skip and
+// Count do not apply; Steps run once the layout is written, and resuming
+// is not supported. The results are in the order of entries, for those
+// that were written.
+func (f *Flasher) FlashLayout(ctx context.Context, entries []LayoutEntry, device string) (results []LayoutResult, err error) {
+	log := f.logger()
+	out := f.output()
+	ctx, span := f.startSpan(ctx, "flash_layout")
+	span.SetAttribute(AttrDevice, device)
+	var total int64
+	defer func() {
+		span.SetAttribute(AttrBytes, total)
+		span.End(err)
+		if err != nil {
+			f.publish(Event{Type: EventFailed, Device: device, Bytes: total, Err: err})
+		} else {
+			f.publish(Event{Type: EventCompleted, Device: device, Bytes: total})
+		}
+	}()
+
+	if len(entries) == 0 {
+		return nil, errors.New("the layout has no images")
+	}
+	checked := make([]bool, len(entries))
+	for i, e := range entries {
+		if checked[i], err = f.precheck(ctx, e.Source, 0, e.Source.Size, e.Checksum); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.label(i), err)
+		}
+	}
+	dest, err := OpenDestination(device)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	if err := checkLayout(entries, dest.Size(), f.Align); err != nil {
+		return nil, err
+	}
+	f.publish(Event{Type: EventValidated, Device: device})
+	if f.Confirm != nil {
+		if err := f.Confirm(); err != nil {
+			return nil, err
+		}
+	}
+	f.publish(Event{Type: EventConfirmed, Device: device})
+
+	start := time.Now()
+	defer func() {
+		for i := range results {
+			results[i].Elapsed = time.Since(start)
+		}
+	}()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	// Il progresso copre tutte le immagini, e la verifica se richiesta,
+	// solo se le dimensioni sono note.
+	var size int64
+	for _, e := range entries {
+		if e.Source.Size <= 0 {
+			size = 0
+			break
+		}
+		size += e.Source.Size
+	}
+	phases := len(entries)
+	if f.Verify {
+		phases *= 2
+	}
+	phase := func(index int, done int64) *progressPhase {
+		if size <= 0 {
+			return nil
+		}
+		return &progressPhase{Index: index, Count: phases, Done: done, Total: size * int64(phases/len(entries)), Start: start}
+	}
+
+	if err := f.runHooks(ctx, HookInfo{Stage: HookPreWrite, Device: device, Verification: "skipped"}); err != nil {
+		return nil, err
+	}
+	f.publish(Event{Type: EventWriteStarted, Device: device})
+	var placed []byteRange
+	wctx, wspan := f.startSpan(ctx, "write")
+	wstart := time.Now()
+	for i, e := range entries {
+		name := e.label(i)
+		offset, room, err := f.placeEntry(dest, device, entries, i, placed)
+		if err != nil {
+			wspan.End(err)
+			return results, err
+		}
+		fmt.Fprintf(out, "Writing %s at offset %d...\n", name, offset)
+		log.Info("writing layout image", "image", name, "offset", offset)
+		w := &layoutWriter{OffsetWriter: io.NewOffsetWriter(dest, offset), dest: dest, room: room, name: name}
+		copied, err := f.copy(wctx, flashOp, e.Source, w, e.Source.Size, phase(i+1, total), &copyState{hasher: f.newHash()})
+		total += copied.Bytes
+		if err != nil {
+			endTransfer(wspan, total, wstart, err)
+			// I dati già scritti vengono scaricati, come per Flash.
+			dest.Sync()
+			switch {
+			case errors.Is(err, ErrTimeout):
+				return results, fmt.Errorf("%w: the layout was not written within %s (%d bytes written)", ErrTimeout, f.Timeout, total)
+			case ctx.Err() != nil:
+				return results, fmt.Errorf("write of %s interrupted (%d bytes written): %w", name, total, err)
+			}
+			return results, checkRemoved(device, fmt.Errorf("could not write %s: %w", name, err))
+		}
+		results = append(results, LayoutResult{Name: name, Offset: offset, Result: Result{Bytes: copied.Bytes, Digest: copied.Digest, Verification: "skipped"}})
+		placed = append(placed, byteRange{offset, offset + copied.Bytes, name})
+		if e.Checksum != "" && !checked[i] {
+			if err := checkDigest(copied.Digest, e.Checksum); err != nil {
+				endTransfer(wspan, total, wstart, err)
+				return results, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	endTransfer(wspan, total, wstart, nil)
+
+	fmt.Fprintln(out, "Finalizing write (syncing)...")
+	if err := dest.Sync(); err != nil {
+		return results, checkRemoved(device, fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+	}
+	f.publish(Event{Type: EventSynced, Device: device, Bytes: total})
+	info := HookInfo{Stage: HookPostWrite, Device: device, Bytes: total, Verification: "skipped"}
+	if err := f.runHooks(ctx, info); err != nil {
+		return results, err
+	}
+	if f.Verify {
+		f.publish(Event{Type: EventVerifyStarted, Device: device, Bytes: total})
+		vctx, vspan := f.startSpan(ctx, "verify")
+		vstart := time.Now()
+		var done int64
+		for i := range results {
+			r := &results[i]
+			fmt.Fprintf(out, "Verifying %s...\n", r.Name)
+			if err := f.verify(vctx, dest, device, r.Offset, r.Bytes, r.Digest, phase(len(entries)+i+1, size+done)); err != nil {
+				r.Verification = "FAILED"
+				endTransfer(vspan, done, vstart, err)
+				return results, fmt.Errorf("%s: %w", r.Name, err)
+			}
+			r.Verification = "passed"
+			done += r.Bytes
+		}
+		endTransfer(vspan, done, vstart, nil)
+		info.Verification = "passed"
+	}
+	if len(f.Steps) > 0 {
+		cctx, cspan := f.startSpan(ctx, "customize")
+		err := f.runSteps(cctx, dest, device)
+		cspan.End(err)
+		if err != nil {
+			return results, err
+		}
+	}
+	if f.Verify {
+		info.Stage = HookPostVerify
+		if err := f.runHooks(ctx, info); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// checkLayout checks, before anything is written, that the entries at a
+// fixed offset fit on a device of capacity bytes (0 if unknown), are
+// aligned to align-byte sectors and do not overlap each other.
+func checkLayout(entries []LayoutEntry, capacity int64, align int) error {
+	for i, e := range entries {
+		name := e.label(i)
+		switch {
+		case e.Source == nil:
+			return fmt.Errorf("%s has no image", name)
+		case e.Offset < 0 || e.Partition < 0:
+			return fmt.Errorf("invalid position of %s", name)
+		case align > 0 && e.Offset%int64(align) != 0:
+			return fmt.Errorf("the offset %d of %s is not a multiple of the %d-byte sectors", e.Offset, name, align)
+		}
+		if e.Partition != 0 || !e.Source.Exact {
+			continue
+		}
+		end := e.Offset + e.Source.Size
+		if capacity > 0 && end > capacity {
+			return fmt.Errorf("%w: %s needs %d bytes but the device has only %d", ErrDeviceTooSmall, name, end, capacity)
+		}
+		for j, o := range entries[:i] {
+			if o.Partition == 0 && o.Source.Exact && e.Offset < o.Offset+o.Source.Size && o.Offset < end {
+				return fmt.Errorf("%s and %s overlap", o.label(j), name)
+			}
+		}
+	}
+	return nil
+}
+
+// placeEntry returns the device offset of the entry i of entries, and how
+// many bytes it may take (0 for no limit): up to the end of its partition
+// or of the device, and never over the images already placed or the next
+// entries at a fixed offset.
+func (f *Flasher) placeEntry(dest Destination, device string, entries []LayoutEntry, i int, placed []byteRange) (offset, room int64, err error) {
+	e := entries[i]
+	name := e.label(i)
+	offset, end := e.Offset, dest.Size()
+	if e.Partition != 0 {
+		d, err := NewDisk(device, dest)
+		if err != nil {
+			return 0, 0, err
+		}
+		p, err := d.Partition(e.Partition)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot place %s: %w", name, err)
+		}
+		if e.Offset >= p.Size {
+			return 0, 0, fmt.Errorf("the offset %d of %s is past the end of partition %d", e.Offset, name, p.Number)
+		}
+		offset, end = p.Start+e.Offset, p.Start+p.Size
+	}
+	ranges := placed
+	for j, o := range entries[i+1:] {
+		if o.Partition == 0 {
+			ranges = append(ranges, byteRange{o.Offset, o.Offset + max(o.Source.Size, 1), o.label(i + 1 + j)})
+		}
+	}
+	for _, r := range ranges {
+		if offset >= r.start && offset < r.end {
+			return 0, 0, fmt.Errorf("%s at offset %d would overwrite %s", name, offset, r.what)
+		}
+		if r.start > offset && (end <= 0 || r.start < end) {
+			end = r.start
+		}
+	}
+	if e.Source.Exact && end > 0 && offset+e.Source.Size > end {
+		return 0, 0, fmt.Errorf("%w: %s needs %d bytes at offset %d but only %d are free", ErrDeviceTooSmall, name, e.Source.Size, offset, end-offset)
+	}
+	if end > 0 {
+		room = end - offset
+	}
+	return offset, room, nil
+}
+
+// layoutWriter writes an image of a layout to dest, failing before it
+// writes past the room it was given, e.g. an image whose size was only
+// estimated.
+type layoutWriter struct {
+	*io.OffsetWriter
+	dest    Destination
+	room    int64
+	written int64
+	name    string
+}
+
+func (w *layoutWriter) Write(p []byte) (int, error) {
+	if w.room > 0 && w.written+int64(len(p)) > w.room {
+		return 0, fmt.Errorf("%w: %s does not fit in the %d bytes it has", ErrDeviceTooSmall, w.name, w.room)
+	}
+	n, err := w.OffsetWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Sync lets a paused copy flush the data written so far.
+func (w *layoutWriter) Sync() error { return w.dest.Sync() }
@@ -0,0 +1,76 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// TestFlashLayout verifica la scrittura di più immagini in un solo
+// lavoro: una tabella delle partizioni, un bootloader a offset fisso e un
+// rootfs nella partizione descritta dalla tabella appena scritta.
+func TestFlashLayout(t *testing.T) {
+	scratch := &memDest{data: make([]byte, 4*mib)}
+	d, err := NewDisk("scratch", scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Linux, Start: 2048, Size: 2048},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	mbrImage := scratch.data[:512]
+	uboot := bytes.Repeat([]byte("u-boot"), 100)
+	rootfs := bytes.Repeat([]byte("rootfs"), 1000)
+
+	dest := &memDest{data: make([]byte, 4*mib)}
+	RegisterDestination("layout", func(string) (Destination, error) { return dest, nil })
+	entries := func() []LayoutEntry {
+		return []LayoutEntry{
+			{Name: "mbr", Source: NewSource(bytes.NewReader(mbrImage), 512)},
+			{Name: "u-boot", Source: NewSource(bytes.NewReader(uboot), int64(len(uboot))), Offset: 8192},
+			{Name: "rootfs", Source: NewSource(bytes.NewReader(rootfs), int64(len(rootfs))), Partition: 1},
+		}
+	}
+	confirmed := 0
+	var phases []int
+	f := &Flasher{BlockSize: 512, Verify: true, Confirm: func() error { confirmed++; return nil },
+		OnProgress: func(p Progress) { phases = append(phases, p.PhaseIndex) }}
+	results, err := f.FlashLayout(context.Background(), entries(), "layout://sdb")
+	if err != nil {
+		t.Fatalf("FlashLayout ha restituito un errore: %v", err)
+	}
+	if confirmed != 1 {
+		t.Errorf("La conferma dovrebbe essere chiesta una volta. Got: %d", confirmed)
+	}
+	if len(results) != 3 || results[2].Offset != mib || results[2].Verification != "passed" {
+		t.Errorf("Risultati errati. Got: %+v", results)
+	}
+	if !bytes.Equal(dest.data[:512], mbrImage) || !bytes.Equal(dest.data[8192:8192+len(uboot)], uboot) ||
+		!bytes.Equal(dest.data[mib:mib+len(rootfs)], rootfs) || !dest.synced {
+		t.Error("Le immagini non sono state scritte al loro posto")
+	}
+	if len(phases) == 0 || phases[len(phases)-1] != 6 {
+		t.Errorf("Il progresso dovrebbe coprire 6 fasi. Got: %v", phases)
+	}
+
+	overlap := entries()
+	overlap[1].Offset = 256
+	if _, err := f.FlashLayout(context.Background(), overlap, "layout://sdb"); err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("Immagini sovrapposte dovrebbero essere rifiutate. Got: %v", err)
+	}
+	big := entries()
+	big[2].Source = NewSource(bytes.NewReader(make([]byte, 2*mib)), 2*mib)
+	if _, err := f.FlashLayout(context.Background(), big, "layout://sdb"); !errors.Is(err, ErrDeviceTooSmall) {
+		t.Errorf("Un'immagine più grande della partizione dovrebbe essere rifiutata. Got: %v", err)
+	}
+	if confirmed != 2 {
+		t.Errorf("La conferma non dovrebbe essere chiesta per un layout sovrapposto. Got: %d", confirmed)
+	}
+}
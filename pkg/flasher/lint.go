@@ -0,0 +1,179 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// devicePartition matches the name of a partition in /dev, e.g.
+// /dev/mmcblk0p2 or /dev/sda2, capturing its number.
+var devicePartition = regexp.MustCompile(`^/dev/(?:(?:mmcblk|nvme|loop)\S*p|[shv]d[a-z]+)(\d+)$`)
+
+// extlinuxConfigs are the boot menus of U-Boot, whose APPEND lines hold
+// the kernel command line.
+var extlinuxConfigs = []string{"/extlinux/extlinux.conf", "/boot/extlinux/extlinux.conf"}
+
+// LintDevice opens the device at location for reading and returns the
+// problems that Disk.Lint finds on it.
+func LintDevice(location string, required []string) ([]string, error) {
+	dest, err := openForReading(location)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	d, err := NewDisk(location, dest)
+	if err != nil {
+		return nil, err
+	}
+	return d.Lint(required)
+}
+
+// Lint looks for the mistakes that would keep the system on d from
+// booting, and returns them, none if it looks right:
+//
+//   - the partition table or the FAT32 boot partition are missing;
+//   - a file of required, e.g. "/overlays/my-hat.dtbo", is in none of the
+//     partitions;
+//   - an entry of /etc/fstab, unless nofail or noauto, or the root= of the
+//     kernel command line (cmdline.txt, extlinux.conf) names by UUID,
+//     label or number a partition or a filesystem that is not there.
+//
+// Devices named otherwise, e.g. /dev/root, are not checked.
+func (d *Disk) Lint(required []string) ([]string, error) {
+	parts, err := d.Partitions()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 {
+		return []string{"the device has no partition table"}, nil
+	}
+	var problems []string
+	_, boot, err := d.BootPartition()
+	if err != nil {
+		problems = append(problems, "no FAT32 boot partition")
+	}
+	for _, name := range required {
+		if _, _, err := d.FindFile(name); err != nil {
+			problems = append(problems, fmt.Sprintf("%s is missing", name))
+		}
+	}
+	ids := d.partitionIDs(parts)
+
+	if _, root, err := d.FindFile("/etc/fstab"); err == nil {
+		fstab, _ := root.ReadFile("/etc/fstab")
+		for _, l := range splitLines(string(fstab)) {
+			f := strings.Fields(l)
+			if len(f) < 4 || strings.HasPrefix(f[0], "#") || f[2] == "swap" {
+				continue
+			}
+			options := "," + f[3] + ","
+			if strings.Contains(options, ",nofail,") || strings.Contains(options, ",noauto,") {
+				continue
+			}
+			if !ids.resolve(f[0]) {
+				problems = append(problems, fmt.Sprintf("fstab mounts %s on %s, which is not on the device", f[0], f[1]))
+			}
+		}
+	}
+
+	checkRoot := func(source, cmdline string) {
+		for _, p := range strings.Fields(cmdline) {
+			if root, ok := strings.CutPrefix(p, "root="); ok && !ids.resolve(root) {
+				problems = append(problems, fmt.Sprintf("the root=%s of %s is not on the device", root, source))
+			}
+		}
+	}
+	if boot != nil {
+		if cmdline, err := boot.ReadFile("/cmdline.txt"); err == nil {
+			checkRoot("cmdline.txt", string(cmdline))
+		}
+	}
+	for _, name := range extlinuxConfigs {
+		_, fsys, err := d.FindFile(name)
+		if err != nil {
+			continue
+		}
+		conf, _ := fsys.ReadFile(name)
+		for _, l := range splitLines(string(conf)) {
+			if f := strings.Fields(l); len(f) > 1 && strings.EqualFold(f[0], "append") {
+				checkRoot("extlinux.conf", strings.Join(f[1:], " "))
+			}
+		}
+		break
+	}
+	return problems, nil
+}
+
+// partitionIDs are the names by which fstab and the kernel find the
+// partitions of a disk, in lower case: keys are "UUID", "PARTUUID",
+// "LABEL", "PARTLABEL" and "number".
+type partitionIDs map[string]map[string]bool
+
+// partitionIDs returns the names of parts, and of their filesystems.
+func (d *Disk) partitionIDs(parts []Partition) partitionIDs {
+	ids := partitionIDs{"UUID": {}, "PARTUUID": {}, "LABEL": {}, "PARTLABEL": {}, "number": {}}
+	for _, p := range parts {
+		ids["number"][strconv.Itoa(p.Number)] = true
+		uuid := strings.ToLower(p.UUID)
+		// go-diskfs non completa con gli zeri la firma del disco MBR.
+		if sig, n, ok := strings.Cut(uuid, "-"); ok && len(p.Type) == 2 && len(sig) < 8 {
+			uuid = strings.Repeat("0", 8-len(sig)) + sig + "-" + n
+		}
+		ids["PARTUUID"][uuid] = true
+		if p.Name != "" {
+			ids["PARTLABEL"][strings.ToLower(p.Name)] = true
+		}
+		if fs := ProbeFilesystem(&diskBackend{dest: d.dest, base: p.Start, size: p.Size}); fs != nil {
+			ids["UUID"][strings.ToLower(fs.UUID)] = true
+			if fs.Label != "" {
+				ids["LABEL"][strings.ToLower(fs.Label)] = true
+			}
+		}
+	}
+	return ids
+}
+
+// resolve reports whether the device spec of fstab or root= names a
+// partition of ids; other specs, which sflashy cannot check, are taken to
+// resolve.
+func (ids partitionIDs) resolve(spec string) bool {
+	for key, prefix := range map[string]string{"UUID": "/dev/disk/by-uuid/", "PARTUUID": "/dev/disk/by-partuuid/", "LABEL": "/dev/disk/by-label/", "PARTLABEL": "/dev/disk/by-partlabel/"} {
+		value, ok := strings.CutPrefix(spec, key+"=")
+		if !ok {
+			value, ok = strings.CutPrefix(spec, prefix)
+		}
+		if ok {
+			return ids[key][strings.ToLower(strings.Trim(value, `"`))]
+		}
+	}
+	if m := devicePartition.FindStringSubmatch(spec); m != nil {
+		return ids["number"][m[1]]
+	}
+	return true
+}
+
+// CheckBoot is the last Step of a recipe: it fails with ErrNotBootable when
+// Disk.Lint finds a problem, so that a device that would obviously not
+// boot is reported as a failed flash. Partitions whose filesystem is
+// created once the device is closed are not there yet: LintDevice checks
+// the device then.
+type CheckBoot struct {
+	// Required are files that must be in one of the partitions.
+	Required []string
+}
+
+func (s CheckBoot) Name() string { return "check that the device would boot" }
+
+func (s CheckBoot) Apply(_ context.Context, disk *Disk) error {
+	problems, err := disk.Lint(s.Required)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotBootable, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestLint verifica i controlli sul risultato della personalizzazione:
+// partizioni di fstab e root= della riga di comando del kernel.
+func TestLint(t *testing.T) {
+	d, err := NewDisk("dev", &memDest{data: newTestImage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// L'fstab dell'immagine di prova indica PARTUUID di un altro disco.
+	problems, err := d.Lint([]string{"/etc/hostname", "/overlays/manca.dtbo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 || !strings.Contains(problems[0], "/overlays/manca.dtbo") || !strings.Contains(problems[1], "PARTUUID=1234-01") {
+		t.Errorf("Problemi errati. Got: %q", problems)
+	}
+
+	fstab := "proc /proc proc defaults 0 0\nPARTUUID=00000000-01 /boot/firmware vfat defaults 0 2\nLABEL=rootfs / ext4 defaults,noatime 0 1\nLABEL=DATA /data ext4 defaults,nofail 0 2\n"
+	err = d.Apply(context.Background(),
+		WriteFiles{Partition: 2, Files: map[string][]byte{"/etc/fstab": []byte(fstab)}},
+		WriteFiles{Partition: 1, Files: map[string][]byte{"/cmdline.txt": []byte("console=tty1 root=PARTUUID=00000000-02 rootwait\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := d.Lint([]string{"/etc/hostname", "/cmdline.txt"}); err != nil || len(problems) != 0 {
+		t.Errorf("Un'immagine corretta non dovrebbe avere problemi. Got: %q, %v", problems, err)
+	}
+	if err := d.Apply(context.Background(), CheckBoot{}); err != nil {
+		t.Errorf("CheckBoot ha restituito un errore: %v", err)
+	}
+
+	if err := d.Apply(context.Background(), WriteFiles{Partition: 1, Files: map[string][]byte{"/cmdline.txt": []byte("root=/dev/mmcblk0p3 rootwait\n")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), CheckBoot{}); !errors.Is(err, ErrNotBootable) || !strings.Contains(err.Error(), "root=/dev/mmcblk0p3") {
+		t.Errorf("Una root inesistente dovrebbe essere segnalata. Got: %v", err)
+	}
+}
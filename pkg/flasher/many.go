@@ -0,0 +1,423 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TargetResult is the outcome of FlashMany for one of its devices.
+type TargetResult struct {
+	Device string
+	Result
+	// Err is why the device failed, nil if it was written (and verified).
+	Err error
+}
+
+// target is a device written by FlashMany.
+type target struct {
+	res  *TargetResult
+	dest Destination
+}
+
+// fail marks t as failed with err, the first error only.
+func (t *target) fail(err error) {
+	if t.res.Err == nil {
+		t.res.Err = checkRemoved(t.res.Device, err)
+	}
+}
+
+// FlashMany writes src to all of devices at once, reading it a single
+// time, e.g. to duplicate a card to several blank ones. Each block is
+// written to every device before the next one is read, so the copy goes
+// at the pace of the slowest device. A device that fails, to open, to be
+// written or to be verified, is left behind and the others go on: its
+// TargetResult tells why. Confirm is asked once, after every device has
+// been opened. The returned error is set when no device could be
+// written, or when the copy was interrupted through ctx. Steps run on each
+// device as Flash runs them; resuming is not supported.
+func (f *Flasher) FlashMany(ctx context.Context, src *Source, devices []string) (results []TargetResult, err error) {
+	ctx, span := f.startSpan(ctx, "flash_many")
+	span.SetAttribute(AttrImageFormat, src.Format)
+	span.SetAttribute(AttrImageSize, src.Size)
+	defer func() { span.End(err) }()
+
+	results = make([]TargetResult, len(devices))
+	var targets []*target
+	defer func() {
+		for _, t := range targets {
+			t.dest.Close()
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				f.publish(Event{Type: EventFailed, Device: r.Device, Bytes: r.Bytes, Err: r.Err})
+			} else if err == nil {
+				f.publish(Event{Type: EventCompleted, Device: r.Device, Bytes: r.Bytes})
+			}
+		}
+	}()
+	if f.Align > 0 && f.Seek%int64(f.Align) != 0 {
+		return results, fmt.Errorf("the offset %d is not a multiple of the %d-byte sectors", f.Seek, f.Align)
+	}
+	size := f.WriteSize(src.Size)
+	checked, err := f.precheck(ctx, src, f.Skip, size, f.Checksum)
+	if err != nil {
+		for i, device := range devices {
+			results[i] = TargetResult{Device: device, Result: Result{Verification: "skipped"}, Err: err}
+		}
+		return results, err
+	}
+	for i, device := range devices {
+		results[i] = TargetResult{Device: device, Result: Result{Verification: "skipped"}}
+		dest, err := OpenDestination(device)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if capacity := dest.Size(); capacity > 0 && src.Exact && f.Seek+size > capacity {
+			dest.Close()
+			results[i].Err = fmt.Errorf("%w: the image needs %d bytes but %s has only %d", ErrDeviceTooSmall, f.Seek+size, device, capacity)
+			continue
+		}
+		targets = append(targets, &target{res: &results[i], dest: dest})
+		f.publish(Event{Type: EventValidated, Device: device})
+	}
+	if len(targets) == 0 {
+		return results, fmt.Errorf("none of the %d devices can be written", len(devices))
+	}
+
+	var r io.Reader = src.Reader
+	if f.Skip > 0 {
+		if err := skipInput(ctx, r, f.Skip); err != nil {
+			return results, fmt.Errorf("could not skip %d bytes of the image: %w", f.Skip, err)
+		}
+	}
+	if f.Count > 0 {
+		r = io.LimitReader(r, f.Count)
+	}
+	if f.Confirm != nil {
+		if err := f.Confirm(); err != nil {
+			return results, err
+		}
+	}
+	for _, t := range targets {
+		f.publish(Event{Type: EventConfirmed, Device: t.res.Device})
+	}
+
+	start := time.Now()
+	defer func() {
+		for i := range results {
+			results[i].Elapsed = time.Since(start)
+		}
+	}()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	var writePhase, verifyPhase *progressPhase
+	if f.Verify && size > 0 {
+		writePhase = &progressPhase{Index: 1, Count: 2, Total: 2 * size, Start: start}
+		verifyPhase = &progressPhase{Index: 2, Count: 2, Done: size, Total: 2 * size, Start: start}
+	}
+	live := f.eachTarget(targets, func(t *target) error {
+		return f.runHooks(ctx, HookInfo{Stage: HookPreWrite, Device: t.res.Device, Verification: t.res.Verification})
+	})
+	if len(live) == 0 {
+		return results, fmt.Errorf("none of the %d devices can be written", len(devices))
+	}
+	for _, t := range live {
+		f.publish(Event{Type: EventWriteStarted, Device: t.res.Device})
+	}
+	fan := &fanOut{targets: live, offset: f.Seek}
+	st := &copyState{hasher: f.newHash()}
+	if bars := f.newTargetBars(live); bars != nil {
+		// Si scrive un blocco alla volta su tutti: la riga è la stessa,
+		// tranne per i dispositivi che hanno già fallito.
+		st.render = func(line string) {
+			for _, t := range live {
+				if t.res.Err != nil {
+					bars.fail(t, t.res.Err)
+				} else {
+					bars.set(t, line)
+				}
+			}
+			bars.draw()
+		}
+	}
+	copied, err := f.copy(ctx, flashOp, r, fan, size, writePhase, st)
+	for _, t := range fan.targets {
+		t.res.Bytes = copied.Bytes
+	}
+	if err != nil {
+		// I dati scritti vengono comunque scaricati, come per Flash.
+		for _, t := range fan.targets {
+			t.dest.Sync()
+			t.fail(err)
+		}
+		switch {
+		case errors.Is(err, ErrTimeout):
+			return results, fmt.Errorf("%w: the write did not complete within %s (%d bytes written)", ErrTimeout, f.Timeout, copied.Bytes)
+		case ctx.Err() != nil:
+			return results, fmt.Errorf("write interrupted (%d bytes written): %w", copied.Bytes, err)
+		}
+		return results, err
+	}
+	if f.Checksum != "" && !checked {
+		if err := checkDigest(copied.Digest, f.Checksum); err != nil {
+			for _, t := range fan.targets {
+				t.fail(err)
+			}
+			return results, err
+		}
+	}
+
+	fmt.Fprintln(f.output(), "Finalizing write (syncing)...")
+	live = f.eachTarget(fan.targets, func(t *target) error {
+		t.res.Digest = copied.Digest
+		if err := t.dest.Sync(); err != nil {
+			return fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err)
+		}
+		f.publish(Event{Type: EventSynced, Device: t.res.Device, Bytes: t.res.Bytes})
+		return f.runHooks(ctx, HookInfo{Stage: HookPostWrite, Device: t.res.Device, Bytes: t.res.Bytes, Digest: t.res.Digest, Verification: t.res.Verification})
+	})
+	if f.Verify && len(live) > 0 {
+		live = f.verifyMany(ctx, live, copied.Bytes, copied.Digest, verifyPhase)
+	}
+	if len(f.Steps) > 0 {
+		cctx, cspan := f.startSpan(ctx, "customize")
+		live = f.eachTarget(live, func(t *target) error {
+			return f.runSteps(cctx, t.dest, t.res.Device)
+		})
+		cspan.End(nil)
+	}
+	if f.Verify {
+		live = f.eachTarget(live, func(t *target) error {
+			return f.runHooks(ctx, HookInfo{Stage: HookPostVerify, Device: t.res.Device, Bytes: t.res.Bytes, Digest: t.res.Digest, Verification: t.res.Verification})
+		})
+	}
+	if len(live) == 0 {
+		return results, fmt.Errorf("none of the %d devices was written successfully", len(devices))
+	}
+	return results, nil
+}
+
+// eachTarget calls fn for each of targets, in order, and returns those for
+// which it succeeded; the others are marked as failed.
+func (f *Flasher) eachTarget(targets []*target, fn func(*target) error) []*target {
+	var ok []*target
+	for _, t := range targets {
+		if err := fn(t); err != nil {
+			f.logger().Warn("device failed, going on with the others", "device", t.res.Device, "err", err)
+			t.fail(err)
+			continue
+		}
+		ok = append(ok, t)
+	}
+	return ok
+}
+
+// verifyMany reads back size bytes of each of targets at once and compares
+// their digest with want. It returns the targets that match; the progress
+// reported covers the reads of all of them, while a terminal shows that
+// of each device.
+func (f *Flasher) verifyMany(ctx context.Context, targets []*target, size int64, want []byte, phase *progressPhase) []*target {
+	out := f.output()
+	fmt.Fprintf(out, "Verifying written data on %d devices...\n", len(targets))
+	pw := f.newProgress("Verifying", size*int64(len(targets)), perDevice(phase, len(targets)))
+	bars := f.newTargetBars(targets)
+	if bars != nil {
+		pw.render = func(string) {}
+	}
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c, ok := t.dest.(interface{ DropCache() }); ok {
+				c.DropCache()
+			}
+			hasher := f.newHash()
+			var progress io.Writer = pw
+			if bars != nil {
+				progress = io.MultiWriter(pw, f.targetProgress(bars, t, size, phase))
+			}
+			n, err := io.Copy(io.MultiWriter(hasher, progress), withContext(ctx, io.NewSectionReader(t.dest, f.Seek, size)))
+			switch {
+			case err != nil:
+				err = fmt.Errorf("%w: error while reading back the device: %w", ErrVerifyFailed, err)
+			case n != size:
+				err = fmt.Errorf("%w: read back %d bytes, expected %d", ErrVerifyFailed, n, size)
+			case !bytes.Equal(hasher.Sum(nil), want):
+				err = fmt.Errorf("%w: device digest is %x, image digest is %x", ErrVerifyFailed, hasher.Sum(nil), want)
+			}
+			if err != nil {
+				t.fail(err)
+			}
+			if bars != nil {
+				if err != nil {
+					bars.fail(t, err)
+				} else {
+					bars.set(t, "Verification passed")
+				}
+				bars.draw()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Fprintln(out)
+	pw.finish()
+
+	var ok []*target
+	for _, t := range targets {
+		if t.res.Err != nil {
+			t.res.Verification = "FAILED"
+			f.logger().Warn("verification failed", "device", t.res.Device, "err", t.res.Err)
+			continue
+		}
+		t.res.Verification = "passed"
+		ok = append(ok, t)
+	}
+	if len(ok) > 0 {
+		fmt.Fprintf(out, f.Colors.Success+"Verification successful on %d of %d devices."+f.Colors.Reset+"\n", len(ok), len(targets))
+	}
+	return ok
+}
+
+// perDevice returns phase, which counts the bytes of a device, for the
+// reads of n devices at once.
+func perDevice(phase *progressPhase, n int) *progressPhase {
+	if phase == nil {
+		return nil
+	}
+	return &progressPhase{Index: phase.Index, Count: phase.Count, Done: phase.Done * int64(n), Total: phase.Total * int64(n), Start: phase.Start}
+}
+
+// targetBars draw a progress line for each target of FlashMany on a
+// terminal, one under the other, and redraw them in place.
+type targetBars struct {
+	mu      sync.Mutex
+	out     io.Writer
+	colors  Colors
+	targets []*target
+	lines   map[*target]string
+	failed  map[*target]bool
+	width   int  // del nome di dispositivo più lungo
+	drawn   bool // le righe sono sopra il cursore
+}
+
+// newTargetBars returns the targetBars of targets, or nil when the output
+// is not a terminal or there is a single target, whose progress is drawn
+// as Flash draws it.
+func (f *Flasher) newTargetBars(targets []*target) *targetBars {
+	out := f.output()
+	if len(targets) < 2 || !IsTerminal(out) {
+		return nil
+	}
+	b := &targetBars{out: out, colors: f.Colors, targets: targets, lines: make(map[*target]string), failed: make(map[*target]bool)}
+	for _, t := range targets {
+		b.width = max(b.width, len(t.res.Device))
+	}
+	return b
+}
+
+// set changes the line of t, which is shown by the next draw.
+func (b *targetBars) set(t *target, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.failed[t] {
+		b.lines[t] = line
+	}
+}
+
+// fail shows err on the line of t from the next draw on.
+func (b *targetBars) fail(t *target, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines[t], b.failed[t] = "FAILED: "+err.Error(), true
+}
+
+// draw redraws the lines over the previous ones, leaving the cursor below.
+func (b *targetBars) draw() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.drawn {
+		fmt.Fprintf(b.out, "\x1b[%dA", len(b.targets))
+	}
+	for _, t := range b.targets {
+		color := b.colors.Progress
+		if b.failed[t] {
+			color = ""
+		}
+		fmt.Fprintf(b.out, "\r%s%-*s  %s\x1b[K%s\n", color, b.width, t.res.Device, b.lines[t], b.colors.Reset)
+	}
+	b.drawn = true
+}
+
+// targetProgress returns a progressWriter for the reads of size bytes
+// of t, drawn on its line of bars.
+func (f *Flasher) targetProgress(bars *targetBars, t *target, size int64, phase *progressPhase) *progressWriter {
+	pw := newProgressWriter(bars.out, "Verifying", size)
+	pw.phase, pw.step, pw.sizeFmt = phase, f.ProgressStep, f.FormatSize
+	pw.render = func(line string) {
+		bars.set(t, line)
+		bars.draw()
+	}
+	return pw
+}
+
+// fanOut writes each block to all of its targets at once, at the same
+// offset. A target that fails is dropped; the write fails only when none
+// is left.
+type fanOut struct {
+	targets []*target
+	offset  int64
+}
+
+func (w *fanOut) Write(p []byte) (int, error) {
+	var wg sync.WaitGroup
+	for _, t := range w.targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := t.dest.WriteAt(p, w.offset); err != nil {
+				t.fail(fmt.Errorf("%w: %w", ErrWrite, err))
+			}
+		}()
+	}
+	wg.Wait()
+	w.offset += int64(len(p))
+	return len(p), w.drop()
+}
+
+// Sync lets a paused copy flush the data written so far to every target.
+func (w *fanOut) Sync() error {
+	for _, t := range w.targets {
+		if err := t.dest.Sync(); err != nil {
+			t.fail(fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+		}
+	}
+	return w.drop()
+}
+
+// drop removes the failed targets, and fails when none is left.
+func (w *fanOut) drop() error {
+	var errs []error
+	live := w.targets[:0]
+	for _, t := range w.targets {
+		if t.res.Err != nil {
+			errs = append(errs, t.res.Err)
+			continue
+		}
+		live = append(live, t)
+	}
+	w.targets = live
+	if len(live) == 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
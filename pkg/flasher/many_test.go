@@ -0,0 +1,86 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingDest è una destinazione che rifiuta ogni scrittura.
+type failingDest struct{ memDest }
+
+func (d *failingDest) WriteAt([]byte, int64) (int, error) { return 0, errors.New("errore di I/O") }
+
+// TestFlashMany verifica la scrittura di un'immagine su più dispositivi:
+// quelli che falliscono vengono lasciati indietro, gli altri completano
+// scrittura e verifica.
+func TestFlashMany(t *testing.T) {
+	data := "immagine da duplicare su più schede"
+	a, b := &memDest{data: make([]byte, 64)}, &memDest{data: make([]byte, 64)}
+	small := &memDest{data: make([]byte, 8)}
+	broken := &failingDest{memDest{data: make([]byte, 64)}}
+	for name, d := range map[string]Destination{"manya": a, "manyb": b, "manysmall": small, "manybroken": broken} {
+		RegisterDestination(name, func(string) (Destination, error) { return d, nil })
+	}
+	confirmed := 0
+	f := &Flasher{BlockSize: 8, Verify: true, Confirm: func() error { confirmed++; return nil }}
+	devices := []string{"manya://sdb", "manysmall://sdc", "manybroken://sdd", "manyb://sde"}
+	results, err := f.FlashMany(context.Background(), NewSource(strings.NewReader(data), int64(len(data))), devices)
+	if err != nil {
+		t.Fatalf("FlashMany ha restituito un errore: %v", err)
+	}
+	if confirmed != 1 {
+		t.Errorf("La conferma dovrebbe essere chiesta una volta. Got: %d", confirmed)
+	}
+	for i, want := range []error{nil, ErrDeviceTooSmall, ErrWrite, nil} {
+		r := results[i]
+		if r.Device != devices[i] || (want == nil) != (r.Err == nil) || (want != nil && !errors.Is(r.Err, want)) {
+			t.Errorf("Risultato di %s errato. Got: %v, Want: %v", devices[i], r.Err, want)
+		}
+	}
+	for _, d := range []*memDest{a, b} {
+		if !bytes.HasPrefix(d.data, []byte(data)) || !d.synced {
+			t.Errorf("Dispositivo scritto male. Got: %q", d.data)
+		}
+	}
+	if results[0].Verification != "passed" || results[3].Bytes != int64(len(data)) {
+		t.Errorf("Risultato errato. Got: %+v", results[3])
+	}
+
+	var customized []string
+	f.Steps = []Step{StepFunc("record", func(_ context.Context, d *Disk) error { customized = append(customized, d.Device); return nil })}
+	if _, err := f.FlashMany(context.Background(), NewSource(strings.NewReader(data), int64(len(data))), []string{"manya://sdb", "manyb://sde"}); err != nil {
+		t.Fatalf("FlashMany ha restituito un errore: %v", err)
+	}
+	if strings.Join(customized, ",") != "manya://sdb,manyb://sde" {
+		t.Errorf("I passi vanno eseguiti su ogni dispositivo. Got: %v", customized)
+	}
+	f.Steps = nil
+
+	if _, err := f.FlashMany(context.Background(), NewSource(strings.NewReader(data), int64(len(data))), []string{"manybroken://sdd"}); err == nil {
+		t.Error("Senza dispositivi scritti FlashMany dovrebbe restituire un errore")
+	}
+}
+
+// TestTargetBars verifica le righe di progresso dei dispositivi: ognuna
+// col nome allineato, ridisegnate sopra le precedenti.
+func TestTargetBars(t *testing.T) {
+	var out bytes.Buffer
+	a, b := &target{res: &TargetResult{Device: "/dev/sdb"}}, &target{res: &TargetResult{Device: "/dev/mmcblk0"}}
+	bars := &targetBars{out: &out, targets: []*target{a, b}, lines: make(map[*target]string), failed: make(map[*target]bool), width: 12}
+	bars.set(a, "Writing... 50%")
+	bars.set(b, "Writing... 50%")
+	bars.draw()
+	if want := "\r/dev/sdb      Writing... 50%\x1b[K\n\r/dev/mmcblk0  Writing... 50%\x1b[K\n"; out.String() != want {
+		t.Errorf("Righe errate. Got: %q, Want: %q", out.String(), want)
+	}
+	out.Reset()
+	bars.fail(a, errors.New("errore di I/O"))
+	bars.set(a, "Writing... 100%")
+	bars.draw()
+	if got := out.String(); !strings.HasPrefix(got, "\x1b[2A") || !strings.Contains(got, "/dev/sdb      FAILED: errore di I/O") {
+		t.Errorf("Il dispositivo fallito va ridisegnato sopra. Got: %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// StaticNetwork gives a network interface of a Raspberry Pi OS image a
+// static IPv4 address instead of DHCP. The configuration is written at the
+// first boot by the firstrun.sh script of RaspberryPiSetup, for the
+// network stack the system uses: a NetworkManager connection from
+// Bookworm, a systemd-networkd unit, or dhcpcd.conf before Bookworm. For a
+// wireless interface under NetworkManager, the connection of
+// RaspberryPiSetup, which must come first, is changed.
+type StaticNetwork struct {
+	// Interface is the name of the interface, "eth0" if empty.
+	Interface string
+	// Address is the address with its prefix length, e.g.
+	// "192.168.1.50/24".
+	Address string
+	// Gateway and DNS are optional addresses.
+	Gateway string
+	DNS     []string
+}
+
+// interfacePattern matches a Linux network interface name.
+var interfacePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+func (s StaticNetwork) Name() string {
+	return fmt.Sprintf("set the address of %s to %s", s.iface(), s.Address)
+}
+
+func (s StaticNetwork) iface() string {
+	if s.Interface == "" {
+		return "eth0"
+	}
+	return s.Interface
+}
+
+// Validate checks the settings, which Apply does before writing anything.
+func (s StaticNetwork) Validate() error {
+	if !interfacePattern.MatchString(s.iface()) {
+		return fmt.Errorf("invalid interface name %q", s.Interface)
+	}
+	prefix, err := netip.ParsePrefix(s.Address)
+	if err != nil || !prefix.Addr().Is4() {
+		return fmt.Errorf("invalid address %q, expected an IPv4 address with its prefix, e.g. 192.168.1.50/24", s.Address)
+	}
+	for _, a := range append([]string{s.Gateway}, s.DNS...) {
+		if a == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(a); err != nil || !addr.Is4() {
+			return fmt.Errorf("invalid IPv4 address %q", a)
+		}
+	}
+	return nil
+}
+
+func (s StaticNetwork) Apply(_ context.Context, disk *Disk) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	_, boot, err := disk.FindFile("/cmdline.txt")
+	if err != nil {
+		return fmt.Errorf("not a Raspberry Pi OS image: %w", err)
+	}
+	files := make(map[string][]byte)
+	if err := addFirstRun(disk, boot, files, []string{s.script()}); err != nil {
+		return err
+	}
+	for _, name := range []string{"/cmdline.txt", "/firstrun.sh"} {
+		if err := boot.WriteFile(name, files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// script returns the firstrun.sh commands that configure the interface.
+func (s StaticNetwork) script() string {
+	iface := s.iface()
+	nmAddress := s.Address
+	if s.Gateway != "" {
+		nmAddress += "," + s.Gateway
+	}
+	var nmDNS, networkd, dhcpcd strings.Builder
+	fmt.Fprintf(&networkd, "[Match]\nName=%s\n\n[Network]\nAddress=%s\n", iface, s.Address)
+	fmt.Fprintf(&dhcpcd, "\ninterface %s\nstatic ip_address=%s\n", iface, s.Address)
+	if s.Gateway != "" {
+		fmt.Fprintf(&networkd, "Gateway=%s\n", s.Gateway)
+		fmt.Fprintf(&dhcpcd, "static routers=%s\n", s.Gateway)
+	}
+	if len(s.DNS) > 0 {
+		fmt.Fprintf(&nmDNS, "dns=%s;\n", strings.Join(s.DNS, ";"))
+		for _, d := range s.DNS {
+			fmt.Fprintf(&networkd, "DNS=%s\n", d)
+		}
+		fmt.Fprintf(&dhcpcd, "static domain_name_servers=%s\n", strings.Join(s.DNS, " "))
+	}
+	ipv4 := fmt.Sprintf("method=manual\naddress1=%s\n%s", nmAddress, nmDNS.String())
+
+	nm := fmt.Sprintf(`cat >/etc/NetworkManager/system-connections/%[1]s.nmconnection <<'NMEOF'
+[connection]
+id=%[1]s
+type=ethernet
+interface-name=%[1]s
+
+[ipv4]
+%[2]s
+[ipv6]
+method=auto
+NMEOF
+   chmod 600 /etc/NetworkManager/system-connections/%[1]s.nmconnection`, iface, ipv4)
+	if strings.HasPrefix(iface, "wl") {
+		// La connessione Wi-Fi è quella scritta da imager_custom.
+		nm = fmt.Sprintf(`sed -i '/^\[ipv4\]/,/^\[/{s|^method=auto$|%s|}' /etc/NetworkManager/system-connections/preconfigured.nmconnection`,
+			strings.ReplaceAll(strings.TrimSuffix(ipv4, "\n"), "\n", `\n`))
+	}
+	return fmt.Sprintf(`if [ -d /etc/NetworkManager/system-connections ] && systemctl -q is-enabled NetworkManager; then
+   %s
+elif systemctl -q is-enabled systemd-networkd; then
+cat >/etc/systemd/network/10-%s.network <<'NETEOF'
+%sNETEOF
+else
+cat >>/etc/dhcpcd.conf <<'DHCPEOF'
+%sDHCPEOF
+fi
+`, nm, iface, networkd.String(), dhcpcd.String())
+}
@@ -0,0 +1,65 @@
+package flasher
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStaticNetwork verifica la configurazione di rete aggiunta a
+// firstrun.sh, dopo quella di RaspberryPiSetup.
+func TestStaticNetwork(t *testing.T) {
+	dest := &memDest{data: newTestImage(t)}
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Apply(context.Background(),
+		WriteFiles{Partition: 1, Files: map[string][]byte{"/cmdline.txt": []byte("console=tty1 rootwait\n")}},
+		RaspberryPiSetup{WiFi: WiFi{SSID: "rete", Password: "password1", Country: "IT"}},
+		StaticNetwork{Address: "192.168.1.50/24", Gateway: "192.168.1.1", DNS: []string{"1.1.1.1", "9.9.9.9"}},
+		StaticNetwork{Interface: "wlan0", Address: "10.0.0.7/8"})
+	if err != nil {
+		t.Fatalf("StaticNetwork ha restituito un errore: %v", err)
+	}
+	boot, err := d.Filesystem(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := boot.ReadFile("/firstrun.sh")
+	for _, want := range []string{
+		"imager_custom set_wlan",
+		"address1=192.168.1.50/24,192.168.1.1\ndns=1.1.1.1;9.9.9.9;\n",
+		"[Match]\nName=eth0\n\n[Network]\nAddress=192.168.1.50/24\nGateway=192.168.1.1\nDNS=1.1.1.1\nDNS=9.9.9.9\n",
+		"static domain_name_servers=1.1.1.1 9.9.9.9\n",
+		`s|^method=auto$|method=manual\naddress1=10.0.0.7/8|`,
+	} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("firstrun.sh non contiene %q. Got:\n%s", want, script)
+		}
+	}
+	if strings.Count(string(script), "rm -f /boot/firmware/firstrun.sh") != 1 || strings.Index(string(script), "set_wlan") > strings.Index(string(script), "eth0") {
+		t.Errorf("I comandi vanno accodati in un solo script. Got:\n%s", script)
+	}
+	if bash, err := exec.LookPath("bash"); err == nil {
+		path := filepath.Join(t.TempDir(), "firstrun.sh")
+		os.WriteFile(path, script, 0o644)
+		if out, err := exec.Command(bash, "-n", path).CombinedOutput(); err != nil {
+			t.Errorf("firstrun.sh non è uno script valido: %v %s", err, out)
+		}
+	}
+
+	for _, bad := range []StaticNetwork{
+		{Address: "192.168.1.50"},
+		{Address: "fd00::1/64"},
+		{Address: "192.168.1.50/24", Gateway: "router"},
+		{Interface: "eth0; reboot", Address: "192.168.1.50/24"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Impostazioni non valide accettate: %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"regexp"
+	"strings"
+)
+
+// NVMeInfo is what the NVMe Identify commands tell about a namespace and
+// its controller.
+type NVMeInfo struct {
+	Model    string `json:"model"`
+	Serial   string `json:"serial"`
+	Firmware string `json:"firmware"`
+	// Namespace is the namespace ID (1 for nvme0n1).
+	Namespace uint32 `json:"namespace"`
+	// Size is the size of the namespace in bytes, LBASize the size of its
+	// blocks in the current format.
+	Size    int64 `json:"size"`
+	LBASize int   `json:"lba_size"`
+	// Sanitize lists the sanitize actions the controller supports, among
+	// "block-erase", "crypto-erase" and "overwrite".
+	Sanitize []string `json:"sanitize,omitempty"`
+	// CryptoErase reports whether Format NVM supports a cryptographic
+	// erase.
+	CryptoErase bool `json:"crypto_erase"`
+}
+
+// NVMeSecureErase is the Secure Erase Settings of a Format NVM command.
+type NVMeSecureErase uint32
+
+const (
+	NVMeNoErase     NVMeSecureErase = 0
+	NVMeUserErase   NVMeSecureErase = 1
+	NVMeCryptoErase NVMeSecureErase = 2
+)
+
+// NVMeSanitizeAction is the action of a Sanitize command.
+type NVMeSanitizeAction uint32
+
+const (
+	NVMeSanitizeBlockErase  NVMeSanitizeAction = 2
+	NVMeSanitizeOverwrite   NVMeSanitizeAction = 3
+	NVMeSanitizeCryptoErase NVMeSanitizeAction = 4
+)
+
+// nvmeNamespaceName matches the block devices of NVMe namespaces, and
+// nvmePathName the per-controller paths of a multipath namespace
+// (nvme0c0n1), which the kernel hides behind nvme0n1.
+var (
+	nvmeNamespaceName = regexp.MustCompile(`^nvme\d+n\d+$`)
+	nvmePathName      = regexp.MustCompile(`^nvme\d+c\d+n\d+$`)
+)
+
+// IsNVMeNamespace reports whether path is the block device of an NVMe
+// namespace, like /dev/nvme0n1.
+func IsNVMeNamespace(path string) bool {
+	return nvmeNamespaceName.MatchString(path[strings.LastIndex(path, "/")+1:])
+}
+
+// IsNVMePath reports whether path is a hidden path of a multipath NVMe
+// namespace, like nvme0c0n1, which is not a device of its own.
+func IsNVMePath(path string) bool {
+	return nvmePathName.MatchString(path[strings.LastIndex(path, "/")+1:])
+}
+
+// parseIdentifyController fills info from the 4096 bytes of an Identify
+// Controller data structure.
+func parseIdentifyController(data []byte, info *NVMeInfo) {
+	info.Serial = strings.TrimSpace(string(data[4:24]))
+	info.Model = strings.TrimSpace(string(data[24:64]))
+	info.Firmware = strings.TrimSpace(string(data[64:72]))
+	fna := data[524]
+	info.CryptoErase = fna&0x4 != 0
+	sanicap := binary.LittleEndian.Uint32(data[328:])
+	for bit, name := range []string{"crypto-erase", "block-erase", "overwrite"} {
+		if sanicap&(1<<bit) != 0 {
+			info.Sanitize = append(info.Sanitize, name)
+		}
+	}
+}
+
+// parseIdentifyNamespace fills info from the 4096 bytes of an Identify
+// Namespace data structure, and returns the index of the current LBA
+// format.
+func parseIdentifyNamespace(data []byte, info *NVMeInfo) uint32 {
+	nsze := binary.LittleEndian.Uint64(data[0:])
+	flbas := uint32(data[26] & 0xf)
+	lbads := data[128+4*flbas+2]
+	info.LBASize = 1 << lbads
+	info.Size = int64(nsze) * int64(info.LBASize)
+	return flbas
+}
@@ -0,0 +1,165 @@
+package flasher
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The NVMe ioctls of Linux: NVME_IOCTL_ID returns the namespace ID of a
+// namespace device, NVME_IOCTL_ADMIN_CMD passes an admin command.
+const (
+	nvmeIoctlID       = 0x4e40
+	nvmeIoctlAdminCmd = 0xc0484e41
+)
+
+// The admin commands used here.
+const (
+	nvmeGetLogPage = 0x02
+	nvmeIdentify   = 0x06
+	nvmeFormatNVM  = 0x80
+	nvmeSanitize   = 0x84
+)
+
+// nvmeAdminCmd is struct nvme_admin_cmd of linux/nvme_ioctl.h.
+type nvmeAdminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2, cdw3  uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// adminCmd passes cmd to the NVMe device f, with data as its buffer.
+func adminCmd(f *os.File, cmd nvmeAdminCmd, data []byte) error {
+	if len(data) > 0 {
+		cmd.addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+		cmd.dataLen = uint32(len(data))
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// namespaceID returns the namespace ID of the namespace device f.
+func namespaceID(f *os.File) (uint32, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlID, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint32(r), nil
+}
+
+// NVMeIdentify sends the Identify Controller and Identify Namespace
+// commands to the namespace device at path, e.g. /dev/nvme0n1.
+func NVMeIdentify(path string) (*NVMeInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info := &NVMeInfo{}
+	if _, _, err := identify(f, info); err != nil {
+		return nil, fmt.Errorf("NVMe identify %s: %w", path, err)
+	}
+	return info, nil
+}
+
+// identify fills info and returns the namespace ID and the current LBA
+// format of f.
+func identify(f *os.File, info *NVMeInfo) (nsid, flbas uint32, err error) {
+	if nsid, err = namespaceID(f); err != nil {
+		return 0, 0, err
+	}
+	info.Namespace = nsid
+	data := make([]byte, 4096)
+	if err := adminCmd(f, nvmeAdminCmd{opcode: nvmeIdentify, cdw10: 1}, data); err != nil {
+		return 0, 0, err
+	}
+	parseIdentifyController(data, info)
+	if err := adminCmd(f, nvmeAdminCmd{opcode: nvmeIdentify, nsid: nsid}, data); err != nil {
+		return 0, 0, err
+	}
+	return nsid, parseIdentifyNamespace(data, info), nil
+}
+
+// NVMeFormat sends a Format NVM command to the namespace device at path,
+// keeping its LBA format: every block reads back as zeros afterwards, and
+// with erase the controller also erases the user data (NVMeUserErase) or
+// the encryption key (NVMeCryptoErase). It blocks until the format ends.
+func NVMeFormat(path string, erase NVMeSecureErase) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	nsid, flbas, err := identify(f, &NVMeInfo{})
+	if err != nil {
+		return fmt.Errorf("NVMe identify %s: %w", path, err)
+	}
+	cmd := nvmeAdminCmd{opcode: nvmeFormatNVM, nsid: nsid, cdw10: flbas | uint32(erase)<<9, timeoutMs: uint32(time.Hour / time.Millisecond)}
+	if err := adminCmd(f, cmd, nil); err != nil {
+		return fmt.Errorf("NVMe format %s: %w", path, err)
+	}
+	return nil
+}
+
+// NVMeSanitize starts a Sanitize operation on the controller of the
+// namespace device at path, which erases every namespace of the
+// controller, and waits for its end, calling progress, if set, with the
+// fraction done. Once ctx is done it stops waiting, but the controller
+// goes on with the sanitize.
+func NVMeSanitize(ctx context.Context, path string, action NVMeSanitizeAction, progress func(float64)) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := adminCmd(f, nvmeAdminCmd{opcode: nvmeSanitize, cdw10: uint32(action)}, nil); err != nil {
+		return fmt.Errorf("NVMe sanitize %s: %w", path, err)
+	}
+	// Il registro 0x81 riporta l'avanzamento, in 65536esimi, e lo stato.
+	status := make([]byte, 512)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		cmd := nvmeAdminCmd{opcode: nvmeGetLogPage, nsid: 0xffffffff, cdw10: 0x81 | uint32(len(status)/4-1)<<16}
+		if err := adminCmd(f, cmd, status); err != nil {
+			return fmt.Errorf("NVMe sanitize status %s: %w", path, err)
+		}
+		switch binary.LittleEndian.Uint16(status[2:]) & 0x7 {
+		case 1, 4:
+			return nil
+		case 3:
+			return fmt.Errorf("NVMe sanitize %s failed", path)
+		}
+		if progress != nil {
+			progress(float64(binary.LittleEndian.Uint16(status[0:])) / 65536)
+		}
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-tick.C:
+		}
+	}
+}
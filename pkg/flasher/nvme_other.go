@@ -0,0 +1,24 @@
+//go:build !linux
+
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// NVMeIdentify is only implemented on Linux.
+func NVMeIdentify(path string) (*NVMeInfo, error) {
+	return nil, fmt.Errorf("NVMe identify %s: %w", path, errors.ErrUnsupported)
+}
+
+// NVMeFormat is only implemented on Linux.
+func NVMeFormat(path string, erase NVMeSecureErase) error {
+	return fmt.Errorf("NVMe format %s: %w", path, errors.ErrUnsupported)
+}
+
+// NVMeSanitize is only implemented on Linux.
+func NVMeSanitize(ctx context.Context, path string, action NVMeSanitizeAction, progress func(float64)) error {
+	return fmt.Errorf("NVMe sanitize %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,44 @@
+package flasher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// TestNVMeIdentify verifica la lettura delle strutture Identify e il
+// riconoscimento dei namespace NVMe.
+func TestNVMeIdentify(t *testing.T) {
+	ctrl := make([]byte, 4096)
+	copy(ctrl[4:24], "S4EWNX0R123456      ")
+	copy(ctrl[24:64], "Samsung SSD 970 EVO Plus 1TB            ")
+	copy(ctrl[64:72], "2B2QEXM7")
+	binary.LittleEndian.PutUint32(ctrl[328:], 0x3) // crypto erase, block erase
+	ctrl[524] = 0x4
+	var info NVMeInfo
+	parseIdentifyController(ctrl, &info)
+	if info.Model != "Samsung SSD 970 EVO Plus 1TB" || info.Serial != "S4EWNX0R123456" || info.Firmware != "2B2QEXM7" {
+		t.Errorf("Identify Controller letto male. Got: %+v", info)
+	}
+	if !info.CryptoErase || fmt.Sprint(info.Sanitize) != "[crypto-erase block-erase]" {
+		t.Errorf("Capacità di cancellazione errate. Got: %+v", info)
+	}
+
+	ns := make([]byte, 4096)
+	binary.LittleEndian.PutUint64(ns[0:], 1953525168)
+	ns[26] = 1         // formato LBA corrente: 1
+	ns[128+2] = 9      // formato 0: 512 byte
+	ns[128+4*1+2] = 12 // formato 1: 4096 byte
+	if flbas := parseIdentifyNamespace(ns, &info); flbas != 1 || info.LBASize != 4096 || info.Size != 1953525168*4096 {
+		t.Errorf("Identify Namespace letto male. Got: %d %+v", flbas, info)
+	}
+
+	for path, want := range map[string][2]bool{
+		"/dev/nvme0n1": {true, false}, "nvme12n3": {true, false}, "/dev/nvme0n1p1": {false, false},
+		"nvme0c0n1": {false, true}, "/dev/nvme0": {false, false}, "/dev/sda": {false, false},
+	} {
+		if IsNVMeNamespace(path) != want[0] || IsNVMePath(path) != want[1] {
+			t.Errorf("%s: namespace %t, percorso %t; want %v", path, IsNVMeNamespace(path), IsNVMePath(path), want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// bootConfigFiles are the files PatchBootConfig edits, and their path in
+// the filesystem that holds them.
+var bootConfigFiles = map[string]string{
+	"cmdline.txt": "/cmdline.txt",
+	"config.txt":  "/config.txt",
+	"fstab":       "/etc/fstab",
+}
+
+// repeatableConfigKeys are the config.txt settings that may appear more
+// than once, each line adding to the others.
+var repeatableConfigKeys = map[string]bool{"dtoverlay": true, "dtparam": true, "include": true, "gpio": true}
+
+// PatchBootConfig sets, or removes, a setting of a boot configuration file
+// of the system on the device, found in the first partition that has it:
+//
+//   - cmdline.txt, the kernel command line of a Raspberry Pi: Key=Value
+//     replaces the parameter Key, or is added, and an empty Value adds
+//     the flag Key, e.g. quiet;
+//   - config.txt, the firmware settings of a Raspberry Pi: the lines
+//     Key=... are replaced, or one is added at the end, in an [all]
+//     section; dtoverlay, dtparam, include and gpio add a line instead,
+//     unless the same one is there;
+//   - fstab: Key is the mount point and Value the rest of the entry,
+//     "<device> <type> <options> [<dump> <pass>]", e.g. "LABEL=DATA ext4
+//     defaults,nofail 0 2".
+//
+// Remove drops the parameter, the lines (those with Value only, if set)
+// or the entry instead.
+type PatchBootConfig struct {
+	// File is "cmdline.txt", "config.txt" or "fstab".
+	File   string
+	Key    string
+	Value  string
+	Remove bool
+}
+
+func (s PatchBootConfig) Name() string {
+	setting := s.Key
+	if s.Value != "" {
+		setting += "=" + s.Value
+	}
+	if s.Remove {
+		return fmt.Sprintf("remove %s from %s", setting, s.File)
+	}
+	return fmt.Sprintf("set %s in %s", setting, s.File)
+}
+
+// Validate checks the patch, which Apply does before writing anything.
+func (s PatchBootConfig) Validate() error {
+	if _, ok := bootConfigFiles[s.File]; !ok {
+		return fmt.Errorf("cannot patch %q, only cmdline.txt, config.txt and fstab", s.File)
+	}
+	if s.Key == "" || strings.ContainsAny(s.Key, " \t\n=#") {
+		return fmt.Errorf("invalid key %q for %s", s.Key, s.File)
+	}
+	if strings.ContainsAny(s.Value, "\n") {
+		return fmt.Errorf("the value for %s in %s spans several lines", s.Key, s.File)
+	}
+	switch s.File {
+	case "cmdline.txt":
+		if strings.ContainsAny(s.Value, " \t") {
+			return fmt.Errorf("the value of the kernel parameter %s contains spaces", s.Key)
+		}
+	case "config.txt":
+		if s.Value == "" && !s.Remove {
+			return fmt.Errorf("%s in config.txt needs a value", s.Key)
+		}
+	case "fstab":
+		if !strings.HasPrefix(s.Key, "/") && s.Key != "none" && s.Key != "swap" {
+			return fmt.Errorf("invalid mount point %q", s.Key)
+		}
+		if n := len(strings.Fields(s.Value)); !s.Remove && (n < 3 || n > 5) {
+			return fmt.Errorf("the fstab entry of %s should be \"<device> <type> <options> [<dump> <pass>]\", not %q", s.Key, s.Value)
+		}
+	}
+	return nil
+}
+
+func (s PatchBootConfig) Apply(_ context.Context, disk *Disk) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	name := bootConfigFiles[s.File]
+	_, fsys, err := disk.FindFile(name)
+	if err != nil {
+		return err
+	}
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var patched string
+	switch s.File {
+	case "cmdline.txt":
+		patched = s.patchCmdline(string(data))
+	case "config.txt":
+		patched = s.patchConfig(string(data))
+	case "fstab":
+		patched = s.patchFstab(string(data))
+	}
+	if patched == string(data) {
+		return nil
+	}
+	return fsys.WriteFile(name, []byte(patched))
+}
+
+// patchCmdline returns the kernel command line with the patch applied.
+func (s PatchBootConfig) patchCmdline(cmdline string) string {
+	var params []string
+	found := false
+	for _, p := range strings.Fields(cmdline) {
+		key, _, _ := strings.Cut(p, "=")
+		if key != s.Key {
+			params = append(params, p)
+			continue
+		}
+		if s.Remove || found {
+			continue
+		}
+		found = true
+		params = append(params, s.param())
+	}
+	if !found && !s.Remove {
+		params = append(params, s.param())
+	}
+	return strings.Join(params, " ") + "\n"
+}
+
+func (s PatchBootConfig) param() string {
+	if s.Value == "" {
+		return s.Key
+	}
+	return s.Key + "=" + s.Value
+}
+
+// patchConfig returns config.txt with the patch applied.
+func (s PatchBootConfig) patchConfig(config string) string {
+	line := s.Key + "=" + s.Value
+	lines := splitLines(config)
+	repeatable := repeatableConfigKeys[s.Key]
+	var out []string
+	found := false
+	for _, l := range lines {
+		key, value, ok := strings.Cut(strings.TrimSpace(l), "=")
+		if !ok || strings.TrimSpace(key) != s.Key {
+			out = append(out, l)
+			continue
+		}
+		switch {
+		case s.Remove && (s.Value == "" || strings.TrimSpace(value) == s.Value):
+			continue
+		case s.Remove, repeatable && strings.TrimSpace(value) != s.Value:
+			out = append(out, l)
+			continue
+		}
+		if !found {
+			out = append(out, line)
+		}
+		found = true
+	}
+	if !found && !s.Remove {
+		// Le righe dopo un filtro come [pi4] valgono solo per quei modelli.
+		if section := lastSection(out); section != "" && section != "[all]" {
+			out = append(out, "[all]")
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// lastSection returns the last conditional filter of config.txt lines,
+// e.g. "[pi4]", empty if there is none.
+func lastSection(lines []string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if l := strings.TrimSpace(lines[i]); strings.HasPrefix(l, "[") {
+			return l
+		}
+	}
+	return ""
+}
+
+// patchFstab returns fstab with the patch applied.
+func (s PatchBootConfig) patchFstab(fstab string) string {
+	fields := strings.Fields(s.Value)
+	var entry string
+	if len(fields) >= 3 {
+		entry = strings.Join(append([]string{fields[0], s.Key}, fields[1:]...), " ")
+	}
+	var out []string
+	found := false
+	for _, l := range splitLines(fstab) {
+		f := strings.Fields(l)
+		if len(f) < 2 || strings.HasPrefix(f[0], "#") || f[1] != s.Key {
+			out = append(out, l)
+			continue
+		}
+		if !s.Remove && !found {
+			out = append(out, entry)
+		}
+		found = true
+	}
+	if !found && !s.Remove {
+		out = append(out, entry)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+// splitLines returns the lines of text, none for an empty text.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
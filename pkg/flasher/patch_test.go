@@ -0,0 +1,81 @@
+package flasher
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestPatchBootConfig verifica le modifiche a cmdline.txt, config.txt e
+// fstab, sui testi e su un'immagine.
+func TestPatchBootConfig(t *testing.T) {
+	cmdline := "console=serial0,115200 console=tty1 root=PARTUUID=1234-02 rootwait quiet\n"
+	config := "# commento\ndtoverlay=vc4-kms-v3d\narm_64bit=1\n[pi4]\narm_boost=1\n"
+	fstab := "proc /proc proc defaults 0 0\nPARTUUID=1234-02 / ext4 defaults,noatime 0 1\n#/dev/sda1 /data ext4 defaults 0 2\n"
+	for _, c := range []struct {
+		patch PatchBootConfig
+		text  string
+		want  string
+	}{
+		{PatchBootConfig{File: "cmdline.txt", Key: "root", Value: "/dev/mmcblk0p2"}, cmdline, "console=serial0,115200 console=tty1 root=/dev/mmcblk0p2 rootwait quiet\n"},
+		{PatchBootConfig{File: "cmdline.txt", Key: "splash"}, cmdline, strings.TrimSuffix(cmdline, "\n") + " splash\n"},
+		{PatchBootConfig{File: "cmdline.txt", Key: "quiet", Remove: true}, cmdline, "console=serial0,115200 console=tty1 root=PARTUUID=1234-02 rootwait\n"},
+		{PatchBootConfig{File: "config.txt", Key: "arm_64bit", Value: "0"}, config, "# commento\ndtoverlay=vc4-kms-v3d\narm_64bit=0\n[pi4]\narm_boost=1\n"},
+		{PatchBootConfig{File: "config.txt", Key: "dtoverlay", Value: "vc4-kms-v3d"}, config, config},
+		{PatchBootConfig{File: "config.txt", Key: "dtoverlay", Value: "dwc2"}, config, config + "[all]\ndtoverlay=dwc2\n"},
+		{PatchBootConfig{File: "config.txt", Key: "dtoverlay", Value: "vc4-kms-v3d", Remove: true}, config, "# commento\narm_64bit=1\n[pi4]\narm_boost=1\n"},
+		{PatchBootConfig{File: "config.txt", Key: "enable_uart", Value: "1"}, "", "enable_uart=1\n"},
+		{PatchBootConfig{File: "fstab", Key: "/data", Value: "LABEL=DATA ext4 defaults,nofail 0 2"}, fstab, fstab + "LABEL=DATA /data ext4 defaults,nofail 0 2\n"},
+		{PatchBootConfig{File: "fstab", Key: "/", Value: "LABEL=rootfs ext4 defaults 0 1"}, fstab, "proc /proc proc defaults 0 0\nLABEL=rootfs / ext4 defaults 0 1\n#/dev/sda1 /data ext4 defaults 0 2\n"},
+		{PatchBootConfig{File: "fstab", Key: "/proc", Remove: true}, fstab, strings.TrimPrefix(fstab, "proc /proc proc defaults 0 0\n")},
+	} {
+		var got string
+		switch c.patch.File {
+		case "cmdline.txt":
+			got = c.patch.patchCmdline(c.text)
+		case "config.txt":
+			got = c.patch.patchConfig(c.text)
+		default:
+			got = c.patch.patchFstab(c.text)
+		}
+		if got != c.want {
+			t.Errorf("%s: testo errato.\nGot:  %q\nWant: %q", c.patch.Name(), got, c.want)
+		}
+	}
+
+	for _, bad := range []PatchBootConfig{
+		{File: "boot.ini", Key: "a", Value: "b"},
+		{File: "cmdline.txt", Key: "root", Value: "a b"},
+		{File: "config.txt", Key: "arm_64bit"},
+		{File: "fstab", Key: "data", Value: "LABEL=DATA ext4 defaults"},
+		{File: "fstab", Key: "/data", Value: "LABEL=DATA"},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%s dovrebbe essere rifiutata", bad.Name())
+		}
+	}
+
+	d, err := NewDisk("image", &memDest{data: newTestImage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Apply(context.Background(),
+		WriteFiles{Partition: 1, Files: map[string][]byte{"/config.txt": []byte(config)}},
+		PatchBootConfig{File: "config.txt", Key: "dtparam", Value: "audio=on"},
+		PatchBootConfig{File: "fstab", Key: "/data", Value: "LABEL=DATA ext4 defaults,nofail 0 2"},
+	)
+	if err != nil {
+		t.Fatalf("PatchBootConfig ha restituito un errore: %v", err)
+	}
+	_, boot, _ := d.FindFile("/config.txt")
+	if got, _ := boot.ReadFile("/config.txt"); !strings.HasSuffix(string(got), "[all]\ndtparam=audio=on\n") {
+		t.Errorf("config.txt errato. Got: %q", got)
+	}
+	_, root, _ := d.FindFile("/etc/fstab")
+	if got, _ := root.ReadFile("/etc/fstab"); !strings.HasSuffix(string(got), "LABEL=DATA /data ext4 defaults,nofail 0 2\n") {
+		t.Errorf("fstab errato. Got: %q", got)
+	}
+	if err := d.Apply(context.Background(), PatchBootConfig{File: "cmdline.txt", Key: "quiet"}); err == nil {
+		t.Error("Senza cmdline.txt dovrebbe esserci un errore")
+	}
+}
@@ -0,0 +1,105 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Pauser lets the caller suspend a copy between two blocks, e.g. to
+// briefly free USB bandwidth, and resume it later. The zero value is not
+// usable: create it with NewPauser.
+type Pauser struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+
+	// OnPause and OnResume, if set, are called when the copy actually
+	// stops (after the data written so far has been flushed) and when it
+	// starts again.
+	OnPause, OnResume func()
+}
+
+// NewPauser returns a Pauser for a running copy.
+func NewPauser() *Pauser {
+	p := &Pauser{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Toggle pauses a running copy or resumes a paused one and returns the
+// new state.
+func (p *Pauser) Toggle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(!p.paused)
+	return p.paused
+}
+
+// Pause suspends the copy before its next block; it does nothing if the
+// copy is already paused.
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(true)
+}
+
+// Resume restarts a paused copy; it does nothing if the copy is running.
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(false)
+}
+
+// Paused reports whether the copy is paused, or about to be.
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// set changes the state; p.mu must be held.
+func (p *Pauser) set(paused bool) {
+	p.paused = paused
+	p.cond.Broadcast()
+}
+
+// wait returns immediately unless the copy is paused. When it is, the
+// data written so far is flushed to the device with flush (which may be
+// nil) and wait blocks until the copy is resumed or ctx is done.
+func (p *Pauser) wait(ctx context.Context, flush func() error) error {
+	p.mu.Lock()
+	paused := p.paused
+	p.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	if flush != nil {
+		if err := flush(); err != nil {
+			return fmt.Errorf("%w: failed to flush data before pausing: %w", ErrWrite, err)
+		}
+	}
+	if p.OnPause != nil {
+		p.OnPause()
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.cond.Broadcast()
+	})
+	defer stop()
+	p.mu.Lock()
+	for p.paused && ctx.Err() == nil {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if p.OnResume != nil {
+		p.OnResume()
+	}
+	return nil
+}
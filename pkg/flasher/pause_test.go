@@ -0,0 +1,150 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPauser verifica che wait si blocchi finché la copia è in pausa
+// e che i dati vengano scaricati prima della pausa.
+func TestPauser(t *testing.T) {
+	p := NewPauser()
+	if err := p.wait(context.Background(), nil); err != nil {
+		t.Fatalf("wait senza pausa ha restituito un errore: %v", err)
+	}
+
+	if !p.Toggle() {
+		t.Fatal("toggle avrebbe dovuto mettere in pausa")
+	}
+	flushed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- p.wait(context.Background(), func() error { close(flushed); return nil })
+	}()
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("I dati non sono stati scaricati prima della pausa")
+	}
+	select {
+	case <-done:
+		t.Fatal("wait è tornato mentre la copia era in pausa")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p.Toggle()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("wait ha restituito un errore: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait non è tornato dopo la ripresa")
+	}
+}
+
+// TestCopyPaused verifica che una copia messa in pausa riprenda e
+// scriva l'intera immagine.
+func TestCopyPaused(t *testing.T) {
+	p := NewPauser()
+	p.Toggle()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.Toggle()
+	}()
+
+	var dest strings.Builder
+	f := &Flasher{BlockSize: 4, Pauser: p}
+	res, err := f.Copy(context.Background(), strings.NewReader("abcdefgh"), &dest, 0)
+	if err != nil {
+		t.Fatalf("Copy ha restituito un errore: %v", err)
+	}
+	if dest.String() != "abcdefgh" || res.Bytes != 8 {
+		t.Errorf("Dati errati. Got: %q (%d byte)", dest.String(), res.Bytes)
+	}
+}
+
+// TestPauserCancelled verifica che una copia in pausa si interrompa
+// quando il contesto viene annullato.
+func TestPauserCancelled(t *testing.T) {
+	p := NewPauser()
+	p.Toggle()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.wait(ctx, nil) }()
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("wait dovrebbe restituire context.Canceled. Got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait non è tornato dopo l'annullamento")
+	}
+}
+
+// syncRecorder registra le scritture e i sync ricevuti.
+type syncRecorder struct {
+	mu     sync.Mutex
+	data   strings.Builder
+	synced int
+}
+
+func (s *syncRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Write(p)
+}
+
+func (s *syncRecorder) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.synced++
+	return nil
+}
+
+// TestFlasherPauseResume verifica Pause e Resume durante una copia: i
+// dati vengono scaricati prima della pausa e la copia riprende.
+func TestFlasherPauseResume(t *testing.T) {
+	f := &Flasher{BlockSize: 4}
+	f.Pause()
+	if !f.Paused() {
+		t.Fatal("Paused dovrebbe essere vero dopo Pause")
+	}
+	paused := make(chan struct{})
+	f.Pauser.OnPause = func() { close(paused) }
+
+	dest := &syncRecorder{}
+	done := make(chan error)
+	go func() {
+		_, err := f.Copy(context.Background(), strings.NewReader("abcdefgh"), dest, 0)
+		done <- err
+	}()
+	select {
+	case <-paused:
+	case <-time.After(time.Second):
+		t.Fatal("La copia non si è messa in pausa")
+	}
+	dest.mu.Lock()
+	synced, written := dest.synced, dest.data.Len()
+	dest.mu.Unlock()
+	if synced != 1 || written != 0 {
+		t.Errorf("In pausa: sync %d, scritti %d byte. Want: 1 sync, 0 byte", synced, written)
+	}
+
+	f.Resume()
+	select {
+	case err := <-done:
+		if err != nil || dest.data.String() != "abcdefgh" {
+			t.Errorf("Copia errata dopo la ripresa. Got: %q, err %v", dest.data.String(), err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("La copia non è ripresa")
+	}
+}
@@ -0,0 +1,45 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Persistence is the partition where a live system keeps its changes
+// across reboots.
+type Persistence struct {
+	// Label is the filesystem label the live system looks for.
+	Label string
+	// Files are written to the root of the filesystem, e.g. the
+	// persistence.conf of Debian Live.
+	Files map[string][]byte
+}
+
+// LivePersistence returns the persistence partition that the live system
+// on the disk, an isohybrid image, expects: casper-rw for casper (Ubuntu
+// and its flavours), persistence with a persistence.conf that keeps the
+// whole system for live-boot (Debian, Kali). Other images fail with an
+// error that wraps errors.ErrUnsupported.
+func LivePersistence(d *Disk) (Persistence, error) {
+	fsys, err := d.Filesystem(0)
+	if err != nil || fsys.Type() != "iso9660" {
+		return Persistence{}, fmt.Errorf("%w: %s has no ISO 9660 live system", errors.ErrUnsupported, d.Device)
+	}
+	switch {
+	case hasDir(fsys, "/casper"):
+		return Persistence{Label: "casper-rw"}, nil
+	case hasDir(fsys, "/live"):
+		return Persistence{Label: "persistence", Files: map[string][]byte{"/persistence.conf": []byte("/ union\n")}}, nil
+	}
+	return Persistence{}, fmt.Errorf("%w: the live system of %s is neither casper nor live-boot", errors.ErrUnsupported, d.Device)
+}
+
+// hasDir reports whether fsys has the directory name.
+func hasDir(fsys Filesystem, name string) bool {
+	f, ok := fsys.(diskFilesystem)
+	if !ok {
+		return false
+	}
+	_, err := f.fs.ReadDir(name)
+	return err == nil
+}
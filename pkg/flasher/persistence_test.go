@@ -0,0 +1,125 @@
+package flasher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// newLiveImage crea un'immagine ibrida come quelle di Debian Live: una ISO
+// 9660 con la directory dir, coperta dalla prima partizione MBR di tipo 0.
+func newLiveImage(t *testing.T, dir string, size int64) *memDest {
+	t.Helper()
+	dest := &memDest{data: make([]byte, size)}
+	fsys, err := iso9660.Create(&diskBackend{dest: dest, size: size}, size, 0, 2048, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Finalize(iso9660.FinalizeOptions{RockRidge: true}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDisk("image", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Empty, Bootable: true, Start: 0, Size: 3 * mib / 512},
+		{Type: mbr.EFISystem, Start: 2 * mib / 512, Size: 1 * mib / 512},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+// TestLivePersistence verifica la partizione di persistenza aggiunta dopo
+// quelle di un'immagine ibrida, con l'etichetta che il sistema live cerca.
+func TestLivePersistence(t *testing.T) {
+	image := newLiveImage(t, "/live", 4*mib)
+	dest := &memDest{data: make([]byte, 32*mib)}
+	copy(dest.data, image.data)
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := LivePersistence(d)
+	if err != nil || p.Label != "persistence" || string(p.Files["/persistence.conf"]) != "/ union\n" {
+		t.Fatalf("Persistenza di live-boot errata. Got: %+v, %v", p, err)
+	}
+	part, err := d.AddPartition(0, p.Label)
+	if err != nil {
+		t.Fatalf("AddPartition ha restituito un errore: %v", err)
+	}
+	// La voce di tipo 0 che copre la ISO non va riusata.
+	if part.Number != 3 || part.Start != 3*mib || part.Start+part.Size != 32*mib || part.Type != "83" {
+		t.Errorf("Partizione errata. Got: %+v", part)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Partition(0); err != nil || got.Number != 3 || got.Start != part.Start || got.Size != part.Size {
+		t.Errorf("La partizione va scritta nella tabella. Got: %+v, %v", got, err)
+	}
+	if _, err := d.AddPartition(0, ""); err == nil {
+		t.Error("Senza spazio libero AddPartition dovrebbe restituire un errore")
+	}
+
+	image = &memDest{data: make([]byte, 8*mib)}
+	d, err = NewDisk("image", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.EFISystemPartition, Start: 2048, End: 4095, Name: "boot"},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	dest = &memDest{data: make([]byte, 32*mib)}
+	copy(dest.data, image.data)
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AddPartition(4*mib, "dati"); err != nil {
+		t.Fatalf("AddPartition GPT ha restituito un errore: %v", err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.Partition(0); err != nil || got.Number != 2 || got.Start != 2*mib || got.Size != 4*mib || got.Name != "dati" {
+		t.Errorf("Partizione GPT errata. Got: %+v, %v", got, err)
+	}
+	if _, err := d.AddDataPartition(0, "DATA", "fat32"); err != nil {
+		t.Fatalf("AddDataPartition ha restituito un errore: %v", err)
+	}
+	if got, err := d.Partition(0); err != nil || got.Number != 3 || got.Start != 6*mib || got.Type != string(gpt.MicrosoftBasicData) {
+		t.Errorf("Partizione dati errata. Got: %+v, %v", got, err)
+	}
+	if _, err := d.AddDataPartition(0, "DATA", "ntfs"); err == nil {
+		t.Error("Un filesystem sconosciuto dovrebbe essere rifiutato")
+	}
+
+	d, err = NewDisk("dev", newLiveImage(t, "/casper", 4*mib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := LivePersistence(d); err != nil || p.Label != "casper-rw" || p.Files != nil {
+		t.Errorf("Persistenza di casper errata. Got: %+v, %v", p, err)
+	}
+	d, err = NewDisk("dev", &memDest{data: newTestImage(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LivePersistence(d); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Un'immagine non live dovrebbe restituire ErrUnsupported. Got: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package flasher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Plugin is an external program that adds source handlers (e.g. for a
+// proprietary image format) or a post-flash step, without patching
+// sflashy. It speaks line-delimited JSON on its standard streams:
+//
+//   - "describe": the plugin prints one object telling what it provides,
+//     {"name": "vendor", "sources": ["vendor", ".vimg"], "post_flash": true}.
+//   - "open <location>": the plugin prints a header line, {"size": 1234}
+//     (0 if unknown) or {"error": "..."}, followed by the raw image data.
+//     A non-zero exit status once the data is sent fails the flash.
+//   - "post-flash": sflashy writes the flash on stdin as one object,
+//     {"stage", "device", "bytes", "digest", "verification", "metadata"};
+//     the plugin may print {"message": "..."} lines and ends with
+//     {"ok": true} or {"error": "..."}.
+//
+// The standard error of the plugin goes to Stderr.
+type Plugin struct {
+	// Path is the plugin executable.
+	Path string
+	// Name, Sources and PostFlash are what the plugin described.
+	Name      string   `json:"name"`
+	Sources   []string `json:"sources"`
+	PostFlash bool     `json:"post_flash"`
+	// Stderr receives the standard error of the plugin; nil discards it.
+	Stderr io.Writer `json:"-"`
+}
+
+// pluginMessage is a line printed by a plugin.
+type pluginMessage struct {
+	Size    int64  `json:"size"`
+	Message string `json:"message"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+}
+
+// LoadPlugin runs the plugin at path with "describe" and returns what it
+// provides.
+func LoadPlugin(path string) (*Plugin, error) {
+	out, err := exec.Command(path, "describe").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not describe plugin %s: %w", path, err)
+	}
+	p := &Plugin{}
+	if err := json.Unmarshal(bytes.TrimSpace(out), p); err != nil {
+		return nil, fmt.Errorf("plugin %s: invalid description: %w", path, err)
+	}
+	p.Path = path
+	if p.Name == "" {
+		return nil, fmt.Errorf("plugin %s: the description has no name", path)
+	}
+	return p, nil
+}
+
+// Register makes OpenImage open the schemes and extensions of p.Sources
+// through the plugin.
+func (p *Plugin) Register() {
+	for _, key := range p.Sources {
+		RegisterSource(key, p.Open)
+	}
+}
+
+// Open runs the plugin with "open location" and returns the image it
+// streams.
+func (p *Plugin) Open(location string) (Image, error) {
+	cmd := exec.Command(p.Path, "open", location)
+	cmd.Stderr = p.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not run plugin %s: %w", p.Name, err)
+	}
+	img := &pluginImage{name: p.Name, cmd: cmd, r: bufio.NewReader(stdout)}
+	msg, err := readPluginMessage(img.r)
+	if err == nil && msg.Error != "" {
+		err = errors.New(msg.Error)
+	}
+	if err != nil {
+		img.Close()
+		return nil, fmt.Errorf("plugin %s could not open %s: %w", p.Name, location, err)
+	}
+	img.size = msg.Size
+	return img, nil
+}
+
+// Hook returns the post-flash step of the plugin as a Hook; its messages
+// are printed on out.
+func (p *Plugin) Hook(out io.Writer) Hook {
+	return func(ctx context.Context, info HookInfo) error {
+		req, err := json.Marshal(map[string]any{
+			"stage":        info.Stage,
+			"device":       info.Device,
+			"bytes":        info.Bytes,
+			"digest":       hex.EncodeToString(info.Digest),
+			"verification": info.Verification,
+			"metadata":     info.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, p.Path, "post-flash")
+		cmd.Stdin = bytes.NewReader(append(req, '\n'))
+		cmd.Stderr = p.Stderr
+		// I messaggi vengono letti anche se il plugin esce con errore: il
+		// motivo è di solito nell'ultimo.
+		stdout, runErr := cmd.Output()
+		r := bufio.NewReader(bytes.NewReader(stdout))
+		for {
+			msg, err := readPluginMessage(r)
+			switch {
+			case runErr != nil && (err != nil || msg.OK):
+				return fmt.Errorf("plugin %s: %w", p.Name, runErr)
+			case err != nil:
+				return fmt.Errorf("plugin %s: %w", p.Name, err)
+			case msg.Error != "":
+				return fmt.Errorf("plugin %s: %s", p.Name, msg.Error)
+			case msg.OK:
+				return nil
+			case msg.Message != "" && out != nil:
+				fmt.Fprintf(out, "%s: %s\n", p.Name, msg.Message)
+			}
+		}
+	}
+}
+
+// readPluginMessage reads a JSON line printed by a plugin.
+func readPluginMessage(r *bufio.Reader) (pluginMessage, error) {
+	var msg pluginMessage
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		if err == io.EOF {
+			return msg, errors.New("unexpected end of the plugin output")
+		}
+		return msg, err
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &msg); err != nil {
+		return msg, fmt.Errorf("invalid plugin message %q: %w", strings.TrimSpace(line), err)
+	}
+	return msg, nil
+}
+
+// pluginImage is the image streamed by a plugin after its header.
+type pluginImage struct {
+	name string
+	cmd  *exec.Cmd
+	r    *bufio.Reader
+	size int64
+	done bool  // the plugin has exited
+	err  error // returned once done
+}
+
+func (img *pluginImage) Size() int64 { return img.size }
+
+// Read reports a plugin that fails after sending its data as an error
+// rather than as the end of the image.
+func (img *pluginImage) Read(p []byte) (int, error) {
+	if img.done {
+		return 0, img.err
+	}
+	n, err := img.r.Read(p)
+	if err == io.EOF {
+		img.done, img.err = true, io.EOF
+		if werr := img.cmd.Wait(); werr != nil {
+			img.err = fmt.Errorf("plugin %s: %w", img.name, werr)
+		}
+		err = img.err
+	}
+	return n, err
+}
+
+// Close stops the plugin if the image was not read to the end.
+func (img *pluginImage) Close() error {
+	if img.done {
+		return nil
+	}
+	img.done = true
+	img.cmd.Process.Kill()
+	img.cmd.Wait()
+	return nil
+}
@@ -0,0 +1,101 @@
+package flasher
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testPlugin è un plugin di prova scritto in sh.
+const testPlugin = `#!/bin/sh
+case "$1" in
+describe) echo '{"name": "prova", "sources": ["prova"], "post_flash": true}' ;;
+open)
+	case "$2" in
+	prova://broken) echo '{"error": "immagine inesistente"}' ;;
+	prova://truncated) echo '{"size": 8}'; printf dati; exit 1 ;;
+	*) echo '{"size": 4}'; printf dati ;;
+	esac ;;
+post-flash)
+	read req
+	echo '{"message": "personalizzazione in corso"}'
+	case "$req" in
+	*'"device":"/dev/bad"'*) echo '{"error": "dispositivo rifiutato"}'; exit 1 ;;
+	esac
+	echo '{"ok": true}' ;;
+esac
+`
+
+// writeTestPlugin scrive testPlugin in una directory temporanea.
+func writeTestPlugin(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("richiede sh")
+	}
+	path := filepath.Join(t.TempDir(), "sflashy-prova")
+	if err := os.WriteFile(path, []byte(testPlugin), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestPluginSource verifica la lettura di un'immagine fornita da un plugin.
+func TestPluginSource(t *testing.T) {
+	p, err := LoadPlugin(writeTestPlugin(t))
+	if err != nil {
+		t.Fatalf("LoadPlugin ha restituito un errore: %v", err)
+	}
+	if p.Name != "prova" || !p.PostFlash || len(p.Sources) != 1 {
+		t.Errorf("Descrizione errata: %+v", p)
+	}
+	p.Register()
+
+	src, err := OpenImage("prova://immagine", OpenOptions{})
+	if err != nil {
+		t.Fatalf("OpenImage ha restituito un errore: %v", err)
+	}
+	data, err := io.ReadAll(src)
+	src.Close()
+	if err != nil || string(data) != "dati" || src.Size != 4 {
+		t.Errorf("Immagine errata: %q (%d byte), %v", data, src.Size, err)
+	}
+
+	if _, err := OpenImage("prova://broken", OpenOptions{}); err == nil || !strings.Contains(err.Error(), "immagine inesistente") {
+		t.Errorf("L'errore del plugin dovrebbe essere restituito. Got: %v", err)
+	}
+	src, err = OpenImage("prova://truncated", OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := io.ReadAll(src); err == nil {
+		t.Error("Un plugin che esce con errore dovrebbe far fallire la lettura")
+	}
+}
+
+// TestPluginHook verifica il passo post-flash di un plugin.
+func TestPluginHook(t *testing.T) {
+	p, err := LoadPlugin(writeTestPlugin(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	hook := p.Hook(&out)
+	if err := hook(context.Background(), HookInfo{Stage: HookPostWrite, Device: "/dev/sdb"}); err != nil {
+		t.Errorf("Il passo post-flash ha restituito un errore: %v", err)
+	}
+	if !strings.Contains(out.String(), "prova: personalizzazione in corso") {
+		t.Errorf("Messaggi del plugin mancanti. Got: %q", out.String())
+	}
+	err = hook(context.Background(), HookInfo{Stage: HookPostWrite, Device: "/dev/bad"})
+	if err == nil || !strings.Contains(err.Error(), "dispositivo rifiutato") {
+		t.Errorf("L'errore del plugin dovrebbe essere restituito. Got: %v", err)
+	}
+	if _, err := LoadPlugin(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Un plugin inesistente non dovrebbe essere caricato")
+	}
+}
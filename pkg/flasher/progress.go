@@ -0,0 +1,312 @@
+package flasher
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressWriter conta i byte scritti e mostra periodicamente il progresso.
+type progressWriter struct {
+	mu        sync.Mutex
+	total     int64
+	out       io.Writer // Scriviamo il progresso su un output generico
+	lastShown int64
+	lastGB    int64 // ultimo GB registrato nel log delle operazioni
+	start     time.Time
+	label     string // "Writing" se vuoto
+
+	// Quando l'output non è un terminale (CI, tee) il progresso viene
+	// stampato su righe separate ogni 10% o ogni plainInterval.
+	plain     bool
+	size      int64 // dimensione totale attesa, 0 se sconosciuta
+	lastPct   int64
+	lastPlain time.Time
+
+	phase   *progressPhase // nil se la copia è l'unica fase
+	redraws int            // per animare lo spinner quando la dimensione è ignota
+
+	step    int64               // byte tra due aggiornamenti sul terminale, 0 per il default
+	sizeFmt func(uint64) string // formato delle dimensioni
+	colors  Colors
+	log     *slog.Logger
+
+	onProgress func(Progress) // Flasher.OnProgress
+	lastEvent  int64
+
+	// render, se impostata, disegna la riga sul terminale al posto di out,
+	// ad esempio sulle righe dei dispositivi di FlashMany.
+	render func(line string)
+}
+
+// Progress is a snapshot of a running flash, passed to Flasher.OnProgress.
+type Progress struct {
+	// Phase is "Writing" or "Verifying".
+	Phase string
+	// PhaseIndex and PhaseCount number the phases of the job: 1 of 1 for
+	// a plain write, 1 and 2 of 2 when the device is verified.
+	PhaseIndex, PhaseCount int
+	// Bytes were processed by this phase, out of Total (0 if unknown).
+	Bytes, Total int64
+	// Rate is the average throughput of this phase, in bytes per second.
+	Rate float64
+	// Percent and ETA cover the whole job; they are zero when the size
+	// is unknown.
+	Percent int64
+	ETA     time.Duration
+}
+
+// spinner is drawn in place of the percentage when the size is unknown.
+const spinner = `|/-\`
+
+// progressPhase places a progressWriter within a job made of several
+// passes over the data, like writing and then verifying, so that the
+// progress and the ETA cover the whole job.
+type progressPhase struct {
+	Index, Count int       // 1-based number of this phase and number of phases
+	Done         int64     // bytes processed by the previous phases
+	Total        int64     // bytes processed by all the phases
+	Start        time.Time // start of the first phase
+}
+
+// overall returns the fraction of the whole job completed once total
+// bytes of this phase are processed, and the estimated time left.
+func (ph *progressPhase) overall(total int64, now time.Time) (pct int64, eta time.Duration) {
+	done := ph.Done + total
+	if ph.Total <= 0 || done <= 0 {
+		return 0, 0
+	}
+	pct = done * 100 / ph.Total
+	elapsed := now.Sub(ph.Start)
+	eta = time.Duration(float64(elapsed) * float64(ph.Total-done) / float64(done))
+	return pct, eta.Round(time.Second)
+}
+
+// plainInterval is the maximum time between two plain progress lines.
+const plainInterval = 30 * time.Second
+
+// DefaultProgressStep is how many bytes are copied between two redraws of
+// the progress line on a terminal, unless Flasher.ProgressStep is set.
+const DefaultProgressStep = 2 * 1024 * 1024
+
+// newProgressWriter returns a progressWriter for a copy of size bytes
+// (0 if unknown) that picks the plain line-based output when out is not a
+// terminal.
+func newProgressWriter(out io.Writer, label string, size int64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{out: out, label: label, size: size, start: now, lastPlain: now, plain: !IsTerminal(out)}
+}
+
+// FormatGiB formats n bytes in GiB, the default format of the sizes in
+// the progress.
+func FormatGiB(n uint64) string {
+	return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+}
+
+// IsTerminal reports whether v, an input or an output, is a terminal
+// (character device).
+func IsTerminal(v any) bool {
+	f, ok := v.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// sourceSize returns the size of r when it can be known without reading it.
+func sourceSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case *os.File:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	case interface{ Size() int64 }:
+		return v.Size()
+	}
+	return 0
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.add(int64(len(p)))
+	return len(p), nil
+}
+
+// add counts n more bytes processed, without a buffer holding them, e.g.
+// for a range the device discards by itself.
+func (pw *progressWriter) add(n int64) {
+	pw.mu.Lock()
+	pw.total += n
+	step := pw.step
+	if step <= 0 {
+		step = DefaultProgressStep
+	}
+	pw.draw(step)
+	// La callback viene chiamata senza lock: può chiedere Status.
+	var event *Progress
+	if pw.onProgress != nil && (pw.total-pw.lastEvent >= step || pw.total == pw.size) {
+		e := pw.event(time.Now())
+		event, pw.lastEvent = &e, pw.total
+	}
+	pw.mu.Unlock()
+
+	if event != nil {
+		pw.onProgress(*event)
+	}
+}
+
+// finish reports the last Progress of the phase, if the last Write did
+// not already report it.
+func (pw *progressWriter) finish() {
+	pw.mu.Lock()
+	if pw.render != nil && !pw.plain {
+		// L'ultima riga va mostrata anche se è caduta tra due passi.
+		pw.render(pw.line(time.Now()))
+	}
+	if pw.onProgress == nil || pw.total == pw.lastEvent {
+		pw.mu.Unlock()
+		return
+	}
+	e := pw.event(time.Now())
+	pw.lastEvent = pw.total
+	pw.mu.Unlock()
+	pw.onProgress(e)
+}
+
+// draw updates the progress shown on out; pw.mu must be held.
+func (pw *progressWriter) draw(step int64) {
+	if pw.plain {
+		pw.writePlain()
+	} else if pw.total-pw.lastShown > step && pw.render != nil {
+		pw.render(pw.line(time.Now()))
+		pw.lastShown = pw.total
+		pw.redraws++
+	} else if pw.total-pw.lastShown > step {
+		// Scrive il progresso sull'output specificato (es. os.Stdout);
+		// \x1b[K cancella il resto della riga quando questa si accorcia.
+		fmt.Fprintf(pw.out, "\r%s%s\x1b[K%s", pw.colors.Progress, pw.line(time.Now()), pw.colors.Reset)
+		pw.lastShown = pw.total
+		pw.redraws++
+	}
+	if gb := pw.total >> 30; gb > pw.lastGB {
+		pw.logger().Debug("progress", "phase", pw.labelOrDefault(), "gb_copied", gb)
+		pw.lastGB = gb
+	}
+}
+
+// event returns the Progress reported to Flasher.OnProgress; pw.mu must
+// be held.
+func (pw *progressWriter) event(now time.Time) Progress {
+	e := Progress{Phase: pw.labelOrDefault(), PhaseIndex: 1, PhaseCount: 1, Bytes: pw.total, Total: pw.size}
+	elapsed := now.Sub(pw.start)
+	if elapsed > 0 {
+		e.Rate = float64(pw.total) / elapsed.Seconds()
+	}
+	switch {
+	case pw.phase != nil:
+		e.PhaseIndex, e.PhaseCount = pw.phase.Index, pw.phase.Count
+		e.Percent, e.ETA = pw.phase.overall(pw.total, now)
+	case pw.size > 0:
+		single := progressPhase{Index: 1, Count: 1, Total: pw.size, Start: pw.start}
+		e.Percent, e.ETA = single.overall(pw.total, now)
+	}
+	return e
+}
+
+// line is the progress line redrawn on a terminal. Without a known size
+// it shows a spinner with the bytes copied and the throughput.
+func (pw *progressWriter) line(now time.Time) string {
+	rate := formatRate(pw.total, now.Sub(pw.start))
+	if pw.size <= 0 {
+		return fmt.Sprintf("%c %s... %s copied, %s", spinner[pw.redraws%len(spinner)], pw.title(), pw.formatSize(pw.total), rate)
+	}
+	pct := min(pw.total*100/pw.size, 100)
+	return fmt.Sprintf("%s... %d%% (%s of %s), %s%s", pw.title(), pct, pw.formatSize(pw.total), pw.formatSize(pw.size), rate, pw.overall(now))
+}
+
+// formatRate returns the average throughput of n bytes in elapsed.
+func formatRate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- MB/s"
+	}
+	return fmt.Sprintf("%.1f MB/s", float64(n)/elapsed.Seconds()/1e6)
+}
+
+// writePlain prints a progress line whenever a 10% step is crossed or
+// plainInterval has passed since the previous line.
+func (pw *progressWriter) writePlain() {
+	now := time.Now()
+	var pct int64
+	if pw.size > 0 {
+		pct = pw.total * 100 / pw.size
+	}
+	if pct/10 <= pw.lastPct/10 && now.Sub(pw.lastPlain) < plainInterval {
+		return
+	}
+
+	if pw.size > 0 {
+		fmt.Fprintf(pw.out, "%s: %d%% (%s of %s)%s\n", pw.title(), pct, pw.formatSize(pw.total), pw.formatSize(pw.size), pw.overall(now))
+	} else {
+		fmt.Fprintf(pw.out, "%s: %s copied, %s\n", pw.title(), pw.formatSize(pw.total), formatRate(pw.total, now.Sub(pw.start)))
+	}
+	pw.lastPct, pw.lastPlain = pct, now
+}
+
+// formatSize formats n bytes with the format of the Flasher.
+func (pw *progressWriter) formatSize(n int64) string {
+	if pw.sizeFmt == nil {
+		return FormatGiB(uint64(n))
+	}
+	return pw.sizeFmt(uint64(n))
+}
+
+func (pw *progressWriter) logger() *slog.Logger {
+	if pw.log == nil {
+		return discardLogger
+	}
+	return pw.log
+}
+
+func (pw *progressWriter) labelOrDefault() string {
+	if pw.label == "" {
+		return "Writing"
+	}
+	return pw.label
+}
+
+// title is the label prefixed with the phase number, e.g. "[2/2] Verifying".
+func (pw *progressWriter) title() string {
+	if pw.phase == nil {
+		return pw.labelOrDefault()
+	}
+	return fmt.Sprintf("[%d/%d] %s", pw.phase.Index, pw.phase.Count, pw.labelOrDefault())
+}
+
+// overall describes the progress of the whole job, or is empty when the
+// copy is the only phase.
+func (pw *progressWriter) overall(now time.Time) string {
+	if pw.phase == nil {
+		return ""
+	}
+	pct, eta := pw.phase.overall(pw.total, now)
+	return fmt.Sprintf(", %d%% overall, ETA %s", pct, eta)
+}
+
+// status returns a dd-like one-line summary of the bytes written so far,
+// the elapsed time and the average throughput.
+func (pw *progressWriter) status() string {
+	pw.mu.Lock()
+	total := pw.total
+	pw.mu.Unlock()
+
+	elapsed := time.Since(pw.start)
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(total) / elapsed.Seconds()
+	}
+	return fmt.Sprintf("%d bytes (%.1f MB, %.1f MiB) copied, %.1f s, %.1f MB/s",
+		total, float64(total)/1e6, float64(total)/(1<<20), elapsed.Seconds(), rate/1e6)
+}
@@ -0,0 +1,136 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestProgressWriterStatus verifica la riga di stato in stile dd.
+func TestProgressWriterStatus(t *testing.T) {
+	pw := &progressWriter{out: &strings.Builder{}, start: time.Now().Add(-2 * time.Second)}
+	_, _ = pw.Write(make([]byte, 4*1000*1000))
+
+	status := pw.status()
+	if !strings.HasPrefix(status, "4000000 bytes (4.0 MB, 3.8 MiB) copied, 2.") {
+		t.Errorf("Riga di stato inattesa. Got: %q", status)
+	}
+	if !strings.HasSuffix(status, "MB/s") {
+		t.Errorf("La riga di stato non contiene il throughput. Got: %q", status)
+	}
+}
+
+// TestProgressWriterPlain verifica l'output a righe quando l'uscita non è un terminale.
+func TestProgressWriterPlain(t *testing.T) {
+	var out strings.Builder
+	pw := newProgressWriter(&out, "Writing", 1000)
+	if !pw.plain {
+		t.Fatal("Un buffer in memoria non è un terminale: l'output dovrebbe essere a righe")
+	}
+
+	for i := 0; i < 100; i++ {
+		_, _ = pw.Write(make([]byte, 10))
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 10 {
+		t.Errorf("Attese 10 righe di progresso (una ogni 10%%). Got: %d\n%s", len(lines), out.String())
+	}
+	if strings.Contains(out.String(), "\r") {
+		t.Error("L'output a righe non deve contenere ritorni a capo")
+	}
+	if lines[len(lines)-1] != "Writing: 100% (0.00 GiB of 0.00 GiB)" {
+		t.Errorf("Ultima riga inattesa: %q", lines[len(lines)-1])
+	}
+}
+
+// TestProgressPhase verifica il progresso complessivo e l'ETA di un lavoro
+// in due fasi (scrittura e verifica).
+func TestProgressPhase(t *testing.T) {
+	start := time.Now().Add(-30 * time.Second)
+	ph := &progressPhase{Index: 2, Count: 2, Done: 1000, Total: 2000, Start: start}
+	pct, eta := ph.overall(500, start.Add(30*time.Second))
+	if pct != 75 || eta != 10*time.Second {
+		t.Errorf("Progresso complessivo errato. Got: %d%% ETA %s, Want: 75%% ETA 10s", pct, eta)
+	}
+
+	var out strings.Builder
+	pw := newProgressWriter(&out, "Verifying", 1000)
+	pw.phase = ph
+	_, _ = pw.Write(make([]byte, 1000))
+	if line := strings.TrimSpace(out.String()); !strings.HasPrefix(line, "[2/2] Verifying: 100% (0.00 GiB of 0.00 GiB), 100% overall, ETA 0s") {
+		t.Errorf("Riga di progresso inattesa: %q", line)
+	}
+}
+
+// TestProgressWriterLine verifica la riga mostrata sul terminale, con e
+// senza dimensione nota.
+func TestProgressWriterLine(t *testing.T) {
+	start := time.Now()
+	pw := &progressWriter{out: &strings.Builder{}, start: start, size: 4000000}
+	pw.total = 1000000
+	if got := pw.line(start.Add(time.Second)); got != "Writing... 25% (0.00 GiB of 0.00 GiB), 1.0 MB/s" {
+		t.Errorf("Riga con dimensione nota inattesa: %q", got)
+	}
+
+	pw.size = 0
+	first := pw.line(start.Add(time.Second))
+	if first != "| Writing... 0.00 GiB copied, 1.0 MB/s" {
+		t.Errorf("Riga con dimensione ignota inattesa: %q", first)
+	}
+	pw.redraws++
+	if pw.line(start.Add(time.Second))[0] == first[0] {
+		t.Error("Lo spinner dovrebbe avanzare a ogni aggiornamento")
+	}
+}
+
+// TestProgressWriter verifica che il contatore di progresso funzioni correttamente.
+func TestProgressWriter(t *testing.T) {
+	// Setup
+	var capturedOutput bytes.Buffer
+	pw := &progressWriter{out: &capturedOutput}
+
+	// Esecuzione
+	testData := make([]byte, 1024) // 1KB di dati
+	n, err := pw.Write(testData)
+	if err != nil {
+		t.Fatalf("pw.Write ha restituito un errore: %v", err)
+	}
+
+	// Asserzioni
+	if n != 1024 {
+		t.Errorf("Write ha restituito un numero di byte errato. Got: %d, Want: %d", n, 1024)
+	}
+
+	if pw.total != 1024 {
+		t.Errorf("Il totale dei byte non è stato aggiornato correttamente. Got: %d, Want: %d", pw.total, 1024)
+	}
+
+	// Scriviamo abbastanza dati da triggerare la stampa del progresso
+	largeData := make([]byte, 3*1024*1024) // 3MB
+	_, _ = pw.Write(largeData)
+
+	if !strings.Contains(capturedOutput.String(), "Writing...") {
+		t.Error("Il messaggio di progresso non è stato scritto sull'output")
+	}
+}
+
+// TestOnProgress verifica gli eventi di progresso passati alla callback
+// durante una copia.
+func TestOnProgress(t *testing.T) {
+	var events []Progress
+	f := &Flasher{BlockSize: 4, ProgressStep: 4, OnProgress: func(p Progress) { events = append(events, p) }}
+	if _, err := f.Copy(context.Background(), strings.NewReader("abcdefghij"), io.Discard, 10); err != nil {
+		t.Fatalf("Copy ha restituito un errore: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Attesi 3 eventi (4, 8 e 10 byte). Got: %+v", events)
+	}
+	last := events[len(events)-1]
+	if last.Phase != "Writing" || last.PhaseIndex != 1 || last.PhaseCount != 1 || last.Bytes != 10 || last.Total != 10 || last.Percent != 100 {
+		t.Errorf("Ultimo evento inatteso: %+v", last)
+	}
+}
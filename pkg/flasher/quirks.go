@@ -0,0 +1,103 @@
+package flasher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Quirk is how a USB bridge or card reader, recognized by its vendor and
+// product IDs, must be written to.
+type Quirk struct {
+	// VendorID and ProductID are hexadecimal, as in USBDetails.
+	VendorID  string
+	ProductID string
+	Name      string
+	// SectorSize is the logical sector size the bridge exposes when it
+	// differs from what the disk behind it uses, e.g. 4096 for the
+	// enclosures that translate 512-byte sectors; writes are aligned to it.
+	SectorSize int
+	// MaxBlockSize limits Flasher.BlockSize, for bridges that drop off
+	// the bus under long writes.
+	MaxBlockSize int
+	// NoFlush avoids the cache flushes in the middle of the write, for
+	// bridges that hang on them (Flasher.NoFlush).
+	NoFlush bool
+	// Warning is shown to the user before flashing, for enclosures that
+	// are known to corrupt or lose data.
+	Warning string
+}
+
+// key returns the VID:PID of q, in lower case.
+func (q Quirk) key() string {
+	return strings.ToLower(q.VendorID + ":" + q.ProductID)
+}
+
+// quirks are the known bridges, by VID:PID.
+var (
+	quirksMu sync.RWMutex
+	quirks   = map[string]Quirk{}
+)
+
+func init() {
+	for _, q := range []Quirk{
+		{VendorID: "152d", ProductID: "0578", Name: "JMicron JMS567/JMS578", NoFlush: true,
+			Warning: "this bridge may stall on cache flushes in UAS mode; if it disconnects, boot with usb-storage.quirks=152d:0578:u"},
+		{VendorID: "174c", ProductID: "55aa", Name: "ASMedia ASM1051/ASM1053", NoFlush: true,
+			Warning: "this bridge is known to reset under load in UAS mode; if it disconnects, boot with usb-storage.quirks=174c:55aa:u"},
+		{VendorID: "0bda", ProductID: "9210", Name: "Realtek RTL9210", MaxBlockSize: 4 * 1024 * 1024,
+			Warning: "this NVMe enclosure overheats under sustained writes and may disconnect; keep it ventilated"},
+		{VendorID: "1058", ProductID: "1130", Name: "WD My Book Essential", SectorSize: 4096},
+		{VendorID: "1058", ProductID: "1140", Name: "WD My Book Essential", SectorSize: 4096},
+		{VendorID: "0bc2", ProductID: "3312", Name: "Seagate FreeAgent GoFlex Desk", SectorSize: 4096},
+		{VendorID: "05e3", ProductID: "0702", Name: "Genesys Logic GL811E",
+			Warning: "this bridge silently corrupts writes larger than 2 TB; use a different enclosure for large disks"},
+	} {
+		quirks[q.key()] = q
+	}
+}
+
+// RegisterQuirk adds q to the known bridges, replacing any quirk with the
+// same IDs.
+func RegisterQuirk(q Quirk) error {
+	if q.VendorID == "" || q.ProductID == "" {
+		return fmt.Errorf("quirk %s: missing vendor or product ID", q.Name)
+	}
+	if q.SectorSize < 0 || q.SectorSize&(q.SectorSize-1) != 0 {
+		return fmt.Errorf("quirk %s: invalid sector size %d", q.Name, q.SectorSize)
+	}
+	quirksMu.Lock()
+	defer quirksMu.Unlock()
+	quirks[q.key()] = q
+	return nil
+}
+
+// LookupQuirk returns the quirk of the bridge with the given hexadecimal
+// vendor and product IDs.
+func LookupQuirk(vendorID, productID string) (Quirk, bool) {
+	quirksMu.RLock()
+	defer quirksMu.RUnlock()
+	q, ok := quirks[Quirk{VendorID: vendorID, ProductID: productID}.key()]
+	return q, ok
+}
+
+// QuirkFor returns the quirk of the USB bridge the block device at path is
+// attached to. It finds none for a device that is not on USB, or where
+// ReadDeviceDetails is not supported.
+func QuirkFor(path string) (Quirk, bool) {
+	d, err := ReadDeviceDetails(path)
+	if err != nil || d.USB == nil {
+		return Quirk{}, false
+	}
+	return LookupQuirk(d.USB.VendorID, d.USB.ProductID)
+}
+
+// ApplyQuirk adapts f to the bridge described by q; it does not show
+// q.Warning, which is up to the caller.
+func (f *Flasher) ApplyQuirk(q Quirk) {
+	f.Align = max(f.Align, q.SectorSize)
+	if q.MaxBlockSize > 0 && (f.BlockSize <= 0 || f.BlockSize > q.MaxBlockSize) {
+		f.BlockSize = q.MaxBlockSize
+	}
+	f.NoFlush = f.NoFlush || q.NoFlush
+}
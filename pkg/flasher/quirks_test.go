@@ -0,0 +1,83 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLookupQuirk verifica la tabella dei bridge e la registrazione di un
+// nuovo bridge.
+func TestLookupQuirk(t *testing.T) {
+	if q, ok := LookupQuirk("152D", "0578"); !ok || !q.NoFlush || q.Warning == "" {
+		t.Errorf("Quirk del JMS578 errato. Got: %+v (%v)", q, ok)
+	}
+	if _, ok := LookupQuirk("dead", "beef"); ok {
+		t.Error("Un bridge sconosciuto non dovrebbe avere quirk")
+	}
+	if err := RegisterQuirk(Quirk{Name: "noid"}); err == nil {
+		t.Error("Un quirk senza ID dovrebbe essere un errore")
+	}
+	if err := RegisterQuirk(Quirk{VendorID: "dead", ProductID: "beef", SectorSize: 1000}); err == nil {
+		t.Error("Una dimensione del settore non potenza di due dovrebbe essere un errore")
+	}
+	if err := RegisterQuirk(Quirk{VendorID: "dead", ProductID: "beef", SectorSize: 4096}); err != nil {
+		t.Fatalf("RegisterQuirk ha restituito un errore: %v", err)
+	}
+	if q, ok := LookupQuirk("dead", "beef"); !ok || q.SectorSize != 4096 {
+		t.Errorf("Quirk registrato errato. Got: %+v (%v)", q, ok)
+	}
+}
+
+// TestApplyQuirk verifica come un quirk modifica il Flasher.
+func TestApplyQuirk(t *testing.T) {
+	f := &Flasher{}
+	f.ApplyQuirk(Quirk{SectorSize: 4096, MaxBlockSize: 1 << 20, NoFlush: true})
+	if f.Align != 4096 || f.BlockSize != 1<<20 || !f.NoFlush {
+		t.Errorf("Flasher errato. Got: align %d, blocchi %d, noflush %v", f.Align, f.BlockSize, f.NoFlush)
+	}
+	f = &Flasher{BlockSize: 512}
+	f.ApplyQuirk(Quirk{MaxBlockSize: 1 << 20})
+	if f.BlockSize != 512 {
+		t.Errorf("Blocchi più piccoli del limite non dovrebbero cambiare. Got: %d", f.BlockSize)
+	}
+}
+
+// TestFlashAlign verifica che con Align l'ultimo blocco venga completato
+// fino al settore e che un offset non allineato venga rifiutato.
+func TestFlashAlign(t *testing.T) {
+	dest := &memDest{data: bytes.Repeat([]byte{0xff}, 16)}
+	RegisterDestination("aligntest", func(string) (Destination, error) { return dest, nil })
+	f := &Flasher{BlockSize: 6, Align: 4, Verify: true}
+	res, err := f.Flash(context.Background(), NewSource(strings.NewReader("abcdefghij"), 10), "aligntest://device")
+	if err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if want := "abcdefghij\x00\x00\xff"; string(dest.data[:13]) != want || res.Bytes != 10 {
+		t.Errorf("Destinazione errata. Got: %q (%d byte), Want: %q", dest.data[:13], res.Bytes, want)
+	}
+
+	f = &Flasher{Align: 4, Seek: 2}
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "aligntest://device"); err == nil {
+		t.Error("Un offset non allineato dovrebbe essere un errore")
+	}
+}
+
+// TestCopyNoFlush verifica che con NoFlush la pausa non scarichi i dati.
+func TestCopyNoFlush(t *testing.T) {
+	f := &Flasher{BlockSize: 4, NoFlush: true}
+	f.Pause()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.Resume()
+	}()
+	dest := &syncRecorder{}
+	if _, err := f.Copy(context.Background(), strings.NewReader("abcdefgh"), dest, 0); err != nil {
+		t.Fatalf("Copy ha restituito un errore: %v", err)
+	}
+	if dest.data.String() != "abcdefgh" || dest.synced != 0 {
+		t.Errorf("Copia errata. Got: %q (sync: %d)", dest.data.String(), dest.synced)
+	}
+}
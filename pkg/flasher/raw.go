@@ -0,0 +1,66 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// WriteRaw writes Data at Offset bytes from the start of the device,
+// outside the partitions, e.g. the SPL and U-Boot that many ARM boards
+// load from a fixed offset. Data must overlap neither a partition nor the
+// partition table; the boot code and the disk signature of an MBR may be
+// overwritten.
+type WriteRaw struct {
+	Offset int64
+	Data   []byte
+}
+
+func (s WriteRaw) Name() string {
+	return fmt.Sprintf("write %d bytes at offset %d", len(s.Data), s.Offset)
+}
+
+func (s WriteRaw) Apply(ctx context.Context, disk *Disk) error {
+	start, end := s.Offset, s.Offset+int64(len(s.Data))
+	if start < 0 || (disk.Size() > 0 && end > disk.Size()) {
+		return fmt.Errorf("%d bytes at offset %d do not fit on %s", len(s.Data), s.Offset, disk.Device)
+	}
+	for _, r := range disk.reserved() {
+		if start < r.end && r.start < end {
+			return fmt.Errorf("%d bytes at offset %d would overwrite the %s of %s", len(s.Data), s.Offset, r.what, disk.Device)
+		}
+	}
+	if _, err := disk.dest.WriteAt(s.Data, s.Offset); err != nil {
+		return fmt.Errorf("could not write at offset %d of %s: %w", s.Offset, disk.Device, err)
+	}
+	return nil
+}
+
+// byteRange is a range of bytes of a Disk, from start to end excluded.
+type byteRange struct {
+	start, end int64
+	what       string
+}
+
+// reserved returns the ranges of d that the partition table and the
+// partitions use.
+func (d *Disk) reserved() []byteRange {
+	var ranges []byteRange
+	sector := d.d.LogicalBlocksize
+	switch t := d.d.Table.(type) {
+	case *mbr.Table:
+		ranges = append(ranges, byteRange{446, 512, "partition table"})
+	case *gpt.Table:
+		// MBR protettivo, intestazione e 128 voci da 128 byte, e la copia
+		// in fondo.
+		ranges = append(ranges, byteRange{446, 2*sector + 128*128, "partition table"},
+			byteRange{(int64(t.LastDataSector()) + 1) * sector, d.Size(), "backup partition table"})
+	}
+	parts, _ := d.Partitions()
+	for _, p := range parts {
+		ranges = append(ranges, byteRange{p.Start, p.Start + p.Size, fmt.Sprintf("partition %d", p.Number)})
+	}
+	return ranges
+}
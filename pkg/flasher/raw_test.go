@@ -0,0 +1,58 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// TestWriteRaw verifica la scrittura di un bootloader fuori dalle
+// partizioni e il rifiuto delle scritture che le toccano.
+func TestWriteRaw(t *testing.T) {
+	dest := &memDest{data: newTestImage(t)}
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spl := bytes.Repeat([]byte{0xa5}, 32*1024)
+	if err := d.Apply(context.Background(), WriteRaw{Offset: 8192, Data: spl}, WriteRaw{Offset: 0, Data: make([]byte, 440)}); err != nil {
+		t.Fatalf("WriteRaw ha restituito un errore: %v", err)
+	}
+	if !bytes.Equal(dest.data[8192:8192+len(spl)], spl) {
+		t.Error("Il bootloader non è stato scritto all'offset richiesto")
+	}
+	if _, err := d.Partition(1); err != nil {
+		t.Errorf("La tabella delle partizioni va lasciata intatta: %v", err)
+	}
+
+	for _, bad := range []WriteRaw{
+		{Offset: 0, Data: make([]byte, 512)},            // tabella MBR
+		{Offset: 1<<20 - 512, Data: make([]byte, 1024)}, // prima partizione
+		{Offset: int64(len(dest.data)) - 10, Data: make([]byte, 20)},
+		{Offset: -1, Data: []byte{0}},
+	} {
+		if err := d.Apply(context.Background(), bad); err == nil {
+			t.Errorf("Scrittura di %d byte a %d accettata", len(bad.Data), bad.Offset)
+		}
+	}
+
+	image := &memDest{data: make([]byte, 8*mib)}
+	d, err = NewDisk("image", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.LinuxFilesystem, Start: 2048, End: 4095},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), WriteRaw{Offset: 8192, Data: spl}); err == nil {
+		t.Error("Su GPT l'offset 8K sovrascrive le voci della tabella")
+	}
+	if err := d.Apply(context.Background(), WriteRaw{Offset: 256 * 512, Data: spl}); err != nil {
+		t.Errorf("Su GPT il settore 256 è libero. Got: %v", err)
+	}
+}
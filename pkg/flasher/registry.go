@@ -0,0 +1,69 @@
+package flasher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SourceOpener opens the image at location, as given to OpenImage.
+type SourceOpener func(location string) (Image, error)
+
+// DestinationOpener opens the destination at location, as given to
+// Flasher.Flash.
+type DestinationOpener func(location string) (Destination, error)
+
+// The registries map a URL scheme ("http") or a file extension (".vhd",
+// with the dot) to the opener of the locations that use it. Locations
+// without a registered scheme or extension are local files and devices.
+var (
+	registryMu   sync.RWMutex
+	sources      = map[string]SourceOpener{"file": openFileURL, firstPart: openSplitImage}
+	destinations = map[string]DestinationOpener{"file": createFileURL}
+)
+
+// RegisterSource makes OpenImage use open for the locations with the
+// given scheme or extension, replacing any previous opener.
+func RegisterSource(key string, open SourceOpener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	sources[strings.ToLower(key)] = open
+}
+
+// RegisterDestination makes Flasher.Flash use open for the locations with
+// the given scheme or extension, replacing any previous opener.
+func RegisterDestination(key string, open DestinationOpener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	destinations[strings.ToLower(key)] = open
+}
+
+// schemeOf returns the scheme of a location like "http://host/image.img",
+// or an empty string for a plain path.
+func schemeOf(location string) string {
+	scheme, _, ok := strings.Cut(location, "://")
+	if !ok || scheme == "" || strings.ContainsAny(scheme, `/\`) {
+		return ""
+	}
+	return strings.ToLower(scheme)
+}
+
+// lookup returns the opener registered in table for the scheme of
+// location or, for a plain path, for its extension. An unknown scheme is
+// an error; an unknown extension returns def.
+func lookup[T any](table map[string]T, location string, def T) (T, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if scheme := schemeOf(location); scheme != "" {
+		open, ok := table[scheme]
+		if !ok {
+			return def, fmt.Errorf("unsupported location %s: no handler for %s://", location, scheme)
+		}
+		return open, nil
+	}
+	if open, ok := table[strings.ToLower(filepath.Ext(location))]; ok {
+		return open, nil
+	}
+	return def, nil
+}
@@ -0,0 +1,84 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memImage è un'immagine in memoria, con ReadAt.
+type memImage struct {
+	*bytes.Reader
+}
+
+func (memImage) Close() error { return nil }
+
+func (m memImage) Size() int64 { return m.Reader.Size() }
+
+// memDest è una destinazione in memoria di capacità fissa.
+type memDest struct {
+	data   []byte
+	synced bool
+}
+
+func (d *memDest) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDest) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(d.data).ReadAt(p, off)
+}
+
+func (d *memDest) Sync() error  { d.synced = true; return nil }
+func (d *memDest) Close() error { return nil }
+func (d *memDest) Size() int64  { return int64(len(d.data)) }
+
+// TestRegistry verifica che sorgenti e destinazioni registrate per schema
+// vengano usate da OpenImage e da Flash.
+func TestRegistry(t *testing.T) {
+	data := []byte("immagine registrata per schema")
+	RegisterSource("memtest", func(string) (Image, error) { return memImage{bytes.NewReader(data)}, nil })
+	dest := &memDest{data: make([]byte, 64)}
+	RegisterDestination("memtest", func(string) (Destination, error) { return dest, nil })
+
+	src, err := OpenImage("memtest://image", OpenOptions{})
+	if err != nil {
+		t.Fatalf("OpenImage ha restituito un errore: %v", err)
+	}
+	defer src.Close()
+	if src.Size != int64(len(data)) || !src.Exact {
+		t.Errorf("Dimensione errata. Got: %d (esatta: %v), Want: %d", src.Size, src.Exact, len(data))
+	}
+
+	f := &Flasher{Seek: 4, Verify: true}
+	res, err := f.Flash(context.Background(), src, "memtest://device")
+	if err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if !bytes.Equal(dest.data[4:4+len(data)], data) || !dest.synced || res.Verification != "passed" {
+		t.Errorf("Destinazione errata. Got: %q (sync: %v, verifica: %s)", dest.data, dest.synced, res.Verification)
+	}
+
+	if _, err := OpenImage("nosuch://image", OpenOptions{}); err == nil || !strings.Contains(err.Error(), "nosuch://") {
+		t.Errorf("Uno schema sconosciuto dovrebbe essere un errore. Got: %v", err)
+	}
+}
+
+// TestFileURL verifica la scrittura su un file indicato con file://.
+func TestFileURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "copy.img")
+	f := &Flasher{}
+	if _, err := f.Flash(context.Background(), NewSource(strings.NewReader("dati"), 4), "file://"+path); err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "dati" {
+		t.Errorf("Contenuto errato. Got: %q", got)
+	}
+}
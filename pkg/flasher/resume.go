@@ -0,0 +1,124 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// checkpoint records, in Flasher.State, how far an interrupted flash got.
+type checkpoint struct {
+	Device string `json:"device"`
+	// Serial and Size identify the device, so that a different device
+	// later found at the same path is not resumed.
+	Serial string `json:"serial,omitempty"`
+	Size   int64  `json:"size"`
+	// The settings of the flash, which a resumed flash must repeat.
+	Skip  int64 `json:"skip"`
+	Seek  int64 `json:"seek"`
+	Count int64 `json:"count"`
+	Pad   bool  `json:"pad"`
+	// Written bytes of the image are on the device, synced; Digest is
+	// their hexadecimal digest, to recognize the image.
+	Written int64     `json:"written"`
+	Digest  string    `json:"digest"`
+	Time    time.Time `json:"time"`
+}
+
+// checkpointKey is the StateStore key of the checkpoint of device.
+func checkpointKey(device string) string {
+	return "flash/" + device
+}
+
+// deviceIdentity returns the serial number, if known, and the size of the
+// device behind dest.
+func deviceIdentity(device string, dest Destination) (serial string, size int64) {
+	if schemeOf(device) != "" {
+		_, device, _ = strings.Cut(device, "://")
+	}
+	if d, err := ReadDeviceDetails(device); err == nil {
+		serial = d.Serial
+	}
+	return serial, dest.Size()
+}
+
+// checkpoint syncs the data written so far to dest and, if f.State is
+// set, records st so that the flash can be resumed.
+func (f *Flasher) checkpoint(dest Destination, device string, st *copyState) {
+	log := f.logger()
+	if err := dest.Sync(); err != nil {
+		log.Warn("could not sync the data written so far", "err", err)
+		return
+	}
+	if f.State == nil || st.written == 0 {
+		return
+	}
+	serial, size := deviceIdentity(device, dest)
+	cp := checkpoint{
+		Device: device, Serial: serial, Size: size, Skip: f.Skip, Seek: f.Seek, Count: f.Count, Pad: f.Pad,
+		Written: st.written, Digest: hex.EncodeToString(st.hasher.Sum(nil)), Time: time.Now(),
+	}
+	if err := f.State.Save(checkpointKey(device), cp); err != nil {
+		log.Warn("could not save the flash checkpoint", "err", err)
+		return
+	}
+	log.Info("flash checkpoint saved", "written", st.written)
+}
+
+// resume reads the part of r written by an interrupted flash of device,
+// as recorded in f.State, and moves st past it. Without a matching
+// checkpoint, or if dest is not the device that was interrupted, the
+// flash starts over. Once read, the data cannot be read again: an image
+// that differs from the interrupted one is an error unless r can seek
+// back.
+func (f *Flasher) resume(ctx context.Context, r io.Reader, dest Destination, device string, st *copyState) error {
+	log := f.logger()
+	var cp checkpoint
+	if err := f.State.Load(checkpointKey(device), &cp); err != nil {
+		if !errors.Is(err, ErrNoState) {
+			log.Warn("could not load the flash checkpoint, starting over", "err", err)
+		}
+		return nil
+	}
+	if cp.Skip != f.Skip || cp.Seek != f.Seek || cp.Count != f.Count || cp.Pad != f.Pad || cp.Written <= 0 {
+		log.Warn("the interrupted flash used other settings, starting over", "device", device)
+		return nil
+	}
+	if serial, size := deviceIdentity(device, dest); cp.Serial != serial || cp.Size != size {
+		log.Warn("the device differs from the interrupted flash, starting over", "device", device, "serial", serial, "size", size)
+		return nil
+	}
+	want, err := hex.DecodeString(cp.Digest)
+	if err != nil {
+		log.Warn("invalid flash checkpoint, starting over", "err", err)
+		return nil
+	}
+
+	fmt.Fprintf(f.output(), "Resuming an interrupted flash: checking the first %d bytes of the image...\n", cp.Written)
+	n, err := io.CopyN(st.hasher, withContext(ctx, r), cp.Written)
+	if err == nil && bytes.Equal(st.hasher.Sum(nil), want) {
+		st.written = n
+		log.Info("resuming the flash", "device", device, "written", n)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("resume interrupted: %w", context.Cause(ctx))
+	}
+	// L'immagine è cambiata: si riparte da capo se si può tornare indietro.
+	if s, ok := r.(io.Seeker); ok {
+		if _, serr := s.Seek(f.Skip, io.SeekStart); serr == nil {
+			log.Warn("the image differs from the interrupted flash, starting over", "device", device)
+			st.hasher.Reset()
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not resume the flash of %s: %w", device, err)
+	}
+	return fmt.Errorf("could not resume the flash of %s: the image differs from the interrupted one, flash it again without resuming", device)
+}
@@ -0,0 +1,152 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy tells how transient failures are retried: the reads of the
+// image, the writes to the device and the opening of the image, e.g. a
+// download. The zero value does not retry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one;
+	// 0 or 1 means no retry.
+	MaxAttempts int
+	// Backoff is the wait before the second attempt, doubled before each
+	// of the following ones up to MaxBackoff (no limit if 0).
+	Backoff, MaxBackoff time.Duration
+	// Retryable tells which errors are worth retrying (DefaultRetryable if
+	// nil).
+	Retryable func(error) bool
+	// OnRetry, if set, is called before waiting for attempt (2 for the
+	// first retry) after err.
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+// DefaultRetryable reports whether err looks transient: an I/O error,
+// an interrupted or timed out call, or a network timeout. A cancelled
+// flash, a removed device or a full device are never retried.
+func DefaultRetryable(err error) bool {
+	switch {
+	case err == nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrTimeout), errors.Is(err, ErrDeviceRemoved),
+		errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO), errors.Is(err, syscall.ENOSPC):
+		return false
+	case errors.Is(err, syscall.EIO), errors.Is(err, syscall.EAGAIN), errors.Is(err, syscall.EINTR),
+		errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// retryable reports whether err is retried by p.
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+// backoff returns the wait before attempt (2 for the first retry).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 2; i < attempt && (p.MaxBackoff == 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 {
+		wait = min(wait, p.MaxBackoff)
+	}
+	return wait
+}
+
+// Do calls op until it succeeds, fails with an error that is not
+// retryable or has been called MaxAttempts times, and returns its last
+// error. It stops waiting with the cause of ctx once ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !p.retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if err := p.wait(ctx, attempt+1, err); err != nil {
+			return err
+		}
+	}
+}
+
+// wait reports the retry and sleeps before attempt.
+func (p RetryPolicy) wait(ctx context.Context, attempt int, err error) error {
+	wait := p.backoff(attempt)
+	if p.OnRetry != nil {
+		p.OnRetry(attempt, err, wait)
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// retryReader retries the failed reads of r. Readers like files and
+// devices do not advance on a failed read, so the retry reads the same
+// data again; the data read before an error is returned first, and the
+// error, if it persists, comes back on the next read.
+type retryReader struct {
+	ctx    context.Context
+	r      io.Reader
+	policy RetryPolicy
+}
+
+func (rr retryReader) Read(p []byte) (n int, err error) {
+	rerr := rr.policy.Do(rr.ctx, func() error {
+		n, err = rr.r.Read(p)
+		if n > 0 && err != io.EOF {
+			err = nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	})
+	if rerr != nil {
+		return n, rerr
+	}
+	return n, err
+}
+
+// retryWriter retries the failed writes to w, writing again what was not
+// written yet.
+type retryWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	policy RetryPolicy
+}
+
+func (rw retryWriter) Write(p []byte) (int, error) {
+	var written int
+	err := rw.policy.Do(rw.ctx, func() error {
+		n, err := rw.w.Write(p[written:])
+		written += n
+		return err
+	})
+	return written, err
+}
+
+// Sync lets a paused copy flush the data written so far.
+func (rw retryWriter) Sync() error {
+	if sync := flushFunc(rw.w); sync != nil {
+		return sync()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRetryPolicyDo verifica il numero di tentativi e gli errori ritentati.
+func TestRetryPolicyDo(t *testing.T) {
+	var waits []time.Duration
+	p := RetryPolicy{MaxAttempts: 4, Backoff: time.Millisecond, MaxBackoff: 3 * time.Millisecond,
+		OnRetry: func(_ int, _ error, wait time.Duration) { waits = append(waits, wait) }}
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("read: %w", syscall.EIO)
+	})
+	if !errors.Is(err, syscall.EIO) || calls != 4 {
+		t.Errorf("Do dovrebbe fare 4 tentativi e restituire l'ultimo errore. Got: %d, %v", calls, err)
+	}
+	if want := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}; fmt.Sprint(waits) != fmt.Sprint(want) {
+		t.Errorf("Attese errate. Got: %v, Want: %v", waits, want)
+	}
+
+	calls = 0
+	if err := p.Do(context.Background(), func() error { calls++; return ErrDeviceRemoved }); !errors.Is(err, ErrDeviceRemoved) || calls != 1 {
+		t.Errorf("Un dispositivo rimosso non va ritentato. Got: %d, %v", calls, err)
+	}
+	calls = 0
+	if err := (RetryPolicy{}).Do(context.Background(), func() error { calls++; return syscall.EIO }); calls != 1 || err == nil {
+		t.Errorf("La politica vuota non dovrebbe ritentare. Got: %d, %v", calls, err)
+	}
+}
+
+// flakyWriter fallisce una volta ogni due scritture, dopo aver scritto
+// metà del blocco.
+type flakyWriter struct {
+	strings.Builder
+	fail bool
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.fail = !w.fail
+	if w.fail {
+		n, _ := w.Builder.Write(p[:len(p)/2])
+		return n, syscall.EIO
+	}
+	return w.Builder.Write(p)
+}
+
+// flakyReader fallisce prima di ogni lettura riuscita.
+type flakyReader struct {
+	r    *strings.Reader
+	fail bool
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	r.fail = !r.fail
+	if r.fail {
+		return 0, syscall.EAGAIN
+	}
+	return r.r.Read(p)
+}
+
+// TestCopyRetry verifica che letture e scritture fallite vengano ritentate
+// senza perdere né duplicare dati.
+func TestCopyRetry(t *testing.T) {
+	dest := &flakyWriter{}
+	f := &Flasher{BlockSize: 4, Retry: RetryPolicy{MaxAttempts: 2}}
+	res, err := f.Copy(context.Background(), &flakyReader{r: strings.NewReader("abcdefghij")}, dest, 0)
+	if err != nil {
+		t.Fatalf("Copy ha restituito un errore: %v", err)
+	}
+	if dest.String() != "abcdefghij" || res.Bytes != 10 {
+		t.Errorf("Dati scritti errati. Got: %q (%d byte)", dest.String(), res.Bytes)
+	}
+
+	f.Retry = RetryPolicy{}
+	if _, err := f.Copy(context.Background(), strings.NewReader("abcd"), &flakyWriter{}, 0); !errors.Is(err, ErrWrite) {
+		t.Errorf("Senza tentativi la scrittura dovrebbe fallire. Got: %v", err)
+	}
+}
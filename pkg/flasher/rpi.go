@@ -0,0 +1,260 @@
+package flasher
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RaspberryPiSetup prepares a Raspberry Pi OS image for a headless first
+// boot, as the OS customization of Raspberry Pi Imager does, through its
+// boot partition: ssh enables the SSH server, userconf.txt creates the
+// first user, and a firstrun.sh script, run once by systemd at the first
+// boot, configures the rest, e.g. the Wi-Fi.
+type RaspberryPiSetup struct {
+	// SSH enables the SSH server.
+	SSH bool
+	// AuthorizedKeys are public keys, in the authorized_keys format, that
+	// log in as the first user, or root if there is none; as with Imager,
+	// they enable the SSH server and disable its password logins.
+	AuthorizedKeys []string
+	// User and Password create the first user instead of the first boot
+	// wizard. Password may already be a crypt(3) hash, e.g. from
+	// `openssl passwd -6`; it is hashed otherwise.
+	User, Password string
+	// WiFi, if its SSID is set, connects to a wireless network.
+	WiFi WiFi
+}
+
+// WiFi is a wireless network of RaspberryPiSetup.
+type WiFi struct {
+	SSID string
+	// Password is the WPA passphrase, 8 to 63 characters.
+	Password string
+	// Country is the ISO 3166 code of the regulatory domain, e.g. "IT":
+	// Raspberry Pi OS keeps the Wi-Fi off until it is set.
+	Country string
+	// Hidden is set for a network that does not broadcast its SSID.
+	Hidden bool
+}
+
+var (
+	// userPattern matches the user names that Raspberry Pi OS accepts.
+	userPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	// countryPattern matches an ISO 3166 alpha-2 code.
+	countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+	// keyPattern matches an SSH public key: its type, the key in base64
+	// and an optional comment.
+	keyPattern = regexp.MustCompile(`^(ssh-|ecdsa-sha2-|sk-)[a-z0-9@.-]+ [A-Za-z0-9+/]+={0,3}( [^\r\n]*)?$`)
+)
+
+func (s RaspberryPiSetup) Name() string {
+	var what []string
+	if s.SSH || len(s.AuthorizedKeys) > 0 {
+		what = append(what, "SSH")
+	}
+	if s.User != "" {
+		what = append(what, "user "+s.User)
+	}
+	if s.WiFi.SSID != "" {
+		what = append(what, "Wi-Fi "+s.WiFi.SSID)
+	}
+	return "set up the Raspberry Pi: " + strings.Join(what, ", ")
+}
+
+func (s RaspberryPiSetup) Apply(ctx context.Context, disk *Disk) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	_, boot, err := disk.FindFile("/cmdline.txt")
+	if err != nil {
+		return fmt.Errorf("not a Raspberry Pi OS image: %w", err)
+	}
+	files := make(map[string][]byte)
+	if s.SSH {
+		files["/ssh"] = nil
+	}
+	if s.User != "" {
+		hash := s.Password
+		if !strings.HasPrefix(hash, "$") {
+			if hash, err = hashPassword(s.Password); err != nil {
+				return err
+			}
+		}
+		files["/userconf.txt"] = []byte(s.User + ":" + hash + "\n")
+	}
+	var script []string
+	if len(s.AuthorizedKeys) > 0 {
+		files["/ssh"] = nil
+		script = append(script, authorizedKeysScript(s.AuthorizedKeys))
+	}
+	if s.WiFi.SSID != "" {
+		script = append(script, s.WiFi.script())
+	}
+	if len(script) > 0 {
+		if err := addFirstRun(disk, boot, files, script); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		if err := boot.WriteFile(name, files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks the settings, which Apply does before writing anything,
+// e.g. to refuse them before the image is flashed.
+func (s RaspberryPiSetup) Validate() error {
+	if s.User != "" {
+		if !userPattern.MatchString(s.User) {
+			return fmt.Errorf("invalid user name %q", s.User)
+		}
+		if s.Password == "" {
+			return fmt.Errorf("the user %s needs a password", s.User)
+		}
+	}
+	for _, key := range s.AuthorizedKeys {
+		if !keyPattern.MatchString(key) {
+			return fmt.Errorf("invalid SSH public key %q", key)
+		}
+	}
+	if w := s.WiFi; w.SSID != "" {
+		if len(w.SSID) > 32 {
+			return fmt.Errorf("the SSID %q is longer than 32 bytes", w.SSID)
+		}
+		if len(w.Password) < 8 || len(w.Password) > 63 {
+			return fmt.Errorf("the Wi-Fi password must be 8 to 63 characters")
+		}
+		if !countryPattern.MatchString(w.Country) {
+			return fmt.Errorf("the Wi-Fi needs a country code, e.g. IT, not %q", w.Country)
+		}
+	}
+	return nil
+}
+
+// script returns the firstrun.sh commands that configure w, as Raspberry
+// Pi Imager writes them: imager_custom of Raspberry Pi OS from Bookworm,
+// wpa_supplicant.conf before it.
+func (w WiFi) script() string {
+	psk := wpaPSK(w.SSID, w.Password)
+	hidden, scan := "", ""
+	if w.Hidden {
+		hidden, scan = "-h ", "\tscan_ssid=1\n"
+	}
+	return fmt.Sprintf(`if [ -f /usr/lib/raspberrypi-sys-mods/imager_custom ]; then
+   /usr/lib/raspberrypi-sys-mods/imager_custom set_wlan %s%s %s %s
+else
+cat >/etc/wpa_supplicant/wpa_supplicant.conf <<'WPAEOF'
+country=%s
+ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev
+ap_scan=1
+
+update_config=1
+network={
+%s	ssid=%s
+	psk=%s
+}
+
+WPAEOF
+   chmod 600 /etc/wpa_supplicant/wpa_supplicant.conf
+   rfkill unblock wifi
+   for filename in /var/lib/systemd/rfkill/*:wlan ; do
+       echo 0 > $filename
+   done
+fi
+`, hidden, shellQuote(w.SSID), shellQuote(psk), shellQuote(w.Country), w.Country, scan, hex.EncodeToString([]byte(w.SSID)), psk)
+}
+
+// authorizedKeysScript returns the firstrun.sh commands that authorize
+// keys for the first user, as Raspberry Pi Imager writes them, or for root
+// if the image has no user 1000.
+func authorizedKeysScript(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = shellQuote(key)
+	}
+	args := strings.Join(quoted, " ")
+	return fmt.Sprintf(`FIRSTUSER=$(getent passwd 1000 | cut -d: -f1)
+FIRSTUSERHOME=$(getent passwd 1000 | cut -d: -f6)
+if [ -f /usr/lib/raspberrypi-sys-mods/imager_custom ] && [ -n "$FIRSTUSER" ]; then
+   /usr/lib/raspberrypi-sys-mods/imager_custom enable_ssh -k %[1]s
+else
+   if [ -z "$FIRSTUSER" ]; then
+      FIRSTUSER=root
+      FIRSTUSERHOME=/root
+   fi
+   install -o "$FIRSTUSER" -m 700 -d "$FIRSTUSERHOME/.ssh"
+   install -o "$FIRSTUSER" -m 600 <(printf "%%s\n" %[1]s) "$FIRSTUSERHOME/.ssh/authorized_keys"
+   echo 'PasswordAuthentication no' >>/etc/ssh/sshd_config
+   systemctl enable ssh
+fi
+`, args)
+}
+
+// firstRunArgs are appended to cmdline.txt to run firstrun.sh once, at
+// the first boot, and reboot.
+const firstRunArgs = " systemd.run=%s/firstrun.sh systemd.run_success_action=reboot systemd.unit=kernel-command-line.target"
+
+// firstRunHeader starts the firstrun.sh script.
+const firstRunHeader = "#!/bin/bash\n\nset +e\n\n"
+
+// firstRunTrailer ends the firstrun.sh script in dir: it removes the
+// script, and its arguments from cmdline.txt.
+const firstRunTrailer = "rm -f %[1]s/firstrun.sh\nsed -i 's| systemd.run.*||g' %[1]s/cmdline.txt\nexit 0\n"
+
+// addFirstRun adds to files the firstrun.sh script running commands, and
+// the cmdline.txt that runs it. The commands go after those of a
+// firstrun.sh already in files or on the boot partition, so that several
+// steps can add theirs.
+func addFirstRun(disk *Disk, boot Filesystem, files map[string][]byte, commands []string) error {
+	cmdline, err := boot.ReadFile("/cmdline.txt")
+	if err != nil {
+		return err
+	}
+	// Da Bookworm la partizione di boot è montata in /boot/firmware.
+	dir := "/boot"
+	if _, root, err := disk.FindFile("/etc/fstab"); err == nil {
+		if fstab, err := root.ReadFile("/etc/fstab"); err == nil && strings.Contains(string(fstab), "/boot/firmware") {
+			dir = "/boot/firmware"
+		}
+	}
+	line := strings.TrimSpace(string(cmdline))
+	if i := strings.Index(line, " systemd.run="); i >= 0 {
+		line = line[:i]
+	}
+	files["/cmdline.txt"] = []byte(line + fmt.Sprintf(firstRunArgs, dir) + "\n")
+
+	old, ok := files["/firstrun.sh"]
+	if !ok {
+		old, _ = boot.ReadFile("/firstrun.sh")
+	}
+	trailer := fmt.Sprintf(firstRunTrailer, dir)
+	script, found := strings.CutSuffix(string(old), trailer)
+	if !found || !strings.HasPrefix(script, firstRunHeader) {
+		script = firstRunHeader
+	}
+	for _, c := range commands {
+		script += c + "\n"
+	}
+	files["/firstrun.sh"] = []byte(script + trailer)
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,162 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// gptLegacyBootable is the GPT attribute bit that marks a partition as
+// bootable, like the active flag of MBR.
+const gptLegacyBootable = 1 << 2
+
+// slotPattern matches the name of a partition of an A/B pair, e.g.
+// rootfs_a or boot-B.
+var slotPattern = regexp.MustCompile(`(?i)^(.+)[_-]([ab])$`)
+
+// SlotPair is a pair of A/B partitions, for systems that update the slot
+// they are not running from and boot it once written. The partitions are
+// found by their name, <base>_a and <base>_b (or -a and -b): the GPT name
+// or, failing that, the label of their filesystem.
+type SlotPair struct {
+	Base string
+	A, B Partition
+	// Active is the slot marked as the one to boot, "a" or "b": the slot
+	// whose partition is bootable (the active flag of MBR, the legacy
+	// BIOS bootable attribute of GPT), "a" unless only b is.
+	Active string
+}
+
+// Inactive returns the slot that is not active, and its partition.
+func (s SlotPair) Inactive() (string, Partition) {
+	if s.Active == "b" {
+		return "a", s.A
+	}
+	return "b", s.B
+}
+
+// ReadSlotPairs opens the device at location for reading and returns its
+// A/B slot pairs, as Disk.SlotPairs does.
+func ReadSlotPairs(location string) ([]SlotPair, error) {
+	dest, err := openForReading(location)
+	if err != nil {
+		return nil, err
+	}
+	defer dest.Close()
+	d, err := NewDisk(location, dest)
+	if err != nil {
+		return nil, err
+	}
+	return d.SlotPairs()
+}
+
+// SlotPairs returns the A/B slot pairs of d, sorted by Base; a partition
+// without its counterpart is not a pair.
+func (d *Disk) SlotPairs() ([]SlotPair, error) {
+	parts, err := d.Partitions()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]*SlotPair)
+	for _, p := range parts {
+		m := slotPattern.FindStringSubmatch(d.partitionLabel(p))
+		if m == nil {
+			continue
+		}
+		base := m[1]
+		pair := found[base]
+		if pair == nil {
+			pair = &SlotPair{Base: base}
+			found[base] = pair
+		}
+		if strings.EqualFold(m[2], "a") {
+			pair.A = p
+		} else {
+			pair.B = p
+		}
+	}
+	var pairs []SlotPair
+	for _, pair := range found {
+		if pair.A.Number == 0 || pair.B.Number == 0 {
+			continue
+		}
+		pair.Active = "a"
+		if !d.bootable(pair.A.Number) && d.bootable(pair.B.Number) {
+			pair.Active = "b"
+		}
+		pairs = append(pairs, *pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Base < pairs[j].Base })
+	return pairs, nil
+}
+
+// partitionLabel returns the GPT name of p or the label of its
+// filesystem, empty if it has neither.
+func (d *Disk) partitionLabel(p Partition) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	fs, err := d.Filesystem(p.Number)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(fs.Label())
+}
+
+// bootable reports whether the partition number is marked bootable.
+func (d *Disk) bootable(number int) bool {
+	switch t := d.d.Table.(type) {
+	case *mbr.Table:
+		return t.Partitions[number-1].Bootable
+	case *gpt.Table:
+		return t.Partitions[number-1].Attributes&gptLegacyBootable != 0
+	}
+	return false
+}
+
+// SetActiveSlot marks Slot, "a" or "b", of the A/B pair Base as the one to
+// boot: its partition becomes bootable and the other one of the pair no
+// longer is. It is for boot loaders that pick the slot from the bootable
+// flag; others keep their own marker, e.g. in the U-Boot environment.
+type SetActiveSlot struct {
+	Base string
+	Slot string
+}
+
+func (s SetActiveSlot) Name() string {
+	return fmt.Sprintf("make slot %s of %s active", s.Slot, s.Base)
+}
+
+func (s SetActiveSlot) Apply(_ context.Context, disk *Disk) error {
+	if s.Slot != "a" && s.Slot != "b" {
+		return fmt.Errorf("invalid slot %q, expected a or b", s.Slot)
+	}
+	pairs, err := disk.SlotPairs()
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if pair.Base != s.Base {
+			continue
+		}
+		active, inactive := pair.A.Number, pair.B.Number
+		if s.Slot == "b" {
+			active, inactive = inactive, active
+		}
+		switch t := disk.d.Table.(type) {
+		case *mbr.Table:
+			t.Partitions[active-1].Bootable = true
+			t.Partitions[inactive-1].Bootable = false
+		case *gpt.Table:
+			t.Partitions[active-1].Attributes |= gptLegacyBootable
+			t.Partitions[inactive-1].Attributes &^= gptLegacyBootable
+		}
+		return disk.writeTable()
+	}
+	return fmt.Errorf("%s has no A/B partitions named %s_a and %s_b", disk.Device, s.Base, s.Base)
+}
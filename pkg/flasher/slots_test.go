@@ -0,0 +1,82 @@
+package flasher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// TestSlotPairs verifica il riconoscimento delle coppie A/B, per nome GPT
+// e per etichetta del filesystem, e il cambio dello slot attivo.
+func TestSlotPairs(t *testing.T) {
+	dest := &memDest{data: make([]byte, 8*mib)}
+	d, err := NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.EFISystemPartition, Start: 2048, End: 4095, Name: "boot"},
+		{Type: gpt.LinuxFilesystem, Start: 4096, End: 6143, Name: "rootfs_a"},
+		{Type: gpt.LinuxFilesystem, Start: 6144, End: 8191, Name: "rootfs_b"},
+		{Type: gpt.LinuxFilesystem, Start: 8192, End: 10239, Name: "data"},
+		{Type: gpt.LinuxFilesystem, Start: 10240, End: 12287, Name: "spare-a"},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := d.SlotPairs()
+	if err != nil {
+		t.Fatalf("SlotPairs ha restituito un errore: %v", err)
+	}
+	if len(pairs) != 1 || pairs[0].Base != "rootfs" || pairs[0].A.Number != 2 || pairs[0].B.Number != 3 || pairs[0].Active != "a" {
+		t.Fatalf("Coppie errate. Got: %+v", pairs)
+	}
+	if slot, p := pairs[0].Inactive(); slot != "b" || p.Number != 3 {
+		t.Errorf("Slot inattivo errato. Got: %s, %+v", slot, p)
+	}
+
+	if err := d.Apply(context.Background(), SetActiveSlot{Base: "rootfs", Slot: "b"}); err != nil {
+		t.Fatalf("SetActiveSlot ha restituito un errore: %v", err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs, _ := d.SlotPairs(); len(pairs) != 1 || pairs[0].Active != "b" {
+		t.Errorf("Lo slot b dovrebbe essere attivo. Got: %+v", pairs)
+	}
+	if err := d.Apply(context.Background(), SetActiveSlot{Base: "boot", Slot: "a"}); err == nil {
+		t.Error("Una coppia inesistente dovrebbe essere rifiutata")
+	}
+
+	// Con MBR le partizioni non hanno nome: conta l'etichetta del filesystem.
+	dest = &memDest{data: make([]byte, 80*mib)}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtable := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Fat32LBA, Start: 2048, Size: 36 * mib / 512},
+		{Type: mbr.Fat32LBA, Start: 2048 + 36*mib/512, Size: 36 * mib / 512, Bootable: true},
+	}}
+	if err := d.d.Partition(mtable); err != nil {
+		t.Fatal(err)
+	}
+	for i, label := range []string{"ROOT_A", "ROOT_B"} {
+		if _, err := d.d.CreateFilesystem(disk.FilesystemSpec{Partition: i + 1, FSType: filesystem.TypeFat32, VolumeLabel: label}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err = d.SlotPairs()
+	if err != nil || len(pairs) != 1 || pairs[0].Base != "ROOT" || pairs[0].Active != "b" {
+		t.Errorf("Coppia MBR errata. Got: %+v, %v", pairs, err)
+	}
+}
@@ -0,0 +1,161 @@
+package flasher
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StdinImage is the image path that reads the image from the standard
+// input, e.g. from curl or from a decompressor.
+const StdinImage = "-"
+
+// Source is the data to write to the device: an opened Image,
+// decompressed on the fly when it is compressed.
+type Source struct {
+	io.Reader
+	// Size is the (uncompressed) size of the image, 0 if unknown.
+	Size int64
+	// Exact is false when Size is only an estimate.
+	Exact bool
+	// Format is the compression of the image, empty for a raw image.
+	Format string
+	// SizeErr tells why the uncompressed size could not be estimated.
+	SizeErr error
+
+	closers []io.Closer
+}
+
+// OpenOptions tunes OpenImage.
+type OpenOptions struct {
+	// LowMemory decodes on a single thread with small buffers.
+	LowMemory bool
+	// Retry retries the opening of the image, e.g. a download that could
+	// not connect.
+	Retry RetryPolicy
+}
+
+// NewSource returns a Source reading size bytes (0 if unknown) from r.
+func NewSource(r io.Reader, size int64) *Source {
+	return &Source{Reader: r, Size: size, Exact: size > 0}
+}
+
+// Image is a raw, possibly compressed, image as returned by a
+// SourceOpener; OpenImage adds the decompression on top. When it also
+// implements io.ReaderAt and its size is known, the compression headers
+// are read in place and the uncompressed size can be estimated.
+type Image interface {
+	io.ReadCloser
+	// Size returns the size of the data, or 0 if it is unknown.
+	Size() int64
+}
+
+// fileImage is an image file, or the standard input.
+type fileImage struct {
+	*os.File
+	size  int64
+	stdin bool
+}
+
+func (f *fileImage) Size() int64 { return f.size }
+
+func (f *fileImage) Close() error {
+	if f.stdin {
+		return nil
+	}
+	return f.File.Close()
+}
+
+// openFile opens the image file at path, or the standard input for "-".
+func openFile(path string) (Image, error) {
+	img := &fileImage{File: os.Stdin, stdin: true}
+	if path != StdinImage {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open image file %s: %w", path, err)
+		}
+		img = &fileImage{File: f}
+	}
+	if info, err := img.Stat(); err == nil && info.Mode().IsRegular() {
+		img.size = info.Size()
+	}
+	return img, nil
+}
+
+// openFileURL opens the image file of a file:// URL.
+func openFileURL(location string) (Image, error) {
+	return openFile(strings.TrimPrefix(location, "file://"))
+}
+
+// OpenImage opens the image at location: a path, "-" for the standard
+// input, the first part (.001) of a split image, or a location handled by
+// a registered SourceOpener.
+func OpenImage(location string, opts OpenOptions) (*Source, error) {
+	open, err := lookup(sources, location, openFile)
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	err = opts.Retry.Do(context.Background(), func() (err error) {
+		img, err = open(location)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	src := &Source{Reader: img, closers: []io.Closer{img}}
+
+	// Le immagini di dimensione nota si possono leggere in qualsiasi
+	// punto; pipe e stream vanno bufferizzati per riconoscerne il formato.
+	ra, ok := img.(io.ReaderAt)
+	size := img.Size()
+	seekable := ok && size > 0
+	var head []byte
+	if seekable {
+		src.Size, src.Exact = size, true
+		head = make([]byte, magicLen())
+		n, _ := ra.ReadAt(head, 0)
+		head = head[:n]
+	} else {
+		br := bufio.NewReader(img)
+		head, _ = br.Peek(magicLen())
+		src.Reader = br
+		src.Size, src.Exact = size, size > 0
+	}
+
+	format := detectCompression(splitBase(location), head)
+	if format == nil {
+		return src, nil
+	}
+	zr, err := format.NewReader(src.Reader, opts)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("could not decompress %s image %s: %w", format.Name, location, err)
+	}
+	src.Reader, src.Format = zr, format.Name
+	src.closers = append(src.closers, zr)
+	src.Size, src.Exact = 0, false
+	if seekable && format.Size == nil {
+		src.SizeErr = fmt.Errorf("the size of %s images cannot be estimated", format.Name)
+	} else if seekable {
+		if src.Size, src.SizeErr = format.Size(ra, size); src.SizeErr != nil {
+			src.Size = 0
+		}
+		src.Exact = src.Size > 0 && format.ExactSize
+	}
+	return src, nil
+}
+
+// Close closes the decompressor and the image file.
+func (s *Source) Close() error {
+	var first error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,47 @@
+package flasher
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOpenImage verifica l'apertura di un'immagine raw e di una compressa.
+func TestOpenImage(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	raw := filepath.Join(dir, "image.img")
+	if err := os.WriteFile(raw, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	gz := filepath.Join(dir, "image.img.gz")
+	f, err := os.Create(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write(data)
+	w.Close()
+	f.Close()
+
+	for _, path := range []string{raw, gz} {
+		src, err := OpenImage(path, OpenOptions{})
+		if err != nil {
+			t.Fatalf("OpenImage(%s) ha restituito un errore: %v", path, err)
+		}
+		got, err := io.ReadAll(src)
+		src.Close()
+		if err != nil || len(got) != len(data) {
+			t.Errorf("%s: letti %d byte (err %v), attesi %d", path, len(got), err, len(data))
+		}
+		if src.Size != int64(len(data)) {
+			t.Errorf("%s: dimensione errata. Got: %d, Want: %d", path, src.Size, len(data))
+		}
+	}
+}
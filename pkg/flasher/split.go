@@ -0,0 +1,229 @@
+package flasher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// firstPart is the extension of the first part of a split image: the
+// parts are numbered from .001, as split -d and 7-Zip name them.
+const firstPart = ".001"
+
+// SplitPartName returns the name of the part n, from 1, of the split
+// image path.
+func SplitPartName(path string, n int) string {
+	return fmt.Sprintf("%s.%03d", path, n)
+}
+
+// splitBase returns the name of the whole image of location, the first
+// part of a split image, e.g. for the extension of its compression.
+func splitBase(location string) string {
+	if strings.EqualFold(location[max(len(location)-len(firstPart), 0):], firstPart) {
+		return location[:len(location)-len(firstPart)]
+	}
+	return location
+}
+
+// SplitWriter writes a stream to the parts of a split image, files of at
+// most PartSize bytes named path.001, path.002, ..., e.g. to fit on
+// FAT32 media. OpenImage reads them back as one image from path.001.
+type SplitWriter struct {
+	path     string
+	partSize int64
+	// overwrite replaces the existing parts, which are otherwise an
+	// error that wraps fs.ErrExist.
+	overwrite bool
+
+	file  *os.File
+	n     int64 // bytes in file
+	parts []string
+}
+
+// NewSplitWriter returns a SplitWriter creating the parts of path, of
+// partSize bytes but the last one. With overwrite, existing parts are
+// replaced, and those left over from a longer image removed on Close.
+func NewSplitWriter(path string, partSize int64, overwrite bool) *SplitWriter {
+	return &SplitWriter{path: path, partSize: partSize, overwrite: overwrite}
+}
+
+func (w *SplitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.file == nil || w.n == w.partSize {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p[:min(int64(len(p)), w.partSize-w.n)]
+		n, err := w.file.Write(chunk)
+		w.n += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// next closes the current part, synced, and creates the following one.
+func (w *SplitWriter) next() error {
+	if err := w.closePart(); err != nil {
+		return err
+	}
+	name := SplitPartName(w.path, len(w.parts)+1)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if w.overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file, w.n, w.parts = f, 0, append(w.parts, name)
+	return nil
+}
+
+func (w *SplitWriter) closePart() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Sync()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	if err != nil {
+		return fmt.Errorf("could not write %s: %w", w.parts[len(w.parts)-1], err)
+	}
+	return nil
+}
+
+// Close syncs and closes the last part. An empty stream still gets an
+// empty first part.
+func (w *SplitWriter) Close() error {
+	if len(w.parts) == 0 {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if err := w.closePart(); err != nil {
+		return err
+	}
+	// Le parti di un'immagine più lunga verrebbero lette come sue.
+	for n := len(w.parts) + 1; w.overwrite; n++ {
+		if err := os.Remove(SplitPartName(w.path, n)); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove closes and deletes the parts written so far, e.g. after a failed
+// backup.
+func (w *SplitWriter) Remove() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	for _, name := range w.parts {
+		os.Remove(name)
+	}
+}
+
+// Parts returns the names of the parts written so far.
+func (w *SplitWriter) Parts() []string {
+	return w.parts
+}
+
+// splitImage is the concatenation of the parts of a split image.
+type splitImage struct {
+	files   []*os.File
+	offsets []int64 // offset of each part in the image
+	size    int64
+	pos     int64
+}
+
+// openSplitImage opens the split image whose first part is location,
+// with all the parts that follow it.
+func openSplitImage(location string) (Image, error) {
+	base := splitBase(location)
+	img := &splitImage{}
+	for n := 1; ; n++ {
+		name := location
+		if n > 1 {
+			name = SplitPartName(base, n)
+		}
+		f, err := os.Open(name)
+		if n > 1 && errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err == nil {
+			var info fs.FileInfo
+			if info, err = f.Stat(); err == nil {
+				img.files, img.offsets = append(img.files, f), append(img.offsets, img.size)
+				img.size += info.Size()
+				continue
+			}
+			f.Close()
+		}
+		img.Close()
+		return nil, fmt.Errorf("could not open image file %s: %w", name, err)
+	}
+	return img, nil
+}
+
+func (s *splitImage) Size() int64 { return s.size }
+
+func (s *splitImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	read := 0
+	for i := len(s.offsets) - 1; len(p) > 0 && off < s.size; i = len(s.offsets) - 1 {
+		for s.offsets[i] > off {
+			i--
+		}
+		n, err := s.files[i].ReadAt(p, off-s.offsets[i])
+		read += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n == 0 && err == io.EOF {
+			// La parte si è accorciata dopo l'apertura.
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *splitImage) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *splitImage) Close() error {
+	var first error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
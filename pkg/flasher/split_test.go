@@ -0,0 +1,92 @@
+package flasher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSplitWriter verifica la scrittura delle parti e la loro rilettura
+// come un'unica immagine, anche compressa.
+func TestSplitWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.img.zst")
+	// Dati casuali, che la compressione non riduce: le parti sono più d'una.
+	data := make([]byte, 5000)
+	rand.NewChaCha8([32]byte{}).Read(data)
+	w := NewSplitWriter(path, 1000, false)
+	zw, err := NewCompressor("zstd", w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close ha restituito un errore: %v", err)
+	}
+	if len(w.Parts()) < 2 || w.Parts()[1] != path+".002" {
+		t.Fatalf("Parti errate. Got: %v", w.Parts())
+	}
+	if info, err := os.Stat(path + ".001"); err != nil || info.Size() != 1000 {
+		t.Errorf("La prima parte dovrebbe avere 1000 byte. Got: %v, %v", info, err)
+	}
+
+	src, err := OpenImage(path+".001", OpenOptions{})
+	if err != nil {
+		t.Fatalf("OpenImage ha restituito un errore: %v", err)
+	}
+	defer src.Close()
+	got, err := io.ReadAll(src)
+	if err != nil || src.Format != "zstd" || !bytes.Equal(got, data) {
+		t.Errorf("Immagine riletta errata: %d byte, formato %q, %v", len(got), src.Format, err)
+	}
+
+	if _, err := NewSplitWriter(path, 1000, false).Write([]byte("x")); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Le parti esistenti non dovrebbero essere sovrascritte. Got: %v", err)
+	}
+	// Un'immagine più corta sovrascritta elimina le parti in più.
+	w = NewSplitWriter(path, 1000, true)
+	w.Write([]byte("corta"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".002"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("La seconda parte dovrebbe essere eliminata. Got: %v", err)
+	}
+	w.Remove()
+	if _, err := os.Stat(path + ".001"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Remove dovrebbe eliminare le parti. Got: %v", err)
+	}
+}
+
+// TestSplitImageReadAt verifica le letture a cavallo di più parti.
+func TestSplitImageReadAt(t *testing.T) {
+	dir := t.TempDir()
+	for i, part := range []string{"0123", "", "4567", "89"} {
+		if err := os.WriteFile(SplitPartName(filepath.Join(dir, "disk.img"), i+1), []byte(part), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img, err := openSplitImage(filepath.Join(dir, "disk.img.001"))
+	if err != nil {
+		t.Fatalf("openSplitImage ha restituito un errore: %v", err)
+	}
+	defer img.Close()
+	ra := img.(io.ReaderAt)
+	buf := make([]byte, 5)
+	if n, err := ra.ReadAt(buf, 2); err != nil || string(buf[:n]) != "23456" {
+		t.Errorf("Lettura errata. Got: %q, %v", buf[:n], err)
+	}
+	if n, err := ra.ReadAt(buf, 7); err != io.EOF || string(buf[:n]) != "789" {
+		t.Errorf("Lettura finale errata. Got: %q, %v", buf[:n], err)
+	}
+	if img.Size() != 10 {
+		t.Errorf("Dimensione errata. Got: %d", img.Size())
+	}
+}
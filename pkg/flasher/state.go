@@ -0,0 +1,121 @@
+package flasher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultStateDir is where the CLI keeps its FileStore.
+const DefaultStateDir = "/var/lib/sflashy"
+
+// ErrNoState is returned by StateStore.Load when nothing is saved under
+// the key.
+var ErrNoState = errors.New("no saved state")
+
+// StateStore persists the small records that let interrupted operations
+// survive a restart: the checkpoints of Flasher.State, the pending jobs
+// of a JobManager and the devices being flashed in watch mode. Keys are
+// made of words separated by slashes, e.g. "flash//dev/sdb"; values are
+// encoded as JSON. Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Save stores v under key, replacing any previous value.
+	Save(key string, v any) error
+	// Load decodes the value stored under key into v, or returns
+	// ErrNoState.
+	Load(key string, v any) error
+	// Delete removes key; a missing key is not an error.
+	Delete(key string) error
+	// Keys returns the keys starting with prefix, sorted.
+	Keys(prefix string) ([]string, error)
+}
+
+// FileStore is a StateStore keeping each record in a JSON file of Dir.
+type FileStore struct {
+	Dir string
+}
+
+// NewFileStore returns a FileStore in dir, which is created on the first
+// Save.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{Dir: dir}
+}
+
+// path returns the file of key.
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.Dir, url.PathEscape(key)+".json")
+}
+
+// Save writes v to a temporary file and renames it over the record, so
+// that a crash never leaves a truncated record.
+func (s *FileStore) Save(key string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode state %s: %w", key, err)
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("could not create the state directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".state-*")
+	if err != nil {
+		return fmt.Errorf("could not save state %s: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not save state %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not save state %s: %w", key, err)
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileStore) Load(key string, v any) error {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNoState, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid state %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		key, err := url.PathUnescape(name)
+		if err == nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
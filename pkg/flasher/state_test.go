@@ -0,0 +1,114 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// TestFileStore verifica salvataggio, lettura, elenco e rimozione dei
+// record.
+func TestFileStore(t *testing.T) {
+	s := NewFileStore(t.TempDir())
+	var v map[string]int
+	if err := s.Load("flash//dev/sdb", &v); !errors.Is(err, ErrNoState) {
+		t.Errorf("Una chiave assente dovrebbe restituire ErrNoState. Got: %v", err)
+	}
+	for i, key := range []string{"flash//dev/sdb", "flash//dev/sda", "job/1"} {
+		if err := s.Save(key, map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Load("flash//dev/sdb", &v); err != nil || v["n"] != 0 {
+		t.Errorf("Record letto errato. Got: %v, %v", v, err)
+	}
+	keys, err := s.Keys("flash/")
+	if err != nil || fmt.Sprint(keys) != "[flash//dev/sda flash//dev/sdb]" {
+		t.Errorf("Chiavi errate. Got: %v, %v", keys, err)
+	}
+	if err := s.Delete("job/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("job/1"); err != nil {
+		t.Errorf("Rimuovere una chiave assente non è un errore. Got: %v", err)
+	}
+	if keys, _ := s.Keys(""); len(keys) != 2 {
+		t.Errorf("Il record rimosso è ancora elencato: %v", keys)
+	}
+}
+
+// cancellingReader annulla il contesto dopo limit byte letti.
+type cancellingReader struct {
+	r      io.Reader
+	limit  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.read >= r.limit {
+		r.cancel()
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+// TestResume verifica che un flash interrotto riprenda dal checkpoint.
+func TestResume(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuv")
+	dest := &memDest{data: make([]byte, len(data))}
+	RegisterDestination("resumetest", func(string) (Destination, error) { return dest, nil })
+	store := NewFileStore(t.TempDir())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Flasher{BlockSize: 4, State: store}
+	src := NewSource(&cancellingReader{r: bytes.NewReader(data), limit: 8, cancel: cancel}, int64(len(data)))
+	if _, err := f.Flash(ctx, src, "resumetest://dev"); err == nil {
+		t.Fatal("Il flash annullato dovrebbe restituire un errore")
+	}
+	var cp checkpoint
+	if err := store.Load(checkpointKey("resumetest://dev"), &cp); err != nil || cp.Written == 0 || cp.Written >= int64(len(data)) {
+		t.Fatalf("Checkpoint non salvato. Got: %+v, %v", cp, err)
+	}
+
+	// Il resto dell'immagine viene scritto a partire dal checkpoint.
+	clear(dest.data)
+	f = &Flasher{BlockSize: 4, State: store, Continue: true}
+	res, err := f.Flash(context.Background(), NewSource(bytes.NewReader(data), int64(len(data))), "resumetest://dev")
+	if err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if res.Bytes != int64(len(data)) || !bytes.Equal(dest.data[cp.Written:], data[cp.Written:]) {
+		t.Errorf("Ripresa errata. Got: %d byte, %q", res.Bytes, dest.data)
+	}
+	if bytes.ContainsAny(dest.data[:cp.Written], "0123456789") {
+		t.Errorf("I byte già scritti non dovrebbero essere riscritti: %q", dest.data[:cp.Written])
+	}
+	if err := store.Load(checkpointKey("resumetest://dev"), &cp); !errors.Is(err, ErrNoState) {
+		t.Errorf("Il checkpoint dovrebbe essere rimosso a flash completato. Got: %v", err)
+	}
+
+	// Un'immagine diversa non si può riprendere da uno stream.
+	store.Save(checkpointKey("resumetest://dev"), checkpoint{Device: "resumetest://dev", Size: dest.Size(), Written: 8, Digest: "00"})
+	other := NewSource(io.MultiReader(bytes.NewReader(data)), int64(len(data)))
+	if _, err := f.Flash(context.Background(), other, "resumetest://dev"); err == nil {
+		t.Error("Riprendere un'immagine diversa da uno stream dovrebbe essere un errore")
+	}
+
+	// Un altro dispositivo allo stesso percorso viene scritto da capo.
+	for _, cp := range []checkpoint{
+		{Device: "resumetest://dev", Size: 2 * dest.Size(), Written: 8, Digest: "00"},
+		{Device: "resumetest://dev", Serial: "ALTRA", Size: dest.Size(), Written: 8, Digest: "00"},
+	} {
+		clear(dest.data)
+		store.Save(checkpointKey("resumetest://dev"), cp)
+		other := NewSource(io.MultiReader(bytes.NewReader(data)), int64(len(data)))
+		if _, err := f.Flash(context.Background(), other, "resumetest://dev"); err != nil || !bytes.Equal(dest.data, data) {
+			t.Errorf("Un dispositivo diverso va scritto da capo. Got: %q, %v", dest.data, err)
+		}
+	}
+}
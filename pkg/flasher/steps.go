@@ -0,0 +1,202 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Step customizes a device once the image is written, e.g. expanding a
+// partition or adding files. Steps are composed into recipes through
+// Flasher.Steps or Disk.Apply.
+type Step interface {
+	// Name describes the step in the output and in errors.
+	Name() string
+	// Apply changes disk; ctx is the context of the flash.
+	Apply(ctx context.Context, disk *Disk) error
+}
+
+// StepFunc returns a Step named name that calls apply.
+func StepFunc(name string, apply func(ctx context.Context, disk *Disk) error) Step {
+	return funcStep{name, apply}
+}
+
+type funcStep struct {
+	name  string
+	apply func(context.Context, *Disk) error
+}
+
+func (s funcStep) Name() string                                { return s.name }
+func (s funcStep) Apply(ctx context.Context, disk *Disk) error { return s.apply(ctx, disk) }
+
+// Apply runs steps in order on d, stopping at the first error, which
+// wraps ErrStepFailed.
+func (d *Disk) Apply(ctx context.Context, steps ...Step) error {
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("customization interrupted before %s: %w", step.Name(), context.Cause(ctx))
+		}
+		if err := step.Apply(ctx, d); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrStepFailed, step.Name(), err)
+		}
+	}
+	return nil
+}
+
+// runSteps applies f.Steps to dest and syncs it.
+func (f *Flasher) runSteps(ctx context.Context, dest Destination, device string) error {
+	out, log := f.output(), f.logger()
+	d, err := NewDisk(device, dest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStepFailed, err)
+	}
+	for _, step := range f.Steps {
+		fmt.Fprintf(out, "Customizing: %s...\n", step.Name())
+		log.Info("running customization step", "step", step.Name())
+		if err := d.Apply(ctx, step); err != nil {
+			return err
+		}
+	}
+	if err := dest.Sync(); err != nil {
+		return checkRemoved(device, fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+	}
+	return nil
+}
+
+// ExpandPartition grows a partition, the last one if Number is 0, up to
+// the end of the device, so that an image written to a larger card can
+// use all of it. Only the partition table changes: the filesystem keeps
+// its size until it is grown.
+type ExpandPartition struct {
+	Number int
+}
+
+func (s ExpandPartition) Name() string {
+	if s.Number == 0 {
+		return "expand the last partition"
+	}
+	return fmt.Sprintf("expand partition %d", s.Number)
+}
+
+func (s ExpandPartition) Apply(_ context.Context, disk *Disk) error {
+	p, err := disk.Partition(s.Number)
+	if err != nil {
+		return err
+	}
+	return disk.ResizePartition(p.Number, disk.LastUsableByte()-p.Start)
+}
+
+// WriteFiles writes Files, keyed by absolute path, to the filesystem of
+// partition Partition (the first one if 0), e.g. config files to the boot
+// partition.
+type WriteFiles struct {
+	Partition int
+	Files     map[string][]byte
+}
+
+func (s WriteFiles) Name() string {
+	return fmt.Sprintf("write %d files", len(s.Files))
+}
+
+func (s WriteFiles) Apply(ctx context.Context, disk *Disk) error {
+	number := s.Partition
+	if number == 0 {
+		parts, err := disk.Partitions()
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 {
+			return fmt.Errorf("%s has no partitions", disk.Device)
+		}
+		number = parts[0].Number
+	}
+	fsys, err := disk.Filesystem(number)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		if err := fsys.WriteFile(name, s.Files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostnamePattern matches a valid hostname label (RFC 1123).
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// SetHostname sets the hostname of the system on the device: it writes
+// /etc/hostname of the root filesystem and renames the old hostname in
+// /etc/hosts.
+type SetHostname struct {
+	Hostname string
+}
+
+func (s SetHostname) Name() string { return "set the hostname to " + s.Hostname }
+
+// Validate checks the hostname, which Apply does before writing anything.
+func (s SetHostname) Validate() error {
+	if !hostnamePattern.MatchString(s.Hostname) {
+		return fmt.Errorf("invalid hostname %q", s.Hostname)
+	}
+	return nil
+}
+
+func (s SetHostname) Apply(_ context.Context, disk *Disk) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	_, fsys, err := disk.FindFile("/etc/hostname")
+	if err != nil {
+		return err
+	}
+	old, err := fsys.ReadFile("/etc/hostname")
+	if err != nil {
+		return err
+	}
+	if err := fsys.WriteFile("/etc/hostname", []byte(s.Hostname+"\n")); err != nil {
+		return err
+	}
+	hosts, err := fsys.ReadFile("/etc/hosts")
+	if err != nil {
+		return nil // Senza /etc/hosts basta il nome.
+	}
+	oldName := strings.TrimSpace(string(old))
+	if oldName == "" || oldName == s.Hostname {
+		return nil
+	}
+	return fsys.WriteFile("/etc/hosts", []byte(replaceHostname(string(hosts), oldName, s.Hostname)))
+}
+
+// replaceHostname replaces the whole-word occurrences of old in the host
+// names of an /etc/hosts file.
+func replaceHostname(hosts, old, name string) string {
+	lines := strings.SplitAfter(hosts, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || !slices.Contains(fields[1:], old) {
+			continue
+		}
+		for j := 1; j < len(fields); j++ {
+			if fields[j] == old {
+				fields[j] = name
+			}
+		}
+		eol := ""
+		if strings.HasSuffix(line, "\n") {
+			eol = "\n"
+		}
+		lines[i] = fields[0] + "\t" + strings.Join(fields[1:], " ") + eol
+	}
+	return strings.Join(lines, "")
+}
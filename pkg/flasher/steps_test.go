@@ -0,0 +1,212 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+const mib = 1 << 20
+
+// newTestImage crea un'immagine con una partizione di boot FAT32 e una
+// root ext4 con /etc/hostname, /etc/hosts e /etc/fstab.
+func newTestImage(t *testing.T) []byte {
+	t.Helper()
+	return newTestImageFiles(t, nil)
+}
+
+// newTestImageFiles crea un'immagine come newTestImage, con in più i file
+// della root indicati in files.
+func newTestImageFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	dest := &memDest{data: make([]byte, 96*mib)}
+	d, err := NewDisk("image", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &mbr.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, Partitions: []*mbr.Partition{
+		{Type: mbr.Fat32LBA, Start: 2048, Size: 40 * mib / 512},
+		{Type: mbr.Linux, Start: 2048 + 40*mib/512, Size: 48 * mib / 512},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "bootfs"}); err != nil {
+		t.Fatal(err)
+	}
+	// go-diskfs non sa creare filesystem ext4 affidabili: si usa mke2fs.
+	mke2fs, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs non disponibile")
+	}
+	dir := t.TempDir()
+	etc := filepath.Join(dir, "root", "etc")
+	if err := os.MkdirAll(etc, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(etc, "hostname"), []byte("raspberrypi\n"), 0o644)
+	os.WriteFile(filepath.Join(etc, "hosts"), []byte("127.0.0.1\tlocalhost\n127.0.1.1\traspberrypi\n"), 0o644)
+	os.WriteFile(filepath.Join(etc, "fstab"), []byte("proc /proc proc defaults 0 0\nPARTUUID=1234-01 /boot/firmware vfat defaults 0 2\nPARTUUID=1234-02 / ext4 defaults,noatime 0 1\n"), 0o644)
+	for name, content := range files {
+		p := filepath.Join(dir, "root", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(p, []byte(content), 0o644)
+	}
+	rootfs := filepath.Join(dir, "rootfs.img")
+	if out, err := exec.Command(mke2fs, "-q", "-t", "ext4", "-b", "4096", "-L", "rootfs", "-d", filepath.Join(dir, "root"), rootfs, "48M").CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs: %v: %s", err, out)
+	}
+	data, err := os.ReadFile(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(dest.data[(2048+40*mib/512)*512:], data)
+	return dest.data
+}
+
+// TestSteps verifica i passi di personalizzazione eseguiti da Flash.
+func TestSteps(t *testing.T) {
+	image := newTestImage(t)
+	dest := &memDest{data: make([]byte, 128*mib)}
+	RegisterDestination("steptest", func(string) (Destination, error) { return dest, nil })
+	var order []string
+	f := &Flasher{Verify: true, Steps: []Step{
+		ExpandPartition{},
+		WriteFiles{Files: map[string][]byte{"/ssh": nil, "/config/userconf.txt": []byte("pi:hash\n")}},
+		SetHostname{Hostname: "kiosk-01"},
+		StepFunc("record", func(context.Context, *Disk) error { order = append(order, "step"); return nil }),
+	}, Hooks: Hooks{PostVerify: []Hook{func(context.Context, HookInfo) error { order = append(order, "hook"); return nil }}}}
+	res, err := f.Flash(context.Background(), NewSource(bytes.NewReader(image), int64(len(image))), "steptest://dev")
+	if err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+	if res.Verification != "passed" || strings.Join(order, ",") != "step,hook" {
+		t.Errorf("I passi vanno eseguiti dopo la verifica e prima degli hook. Got: %s, %v", res.Verification, order)
+	}
+
+	d, err := NewDisk("steptest://dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := d.Partition(0)
+	if err != nil || last.Number != 2 || last.Start+last.Size != int64(len(dest.data)) {
+		t.Errorf("L'ultima partizione dovrebbe arrivare in fondo al dispositivo. Got: %+v, %v", last, err)
+	}
+	p, boot, err := d.BootPartition()
+	if err != nil || p.Number != 1 {
+		t.Fatalf("La partizione di boot è la prima, FAT32. Got: %+v, %v", p, err)
+	}
+	if got, err := boot.ReadFile("/config/userconf.txt"); err != nil || string(got) != "pi:hash\n" {
+		t.Errorf("File scritto errato. Got: %q, %v", got, err)
+	}
+	root, err := d.Filesystem(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := root.ReadFile("/etc/hostname"); string(got) != "kiosk-01\n" {
+		t.Errorf("Hostname errato. Got: %q", got)
+	}
+	if got, _ := root.ReadFile("/etc/hosts"); !strings.Contains(string(got), "127.0.1.1\tkiosk-01") || strings.Contains(string(got), "raspberrypi") {
+		t.Errorf("/etc/hosts errato. Got: %q", got)
+	}
+
+	f = &Flasher{Steps: []Step{SetHostname{Hostname: "non valido"}}}
+	if _, err := f.Flash(context.Background(), NewSource(bytes.NewReader(image), int64(len(image))), "steptest://dev"); !errors.Is(err, ErrStepFailed) {
+		t.Errorf("Un passo fallito dovrebbe restituire ErrStepFailed. Got: %v", err)
+	}
+}
+
+// TestExpandPartitionGPT verifica che l'ultima partizione GPT arrivi fino
+// alla tabella di backup, spostata in fondo al dispositivo più grande.
+func TestExpandPartitionGPT(t *testing.T) {
+	image := &memDest{data: make([]byte, 8*mib)}
+	d, err := NewDisk("image", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.EFISystemPartition, Start: 2048, End: 4095, Name: "boot"},
+		{Type: gpt.LinuxFilesystem, Start: 4096, End: 8191, Name: "root"},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &memDest{data: make([]byte, 32*mib)}
+	copy(dest.data, image.data)
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(context.Background(), ExpandPartition{}); err != nil {
+		t.Fatalf("ExpandPartition ha restituito un errore: %v", err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := d.Partition(0)
+	// 33 settori di tabella di backup in fondo al dispositivo.
+	if want := int64(len(dest.data)) - 33*512; err != nil || last.Number != 2 || last.Start+last.Size != want {
+		t.Errorf("L'ultima partizione dovrebbe finire a %d. Got: %+v, %v", int64(len(dest.data))-33*512, last, err)
+	}
+	if _, ok := d.d.Table.(*gpt.Table); !ok {
+		t.Errorf("La tabella dovrebbe essere ancora GPT. Got: %T", d.d.Table)
+	}
+}
+
+// TestPartitionNumbersGPT verifica che una voce GPT vuota non cambi il
+// numero delle partizioni che la seguono, né quando si riscrive la
+// tabella.
+func TestPartitionNumbersGPT(t *testing.T) {
+	image := &memDest{data: make([]byte, 8*mib)}
+	d, err := NewDisk("image", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Type: gpt.EFISystemPartition, Start: 2048, End: 4095, Name: "boot"},
+		{Type: gpt.Unused},
+		{Type: gpt.LinuxFilesystem, Start: 4096, End: 8191, Name: "root"},
+	}}
+	if err := d.d.Partition(table); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &memDest{data: make([]byte, 32*mib)}
+	copy(dest.data, image.data)
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := d.Partitions()
+	if err != nil || len(parts) != 2 || parts[0].Number != 1 || parts[1].Number != 3 || parts[1].Name != "root" {
+		t.Fatalf("Numeri delle partizioni errati. Got: %+v, %v", parts, err)
+	}
+	if err := d.Apply(context.Background(), ExpandPartition{Number: 3}); err != nil {
+		t.Fatal(err)
+	}
+	d, err = NewDisk("dev", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := d.Partition(3)
+	if want := int64(len(dest.data)) - 33*512; err != nil || root.Name != "root" || root.Start+root.Size != want {
+		t.Errorf("La partizione 3 va ingrandita restando la 3. Got: %+v, %v", root, err)
+	}
+	if _, err := d.Partition(2); err == nil {
+		t.Error("La voce 2 dovrebbe restare vuota")
+	}
+}
@@ -0,0 +1,63 @@
+package flasher
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer records the stages of a flash as spans, e.g. to export them with
+// OpenTelemetry. Flash starts a "flash" span with the children "write",
+// "sync", "verify" and "customize".
+type Tracer interface {
+	// Start starts a span named name, child of the span in ctx if any, and
+	// returns the context carrying it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a stage of a flash started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute of the span: value is a string,
+	// an int64, a float64 or a bool.
+	SetAttribute(key string, value any)
+	// End ends the span, failed if err is not nil.
+	End(err error)
+}
+
+// The attributes set on the spans of Flash.
+const (
+	AttrDevice      = "sflashy.device"
+	AttrImageFormat = "sflashy.image.format"
+	AttrImageSize   = "sflashy.image.size"
+	AttrBytes       = "sflashy.bytes"
+	// AttrThroughput is in bytes per second.
+	AttrThroughput = "sflashy.throughput"
+	// AttrReadSeconds is the time spent waiting for the image, i.e.
+	// downloading and decompressing it; AttrWriteSeconds the time spent
+	// writing to the device.
+	AttrReadSeconds  = "sflashy.read.seconds"
+	AttrWriteSeconds = "sflashy.write.seconds"
+)
+
+// nopSpan is the Span of a Flasher without Tracer.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) End(error)                {}
+
+// startSpan starts a span with f.Tracer, if set.
+func (f *Flasher) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if f.Tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return f.Tracer.Start(ctx, name)
+}
+
+// endTransfer sets the byte count and the throughput of a span that moved
+// n bytes since start, and ends it.
+func endTransfer(span Span, n int64, start time.Time, err error) {
+	span.SetAttribute(AttrBytes, n)
+	if d := time.Since(start).Seconds(); d > 0 {
+		span.SetAttribute(AttrThroughput, float64(n)/d)
+	}
+	span.End(err)
+}
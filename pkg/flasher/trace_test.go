@@ -0,0 +1,69 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// recordedSpan è uno span registrato da recordingTracer.
+type recordedSpan struct {
+	name, parent string
+	attrs        map[string]any
+	ended        bool
+	err          error
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+func (s *recordedSpan) End(err error)                      { s.ended, s.err = true, err }
+
+type spanKey struct{}
+
+// recordingTracer registra gli span in memoria.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{name: name, attrs: map[string]any{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// TestTracer verifica gli span di Flash e i loro attributi.
+func TestTracer(t *testing.T) {
+	data := bytes.Repeat([]byte("traccia "), 64)
+	dest := &memDest{data: make([]byte, len(data))}
+	RegisterDestination("tracetest", func(string) (Destination, error) { return dest, nil })
+	tracer := &recordingTracer{}
+	f := &Flasher{BlockSize: 64, Verify: true, Tracer: tracer}
+	if _, err := f.Flash(context.Background(), NewSource(bytes.NewReader(data), int64(len(data))), "tracetest://dev"); err != nil {
+		t.Fatalf("Flash ha restituito un errore: %v", err)
+	}
+
+	var got []string
+	for _, s := range tracer.spans {
+		got = append(got, s.parent+">"+s.name)
+		if !s.ended || s.err != nil {
+			t.Errorf("Lo span %s non è terminato correttamente: %v", s.name, s.err)
+		}
+	}
+	if want := "[>flash flash>write flash>sync flash>verify]"; fmt.Sprint(got) != want {
+		t.Errorf("Span errati. Got: %v, Want: %s", got, want)
+	}
+	write := tracer.spans[1]
+	if write.attrs[AttrBytes] != int64(len(data)) || write.attrs[AttrThroughput] == nil || write.attrs[AttrReadSeconds] == nil {
+		t.Errorf("Attributi della scrittura errati: %v", write.attrs)
+	}
+	if flash := tracer.spans[0]; flash.attrs[AttrDevice] != "tracetest://dev" || flash.attrs[AttrBytes] != int64(len(data)) {
+		t.Errorf("Attributi del flash errati: %v", flash.attrs)
+	}
+}
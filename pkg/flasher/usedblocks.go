@@ -0,0 +1,419 @@
+package flasher
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Extent is a range of bytes of a device or of a filesystem.
+type Extent struct {
+	Start, Size int64
+}
+
+// ErrUnknownFilesystem is returned by UsedExtents for the filesystems whose
+// allocation it cannot read.
+var ErrUnknownFilesystem = errors.New("unknown filesystem")
+
+// UsedExtents returns the ranges of the size bytes of r, a filesystem,
+// that hold data: the metadata and the allocated blocks of ext2/3/4, FAT
+// and NTFS, read from their block bitmaps or allocation table, sorted and
+// merged. Other filesystems return ErrUnknownFilesystem.
+func UsedExtents(r io.ReaderAt, size int64) ([]Extent, error) {
+	boot := make([]byte, 512)
+	if _, err := r.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	var used []Extent
+	var err error
+	switch {
+	case string(boot[3:11]) == "NTFS    ":
+		used, err = ntfsUsed(r, boot, size)
+	case isFAT(boot):
+		used, err = fatUsed(r, boot, size)
+	default:
+		sb := make([]byte, 1024)
+		if _, err := r.ReadAt(sb, 1024); err != nil || binary.LittleEndian.Uint16(sb[56:]) != 0xef53 {
+			return nil, ErrUnknownFilesystem
+		}
+		used, err = extUsed(r, sb, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mergeExtents(used, size), nil
+}
+
+// mergeExtents sorts extents, merges the ones that touch or overlap and
+// cuts them at size.
+func mergeExtents(extents []Extent, size int64) []Extent {
+	slices.SortFunc(extents, func(a, b Extent) int { return cmp.Compare(a.Start, b.Start) })
+	var merged []Extent
+	for _, e := range extents {
+		e.Size = min(e.Start+e.Size, size) - e.Start
+		if e.Size <= 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && e.Start <= merged[n-1].Start+merged[n-1].Size {
+			last := &merged[n-1]
+			last.Size = max(last.Size, e.Start+e.Size-last.Start)
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
+
+// bitmapExtents appends to extents the units of bitmap, unit bytes each
+// from base, whose bit is set; only the first n bits count.
+func bitmapExtents(extents []Extent, bitmap []byte, n, unit, base int64) []Extent {
+	start := int64(-1)
+	for i := int64(0); i <= n; i++ {
+		set := i < n && i/8 < int64(len(bitmap)) && bitmap[i/8]&(1<<(i%8)) != 0
+		switch {
+		case set && start < 0:
+			start = i
+		case !set && start >= 0:
+			extents = append(extents, Extent{base + start*unit, (i - start) * unit})
+			start = -1
+		}
+		// I byte vuoti si saltano interi.
+		if start < 0 && i%8 == 0 && i+8 < n && i/8 < int64(len(bitmap)) && bitmap[i/8] == 0 {
+			i += 7
+		}
+	}
+	return extents
+}
+
+// extUsed reads the block bitmaps of an ext2/3/4 filesystem, whose
+// superblock is sb.
+func extUsed(r io.ReaderAt, sb []byte, size int64) ([]Extent, error) {
+	le := binary.LittleEndian
+	incompat, roCompat := le.Uint32(sb[96:]), le.Uint32(sb[100:])
+	if incompat&0x10 != 0 {
+		return nil, fmt.Errorf("%w: ext4 with meta_bg", ErrUnknownFilesystem)
+	}
+	blockSize := int64(1024) << le.Uint32(sb[24:])
+	blocks := int64(le.Uint32(sb[4:]))
+	descSize := int64(32)
+	if incompat&0x80 != 0 { // 64bit
+		blocks |= int64(le.Uint32(sb[336:])) << 32
+		descSize = max(int64(le.Uint16(sb[254:])), 32)
+	}
+	firstData, perGroup := int64(le.Uint32(sb[20:])), int64(le.Uint32(sb[32:]))
+	inodeSize := int64(128)
+	if le.Uint32(sb[76:]) >= 1 {
+		inodeSize = int64(le.Uint16(sb[88:]))
+	}
+	if perGroup == 0 || perGroup > 8*blockSize || blockSize > 64*1024 || blocks*blockSize > size {
+		return nil, fmt.Errorf("%w: invalid ext superblock", ErrUnknownFilesystem)
+	}
+	groups := (blocks - firstData + perGroup - 1) / perGroup
+	gdt := make([]byte, groups*descSize)
+	if _, err := r.ReadAt(gdt, (firstData+1)*blockSize); err != nil {
+		return nil, fmt.Errorf("could not read the ext group descriptors: %w", err)
+	}
+	gdtBlocks := (groups*descSize + blockSize - 1) / blockSize
+	reservedGDT := int64(le.Uint16(sb[206:]))
+	tableBlocks := (int64(le.Uint32(sb[40:]))*inodeSize + blockSize - 1) / blockSize
+
+	// Con blocchi da 1K il blocco 0 contiene il settore di avvio.
+	used := []Extent{{0, (firstData + 1) * blockSize}}
+	bitmap := make([]byte, blockSize)
+	for g := int64(0); g < groups; g++ {
+		desc := gdt[g*descSize:]
+		addr := func(lo, hi int) int64 {
+			a := int64(le.Uint32(desc[lo:]))
+			if descSize >= 64 {
+				a |= int64(le.Uint32(desc[hi:])) << 32
+			}
+			return a
+		}
+		blockBitmap, inodeBitmap, inodeTable := addr(0, 0x20), addr(4, 0x24), addr(8, 0x28)
+		first := firstData + g*perGroup
+		count := min(perGroup, blocks-first)
+		// BLOCK_UNINIT vale solo con i checksum dei descrittori.
+		if roCompat&0x410 == 0 || le.Uint16(desc[18:])&0x2 == 0 {
+			if _, err := r.ReadAt(bitmap, blockBitmap*blockSize); err != nil {
+				return nil, fmt.Errorf("could not read the block bitmap of group %d: %w", g, err)
+			}
+			used = bitmapExtents(used, bitmap, count, blockSize, first*blockSize)
+			continue
+		}
+		// Un gruppo mai usato ha solo i metadati, come li segna il kernel
+		// quando ne inizializza la bitmap.
+		if extHasSuper(g, roCompat&0x1 != 0) {
+			used = append(used, Extent{first * blockSize, (1 + gdtBlocks + reservedGDT) * blockSize})
+		}
+		for _, m := range []Extent{{blockBitmap, 1}, {inodeBitmap, 1}, {inodeTable, tableBlocks}} {
+			if m.Start >= first && m.Start < first+count {
+				used = append(used, Extent{m.Start * blockSize, m.Size * blockSize})
+			}
+		}
+	}
+	return used, nil
+}
+
+// extHasSuper reports whether the block group g has a copy of the
+// superblock: every group, or with sparse_super only 0, 1 and the powers
+// of 3, 5 and 7.
+func extHasSuper(g int64, sparse bool) bool {
+	if !sparse || g <= 1 {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
+
+// isFAT reports whether boot is the boot sector of a FAT12/16/32
+// filesystem.
+func isFAT(boot []byte) bool {
+	le := binary.LittleEndian
+	bps, spc := le.Uint16(boot[11:]), boot[13]
+	return boot[510] == 0x55 && boot[511] == 0xaa && string(boot[3:11]) != "EXFAT   " &&
+		bps >= 512 && bps <= 4096 && bps&(bps-1) == 0 && spc != 0 && spc&(spc-1) == 0 &&
+		boot[16] != 0 && le.Uint16(boot[14:]) != 0 && (le.Uint16(boot[22:]) != 0 || le.Uint32(boot[36:]) != 0)
+}
+
+// fatUsed reads the first allocation table of a FAT filesystem, whose boot
+// sector is boot.
+func fatUsed(r io.ReaderAt, boot []byte, size int64) ([]Extent, error) {
+	le := binary.LittleEndian
+	bps, spc := int64(le.Uint16(boot[11:])), int64(boot[13])
+	reserved, fats := int64(le.Uint16(boot[14:])), int64(boot[16])
+	rootSectors := (int64(le.Uint16(boot[17:]))*32 + bps - 1) / bps
+	total := int64(le.Uint16(boot[19:]))
+	if total == 0 {
+		total = int64(le.Uint32(boot[32:]))
+	}
+	fatSize := int64(le.Uint16(boot[22:]))
+	fat32 := fatSize == 0
+	if fat32 {
+		fatSize = int64(le.Uint32(boot[36:]))
+	}
+	dataStart := reserved + fats*fatSize + rootSectors
+	if total*bps > size || dataStart >= total {
+		return nil, fmt.Errorf("%w: invalid FAT boot sector", ErrUnknownFilesystem)
+	}
+	clusters := (total - dataStart) / spc
+	fat := make([]byte, fatSize*bps)
+	if _, err := r.ReadAt(fat, reserved*bps); err != nil {
+		return nil, fmt.Errorf("could not read the FAT: %w", err)
+	}
+
+	// Come Linux, FAT32 se manca la dimensione a 16 bit della FAT.
+	entry := func(c int64) uint32 {
+		switch {
+		case fat32:
+			return le.Uint32(fat[4*c:]) & 0x0fffffff
+		case clusters < 4085:
+			v := uint32(le.Uint16(fat[c+c/2:]))
+			if c%2 == 1 {
+				return v >> 4
+			}
+			return v & 0xfff
+		}
+		return uint32(le.Uint16(fat[2*c:]))
+	}
+	// Byte della FAT occupati fino alla voce c compresa.
+	fits := func(c int64) bool {
+		switch {
+		case fat32:
+			return 4*c+4 <= int64(len(fat))
+		case clusters < 4085:
+			return c+c/2+2 <= int64(len(fat))
+		}
+		return 2*c+2 <= int64(len(fat))
+	}
+	used := []Extent{{0, dataStart * bps}}
+	for c := int64(2); c < clusters+2 && fits(c); c++ {
+		if entry(c) != 0 {
+			used = append(used, Extent{(dataStart + (c-2)*spc) * bps, spc * bps})
+		}
+	}
+	return used, nil
+}
+
+// ntfsUsed reads the $Bitmap of an NTFS filesystem, whose boot sector is
+// boot.
+func ntfsUsed(r io.ReaderAt, boot []byte, size int64) ([]Extent, error) {
+	le := binary.LittleEndian
+	bps := int64(le.Uint16(boot[11:]))
+	spc := int64(boot[13])
+	if spc > 128 {
+		spc = 1 << (256 - spc)
+	}
+	clusterSize := bps * spc
+	recordSize := int64(int8(boot[64]))
+	if recordSize > 0 {
+		recordSize *= clusterSize
+	} else {
+		recordSize = 1 << -recordSize
+	}
+	sectors := int64(le.Uint64(boot[40:]))
+	if clusterSize == 0 || recordSize < 512 || recordSize > 64*1024 || sectors*bps > size {
+		return nil, fmt.Errorf("%w: invalid NTFS boot sector", ErrUnknownFilesystem)
+	}
+	clusters := sectors / spc
+
+	// $Bitmap è il record 6 della MFT, i cui primi record sono contigui.
+	rec := make([]byte, recordSize)
+	if _, err := r.ReadAt(rec, int64(le.Uint64(boot[48:]))*clusterSize+6*recordSize); err != nil {
+		return nil, fmt.Errorf("could not read the NTFS $Bitmap record: %w", err)
+	}
+	if err := ntfsFixup(rec); err != nil {
+		return nil, err
+	}
+	runs, length, err := ntfsDataRuns(rec)
+	if err != nil {
+		return nil, err
+	}
+	bitmap := make([]byte, 0, length)
+	for _, run := range runs {
+		chunk := make([]byte, run.Size*clusterSize)
+		if _, err := r.ReadAt(chunk, run.Start*clusterSize); err != nil {
+			return nil, fmt.Errorf("could not read the NTFS $Bitmap: %w", err)
+		}
+		bitmap = append(bitmap, chunk...)
+	}
+	bitmap = bitmap[:min(int64(len(bitmap)), length)]
+	// La copia del settore di avvio segue l'ultimo cluster.
+	used := []Extent{{clusters * clusterSize, size - clusters*clusterSize}}
+	return bitmapExtents(used, bitmap, clusters, clusterSize, 0), nil
+}
+
+// ntfsFixup restores the last two bytes of each 512-byte stride of an MFT
+// record, which hold its update sequence number on disk.
+func ntfsFixup(rec []byte) error {
+	le := binary.LittleEndian
+	if string(rec[:4]) != "FILE" {
+		return fmt.Errorf("%w: invalid NTFS MFT record", ErrUnknownFilesystem)
+	}
+	off, count := int(le.Uint16(rec[4:])), int(le.Uint16(rec[6:]))
+	if off+2*count > len(rec) || (count-1)*512 > len(rec) {
+		return fmt.Errorf("%w: invalid NTFS update sequence", ErrUnknownFilesystem)
+	}
+	for i := 1; i < count; i++ {
+		pos := i*512 - 2
+		if rec[pos] != rec[off] || rec[pos+1] != rec[off+1] {
+			return fmt.Errorf("%w: torn NTFS MFT record", ErrUnknownFilesystem)
+		}
+		copy(rec[pos:pos+2], rec[off+2*i:])
+	}
+	return nil
+}
+
+// ntfsDataRuns returns the runs, in clusters, and the length in bytes of
+// the unnamed non-resident $DATA attribute of rec.
+func ntfsDataRuns(rec []byte) ([]Extent, int64, error) {
+	le := binary.LittleEndian
+	invalid := fmt.Errorf("%w: no $DATA in the NTFS $Bitmap record", ErrUnknownFilesystem)
+	for a := int(le.Uint16(rec[20:])); a+16 <= len(rec); {
+		typ, alen := le.Uint32(rec[a:]), int(le.Uint32(rec[a+4:]))
+		if typ == 0xffffffff || alen < 16 || a+alen > len(rec) {
+			break
+		}
+		if typ != 0x80 || rec[a+8] != 1 || rec[a+9] != 0 || alen < 64 {
+			a += alen
+			continue
+		}
+		var runs []Extent
+		lcn := int64(0)
+		for p := a + int(le.Uint16(rec[a+32:])); p < a+alen && rec[p] != 0; {
+			lenSize, offSize := int(rec[p]&0xf), int(rec[p]>>4)
+			if p+1+lenSize+offSize > a+alen || lenSize == 0 || lenSize > 8 || offSize > 8 {
+				return nil, 0, invalid
+			}
+			var length, delta int64
+			for i := lenSize - 1; i >= 0; i-- {
+				length = length<<8 | int64(rec[p+1+i])
+			}
+			for i := offSize - 1; i >= 0; i-- {
+				delta = delta<<8 | int64(rec[p+1+lenSize+i])
+			}
+			if offSize > 0 && offSize < 8 && rec[p+lenSize+offSize]&0x80 != 0 {
+				delta -= 1 << (8 * offSize) // offset negativo
+			}
+			p += 1 + lenSize + offSize
+			if offSize == 0 {
+				continue // run sparso: $Bitmap non ne ha
+			}
+			lcn += delta
+			runs = append(runs, Extent{lcn, length})
+		}
+		return runs, int64(le.Uint64(rec[a+48:])), nil
+	}
+	return nil, 0, invalid
+}
+
+// usedReader reads a device where only extents hold data, returning zeros
+// for the rest without reading it.
+type usedReader struct {
+	r       io.ReaderAt
+	extents []Extent
+}
+
+func (u usedReader) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	end := off + int64(len(p))
+	i, _ := slices.BinarySearchFunc(u.extents, off, func(e Extent, off int64) int {
+		if e.Start+e.Size <= off {
+			return -1
+		}
+		return 1
+	})
+	for ; i < len(u.extents) && u.extents[i].Start < end; i++ {
+		e := u.extents[i]
+		from, to := max(e.Start, off), min(e.Start+e.Size, end)
+		if n, err := u.r.ReadAt(p[from-off:to-off], from); err != nil && !(err == io.EOF && int64(n) == to-from) {
+			return int(from - off), err
+		}
+	}
+	return len(p), nil
+}
+
+// deviceUsedExtents returns the ranges of dest to read to back it up: the
+// used blocks of the filesystems UsedExtents knows, and everything else,
+// i.e. the partition table, the gaps and the other partitions.
+func deviceUsedExtents(location string, dest Destination) ([]Extent, error) {
+	size := dest.Size()
+	disk, err := NewDisk(location, dest)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := disk.Partitions()
+	if err != nil {
+		// Un filesystem sull'intero dispositivo, o altro.
+		parts = []Partition{{Start: 0, Size: size}}
+	}
+	slices.SortFunc(parts, func(a, b Partition) int { return cmp.Compare(a.Start, b.Start) })
+	var used []Extent
+	next := int64(0)
+	for _, p := range parts {
+		if p.Start < next || p.Start+p.Size > size {
+			return nil, fmt.Errorf("%s: partition %d overlaps another one or the end of the device", location, p.Number)
+		}
+		used = append(used, Extent{next, p.Start - next})
+		extents, err := UsedExtents(io.NewSectionReader(dest, p.Start, p.Size), p.Size)
+		if err != nil {
+			extents = []Extent{{0, p.Size}}
+		}
+		for _, e := range extents {
+			used = append(used, Extent{p.Start + e.Start, e.Size})
+		}
+		next = p.Start + p.Size
+	}
+	used = append(used, Extent{next, size - next})
+	return mergeExtents(used, size), nil
+}
@@ -0,0 +1,125 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// TestBitmapExtents verifica la conversione di una bitmap in intervalli.
+func TestBitmapExtents(t *testing.T) {
+	bitmap := []byte{0b00001110, 0x00, 0x00, 0b10000000, 0xff}
+	got := bitmapExtents(nil, bitmap, 38, 10, 1000)
+	want := []Extent{{1010, 30}, {1310, 70}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Intervalli errati. Got: %v, Want: %v", got, want)
+	}
+	merged := mergeExtents([]Extent{{50, 10}, {0, 20}, {10, 5}, {60, 100}}, 100)
+	if want := []Extent{{0, 20}, {50, 50}}; !reflect.DeepEqual(merged, want) {
+		t.Errorf("Unione errata. Got: %v, Want: %v", merged, want)
+	}
+}
+
+// TestBackupSkipFree verifica che un backup con SkipFree legga solo i
+// blocchi usati dai filesystem FAT32 ed ext4 e che l'immagine ottenuta
+// resti leggibile.
+func TestBackupSkipFree(t *testing.T) {
+	src := &memDest{data: newTestImage(t)}
+	used, err := deviceUsedExtents("image", src)
+	if err != nil {
+		t.Fatalf("deviceUsedExtents ha restituito un errore: %v", err)
+	}
+	var n int64
+	for _, e := range used {
+		n += e.Size
+	}
+	if n == 0 || n > int64(len(src.data))/4 {
+		t.Errorf("Troppi blocchi usati: %d di %d", n, len(src.data))
+	}
+	// I blocchi liberi vengono sporcati: non devono finire nel backup.
+	next := int64(0)
+	for _, e := range append(used, Extent{int64(len(src.data)), 0}) {
+		for i := next; i < e.Start; i++ {
+			src.data[i] = 0xaa
+		}
+		next = e.Start + e.Size
+	}
+	RegisterDestination("skipfreetest", func(string) (Destination, error) { return src, nil })
+
+	var out bytes.Buffer
+	if _, err := (&Flasher{SkipFree: true}).Backup(context.Background(), "skipfreetest://dev", &out); err != nil {
+		t.Fatalf("Backup ha restituito un errore: %v", err)
+	}
+	if out.Len() != len(src.data) || bytes.Contains(out.Bytes(), bytes.Repeat([]byte{0xaa}, 512)) {
+		t.Fatalf("Il backup contiene blocchi liberi (%d byte)", out.Len())
+	}
+	d, err := NewDisk("backup", &memDest{data: out.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Filesystem(1); err != nil {
+		t.Errorf("La partizione FAT32 non è leggibile: %v", err)
+	}
+	root, err := d.Filesystem(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := root.ReadFile("/etc/hostname"); err != nil || string(got) != "raspberrypi\n" {
+		t.Errorf("File letto errato. Got: %q, %v", got, err)
+	}
+}
+
+// TestUsedExtentsNTFS verifica la lettura di $Bitmap da un NTFS minimo:
+// 64 cluster da 4K, MFT al cluster 4 e $Bitmap al cluster 10.
+func TestUsedExtentsNTFS(t *testing.T) {
+	le := binary.LittleEndian
+	const cluster = 4096
+	data := make([]byte, 64*cluster+512)
+	copy(data[3:], "NTFS    ")
+	le.PutUint16(data[11:], 512)
+	data[13] = 8
+	le.PutUint64(data[40:], 64*8)
+	le.PutUint64(data[48:], 4)
+	data[64] = 0xf6 // record da 1024 byte
+	data[510], data[511] = 0x55, 0xaa
+
+	rec := data[4*cluster+6*1024:][:1024]
+	copy(rec, "FILE")
+	le.PutUint16(rec[4:], 48)
+	le.PutUint16(rec[6:], 3)
+	le.PutUint16(rec[20:], 56)
+	attr := rec[56:]
+	le.PutUint32(attr[0:], 0x80)
+	le.PutUint32(attr[4:], 72)
+	attr[8] = 1
+	le.PutUint16(attr[32:], 64)
+	le.PutUint64(attr[48:], 8)
+	copy(attr[64:], []byte{0x11, 0x01, 0x0a, 0x00})
+	le.PutUint32(rec[128:], 0xffffffff)
+	// Il numero di sequenza sostituisce gli ultimi due byte di ogni settore.
+	le.PutUint16(rec[48:], 7)
+	copy(rec[50:], rec[510:512])
+	copy(rec[52:], rec[1022:1024])
+	le.PutUint16(rec[510:], 7)
+	le.PutUint16(rec[1022:], 7)
+
+	bitmap := data[10*cluster:]
+	bitmap[0] = 0b00011111 // boot e MFT
+	bitmap[1] = 0b00000100 // $Bitmap
+	bitmap[7] = 0b10000000 // l'ultimo cluster
+
+	got, err := UsedExtents(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("UsedExtents ha restituito un errore: %v", err)
+	}
+	want := []Extent{{0, 5 * cluster}, {10 * cluster, cluster}, {63 * cluster, cluster + 512}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Intervalli errati. Got: %v, Want: %v", got, want)
+	}
+
+	if _, err := UsedExtents(bytes.NewReader(make([]byte, 4096)), 4096); err != ErrUnknownFilesystem {
+		t.Errorf("Un filesystem sconosciuto dovrebbe restituire ErrUnknownFilesystem. Got: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// verify reads back size bytes of dest, the device at location, starting
+// at offset and compares
+// their digest with the digest of the image that was written. phase,
+// which may be nil, places the verification within the whole job; the
+// verification stops with the cause of ctx once ctx is done.
+func (f *Flasher) verify(ctx context.Context, dest Destination, device string, offset, size int64, want []byte, phase *progressPhase) error {
+	// Evitiamo di rileggere i dati dalla cache invece che dal dispositivo.
+	if c, ok := dest.(interface{ DropCache() }); ok {
+		c.DropCache()
+	}
+
+	out := f.output()
+	fmt.Fprintln(out, "Verifying written data...")
+	hasher := f.newHash()
+	pw := f.newProgress("Verifying", size, phase)
+	n, err := io.Copy(io.MultiWriter(hasher, pw), withContext(ctx, io.NewSectionReader(dest, offset, size)))
+	fmt.Fprintln(out)
+	if err == nil {
+		pw.finish()
+	}
+	if errors.Is(err, ErrTimeout) {
+		return fmt.Errorf("%w: the verification did not complete in time (%d of %d bytes read back)", ErrTimeout, n, size)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("verification interrupted (%d of %d bytes read back): %w", n, size, err)
+	}
+	if err != nil {
+		return checkRemoved(device, fmt.Errorf("%w: error while reading back the device: %w", ErrVerifyFailed, err))
+	}
+	if n != size {
+		return fmt.Errorf("%w: read back %d bytes, expected %d", ErrVerifyFailed, n, size)
+	}
+	if got := hasher.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: device digest is %x, image digest is %x", ErrVerifyFailed, got, want)
+	}
+
+	fmt.Fprintln(out, f.Colors.Success+"Verification successful."+f.Colors.Reset)
+	return nil
+}
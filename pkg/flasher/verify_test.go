@@ -0,0 +1,84 @@
+package flasher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestCheckDigest verifica il confronto con il checksum atteso.
+func TestCheckDigest(t *testing.T) {
+	digest := sha256.Sum256([]byte("immagine"))
+
+	if err := checkDigest(digest[:], "not-the-right-one"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("checkDigest dovrebbe restituire ErrChecksumMismatch. Got: %v", err)
+	}
+	if err := checkDigest(digest[:], strings.ToUpper(hex.EncodeToString(digest[:]))); err != nil {
+		t.Errorf("checkDigest dovrebbe ignorare maiuscole/minuscole. Got: %v", err)
+	}
+}
+
+// TestVerifyDevice verifica la rilettura su un file che simula il dispositivo.
+func TestVerifyDevice(t *testing.T) {
+	data := []byte("dati scritti sul dispositivo, seguiti da spazio libero")
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, append(data, make([]byte, 1024)...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	dest, err := openDevice(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	f := &Flasher{}
+
+	if err := f.verify(context.Background(), dest, path, 0, int64(len(data)), digest[:], nil); err != nil {
+		t.Errorf("verify ha restituito un errore inaspettato: %v", err)
+	}
+
+	other := sha256.Sum256([]byte("un'altra immagine"))
+	if err := f.verify(context.Background(), dest, path, 0, int64(len(data)), other[:], nil); !errors.Is(err, ErrVerifyFailed) {
+		t.Errorf("verify dovrebbe restituire ErrVerifyFailed. Got: %v", err)
+	}
+
+	expired, cancel := context.WithTimeoutCause(context.Background(), -time.Second, ErrTimeout)
+	defer cancel()
+	if err := f.verify(expired, dest, path, 0, int64(len(data)), digest[:], nil); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Con la scadenza superata verify dovrebbe restituire ErrTimeout. Got: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := f.verify(cancelled, dest, path, 0, int64(len(data)), digest[:], nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Con il contesto annullato verify dovrebbe restituire context.Canceled. Got: %v", err)
+	}
+}
+
+// TestCheckRemoved verifica il riconoscimento di un dispositivo rimosso
+// durante la scrittura.
+func TestCheckRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ioErr := fmt.Errorf("%w: %w", ErrWrite, syscall.EIO)
+	if err := checkRemoved(path, ioErr); errors.Is(err, ErrDeviceRemoved) {
+		t.Errorf("Un dispositivo ancora presente non è stato rimosso. Got: %v", err)
+	}
+	if err := checkRemoved(path, fmt.Errorf("%w: %w", ErrWrite, syscall.ENODEV)); !errors.Is(err, ErrDeviceRemoved) || !errors.Is(err, ErrWrite) {
+		t.Errorf("ENODEV dovrebbe indicare un dispositivo rimosso. Got: %v", err)
+	}
+	os.Remove(path)
+	if err := checkRemoved(path, ioErr); !errors.Is(err, ErrDeviceRemoved) {
+		t.Errorf("Senza il nodo il dispositivo dovrebbe risultare rimosso. Got: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package flasher
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// WipeMode is how Wipe erases a device.
+type WipeMode string
+
+const (
+	// WipeZero overwrites the whole device with zeros.
+	WipeZero WipeMode = "zero"
+	// WipeRandom overwrites the whole device with random data, once for
+	// each of WipeOptions.Passes.
+	WipeRandom WipeMode = "random"
+	// WipeQuick only zeroes the partition tables, at both ends of the
+	// device, and the first and last MiB of each partition, where the
+	// filesystems, RAID and LVM keep their signatures: the data is still
+	// there, but nothing recognizes it.
+	WipeQuick WipeMode = "quick"
+	// WipeSecure asks the drive to erase itself: NVMe Sanitize, or Format
+	// NVM where it is not supported, for an NVMe namespace, ATA Security
+	// Erase Unit for a SATA drive. It is faster than an overwrite and, on
+	// SSDs, also reaches the spare and remapped blocks. Linux only.
+	WipeSecure WipeMode = "secure"
+	// WipeDiscard tells the device that all of its blocks are unused
+	// (BLKDISCARD, TRIM), which takes seconds on the flash media that
+	// support it; most then read back as zeros. Linux only.
+	WipeDiscard WipeMode = "discard"
+	// WipeSecureDiscard is WipeDiscard asking the device to also erase
+	// every copy of the data (BLKSECDISCARD), as eMMC and some SD cards
+	// support. Linux only.
+	WipeSecureDiscard WipeMode = "secdiscard"
+)
+
+// WipeModes lists the modes Wipe supports.
+func WipeModes() []WipeMode {
+	return []WipeMode{WipeZero, WipeRandom, WipeQuick, WipeSecure, WipeDiscard, WipeSecureDiscard}
+}
+
+// WipeOptions selects how Wipe erases a device.
+type WipeOptions struct {
+	Mode WipeMode
+	// Passes is the number of random passes of WipeRandom (1 if 0).
+	Passes int
+}
+
+// wipeSignatureSize is how much WipeQuick zeroes at each end of the
+// device and of its partitions.
+const wipeSignatureSize = 1 << 20
+
+// Wipe erases the device at device (or the Destination registered for its
+// scheme or extension) as opts.Mode asks, asking Confirm first, and syncs
+// it; with WipeSecure, device must be the path of the drive itself. With
+// Verify, the last pass of WipeZero and WipeRandom is read back;
+// Count and Seek are ignored, the whole device is always erased. Once ctx
+// is done the wipe stops between two blocks and the returned error wraps
+// the cause of ctx.
+func (f *Flasher) Wipe(ctx context.Context, device string, opts WipeOptions) (res Result, err error) {
+	res = Result{Verification: "skipped"}
+	ctx, span := f.startSpan(ctx, "wipe")
+	span.SetAttribute(AttrDevice, device)
+	defer func() {
+		span.SetAttribute(AttrBytes, res.Bytes)
+		span.End(err)
+		if err != nil {
+			f.publish(Event{Type: EventFailed, Device: device, Bytes: res.Bytes, Err: err})
+		} else {
+			f.publish(Event{Type: EventCompleted, Device: device, Bytes: res.Bytes})
+		}
+	}()
+
+	passes := max(opts.Passes, 1)
+	switch opts.Mode {
+	case WipeZero, WipeQuick, WipeDiscard, WipeSecureDiscard:
+		passes = 1
+	case WipeRandom:
+	case WipeSecure:
+		// Il comando apre il disco in esclusiva: non si apre qui.
+		if err := f.confirm(device); err != nil {
+			return res, err
+		}
+		start := time.Now()
+		err := f.secureErase(ctx, device)
+		res.Elapsed = time.Since(start)
+		return res, err
+	default:
+		return res, fmt.Errorf("unknown wipe mode %q", opts.Mode)
+	}
+	dest, err := OpenDestination(device)
+	if err != nil {
+		return res, err
+	}
+	defer dest.Close()
+	size := dest.Size()
+	if size <= 0 {
+		return res, fmt.Errorf("could not read the size of %s", device)
+	}
+	// Le partizioni si leggono prima di cancellare la tabella.
+	var regions []Extent
+	if opts.Mode == WipeQuick {
+		regions = signatureRegions(device, dest)
+	}
+	if err := f.confirm(device); err != nil {
+		return res, err
+	}
+
+	start := time.Now()
+	defer func() { res.Elapsed = time.Since(start) }()
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.Timeout, ErrTimeout)
+		defer cancel()
+	}
+	f.publish(Event{Type: EventWriteStarted, Device: device})
+	var wiped Result
+	switch opts.Mode {
+	case WipeQuick:
+		wiped.Bytes, err = wipeRegions(ctx, dest, regions)
+	case WipeDiscard, WipeSecureDiscard:
+		wiped.Bytes, err = f.discard(ctx, dest, size, opts.Mode == WipeSecureDiscard)
+	default:
+		wiped, err = f.overwrite(ctx, dest, size, opts.Mode, passes)
+	}
+	res.Bytes, res.Digest = wiped.Bytes, wiped.Digest
+	switch {
+	case errors.Is(err, ErrTimeout):
+		dest.Sync()
+		return res, fmt.Errorf("%w: the wipe did not complete within %s (%d bytes erased)", ErrTimeout, f.Timeout, res.Bytes)
+	case err != nil && ctx.Err() != nil:
+		fmt.Fprintln(f.output(), "Interrupted, syncing the data written so far...")
+		dest.Sync()
+		return res, fmt.Errorf("wipe interrupted (%d bytes erased): %w", res.Bytes, err)
+	case err != nil:
+		return res, checkRemoved(device, err)
+	}
+
+	fmt.Fprintln(f.output(), "Finalizing write (syncing)...")
+	if err := dest.Sync(); err != nil {
+		return res, checkRemoved(device, fmt.Errorf("%w: failed to sync data to device: %w", ErrWrite, err))
+	}
+	f.publish(Event{Type: EventSynced, Device: device, Bytes: res.Bytes})
+	f.logger().Info("device wiped", "mode", opts.Mode, "bytes", res.Bytes)
+
+	if f.Verify && (opts.Mode == WipeZero || opts.Mode == WipeRandom) {
+		f.publish(Event{Type: EventVerifyStarted, Device: device, Bytes: res.Bytes})
+		if err := f.verify(ctx, dest, device, 0, size, res.Digest, nil); err != nil {
+			res.Verification = "FAILED"
+			return res, err
+		}
+		res.Verification = "passed"
+	}
+	return res, nil
+}
+
+// confirm asks Confirm, if set, before device is changed.
+func (f *Flasher) confirm(device string) error {
+	f.publish(Event{Type: EventValidated, Device: device})
+	if f.Confirm != nil {
+		if err := f.Confirm(); err != nil {
+			return err
+		}
+	}
+	f.publish(Event{Type: EventConfirmed, Device: device})
+	return nil
+}
+
+// secureErase runs the erase command of WipeSecure that the drive at path
+// supports, the most thorough first. A sanitize reports its progress; the
+// other commands block until the drive is done.
+func (f *Flasher) secureErase(ctx context.Context, path string) error {
+	out, log := f.output(), f.logger()
+	f.publish(Event{Type: EventWriteStarted, Device: path})
+	if IsNVMeNamespace(path) {
+		info, err := NVMeIdentify(path)
+		if err != nil {
+			return err
+		}
+		var action NVMeSanitizeAction
+		switch {
+		case slices.Contains(info.Sanitize, "crypto-erase"):
+			action = NVMeSanitizeCryptoErase
+		case slices.Contains(info.Sanitize, "block-erase"):
+			action = NVMeSanitizeBlockErase
+		}
+		if action != 0 {
+			log.Info("sanitizing the NVMe controller", "device", path, "action", action)
+			fmt.Fprintln(out, "Sanitizing the NVMe controller, this erases all of its namespaces...")
+			err := NVMeSanitize(ctx, path, action, func(done float64) {
+				fmt.Fprintf(out, "\r%sSanitizing: %3.0f%%%s", f.Colors.Progress, 100*done, f.Colors.Reset)
+			})
+			fmt.Fprintln(out)
+			return err
+		}
+		erase := NVMeUserErase
+		if info.CryptoErase {
+			erase = NVMeCryptoErase
+		}
+		log.Info("formatting the NVMe namespace", "device", path, "secure_erase", erase)
+		fmt.Fprintln(out, "Formatting the NVMe namespace with a secure erase...")
+		return NVMeFormat(path, erase)
+	}
+
+	sec, err := ATASecurityInfo(path)
+	if err != nil {
+		return err
+	}
+	estimate := sec.EraseTime
+	if sec.EnhancedErase {
+		estimate = sec.EnhancedEraseTime
+	}
+	log.Info("erasing the drive with ATA Security Erase Unit", "device", path, "enhanced", sec.EnhancedErase, "estimate", estimate)
+	if estimate > 0 {
+		fmt.Fprintf(out, "Erasing the drive with ATA Security Erase Unit, about %s; do not unplug it...\n", estimate)
+	} else {
+		fmt.Fprintln(out, "Erasing the drive with ATA Security Erase Unit; do not unplug it...")
+	}
+	return ATASecureErase(path, sec.EnhancedErase)
+}
+
+// overwrite writes size bytes of zeros, or passes passes of random data,
+// to dest. The digest of the result is the one of the last pass.
+func (f *Flasher) overwrite(ctx context.Context, dest Destination, size int64, mode WipeMode, passes int) (Result, error) {
+	var res Result
+	start := time.Now()
+	for pass := range passes {
+		var data io.Reader = zeroReader{}
+		if mode == WipeRandom {
+			data = rand.Reader
+		}
+		var phase *progressPhase
+		if passes > 1 {
+			phase = &progressPhase{Index: pass + 1, Count: passes, Done: int64(pass) * size, Total: int64(passes) * size, Start: start}
+		}
+		copied, err := f.copy(ctx, wipeOp, io.LimitReader(data, size), destWriter{io.NewOffsetWriter(dest, 0), dest}, size, phase, &copyState{hasher: f.newHash()})
+		res.Bytes += copied.Bytes
+		res.Digest = copied.Digest
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// discardChunk is the size of each discard request of WipeDiscard, so
+// that the progress moves and an interrupt stops it between two requests.
+const discardChunk = 1 << 30
+
+// discard discards the size bytes of dest, a block device, and returns
+// the bytes discarded.
+func (f *Flasher) discard(ctx context.Context, dest Destination, size int64, secure bool) (int64, error) {
+	file, ok := dest.(interface{ Fd() uintptr })
+	if !ok {
+		return 0, fmt.Errorf("%w: only block devices can be discarded", errors.ErrUnsupported)
+	}
+	out := f.output()
+	fmt.Fprintln(out, "Starting wipe operation...")
+	pw := f.newProgress("Discarding", size, nil)
+	var n int64
+	for n < size {
+		if err := context.Cause(ctx); err != nil {
+			fmt.Fprintln(out)
+			return n, err
+		}
+		chunk := min(discardChunk, size-n)
+		if err := discardRange(file.Fd(), n, chunk, secure); err != nil {
+			fmt.Fprintln(out)
+			if n == 0 && errors.Is(err, errors.ErrUnsupported) {
+				return 0, fmt.Errorf("the device does not support discard, wipe it with zeros instead: %w", err)
+			}
+			return n, fmt.Errorf("%w: discard failed at offset %d: %w", ErrWrite, n, err)
+		}
+		n += chunk
+		pw.add(chunk)
+	}
+	pw.finish()
+	fmt.Fprintln(out)
+	// Le pagine in cache conservano ancora i dati scartati.
+	if c, ok := dest.(interface{ DropCache() }); ok {
+		c.DropCache()
+	}
+	return n, nil
+}
+
+// signatureRegions returns the regions of dest, the device at location,
+// that WipeQuick zeroes.
+func signatureRegions(location string, dest Destination) []Extent {
+	size := dest.Size()
+	regions := []Extent{{0, wipeSignatureSize}, {max(size-wipeSignatureSize, 0), wipeSignatureSize}}
+	if disk, err := NewDisk(location, dest); err == nil {
+		parts, _ := disk.Partitions()
+		for _, p := range parts {
+			n := min(p.Size, wipeSignatureSize)
+			regions = append(regions, Extent{p.Start, n}, Extent{p.Start + p.Size - n, n})
+		}
+	}
+	return mergeExtents(regions, size)
+}
+
+// wipeRegions zeroes regions of dest and returns the bytes written.
+func wipeRegions(ctx context.Context, dest Destination, regions []Extent) (int64, error) {
+	zeros := make([]byte, wipeSignatureSize)
+	var n int64
+	for _, r := range regions {
+		for off := r.Start; off < r.Start+r.Size; off += int64(len(zeros)) {
+			if err := context.Cause(ctx); err != nil {
+				return n, err
+			}
+			w, err := dest.WriteAt(zeros[:min(int64(len(zeros)), r.Start+r.Size-off)], off)
+			n += int64(w)
+			if err != nil {
+				return n, fmt.Errorf("%w: %w", ErrWrite, err)
+			}
+		}
+	}
+	return n, nil
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
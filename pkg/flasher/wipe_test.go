@@ -0,0 +1,74 @@
+package flasher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestWipe verifica la cancellazione completa con zeri e con dati casuali.
+func TestWipe(t *testing.T) {
+	dest := &memDest{data: bytes.Repeat([]byte{0xaa}, 1000)}
+	RegisterDestination("wipetest", func(string) (Destination, error) { return dest, nil })
+	f := &Flasher{BlockSize: 64, Verify: true}
+	res, err := f.Wipe(context.Background(), "wipetest://dev", WipeOptions{Mode: WipeZero})
+	if err != nil {
+		t.Fatalf("Wipe ha restituito un errore: %v", err)
+	}
+	if !bytes.Equal(dest.data, make([]byte, 1000)) || res.Bytes != 1000 || res.Verification != "passed" || !dest.synced {
+		t.Errorf("Cancellazione errata. Got: %+v", res)
+	}
+
+	res, err = f.Wipe(context.Background(), "wipetest://dev", WipeOptions{Mode: WipeRandom, Passes: 2})
+	if err != nil {
+		t.Fatalf("Wipe ha restituito un errore: %v", err)
+	}
+	if bytes.Equal(dest.data, make([]byte, 1000)) || res.Bytes != 2000 || res.Verification != "passed" {
+		t.Errorf("Cancellazione casuale errata. Got: %+v", res)
+	}
+
+	if _, err := f.Wipe(context.Background(), "wipetest://dev", WipeOptions{Mode: "shred"}); err == nil {
+		t.Error("Una modalità sconosciuta dovrebbe essere un errore")
+	}
+	if _, err := f.Wipe(context.Background(), "wipetest://dev", WipeOptions{Mode: WipeDiscard}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Solo i dispositivi a blocchi si possono scartare. Got: %v", err)
+	}
+	f.Confirm = func() error { return ErrUserCancelled }
+	dest.data[0] = 1
+	if _, err := f.Wipe(context.Background(), "wipetest://dev", WipeOptions{Mode: WipeZero}); err != ErrUserCancelled || dest.data[0] != 1 {
+		t.Errorf("Senza conferma il dispositivo non dovrebbe cambiare. Got: %v", err)
+	}
+}
+
+// TestWipeQuick verifica che la cancellazione rapida renda irriconoscibili
+// tabella delle partizioni e filesystem, senza scrivere tutto il disco.
+func TestWipeQuick(t *testing.T) {
+	dest := &memDest{data: newTestImage(t)}
+	RegisterDestination("wipequicktest", func(string) (Destination, error) { return dest, nil })
+	d, err := NewDisk("image", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := d.Partitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&Flasher{}).Wipe(context.Background(), "wipequicktest://dev", WipeOptions{Mode: WipeQuick})
+	if err != nil {
+		t.Fatalf("Wipe ha restituito un errore: %v", err)
+	}
+	if res.Bytes == 0 || res.Bytes > 6*wipeSignatureSize {
+		t.Errorf("Byte cancellati errati. Got: %d", res.Bytes)
+	}
+	if d, err := NewDisk("image", dest); err == nil {
+		if _, err := d.Partitions(); err == nil {
+			t.Error("La tabella delle partizioni dovrebbe essere cancellata")
+		}
+	}
+	for _, p := range parts {
+		if _, err := UsedExtents(bytes.NewReader(dest.data[p.Start:p.Start+p.Size]), p.Size); err != ErrUnknownFilesystem {
+			t.Errorf("Il filesystem della partizione %d dovrebbe essere irriconoscibile. Got: %v", p.Number, err)
+		}
+	}
+}